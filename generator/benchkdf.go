@@ -0,0 +1,201 @@
+package main
+
+// Measures how long LUKS key derivation takes on this machine and whether its memory cost fits into RAM.
+// Booster init refuses to try keyslots whose argon2 memory cost exceeds the available memory (unless booster.kdf_low_memory
+// is specified), this command helps to find such keyslots before reboot.
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// keyslotKDF is a key derivation function description as it is stored in LUKS2 keyslot metadata
+type keyslotKDF struct {
+	Slot int    `json:"-"`
+	Type string `json:"type"`
+
+	// pbkdf2 fields
+	Hash       string `json:"hash"`
+	Iterations int    `json:"iterations"`
+
+	// argon2 fields
+	Time   int `json:"time"`
+	Memory int `json:"memory"` // in KiB
+	Cpus   int `json:"cpus"`
+}
+
+func (k keyslotKDF) String() string {
+	if k.Type == "pbkdf2" {
+		return fmt.Sprintf("pbkdf2-%s iterations=%d", k.Hash, k.Iterations)
+	}
+	return fmt.Sprintf("%s time=%d memory=%dKiB cpus=%d", k.Type, k.Time, k.Memory, k.Cpus)
+}
+
+// parseKeyslotKDFs parses KDF parameters from 'cryptsetup luksDump --dump-json-metadata' output, keyslots are sorted by number
+func parseKeyslotKDFs(data []byte) ([]keyslotKDF, error) {
+	var metadata struct {
+		Keyslots map[string]struct {
+			KDF keyslotKDF `json:"kdf"`
+		} `json:"keyslots"`
+	}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, err
+	}
+
+	var kdfs []keyslotKDF
+	for id, ks := range metadata.Keyslots {
+		slot, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keyslot id %s", id)
+		}
+		kdf := ks.KDF
+		kdf.Slot = slot
+		kdfs = append(kdfs, kdf)
+	}
+	sort.Slice(kdfs, func(i, j int) bool { return kdfs[i].Slot < kdfs[j].Slot })
+	return kdfs, nil
+}
+
+func luksKeyslotKDFs(device string) ([]keyslotKDF, error) {
+	// fail early if the partition is not LUKS2
+	if _, err := luksSlots(device); err != nil {
+		return nil, err
+	}
+
+	out, err := exec.Command("cryptsetup", "luksDump", "--dump-json-metadata", device).Output()
+	if err != nil {
+		return nil, fmt.Errorf("cryptsetup luksDump: %v", err)
+	}
+	return parseKeyslotKDFs(out)
+}
+
+// benchmarkKDF derives a key with the given KDF parameters and returns the time it took
+func benchmarkKDF(kdf keyslotKDF) (time.Duration, error) {
+	passphrase := []byte("booster benchmark")
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	switch kdf.Type {
+	case "pbkdf2":
+		var h func() hash.Hash
+		switch kdf.Hash {
+		case "sha1":
+			h = sha1.New
+		case "sha256":
+			h = sha256.New
+		case "sha512":
+			h = sha512.New
+		default:
+			return 0, fmt.Errorf("unsupported pbkdf2 hash %s", kdf.Hash)
+		}
+		if kdf.Iterations < 1 {
+			return 0, fmt.Errorf("invalid pbkdf2 iterations %d", kdf.Iterations)
+		}
+		pbkdf2.Key(passphrase, salt, kdf.Iterations, 32, h)
+	case "argon2i", "argon2id":
+		if kdf.Time < 1 || kdf.Cpus < 1 || kdf.Cpus > 255 || kdf.Memory < 8*kdf.Cpus {
+			return 0, fmt.Errorf("invalid %s parameters", kdf.Type)
+		}
+		if kdf.Type == "argon2i" {
+			argon2.Key(passphrase, salt, uint32(kdf.Time), uint32(kdf.Memory), uint8(kdf.Cpus), 32)
+		} else {
+			argon2.IDKey(passphrase, salt, uint32(kdf.Time), uint32(kdf.Memory), uint8(kdf.Cpus), 32)
+		}
+	default:
+		return 0, fmt.Errorf("unsupported kdf type %s", kdf.Type)
+	}
+	return time.Since(start), nil
+}
+
+// memTotal returns the amount of RAM in KiB
+func memTotal() (int, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			return strconv.Atoi(fields[1])
+		}
+	}
+	return 0, fmt.Errorf("MemTotal is not found in /proc/meminfo")
+}
+
+func runBenchmarkKDF() error {
+	args := opts.BenchmarkKDFCommand
+
+	var kdfs []keyslotKDF
+	if args.Args.LuksDevice != "" {
+		var err error
+		kdfs, err = luksKeyslotKDFs(args.Args.LuksDevice)
+		if err != nil {
+			return err
+		}
+		if len(kdfs) == 0 {
+			return fmt.Errorf("%s: no keyslots found", args.Args.LuksDevice)
+		}
+	} else {
+		kdfs = []keyslotKDF{{
+			Slot:       -1,
+			Type:       args.Type,
+			Hash:       args.Hash,
+			Iterations: args.Iterations,
+			Time:       args.Time,
+			Memory:     args.Memory,
+			Cpus:       args.Parallel,
+		}}
+	}
+
+	total, err := memTotal()
+	if err != nil {
+		return err
+	}
+
+	for _, kdf := range kdfs {
+		name := kdf.String()
+		if kdf.Slot >= 0 {
+			name = fmt.Sprintf("keyslot %d: %s", kdf.Slot, name)
+		}
+
+		if kdf.Type != "pbkdf2" && kdf.Memory > total {
+			fmt.Printf("%s: needs more memory than the machine has (%d KiB), booster will not be able to unlock it.\n", name, total)
+			if kdf.Slot >= 0 {
+				fmt.Printf("  Re-enroll it with a lower memory cost, e.g. 'cryptsetup luksConvertKey --key-slot %d --pbkdf-memory %d %s'\n", kdf.Slot, total/2, args.Args.LuksDevice)
+			}
+			continue
+		}
+
+		duration, err := benchmarkKDF(kdf)
+		if err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+			continue
+		}
+		fmt.Printf("%s: %v\n", name, duration.Round(time.Millisecond))
+		if kdf.Type != "pbkdf2" && kdf.Memory > total/2 {
+			fmt.Printf("  The keyslot uses %d%% of RAM, it might not fit into memory available at boot time\n", kdf.Memory*100/total)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKeyslotKDFs(t *testing.T) {
+	kdfs, err := parseKeyslotKDFs([]byte(`{"keyslots":{"2":{"type":"luks2","kdf":{"type":"pbkdf2","hash":"sha256","iterations":1000,"salt":"c2FsdA=="}},"0":{"type":"luks2","kdf":{"type":"argon2id","time":4,"memory":1048576,"cpus":4,"salt":"c2FsdA=="}}},"tokens":{}}`))
+	require.NoError(t, err)
+	require.Equal(t, []keyslotKDF{
+		{Slot: 0, Type: "argon2id", Time: 4, Memory: 1048576, Cpus: 4},
+		{Slot: 2, Type: "pbkdf2", Hash: "sha256", Iterations: 1000},
+	}, kdfs)
+
+	_, err = parseKeyslotKDFs([]byte(`{"keyslots":{"foo":{}}}`))
+	require.Error(t, err)
+}
+
+func TestBenchmarkKDF(t *testing.T) {
+	_, err := benchmarkKDF(keyslotKDF{Type: "argon2id", Time: 1, Memory: 64, Cpus: 1})
+	require.NoError(t, err)
+	_, err = benchmarkKDF(keyslotKDF{Type: "pbkdf2", Hash: "sha256", Iterations: 1000})
+	require.NoError(t, err)
+
+	_, err = benchmarkKDF(keyslotKDF{Type: "argon2id", Time: 1, Memory: 64})
+	require.Error(t, err)
+	_, err = benchmarkKDF(keyslotKDF{Type: "pbkdf2", Hash: "whirlpool", Iterations: 1000})
+	require.Error(t, err)
+}
@@ -23,22 +23,64 @@ type UserConfig struct {
 		IP         string `yaml:",omitempty"`            // e.g. 10.0.2.15/24
 		Gateway    string `yaml:",omitempty"`            // e.g. 10.0.2.255
 		DNSServers string `yaml:"dns_servers,omitempty"` // comma-separated list of ips, e.g. 10.0.1.1,8.8.8.8
+
+		IPv6 string `yaml:"ipv6,omitempty"` // IPv6 configuration method, either auto6 or dhcp6
+
+		Vlans   string   `yaml:",omitempty"` // comma-separated list of 802.1Q interfaces, e.g. vlan10:eth0
+		Bonds   []string `yaml:",omitempty"` // bonding interfaces, e.g. bond0:eth0,eth1:mode=802.3ad
+		Bridges []string `yaml:",omitempty"` // bridge interfaces, e.g. br0:eth0,eth1
+
+		Handoff bool `yaml:",omitempty"` // keep the network up and pass its configuration to the booted system
 	}
-	Universal            bool   `yaml:",omitempty"`
-	Modules              string `yaml:",omitempty"`                   // comma separated list of extra modules to add to initramfs
-	ModulesForceLoad     string `yaml:"modules_force_load,omitempty"` // comma separated list of extra modules to load at the boot time
-	AppendAllModAliases  bool   `yaml:"append_all_modaliases,omitempty"`
-	Compression          string `yaml:",omitempty"`              // output file compression
-	MountTimeout         string `yaml:"mount_timeout,omitempty"` // timeout for waiting for the rootfs mounted
-	ExtraFiles           string `yaml:"extra_files,omitempty"`   // comma-separated list of files to add to image
-	StripBinaries        bool   `yaml:"strip,omitempty"`         // if strip symbols from the binaries, shared libraries and kernel modules
-	EnableVirtualConsole bool   `yaml:"vconsole,omitempty"`      // configure virtual console at boot time using config from https://www.freedesktop.org/software/systemd/man/vconsole.conf.html
-	EnableLVM            bool   `yaml:"enable_lvm"`
-	EnableMdraid         bool   `yaml:"enable_mdraid"`
-	MdraidConfigPath     string `yaml:"mdraid_config_path"`
-	EnableZfs            bool   `yaml:"enable_zfs"`
-	ZfsImportParams      string `yaml:"zfs_import_params"`
-	ZfsCachePath         string `yaml:"zfs_cache_path"`
+	Universal           bool   `yaml:",omitempty"`
+	Modules             string `yaml:",omitempty"`                   // comma separated list of extra modules to add to initramfs
+	ModulesForceLoad    string `yaml:"modules_force_load,omitempty"` // comma separated list of extra modules to load at the boot time
+	AppendAllModAliases bool   `yaml:"append_all_modaliases,omitempty"`
+	Compression         string `yaml:",omitempty"`                      // output file compression
+	MountTimeout        string `yaml:"mount_timeout,omitempty"`         // timeout for waiting for the rootfs mounted
+	ExtraFiles          string `yaml:"extra_files,omitempty"`           // comma-separated list of files to add to image
+	RescueTools         string `yaml:"rescue_tools,omitempty"`          // 'true' for busybox or comma-separated list of binaries available in the emergency shell
+	StripBinaries       bool   `yaml:"strip,omitempty"`                 // if strip symbols from the binaries, shared libraries and kernel modules
+	EnablePlymouth      bool   `yaml:"plymouth,omitempty"`              // add plymouth splash screen, it is shown if 'splash' boot parameter is set
+	GraphicalPrompt     bool   `yaml:"graphical_prompt,omitempty"`      // ask passwords with the built-in graphical prompt instead of the text console
+	GraphicalPromptFont string `yaml:"graphical_prompt_font,omitempty"` // console font name or path to PSF font used by the graphical prompt
+	EnableUswsusp       bool   `yaml:"uswsusp,omitempty"`               // add uswsusp resume tool to resume images written by s2disk
+	EnableMicrocode     bool   `yaml:"microcode,omitempty"`             // prepend uncompressed archive with CPU microcode updates loaded early by the kernel
+	EnableLVM           bool   `yaml:"enable_lvm"`
+	LvmNative           bool   `yaml:"lvm_native,omitempty"` // activate LVM volumes natively without adding lvm tools to the image
+	EnableVerity        bool   `yaml:"enable_verity"`
+	EnableOverlay       bool   `yaml:"enable_overlay,omitempty"` // add overlayfs module for booster.overlay= root
+	EnableLive          bool   `yaml:"enable_live,omitempty"`    // add modules needed to boot live media with root=live:
+	EnableIntegrity     bool   `yaml:"enable_integrity"`
+	EnableMdraid        bool   `yaml:"enable_mdraid"`
+	MdraidNative        bool   `yaml:"mdraid_native,omitempty"` // assemble md arrays natively without adding mdadm to the image
+	MdraidConfigPath    string `yaml:"mdraid_config_path"`
+	EnableZfs           bool   `yaml:"enable_zfs"`
+	ZfsImportParams     string `yaml:"zfs_import_params"`
+	ZfsCachePath        string `yaml:"zfs_cache_path"`
+	EnableWifi          bool   `yaml:"enable_wifi"`
+	EnableFsck          bool   `yaml:"enable_fsck,omitempty"`           // check the root filesystem before mounting it
+	HooksIgnoreFailures bool   `yaml:"hooks_ignore_failures,omitempty"` // continue boot if a post-unlock hook fails
+	LuksKeyfiles        []struct {
+		Volume string `yaml:"volume"` // LUKS volume UUID
+		Device string `yaml:"device,omitempty"`
+		Path   string `yaml:"path"`
+		Offset int64  `yaml:"offset,omitempty"`
+		Size   int64  `yaml:"size,omitempty"`
+	} `yaml:"luks_keyfiles,omitempty"` // keyfiles that unlock LUKS volumes, located in the image or at a removable device
+	DisablePassphraseCache bool `yaml:"disable_passphrase_cache,omitempty"` // do not try the passphrase of the previous volume
+	EnableShell            bool `yaml:"enable_shell,omitempty"`             // allow rd.break= breakpoints and the built-in emergency shell
+	SSH                    *struct {
+		Port           int    `yaml:",omitempty"`
+		AuthorizedKeys string `yaml:"authorized_keys,omitempty"` // keys allowed to connect, default is /etc/booster/authorized_keys
+		HostKey        string `yaml:"host_key,omitempty"`        // generated if does not exist, default is /etc/booster/ssh_host_ed25519_key
+	} `yaml:"ssh,omitempty"` // SSH server that allows to unlock volumes remotely
+	WireGuard      *wireguardUserConfig  `yaml:"wireguard,omitempty"`   // tunnel brought up at boot, e.g. to reach the SSH server behind NAT
+	VirtualConsole *vconsoleUserConfig   `yaml:"vconsole,omitempty"`    // configure virtual console at boot time using config from https://www.freedesktop.org/software/systemd/man/vconsole.conf.html, keymap and font set here take precedence
+	Kdump          *kdumpUserConfig      `yaml:"kdump,omitempty"`       // crash capture settings used by 'booster build --kdump'
+	UKI            *ukiUserConfig        `yaml:"uki,omitempty"`         // unified kernel image settings used by 'booster build --uki'
+	SecureBoot     *secureBootUserConfig `yaml:"secure_boot,omitempty"` // keys that sign the generated EFI binaries
+	Measure        *measureUserConfig    `yaml:"measure,omitempty"`     // measure the config, command line and keys to a TPM PCR at boot
 }
 
 // read user config from the specified file. If file parameter is empty string then "empty" configuration is considered
@@ -60,6 +102,45 @@ func readGeneratorConfig(file string) (*generatorConfig, error) {
 			if n.Dhcp && (n.IP != "" || n.Gateway != "") {
 				return nil, fmt.Errorf("config: option network.(ip|gateway) cannot be used together with network.dhcp")
 			}
+			if n.IPv6 != "" && n.IPv6 != "auto6" && n.IPv6 != "dhcp6" {
+				return nil, fmt.Errorf("config: unsupported network.ipv6 method '%s', expected auto6 or dhcp6", n.IPv6)
+			}
+			if n.Vlans != "" {
+				for _, v := range strings.Split(n.Vlans, ",") {
+					if name, parent, ok := strings.Cut(v, ":"); !ok || name == "" || parent == "" {
+						return nil, fmt.Errorf("config: invalid network.vlans entry '%s', expected <name>:<parent>", v)
+					}
+				}
+			}
+			for _, b := range n.Bonds {
+				if name, slaves, _ := strings.Cut(b, ":"); name == "" || slaves == "" {
+					return nil, fmt.Errorf("config: invalid network.bonds entry '%s', expected <name>:<slaves>[:<options>[:<mtu>]]", b)
+				}
+			}
+			for _, b := range n.Bridges {
+				if name, ports, _ := strings.Cut(b, ":"); name == "" || ports == "" {
+					return nil, fmt.Errorf("config: invalid network.bridges entry '%s', expected <name>:<ports>", b)
+				}
+			}
+		}
+		if s := u.SSH; s != nil {
+			if u.Network == nil {
+				return nil, fmt.Errorf("config: ssh requires network to be configured")
+			}
+			if s.Port < 0 || s.Port > 65535 {
+				return nil, fmt.Errorf("config: invalid ssh.port %d", s.Port)
+			}
+		}
+		if u.WireGuard != nil && u.Network == nil {
+			return nil, fmt.Errorf("config: wireguard requires network to be configured")
+		}
+		for _, k := range u.LuksKeyfiles {
+			if k.Volume == "" || !strings.HasPrefix(k.Path, "/") {
+				return nil, fmt.Errorf("config: luks_keyfiles entries require a volume UUID and an absolute keyfile path")
+			}
+			if k.Offset < 0 || k.Size < 0 {
+				return nil, fmt.Errorf("config: luks_keyfiles offset and size cannot be negative")
+			}
 		}
 	}
 
@@ -75,6 +156,13 @@ func readGeneratorConfig(file string) (*generatorConfig, error) {
 				n.IP, n.Gateway, n.DNSServers,
 			}
 		}
+		conf.networkIPv6 = n.IPv6
+		if n.Vlans != "" {
+			conf.networkVlans = strings.Split(n.Vlans, ",")
+		}
+		conf.networkBonds = n.Bonds
+		conf.networkBridges = n.Bridges
+		conf.networkHandoff = n.Handoff
 
 		if u.Network.Interfaces != "" {
 			// get MAC addresses for the specified interface names
@@ -107,6 +195,7 @@ func readGeneratorConfig(file string) (*generatorConfig, error) {
 	if u.ExtraFiles != "" {
 		conf.extraFiles = strings.Split(u.ExtraFiles, ",")
 	}
+	conf.rescueTools = parseRescueTools(u.RescueTools)
 	if u.MountTimeout != "" {
 		timeout, err := time.ParseDuration(u.MountTimeout)
 		if err != nil {
@@ -146,15 +235,86 @@ func readGeneratorConfig(file string) (*generatorConfig, error) {
 	conf.appendAllModAliases = u.AppendAllModAliases
 	conf.stripBinaries = u.StripBinaries || opts.BuildCommand.Strip
 	conf.enableLVM = u.EnableLVM
+	conf.lvmNative = u.LvmNative
+	conf.enableVerity = u.EnableVerity
+	conf.enableOverlay = u.EnableOverlay
+	conf.enableLive = u.EnableLive
+	conf.enableIntegrity = u.EnableIntegrity
 	conf.enableMdraid = u.EnableMdraid
+	conf.mdraidNative = u.MdraidNative
 	conf.mdraidConfigPath = u.MdraidConfigPath
 	conf.enableZfs = u.EnableZfs
 	conf.zfsImportParams = u.ZfsImportParams
 	conf.zfsCachePath = u.ZfsCachePath
-	conf.enableVirtualConsole = u.EnableVirtualConsole
-	if conf.enableVirtualConsole {
+	conf.enableWifi = u.EnableWifi
+	conf.enableFsck = u.EnableFsck
+	conf.hooksDir = "/etc/booster/hooks.d"
+	conf.hooksIgnoreFailures = u.HooksIgnoreFailures
+	conf.disablePassphraseCache = u.DisablePassphraseCache
+	conf.enableShell = u.EnableShell
+	for _, k := range u.LuksKeyfiles {
+		conf.luksKeyfiles = append(conf.luksKeyfiles, InitLuksKeyfile{Volume: k.Volume, Device: k.Device, Path: k.Path, Offset: k.Offset, Size: k.Size})
+	}
+	if s := u.SSH; s != nil {
+		conf.enableSSH = true
+		conf.sshPort = s.Port
+		conf.sshAuthorizedKeysPath = s.AuthorizedKeys
+		if conf.sshAuthorizedKeysPath == "" {
+			conf.sshAuthorizedKeysPath = defaultSSHAuthorizedKeysPath
+		}
+		conf.sshHostKeyPath = s.HostKey
+		if conf.sshHostKeyPath == "" {
+			conf.sshHostKeyPath = defaultSSHHostKeyPath
+		}
+	}
+	if u.WireGuard != nil {
+		if err := readWireGuardConfig(u.WireGuard, &conf); err != nil {
+			return nil, fmt.Errorf("config: wireguard: %v", err)
+		}
+	}
+	conf.enablePlymouth = u.EnablePlymouth
+	conf.enableUswsusp = u.EnableUswsusp
+	conf.enableMicrocode = u.EnableMicrocode
+	if u.GraphicalPrompt {
+		conf.graphicalPromptFont = u.GraphicalPromptFont
+		if conf.graphicalPromptFont == "" {
+			conf.graphicalPromptFont = defaultGraphicalPromptFont
+		}
+	}
+	if opts.BuildCommand.Kdump {
+		conf.kdump = u.Kdump.initConfig()
+		// the crash kernel runs with a small memory reservation, leave out the splash screen and other extras
+		conf.enablePlymouth = false
+		conf.graphicalPromptFont = ""
+		conf.enableUswsusp = false
+	}
+	if m := u.Measure; m != nil {
+		pcr, err := m.pcr()
+		if err != nil {
+			return nil, fmt.Errorf("config: measure: %v", err)
+		}
+		conf.measurePCR = pcr
+	}
+	if s := u.SecureBoot; s != nil {
+		if s.Key == "" || s.Cert == "" {
+			return nil, fmt.Errorf("config: secure_boot requires key and cert")
+		}
+		conf.secureBoot = s
+	}
+	if opts.BuildCommand.UKI {
+		conf.uki = u.UKI
+		if conf.uki == nil {
+			conf.uki = &ukiUserConfig{}
+		}
+		if conf.uki.PCRPrivateKey != "" && conf.uki.PCRSignature != "" {
+			return nil, fmt.Errorf("config: uki.pcr_signature and uki.pcr_private_key are mutually exclusive")
+		}
+	}
+	if v := u.VirtualConsole; v != nil && v.Enabled {
+		conf.enableVirtualConsole = true
 		conf.vconsolePath = "/etc/vconsole.conf"
 		conf.localePath = "/etc/locale.conf"
+		conf.vconsoleOverrides = v.properties()
 	}
 
 	return &conf, nil
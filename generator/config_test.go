@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -13,3 +15,103 @@ func TestReadEmptyConfig(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, "zstd", c.compression)
 }
+
+func TestReadConfigLuksKeyfiles(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "booster.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(`luks_keyfiles:
+  - volume: 2a9f1e2c-4ba5-4c1c-8b66-3d1e1c7f6d2a
+    device: LABEL=keys
+    path: /root.key
+    offset: 512
+    size: 4096
+`), 0o644))
+	c, err := readGeneratorConfig(file)
+	require.NoError(t, err)
+	require.Equal(t, []InitLuksKeyfile{{Volume: "2a9f1e2c-4ba5-4c1c-8b66-3d1e1c7f6d2a", Device: "LABEL=keys", Path: "/root.key", Offset: 512, Size: 4096}}, c.luksKeyfiles)
+
+	require.NoError(t, os.WriteFile(file, []byte("luks_keyfiles:\n  - volume: 2a9f1e2c-4ba5-4c1c-8b66-3d1e1c7f6d2a\n    path: root.key\n"), 0o644))
+	_, err = readGeneratorConfig(file)
+	require.Error(t, err)
+}
+
+func TestReadConfigSSH(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "booster.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("network:\n  dhcp: true\nssh:\n  port: 2222\n"), 0o644))
+	c, err := readGeneratorConfig(file)
+	require.NoError(t, err)
+	require.True(t, c.enableSSH)
+	require.Equal(t, 2222, c.sshPort)
+	require.Equal(t, defaultSSHAuthorizedKeysPath, c.sshAuthorizedKeysPath)
+	require.Equal(t, defaultSSHHostKeyPath, c.sshHostKeyPath)
+
+	require.NoError(t, os.WriteFile(file, []byte("ssh:\n  port: 2222\n"), 0o644))
+	_, err = readGeneratorConfig(file)
+	require.EqualError(t, err, "config: ssh requires network to be configured")
+}
+
+func TestReadConfigRescueTools(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "booster.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("rescue_tools: true\n"), 0o644))
+	c, err := readGeneratorConfig(file)
+	require.NoError(t, err)
+	require.Equal(t, []string{"busybox"}, c.rescueTools)
+
+	require.NoError(t, os.WriteFile(file, []byte("rescue_tools: strace,/opt/bin/nvme\n"), 0o644))
+	c, err = readGeneratorConfig(file)
+	require.NoError(t, err)
+	require.Equal(t, []string{"strace", "/opt/bin/nvme"}, c.rescueTools)
+
+	require.NoError(t, os.WriteFile(file, []byte("rescue_tools: false\n"), 0o644))
+	c, err = readGeneratorConfig(file)
+	require.NoError(t, err)
+	require.Empty(t, c.rescueTools)
+}
+
+func TestReadConfigGraphicalPrompt(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "booster.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("graphical_prompt: true\n"), 0o644))
+	c, err := readGeneratorConfig(file)
+	require.NoError(t, err)
+	require.Equal(t, "default8x16", c.graphicalPromptFont)
+
+	require.NoError(t, os.WriteFile(file, []byte("graphical_prompt: true\ngraphical_prompt_font: ter-v32n\n"), 0o644))
+	c, err = readGeneratorConfig(file)
+	require.NoError(t, err)
+	require.Equal(t, "ter-v32n", c.graphicalPromptFont)
+
+	require.NoError(t, os.WriteFile(file, []byte("graphical_prompt_font: ter-v32n\n"), 0o644))
+	c, err = readGeneratorConfig(file)
+	require.NoError(t, err)
+	require.Empty(t, c.graphicalPromptFont)
+}
+
+func TestReadConfigVirtualConsole(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "booster.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("vconsole: true\n"), 0o644))
+	c, err := readGeneratorConfig(file)
+	require.NoError(t, err)
+	require.True(t, c.enableVirtualConsole)
+	require.Equal(t, "/etc/vconsole.conf", c.vconsolePath)
+	require.Empty(t, c.vconsoleOverrides)
+
+	require.NoError(t, os.WriteFile(file, []byte("vconsole:\n  keymap: de-latin1\n  font: eurlatgr\n"), 0o644))
+	c, err = readGeneratorConfig(file)
+	require.NoError(t, err)
+	require.True(t, c.enableVirtualConsole)
+	require.Equal(t, map[string]string{"KEYMAP": "de-latin1", "FONT": "eurlatgr"}, c.vconsoleOverrides)
+
+	require.NoError(t, os.WriteFile(file, []byte("vconsole: false\n"), 0o644))
+	c, err = readGeneratorConfig(file)
+	require.NoError(t, err)
+	require.False(t, c.enableVirtualConsole)
+}
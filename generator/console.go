@@ -11,21 +11,70 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+
+	"gopkg.in/yaml.v3"
 )
 
 // path to console fonts, adjust it to your distro (e.g. Fedora uses /usr/lib/kbd/consolefonts path for it)
 var consolefontsDir = "/usr/share/kbd/consolefonts/"
 
-func (img *Image) enableVirtualConsole(vConsolePath, localePath string) (*VirtualConsole, error) {
+// vconsoleUserConfig is 'vconsole' config option. It is either a flag that enables console configuration from
+// /etc/vconsole.conf or a map with the keymap and font that take precedence over the values from the file.
+type vconsoleUserConfig struct {
+	Enabled      bool   `yaml:"-"`
+	Keymap       string `yaml:"keymap,omitempty"`
+	KeymapToggle string `yaml:"keymap_toggle,omitempty"`
+	Font         string `yaml:"font,omitempty"`
+	FontMap      string `yaml:"font_map,omitempty"`
+	FontUnimap   string `yaml:"font_unimap,omitempty"`
+}
+
+func (v *vconsoleUserConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&v.Enabled)
+	}
+	type plain vconsoleUserConfig
+	if err := value.Decode((*plain)(v)); err != nil {
+		return err
+	}
+	v.Enabled = true
+	return nil
+}
+
+// properties returns the options specified in the config using vconsole.conf property names
+func (v *vconsoleUserConfig) properties() map[string]string {
+	props := make(map[string]string)
+	for k, val := range map[string]string{
+		"KEYMAP":        v.Keymap,
+		"KEYMAP_TOGGLE": v.KeymapToggle,
+		"FONT":          v.Font,
+		"FONT_MAP":      v.FontMap,
+		"FONT_UNIMAP":   v.FontUnimap,
+	} {
+		if val != "" {
+			props[k] = val
+		}
+	}
+	return props
+}
+
+// enableVirtualConsole adds keymap and fonts configured at vConsolePath to the image. The overrides (in vconsole.conf format)
+// take precedence over the file content.
+func (img *Image) enableVirtualConsole(vConsolePath, localePath string, overrides map[string]string) (*VirtualConsole, error) {
 	debug("enabling virtual console")
 
 	var conf VirtualConsole
 
+	vprop := make(map[string]string)
 	vconf, err := os.ReadFile(vConsolePath)
-	if err != nil {
+	if err == nil {
+		vprop = parseProperties(string(vconf), true)
+	} else if !errors.Is(err, fs.ErrNotExist) || len(overrides) == 0 {
 		return nil, err
 	}
-	vprop := parseProperties(string(vconf), true)
+	for k, v := range overrides {
+		vprop[k] = v
+	}
 
 	// adding keymap
 	if keymap, ok := vprop["KEYMAP"]; ok {
@@ -76,8 +125,8 @@ func (img *Image) enableVirtualConsole(vConsolePath, localePath string) (*Virtua
 			if err != nil {
 				return nil, err
 			}
-			conf.FontFile = "/console/font.map"
-			if err := img.AppendContent(conf.FontFile, 0o644, blob); err != nil {
+			conf.FontMapFile = "/console/font.map"
+			if err := img.AppendContent(conf.FontMapFile, 0o644, blob); err != nil {
 				return nil, err
 			}
 		}
@@ -87,8 +136,8 @@ func (img *Image) enableVirtualConsole(vConsolePath, localePath string) (*Virtua
 			if err != nil {
 				return nil, err
 			}
-			conf.FontFile = "/console/font.unimap"
-			if err := img.AppendContent(conf.FontFile, 0o644, blob); err != nil {
+			conf.FontUnicodeFile = "/console/font.unimap"
+			if err := img.AppendContent(conf.FontUnicodeFile, 0o644, blob); err != nil {
 				return nil, err
 			}
 		}
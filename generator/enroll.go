@@ -0,0 +1,242 @@
+package main
+
+// Enrolls a FIDO2 security key into a LUKS2 partition. The credential is stored as a 'systemd-fido2' token
+// so it is understood both by booster init and by systemd-cryptsetup.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/anatol/luks.go"
+)
+
+// defaultFido2RelyingParty matches the default of booster init (see booster.fido2_rp) and systemd-cryptenroll
+const defaultFido2RelyingParty = "io.systemd.cryptsetup"
+
+type fido2Token struct {
+	Type                     string   `json:"type"`
+	Keyslots                 []string `json:"keyslots"`
+	Credential               string   `json:"fido2-credential"` // base64
+	Salt                     string   `json:"fido2-salt"`       // base64
+	RelyingParty             string   `json:"fido2-rp"`
+	PinRequired              bool     `json:"fido2-clientPin-required"`
+	UserPresenceRequired     bool     `json:"fido2-up-required"`
+	UserVerificationRequired bool     `json:"fido2-uv-required"`
+}
+
+// newFido2Token creates a token for the credential with a new random salt. The token is bound to a keyslot once
+// the keyslot is added.
+func newFido2Token(credential, relyingParty string, pin, userPresence, userVerification bool) (*fido2Token, error) {
+	salt, err := randomBase64(32)
+	if err != nil {
+		return nil, err
+	}
+	return &fido2Token{
+		Type:                     "systemd-fido2",
+		Keyslots:                 []string{},
+		Credential:               credential,
+		Salt:                     salt,
+		RelyingParty:             relyingParty,
+		PinRequired:              pin,
+		UserPresenceRequired:     userPresence,
+		UserVerificationRequired: userVerification,
+	}, nil
+}
+
+// bindKeyslot binds the token to the keyslot. Keyslot numbers are strings in LUKS2 token JSON.
+func (t *fido2Token) bindKeyslot(slot int) {
+	t.Keyslots = []string{strconv.Itoa(slot)}
+}
+
+func randomBase64(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// runFido2Tool runs one of fido2-cred/fido2-assert tools and returns lines of its output.
+// PIN and touch requests are handled by the tool itself using the terminal.
+func runFido2Tool(input []string, name string, args ...string) ([]string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(strings.Join(input, "\n") + "\n")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return strings.Split(strings.TrimRight(string(out), "\n"), "\n"), nil
+}
+
+// fido2MakeCredential creates a new credential with hmac-secret extension enabled and returns its ID
+func fido2MakeCredential(device, relyingParty string) (string, error) {
+	clientDataHash, err := randomBase64(32)
+	if err != nil {
+		return "", err
+	}
+	userID, err := randomBase64(32)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Printf("Please touch the security key %s to create a credential\n", device)
+	lines, err := runFido2Tool([]string{clientDataHash, relyingParty, "booster", userID}, "fido2-cred", "-M", "-h", device)
+	if err != nil {
+		return "", err
+	}
+	// credential id is the 5th line in the output
+	if len(lines) < 5 {
+		return "", fmt.Errorf("fido2-cred: unexpected output")
+	}
+	return lines[4], nil
+}
+
+// fido2AssertArgs returns fido2-assert arguments for the token. up and uv are always set explicitly the same way
+// as booster init does it at boot, otherwise the authenticator defaults are used and the computed secret might not
+// match the one at boot.
+func fido2AssertArgs(device string, t *fido2Token) []string {
+	args := []string{"-G", "-h"}
+	args = append(args, "-t", fmt.Sprintf("up=%t", t.UserPresenceRequired))
+	args = append(args, "-t", fmt.Sprintf("uv=%t", t.UserVerificationRequired))
+	if t.PinRequired {
+		args = append(args, "-t", "pin=true")
+	}
+	return append(args, device)
+}
+
+// fido2HmacSecret computes the hmac secret for the given credential and salt the same way as booster init does it at boot
+func fido2HmacSecret(device string, t *fido2Token) (string, error) {
+	clientDataHash := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	args := fido2AssertArgs(device, t)
+
+	fmt.Printf("Please touch the security key %s again to compute the volume key\n", device)
+	lines, err := runFido2Tool([]string{clientDataHash, t.RelyingParty, t.Credential, t.Salt}, "fido2-assert", args...)
+	if err != nil {
+		return "", err
+	}
+	// hmac is the 5th line in the output
+	if len(lines) < 5 {
+		return "", fmt.Errorf("fido2-assert: unexpected output")
+	}
+	return lines[4], nil
+}
+
+func luksSlots(device string) (map[int]bool, error) {
+	d, err := luks.Open(device)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	if d.Version() != 2 {
+		return nil, fmt.Errorf("%s: tokens are supported by LUKS2 only", device)
+	}
+
+	slots := make(map[int]bool)
+	for _, s := range d.Slots() {
+		slots[s] = true
+	}
+	return slots, nil
+}
+
+// luksAddKey adds a new keyslot protected by key and returns its number.
+// cryptsetup asks the user for one of the existing passphrases.
+func luksAddKey(device string, key []byte) (int, error) {
+	before, err := luksSlots(device)
+	if err != nil {
+		return 0, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	go func() {
+		_, _ = w.Write(key)
+		_ = w.Close()
+	}()
+
+	// the new key is passed via an extra file descriptor as stdin is used for the existing passphrase prompt
+	cmd := exec.Command("cryptsetup", "luksAddKey", device, "/dev/fd/3")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{r}
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("cryptsetup luksAddKey: %v", err)
+	}
+
+	after, err := luksSlots(device)
+	if err != nil {
+		return 0, err
+	}
+	for s := range after {
+		if !before[s] {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unable to find the new keyslot")
+}
+
+func luksImportToken(device string, token interface{}) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("cryptsetup", "token", "import", "--json-file", "-", device)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cryptsetup token import: %v", err)
+	}
+	return nil
+}
+
+func runEnrollFido2() error {
+	args := opts.EnrollFido2Command
+	if args.RelyingParty == "" {
+		args.RelyingParty = defaultFido2RelyingParty
+	}
+
+	// fail early if the partition is not LUKS2
+	if _, err := luksSlots(args.Args.LuksDevice); err != nil {
+		return err
+	}
+
+	credential, err := fido2MakeCredential(args.Fido2Device, args.RelyingParty)
+	if err != nil {
+		return err
+	}
+	token, err := newFido2Token(credential, args.RelyingParty, args.Pin, !args.NoUserPresence, args.UserVerification)
+	if err != nil {
+		return err
+	}
+
+	key, err := fido2HmacSecret(args.Fido2Device, token)
+	if err != nil {
+		return err
+	}
+
+	slot, err := luksAddKey(args.Args.LuksDevice, []byte(key))
+	if err != nil {
+		return err
+	}
+	token.bindKeyslot(slot)
+
+	if err := luksImportToken(args.Args.LuksDevice, token); err != nil {
+		return err
+	}
+
+	fmt.Printf("FIDO2 key %s is enrolled to %s keyslot %d\n", args.Fido2Device, args.Args.LuksDevice, slot)
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFido2TokenJSON(t *testing.T) {
+	token, err := newFido2Token("Y3JlZGVudGlhbA==", defaultFido2RelyingParty, true, true, false)
+	require.NoError(t, err)
+	token.bindKeyslot(3)
+
+	data, err := json.Marshal(token)
+	require.NoError(t, err)
+
+	// the field names and types are the ones written by systemd-cryptenroll and read by booster init
+	var node map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &node))
+	require.Equal(t, map[string]interface{}{
+		"type":                     "systemd-fido2",
+		"keyslots":                 []interface{}{"3"},
+		"fido2-credential":         "Y3JlZGVudGlhbA==",
+		"fido2-salt":               token.Salt,
+		"fido2-rp":                 "io.systemd.cryptsetup",
+		"fido2-clientPin-required": true,
+		"fido2-up-required":        true,
+		"fido2-uv-required":        false,
+	}, node)
+
+	salt, err := base64.StdEncoding.DecodeString(token.Salt)
+	require.NoError(t, err)
+	require.Len(t, salt, 32)
+
+	// every enrollment gets its own salt
+	other, err := newFido2Token("Y3JlZGVudGlhbA==", defaultFido2RelyingParty, true, true, false)
+	require.NoError(t, err)
+	require.NotEqual(t, token.Salt, other.Salt)
+
+	// a token that is not bound yet has no keyslots rather than null
+	data, err = json.Marshal(other)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"keyslots":[]`)
+}
+
+func TestFido2AssertArgs(t *testing.T) {
+	check := func(pin, up, uv bool, expected ...string) {
+		token, err := newFido2Token("Y3JlZGVudGlhbA==", defaultFido2RelyingParty, pin, up, uv)
+		require.NoError(t, err)
+		require.Equal(t, expected, fido2AssertArgs("/dev/hidraw0", token))
+	}
+
+	// up and uv are passed even when they are disabled, otherwise the authenticator defaults are used
+	check(false, false, false, "-G", "-h", "-t", "up=false", "-t", "uv=false", "/dev/hidraw0")
+	check(false, true, false, "-G", "-h", "-t", "up=true", "-t", "uv=false", "/dev/hidraw0")
+	check(true, true, true, "-G", "-h", "-t", "up=true", "-t", "uv=true", "-t", "pin=true", "/dev/hidraw0")
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"io"
+	"math"
 	"os"
 )
 
@@ -47,6 +48,7 @@ func matchZstd(f io.ReadSeeker) (bool, error) {
 	return matchBytes(f, 0, []byte{0x28, 0xb5, 0x2f, 0xfd})
 }
 
+// filetype detects the format of the data at the current position of the file
 func filetype(r *os.File) (string, error) {
 	loc, err := r.Seek(0, io.SeekCurrent)
 	if err != nil {
@@ -54,8 +56,9 @@ func filetype(r *os.File) (string, error) {
 	}
 	defer r.Seek(loc, io.SeekStart)
 
+	data := io.NewSectionReader(r, loc, math.MaxInt64-loc)
 	for name, match := range matchers {
-		ok, err := match(r)
+		ok, err := match(data)
 		if err != nil {
 			return "", err
 		}
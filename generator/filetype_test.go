@@ -12,7 +12,7 @@ func TestFileType(t *testing.T) {
 	dir := t.TempDir()
 	check := func(compression, expectedType string) {
 		fileName := dir + "/" + compression
-		img, err := NewImage(fileName, compression, false)
+		img, err := NewImage(fileName, compression, false, nil)
 		require.NoError(t, err)
 
 		require.NoError(t, img.AppendEntry("foo.txt", cpio.TypeReg, []byte("hello, world!")))
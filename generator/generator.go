@@ -18,6 +18,11 @@ type generatorConfig struct {
 	networkConfigType       netConfigType
 	networkStaticConfig     *networkStaticConfig
 	networkActiveInterfaces []net.HardwareAddr
+	networkIPv6             string   // IPv6 configuration method
+	networkVlans            []string // 802.1Q interfaces in <name>:<parent> format
+	networkBonds            []string // bonding interfaces in <name>:<slaves>[:<options>[:<mtu>]] format
+	networkBridges          []string // bridge interfaces in <name>:<ports> format
+	networkHandoff          bool     // pass network configuration to the booted system
 	universal               bool
 	modules                 []string // extra modules to add
 	modulesForceLoad        []string // extra modules to load at the boot time
@@ -25,6 +30,7 @@ type generatorConfig struct {
 	compression             string
 	timeout                 time.Duration
 	extraFiles              []string
+	rescueTools             []string // binaries added to the emergency shell PATH
 	output                  string
 	forceOverwrite          bool // overwrite output file
 	initBinary              string
@@ -36,15 +42,47 @@ type generatorConfig struct {
 	readModprobeOptions     func() (map[string]string, error)
 	stripBinaries           bool
 	enableLVM               bool
+	lvmNative               bool
+	enableVerity            bool
+	enableOverlay           bool
+	enableLive              bool
+	enableIntegrity         bool
 	enableMdraid            bool
+	mdraidNative            bool
 	mdraidConfigPath        string
 	enableZfs               bool
 	zfsImportParams         string
 	zfsCachePath            string
+	enableWifi              bool
+	enableFsck              bool
+	hooksDir                string // post-unlock hooks directory at the host, it is copied to the image if exists
+	hooksIgnoreFailures     bool
+	luksKeyfiles            []InitLuksKeyfile
+	disablePassphraseCache  bool
+	enableShell             bool
+	enableSSH               bool // SSH server for remote unlock
+	sshPort                 int
+	sshAuthorizedKeysPath   string
+	sshHostKeyPath          string
+	wireguard               *InitWireGuardConfig // WireGuard tunnel, the keys are sealed with TPM when the image is generated
+	wireguardPrivateKey     []byte
+	wireguardPresharedKeys  [][]byte
+	wireguardPCRs           []int
+	enablePlymouth          bool   // splash screen
+	graphicalPromptFont     string // font of the built-in graphical password prompt, empty if the prompt is disabled
+	enableUswsusp           bool   // userspace hibernation (s2disk) resume
+	enableMicrocode         bool   // prepend early CPU microcode archive
+	measurePCR              int    // PCR init extends with the measurements of the boot config, zero disables measurements
 
 	// virtual console configs
 	enableVirtualConsole     bool
 	vconsolePath, localePath string
+	vconsoleOverrides        map[string]string // KEYMAP, FONT, etc. properties from the config that take precedence over vconsole.conf
+
+	kdump *InitKdumpConfig // crash capture image settings, nil for a regular image
+	uki   *ukiUserConfig   // unified kernel image settings, nil if only initrd is generated
+
+	secureBoot *secureBootUserConfig // keys to sign the unified kernel image and the kernel with
 }
 
 type networkStaticConfig struct {
@@ -96,7 +134,16 @@ func generateInitRamfs(conf *generatorConfig) error {
 		return fmt.Errorf("File %v exists, please specify --force if you want to overwrite it", conf.output)
 	}
 
-	img, err := NewImage(conf.output, conf.compression, conf.stripBinaries)
+	var earlyCpio []byte
+	if conf.enableMicrocode {
+		var err error
+		earlyCpio, err = readEarlyMicrocode(conf.universal)
+		if err != nil {
+			return fmt.Errorf("microcode: %v", err)
+		}
+	}
+
+	img, err := NewImage(conf.output, conf.compression, conf.stripBinaries, earlyCpio)
 	if err != nil {
 		return err
 	}
@@ -114,6 +161,14 @@ func generateInitRamfs(conf *generatorConfig) error {
 		return err
 	}
 
+	if err := img.appendRescueTools(conf.rescueTools); err != nil {
+		return err
+	}
+
+	if err := img.appendPostUnlockHooks(conf.hooksDir); err != nil {
+		return err
+	}
+
 	kmod, err := NewKmod(conf)
 	if err != nil {
 		return err
@@ -139,44 +194,168 @@ func generateInitRamfs(conf *generatorConfig) error {
 		if err := kmod.activateModules(true, false, "kernel/drivers/net/ethernet/"); err != nil {
 			return err
 		}
+		// network block device, NFS, iSCSI and NVMe over TCP are used for network root,
+		// ipv6 is needed for IPv6-only networks, 8021q, bonding and bridge for virtual interfaces
+		if err := kmod.activateModules(false, false, "nbd", "nfs", "nfsv3", "nfsv4", "iscsi_tcp", "iscsi_ibft", "nvme_tcp", "ipv6", "8021q", "bonding", "bridge"); err != nil {
+			return err
+		}
 	}
 
-	if conf.enableLVM {
-		if err := kmod.activateModules(false, false, "dm_mod", "dm_snapshot", "dm_mirror", "dm_cache", "dm_cache_smq", "dm_thin_pool"); err != nil {
+	if conf.enablePlymouth {
+		// KMS drivers are needed to show the splash before the root filesystem is mounted
+		if err := kmod.activateModules(true, false, "kernel/drivers/gpu/drm/"); err != nil {
+			return err
+		}
+		if err := img.appendPlymouth(); err != nil {
 			return err
 		}
+	}
 
-		conf.modulesForceLoad = append(conf.modulesForceLoad, "dm_mod")
-		if err := img.appendExtraFiles("lvm"); err != nil {
+	if conf.graphicalPromptFont != "" {
+		if err := kmod.activateModules(true, false, "kernel/drivers/gpu/drm/"); err != nil {
+			return err
+		}
+		font, err := readPromptFont(conf.graphicalPromptFont)
+		if err != nil {
+			return fmt.Errorf("graphical prompt: %v", err)
+		}
+		if err := img.AppendContent(graphicalPromptFontPath, 0o644, font); err != nil {
 			return err
 		}
 	}
 
-	if conf.enableMdraid {
-		if err := kmod.activateModules(true, true, "kernel/drivers/md/"); err != nil {
+	if conf.enableUswsusp {
+		if err := img.appendUswsusp(); err != nil {
+			return fmt.Errorf("uswsusp: %v", err)
+		}
+	}
+
+	if conf.kdump != nil && conf.kdump.Makedumpfile != "" {
+		if err := img.appendExtraFiles("makedumpfile"); err != nil {
+			return fmt.Errorf("kdump: makedumpfile: %v", err)
+		}
+	}
+
+	if conf.enableWifi {
+		if err := kmod.activateModules(true, false, "kernel/drivers/net/wireless/"); err != nil {
+			return err
+		}
+		// cfg80211/mac80211 and the ciphers used by WPA2 (CCMP) and WPA3 (GCMP)
+		if err := kmod.activateModules(false, false, "cfg80211", "mac80211", "ccm", "gcm", "ctr", "cmac"); err != nil {
 			return err
 		}
+		// wpa_supplicant is optional, without it init uses the built-in WPA2-PSK supplicant
+		if _, err := lookupPath("wpa_supplicant"); err == nil {
+			if err := img.appendExtraFiles("wpa_supplicant"); err != nil {
+				return err
+			}
+		} else {
+			debug("wpa_supplicant is not found, the image uses the built-in supplicant")
+		}
+		// wireless regulatory database, without it cfg80211 restricts the device to the channels allowed worldwide
+		for _, f := range []string{"regulatory.db", "regulatory.db.p7s"} {
+			if _, err := os.Stat(firmwareDir + f); err == nil {
+				if err := img.AppendFile(firmwareDir + f); err != nil {
+					return err
+				}
+			}
+		}
+	}
 
-		// preload md_mod for speed. Level-specific drivers (e.g. raid1, raid456) are going to be detected loaded at boot-time
-		conf.modulesForceLoad = append(conf.modulesForceLoad, "md_mod")
+	if conf.enableSSH {
+		if err := img.appendSSHKeys(conf); err != nil {
+			return err
+		}
+	}
 
-		if err := img.appendExtraFiles("mdadm"); err != nil {
+	if conf.wireguard != nil {
+		if err := kmod.activateModules(false, false, "wireguard"); err != nil {
 			return err
 		}
+	}
 
-		mdadmConf := conf.mdraidConfigPath
-		if mdadmConf == "" {
-			mdadmConf = "/etc/mdadm.conf"
+	if conf.enableFsck {
+		if err := img.appendExtraFiles("fsck"); err != nil {
+			return err
 		}
-		content, err := os.ReadFile(mdadmConf)
-		if err != nil {
+		// checkers of the filesystems that can be checked without a shell, e.g. fsck.xfs is a shell script that does nothing
+		for _, checker := range []string{"fsck.ext2", "fsck.ext3", "fsck.ext4", "fsck.f2fs", "fsck.vfat", "fsck.fat"} {
+			if err := img.appendExtraFiles(checker); err != nil {
+				if os.IsNotExist(err) {
+					debug("Adding %s to the image: %v", checker, err)
+				} else {
+					return err
+				}
+			}
+		}
+	}
+
+	if conf.enableVerity {
+		if err := kmod.activateModules(false, false, "dm_mod", "dm_verity"); err != nil {
 			return err
 		}
-		if err := img.AppendContent("/etc/mdadm.conf", 0o644, content); err != nil {
+	}
+
+	if conf.enableOverlay {
+		if err := kmod.activateModules(false, false, "overlay"); err != nil {
+			return err
+		}
+	}
+
+	if conf.enableLive {
+		// live media are usually ISO images or USB sticks with FAT filesystem, the root filesystem image is squashfs
+		if err := kmod.activateModules(false, false, "loop", "isofs", "vfat", "nls_cp437", "nls_iso8859-1", "squashfs", "erofs", "overlay"); err != nil {
+			return err
+		}
+	}
+
+	if conf.enableIntegrity {
+		if err := kmod.activateModules(false, false, "dm_mod", "dm_integrity", "crc32c_generic"); err != nil {
 			return err
 		}
 	}
 
+	if conf.enableLVM {
+		if err := kmod.activateModules(false, false, "dm_mod", "dm_snapshot", "dm_mirror", "dm_cache", "dm_cache_smq", "dm_thin_pool"); err != nil {
+			return err
+		}
+
+		conf.modulesForceLoad = append(conf.modulesForceLoad, "dm_mod")
+		if !conf.lvmNative {
+			if err := img.appendExtraFiles("lvm"); err != nil {
+				return err
+			}
+		}
+	}
+
+	if conf.enableMdraid {
+		if err := kmod.activateModules(true, true, "kernel/drivers/md/"); err != nil {
+			return err
+		}
+
+		// preload md_mod for speed. Level-specific drivers (e.g. raid1, raid456) are going to be detected loaded at boot-time
+		conf.modulesForceLoad = append(conf.modulesForceLoad, "md_mod")
+
+		if !conf.mdraidNative {
+			// mdmon manages metadata of IMSM/DDF containers
+			if err := img.appendExtraFiles("mdadm", "mdmon"); err != nil {
+				return err
+			}
+
+			mdadmConf := conf.mdraidConfigPath
+			if mdadmConf == "" {
+				mdadmConf = "/etc/mdadm.conf"
+			}
+			content, err := os.ReadFile(mdadmConf)
+			if err != nil {
+				return err
+			}
+			if err := img.AppendContent("/etc/mdadm.conf", 0o644, content); err != nil {
+				return err
+			}
+		}
+	}
+
 	if conf.enableZfs {
 		if err := kmod.activateModules(false, true, "zfs"); err != nil {
 			return err
@@ -199,11 +378,14 @@ func generateInitRamfs(conf *generatorConfig) error {
 			return err
 		}
 
-		if err := img.AppendFile("/etc/default/zfs"); err != nil {
-			if os.IsNotExist(err) {
-				debug("Adding /etc/default/zfs to the image: %v", err)
-			} else {
-				return err
+		// zpool refuses to import a pool last used by a system with another hostid
+		for _, f := range []string{"/etc/default/zfs", "/etc/hostid"} {
+			if err := img.AppendFile(f); err != nil {
+				if os.IsNotExist(err) {
+					debug("Adding %s to the image: %v", f, err)
+				} else {
+					return err
+				}
 			}
 		}
 	}
@@ -233,7 +415,7 @@ func generateInitRamfs(conf *generatorConfig) error {
 
 	var vconsole *VirtualConsole
 	if conf.enableVirtualConsole {
-		vconsole, err = img.enableVirtualConsole(conf.vconsolePath, conf.localePath)
+		vconsole, err = img.enableVirtualConsole(conf.vconsolePath, conf.localePath, conf.vconsoleOverrides)
 		if err != nil {
 			return err
 		}
@@ -309,6 +491,20 @@ func (img *Image) appendExtraFiles(binaries ...string) error {
 	return nil
 }
 
+// appendPostUnlockHooks adds the post-unlock hooks directory to the image, all the hooks are executed by init
+// after a LUKS volume is unlocked
+func (img *Image) appendPostUnlockHooks(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return img.AppendFile(dir)
+}
+
 func lookupPath(binary string) (string, error) {
 	paths := []string{
 		"/usr/bin",
@@ -386,8 +582,19 @@ func (img *Image) appendInitConfig(conf *generatorConfig, kmod *Kmod, vconsole *
 	initConfig.BuiltinModules = kmod.builtinModules
 	initConfig.VirtualConsole = vconsole
 	initConfig.EnableLVM = conf.enableLVM
+	initConfig.LvmNative = conf.lvmNative
 	initConfig.EnableMdraid = conf.enableMdraid
+	initConfig.MdraidNative = conf.mdraidNative
+	initConfig.EnableIntegrity = conf.enableIntegrity
 	initConfig.EnableZfs = conf.enableZfs
+	initConfig.EnableWifi = conf.enableWifi
+	initConfig.HooksIgnoreFailures = conf.hooksIgnoreFailures
+	initConfig.LuksKeyfiles = conf.luksKeyfiles
+	initConfig.DisablePassphraseCache = conf.disablePassphraseCache
+	initConfig.EnableShell = conf.enableShell
+	initConfig.EnableGraphicalPrompt = conf.graphicalPromptFont != ""
+	initConfig.Kdump = conf.kdump
+	initConfig.MeasurePCR = conf.measurePCR
 	initConfig.ZfsImportParams = conf.zfsImportParams
 
 	if conf.networkConfigType == netDhcp {
@@ -399,6 +606,23 @@ func (img *Image) appendInitConfig(conf *generatorConfig, kmod *Kmod, vconsole *
 		initConfig.Network.Gateway = conf.networkStaticConfig.gateway
 		initConfig.Network.DNSServers = conf.networkStaticConfig.dnsServers
 	}
+	if conf.networkConfigType != netOff {
+		initConfig.Network.IPv6 = conf.networkIPv6
+		initConfig.Network.Vlans = conf.networkVlans
+		initConfig.Network.Bonds = conf.networkBonds
+		initConfig.Network.Bridges = conf.networkBridges
+		initConfig.Network.Handoff = conf.networkHandoff
+	}
+	if conf.enableSSH {
+		initConfig.SSH = &InitSSHConfig{Port: conf.sshPort}
+	}
+	if conf.wireguard != nil {
+		wg, err := sealWireGuardConfig(conf)
+		if err != nil {
+			return fmt.Errorf("wireguard: %v", err)
+		}
+		initConfig.WireGuard = wg
+	}
 	if conf.networkActiveInterfaces != nil {
 		initConfig.Network.Interfaces = conf.networkActiveInterfaces
 	}
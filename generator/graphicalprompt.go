@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const defaultGraphicalPromptFont = "default8x16"
+
+// readPromptFont reads the PSF font used by the graphical password prompt. The font is either a console font name
+// (e.g. ter-v24n) or a path to a font file.
+func readPromptFont(font string) ([]byte, error) {
+	var blob []byte
+	if filepath.IsAbs(font) {
+		data, err := os.ReadFile(font)
+		if err != nil {
+			return nil, err
+		}
+		blob = data
+		if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+			gz, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			defer gz.Close()
+			if blob, err = io.ReadAll(gz); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		data, err := readFontFile(font)
+		if err != nil {
+			return nil, err
+		}
+		blob = data
+	}
+
+	// PSF1 and PSF2 magic numbers, init does not support other font formats
+	if !bytes.HasPrefix(blob, []byte{0x36, 0x04}) && !bytes.HasPrefix(blob, []byte{0x72, 0xb5, 0x4a, 0x86}) {
+		return nil, fmt.Errorf("font %s is not in PSF format", font)
+	}
+	return blob, nil
+}
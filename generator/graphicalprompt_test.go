@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadPromptFont(t *testing.T) {
+	dir := t.TempDir()
+	psf := append([]byte{0x36, 0x04, 0, 16}, make([]byte, 256*16)...)
+
+	plain := filepath.Join(dir, "font.psf")
+	require.NoError(t, os.WriteFile(plain, psf, 0o644))
+	blob, err := readPromptFont(plain)
+	require.NoError(t, err)
+	require.Equal(t, psf, blob)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err = gz.Write(psf)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	compressed := filepath.Join(dir, "font.psfu.gz")
+	require.NoError(t, os.WriteFile(compressed, buf.Bytes(), 0o644))
+	blob, err = readPromptFont(compressed)
+	require.NoError(t, err)
+	require.Equal(t, psf, blob)
+
+	other := filepath.Join(dir, "font.fnt")
+	require.NoError(t, os.WriteFile(other, []byte("MZ\x00\x00"), 0o644))
+	_, err = readPromptFont(other)
+	require.EqualError(t, err, "font "+other+" is not in PSF format")
+}
@@ -28,7 +28,8 @@ type Image struct {
 	stripBinaries bool
 }
 
-func NewImage(path string, compression string, stripBinaries bool) (*Image, error) {
+// NewImage creates an initramfs image. earlyCpio is an optional uncompressed archive (e.g. CPU microcode) placed before the main one.
+func NewImage(path string, compression string, stripBinaries bool, earlyCpio []byte) (*Image, error) {
 	file, err := renameio.TempFile("", path)
 	if err != nil {
 		return nil, err
@@ -36,6 +37,9 @@ func NewImage(path string, compression string, stripBinaries bool) (*Image, erro
 	if err := file.Chmod(0o644); err != nil {
 		return nil, err
 	}
+	if _, err := file.Write(earlyCpio); err != nil {
+		return nil, err
+	}
 
 	var compressor io.WriteCloser
 	switch compression {
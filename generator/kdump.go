@@ -0,0 +1,21 @@
+package main
+
+// defaultKdumpPath is the crash dump directory, the same one kdump-tools and kexec-tools use
+const defaultKdumpPath = "/var/crash"
+
+type kdumpUserConfig struct {
+	Path         string `yaml:",omitempty"` // directory at the dump target (the root filesystem of the crash kernel), default is /var/crash
+	Makedumpfile string `yaml:",omitempty"` // makedumpfile arguments, e.g. '-l -d 31'. If empty the dump is copied with gzip compression
+}
+
+// initConfig returns the crash capture config for init, the receiver can be nil if the config file has no 'kdump' section
+func (k *kdumpUserConfig) initConfig() *InitKdumpConfig {
+	c := &InitKdumpConfig{Path: defaultKdumpPath}
+	if k != nil {
+		if k.Path != "" {
+			c.Path = k.Path
+		}
+		c.Makedumpfile = k.Makedumpfile
+	}
+	return c
+}
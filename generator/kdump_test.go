@@ -0,0 +1,15 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKdumpInitConfig(t *testing.T) {
+	var k *kdumpUserConfig
+	require.Equal(t, &InitKdumpConfig{Path: "/var/crash"}, k.initConfig())
+
+	k = &kdumpUserConfig{Path: "/srv/dumps", Makedumpfile: "-l -d 31"}
+	require.Equal(t, &InitKdumpConfig{Path: "/srv/dumps", Makedumpfile: "-l -d 31"}, k.initConfig())
+}
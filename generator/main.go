@@ -24,6 +24,8 @@ var opts struct {
 		ConfigFile       string `long:"config" default:"/etc/booster.yaml" description:"Configuration file path"`
 		Universal        bool   `long:"universal" description:"Add wide range of modules/tools to allow this image boot at different machines"`
 		Strip            bool   `long:"strip" description:"Strip ELF files (binaries, shared libraries and kernel modules) before adding it to the image"`
+		Kdump            bool   `long:"kdump" description:"Build a crash capture image that saves the kdump memory image and reboots"`
+		UKI              bool   `long:"uki" description:"Build a unified kernel image (EFI binary with the kernel and initrd embedded) instead of initrd"`
 		Args             struct {
 			Output string `positional-arg-name:"output" required:"true"`
 		} `positional-args:"true"`
@@ -48,6 +50,29 @@ var opts struct {
 			OutputDir string `positional-arg-name:"output-dir" required:"true"`
 		} `positional-args:"true"`
 	} `command:"unpack" description:"Unpack image"`
+
+	EnrollFido2Command struct {
+		Fido2Device      string `long:"fido2-device" required:"true" description:"FIDO2 security key device, e.g. /dev/hidraw0"`
+		RelyingParty     string `long:"rp" description:"FIDO2 relying party ID, if not set then io.systemd.cryptsetup is used"`
+		Pin              bool   `long:"pin" description:"Require security key PIN at unlock time"`
+		UserVerification bool   `long:"uv" description:"Require user verification (e.g. fingerprint) at unlock time"`
+		NoUserPresence   bool   `long:"no-up" description:"Do not require the security key touch at unlock time"`
+		Args             struct {
+			LuksDevice string `positional-arg-name:"luks-device" required:"true"`
+		} `positional-args:"true"`
+	} `command:"enroll-fido2" description:"Enroll a FIDO2 security key into a LUKS2 partition"`
+
+	BenchmarkKDFCommand struct {
+		Type       string `long:"type" default:"argon2id" choice:"argon2id" choice:"argon2i" choice:"pbkdf2" description:"Key derivation function"`
+		Memory     int    `long:"memory" default:"1048576" description:"argon2 memory cost in KiB"`
+		Time       int    `long:"time" default:"4" description:"argon2 time cost"`
+		Parallel   int    `long:"parallel" default:"4" description:"argon2 parallelism"`
+		Hash       string `long:"hash" default:"sha256" description:"pbkdf2 hash"`
+		Iterations int    `long:"iterations" default:"1000000" description:"pbkdf2 iterations"`
+		Args       struct {
+			LuksDevice string `positional-arg-name:"luks-device"`
+		} `positional-args:"true"`
+	} `command:"benchmark-kdf" description:"Measure LUKS key derivation time and memory usage"`
 }
 
 type set map[string]bool
@@ -99,7 +124,14 @@ func runGenerator() error {
 		return err
 	}
 
-	err = generateInitRamfs(conf)
+	if conf.uki != nil {
+		err = buildUKI(conf)
+	} else {
+		err = generateInitRamfs(conf)
+	}
+	if err == nil && conf.secureBoot != nil && conf.secureBoot.KernelOutput != "" {
+		err = signKernel(conf)
+	}
 	if opts.Pprofmem != "" {
 		if err := saveProfile("allocs", opts.Pprofmem); err != nil {
 			fmt.Println(err)
@@ -128,6 +160,10 @@ func main() {
 		err = runLs()
 	case "unpack":
 		err = runUnpack()
+	case "enroll-fido2":
+		err = runEnrollFido2()
+	case "benchmark-kdf":
+		err = runBenchmarkKDF()
 	}
 
 	if err != nil {
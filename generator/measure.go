@@ -0,0 +1,22 @@
+package main
+
+import "fmt"
+
+// defaultMeasurePCR is the PCR the kernel measures the initrd to, the booster measurements describe the same image
+const defaultMeasurePCR = 9
+
+type measureUserConfig struct {
+	PCR int `yaml:"pcr,omitempty"` // PCR extended with the measurements, default is 9
+}
+
+// pcr returns the PCR that init extends with the measurements of the config, the command line and the keys
+func (m *measureUserConfig) pcr() (int, error) {
+	if m.PCR == 0 {
+		return defaultMeasurePCR, nil
+	}
+	// PCRs 0-7 belong to the firmware
+	if m.PCR < 8 || m.PCR > 23 {
+		return 0, fmt.Errorf("pcr %d is out of 8-23 range", m.PCR)
+	}
+	return m.PCR, nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeasurePCR(t *testing.T) {
+	pcr, err := (&measureUserConfig{}).pcr()
+	require.NoError(t, err)
+	require.Equal(t, 9, pcr)
+
+	pcr, err = (&measureUserConfig{PCR: 12}).pcr()
+	require.NoError(t, err)
+	require.Equal(t, 12, pcr)
+
+	_, err = (&measureUserConfig{PCR: 7}).pcr()
+	require.Error(t, err)
+	_, err = (&measureUserConfig{PCR: 24}).pcr()
+	require.Error(t, err)
+}
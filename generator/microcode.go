@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cavaliergopher/cpio"
+	"github.com/klauspost/compress/zstd"
+	"github.com/xi2/xz"
+)
+
+// The kernel loads CPU microcode updates very early from an uncompressed cpio archive at the beginning
+// of the initramfs, see https://docs.kernel.org/arch/x86/microcode.html
+
+const earlyMicrocodeDir = "kernel/x86/microcode"
+
+var microcodeVendors = []struct {
+	vendor  string // vendor_id from /proc/cpuinfo
+	dir     string // directory under firmwareDir with the vendor microcode files
+	pattern string // names of the microcode files in dir
+}{
+	{"GenuineIntel", "intel-ucode", "??-??-??*"},
+	{"AuthenticAMD", "amd-ucode", "microcode_amd*.bin*"},
+}
+
+type cpuInfo struct {
+	vendor                  string
+	family, model, stepping int
+}
+
+// parseCPUInfo parses the description of the first processor in /proc/cpuinfo
+func parseCPUInfo(r io.Reader) (*cpuInfo, error) {
+	var cpu cpuInfo
+	var seen int
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		key, value, ok := strings.Cut(s.Text(), ":")
+		if !ok {
+			if seen > 0 {
+				break // the end of the first processor block
+			}
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		var err error
+		switch key {
+		case "vendor_id":
+			cpu.vendor = value
+			seen++
+		case "cpu family":
+			cpu.family, err = strconv.Atoi(value)
+			seen++
+		case "model":
+			cpu.model, err = strconv.Atoi(value)
+			seen++
+		case "stepping":
+			cpu.stepping, err = strconv.Atoi(value)
+			seen++
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cpuinfo: %s: %v", key, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if cpu.vendor == "" {
+		return nil, fmt.Errorf("cpuinfo: vendor_id is not found")
+	}
+	return &cpu, nil
+}
+
+// microcodeName returns the name of the microcode file for the CPU as it is named in the linux-firmware repository
+func (cpu *cpuInfo) microcodeName() string {
+	switch cpu.vendor {
+	case "GenuineIntel":
+		return fmt.Sprintf("%02x-%02x-%02x", cpu.family, cpu.model, cpu.stepping)
+	case "AuthenticAMD":
+		if cpu.family < 0x15 {
+			return "microcode_amd.bin"
+		}
+		return fmt.Sprintf("microcode_amd_fam%02xh.bin", cpu.family)
+	}
+	return ""
+}
+
+// readMicrocodeFile reads the microcode file, the kernel expects it uncompressed
+func readMicrocodeFile(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader
+	switch filepath.Ext(file) {
+	case ".xz":
+		r, err = xz.NewReader(f, 0)
+	case ".zst":
+		var zr *zstd.Decoder
+		zr, err = zstd.NewReader(f)
+		if err == nil {
+			defer zr.Close()
+			r = zr
+		}
+	default:
+		r = f
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return io.ReadAll(r)
+}
+
+// readMicrocode returns the microcode blobs for the early archive keyed by the vendor file name (e.g. GenuineIntel.bin).
+// If cpu is nil then microcode of all the CPUs is added, otherwise only the update for the given CPU.
+func readMicrocode(cpu *cpuInfo) (map[string][]byte, error) {
+	blobs := make(map[string][]byte)
+	for _, v := range microcodeVendors {
+		if cpu != nil && cpu.vendor != v.vendor {
+			continue
+		}
+
+		var files []string
+		if cpu != nil {
+			f, err := findFwFile(filepath.Join(v.dir, cpu.microcodeName()))
+			if os.IsNotExist(err) {
+				debug("no microcode update found for %s family %d model %d stepping %d", cpu.vendor, cpu.family, cpu.model, cpu.stepping)
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			files = []string{f}
+		} else {
+			var err error
+			files, err = filepath.Glob(filepath.Join(firmwareDir, v.dir, v.pattern))
+			if err != nil {
+				return nil, err
+			}
+			sort.Strings(files)
+		}
+
+		var blob bytes.Buffer
+		for _, f := range files {
+			if strings.HasSuffix(f, ".asc") {
+				continue // linux-firmware ships signatures next to the AMD microcode
+			}
+			content, err := readMicrocodeFile(f)
+			if err != nil {
+				return nil, err
+			}
+			blob.Write(content)
+		}
+		if blob.Len() > 0 {
+			blobs[v.vendor+".bin"] = blob.Bytes()
+		}
+	}
+	return blobs, nil
+}
+
+// earlyMicrocodeArchive builds the uncompressed cpio archive that is prepended to the image
+func earlyMicrocodeArchive(blobs map[string][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := cpio.NewWriter(&buf)
+
+	dir := ""
+	for _, d := range strings.Split(earlyMicrocodeDir, "/") {
+		dir = filepath.Join(dir, d)
+		if err := w.WriteHeader(&cpio.Header{Name: dir, Mode: cpio.FileMode(0o755) | cpio.TypeDir}); err != nil {
+			return nil, err
+		}
+	}
+
+	names := make([]string, 0, len(blobs))
+	for name := range blobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		content := blobs[name]
+		hdr := &cpio.Header{
+			Name: filepath.Join(earlyMicrocodeDir, name),
+			Mode: cpio.FileMode(0o644) | cpio.TypeReg,
+			Size: int64(len(content)),
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(content); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readEarlyMicrocode returns the early microcode archive, nil if there is no microcode for the host CPU
+func readEarlyMicrocode(universal bool) ([]byte, error) {
+	var cpu *cpuInfo
+	if !universal {
+		f, err := os.Open("/proc/cpuinfo")
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		cpu, err = parseCPUInfo(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	blobs, err := readMicrocode(cpu)
+	if err != nil {
+		return nil, err
+	}
+	if len(blobs) == 0 {
+		return nil, nil
+	}
+	return earlyMicrocodeArchive(blobs)
+}
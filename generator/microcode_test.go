@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cavaliergopher/cpio"
+	"github.com/stretchr/testify/require"
+)
+
+const cpuinfoIntel = `processor	: 0
+vendor_id	: GenuineIntel
+cpu family	: 6
+model		: 158
+model name	: Intel(R) Core(TM) i7-8700K CPU @ 3.70GHz
+stepping	: 10
+microcode	: 0xf4
+
+processor	: 1
+vendor_id	: GenuineIntel
+cpu family	: 6
+model		: 158
+`
+
+func TestParseCPUInfo(t *testing.T) {
+	cpu, err := parseCPUInfo(strings.NewReader(cpuinfoIntel))
+	require.NoError(t, err)
+	require.Equal(t, &cpuInfo{vendor: "GenuineIntel", family: 6, model: 158, stepping: 10}, cpu)
+	require.Equal(t, "06-9e-0a", cpu.microcodeName())
+
+	_, err = parseCPUInfo(strings.NewReader("processor : 0\n"))
+	require.Error(t, err)
+}
+
+func TestMicrocodeNameAMD(t *testing.T) {
+	require.Equal(t, "microcode_amd_fam17h.bin", (&cpuInfo{vendor: "AuthenticAMD", family: 23}).microcodeName())
+	require.Equal(t, "microcode_amd_fam19h.bin", (&cpuInfo{vendor: "AuthenticAMD", family: 25}).microcodeName())
+	require.Equal(t, "microcode_amd.bin", (&cpuInfo{vendor: "AuthenticAMD", family: 16}).microcodeName())
+}
+
+func TestEarlyMicrocodeImage(t *testing.T) {
+	early, err := earlyMicrocodeArchive(map[string][]byte{"GenuineIntel.bin": []byte("intel microcode")})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(early), "070701"))
+	require.Zero(t, len(early)%4)
+
+	for _, compression := range []string{"zstd", "none"} {
+		file := filepath.Join(t.TempDir(), "booster.img")
+		img, err := NewImage(file, compression, false, early)
+		require.NoError(t, err)
+		require.NoError(t, img.AppendContent("/foo.txt", 0o644, []byte("hello, world!")))
+		require.NoError(t, img.Close())
+
+		files := make(map[string]string)
+		require.NoError(t, processImage(file, func(hdr *cpio.Header, r *cpio.Reader) error {
+			content, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			files[hdr.Name] = string(content)
+			return nil
+		}))
+		require.Equal(t, "intel microcode", files["kernel/x86/microcode/GenuineIntel.bin"], compression)
+		require.Equal(t, "hello, world!", files["foo.txt"], compression)
+	}
+}
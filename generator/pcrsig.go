@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"debug/pe"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// systemd-stub measures the UKI sections to PCR 11 before it starts the kernel. As the measured content is known at
+// build time booster predicts the PCR value and signs the PolicyPCR digest the same way systemd-measure does it.
+// Secrets enrolled with 'systemd-cryptenroll --tpm2-public-key' stay unlockable after the kernel is updated
+// as long as the new image carries a policy signed by the same key.
+
+const (
+	ukiPCR          = 11
+	cmdPolicyPCR    = 0x0000017F
+	tpmAlgSHA256    = 0x000B
+	pcrSelectBytes  = 3
+	pcrDigestLength = sha256.Size
+)
+
+// ukiMeasuredSections are the sections measured by systemd-stub in the measurement order. '.pcrsig' is not
+// measured as it cannot contain its own signature.
+var ukiMeasuredSections = []string{".linux", ".osrel", ".cmdline", ".initrd", ".ucode", ".splash", ".dtb", ".uname", ".sbat", ".pcrpkey"}
+
+type pcrSignature struct {
+	PCRs        []int  `json:"pcrs"`
+	Fingerprint string `json:"pkfp"` // hex
+	Policy      string `json:"pol"`  // hex
+	Signature   string `json:"sig"`  // base64
+}
+
+func pcrExtend(pcr, data []byte) []byte {
+	digest := sha256.Sum256(data)
+	h := sha256.New()
+	h.Write(pcr)
+	h.Write(digest[:])
+	return h.Sum(nil)
+}
+
+// predictUKIPCR computes the value of PCR 11 after systemd-stub measured the image and the words of
+// the boot phase (e.g. "enter-initrd:leave-initrd") were measured by systemd-pcrphase
+func predictUKIPCR(image []byte, phase string) ([]byte, error) {
+	f, err := pe.NewFile(bytes.NewReader(image))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pcr := make([]byte, pcrDigestLength)
+	for _, name := range ukiMeasuredSections {
+		s := f.Section(name)
+		if s == nil {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if s.VirtualSize < uint32(len(data)) {
+			data = data[:s.VirtualSize] // the stub measures the section as it is loaded in memory
+		}
+		pcr = pcrExtend(pcr, append([]byte(name), 0))
+		pcr = pcrExtend(pcr, data)
+	}
+	if phase != "" {
+		for _, word := range strings.Split(phase, ":") {
+			pcr = pcrExtend(pcr, []byte(word))
+		}
+	}
+	return pcr, nil
+}
+
+// pcrPolicyDigest returns the digest of a TPM2_PolicyPCR policy that checks that the PCR has the given value
+func pcrPolicyDigest(pcr int, value []byte) []byte {
+	// TPML_PCR_SELECTION with a single sha256 bank
+	selection := make([]byte, 4+2+1+pcrSelectBytes)
+	binary.BigEndian.PutUint32(selection, 1)
+	binary.BigEndian.PutUint16(selection[4:], tpmAlgSHA256)
+	selection[6] = pcrSelectBytes
+	selection[7+pcr/8] |= 1 << (pcr % 8)
+
+	pcrsDigest := sha256.Sum256(value)
+
+	h := sha256.New()
+	h.Write(make([]byte, pcrDigestLength)) // the initial policy digest
+	_ = binary.Write(h, binary.BigEndian, uint32(cmdPolicyPCR))
+	h.Write(selection)
+	h.Write(pcrsDigest[:])
+	return h.Sum(nil)
+}
+
+// pcrPublicKey returns the PEM encoded public key of the signing key as it is embedded to .pcrpkey
+func pcrPublicKey(key *rsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// ukiPCRSignature returns the content of the .pcrsig section with the policies for every phase signed by the key
+func ukiPCRSignature(image []byte, key *rsa.PrivateKey, phases []string) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := sha256.Sum256(der)
+
+	if len(phases) == 0 {
+		phases = []string{""}
+	}
+	var signatures []pcrSignature
+	for _, phase := range phases {
+		pcr, err := predictUKIPCR(image, phase)
+		if err != nil {
+			return nil, err
+		}
+		policy := pcrPolicyDigest(ukiPCR, pcr)
+		digest := sha256.Sum256(policy)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, pcrSignature{
+			PCRs:        []int{ukiPCR},
+			Fingerprint: hex.EncodeToString(fingerprint[:]),
+			Policy:      hex.EncodeToString(policy),
+			Signature:   base64.StdEncoding.EncodeToString(sig),
+		})
+	}
+	return json.Marshal(map[string][]pcrSignature{"sha256": signatures})
+}
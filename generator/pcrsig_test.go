@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPredictUKIPCR(t *testing.T) {
+	image, err := peAddSections(testPEImage(), []peSection{
+		{".osrel", []byte("ID=arch\n")},
+		{".cmdline", []byte("quiet")},
+		{".linux", []byte("kernel")},
+	})
+	require.NoError(t, err)
+
+	expected := make([]byte, 32)
+	for _, data := range []string{".linux\x00", "kernel", ".osrel\x00", "ID=arch\n", ".cmdline\x00", "quiet"} {
+		expected = pcrExtend(expected, []byte(data))
+	}
+	pcr, err := predictUKIPCR(image, "")
+	require.NoError(t, err)
+	require.Equal(t, expected, pcr)
+
+	for _, word := range []string{"enter-initrd", "leave-initrd"} {
+		expected = pcrExtend(expected, []byte(word))
+	}
+	pcr, err = predictUKIPCR(image, "enter-initrd:leave-initrd")
+	require.NoError(t, err)
+	require.Equal(t, expected, pcr)
+}
+
+func TestPCRPolicyDigest(t *testing.T) {
+	value := sha256.Sum256([]byte("pcr value"))
+	digest := sha256.Sum256(value[:])
+
+	calc, err := tpm2.NewPolicyCalculator(tpm2.TPMAlgSHA256)
+	require.NoError(t, err)
+	policy := tpm2.PolicyPCR{
+		PcrDigest: tpm2.TPM2BDigest{Buffer: digest[:]},
+		Pcrs: tpm2.TPMLPCRSelection{PCRSelections: []tpm2.TPMSPCRSelection{
+			{Hash: tpm2.TPMAlgSHA256, PCRSelect: []byte{0x00, 0x08, 0x00}},
+		}},
+	}
+	require.NoError(t, policy.Update(calc))
+	require.Equal(t, calc.Hash().Digest, pcrPolicyDigest(11, value[:]))
+}
+
+func TestUKIPCRSignature(t *testing.T) {
+	keyFile, _ := testSigningKeys(t, t.TempDir())
+	key, err := readRSAPrivateKey(keyFile)
+	require.NoError(t, err)
+
+	pub, err := pcrPublicKey(key)
+	require.NoError(t, err)
+	image, err := peAddSections(testPEImage(), []peSection{{".pcrpkey", pub}, {".linux", []byte("kernel")}})
+	require.NoError(t, err)
+
+	data, err := ukiPCRSignature(image, key, []string{"", "enter-initrd"})
+	require.NoError(t, err)
+	var content map[string][]pcrSignature
+	require.NoError(t, json.Unmarshal(data, &content))
+	require.Len(t, content["sha256"], 2)
+
+	block, _ := pem.Decode(pub)
+	fingerprint := sha256.Sum256(block.Bytes)
+	for i, phase := range []string{"", "enter-initrd"} {
+		s := content["sha256"][i]
+		require.Equal(t, []int{11}, s.PCRs)
+		require.Equal(t, hex.EncodeToString(fingerprint[:]), s.Fingerprint)
+
+		pcr, err := predictUKIPCR(image, phase)
+		require.NoError(t, err)
+		policy := pcrPolicyDigest(11, pcr)
+		require.Equal(t, hex.EncodeToString(policy), s.Policy)
+
+		sig, err := base64.StdEncoding.DecodeString(s.Signature)
+		require.NoError(t, err)
+		pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		require.NoError(t, err)
+		digest := sha256.Sum256(policy)
+		require.NoError(t, rsa.VerifyPKCS1v15(pubKey.(*rsa.PublicKey), crypto.SHA256, digest[:], sig))
+	}
+
+	_, err = readRSAPrivateKey(filepath.Join(t.TempDir(), "nonexistent"))
+	require.Error(t, err)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Minimal PE/COFF editing needed to assemble a unified kernel image: new sections are appended to the EFI stub
+// the same way 'objcopy --add-section' does it. See https://learn.microsoft.com/en-us/windows/win32/debug/pe-format
+
+const (
+	peSectionHeaderSize  = 40
+	peScnInitializedData = 0x00000040
+	peScnMemRead         = 0x40000000
+
+	pe32Magic     = 0x10b
+	pe32PlusMagic = 0x20b
+)
+
+type peSection struct {
+	name string // up to 8 characters, e.g. .linux
+	data []byte
+}
+
+func alignUp(v, align uint32) uint32 {
+	return (v + align - 1) / align * align
+}
+
+// peHeader contains offsets and values of the PE headers fields
+type peHeader struct {
+	coff, opt        int // offsets of the COFF and optional headers
+	sectionTable     int
+	numSections      int
+	dataDirs         int // offset of the data directories
+	numDataDirs      int
+	sectionAlignment uint32
+	fileAlignment    uint32
+	sizeOfHeaders    int
+}
+
+func parsePEHeader(image []byte) (*peHeader, error) {
+	if len(image) < 0x40 || image[0] != 'M' || image[1] != 'Z' {
+		return nil, fmt.Errorf("not a PE image")
+	}
+	peOffset := int(binary.LittleEndian.Uint32(image[0x3c:]))
+	if peOffset+24 > len(image) || !bytes.Equal(image[peOffset:peOffset+4], []byte("PE\x00\x00")) {
+		return nil, fmt.Errorf("PE signature is not found")
+	}
+	h := &peHeader{coff: peOffset + 4}
+	h.numSections = int(binary.LittleEndian.Uint16(image[h.coff+2:]))
+	optSize := int(binary.LittleEndian.Uint16(image[h.coff+16:]))
+	h.opt = h.coff + 20
+	h.sectionTable = h.opt + optSize
+	if h.sectionTable+h.numSections*peSectionHeaderSize > len(image) {
+		return nil, fmt.Errorf("PE headers are truncated")
+	}
+
+	switch magic := binary.LittleEndian.Uint16(image[h.opt:]); magic {
+	case pe32Magic:
+		h.dataDirs = h.opt + 96
+	case pe32PlusMagic:
+		h.dataDirs = h.opt + 112
+	default:
+		return nil, fmt.Errorf("unknown PE optional header magic 0x%x", magic)
+	}
+	h.numDataDirs = int(binary.LittleEndian.Uint32(image[h.dataDirs-4:]))
+	if h.dataDirs+h.numDataDirs*8 > h.sectionTable {
+		return nil, fmt.Errorf("PE data directories are truncated")
+	}
+	h.sectionAlignment = binary.LittleEndian.Uint32(image[h.opt+32:])
+	h.fileAlignment = binary.LittleEndian.Uint32(image[h.opt+36:])
+	h.sizeOfHeaders = int(binary.LittleEndian.Uint32(image[h.opt+60:]))
+	if h.sectionAlignment == 0 || h.fileAlignment == 0 {
+		return nil, fmt.Errorf("invalid PE alignment")
+	}
+	if h.sizeOfHeaders > len(image) {
+		return nil, fmt.Errorf("PE headers are truncated")
+	}
+	return h, nil
+}
+
+func (h *peHeader) checksumOffset() int {
+	return h.opt + 64
+}
+
+// securityDirOffset returns the offset of the data directory entry that points to the Authenticode signatures
+func (h *peHeader) securityDirOffset() (int, bool) {
+	const securityDirIndex = 4
+	if h.numDataDirs <= securityDirIndex {
+		return 0, false
+	}
+	return h.dataDirs + securityDirIndex*8, true
+}
+
+// sectionsEnd returns the end of the sections in memory and in the file
+func (h *peHeader) sectionsEnd(image []byte) (vaEnd, fileEnd uint32) {
+	for i := 0; i < h.numSections; i++ {
+		hdr := image[h.sectionTable+i*peSectionHeaderSize:]
+		virtualSize := binary.LittleEndian.Uint32(hdr[8:])
+		va := binary.LittleEndian.Uint32(hdr[12:])
+		rawSize := binary.LittleEndian.Uint32(hdr[16:])
+		rawPtr := binary.LittleEndian.Uint32(hdr[20:])
+		if virtualSize < rawSize {
+			virtualSize = rawSize
+		}
+		if va+virtualSize > vaEnd {
+			vaEnd = va + virtualSize
+		}
+		if rawPtr+rawSize > fileEnd {
+			fileEnd = rawPtr + rawSize
+		}
+	}
+	return
+}
+
+// peAddSections returns a copy of the PE image with the sections appended. The Authenticode signature of the image
+// (if any) is dropped as it does not match the new content.
+func peAddSections(image []byte, sections []peSection) ([]byte, error) {
+	h, err := parsePEHeader(image)
+	if err != nil {
+		return nil, err
+	}
+	if h.sectionTable+(h.numSections+len(sections))*peSectionHeaderSize > h.sizeOfHeaders {
+		return nil, fmt.Errorf("no room for %d more section headers", len(sections))
+	}
+
+	// the new sections go after the existing ones both in memory and in the file
+	vaEnd, fileEnd := h.sectionsEnd(image)
+	if int(fileEnd) > len(image) {
+		return nil, fmt.Errorf("PE sections are truncated")
+	}
+
+	// everything after the sections (e.g. the signature) is dropped
+	out := make([]byte, alignUp(fileEnd, h.fileAlignment))
+	copy(out, image[:fileEnd])
+	if dir, ok := h.securityDirOffset(); ok {
+		binary.LittleEndian.PutUint64(out[dir:], 0)
+	}
+
+	var initializedData uint32
+	for i, s := range sections {
+		if len(s.name) > 8 {
+			return nil, fmt.Errorf("section name %s is too long", s.name)
+		}
+		va := alignUp(vaEnd, h.sectionAlignment)
+		rawSize := alignUp(uint32(len(s.data)), h.fileAlignment)
+
+		hdr := out[h.sectionTable+(h.numSections+i)*peSectionHeaderSize:][:peSectionHeaderSize]
+		copy(hdr, make([]byte, peSectionHeaderSize))
+		copy(hdr, s.name)
+		binary.LittleEndian.PutUint32(hdr[8:], uint32(len(s.data)))
+		binary.LittleEndian.PutUint32(hdr[12:], va)
+		binary.LittleEndian.PutUint32(hdr[16:], rawSize)
+		binary.LittleEndian.PutUint32(hdr[20:], uint32(len(out)))
+		binary.LittleEndian.PutUint32(hdr[36:], peScnInitializedData|peScnMemRead)
+
+		out = append(out, s.data...)
+		out = append(out, make([]byte, int(rawSize)-len(s.data))...)
+		vaEnd = va + uint32(len(s.data))
+		initializedData += rawSize
+	}
+
+	binary.LittleEndian.PutUint16(out[h.coff+2:], uint16(h.numSections+len(sections)))
+	binary.LittleEndian.PutUint32(out[h.opt+8:], binary.LittleEndian.Uint32(out[h.opt+8:])+initializedData)
+	binary.LittleEndian.PutUint32(out[h.opt+56:], alignUp(vaEnd, h.sectionAlignment))
+	binary.LittleEndian.PutUint32(out[h.checksumOffset():], peChecksum(out, h.checksumOffset()))
+	return out, nil
+}
+
+// peChecksum computes the image checksum the same way as MapFileAndCheckSum does
+func peChecksum(data []byte, checksumOffset int) uint32 {
+	var sum uint32
+	for i := 0; i < len(data); i += 2 {
+		if i == checksumOffset || i == checksumOffset+2 {
+			continue
+		}
+		var w uint32
+		if i+1 < len(data) {
+			w = uint32(binary.LittleEndian.Uint16(data[i:]))
+		} else {
+			w = uint32(data[i])
+		}
+		sum += w
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	sum = (sum & 0xffff) + (sum >> 16)
+	return sum + uint32(len(data))
+}
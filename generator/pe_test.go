@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testPEImage returns a minimal PE32+ image with a single .text section
+func testPEImage() []byte {
+	const fileAlignment, sectionAlignment, sizeOfHeaders = 0x200, 0x1000, 0x400
+	image := make([]byte, sizeOfHeaders+fileAlignment)
+	image[0], image[1] = 'M', 'Z'
+	binary.LittleEndian.PutUint32(image[0x3c:], 0x80)
+	copy(image[0x80:], "PE\x00\x00")
+
+	coff := 0x84
+	binary.LittleEndian.PutUint16(image[coff:], 0x8664) // machine
+	binary.LittleEndian.PutUint16(image[coff+2:], 1)    // number of sections
+	binary.LittleEndian.PutUint16(image[coff+16:], 240) // optional header size
+	binary.LittleEndian.PutUint16(image[coff+18:], 0x22)
+
+	opt := coff + 20
+	binary.LittleEndian.PutUint16(image[opt:], pe32PlusMagic)
+	binary.LittleEndian.PutUint32(image[opt+32:], sectionAlignment)
+	binary.LittleEndian.PutUint32(image[opt+36:], fileAlignment)
+	binary.LittleEndian.PutUint32(image[opt+56:], 2*sectionAlignment)
+	binary.LittleEndian.PutUint32(image[opt+60:], sizeOfHeaders)
+	binary.LittleEndian.PutUint16(image[opt+68:], 10) // EFI application
+	binary.LittleEndian.PutUint32(image[opt+108:], 16)
+
+	text := image[opt+240:]
+	copy(text, ".text")
+	binary.LittleEndian.PutUint32(text[8:], 5)
+	binary.LittleEndian.PutUint32(text[12:], sectionAlignment)
+	binary.LittleEndian.PutUint32(text[16:], fileAlignment)
+	binary.LittleEndian.PutUint32(text[20:], sizeOfHeaders)
+	binary.LittleEndian.PutUint32(text[36:], 0x60000020)
+	copy(image[sizeOfHeaders:], "stub!")
+
+	// the signature that must be dropped
+	return append(image, []byte("certificate")...)
+}
+
+func TestPEAddSections(t *testing.T) {
+	out, err := peAddSections(testPEImage(), []peSection{
+		{".cmdline", []byte("root=/dev/sda2 rw")},
+		{".linux", bytes.Repeat([]byte{0xaa}, 0x1234)},
+	})
+	require.NoError(t, err)
+	require.Zero(t, len(out)%0x200)
+
+	f, err := pe.NewFile(bytes.NewReader(out))
+	require.NoError(t, err)
+	require.Len(t, f.Sections, 3)
+
+	read := func(name string) []byte {
+		s := f.Section(name)
+		require.NotNil(t, s, name)
+		data, err := io.ReadAll(s.Open())
+		require.NoError(t, err)
+		return data[:s.VirtualSize]
+	}
+	require.Equal(t, []byte("stub!"), read(".text"))
+	require.Equal(t, []byte("root=/dev/sda2 rw"), read(".cmdline"))
+	require.Equal(t, bytes.Repeat([]byte{0xaa}, 0x1234), read(".linux"))
+
+	require.Equal(t, uint32(0x2000), f.Section(".cmdline").VirtualAddress)
+	require.Equal(t, uint32(0x3000), f.Section(".linux").VirtualAddress)
+	opt := f.OptionalHeader.(*pe.OptionalHeader64)
+	require.Equal(t, uint32(0x5000), opt.SizeOfImage)
+	require.Equal(t, peChecksum(out, 0x84+20+64), opt.CheckSum)
+
+	_, err = peAddSections([]byte("not a PE file, definitely not a PE file, really not a PE file!!!"), nil)
+	require.Error(t, err)
+	_, err = peAddSections(testPEImage(), []peSection{{".toolongname", nil}})
+	require.Error(t, err)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var (
+	plymouthConfigFile   = "/etc/plymouth/plymouthd.conf"
+	plymouthDefaultsFile = "/usr/share/plymouth/plymouthd.defaults"
+	plymouthThemesDir    = "/usr/share/plymouth/themes"
+	// plymouth plugins location differs between distros
+	plymouthPluginsDirs = []string{"/usr/lib/plymouth", "/usr/lib64/plymouth", "/usr/lib/x86_64-linux-gnu/plymouth", "/usr/lib/aarch64-linux-gnu/plymouth"}
+)
+
+// plymouthTheme returns the splash theme configured at the host
+func plymouthTheme() (string, error) {
+	for _, f := range []string{plymouthConfigFile, plymouthDefaultsFile} {
+		data, err := os.ReadFile(f)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if theme := parseProperties(string(data), true)["Theme"]; theme != "" {
+			return theme, nil
+		}
+	}
+	return "", fmt.Errorf("plymouth theme is not configured in %s", plymouthConfigFile)
+}
+
+// appendPlymouth adds plymouth daemon, its plugins and the configured theme to the image
+func (img *Image) appendPlymouth() error {
+	if err := img.appendExtraFiles("plymouthd", "plymouth"); err != nil {
+		return fmt.Errorf("plymouth: %v", err)
+	}
+
+	for _, f := range []string{plymouthConfigFile, plymouthDefaultsFile} {
+		if _, err := os.Stat(f); err == nil {
+			if err := img.AppendFile(f); err != nil {
+				return err
+			}
+		}
+	}
+
+	pluginsFound := false
+	for _, d := range plymouthPluginsDirs {
+		if _, err := os.Stat(d); err != nil {
+			continue
+		}
+		pluginsFound = true
+		// renderers (drm, frame-buffer) and the theme plugins, the libraries they depend on are added as well
+		if err := img.AppendFile(d); err != nil {
+			return err
+		}
+	}
+	if !pluginsFound {
+		return fmt.Errorf("plymouth plugins directory is not found")
+	}
+
+	theme, err := plymouthTheme()
+	if err != nil {
+		return err
+	}
+	debug("adding plymouth theme %s", theme)
+	// 'details' and 'text' themes are used as a fallback if the graphical theme cannot be shown
+	for _, t := range []string{theme, "details", "text"} {
+		dir := filepath.Join(plymouthThemesDir, t)
+		if _, err := os.Stat(dir); err != nil {
+			if t == theme {
+				return fmt.Errorf("plymouth theme %s: %v", theme, err)
+			}
+			continue
+		}
+		if err := img.AppendFile(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
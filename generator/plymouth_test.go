@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlymouthTheme(t *testing.T) {
+	dir := t.TempDir()
+	defer func(config, defaults string) {
+		plymouthConfigFile, plymouthDefaultsFile = config, defaults
+	}(plymouthConfigFile, plymouthDefaultsFile)
+	plymouthConfigFile = filepath.Join(dir, "plymouthd.conf")
+	plymouthDefaultsFile = filepath.Join(dir, "plymouthd.defaults")
+
+	_, err := plymouthTheme()
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(plymouthDefaultsFile, []byte("[Daemon]\nTheme=bgrt\nShowDelay=0\n"), 0o644))
+	theme, err := plymouthTheme()
+	require.NoError(t, err)
+	require.Equal(t, "bgrt", theme)
+
+	// the host config overrides the distro defaults
+	require.NoError(t, os.WriteFile(plymouthConfigFile, []byte("[Daemon]\nTheme=spinner\n"), 0o644))
+	theme, err = plymouthTheme()
+	require.NoError(t, err)
+	require.Equal(t, "spinner", theme)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/cavaliergopher/cpio"
+)
+
+// parseRescueTools parses 'rescue_tools' config option. 'true' means busybox, otherwise it is a comma-separated list of binaries.
+func parseRescueTools(value string) []string {
+	switch value {
+	case "", "false":
+		return nil
+	case "true":
+		return []string{"busybox"}
+	}
+	return strings.Split(value, ",")
+}
+
+// busyboxApplets returns names of the applets compiled into the busybox binary
+func busyboxApplets(busybox string) ([]string, error) {
+	out, err := exec.Command(busybox, "--list").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s --list: %v", busybox, unwrapExitError(err))
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// appendRescueTools adds the binaries together with the libraries they depend on to the image. The binaries
+// (and busybox applets) are linked to rescueToolsDir that init adds to PATH of the emergency shell.
+func (img *Image) appendRescueTools(tools []string) error {
+	linked := make(set)
+	link := func(name, target string) error {
+		if linked[name] {
+			return nil
+		}
+		linked[name] = true
+		mode := cpio.FileMode(0o777) | cpio.TypeSymlink
+		return img.AppendEntry(filepath.Join(rescueToolsDir, name), mode, []byte(target))
+	}
+
+	for _, t := range tools {
+		path := t
+		if !filepath.IsAbs(path) {
+			var err error
+			path, err = lookupPath(t)
+			if err != nil {
+				return err
+			}
+		}
+		if err := img.AppendFile(path); err != nil {
+			return err
+		}
+		name := filepath.Base(path)
+		if err := link(name, path); err != nil {
+			return err
+		}
+
+		if name != "busybox" {
+			continue
+		}
+		applets, err := busyboxApplets(path)
+		if err != nil {
+			return err
+		}
+		debug("adding %d busybox applets to the rescue tools", len(applets))
+		for _, a := range applets {
+			if err := link(a, path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
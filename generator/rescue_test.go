@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBusyboxApplets(t *testing.T) {
+	busybox := filepath.Join(t.TempDir(), "busybox")
+	require.NoError(t, os.WriteFile(busybox, []byte("#!/bin/sh\n[ \"$1\" = --list ] && printf 'ash\\nls\\nvi\\n'\n"), 0o755))
+
+	applets, err := busyboxApplets(busybox)
+	require.NoError(t, err)
+	require.Equal(t, []string{"ash", "ls", "vi"}, applets)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/google/renameio/v2"
+)
+
+// Secure Boot signing of EFI binaries with Authenticode signatures, the same signatures sbsign creates.
+// See "Windows Authenticode Portable Executable Signature Format" for the details.
+
+type secureBootUserConfig struct {
+	Key          string `yaml:"key"`                     // PEM encoded RSA private key
+	Cert         string `yaml:"cert"`                    // PEM encoded certificate enrolled to the db
+	KernelOutput string `yaml:"kernel_output,omitempty"` // if set then a signed copy of the kernel is written there
+}
+
+var (
+	oidSHA256             = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSignedData         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSpcIndirectData    = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+	oidSpcSpOpusInfo      = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 12}
+	oidSpcPeImageData     = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 15}
+	winCertRevision2      = uint16(0x0200)
+	winCertTypePKCSSigned = uint16(0x0002)
+)
+
+// derTLV encodes the content with the given tag
+func derTLV(tag byte, content ...[]byte) []byte {
+	var n int
+	for _, c := range content {
+		n += len(c)
+	}
+	out := []byte{tag}
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	case n < 0x10000:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	for _, c := range content {
+		out = append(out, c...)
+	}
+	return out
+}
+
+func derSequence(content ...[]byte) []byte { return derTLV(0x30, content...) }
+func derSet(content ...[]byte) []byte      { return derTLV(0x31, content...) }
+
+func derOID(oid asn1.ObjectIdentifier) []byte {
+	b, _ := asn1.Marshal(oid)
+	return b
+}
+
+func derAlgorithm(oid asn1.ObjectIdentifier) []byte {
+	return derSequence(derOID(oid), []byte{0x05, 0x00})
+}
+
+// authenticodeDigest computes the sha256 image hash. The checksum, the security directory entry and the signatures are
+// excluded from the hash, the sections are hashed in the file order.
+func authenticodeDigest(image []byte) ([]byte, error) {
+	h, err := parsePEHeader(image)
+	if err != nil {
+		return nil, err
+	}
+	secDir, ok := h.securityDirOffset()
+	if !ok {
+		return nil, fmt.Errorf("PE image has no security directory")
+	}
+	certOffset := int(binary.LittleEndian.Uint32(image[secDir:]))
+	certSize := int(binary.LittleEndian.Uint32(image[secDir+4:]))
+	if certSize == 0 {
+		certOffset = len(image)
+	}
+	if certOffset+certSize > len(image) {
+		return nil, fmt.Errorf("PE signatures are truncated")
+	}
+
+	d := sha256.New()
+	d.Write(image[:h.checksumOffset()])
+	d.Write(image[h.checksumOffset()+4 : secDir])
+	d.Write(image[secDir+8 : h.sizeOfHeaders])
+
+	type region struct{ offset, size int }
+	var sections []region
+	for i := 0; i < h.numSections; i++ {
+		hdr := image[h.sectionTable+i*peSectionHeaderSize:]
+		size := int(binary.LittleEndian.Uint32(hdr[16:]))
+		offset := int(binary.LittleEndian.Uint32(hdr[20:]))
+		if size == 0 {
+			continue
+		}
+		if offset+size > certOffset {
+			return nil, fmt.Errorf("PE section %d is truncated", i)
+		}
+		sections = append(sections, region{offset, size})
+	}
+	sort.Slice(sections, func(i, j int) bool { return sections[i].offset < sections[j].offset })
+
+	hashed := h.sizeOfHeaders
+	for _, s := range sections {
+		d.Write(image[s.offset : s.offset+s.size])
+		hashed = s.offset + s.size
+	}
+	// data after the sections except the signatures
+	if hashed < certOffset {
+		d.Write(image[hashed:certOffset])
+	}
+	return d.Sum(nil), nil
+}
+
+// authenticodeSignedData creates PKCS#7 SignedData with SpcIndirectDataContent for the image digest
+func authenticodeSignedData(digest []byte, key *rsa.PrivateKey, cert *x509.Certificate) ([]byte, error) {
+	// SpcPeImageData with the obsolete file link, the same as signtool and sbsign put there
+	obsolete := []byte{0x00, '<', 0x00, '<', 0x00, '<', 0x00, 'O', 0x00, 'b', 0x00, 's', 0x00, 'o', 0x00, 'l', 0x00, 'e', 0x00, 't', 0x00, 'e', 0x00, '>', 0x00, '>', 0x00, '>'}
+	peImageData := derSequence(
+		[]byte{0x03, 0x01, 0x00}, // flags, an empty bit string
+		derTLV(0xa0, derTLV(0xa2, derTLV(0x80, obsolete))),
+	)
+	indirectData := derSequence(
+		derSequence(derOID(oidSpcPeImageData), peImageData),
+		derSequence(derAlgorithm(oidSHA256), derTLV(0x04, digest)),
+	)
+
+	// the content hash covers SpcIndirectDataContent without its tag and length
+	content, err := derContent(indirectData)
+	if err != nil {
+		return nil, err
+	}
+	contentDigest := sha256.Sum256(content)
+
+	attrs := [][]byte{
+		derSequence(derOID(oidContentType), derSet(derOID(oidSpcIndirectData))),
+		derSequence(derOID(oidSpcSpOpusInfo), derSet(derSequence())),
+		derSequence(derOID(oidMessageDigest), derSet(derTLV(0x04, contentDigest[:]))),
+	}
+	// the attributes are signed as a SET and embedded as [0] IMPLICIT
+	attrsDigest := sha256.Sum256(derSet(attrs...))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, attrsDigest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := asn1.Marshal(cert.SerialNumber)
+	if err != nil {
+		return nil, err
+	}
+	signerInfo := derSequence(
+		[]byte{0x02, 0x01, 0x01}, // version
+		derSequence(cert.RawIssuer, serial),
+		derAlgorithm(oidSHA256),
+		derTLV(0xa0, attrs...),
+		derAlgorithm(oidRSAEncryption),
+		derTLV(0x04, signature),
+	)
+	signedData := derSequence(
+		[]byte{0x02, 0x01, 0x01}, // version
+		derSet(derAlgorithm(oidSHA256)),
+		derSequence(derOID(oidSpcIndirectData), derTLV(0xa0, indirectData)),
+		derTLV(0xa0, cert.Raw),
+		derSet(signerInfo),
+	)
+	return derSequence(derOID(oidSignedData), derTLV(0xa0, signedData)), nil
+}
+
+// derContent returns the content of a DER encoded value
+func derContent(der []byte) ([]byte, error) {
+	var v asn1.RawValue
+	if _, err := asn1.Unmarshal(der, &v); err != nil {
+		return nil, err
+	}
+	return v.Bytes, nil
+}
+
+// signPE returns the image with an Authenticode signature, existing signatures are replaced
+func signPE(image []byte, key *rsa.PrivateKey, cert *x509.Certificate) ([]byte, error) {
+	h, err := parsePEHeader(image)
+	if err != nil {
+		return nil, err
+	}
+	secDir, ok := h.securityDirOffset()
+	if !ok {
+		return nil, fmt.Errorf("PE image has no security directory")
+	}
+
+	out := make([]byte, len(image))
+	copy(out, image)
+	if certSize := binary.LittleEndian.Uint32(out[secDir+4:]); certSize != 0 {
+		certOffset := binary.LittleEndian.Uint32(out[secDir:])
+		if int(certOffset) > len(out) {
+			return nil, fmt.Errorf("PE signatures are truncated")
+		}
+		out = out[:certOffset]
+		binary.LittleEndian.PutUint64(out[secDir:], 0)
+	}
+	// the signature table is 8 bytes aligned
+	out = append(out, make([]byte, int(alignUp(uint32(len(out)), 8))-len(out))...)
+
+	digest, err := authenticodeDigest(out)
+	if err != nil {
+		return nil, err
+	}
+	signedData, err := authenticodeSignedData(digest, key, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	// WIN_CERTIFICATE structure
+	certSize := alignUp(uint32(8+len(signedData)), 8)
+	winCert := make([]byte, certSize)
+	binary.LittleEndian.PutUint32(winCert[0:], certSize)
+	binary.LittleEndian.PutUint16(winCert[4:], winCertRevision2)
+	binary.LittleEndian.PutUint16(winCert[6:], winCertTypePKCSSigned)
+	copy(winCert[8:], signedData)
+
+	binary.LittleEndian.PutUint32(out[secDir:], uint32(len(out)))
+	binary.LittleEndian.PutUint32(out[secDir+4:], certSize)
+	out = append(out, winCert...)
+	binary.LittleEndian.PutUint32(out[h.checksumOffset():], peChecksum(out, h.checksumOffset()))
+	return out, nil
+}
+
+// readRSAPrivateKey reads PEM encoded RSA private key in PKCS#1 or PKCS#8 format
+func readRSAPrivateKey(keyFile string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: key is not PEM encoded", keyFile)
+	}
+	var key interface{}
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", keyFile, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type %T, only RSA keys are supported", keyFile, key)
+	}
+	return rsaKey, nil
+}
+
+// readSigningKeys reads the RSA private key and the certificate used to sign EFI binaries
+func readSigningKeys(keyFile, certFile string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	rsaKey, err := readRSAPrivateKey(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, nil, fmt.Errorf("%s: certificate is not PEM encoded", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", certFile, err)
+	}
+	if !rsaKey.PublicKey.Equal(cert.PublicKey) {
+		return nil, nil, fmt.Errorf("%s does not match the key %s", certFile, keyFile)
+	}
+	return rsaKey, cert, nil
+}
+
+// signEfiImage signs the EFI binary with the configured key
+func signEfiImage(image []byte, conf *secureBootUserConfig) ([]byte, error) {
+	key, cert, err := readSigningKeys(conf.Key, conf.Cert)
+	if err != nil {
+		return nil, err
+	}
+	return signPE(image, key, cert)
+}
+
+// signKernel writes the signed copy of the kernel the image is generated for
+func signKernel(conf *generatorConfig) error {
+	kernel := ""
+	if conf.uki != nil {
+		kernel = conf.uki.Kernel
+	}
+	if kernel == "" {
+		var err error
+		kernel, err = hostKernelImage(conf.kernelVersion)
+		if err != nil {
+			return err
+		}
+	}
+	image, err := os.ReadFile(kernel)
+	if err != nil {
+		return err
+	}
+	signed, err := signEfiImage(image, conf.secureBoot)
+	if err != nil {
+		return fmt.Errorf("%s: %v", kernel, err)
+	}
+	return renameio.WriteFile(conf.secureBoot.KernelOutput, signed, 0o644)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"debug/pe"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testSigningKeys writes a self-signed certificate and its key to dir
+func testSigningKeys(t *testing.T, dir string) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(0x1234),
+		Subject:      pkix.Name{CommonName: "booster test db key"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyFile, certFile := filepath.Join(dir, "db.key"), filepath.Join(dir, "db.crt")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600))
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644))
+	return keyFile, certFile
+}
+
+// verifyAuthenticode checks that the PKCS#7 signature is made for the image digest
+func verifyAuthenticode(t *testing.T, der, digest []byte, cert *x509.Certificate) {
+	var contentInfo struct {
+		Type    asn1.ObjectIdentifier
+		Content asn1.RawValue `asn1:"explicit,tag:0"`
+	}
+	_, err := asn1.Unmarshal(der, &contentInfo)
+	require.NoError(t, err)
+	require.Equal(t, oidSignedData, contentInfo.Type)
+
+	var signedData struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      struct {
+			Type    asn1.ObjectIdentifier
+			Content asn1.RawValue `asn1:"explicit,tag:0"`
+		}
+		Certificates asn1.RawValue `asn1:"tag:0"`
+		SignerInfos  []struct {
+			Version            int
+			IssuerAndSerial    asn1.RawValue
+			DigestAlgorithm    asn1.RawValue
+			Attributes         asn1.RawValue `asn1:"tag:0"`
+			SignatureAlgorithm asn1.RawValue
+			Signature          []byte
+		} `asn1:"set"`
+	}
+	_, err = asn1.Unmarshal(contentInfo.Content.Bytes, &signedData)
+	require.NoError(t, err)
+	require.Equal(t, oidSpcIndirectData, signedData.ContentInfo.Type)
+	require.Equal(t, cert.Raw, signedData.Certificates.Bytes)
+	require.Len(t, signedData.SignerInfos, 1)
+
+	// SpcIndirectDataContent ends with the image digest
+	indirectData, err := derContent(signedData.ContentInfo.Content.Bytes)
+	require.NoError(t, err)
+	require.True(t, bytes.HasSuffix(indirectData, digest))
+
+	signer := signedData.SignerInfos[0]
+	contentDigest := sha256.Sum256(indirectData)
+	require.True(t, bytes.Contains(signer.Attributes.Bytes, contentDigest[:]))
+
+	attrs := append([]byte{0x31}, signer.Attributes.FullBytes[1:]...)
+	attrsDigest := sha256.Sum256(attrs)
+	require.NoError(t, rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, attrsDigest[:], signer.Signature))
+}
+
+func TestSignPE(t *testing.T) {
+	keyFile, certFile := testSigningKeys(t, t.TempDir())
+	key, cert, err := readSigningKeys(keyFile, certFile)
+	require.NoError(t, err)
+
+	image, err := peAddSections(testPEImage(), []peSection{{".linux", []byte("kernel")}})
+	require.NoError(t, err)
+	digest, err := authenticodeDigest(image)
+	require.NoError(t, err)
+
+	signed, err := signPE(image, key, cert)
+	require.NoError(t, err)
+
+	f, err := pe.NewFile(bytes.NewReader(signed))
+	require.NoError(t, err)
+	secDir := f.OptionalHeader.(*pe.OptionalHeader64).DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]
+	require.Equal(t, uint32(len(signed)), secDir.VirtualAddress+secDir.Size)
+	require.Zero(t, secDir.VirtualAddress%8)
+
+	winCert := signed[secDir.VirtualAddress:]
+	require.Equal(t, secDir.Size, binary.LittleEndian.Uint32(winCert))
+	require.Equal(t, winCertRevision2, binary.LittleEndian.Uint16(winCert[4:]))
+	require.Equal(t, winCertTypePKCSSigned, binary.LittleEndian.Uint16(winCert[6:]))
+	verifyAuthenticode(t, winCert[8:], digest, cert)
+
+	// the signature does not change the image hash
+	signedDigest, err := authenticodeDigest(signed)
+	require.NoError(t, err)
+	require.Equal(t, digest, signedDigest)
+
+	// signing again replaces the signature
+	resigned, err := signPE(signed, key, cert)
+	require.NoError(t, err)
+	require.Equal(t, len(signed), len(resigned))
+}
+
+func TestReadSigningKeysMismatch(t *testing.T) {
+	keyFile, _ := testSigningKeys(t, t.TempDir())
+	_, certFile := testSigningKeys(t, t.TempDir())
+	_, _, err := readSigningKeys(keyFile, certFile)
+	require.Error(t, err)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultSSHAuthorizedKeysPath = "/etc/booster/authorized_keys"
+	defaultSSHHostKeyPath        = "/etc/booster/ssh_host_ed25519_key"
+)
+
+// readAuthorizedKeys reads authorized_keys file and checks that it contains valid keys
+func readAuthorizedKeys(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var numKeys int
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, _, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if len(options) > 0 {
+			// the restrictions like from= or command= would be silently lost at boot
+			return nil, fmt.Errorf("%s: key %s has options %v, booster SSH server does not support key options", file, ssh.FingerprintSHA256(key), options)
+		}
+		numKeys++
+	}
+	if numKeys == 0 {
+		return nil, fmt.Errorf("%s: no keys found", file)
+	}
+	return data, nil
+}
+
+// readSSHHostKey reads the host key of the SSH server. If the key does not exist then a new ed25519 key is generated
+// and saved so the server keeps the same fingerprint every time the image is regenerated.
+func readSSHHostKey(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err == nil {
+		if _, err := ssh.ParsePrivateKey(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		return data, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Generated SSH host key %s with fingerprint %s\n", file, ssh.FingerprintSHA256(signer.PublicKey()))
+	return data, nil
+}
+
+// appendSSHKeys adds the keys used by the remote unlock SSH server to the image
+func (img *Image) appendSSHKeys(conf *generatorConfig) error {
+	authorizedKeys, err := readAuthorizedKeys(conf.sshAuthorizedKeysPath)
+	if err != nil {
+		return err
+	}
+	hostKey, err := readSSHHostKey(conf.sshHostKeyPath)
+	if err != nil {
+		return err
+	}
+
+	if err := img.AppendContent(sshAuthorizedKeysPath, 0o644, authorizedKeys); err != nil {
+		return err
+	}
+	return img.AppendContent(sshHostKeyPath, 0o600, hostKey)
+}
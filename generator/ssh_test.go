@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestReadSSHHostKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "booster", "ssh_host_ed25519_key")
+
+	// the key is generated at the first run and reused later
+	generated, err := readSSHHostKey(file)
+	require.NoError(t, err)
+	_, err = ssh.ParsePrivateKey(generated)
+	require.NoError(t, err)
+	st, err := os.Stat(file)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), st.Mode().Perm())
+
+	key, err := readSSHHostKey(file)
+	require.NoError(t, err)
+	require.Equal(t, generated, key)
+
+	require.NoError(t, os.WriteFile(file, []byte("garbage"), 0o600))
+	_, err = readSSHHostKey(file)
+	require.Error(t, err)
+}
+
+func TestReadAuthorizedKeys(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sshPub, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+
+	file := filepath.Join(t.TempDir(), "authorized_keys")
+	content := append([]byte("# remote unlock\n"), ssh.MarshalAuthorizedKey(sshPub)...)
+	require.NoError(t, os.WriteFile(file, content, 0o644))
+	data, err := readAuthorizedKeys(file)
+	require.NoError(t, err)
+	require.Equal(t, content, data)
+
+	require.NoError(t, os.WriteFile(file, []byte("# no keys\n"), 0o644))
+	_, err = readAuthorizedKeys(file)
+	require.Error(t, err)
+
+	// key options cannot be enforced at boot
+	require.NoError(t, os.WriteFile(file, append([]byte(`from="10.0.0.0/8" `), ssh.MarshalAuthorizedKey(sshPub)...), 0o644))
+	_, err = readAuthorizedKeys(file)
+	require.ErrorContains(t, err, "does not support key options")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+)
+
+// openHostTPM opens the TPM of the machine the image is generated at
+var openHostTPM = func() (io.ReadWriteCloser, error) {
+	return tpm2.OpenTPM("/dev/tpmrm0")
+}
+
+// srkTemplate is the ECC storage root key template, it must match the template init uses to unseal the data
+var srkTemplate = tpm2.Public{
+	Type:       tpm2.AlgECC,
+	NameAlg:    tpm2.AlgSHA256,
+	Attributes: tpm2.FlagStorageDefault,
+	ECCParameters: &tpm2.ECCParams{
+		Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+		CurveID:   tpm2.CurveNISTP256,
+	},
+}
+
+// tpmSeal seals data with the host TPM against the current values of the given sha256 PCRs. It returns
+// a booster-tpm2 token (JSON) that init unseals the same way as LUKS TPM2 tokens.
+func tpmSeal(data []byte, pcrs []int) ([]byte, error) {
+	dev, err := openHostTPM()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open TPM: %v", err)
+	}
+	defer dev.Close()
+
+	sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: pcrs}
+	sess, _, err := tpm2.StartAuthSession(dev, tpm2.HandleNull, tpm2.HandleNull, make([]byte, 32), nil, tpm2.SessionTrial, tpm2.AlgNull, tpm2.AlgSHA256)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start trial session: %v", err)
+	}
+	defer tpm2.FlushContext(dev, sess)
+	if err := tpm2.PolicyPCR(dev, sess, nil, sel); err != nil {
+		return nil, fmt.Errorf("unable to bind PCRs to auth policy: %v", err)
+	}
+	policy, err := tpm2.PolicyGetDigest(dev, sess)
+	if err != nil {
+		return nil, err
+	}
+
+	srk, _, err := tpm2.CreatePrimary(dev, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", srkTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create primary key: %v", err)
+	}
+	defer tpm2.FlushContext(dev, srk)
+
+	private, public, err := tpm2.Seal(dev, srk, "", "", policy, data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to seal data: %v", err)
+	}
+
+	var blob []byte
+	blob = binary.BigEndian.AppendUint16(blob, uint16(len(private)))
+	blob = append(blob, private...)
+	blob = binary.BigEndian.AppendUint16(blob, uint16(len(public)))
+	blob = append(blob, public...)
+
+	return json.Marshal(map[string]interface{}{
+		"type":             "booster-tpm2",
+		"tpm2-blob":        base64.StdEncoding.EncodeToString(blob),
+		"tpm2-pcrs":        pcrs,
+		"tpm2-pcr-bank":    "sha256",
+		"tpm2-policy-hash": hex.EncodeToString(policy),
+	})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/google/renameio/v2"
+)
+
+// A unified kernel image (UKI) is an EFI stub with the kernel, initramfs, command line and other resources
+// embedded as PE sections, see https://uapi-group.org/specifications/specs/unified_kernel_image/
+
+type ukiUserConfig struct {
+	Stub          string   `yaml:",omitempty"`                // systemd EFI stub, default is /usr/lib/systemd/boot/efi/linux$ARCH.efi.stub
+	Kernel        string   `yaml:",omitempty"`                // kernel image, default is /usr/lib/modules/$KERNEL_VERSION/vmlinuz or /boot/vmlinuz-$KERNEL_VERSION
+	Cmdline       string   `yaml:",omitempty"`                // kernel command line, default is /etc/kernel/cmdline or the current command line
+	OsRelease     string   `yaml:"os_release,omitempty"`      // default is /etc/os-release
+	Splash        string   `yaml:",omitempty"`                // BMP image shown by the stub
+	PCRPublicKey  string   `yaml:"pcr_public_key,omitempty"`  // PEM public key that signs the PCR policies, embedded as .pcrpkey
+	PCRSignature  string   `yaml:"pcr_signature,omitempty"`   // JSON file with the signed PCR policies, embedded as .pcrsig
+	PCRPrivateKey string   `yaml:"pcr_private_key,omitempty"` // PEM RSA key that signs the predicted PCR 11 policies, the result is embedded as .pcrsig
+	PCRPhases     []string `yaml:"pcr_phases,omitempty"`      // boot phases to sign the policies for, e.g. "enter-initrd", default is the PCR value right after the stub
+}
+
+var ukiStubArch = map[string]string{
+	"amd64":   "x64",
+	"386":     "ia32",
+	"arm64":   "aa64",
+	"arm":     "arm",
+	"riscv64": "riscv64",
+}
+
+// firstExisting returns the first path that exists
+func firstExisting(paths ...string) (string, error) {
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("none of %s exist", strings.Join(paths, ", "))
+}
+
+// hostKernelImage returns the installed kernel image of the given version
+func hostKernelImage(kernelVersion string) (string, error) {
+	return firstExisting(filepath.Join(imageModulesDir, kernelVersion, "vmlinuz"), "/boot/vmlinuz-"+kernelVersion)
+}
+
+// ukiCmdline returns the command line for the image, the current command line is used without
+// parameters that belong to the bootloader
+func ukiCmdline() (string, error) {
+	if data, err := os.ReadFile("/etc/kernel/cmdline"); err == nil {
+		return strings.TrimSpace(string(data)), nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	data, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return "", err
+	}
+	return filterBootloaderParams(string(data)), nil
+}
+
+func filterBootloaderParams(cmdline string) string {
+	var params []string
+	for _, p := range strings.Fields(cmdline) {
+		if strings.HasPrefix(p, "BOOT_IMAGE=") || strings.HasPrefix(p, "initrd=") {
+			continue
+		}
+		params = append(params, p)
+	}
+	return strings.Join(params, " ")
+}
+
+// ukiSections returns the sections of the image in the order ukify adds them. pcrKey is the key that signs
+// the PCR policies, its public part is embedded if no public key is configured.
+func ukiSections(u *ukiUserConfig, kernelVersion string, initrd []byte, pcrKey *rsa.PrivateKey) ([]peSection, error) {
+	var sections []peSection
+	addFile := func(name, file string) error {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		sections = append(sections, peSection{name, data})
+		return nil
+	}
+
+	osRelease := u.OsRelease
+	if osRelease == "" {
+		var err error
+		osRelease, err = firstExisting("/etc/os-release", "/usr/lib/os-release")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := addFile(".osrel", osRelease); err != nil {
+		return nil, err
+	}
+
+	cmdline := u.Cmdline
+	if cmdline == "" {
+		var err error
+		cmdline, err = ukiCmdline()
+		if err != nil {
+			return nil, err
+		}
+	}
+	sections = append(sections, peSection{".cmdline", []byte(cmdline)})
+	sections = append(sections, peSection{".uname", []byte(kernelVersion)})
+
+	if u.Splash != "" {
+		if err := addFile(".splash", u.Splash); err != nil {
+			return nil, err
+		}
+	}
+	if u.PCRPublicKey != "" {
+		if err := addFile(".pcrpkey", u.PCRPublicKey); err != nil {
+			return nil, err
+		}
+	} else if pcrKey != nil {
+		pub, err := pcrPublicKey(pcrKey)
+		if err != nil {
+			return nil, err
+		}
+		sections = append(sections, peSection{".pcrpkey", pub})
+	}
+	if u.PCRSignature != "" {
+		if err := addFile(".pcrsig", u.PCRSignature); err != nil {
+			return nil, err
+		}
+	}
+
+	sections = append(sections, peSection{".initrd", initrd})
+
+	kernel := u.Kernel
+	if kernel == "" {
+		var err error
+		kernel, err = hostKernelImage(kernelVersion)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := addFile(".linux", kernel); err != nil {
+		return nil, err
+	}
+	return sections, nil
+}
+
+// buildUKI generates the initramfs and embeds it together with the kernel into the EFI stub
+func buildUKI(conf *generatorConfig) error {
+	if _, err := os.Stat(conf.output); (err == nil || !os.IsNotExist(err)) && !conf.forceOverwrite {
+		return fmt.Errorf("File %v exists, please specify --force if you want to overwrite it", conf.output)
+	}
+
+	dir, err := os.MkdirTemp("", "booster.uki")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	initrdConf := *conf
+	initrdConf.output = filepath.Join(dir, "initrd")
+	if err := generateInitRamfs(&initrdConf); err != nil {
+		return err
+	}
+	initrd, err := os.ReadFile(initrdConf.output)
+	if err != nil {
+		return err
+	}
+
+	var pcrKey *rsa.PrivateKey
+	if conf.uki.PCRPrivateKey != "" {
+		pcrKey, err = readRSAPrivateKey(conf.uki.PCRPrivateKey)
+		if err != nil {
+			return fmt.Errorf("uki: %v", err)
+		}
+	}
+
+	sections, err := ukiSections(conf.uki, conf.kernelVersion, initrd, pcrKey)
+	if err != nil {
+		return fmt.Errorf("uki: %v", err)
+	}
+
+	stubPath := conf.uki.Stub
+	if stubPath == "" {
+		arch, ok := ukiStubArch[runtime.GOARCH]
+		if !ok {
+			return fmt.Errorf("uki: no EFI stub for %s architecture, please specify uki.stub", runtime.GOARCH)
+		}
+		stubPath = "/usr/lib/systemd/boot/efi/linux" + arch + ".efi.stub"
+	}
+	stub, err := os.ReadFile(stubPath)
+	if err != nil {
+		return fmt.Errorf("uki: %v", err)
+	}
+	image, err := peAddSections(stub, sections)
+	if err != nil {
+		return fmt.Errorf("uki: %s: %v", stubPath, err)
+	}
+	if pcrKey != nil {
+		// the signature covers the image content that is measured, so it is added after all the other sections
+		pcrSig, err := ukiPCRSignature(image, pcrKey, conf.uki.PCRPhases)
+		if err != nil {
+			return fmt.Errorf("uki: pcr signature: %v", err)
+		}
+		image, err = peAddSections(image, []peSection{{".pcrsig", pcrSig}})
+		if err != nil {
+			return fmt.Errorf("uki: %v", err)
+		}
+	}
+	if conf.secureBoot != nil {
+		image, err = signEfiImage(image, conf.secureBoot)
+		if err != nil {
+			return fmt.Errorf("secure boot: %v", err)
+		}
+	}
+	return renameio.WriteFile(conf.output, image, 0o644)
+}
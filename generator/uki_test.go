@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterBootloaderParams(t *testing.T) {
+	require.Equal(t, "root=/dev/sda2 rw quiet", filterBootloaderParams("BOOT_IMAGE=/vmlinuz-linux root=/dev/sda2 rw initrd=\\booster-linux.img quiet\n"))
+}
+
+func TestUKISections(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(file, []byte(content), 0o644))
+		return file
+	}
+	u := &ukiUserConfig{
+		Kernel:       write("vmlinuz", "kernel"),
+		Cmdline:      "root=/dev/sda2 rw",
+		OsRelease:    write("os-release", "ID=arch\n"),
+		Splash:       write("splash.bmp", "BM"),
+		PCRPublicKey: write("pcr.pem", "public key"),
+	}
+	sections, err := ukiSections(u, "6.4.3-arch1-1", []byte("initrd"), nil)
+	require.NoError(t, err)
+	require.Equal(t, []peSection{
+		{".osrel", []byte("ID=arch\n")},
+		{".cmdline", []byte("root=/dev/sda2 rw")},
+		{".uname", []byte("6.4.3-arch1-1")},
+		{".splash", []byte("BM")},
+		{".pcrpkey", []byte("public key")},
+		{".initrd", []byte("initrd")},
+		{".linux", []byte("kernel")},
+	}, sections)
+
+	u.Kernel = filepath.Join(dir, "nonexistent")
+	_, err = ukiSections(u, "6.4.3-arch1-1", nil, nil)
+	require.Error(t, err)
+}
@@ -23,68 +23,105 @@ func processImage(file string, fn processCpioEntryFn) error {
 		return err
 	}
 
-	var img *cpio.Reader
-
-	kind, err := filetype(input)
-	if err != nil {
-		return err
-	}
+	for {
+		var img *cpio.Reader
 
-	switch kind {
-	case "cpio":
-		img = cpio.NewReader(input)
-	case "zstd":
-		zst, err := zstd.NewReader(input)
-		if err != nil {
-			return err
-		}
-		defer zst.Close()
-		img = cpio.NewReader(zst)
-	case "gzip":
-		gz, err := gzip.NewReader(input)
-		if err != nil {
-			return err
-		}
-		defer gz.Close()
-		img = cpio.NewReader(gz)
-	case "xz":
-		conf := xz.ReaderConfig{}
-		if err := conf.Verify(); err != nil {
-			return err
-		}
-		x, err := conf.NewReader(input)
+		kind, err := filetype(input)
 		if err != nil {
 			return err
 		}
-		img = cpio.NewReader(x)
-	case "lz4":
-		lz, err := newLz4Reader(input)
-		if err != nil {
-			return err
+
+		switch kind {
+		case "cpio":
+			// an uncompressed archive is either the whole image or the early archive (e.g. CPU microcode) followed by the main one
+			stop, err := processCpio(cpio.NewReader(input), fn)
+			if err != nil || stop {
+				return err
+			}
+			more, err := skipPadding(input)
+			if err != nil || !more {
+				return err
+			}
+			continue
+		case "zstd":
+			zst, err := zstd.NewReader(input)
+			if err != nil {
+				return err
+			}
+			defer zst.Close()
+			img = cpio.NewReader(zst)
+		case "gzip":
+			gz, err := gzip.NewReader(input)
+			if err != nil {
+				return err
+			}
+			defer gz.Close()
+			img = cpio.NewReader(gz)
+		case "xz":
+			conf := xz.ReaderConfig{}
+			if err := conf.Verify(); err != nil {
+				return err
+			}
+			x, err := conf.NewReader(input)
+			if err != nil {
+				return err
+			}
+			img = cpio.NewReader(x)
+		case "lz4":
+			lz, err := newLz4Reader(input)
+			if err != nil {
+				return err
+			}
+			defer lz.Close()
+			img = cpio.NewReader(lz)
+		default:
+			return fmt.Errorf("%s: unknown image format", file)
 		}
-		defer lz.Close()
-		img = cpio.NewReader(lz)
+
+		_, err = processCpio(img, fn)
+		return err
 	}
+}
 
+// processCpio calls fn for every entry of the archive, it reports whether fn stopped the processing
+func processCpio(img *cpio.Reader, fn processCpioEntryFn) (bool, error) {
 	for {
 		hdr, err := img.Next()
 		if err == io.EOF {
-			break
+			return false, nil
 		}
 		if err != nil {
-			return err
+			return false, err
 		}
 
 		err = fn(hdr, img)
 		if err == errStop {
-			break
+			return true, nil
 		}
 		if err != nil {
-			return err
+			return false, err
 		}
 	}
+}
 
-	return nil
+// skipPadding moves the file position to the next archive, it returns false if there are no more archives
+func skipPadding(r io.ReadSeeker) (bool, error) {
+	buf := make([]byte, 512)
+	for {
+		n, err := r.Read(buf)
+		for i, b := range buf[:n] {
+			if b != 0 {
+				_, err := r.Seek(int64(i-n), io.SeekCurrent)
+				return true, err
+			}
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
 }
 
 func runUnpack() error {
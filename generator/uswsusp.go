@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cavaliergopher/cpio"
+)
+
+var (
+	// uswsusp resume tool and config location differs between distros
+	uswsuspResumeBinaries = []string{"/usr/lib/suspend/resume", "/usr/lib/uswsusp/resume", "/usr/sbin/resume"}
+	uswsuspConfigFiles    = []string{"/etc/suspend.conf", "/etc/uswsusp.conf"}
+)
+
+// parseUswsuspConfig parses suspend.conf file that has "name = value" (or "name: value") format
+func parseUswsuspConfig(data string) map[string]string {
+	result := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		sep := strings.IndexAny(line, "=:")
+		if sep == -1 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(line[:sep]))
+		result[name] = strings.TrimSpace(line[sep+1:])
+	}
+	return result
+}
+
+// appendUswsusp adds the uswsusp resume tool, its config and the RSA key (if the image is encrypted with RSA)
+// to the image. The tool is linked to uswsuspResumeBinary where init expects it.
+func (img *Image) appendUswsusp() error {
+	var resume string
+	for _, f := range uswsuspResumeBinaries {
+		if _, err := os.Stat(f); err == nil {
+			resume = f
+			break
+		}
+	}
+	if resume == "" {
+		return fmt.Errorf("uswsusp resume tool is not found at %s", strings.Join(uswsuspResumeBinaries, ", "))
+	}
+	if err := img.AppendFile(resume); err != nil {
+		return err
+	}
+	if resume != uswsuspResumeBinary {
+		mode := cpio.FileMode(0o777) | cpio.TypeSymlink
+		if err := img.AppendEntry(uswsuspResumeBinary, mode, []byte(resume)); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range uswsuspConfigFiles {
+		data, err := os.ReadFile(f)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := img.AppendFile(f); err != nil {
+			return err
+		}
+		if key := parseUswsuspConfig(string(data))["rsa key file"]; key != "" {
+			if err := img.AppendFile(key); err != nil {
+				return fmt.Errorf("uswsusp RSA key: %v", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUswsuspConfig(t *testing.T) {
+	conf := parseUswsuspConfig(`# /etc/suspend.conf
+snapshot device = /dev/snapshot
+resume device = /dev/mapper/swap
+compress = y
+encrypt: y
+RSA key file = /etc/suspend.key
+`)
+	require.Equal(t, "/dev/mapper/swap", conf["resume device"])
+	require.Equal(t, "y", conf["encrypt"])
+	require.Equal(t, "/etc/suspend.key", conf["rsa key file"])
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const wireguardKeyLen = 32
+
+// wireguardUserConfig is 'wireguard' section of the user config
+type wireguardUserConfig struct {
+	Interface  string `yaml:",omitempty"`
+	PrivateKey string `yaml:"private_key"` // base64 as generated by 'wg genkey'
+	Address    string `yaml:",omitempty"`  // comma-separated list of addresses in CIDR format
+	ListenPort int    `yaml:"listen_port,omitempty"`
+	TpmPCRs    string `yaml:"tpm_pcrs,omitempty"` // comma-separated list of PCRs the keys are sealed against, 7 by default
+	Peers      []struct {
+		PublicKey           string `yaml:"public_key"`
+		PresharedKey        string `yaml:"preshared_key,omitempty"`
+		Endpoint            string `yaml:",omitempty"`  // host:port
+		AllowedIPs          string `yaml:"allowed_ips"` // comma-separated list of networks in CIDR format
+		PersistentKeepalive int    `yaml:"persistent_keepalive,omitempty"`
+	} `yaml:",omitempty"`
+}
+
+func parseWireGuardKey(key string) ([]byte, error) {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(k) != wireguardKeyLen {
+		return nil, fmt.Errorf("invalid key '%s', expected base64 encoded 32 bytes", key)
+	}
+	return k, nil
+}
+
+// readWireGuardConfig validates the user config and copies it to the generator config
+func readWireGuardConfig(u *wireguardUserConfig, conf *generatorConfig) error {
+	wg := &InitWireGuardConfig{Interface: u.Interface, ListenPort: u.ListenPort}
+	if u.ListenPort < 0 || u.ListenPort > 65535 {
+		return fmt.Errorf("invalid listen_port %d", u.ListenPort)
+	}
+
+	privateKey, err := parseWireGuardKey(u.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("private_key: %v", err)
+	}
+	if u.Address != "" {
+		for _, a := range strings.Split(u.Address, ",") {
+			if _, _, err := net.ParseCIDR(a); err != nil {
+				return fmt.Errorf("invalid address '%s': %v", a, err)
+			}
+			wg.Addresses = append(wg.Addresses, a)
+		}
+	}
+
+	pcrs := []int{7}
+	if u.TpmPCRs != "" {
+		pcrs = nil
+		for _, p := range strings.Split(u.TpmPCRs, ",") {
+			pcr, err := strconv.Atoi(p)
+			if err != nil || pcr < 0 || pcr > 23 {
+				return fmt.Errorf("invalid PCR '%s'", p)
+			}
+			pcrs = append(pcrs, pcr)
+		}
+	}
+
+	if len(u.Peers) == 0 {
+		return fmt.Errorf("no peers specified")
+	}
+	var presharedKeys [][]byte
+	for _, p := range u.Peers {
+		if _, err := parseWireGuardKey(p.PublicKey); err != nil {
+			return fmt.Errorf("peer public_key: %v", err)
+		}
+		var psk []byte
+		if p.PresharedKey != "" {
+			if psk, err = parseWireGuardKey(p.PresharedKey); err != nil {
+				return fmt.Errorf("peer preshared_key: %v", err)
+			}
+		}
+		if p.Endpoint != "" {
+			if _, _, err := net.SplitHostPort(p.Endpoint); err != nil {
+				return fmt.Errorf("invalid peer endpoint '%s': %v", p.Endpoint, err)
+			}
+		}
+		peer := InitWireGuardPeer{PublicKey: p.PublicKey, Endpoint: p.Endpoint, PersistentKeepalive: p.PersistentKeepalive}
+		for _, a := range strings.Split(p.AllowedIPs, ",") {
+			_, ipnet, err := net.ParseCIDR(a)
+			if err != nil {
+				return fmt.Errorf("invalid peer allowed_ips '%s': %v", a, err)
+			}
+			if ones, _ := ipnet.Mask.Size(); ones == 0 {
+				// routing everything through the tunnel requires policy routing that booster does not set up
+				return fmt.Errorf("peer allowed_ips '%s': default route is not supported", a)
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, a)
+		}
+		wg.Peers = append(wg.Peers, peer)
+		presharedKeys = append(presharedKeys, psk)
+	}
+
+	conf.wireguard = wg
+	conf.wireguardPrivateKey = privateKey
+	conf.wireguardPresharedKeys = presharedKeys
+	conf.wireguardPCRs = pcrs
+	return nil
+}
+
+// encryptWireGuardSecrets encrypts the private key followed by the peers preshared keys with AES-GCM,
+// a peer without a preshared key gets zeros
+func encryptWireGuardSecrets(key, privateKey []byte, presharedKeys [][]byte) ([]byte, error) {
+	plain := append([]byte(nil), privateKey...)
+	for _, psk := range presharedKeys {
+		if psk == nil {
+			psk = make([]byte, wireguardKeyLen)
+		}
+		plain = append(plain, psk...)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+// sealWireGuardConfig returns the tunnel config for init. The keys are encrypted with a random key
+// that is sealed with the host TPM, so the image does not contain them in plain text.
+func sealWireGuardConfig(conf *generatorConfig) (*InitWireGuardConfig, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	secrets, err := encryptWireGuardSecrets(key, conf.wireguardPrivateKey, conf.wireguardPresharedKeys)
+	if err != nil {
+		return nil, err
+	}
+	token, err := tpmSeal(key, conf.wireguardPCRs)
+	if err != nil {
+		return nil, err
+	}
+
+	wg := *conf.wireguard
+	wg.Secrets = base64.StdEncoding.EncodeToString(secrets)
+	wg.SealedKey = string(token)
+	return &wg, nil
+}
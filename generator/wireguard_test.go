@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testWireGuardKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string([]byte{b}), wireguardKeyLen)))
+}
+
+func TestReadConfigWireGuard(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "booster.yaml")
+	config := `network:
+  dhcp: true
+wireguard:
+  private_key: ` + testWireGuardKey(1) + `
+  address: 10.100.0.2/24
+  peers:
+    - public_key: ` + testWireGuardKey(2) + `
+      preshared_key: ` + testWireGuardKey(3) + `
+      endpoint: vpn.example.com:51820
+      allowed_ips: 10.100.0.0/24,fd00::/64
+      persistent_keepalive: 25
+`
+	require.NoError(t, os.WriteFile(file, []byte(config), 0o644))
+	c, err := readGeneratorConfig(file)
+	require.NoError(t, err)
+	require.Equal(t, &InitWireGuardConfig{
+		Addresses: []string{"10.100.0.2/24"},
+		Peers: []InitWireGuardPeer{{
+			PublicKey:           testWireGuardKey(2),
+			Endpoint:            "vpn.example.com:51820",
+			AllowedIPs:          []string{"10.100.0.0/24", "fd00::/64"},
+			PersistentKeepalive: 25,
+		}},
+	}, c.wireguard)
+	require.Equal(t, []int{7}, c.wireguardPCRs)
+	require.Len(t, c.wireguardPresharedKeys, 1)
+
+	// the default route cannot be routed through the tunnel
+	require.NoError(t, os.WriteFile(file, []byte(strings.Replace(config, "10.100.0.0/24,fd00::/64", "0.0.0.0/0", 1)), 0o644))
+	_, err = readGeneratorConfig(file)
+	require.EqualError(t, err, "config: wireguard: peer allowed_ips '0.0.0.0/0': default route is not supported")
+
+	require.NoError(t, os.WriteFile(file, []byte(strings.Replace(config, testWireGuardKey(1), "short", 1)), 0o644))
+	_, err = readGeneratorConfig(file)
+	require.Error(t, err)
+}
+
+func TestEncryptWireGuardSecrets(t *testing.T) {
+	key := make([]byte, 32)
+	privateKey := []byte(strings.Repeat("p", wireguardKeyLen))
+	psk := []byte(strings.Repeat("s", wireguardKeyLen))
+
+	encrypted, err := encryptWireGuardSecrets(key, privateKey, [][]byte{nil, psk})
+	require.NoError(t, err)
+
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	plain, err := gcm.Open(nil, encrypted[:gcm.NonceSize()], encrypted[gcm.NonceSize():], nil)
+	require.NoError(t, err)
+
+	var expected []byte
+	expected = append(expected, privateKey...)
+	expected = append(expected, make([]byte, wireguardKeyLen)...)
+	expected = append(expected, psk...)
+	require.Equal(t, expected, plain)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/anatol/luks.go"
+)
+
+// Booster records how each LUKS volume was unlocked to /run/booster/unlock.json. /run is passed to the booted system
+// so a monitoring agent can alert e.g. when a volume was unlocked with a recovery key instead of TPM.
+// The record contains metadata only and never the secrets.
+
+var unlockAuditFile = "/run/booster/unlock.json"
+
+const (
+	unlockMethodTPM2        = "tpm2"
+	unlockMethodTPM2WithPin = "tpm2+pin"
+	unlockMethodFido2       = "fido2"
+	unlockMethodPkcs11      = "pkcs11"
+	unlockMethodClevis      = "clevis"
+	unlockMethodPassphrase  = "passphrase"
+	unlockMethodRecoveryKey = "recovery-key"
+	unlockMethodKeyfile     = "keyfile"
+)
+
+type unlockRecord struct {
+	Volume    string    `json:"volume"`
+	UUID      string    `json:"uuid"`
+	Method    string    `json:"method"`
+	Keyslot   int       `json:"keyslot"`
+	TokenID   *int      `json:"token_id,omitempty"`
+	TokenType string    `json:"token_type,omitempty"`
+	PCRs      []int     `json:"pcrs,omitempty"`
+	PCRBank   string    `json:"pcr_bank,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+var (
+	unlockRecords      sync.Map // *luks.Volume -> *unlockRecord, set by the goroutine that unsealed the volume
+	unlockAuditMutex   sync.Mutex
+	unlockAuditEntries []*unlockRecord
+)
+
+func tokenUnlockRecord(t luks.Token, keyslot int) *unlockRecord {
+	id := t.ID
+	r := &unlockRecord{Keyslot: keyslot, TokenID: &id, TokenType: t.Type}
+	switch t.Type {
+	case "systemd-tpm2", "booster-tpm2":
+		r.Method = unlockMethodTPM2
+		if tok, err := parseTPM2Token(t.Payload); err == nil {
+			if tok.pin {
+				r.Method = unlockMethodTPM2WithPin
+			}
+			r.PCRs = tok.pcrs
+			r.PCRBank = pcrBankName(tok.bank)
+		}
+	case "systemd-fido2":
+		r.Method = unlockMethodFido2
+	case "systemd-pkcs11":
+		r.Method = unlockMethodPkcs11
+	case "clevis":
+		r.Method = unlockMethodClevis
+	}
+	return r
+}
+
+// passphraseUnlockRecord checks whether the keyslot belongs to a systemd recovery key
+func passphraseUnlockRecord(d luks.Device, keyslot int) *unlockRecord {
+	tokens, _ := d.Tokens()
+	for _, t := range tokens {
+		if t.Type != "systemd-recovery" {
+			continue
+		}
+		for _, s := range t.Slots {
+			if s == keyslot {
+				r := tokenUnlockRecord(t, keyslot)
+				r.Method = unlockMethodRecoveryKey
+				return r
+			}
+		}
+	}
+	return &unlockRecord{Method: unlockMethodPassphrase, Keyslot: keyslot}
+}
+
+// writeUnlockRecord appends the record of the unlocked volume to the audit file
+func writeUnlockRecord(v *luks.Volume, name, uuid string) {
+	val, ok := unlockRecords.LoadAndDelete(v)
+	if !ok {
+		return
+	}
+	r := val.(*unlockRecord)
+	r.Volume = name
+	r.UUID = uuid
+	r.Time = time.Now().UTC()
+
+	info("volume %s is unlocked with %s (keyslot %d)", name, r.Method, r.Keyslot)
+
+	unlockAuditMutex.Lock()
+	defer unlockAuditMutex.Unlock()
+
+	unlockAuditEntries = append(unlockAuditEntries, r)
+	data, err := json.MarshalIndent(unlockAuditEntries, "", "  ")
+	if err != nil {
+		warning("unlock audit: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(unlockAuditFile), 0o755); err != nil {
+		warning("unlock audit: %v", err)
+		return
+	}
+	if err := os.WriteFile(unlockAuditFile, append(data, '\n'), 0o644); err != nil {
+		warning("unlock audit: %v", err)
+	}
+}
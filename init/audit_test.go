@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anatol/luks.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteUnlockRecord(t *testing.T) {
+	unlockAuditFile = filepath.Join(t.TempDir(), "booster", "unlock.json")
+	unlockAuditEntries = nil
+	defer func() {
+		unlockAuditFile = "/run/booster/unlock.json"
+		unlockAuditEntries = nil
+	}()
+
+	v1, v2 := &luks.Volume{}, &luks.Volume{}
+	unlockRecords.Store(v1, tokenUnlockRecord(luks.Token{ID: 2, Type: "systemd-fido2"}, 1))
+	unlockRecords.Store(v2, &unlockRecord{Method: unlockMethodPassphrase, Keyslot: 0})
+	writeUnlockRecord(v1, "root", "639b8fdd-36ba-443e-be3e-e5b335935502")
+	writeUnlockRecord(v2, "home", "2a9f1e2c-4ba5-4c1c-8b66-3d1e1c7f6d2a")
+	// volume without a record is ignored
+	writeUnlockRecord(&luks.Volume{}, "swap", "")
+
+	data, err := os.ReadFile(unlockAuditFile)
+	require.NoError(t, err)
+	var records []map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &records))
+	require.Len(t, records, 2)
+
+	require.Equal(t, "root", records[0]["volume"])
+	require.Equal(t, "fido2", records[0]["method"])
+	require.Equal(t, float64(2), records[0]["token_id"])
+	require.Equal(t, float64(1), records[0]["keyslot"])
+	require.Contains(t, records[0], "time")
+
+	require.Equal(t, "home", records[1]["volume"])
+	require.Equal(t, "passphrase", records[1]["method"])
+	require.NotContains(t, records[1], "token_id")
+}
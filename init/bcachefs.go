@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/sys/unix"
+)
+
+// bcachefs superblock is described at fs/bcachefs/bcachefs_format.h. A filesystem might span multiple devices,
+// these devices are mounted together as "dev1:dev2:...". An encrypted filesystem has its key encrypted with a key derived
+// from the passphrase. The decrypted key is added to the user keyring where the kernel module looks for it at mount.
+
+const (
+	bcachefsSuperblockOffset = 4096
+	bcachefsFieldsOffset     = 744 // struct bch_sb fixed part including the superblock layout
+	bcachefsMaxSuperblock    = 64 * 1024
+	bcachefsFieldCrypt       = 2
+	bcachefsKeyMagic         = "bch**key"
+	bcachefsKdfScrypt        = 0
+)
+
+var (
+	bcacheMagic   = []byte{0xc6, 0x85, 0x73, 0xf6, 0x4e, 0x1a, 0x45, 0xca, 0x82, 0x65, 0xf5, 0x7f, 0x48, 0xba, 0x6d, 0x81}
+	bcachefsMagic = []byte{0xc6, 0x85, 0x73, 0xf6, 0x66, 0xce, 0x90, 0xa9, 0xd9, 0x6a, 0x60, 0xcf, 0x80, 0x3d, 0xf7, 0xef}
+)
+
+type bcachefsCrypt struct {
+	flags    uint64
+	kdfFlags uint64
+	key      []byte // struct bch_encrypted_key: magic followed by the key
+}
+
+type bcachefsData struct {
+	internalUUID []byte
+	devIdx       uint8
+	nrDevices    uint8
+	crypt        *bcachefsCrypt
+}
+
+func probeBcachefs(f *os.File) *blkInfo {
+	buf := make([]byte, bcachefsFieldsOffset)
+	if _, err := f.ReadAt(buf, bcachefsSuperblockOffset); err != nil {
+		return nil
+	}
+	if magic := buf[24:40]; !bytes.Equal(magic, bcachefsMagic) && !bytes.Equal(magic, bcacheMagic) {
+		return nil
+	}
+
+	// read the superblock fields
+	size := bcachefsFieldsOffset + 8*int(binary.LittleEndian.Uint32(buf[124:128]))
+	if size > bcachefsMaxSuperblock {
+		return nil
+	}
+	buf = make([]byte, size)
+	if _, err := f.ReadAt(buf, bcachefsSuperblockOffset); err != nil {
+		return nil
+	}
+	return parseBcachefsSuperblock(buf)
+}
+
+func parseBcachefsSuperblock(sb []byte) *blkInfo {
+	if len(sb) < bcachefsFieldsOffset {
+		return nil
+	}
+	magic := sb[24:40]
+	if !bytes.Equal(magic, bcachefsMagic) && !bytes.Equal(magic, bcacheMagic) {
+		return nil
+	}
+
+	data := bcachefsData{
+		internalUUID: sb[40:56],
+		devIdx:       sb[122],
+		nrDevices:    sb[123],
+	}
+	fields := sb[bcachefsFieldsOffset:]
+	for len(fields) >= 8 {
+		size := int(binary.LittleEndian.Uint32(fields[0:4])) * 8
+		typ := binary.LittleEndian.Uint32(fields[4:8])
+		if size < 8 || size > len(fields) {
+			break
+		}
+		if typ == bcachefsFieldCrypt && size >= 64 {
+			data.crypt = &bcachefsCrypt{
+				flags:    binary.LittleEndian.Uint64(fields[8:16]),
+				kdfFlags: binary.LittleEndian.Uint64(fields[16:24]),
+				key:      fields[24:64],
+			}
+		}
+		fields = fields[size:]
+	}
+
+	return &blkInfo{format: "bcachefs", isFs: true, uuid: sb[56:72], label: fixedArrayToString(sb[72:104]), data: data}
+}
+
+// passphraseProtected returns true if the filesystem key is encrypted with a passphrase
+func (c *bcachefsCrypt) passphraseProtected() bool {
+	return c != nil && string(c.key[:8]) != bcachefsKeyMagic
+}
+
+// deriveKey decrypts the filesystem key with the passphrase, it returns nil if the passphrase does not match
+func (c *bcachefsCrypt) deriveKey(internalUUID, passphrase []byte) ([]byte, error) {
+	if kdf := c.flags & 0xf; kdf != bcachefsKdfScrypt {
+		return nil, fmt.Errorf("unsupported key derivation function %d", kdf)
+	}
+	n := 1 << (c.kdfFlags & 0xffff)
+	r := 1 << ((c.kdfFlags >> 16) & 0xffff)
+	p := 1 << ((c.kdfFlags >> 32) & 0xffff)
+	passphraseKey, err := scrypt.Key(passphrase, []byte("bcache\x00"), n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	defer memZeroBytes(passphraseKey)
+
+	// the nonce is the first 8 bytes of the internal UUID, see __bch2_sb_key_nonce()
+	nonce := make([]byte, chacha20.NonceSize)
+	copy(nonce[4:], internalUUID[:8])
+	cipher, err := chacha20.NewUnauthenticatedCipher(passphraseKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, len(c.key))
+	cipher.XORKeyStream(key, c.key)
+	if string(key[:8]) != bcachefsKeyMagic {
+		memZeroBytes(key)
+		return nil, nil
+	}
+	return key[8:], nil
+}
+
+// unlockBcachefs asks for the passphrase of an encrypted filesystem and adds its key to the keyring
+func unlockBcachefs(blk *blkInfo) error {
+	data := blk.data.(bcachefsData)
+	if !data.crypt.passphraseProtected() {
+		return nil
+	}
+
+	description := "bcachefs:" + blk.uuid.toString()
+	if _, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", description, 0); err == nil {
+		return nil // unlocked already
+	}
+
+	addKey := func(passphrase []byte) (bool, error) {
+		key, err := data.crypt.deriveKey(data.internalUUID, passphrase)
+		if err != nil || key == nil {
+			return false, err
+		}
+		defer memZeroBytes(key)
+		_, err = unix.AddKey("user", description, key, unix.KEY_SPEC_USER_KEYRING)
+		return err == nil, err
+	}
+
+	passphrasePromptMutex.Lock()
+	defer passphrasePromptMutex.Unlock()
+
+	passphraseCacheMutex.Lock()
+	if passphraseCache != nil {
+		if ok, _ := addKey(passphraseCache); ok {
+			passphraseCacheMutex.Unlock()
+			info("bcachefs filesystem %s is unlocked with the passphrase of the previous volume", blk.uuid.toString())
+			return nil
+		}
+	}
+	passphraseCacheMutex.Unlock()
+
+	attempts := passwordAttempts{name: "bcachefs filesystem " + blk.uuid.toString()}
+	for {
+		password, err := attempts.read(fmt.Sprintf("Enter passphrase for %s:", attempts.name))
+		if err != nil {
+			return err
+		}
+
+		ok, err := addKey(password)
+		if ok {
+			cachePassphrase(password)
+		}
+		memZeroBytes(password)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+
+		if err := attempts.fail("   Incorrect passphrase"); err != nil {
+			return err
+		}
+	}
+}
+
+var bcachefsFilesystems = newMultiDeviceFs("bcachefs")
+
+// handleBcachefsRootDevice mounts the root filesystem once all its devices are present
+func handleBcachefsRootDevice(blk *blkInfo) error {
+	data, ok := blk.data.(bcachefsData)
+	if !ok {
+		return mountRootFs(blk.path, blk.format)
+	}
+
+	fsUUID := blk.uuid.toString()
+	degraded := hasMountOption(rootFlags, "degraded") || hasMountOption(rootFlags, "very_degraded")
+	return bcachefsFilesystems.addDevice(fsUUID, uint64(data.devIdx), uint64(data.nrDevices), blk.path, degraded, func() error {
+		if err := unlockBcachefs(blk); err != nil {
+			return fmt.Errorf("unable to unlock bcachefs filesystem %s: %v", fsUUID, err)
+		}
+		return mountRootFs(strings.Join(bcachefsFilesystems.paths(fsUUID), ":"), "bcachefs")
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/scrypt"
+)
+
+// makeBcachefsSuperblock creates a superblock with crypt field where the key is encrypted with the passphrase
+func makeBcachefsSuperblock(t *testing.T, key []byte, passphrase string) []byte {
+	const kdfFlags = 10 | 3<<16 // N=1024 r=8 p=1
+
+	sb := make([]byte, bcachefsFieldsOffset+64)
+	copy(sb[24:40], bcachefsMagic)
+	internalUUID := []byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, 0x00}
+	copy(sb[40:56], internalUUID)
+	copy(sb[56:72], []byte{0x18, 0x84, 0xe1, 0xeb, 0x18, 0x6f, 0x4b, 0x1b, 0xaf, 0x11, 0x45, 0xea, 0x80, 0xda, 0x8e, 0x3c})
+	copy(sb[72:104], "bcachefsroot")
+	sb[122] = 1 // dev_idx
+	sb[123] = 2 // nr_devices
+	binary.LittleEndian.PutUint32(sb[124:128], 8)
+
+	crypt := sb[bcachefsFieldsOffset:]
+	binary.LittleEndian.PutUint32(crypt[0:4], 8)
+	binary.LittleEndian.PutUint32(crypt[4:8], bcachefsFieldCrypt)
+	binary.LittleEndian.PutUint64(crypt[16:24], kdfFlags)
+	copy(crypt[24:32], bcachefsKeyMagic)
+	copy(crypt[32:64], key)
+
+	passphraseKey, err := scrypt.Key([]byte(passphrase), []byte("bcache\x00"), 1024, 8, 1, 32)
+	require.NoError(t, err)
+	nonce := make([]byte, chacha20.NonceSize)
+	copy(nonce[4:], internalUUID[:8])
+	cipher, err := chacha20.NewUnauthenticatedCipher(passphraseKey, nonce)
+	require.NoError(t, err)
+	cipher.XORKeyStream(crypt[24:64], crypt[24:64])
+	return sb
+}
+
+func TestBcachefsSuperblock(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	blk := parseBcachefsSuperblock(makeBcachefsSuperblock(t, key, "secret"))
+	require.NotNil(t, blk)
+	require.Equal(t, "bcachefs", blk.format)
+	require.Equal(t, "1884e1eb-186f-4b1b-af11-45ea80da8e3c", blk.uuid.toString())
+	require.Equal(t, "bcachefsroot", blk.label)
+
+	data := blk.data.(bcachefsData)
+	require.Equal(t, uint8(1), data.devIdx)
+	require.Equal(t, uint8(2), data.nrDevices)
+	require.True(t, data.crypt.passphraseProtected())
+
+	derived, err := data.crypt.deriveKey(data.internalUUID, []byte("secret"))
+	require.NoError(t, err)
+	require.Equal(t, key, derived)
+
+	derived, err = data.crypt.deriveKey(data.internalUUID, []byte("wrong"))
+	require.NoError(t, err)
+	require.Nil(t, derived)
+
+	require.Nil(t, parseBcachefsSuperblock(make([]byte, bcachefsFieldsOffset)))
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 
 	"golang.org/x/sys/unix"
@@ -33,7 +34,9 @@ func readBlkInfo(path string) (*blkInfo, error) {
 
 	type probeFn func(f *os.File) *blkInfo
 	// FAT signature is similar to MBR + some restrictions. Check fat before mbr.
-	probes := []probeFn{probeIso9660, probeGpt, probeFat, probeMbr, probeLuks, probeExt4, probeBtrfs, probeXfs, probeF2fs, probeLvmPv, probeMdraid, probeSwap, probeErofs}
+	// mdraid superblock might be located at the end of the device while the array content (e.g. a filesystem of RAID1)
+	// is visible at the beginning of the member, check raid signatures first.
+	probes := []probeFn{probeMdraid, probeImsm, probeDdf, probeIso9660, probeGpt, probeFat, probeMbr, probeLuks, probeExt4, probeBtrfs, probeBcachefs, probeXfs, probeF2fs, probeLvmPv, probeSwap, probeErofs, probeSquashfs, probeVerity, probeIntegrity}
 	for _, fn := range probes {
 		blk := fn(r)
 		if blk == nil {
@@ -328,6 +331,8 @@ func probeBtrfs(f *os.File) *blkInfo {
 		btrfsSuperblockOffset = 0x10000
 		btrfsMagicOffset      = 0x40
 		btrfsUUIDOffset       = 0x11b
+		btrfsNumDevicesOffset = 0x88
+		btrfsDevidOffset      = 0xc9
 		btrfsLabelOffset      = 0x12b
 		btrfsMagic            = "_BHRfS_M"
 	)
@@ -347,7 +352,18 @@ func probeBtrfs(f *os.File) *blkInfo {
 	if _, err := f.ReadAt(label, btrfsSuperblockOffset+btrfsLabelOffset); err != nil {
 		return nil
 	}
-	return &blkInfo{format: "btrfs", isFs: true, uuid: uuid, label: fixedArrayToString(label)}
+	buf := make([]byte, 8)
+	if _, err := f.ReadAt(buf, btrfsSuperblockOffset+btrfsNumDevicesOffset); err != nil {
+		return nil
+	}
+	numDevices := binary.LittleEndian.Uint64(buf)
+	if _, err := f.ReadAt(buf, btrfsSuperblockOffset+btrfsDevidOffset); err != nil {
+		return nil
+	}
+	devid := binary.LittleEndian.Uint64(buf)
+	data := btrfsData{numDevices: numDevices, devid: devid}
+
+	return &blkInfo{format: "btrfs", isFs: true, uuid: uuid, label: fixedArrayToString(label), data: data}
 }
 
 func probeXfs(f *os.File) *blkInfo {
@@ -463,45 +479,62 @@ type mdraidData struct {
 
 func probeMdraid(f *os.File) *blkInfo {
 	// https://raid.wiki.kernel.org/index.php/RAID_superblock_formats
+	sb, err := readMdSuperblock(f)
+	if err != nil {
+		return nil
+	}
+	data := mdraidData{level: sb.level}
+
+	return &blkInfo{format: "mdraid", isFs: true, uuid: sb.uuid, data: data}
+}
+
+// probeImsm detects a member of Intel Matrix Storage Manager container
+func probeImsm(f *os.File) *blkInfo {
 	const (
-		mdraidHeaderOffset = 0x1000
-		mdraidMagicOffset  = 0x0
-		mdraidMagic        = 0xa92b4efc
-		mdraidVersioOffset = 0x4
-		mdraidUUIDOffset   = 0x10
-		mdraidLevelOffset  = 0x48
+		imsmAnchorOffset    = 2 * 512 // from the end of the device
+		imsmSignature       = "Intel Raid ISM Cfg Sig. "
+		imsmFamilyNumOffset = 40
 	)
 
-	magic := make([]byte, 4)
-	if _, err := f.ReadAt(magic, mdraidHeaderOffset+mdraidMagicOffset); err != nil {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil || size < imsmAnchorOffset {
 		return nil
 	}
-	if binary.LittleEndian.Uint32(magic) != mdraidMagic {
+	anchor := make([]byte, 512)
+	if _, err := f.ReadAt(anchor, size-imsmAnchorOffset); err != nil {
 		return nil
 	}
-
-	version := make([]byte, 4)
-	if _, err := f.ReadAt(version, mdraidHeaderOffset+mdraidVersioOffset); err != nil {
+	if !bytes.Equal(anchor[:len(imsmSignature)], []byte(imsmSignature)) {
 		return nil
 	}
-	if binary.LittleEndian.Uint32(version) != 1 {
+	uuid := anchor[imsmFamilyNumOffset : imsmFamilyNumOffset+4]
+
+	return &blkInfo{format: "imsm", isFs: true, uuid: uuid}
+}
+
+// probeDdf detects a member of SNIA DDF container
+func probeDdf(f *os.File) *blkInfo {
+	const (
+		ddfAnchorOffset = 512 // from the end of the device
+		ddfMagic        = 0xde11de11
+		ddfGUIDOffset   = 8
+		ddfGUIDSize     = 24
+	)
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil || size < ddfAnchorOffset {
 		return nil
 	}
-
-	uuid := make([]byte, 16)
-	if _, err := f.ReadAt(uuid, int64(mdraidHeaderOffset+mdraidUUIDOffset)); err != nil {
+	anchor := make([]byte, 512)
+	if _, err := f.ReadAt(anchor, size-ddfAnchorOffset); err != nil {
 		return nil
 	}
-
-	levelBuff := make([]byte, 4)
-	if _, err := f.ReadAt(levelBuff, int64(mdraidHeaderOffset+mdraidLevelOffset)); err != nil {
+	if binary.BigEndian.Uint32(anchor[0:4]) != ddfMagic {
 		return nil
 	}
-	level := binary.LittleEndian.Uint32(levelBuff)
+	uuid := anchor[ddfGUIDOffset : ddfGUIDOffset+ddfGUIDSize]
 
-	data := mdraidData{level: level}
-
-	return &blkInfo{format: "mdraid", isFs: true, uuid: uuid, data: data}
+	return &blkInfo{format: "ddf", isFs: true, uuid: uuid}
 }
 
 func probeSwap(f *os.File) *blkInfo {
@@ -540,16 +573,32 @@ func probeIso9660(f *os.File) *blkInfo {
 	const (
 		volumeDescriptorOffset = 16 * 2048
 	)
-	magic := make([]byte, 6)
-	if _, err := f.ReadAt(magic, volumeDescriptorOffset); err != nil {
+	descriptor := make([]byte, 72)
+	if _, err := f.ReadAt(descriptor, volumeDescriptorOffset); err != nil {
 		return nil
 	}
 	// bootable volume has magic[0] == 0
-	if string(magic[1:]) != "CD001" {
+	if string(descriptor[1:6]) != "CD001" {
 		return nil
 	}
 
-	return &blkInfo{format: "iso9660", isFs: true}
+	// the volume identifier is padded with spaces, live media are usually referenced by it (root=live:LABEL=...)
+	label := string(bytes.TrimRight(descriptor[40:72], " \x00"))
+	return &blkInfo{format: "iso9660", isFs: true, label: label}
+}
+
+func probeSquashfs(f *os.File) *blkInfo {
+	const superblockMagic = 0x73717368 // "hsqs"
+
+	magic := make([]byte, 4)
+	if _, err := f.ReadAt(magic, 0); err != nil {
+		return nil
+	}
+	if binary.LittleEndian.Uint32(magic) != superblockMagic {
+		return nil
+	}
+	// squashfs has neither UUID nor label
+	return &blkInfo{format: "squashfs", isFs: true}
 }
 
 func probeErofs(f *os.File) *blkInfo {
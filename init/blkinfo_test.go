@@ -76,7 +76,7 @@ func TestBlkInfoExt4(t *testing.T) {
 }
 
 func TestBlkInfoBtrfs(t *testing.T) {
-	checkFs(t, "btrfs", "btrfs", "1884e1eb-186f-4b1b-af11-45ea80da8e3c", "btrfs111", 200, "mkfs.btrfs -L $LABEL -U $UUID $OUTPUT", nil)
+	checkFs(t, "btrfs", "btrfs", "1884e1eb-186f-4b1b-af11-45ea80da8e3c", "btrfs111", 200, "mkfs.btrfs -L $LABEL -U $UUID $OUTPUT", btrfsData{numDevices: 1, devid: 1})
 }
 
 func TestBlkInfoXFS(t *testing.T) {
@@ -141,7 +141,7 @@ sudo mdadm --create --force --verbose --level=0 --raid-devices=1 --uuid=9ee4ce4c
 }
 
 func TestBlkIso9660(t *testing.T) {
-	checkFs(t, "iso9660", "iso9660", "", "", 10, "mkisofs -o $OUTPUT /dev/null", nil)
+	checkFs(t, "iso9660", "iso9660", "", "ISOLBL", 10, "mkisofs -V $LABEL -o $OUTPUT /dev/null", nil)
 }
 
 func TestErofs(t *testing.T) {
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+)
+
+// bondConfig is a bonding interface specified with bond=<name>:<slaves>[:<options>[:<mtu>]] boot param
+// or 'network.bonds' config option
+type bondConfig struct {
+	name    string
+	slaves  []string
+	options map[string]string
+	mtu     int
+}
+
+// options supported by the bond= param, the values are validated when the bond is created
+var bondOptions = []string{"mode", "miimon", "updelay", "downdelay", "lacp_rate", "xmit_hash_policy", "min_links"}
+
+// parseBondParam parses dracut style bond=<name>:<slave>[,<slave>...][:<options>[:<mtu>]] param,
+// options is a comma-separated list like mode=802.3ad,miimon=100
+func parseBondParam(value string) (*bondConfig, error) {
+	fields := strings.Split(value, ":")
+	if len(fields) < 2 || len(fields) > 4 || fields[0] == "" || fields[1] == "" {
+		return nil, fmt.Errorf("expected format is <name>:<slave>[,<slave>...][:<options>[:<mtu>]]")
+	}
+
+	b := &bondConfig{name: fields[0], slaves: strings.Split(fields[1], ","), options: make(map[string]string)}
+	for _, s := range b.slaves {
+		if s == "" {
+			return nil, fmt.Errorf("empty slave interface name")
+		}
+	}
+	if len(fields) > 2 && fields[2] != "" {
+		for _, opt := range strings.Split(fields[2], ",") {
+			k, v, ok := strings.Cut(opt, "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid bond option '%s'", opt)
+			}
+			if !stringListContains(k, bondOptions) {
+				return nil, fmt.Errorf("unsupported bond option '%s'", k)
+			}
+			b.options[k] = v
+		}
+	}
+	if len(fields) > 3 && fields[3] != "" {
+		mtu, err := strconv.Atoi(fields[3])
+		if err != nil || mtu <= 0 {
+			return nil, fmt.Errorf("invalid mtu %s", fields[3])
+		}
+		b.mtu = mtu
+	}
+	if _, err := b.link(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// link converts the bond configuration to the netlink bond attributes
+func (b *bondConfig) link() (*netlink.Bond, error) {
+	bond := netlink.NewLinkBond(netlink.LinkAttrs{Name: b.name, MTU: b.mtu})
+	// link monitoring is disabled by default, without it a failed slave is never detected
+	bond.Miimon = 100
+
+	intOpt := func(name string, v *int) error {
+		s, ok := b.options[name]
+		if !ok {
+			return nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid bond option %s=%s", name, s)
+		}
+		*v = n
+		return nil
+	}
+	for name, v := range map[string]*int{"miimon": &bond.Miimon, "updelay": &bond.UpDelay, "downdelay": &bond.DownDelay, "min_links": &bond.MinLinks} {
+		if err := intOpt(name, v); err != nil {
+			return nil, err
+		}
+	}
+
+	if s, ok := b.options["mode"]; ok {
+		// the mode can be specified either by name or by its number
+		if n, err := strconv.Atoi(s); err == nil {
+			bond.Mode = netlink.BondMode(n)
+		} else {
+			bond.Mode = netlink.StringToBondMode(s)
+		}
+		if bond.Mode < 0 || bond.Mode >= netlink.BOND_MODE_UNKNOWN {
+			return nil, fmt.Errorf("invalid bond mode %s", s)
+		}
+	}
+	if s, ok := b.options["lacp_rate"]; ok {
+		bond.LacpRate = netlink.StringToBondLacpRate(s)
+		if bond.LacpRate == netlink.BOND_LACP_RATE_UNKNOWN {
+			return nil, fmt.Errorf("invalid bond lacp_rate %s", s)
+		}
+	}
+	if s, ok := b.options["xmit_hash_policy"]; ok {
+		bond.XmitHashPolicy = netlink.StringToBondXmitHashPolicy(s)
+		if bond.XmitHashPolicy == netlink.BOND_XMIT_HASH_POLICY_UNKNOWN {
+			return nil, fmt.Errorf("invalid bond xmit_hash_policy %s", s)
+		}
+	}
+	return bond, nil
+}
+
+// addBondParam adds the bond interface to the network config and makes sure it is configured at boot
+func addBondParam(value string) error {
+	b, err := parseBondParam(value)
+	if err != nil {
+		return err
+	}
+	if config.Network == nil {
+		// unless ip= says otherwise the bond interface is configured with DHCP
+		config.Network = &InitNetworkConfig{Dhcp: true, InterfaceNames: []string{b.name}}
+	}
+	config.Network.Bonds = append(config.Network.Bonds, value)
+	return nil
+}
+
+func bondConfigs() ([]*bondConfig, error) {
+	var bonds []*bondConfig
+	for _, value := range config.Network.Bonds {
+		b, err := parseBondParam(value)
+		if err != nil {
+			return nil, fmt.Errorf("bond %s: %v", value, err)
+		}
+		bonds = append(bonds, b)
+	}
+	return bonds, nil
+}
+
+// isBondSlave checks whether the interface is a part of a bond
+func isBondSlave(ifname string) bool {
+	bonds, _ := bondConfigs()
+	for _, b := range bonds {
+		if stringListContains(ifname, b.slaves) {
+			return true
+		}
+	}
+	return false
+}
+
+// configureBondingModule prevents the bonding module from creating a default bond0 interface,
+// all the bonds are created by booster with the requested options
+func configureBondingModule() {
+	for _, p := range moduleParams["bonding"] {
+		if strings.HasPrefix(p, "max_bonds=") {
+			return
+		}
+	}
+	moduleParams["bonding"] = append(moduleParams["bonding"], "max_bonds=0")
+}
+
+// bondsMutex serializes bond creation as the slaves appear concurrently
+var bondsMutex sync.Mutex
+
+// bondLink returns the bond interface, the interface is created if it does not exist yet
+func bondLink(b *bondConfig) (netlink.Link, error) {
+	bondsMutex.Lock()
+	defer bondsMutex.Unlock()
+
+	if l, err := netlink.LinkByName(b.name); err == nil {
+		if !isCreatedLink(b.name) {
+			return nil, fmt.Errorf("interface %s exists already", b.name)
+		}
+		return l, nil
+	}
+
+	loadModules("bonding").Wait()
+	bond, err := b.link()
+	if err != nil {
+		return nil, err
+	}
+	info("creating bond interface %s with mode %s", b.name, bond.Mode)
+	if err := createLink(bond); err != nil {
+		return nil, fmt.Errorf("unable to create bond interface %s: %v", b.name, err)
+	}
+	return netlink.LinkByName(b.name)
+}
+
+// setupBonds adds the interface to the bonds it belongs to. The bond interface is created together with
+// its first slave, it shows up as an udev event and gets configured the same way as a physical interface.
+func setupBonds(ifname string) error {
+	bonds, err := bondConfigs()
+	if err != nil {
+		return err
+	}
+
+	for _, b := range bonds {
+		if !stringListContains(ifname, b.slaves) {
+			continue
+		}
+		bond, err := bondLink(b)
+		if err != nil {
+			return err
+		}
+
+		slave, err := netlink.LinkByName(ifname)
+		if err != nil {
+			return err
+		}
+		// an interface can be enslaved only when it is down
+		if err := netlink.LinkSetDown(slave); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetMasterByIndex(slave, bond.Attrs().Index); err != nil {
+			return fmt.Errorf("unable to add %s to bond %s: %v", ifname, b.name, err)
+		}
+		if err := netlink.LinkSetUp(slave); err != nil {
+			return err
+		}
+		initializedIfnames = append(initializedIfnames, ifname)
+		info("%s: added to bond %s", ifname, b.name)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func TestParseBondParam(t *testing.T) {
+	b, err := parseBondParam("bond0:eth0,eth1:mode=802.3ad,lacp_rate=fast,xmit_hash_policy=layer3+4:9000")
+	require.NoError(t, err)
+	require.Equal(t, "bond0", b.name)
+	require.Equal(t, []string{"eth0", "eth1"}, b.slaves)
+	require.Equal(t, 9000, b.mtu)
+
+	bond, err := b.link()
+	require.NoError(t, err)
+	require.Equal(t, netlink.BOND_MODE_802_3AD, bond.Mode)
+	require.Equal(t, netlink.BOND_LACP_RATE_FAST, bond.LacpRate)
+	require.Equal(t, netlink.BOND_XMIT_HASH_POLICY_LAYER3_4, bond.XmitHashPolicy)
+	require.Equal(t, 100, bond.Miimon)
+	require.Equal(t, 9000, bond.MTU)
+
+	b, err = parseBondParam("bond1:eth2:mode=1,miimon=50")
+	require.NoError(t, err)
+	bond, err = b.link()
+	require.NoError(t, err)
+	require.Equal(t, netlink.BOND_MODE_ACTIVE_BACKUP, bond.Mode)
+	require.Equal(t, 50, bond.Miimon)
+
+	for _, p := range []string{"bond0", "bond0:", ":eth0", "bond0:eth0,", "bond0:eth0:mode=foo", "bond0:eth0:mode=7", "bond0:eth0:arp_interval=1",
+		"bond0:eth0:miimon=-1", "bond0:eth0:mode", "bond0:eth0::0", "bond0:eth0:lacp_rate=medium"} {
+		_, err := parseBondParam(p)
+		require.Error(t, err, p)
+	}
+}
+
+func TestParseParamsBond(t *testing.T) {
+	config.Network = nil
+	defer func() { config.Network = nil }()
+
+	require.NoError(t, parseParams("bond=bond0:eth0,eth1:mode=802.3ad"))
+	require.True(t, config.Network.Dhcp)
+	require.Equal(t, []string{"bond0"}, config.Network.InterfaceNames)
+	require.Equal(t, []string{"bond0:eth0,eth1:mode=802.3ad"}, config.Network.Bonds)
+	require.True(t, isBondSlave("eth1"))
+	require.False(t, isBondSlave("bond0"))
+
+	config.Network = nil
+	require.Error(t, parseParams("bond=bond0"))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// rd.break= boot parameter drops to the shell at the given boot stage, the boot continues once the user exits the shell.
+// The stage names follow dracut.
+
+const (
+	breakCmdline   = "cmdline"   // the kernel command line is parsed, no devices are processed yet
+	breakInitqueue = "initqueue" // the modules for the present hardware are loaded, the block devices are not scanned yet
+	breakPreMount  = "pre-mount" // the root device is ready (e.g. unlocked and checked) but not mounted yet
+	breakPrePivot  = "pre-pivot" // the root filesystem is mounted at newRoot, right before switching to it
+)
+
+var (
+	breakpoints     = make(set) // stages requested with rd.break=, protected by breakpointMutex
+	breakpointMutex sync.Mutex
+)
+
+// parseBreakpoints parses comma-separated list of stages, an empty value means the pre-pivot stage
+func parseBreakpoints(value string) error {
+	if value == "" {
+		value = breakPrePivot
+	}
+	for _, stage := range strings.Split(value, ",") {
+		switch stage {
+		case breakCmdline, breakInitqueue, breakPreMount, breakPrePivot:
+			breakpoints[stage] = true
+		default:
+			return fmt.Errorf("unknown stage '%s', expected one of %s, %s, %s, %s", stage, breakCmdline, breakInitqueue, breakPreMount, breakPrePivot)
+		}
+	}
+	return nil
+}
+
+func breakpointRequested(stage string) bool {
+	breakpointMutex.Lock()
+	defer breakpointMutex.Unlock()
+	return breakpoints[stage]
+}
+
+// breakpoint runs the shell if the stage is requested with rd.break=. Every breakpoint fires only once.
+// If another breakpoint shell is running then it waits till the user exits it.
+func breakpoint(stage string) {
+	breakpointMutex.Lock()
+	defer breakpointMutex.Unlock()
+
+	if !breakpoints[stage] {
+		return
+	}
+	delete(breakpoints, stage)
+
+	// the shell needs the console, wait till the pending password prompt is answered
+	inputMutex.Lock()
+	defer inputMutex.Unlock()
+
+	info("reached %s breakpoint", stage)
+	stopPlymouth()
+	console("Breakpoint %s is reached, exit the shell to continue the boot\n", stage)
+	runShell()
+
+	interruptMutex.Lock()
+	emergencyShellStarted = false
+	interruptMutex.Unlock()
+	info("continuing the boot after %s breakpoint", stage)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+)
+
+// bridgeConfig is a bridge interface specified with bridge=<name>:<ports> boot param or 'network.bridges' config option
+type bridgeConfig struct {
+	name  string
+	ports []string
+}
+
+// parseBridgeParam parses dracut style bridge=<name>:<port>[,<port>...] param
+func parseBridgeParam(value string) (*bridgeConfig, error) {
+	name, ports, ok := strings.Cut(value, ":")
+	if !ok || name == "" || ports == "" {
+		return nil, fmt.Errorf("expected format is <name>:<port>[,<port>...]")
+	}
+	b := &bridgeConfig{name: name, ports: strings.Split(ports, ",")}
+	for _, p := range b.ports {
+		if p == "" {
+			return nil, fmt.Errorf("empty port interface name")
+		}
+	}
+	return b, nil
+}
+
+// addBridgeParam adds the bridge interface to the network config and makes sure it is configured at boot
+func addBridgeParam(value string) error {
+	b, err := parseBridgeParam(value)
+	if err != nil {
+		return err
+	}
+	if config.Network == nil {
+		// unless ip= says otherwise the bridge interface is configured with DHCP
+		config.Network = &InitNetworkConfig{Dhcp: true, InterfaceNames: []string{b.name}}
+	}
+	config.Network.Bridges = append(config.Network.Bridges, value)
+	return nil
+}
+
+func bridgeConfigs() ([]*bridgeConfig, error) {
+	var bridges []*bridgeConfig
+	for _, value := range config.Network.Bridges {
+		b, err := parseBridgeParam(value)
+		if err != nil {
+			return nil, fmt.Errorf("bridge %s: %v", value, err)
+		}
+		bridges = append(bridges, b)
+	}
+	return bridges, nil
+}
+
+// isBridgePort checks whether the interface is a port of a bridge
+func isBridgePort(ifname string) bool {
+	bridges, _ := bridgeConfigs()
+	for _, b := range bridges {
+		if stringListContains(ifname, b.ports) {
+			return true
+		}
+	}
+	return false
+}
+
+// bridgesMutex serializes bridge creation as the ports appear concurrently
+var bridgesMutex sync.Mutex
+
+// bridgeLink returns the bridge interface, the interface is created if it does not exist yet
+func bridgeLink(b *bridgeConfig) (netlink.Link, error) {
+	bridgesMutex.Lock()
+	defer bridgesMutex.Unlock()
+
+	if l, err := netlink.LinkByName(b.name); err == nil {
+		if !isCreatedLink(b.name) {
+			return nil, fmt.Errorf("interface %s exists already", b.name)
+		}
+		return l, nil
+	}
+
+	loadModules("bridge").Wait()
+	info("creating bridge interface %s", b.name)
+	if err := createLink(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: b.name}}); err != nil {
+		return nil, fmt.Errorf("unable to create bridge interface %s: %v", b.name, err)
+	}
+	return netlink.LinkByName(b.name)
+}
+
+// setupBridges adds the interface to the bridges it belongs to. The bridge interface is created together with
+// its first port, it shows up as an udev event and gets configured the same way as a physical interface.
+func setupBridges(ifname string) error {
+	bridges, err := bridgeConfigs()
+	if err != nil {
+		return err
+	}
+
+	for _, b := range bridges {
+		if !stringListContains(ifname, b.ports) {
+			continue
+		}
+		bridge, err := bridgeLink(b)
+		if err != nil {
+			return err
+		}
+
+		port, err := netlink.LinkByName(ifname)
+		if err != nil {
+			return err
+		}
+		if ifname == b.ports[0] {
+			// by default the bridge takes the smallest MAC address of its ports. Use the address of the first
+			// port instead so the bridge gets the same DHCP lease no matter what ports appeared at boot.
+			if err := netlink.LinkSetHardwareAddr(bridge, port.Attrs().HardwareAddr); err != nil {
+				return err
+			}
+		}
+		if err := netlink.LinkSetMasterByIndex(port, bridge.Attrs().Index); err != nil {
+			return fmt.Errorf("unable to add %s to bridge %s: %v", ifname, b.name, err)
+		}
+		if err := netlink.LinkSetUp(port); err != nil {
+			return err
+		}
+		initializedIfnames = append(initializedIfnames, ifname)
+		info("%s: added to bridge %s", ifname, b.name)
+	}
+	return nil
+}
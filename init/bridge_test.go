@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBridgeParam(t *testing.T) {
+	b, err := parseBridgeParam("br0:eth0,eth1")
+	require.NoError(t, err)
+	require.Equal(t, &bridgeConfig{name: "br0", ports: []string{"eth0", "eth1"}}, b)
+
+	for _, p := range []string{"br0", "br0:", ":eth0", "br0:eth0,"} {
+		_, err := parseBridgeParam(p)
+		require.Error(t, err, p)
+	}
+}
+
+func TestParseParamsBridge(t *testing.T) {
+	config.Network = nil
+	defer func() { config.Network = nil }()
+
+	require.NoError(t, parseParams("bridge=br0:eth0"))
+	require.True(t, config.Network.Dhcp)
+	require.Equal(t, []string{"br0"}, config.Network.InterfaceNames)
+	require.Equal(t, []string{"br0:eth0"}, config.Network.Bridges)
+	require.True(t, isBridgePort("eth0"))
+	require.False(t, isBridgePort("br0"))
+
+	// a bridge on top of a bond
+	config.Network = nil
+	require.NoError(t, parseParams("ip=br0:dhcp bond=bond0:eth0,eth1 bridge=br0:bond0"))
+	require.Equal(t, []string{"br0"}, config.Network.InterfaceNames)
+	require.True(t, isBridgePort("bond0"))
+	require.True(t, isBondSlave("eth0"))
+}
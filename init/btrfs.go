@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+)
+
+var btrfsSubvol string // booster.subvol=
+
+type btrfsData struct {
+	numDevices uint64
+	devid      uint64
+}
+
+var btrfsFilesystems = newMultiDeviceFs("btrfs")
+
+// handleBtrfsRootDevice mounts the root filesystem once all its devices are present
+func handleBtrfsRootDevice(blk *blkInfo) error {
+	data, ok := blk.data.(btrfsData)
+	if !ok || data.numDevices <= 1 {
+		return mountRootFs(blk.path, blk.format)
+	}
+
+	// the kernel needs to know about all the devices to mount a multi-device filesystem
+	wg := loadModules("btrfs")
+	wg.Wait()
+	if err := scanBtrfsDevice(blk.path); err != nil {
+		return err
+	}
+
+	degraded := hasMountOption(rootFlags, "degraded")
+	return btrfsFilesystems.addDevice(blk.uuid.toString(), data.devid, data.numDevices, blk.path, degraded, func() error {
+		return mountRootFs(blk.path, "btrfs")
+	})
+}
+
+// scanBtrfsDevice registers the device within the kernel module
+func scanBtrfsDevice(dev string) error {
+	controlFile, err := os.OpenFile("/dev/btrfs-control", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer controlFile.Close()
+
+	/* this should be 4k */
+	var btrfsIoctlVolArgs struct {
+		fs   int64
+		name [4088]uint8
+	}
+
+	copy(btrfsIoctlVolArgs.name[:], dev)
+
+	// BTRFS_IOC_DEVICES_READY scans the device and reports with the return value whether all devices are present,
+	// booster tracks the readiness itself using the device superblocks
+	var BTRFS_IOCTL_MAGIC uintptr = 0x94
+	BTRFS_IOC_DEVICES_READY := ior(BTRFS_IOCTL_MAGIC, 39, unsafe.Sizeof(btrfsIoctlVolArgs))
+	return ioctl(controlFile.Fd(), BTRFS_IOC_DEVICES_READY, uintptr(unsafe.Pointer(&btrfsIoctlVolArgs)))
+}
+
+// hasMountOption checks if the comma-separated options contain the option, with or without a value
+func hasMountOption(options, option string) bool {
+	for _, o := range strings.Split(options, ",") {
+		if o == option || strings.HasPrefix(o, option+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// applyBtrfsSubvol adds booster.subvol= to the root mount options
+func applyBtrfsSubvol() error {
+	if btrfsSubvol == "" {
+		return nil
+	}
+	if hasMountOption(rootFlags, "subvol") || hasMountOption(rootFlags, "subvolid") {
+		return fmt.Errorf("booster.subvol= and rootflags=subvol= should not be specified together")
+	}
+	if rootFlags != "" {
+		rootFlags += ","
+	}
+	rootFlags += "subvol=" + btrfsSubvol
+	return nil
+}
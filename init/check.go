@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/anatol/luks.go"
+)
+
+// Booster init binary can be run from the emergency shell as '/init check-unlock $DEVICE...' to verify
+// that the LUKS tokens can be recovered in the current machine state, e.g. that PCR values still match the
+// TPM policy after a firmware update. Nothing is activated or mounted.
+
+const checkUnlockCommand = "check-unlock"
+
+// diagnosticCommands are extra maintenance commands that are compiled in with build tags, e.g. 'fido2-test' with fido2diag tag
+var diagnosticCommands = make(map[string]func(args []string) int)
+
+// checkUnlock tries all tokens of the LUKS device and returns the number of tokens that unlock it
+func checkUnlock(dev string) (int, error) {
+	d, err := luks.Open(dev)
+	if err != nil {
+		return 0, err
+	}
+	defer d.Close()
+
+	tokens, err := d.Tokens()
+	if err != nil {
+		return 0, err
+	}
+	if len(tokens) == 0 {
+		return 0, fmt.Errorf("device has no LUKS tokens")
+	}
+
+	unlockable := 0
+	for _, t := range tokens {
+		if t.Type == "systemd-recovery" {
+			fmt.Printf("%s: token #%d %s: skipped, recovery key is entered with keyboard\n", dev, t.ID, t.Type)
+			continue
+		}
+
+		password, err := recoverTokenSecret(t, d.Version())
+		if errors.Is(err, errUnknownTokenType) {
+			fmt.Printf("%s: token #%d %s: skipped, unknown token type\n", dev, t.ID, t.Type)
+			continue
+		}
+		if err != nil {
+			fmt.Printf("%s: token #%d %s: FAILED, %v\n", dev, t.ID, t.Type, err)
+			if errors.Is(err, errPCRPolicyMismatch) {
+				reportPCRDrift(d, t)
+			}
+			continue
+		}
+
+		v, slot := unsealTokenSlots(d, t, password)
+		if v == nil {
+			fmt.Printf("%s: token #%d %s: FAILED, recovered %d bytes password does not match keyslots %v\n", dev, t.ID, t.Type, len(password), t.Slots)
+		} else {
+			fmt.Printf("%s: token #%d %s: OK, recovered %d bytes password matches keyslot %d\n", dev, t.ID, t.Type, len(password), slot)
+			unlockable++
+		}
+		memZeroBytes(password)
+	}
+
+	return unlockable, nil
+}
+
+// runCheckUnlock implements 'check-unlock' command and returns the process exit code
+func runCheckUnlock(devices []string) int {
+	if len(devices) == 0 {
+		fmt.Printf("usage: %s %s DEVICE...\n", os.Args[0], checkUnlockCommand)
+		return 2
+	}
+
+	printToConsole = true // there is no kmsg outside of the boot process
+	go handleSignals()
+
+	defer closeTPM()
+
+	exitCode := 0
+	for _, dev := range devices {
+		n, err := checkUnlock(dev)
+		if err != nil {
+			fmt.Printf("%s: %v\n", dev, err)
+			exitCode = 1
+			continue
+		}
+		if n == 0 {
+			fmt.Printf("%s: none of the tokens can unlock the device\n", dev)
+			exitCode = 1
+		}
+	}
+	return exitCode
+}
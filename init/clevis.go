@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/anatol/clevis.go"
+)
+
+// Clevis sss pin splits the content encryption key with Shamir's secret sharing, every share is encrypted with its own
+// pin (tang, tpm2 or a nested sss). Booster evaluates sss pins itself rather than with clevis.go: the shares are
+// decrypted concurrently (so a 1-of-2 tang/tpm2 binding does not wait for the network if TPM is enough) and the errors
+// of the shares are reported instead of being dropped.
+
+// clevisJWE is a clevis JWE in compact (LUKS1) or JSON (LUKS2 token) serialization
+type clevisJWE struct {
+	protected string // base64 encoded protected header, it is the additional authenticated data
+	header    clevisHeader
+	iv        []byte
+	encrypted []byte
+	tag       []byte
+}
+
+type clevisHeader struct {
+	Enc    string `json:"enc"`
+	Clevis struct {
+		Pin string     `json:"pin"`
+		Sss *clevisSss `json:"sss"`
+	} `json:"clevis"`
+}
+
+type clevisSss struct {
+	Prime     string   `json:"p"`
+	Threshold int      `json:"t"`
+	Jwe       []string `json:"jwe"`
+}
+
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func parseClevisJWE(data []byte) (*clevisJWE, error) {
+	var parts []string
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var node struct {
+			Protected    string `json:"protected"`
+			EncryptedKey string `json:"encrypted_key"`
+			IV           string `json:"iv"`
+			Ciphertext   string `json:"ciphertext"`
+			Tag          string `json:"tag"`
+		}
+		if err := json.Unmarshal(data, &node); err != nil {
+			return nil, err
+		}
+		parts = []string{node.Protected, node.EncryptedKey, node.IV, node.Ciphertext, node.Tag}
+	} else {
+		parts = strings.Split(strings.TrimSpace(string(data)), ".")
+		if len(parts) != 5 {
+			return nil, fmt.Errorf("JWE compact serialization has %d parts, expected 5", len(parts))
+		}
+	}
+
+	jwe := clevisJWE{protected: parts[0]}
+	header, err := decodeBase64URL(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("JWE header: %v", err)
+	}
+	if err := json.Unmarshal(header, &jwe.header); err != nil {
+		return nil, fmt.Errorf("JWE header: %v", err)
+	}
+	for i, dst := range []*[]byte{&jwe.iv, &jwe.encrypted, &jwe.tag} {
+		if *dst, err = decodeBase64URL(parts[i+2]); err != nil {
+			return nil, fmt.Errorf("JWE: %v", err)
+		}
+	}
+	return &jwe, nil
+}
+
+// clevisNeedsNetwork checks whether the clevis JWE is bound to a tang server, either directly or as a part of sss pin
+func clevisNeedsNetwork(data []byte) bool {
+	jwe, err := parseClevisJWE(data)
+	if err != nil {
+		return false
+	}
+	switch jwe.header.Clevis.Pin {
+	case "tang":
+		return true
+	case "sss":
+		if jwe.header.Clevis.Sss == nil {
+			return false
+		}
+		for _, j := range jwe.header.Clevis.Sss.Jwe {
+			if clevisNeedsNetwork([]byte(j)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clevisDecrypt decrypts the clevis JWE. Tang pins wait for the network till the deadline.
+func clevisDecrypt(data []byte, deadline time.Time) ([]byte, error) {
+	jwe, err := parseClevisJWE(data)
+	if err != nil {
+		return nil, err
+	}
+
+	switch jwe.header.Clevis.Pin {
+	case "sss":
+		return jwe.decryptSss(deadline)
+	case "tang":
+		if config.Network == nil {
+			warning("clevis tang pin is used but network is not configured in the booster image")
+		} else if !awaitNetwork(time.Until(deadline)) {
+			return nil, fmt.Errorf("timeout waiting for network")
+		}
+	}
+	return clevis.Decrypt(data)
+}
+
+func (jwe *clevisJWE) decryptSss(deadline time.Time) ([]byte, error) {
+	sss := jwe.header.Clevis.Sss
+	if sss == nil {
+		return nil, fmt.Errorf("sss pin config is missing")
+	}
+	prime, err := decodeBase64URL(sss.Prime)
+	if err != nil {
+		return nil, fmt.Errorf("sss: invalid prime: %v", err)
+	}
+	if sss.Threshold < 1 || sss.Threshold > len(sss.Jwe) {
+		return nil, fmt.Errorf("sss: threshold %d does not match %d shares", sss.Threshold, len(sss.Jwe))
+	}
+
+	type share struct {
+		point []byte
+		err   error
+	}
+	shares := make(chan share, len(sss.Jwe))
+	for i, j := range sss.Jwe {
+		go func(i int, j string) {
+			point, err := clevisDecrypt([]byte(j), deadline)
+			if err != nil {
+				err = fmt.Errorf("sss share #%d: %w", i, err)
+			}
+			shares <- share{point, err}
+		}(i, j)
+	}
+
+	var points [][]byte
+	var errs []error
+	for range sss.Jwe {
+		s := <-shares
+		if s.err != nil {
+			debug("%v", s.err)
+			errs = append(errs, s.err)
+			continue
+		}
+		points = append(points, s.point)
+		if len(points) == sss.Threshold {
+			break
+		}
+	}
+	defer func() {
+		for _, p := range points {
+			memZeroBytes(p)
+		}
+	}()
+	if len(points) < sss.Threshold {
+		return nil, fmt.Errorf("sss: %d of %d required shares are decrypted: %w", len(points), sss.Threshold, errors.Join(errs...))
+	}
+
+	key, err := sssCombine(prime, points)
+	if err != nil {
+		return nil, fmt.Errorf("sss: %v", err)
+	}
+	defer memZeroBytes(key)
+	return jwe.decryptDir(key)
+}
+
+// sssCombine reconstructs the secret f(0) from the shares. Every share is a point x||y of the polynomial over GF(prime),
+// the numbers have the same length as the prime.
+func sssCombine(primeBytes []byte, shares [][]byte) ([]byte, error) {
+	size := len(primeBytes)
+	prime := new(big.Int).SetBytes(primeBytes)
+	if !prime.ProbablyPrime(64) {
+		return nil, fmt.Errorf("parameter 'p' is not a prime number")
+	}
+
+	xs := make([]*big.Int, len(shares))
+	ys := make([]*big.Int, len(shares))
+	for i, s := range shares {
+		if len(s) != 2*size {
+			return nil, fmt.Errorf("share #%d has size %d, expected %d", i, len(s), 2*size)
+		}
+		xs[i] = new(big.Int).SetBytes(s[:size])
+		ys[i] = new(big.Int).SetBytes(s[size:])
+	}
+
+	// Lagrange interpolation at x=0: f(0) = sum(y_i * prod(x_j / (x_j - x_i)))
+	secret := new(big.Int)
+	for i := range xs {
+		num := big.NewInt(1)
+		den := big.NewInt(1)
+		for j := range xs {
+			if i == j {
+				continue
+			}
+			num.Mul(num, xs[j]).Mod(num, prime)
+			diff := new(big.Int).Sub(xs[j], xs[i])
+			den.Mul(den, diff).Mod(den, prime)
+		}
+		inv := new(big.Int).ModInverse(den, prime)
+		if inv == nil {
+			return nil, fmt.Errorf("shares have duplicate x coordinates")
+		}
+		term := new(big.Int).Mul(ys[i], num)
+		term.Mul(term, inv).Mod(term, prime)
+		secret.Add(secret, term).Mod(secret, prime)
+	}
+	return secret.FillBytes(make([]byte, size)), nil
+}
+
+// decryptDir decrypts JWE content that uses 'dir' key management, i.e. the key is the content encryption key
+func (jwe *clevisJWE) decryptDir(key []byte) ([]byte, error) {
+	var keySize int
+	switch jwe.header.Enc {
+	case "A128GCM":
+		keySize = 16
+	case "A192GCM":
+		keySize = 24
+	case "A256GCM":
+		keySize = 32
+	default:
+		return nil, fmt.Errorf("unsupported JWE content encryption '%s'", jwe.header.Enc)
+	}
+	if len(key) < keySize {
+		return nil, fmt.Errorf("the key is %d bytes, %s requires %d bytes", len(key), jwe.header.Enc, keySize)
+	}
+
+	block, err := aes.NewCipher(key[len(key)-keySize:])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(jwe.iv))
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := append(append([]byte(nil), jwe.encrypted...), jwe.tag...)
+	plaintext, err := gcm.Open(nil, jwe.iv, ciphertext, []byte(jwe.protected))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt JWE: %v", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testClevisJWE(header string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(header)) + "..aXY.Y2lwaGVydGV4dA.dGFn"
+}
+
+func TestClevisNeedsNetwork(t *testing.T) {
+	tang := testClevisJWE(`{"alg":"ECDH-ES","enc":"A256GCM","clevis":{"pin":"tang","tang":{"url":"http://10.0.0.1"}}}`)
+	tpm := testClevisJWE(`{"alg":"dir","enc":"A256GCM","clevis":{"pin":"tpm2","tpm2":{"hash":"sha256"}}}`)
+
+	require.True(t, clevisNeedsNetwork([]byte(tang)))
+	require.False(t, clevisNeedsNetwork([]byte(tpm)))
+	require.True(t, clevisNeedsNetwork([]byte(testClevisJWE(`{"clevis":{"pin":"sss","sss":{"t":1,"jwe":["`+tpm+`","`+tang+`"]}}}`))))
+	require.False(t, clevisNeedsNetwork([]byte(testClevisJWE(`{"clevis":{"pin":"sss","sss":{"t":1,"jwe":["`+tpm+`"]}}}`))))
+
+	// LUKS2 token stores JWE in JSON serialization
+	parts := strings.Split(tang, ".")
+	require.True(t, clevisNeedsNetwork([]byte(`{"protected":"`+parts[0]+`","iv":"`+parts[2]+`","ciphertext":"`+parts[3]+`","tag":"`+parts[4]+`"}`)))
+	require.False(t, clevisNeedsNetwork([]byte("not a jwe")))
+}
+
+func TestClevisSss(t *testing.T) {
+	prime := big.NewInt(0)
+	prime.SetString("ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff43", 16) // 2^256-189
+	key := make([]byte, 32)
+	key[31] = 7
+	secret := new(big.Int).SetBytes(key)
+
+	// 2-of-3 scheme: f(x) = secret + 5x
+	share := func(x int64) []byte {
+		y := new(big.Int).Mul(big.NewInt(x), big.NewInt(5))
+		y.Add(y, secret).Mod(y, prime)
+		out := make([]byte, 64)
+		big.NewInt(x).FillBytes(out[:32])
+		y.FillBytes(out[32:])
+		return out
+	}
+	primeBytes := prime.Bytes()
+
+	got, err := sssCombine(primeBytes, [][]byte{share(3), share(11)})
+	require.NoError(t, err)
+	require.Equal(t, key, got)
+	got, err = sssCombine(primeBytes, [][]byte{share(11), share(2)})
+	require.NoError(t, err)
+	require.Equal(t, key, got)
+	_, err = sssCombine(primeBytes, [][]byte{share(3), share(3)})
+	require.Error(t, err)
+	_, err = sssCombine(primeBytes, [][]byte{share(3)[:40]})
+	require.Error(t, err)
+
+	// the content is encrypted with the reconstructed key
+	protected := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"dir","enc":"A256GCM","clevis":{"pin":"sss"}}`))
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	iv := make([]byte, gcm.NonceSize())
+	sealed := gcm.Seal(nil, iv, []byte("luks passphrase"), []byte(protected))
+	enc := base64.RawURLEncoding.EncodeToString
+	data := protected + ".." + enc(iv) + "." + enc(sealed[:len(sealed)-16]) + "." + enc(sealed[len(sealed)-16:])
+
+	jwe, err := parseClevisJWE([]byte(data))
+	require.NoError(t, err)
+	plaintext, err := jwe.decryptDir(key)
+	require.NoError(t, err)
+	require.Equal(t, "luks passphrase", string(plaintext))
+
+	key[0] = 1
+	_, err = jwe.decryptDir(key)
+	require.Error(t, err)
+}
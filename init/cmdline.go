@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func parseCmdline() error {
@@ -12,11 +14,30 @@ func parseCmdline() error {
 	if err != nil {
 		return err
 	}
-	if err := parseParams(strings.TrimSpace(string(b))); err != nil {
+	cmdline := strings.TrimSpace(string(b))
+	measure("kernel cmdline", []byte(cmdline))
+	if err := parseParams(cmdline); err != nil {
 		return err
 	}
 
-	if cmdRoot == nil && !config.EnableZfs { // zfs specifies root dataset with 'zfs=' param.
+	if iscsiFirmware {
+		if err := configureIscsiFromIbft(); err != nil {
+			return fmt.Errorf("iBFT: %v", err)
+		}
+	}
+	if iscsi != nil && iscsi.netInterface != "" && config.Network == nil {
+		config.Network = &InitNetworkConfig{Dhcp: true, InterfaceNames: []string{iscsi.netInterface}}
+	}
+	if config.Network != nil && len(config.Network.Bonds) > 0 {
+		configureBondingModule()
+	}
+	if len(nbdTargets) > 0 || nfsRoot != nil || iscsi != nil || len(nvmfTargets) > 0 || needNet {
+		enableNetworkForRoot()
+	}
+
+	// zfs specifies root dataset with 'zfs=' param, live media root device is set up once the medium is found,
+	// root=nbd:... device is known once the export is connected
+	if cmdRoot == nil && !config.EnableZfs && liveMedium == nil && nbdRoot == nil {
 		// try to auto-discover gpt partition https://www.freedesktop.org/wiki/Specifications/DiscoverablePartitionsSpec/
 		rootUUIDType, ok := rootAutodiscoveryGptTypes[runtime.GOARCH]
 		if !ok {
@@ -151,6 +172,8 @@ func getNextParam(params string, index int) (string, string, int) {
 
 func parseParams(params string) error {
 	var luksOptions []string
+	var allowDiscards bool
+	var quiet, verbose, logLevelSpecified bool
 
 	var key, value string
 	i := 0
@@ -164,6 +187,7 @@ func parseParams(params string) error {
 			// probably trailing whitespace, just ignore it
 			warning("attempting to parse a parameter returned a blank key, cmdline may be malformed somewhere around %d", i)
 		case "booster.log":
+			logLevelSpecified = true
 			for _, p := range strings.Split(value, ",") {
 				switch p {
 				case "debug":
@@ -182,16 +206,82 @@ func parseParams(params string) error {
 			}
 		case "booster.debug":
 			// booster.debug is an obsolete parameter
+			logLevelSpecified = true
 			verbosityLevel = levelDebug
 			printToConsole = true
+		case "booster.debug_timing":
+			debugTiming = value == "" || value == "1"
+		case "booster.verbose":
+			verbose = true
 		case "quiet":
-			verbosityLevel = levelError
+			quiet = true
+		case "splash":
+			splashRequested = true
+		case "plymouth.enable", "rd.plymouth":
+			plymouthDisabled = value == "0"
 		case "root":
+			if strings.HasPrefix(value, "nbd:") {
+				if err := parseNbdRoot(value); err != nil {
+					return fmt.Errorf("root=%s: %v", value, err)
+				}
+				break
+			}
+			if isNfsDracutRoot(value) {
+				nfsRootDracut = value
+				cmdRoot = &deviceRef{refPath, "/dev/nfs"}
+				break
+			}
+			if medium, ok := strings.CutPrefix(value, "live:"); ok {
+				var err error
+				liveMedium, err = parseDeviceRef(medium)
+				if err != nil {
+					return fmt.Errorf("root=%s: %v", value, err)
+				}
+				break
+			}
+			if dataset, ok := parseZfsRootParam(value); ok {
+				zfsDataset = dataset
+				break
+			}
 			var err error
 			cmdRoot, err = parseDeviceRef(value)
 			if err != nil {
 				return fmt.Errorf("root=%s: %v", value, err)
 			}
+		case "nfsroot":
+			nfsRootParam = value
+		case "netroot":
+			if strings.HasPrefix(value, "iscsi:") {
+				// the target LUNs are detected as regular disks, root= specifies the root device
+				if err := parseIscsiNetroot(value); err != nil {
+					return fmt.Errorf("netroot=%s: %v", value, err)
+				}
+				break
+			}
+			if isNfsDracutRoot(value) {
+				nfsRootDracut = value
+				cmdRoot = &deviceRef{refPath, "/dev/nfs"}
+				break
+			}
+			if !strings.HasPrefix(value, "nbd:") {
+				return fmt.Errorf("netroot=%s: unsupported network root type", value)
+			}
+			// netroot only connects the device, root= specifies what is mounted e.g. a LUKS volume at the nbd device
+			t, _, err := parseNbdParam(value)
+			if err != nil {
+				return fmt.Errorf("netroot=%s: %v", value, err)
+			}
+			nbdTargets = append(nbdTargets, t)
+		case "rd.nvmf.discover":
+			t, err := parseNvmfDiscoverParam(value)
+			if err != nil {
+				return fmt.Errorf("rd.nvmf.discover=%s: %v", value, err)
+			}
+			nvmfTargets = append(nvmfTargets, t)
+		case "rd.nvmf.hostnqn":
+			nvmfHostNqn = value
+		case "rd.nvmf.hostid":
+			nvmfHostID = value
 		case "rd.modules_force_load":
 			if value == "" {
 				break
@@ -199,37 +289,222 @@ func parseParams(params string) error {
 
 			modules := strings.Split(value, ",")
 			config.ModulesForceLoad = append(config.ModulesForceLoad, modules...)
+		case "vlan":
+			if err := addVlanParam(value); err != nil {
+				return fmt.Errorf("vlan=%s: %v", value, err)
+			}
+		case "bond":
+			if err := addBondParam(value); err != nil {
+				return fmt.Errorf("bond=%s: %v", value, err)
+			}
+		case "bridge":
+			if err := addBridgeParam(value); err != nil {
+				return fmt.Errorf("bridge=%s: %v", value, err)
+			}
+		case "booster.wifi":
+			c, err := parseWifiParam(value)
+			if err != nil {
+				return fmt.Errorf("booster.wifi: %v", err)
+			}
+			configureWifi(c)
+		case "booster.fido2_rp":
+			if value == "" {
+				return fmt.Errorf("booster.fido2_rp: relying party ID is empty")
+			}
+			fido2RelyingParty = value
+		case "booster.pkcs11_module":
+			if !strings.HasPrefix(value, "/") {
+				return fmt.Errorf("booster.pkcs11_module=%s: expected an absolute path", value)
+			}
+			pkcs11Module = value
+		case "booster.fido2_retries":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return fmt.Errorf("booster.fido2_retries=%s: expected a positive number of attempts", value)
+			}
+			fido2OpenAttempts = n
+		case "booster.fido2_retry_delay":
+			delay, err := time.ParseDuration(value)
+			if err != nil || delay < 0 {
+				return fmt.Errorf("booster.fido2_retry_delay=%s: invalid duration", value)
+			}
+			fido2OpenDelay = delay
+		case "booster.unlock_jobs":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return fmt.Errorf("booster.unlock_jobs=%s: expected a positive number", value)
+			}
+			unlockJobs = n
+		case "booster.integrity_hash":
+			if value == "" {
+				return fmt.Errorf("booster.integrity_hash: algorithm is not specified")
+			}
+			integrityHash = value
+		case "booster.kdf_low_memory":
+			kdfLowMemory = true
+		case "booster.fido2_timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("booster.fido2_timeout=%s: expected a positive duration", value)
+			}
+			fido2Timeout = timeout
+		case "booster.unlock_order":
+			order, err := parseUnlockOrder(value)
+			if err != nil {
+				return fmt.Errorf("booster.unlock_order=%s: %v", value, err)
+			}
+			unlockOrder = order
+		case "booster.luks_meta":
+			src, err := parseLuksMetaParam(value)
+			if err != nil {
+				return fmt.Errorf("booster.luks_meta=%s: %v", value, err)
+			}
+			if luksMeta == nil {
+				luksMetaLoaded.Add(1)
+			}
+			luksMeta = src
+		case "booster.password_echo":
+			if err := parsePasswordEchoParam(value); err != nil {
+				return fmt.Errorf("booster.password_echo=%s: %v", value, err)
+			}
+		case "booster.password_timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout < 0 {
+				return fmt.Errorf("booster.password_timeout=%s: invalid duration", value)
+			}
+			passwordTimeout = timeout
+		case "booster.password_tries":
+			tries, err := strconv.Atoi(value)
+			if err != nil || tries < 0 {
+				return fmt.Errorf("booster.password_tries=%s: expected a non-negative number", value)
+			}
+			passwordTries = tries
+		case "booster.unlock_timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout < 0 {
+				return fmt.Errorf("booster.unlock_timeout=%s: invalid duration", value)
+			}
+			unlockTimeout = timeout
+		case "booster.key_source":
+			src, err := parseKeySource(value)
+			if err != nil {
+				return fmt.Errorf("booster.key_source=%s: %v", value, err)
+			}
+			keySrc = src
+		case "booster.key_source_timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("booster.key_source_timeout=%s: invalid duration", value)
+			}
+			keySourceTimeout = timeout
+		case "booster.tpm_auto_reseal":
+			tpmAutoReseal = true
+		case "booster.tpm_lockout_wait":
+			wait, err := time.ParseDuration(value)
+			if err != nil || wait < 0 {
+				return fmt.Errorf("booster.tpm_lockout_wait=%s: invalid duration", value)
+			}
+			tpmLockoutWait = wait
+		case "booster.tpm_unencrypted_sessions":
+			tpmParamEncryption = false
+		case "booster.tpm_vendor":
+			tpmVendors = nil
+			for _, v := range strings.Split(value, ",") {
+				if v != "" {
+					tpmVendors = append(tpmVendors, v)
+				}
+			}
+		case "booster.tpm_timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout < 0 {
+				return fmt.Errorf("booster.tpm_timeout=%s: invalid duration", value)
+			}
+			tpmReadyTimeout = timeout
+		case "booster.tpm2_signature":
+			if !strings.HasPrefix(value, "/") {
+				return fmt.Errorf("booster.tpm2_signature=%s: absolute path expected", value)
+			}
+			tpmPCRSignaturePath = value
+		case "booster.tpm_pcrs":
+			pcrs, err := parsePCRList(value)
+			if err != nil {
+				return fmt.Errorf("booster.tpm_pcrs=%s: %v", value, err)
+			}
+			tpmPCRs = pcrs
+		case "booster.load_modules":
+			switch value {
+			case "auto":
+				modaliasAutoload = true
+			case "none":
+				modaliasAutoload = false
+			default:
+				return fmt.Errorf("booster.load_modules=%s: expected 'auto' or 'none'", value)
+			}
 		case "resume":
 			var err error
 			cmdResume, err = parseDeviceRef(value)
 			if err != nil {
 				return fmt.Errorf("resume=%s: %v", value, err)
 			}
+		case "resume_offset":
+			offset, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("resume_offset=%s: expected a number", value)
+			}
+			cmdResumeOffset = offset
+		case "booster.kexec":
+			if value == "" {
+				return fmt.Errorf("booster.kexec: kernel path is not specified")
+			}
+			kexecKernel = value
+		case "booster.kexec_initrd":
+			kexecInitrd = value
+		case "booster.kexec_cmdline":
+			kexecCmdline = value
 		case "init":
 			initBinary = value
 		case "rootfstype":
 			rootFsType = value
 		case "rootflags":
 			rootFlags = value
+		case "booster.subvol":
+			if value == "" {
+				return fmt.Errorf("booster.subvol: subvolume is not specified")
+			}
+			btrfsSubvol = value
 		case "ro":
 			rootRo = true
 		case "rw":
 			rootRw = true
 		case "rd.luks.options":
-			for _, o := range strings.Split(value, ",") {
-				flag, ok := rdLuksOptions[o]
-				if !ok {
-					return fmt.Errorf("unknown value in rd.luks.options: %v", o)
+			// either a global list of options or per-device form rd.luks.options=<UUID>=<options>
+			if parts := strings.SplitN(value, "=", 2); len(parts) == 2 {
+				if uuid, err := parseUUID(parts[0]); err == nil {
+					m := findOrCreateLuksMapping(uuid)
+					m.options = append(m.options, parseLuksOptions(parts[1])...)
+					m.hasOwnOptions = true
+					break
 				}
-				luksOptions = append(luksOptions, flag)
 			}
+			luksOptions = append(luksOptions, parseLuksOptions(value)...)
+		case "rd.luks.allow-discards":
+			if value == "" {
+				allowDiscards = true
+				break
+			}
+			uuid, err := parseUUID(strings.TrimPrefix(value, "luks-"))
+			if err != nil {
+				return fmt.Errorf("invalid UUID %s in rd.luks.allow-discards boot param: %v", value, err)
+			}
+			m := findOrCreateLuksMapping(uuid)
+			m.options = append(m.options, rdLuksOptions["discard"])
 		case "rd.luks.name":
 			parts := strings.Split(value, "=")
 			if len(parts) != 2 {
 				return fmt.Errorf("invalid rd.luks.name kernel parameter %s, expected format rd.luks.name=<UUID>=<name>", value)
 			}
 
-			uuid, err := parseUUID(parts[0])
+			uuid, err := parseUUID(strings.TrimPrefix(parts[0], "luks-"))
 			if err != nil {
 				return fmt.Errorf("invalid UUID %s %v", parts[0], err)
 			}
@@ -237,46 +512,105 @@ func parseParams(params string) error {
 			m := findOrCreateLuksMapping(uuid)
 			m.name = parts[1]
 		case "rd.luks.uuid":
-			uuid, err := parseUUID(value)
+			// systemd and dracut allow the UUID to be prefixed with 'luks-'
+			uuid, err := parseUUID(strings.TrimPrefix(value, "luks-"))
 			if err != nil {
 				return fmt.Errorf("invalid UUID %s in rd.luks.uuid boot param: %v", value, err)
 			}
 
 			findOrCreateLuksMapping(uuid)
 		case "rd.luks.key":
-			var uuid UUID
-			var keyfile string
-
-			parts := strings.SplitN(value, "=", 2)
-
-			if len(parts) == 1 {
+			uuid, keyfile, err := parseLuksKeyParam(value)
+			if err != nil {
+				return fmt.Errorf("invalid rd.luks.key=%s: %v", value, err)
+			}
+			if uuid == nil {
 				// do we only have 1 luks device?
-				if len(luksMappings) == 1 {
-					// we attach to it and hope for the best
-					uuid = luksMappings[0].ref.data.(UUID)
-				} else {
+				if len(luksMappings) != 1 {
 					// don't know what to do here
-					return fmt.Errorf("invalid rd.luks.key kernel parameter %s, more than 1 luks device", value)
-				}
-
-				keyfile = parts[0]
-			} else if len(parts) == 2 {
-				var err error
-				uuid, err = parseUUID(parts[0])
-				if err != nil {
-					return fmt.Errorf("invalid UUID %s in rd.luks.key boot param: %v", value, err)
+					return fmt.Errorf("invalid rd.luks.key kernel parameter %s, LUKS device is not specified and there is more than 1 luks device", value)
 				}
-
-				keyfile = parts[1]
-			} else {
-				return fmt.Errorf("invalid rd.luks.key kernel parameter %s, expected format rd.luks.key=<UUID>=<keyfile>", value)
+				// we attach to it and hope for the best
+				uuid = luksMappings[0].ref.data.(UUID)
 			}
 
 			m := findOrCreateLuksMapping(uuid)
 			m.keyfile = keyfile
+		case "rd.luks.header":
+			uuid, header, err := parseLuksHeaderParam(value)
+			if err != nil {
+				return fmt.Errorf("invalid rd.luks.header=%s: %v", value, err)
+			}
+			m := findOrCreateLuksMapping(uuid)
+			m.header = header
+		case "rd.luks.data":
+			uuid, data, err := parseLuksDataParam(value)
+			if err != nil {
+				return fmt.Errorf("invalid rd.luks.data=%s: %v", value, err)
+			}
+			m := findOrCreateLuksMapping(uuid)
+			m.data = data
+		case "rd.md.degraded":
+			degraded, timeout, err := parseMdDegradedParam(value)
+			if err != nil {
+				return fmt.Errorf("rd.md.degraded=%s: %v", value, err)
+			}
+			mdDegraded, mdDegradedTimeout = degraded, timeout
+		case "rd.break":
+			if !config.EnableShell {
+				// the boot parameters are not measured and can be edited at the boot loader menu, a shell with
+				// the volumes already unlocked by TPM is given only if the image is built for it
+				warning("rd.break: the image is built without enable_shell option, the breakpoints are ignored")
+				break
+			}
+			if err := parseBreakpoints(value); err != nil {
+				warning("rd.break: %v", err)
+			}
+		case "rd.neednet":
+			// bring the network up and hand it over to the booted system
+			needNet = value == "" || value == "1"
+		case "ip", "booster.ip":
+			if value == "ibft" {
+				// the network is configured with the interface settings from iBFT
+				iscsiFirmware = true
+				break
+			}
+			if err := parseIPParam(value); err != nil {
+				return fmt.Errorf("%s=%s: %v", key, value, err)
+			}
+		case "rd.live.dir":
+			liveDir = value
+		case "rd.live.squashimg":
+			liveSquashImg = value
+		case "booster.overlay":
+			var err error
+			overlayRoot, err = parseOverlayParam(value)
+			if err != nil {
+				return fmt.Errorf("booster.overlay=%s: %v", value, err)
+			}
+		case "fsck.mode":
+			if err := parseFsckModeParam(value); err != nil {
+				return fmt.Errorf("fsck.mode=%s: %v", value, err)
+			}
+		case "fsck.repair":
+			if err := parseFsckRepairParam(value); err != nil {
+				return fmt.Errorf("fsck.repair=%s: %v", value, err)
+			}
 		case "zfs":
 			zfsDataset = value
 		default:
+			if ok, err := parseVerityParam(key, value); ok {
+				if err != nil {
+					return fmt.Errorf("%s=%s: %v", key, value, err)
+				}
+				break
+			}
+			if ok, err := parseIscsiParam(key, value); ok {
+				if err != nil {
+					return fmt.Errorf("%s=%s: %v", key, value, err)
+				}
+				break
+			}
 			if dot := strings.IndexByte(key, '.'); value != "" && dot != -1 {
 				// this param looks like a module options
 				mod, param := key[:dot], key[dot+1:]
@@ -286,11 +620,75 @@ func parseParams(params string) error {
 		}
 	}
 
+	// 'quiet' silences informational messages only, prompts that require user action are always printed with console()
+	if verbose {
+		verbosityLevel = levelDebug
+		printToConsole = true
+	} else if quiet && !logLevelSpecified {
+		verbosityLevel = levelError
+	}
+
+	if nfsRootDracut != "" {
+		var err error
+		nfsRoot, err = parseNfsDracutRootParam(nfsRootDracut, nfsServerAddr)
+		if err != nil {
+			return fmt.Errorf("root=%s: %v", nfsRootDracut, err)
+		}
+	} else if cmdRoot != nil && cmdRoot.format == refPath && cmdRoot.data.(string) == "/dev/nfs" {
+		var err error
+		nfsRoot, err = parseNfsRootParam(nfsRootParam, nfsServerAddr)
+		if err != nil {
+			return fmt.Errorf("nfsroot=%s: %v", nfsRootParam, err)
+		}
+	}
+
+	if zfsDataset != "" && !config.EnableZfs {
+		return fmt.Errorf("ZFS root dataset %s is specified but the image is built without enable_zfs config option", zfsDataset)
+	}
+
+	if err := applyBtrfsSubvol(); err != nil {
+		return err
+	}
+
+	if err := validateVerityRoot(); err != nil {
+		return err
+	}
+
+	for _, m := range luksMappings {
+		if (m.header == nil) != (m.data == nil) {
+			return fmt.Errorf("LUKS volume %s: rd.luks.header and rd.luks.data should be specified together", m.name)
+		}
+	}
+
+	if allowDiscards {
+		luksOptions = append(luksOptions, rdLuksOptions["discard"])
+	}
 	if luksOptions != nil {
-		for i := range luksMappings {
-			luksMappings[i].options = luksOptions
+		// global options apply to all devices that do not have its own rd.luks.options=<UUID>=... options
+		for _, m := range luksMappings {
+			if !m.hasOwnOptions {
+				m.options = append(m.options, luksOptions...)
+			}
 		}
 	}
 
 	return nil
 }
+
+// parseLuksOptions converts a comma-separated list of crypttab-style options into LUKS flags.
+// Options that booster does not understand (e.g. tpm2-device=auto) are reported and skipped.
+func parseLuksOptions(value string) []string {
+	var flags []string
+	for _, o := range strings.Split(value, ",") {
+		if o == "" {
+			continue
+		}
+		flag, ok := rdLuksOptions[o]
+		if !ok {
+			warning("unknown value in rd.luks.options: %v, ignoring it", o)
+			continue
+		}
+		flags = append(flags, flag)
+	}
+	return flags
+}
@@ -1,15 +1,83 @@
 package main
 
 import (
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
-func TestParseParamsInvalidLuksOptions(t *testing.T) {
+func TestParseParamsUnknownLuksOptions(t *testing.T) {
 	luksMappings = nil
 
-	require.Error(t, parseParams("rd.luks.name=ab6d7d78-b816-4495-928d-766d6607035e=root rd.luks.name=7843d77f-cdd6-4289-a4de-a708c4aacede=swap rd.luks.name=7f28c723-fd6b-4640-bc94-9366edd8880d=cache root=UUID=e8e81fc3-8f81-4a3a-ac3d-aab36aa0c45f video=efifb:on add_efi_memmap zswap.enabled=1 zswap.max_pool_percent=100 zswap.zpool=z3fold resume=/dev/mapper/swap acpi=copy_dsdt rd.luks.options=tpm2-device=auto"))
+	// unknown options are reported and skipped
+	require.NoError(t, parseParams("rd.luks.name=ab6d7d78-b816-4495-928d-766d6607035e=root rd.luks.name=7843d77f-cdd6-4289-a4de-a708c4aacede=swap rd.luks.name=7f28c723-fd6b-4640-bc94-9366edd8880d=cache root=UUID=e8e81fc3-8f81-4a3a-ac3d-aab36aa0c45f video=efifb:on add_efi_memmap zswap.enabled=1 zswap.max_pool_percent=100 zswap.zpool=z3fold resume=/dev/mapper/swap acpi=copy_dsdt rd.luks.options=tpm2-device=auto,discard"))
+	require.Len(t, luksMappings, 3)
+	for _, m := range luksMappings {
+		require.Equal(t, []string{"allow-discards"}, m.options)
+	}
+}
+
+func TestParseParamsPerDeviceLuksOptions(t *testing.T) {
+	luksMappings = nil
+
+	require.NoError(t, parseParams("rd.luks.uuid=luks-ab6d7d78-b816-4495-928d-766d6607035e rd.luks.name=7843d77f-cdd6-4289-a4de-a708c4aacede=swap rd.luks.options=7843d77f-cdd6-4289-a4de-a708c4aacede=no-write-workqueue rd.luks.options=same-cpu-crypt rd.luks.allow-discards"))
+	require.Len(t, luksMappings, 2)
+
+	root := luksMappings[0]
+	require.Equal(t, "luks-ab6d7d78-b816-4495-928d-766d6607035e", root.name)
+	require.Equal(t, []string{"same-cpu-crypt", "allow-discards"}, root.options)
+
+	swap := luksMappings[1]
+	require.Equal(t, "swap", swap.name)
+	require.Equal(t, []string{"no-write-workqueue"}, swap.options)
+}
+
+func TestParseParamsLuksAllowDiscardsPerDevice(t *testing.T) {
+	luksMappings = nil
+
+	require.NoError(t, parseParams("rd.luks.uuid=ab6d7d78-b816-4495-928d-766d6607035e rd.luks.uuid=7843d77f-cdd6-4289-a4de-a708c4aacede rd.luks.allow-discards=7843d77f-cdd6-4289-a4de-a708c4aacede"))
+	require.Len(t, luksMappings, 2)
+	require.Nil(t, luksMappings[0].options)
+	require.Equal(t, []string{"allow-discards"}, luksMappings[1].options)
+}
+
+func TestParseParamsLuksDetachedHeader(t *testing.T) {
+	luksMappings = nil
+	defer func() { luksMappings = nil }()
+
+	require.NoError(t, parseParams("rd.luks.name=ab6d7d78-b816-4495-928d-766d6607035e=root rd.luks.header=ab6d7d78-b816-4495-928d-766d6607035e=/root.hdr:LABEL=keys rd.luks.data=ab6d7d78-b816-4495-928d-766d6607035e=PARTUUID=7843d77f-cdd6-4289-a4de-a708c4aacede"))
+	require.Len(t, luksMappings, 1)
+	root := luksMappings[0]
+	require.Equal(t, "root", root.name)
+	require.Equal(t, "/root.hdr at LABEL=keys", root.header.String())
+	require.Equal(t, refGptUUID, root.data.format)
+
+	luksMappings = nil
+	require.Error(t, parseParams("rd.luks.header=ab6d7d78-b816-4495-928d-766d6607035e=/root.hdr"))
+	luksMappings = nil
+	require.Error(t, parseParams("rd.luks.data=ab6d7d78-b816-4495-928d-766d6607035e=/dev/sda2"))
+}
+
+func TestParseParamsVerityRoot(t *testing.T) {
+	defer func() {
+		verityRoot = nil
+		cmdRoot = nil
+	}()
+
+	require.NoError(t, parseParams("root=UUID=e8e81fc3-8f81-4a3a-ac3d-aab36aa0c45f roothash=4392712ba01368efdf14b05c76f9e4df0d53664630b5d48632ed17a137f39076 systemd.verity_root_data=PARTUUID=7843d77f-cdd6-4289-a4de-a708c4aacede systemd.verity_root_hash=/dev/sda3 systemd.verity_root_options=restart-on-corruption,foo"))
+	require.Equal(t, "4392712ba01368efdf14b05c76f9e4df0d53664630b5d48632ed17a137f39076", verityRoot.rootHash)
+	require.Equal(t, refGptUUID, verityRoot.data.format)
+	require.Equal(t, &deviceRef{refPath, "/dev/sda3"}, verityRoot.hash)
+	require.Equal(t, []string{"restart_on_corruption"}, verityRoot.options)
+	// the data device must not be mounted directly
+	require.Equal(t, &deviceRef{refPath, "/dev/mapper/root"}, cmdRoot)
+
+	verityRoot = nil
+	require.Error(t, parseParams("roothash=4392712ba01368efdf14b05c76f9e4df0d53664630b5d48632ed17a137f39076"))
+	verityRoot = nil
+	require.Error(t, parseParams("roothash=foo"))
 }
 
 func TestParseParams(t *testing.T) {
@@ -147,3 +215,511 @@ func TestGetNextParamMulti(t *testing.T) {
 		}
 	}
 }
+
+func TestParseParamsIPDhcp(t *testing.T) {
+	config.Network = nil
+
+	require.NoError(t, parseParams("ip=dhcp"))
+	require.NotNil(t, config.Network)
+	require.True(t, config.Network.Dhcp)
+	require.Empty(t, config.Network.InterfaceNames)
+
+	config.Network = nil
+	require.NoError(t, parseParams("booster.ip=eth0:dhcp booster.ip=eth1:dhcp"))
+	require.True(t, config.Network.Dhcp)
+	require.Equal(t, []string{"eth0", "eth1"}, config.Network.InterfaceNames)
+
+	config.Network = nil
+	require.Error(t, parseParams("ip=eth0:foo"))
+	config.Network = nil
+}
+
+func TestParseParamsIPv6(t *testing.T) {
+	config.Network = nil
+
+	require.NoError(t, parseParams("ip=auto6"))
+	require.NotNil(t, config.Network)
+	require.False(t, config.Network.Dhcp)
+	require.Equal(t, "auto6", config.Network.IPv6)
+
+	config.Network = nil
+	require.NoError(t, parseParams("ip=eth0:dhcp ip=eth0:dhcp6"))
+	require.True(t, config.Network.Dhcp)
+	require.Equal(t, "dhcp6", config.Network.IPv6)
+
+	config.Network = nil
+	ipParams = ipParamState{}
+	require.NoError(t, parseParams("ip=10.0.2.15::10.0.2.2:24::eth0:none ip=:::::eth0:auto6"))
+	require.Equal(t, "10.0.2.15/24", config.Network.IP)
+	require.Equal(t, "auto6", config.Network.IPv6)
+
+	config.Network = nil
+	ipParams = ipParamState{}
+}
+
+func TestParseParamsIPStatic(t *testing.T) {
+	config.Network = nil
+	ipParams = ipParamState{}
+
+	require.NoError(t, parseParams("ip=10.0.2.15::10.0.2.2:255.255.255.0:myhost:eth0:none:8.8.8.8:1.1.1.1"))
+	c := config.Network
+	require.NotNil(t, c)
+	require.False(t, c.Dhcp)
+	require.Equal(t, "10.0.2.15/24", c.IP)
+	require.Equal(t, "10.0.2.2", c.Gateway)
+	require.Equal(t, "8.8.8.8,1.1.1.1", c.DNSServers)
+	require.Equal(t, "myhost", c.Hostname)
+	require.Equal(t, []string{"eth0"}, c.InterfaceNames)
+
+	config.Network = nil
+	ipParams = ipParamState{}
+	require.NoError(t, parseParams("ip=192.168.1.5:::16::enp0s3:off"))
+	require.Equal(t, "192.168.1.5/16", config.Network.IP)
+	require.Empty(t, config.Network.Gateway)
+
+	config.Network = nil
+	ipParams = ipParamState{}
+	require.NoError(t, parseParams("ip=:::::eth1:dhcp"))
+	require.True(t, config.Network.Dhcp)
+	require.Equal(t, []string{"eth1"}, config.Network.InterfaceNames)
+
+	invalid := func(param string) {
+		config.Network = nil
+		ipParams = ipParamState{}
+		require.Error(t, parseParams(param))
+	}
+	invalid("ip=10.0.2.300::10.0.2.2:255.255.255.0::eth0:none")
+	invalid("ip=10.0.2.15::10.0.2.2:255.0.255.0::eth0:none")
+	invalid("ip=10.0.2.15::10.0.2.2:255.255.255.0::eth0:dhcp")
+	invalid("ip=10.0.2.15::gw:255.255.255.0::eth0:none")
+	invalid("ip=10.0.2.15::10.0.2.2:24::eth0:none ip=10.0.2.16::10.0.2.2:24::eth1:none")
+
+	// static and dynamic configurations cannot be mixed, they share the single network config
+	invalid("ip=10.0.2.15::10.0.2.2:24::eth0:none ip=eth1:dhcp")
+	invalid("ip=eth1:dhcp ip=10.0.2.15::10.0.2.2:24::eth0:none")
+	invalid("ip=10.0.2.15::10.0.2.2:24::eth0:none ip=dhcp")
+	invalid("ip=10.0.2.15::10.0.2.2:24::eth0:none ip=eth1:auto6")
+	invalid("ip=eth1:auto6 ip=10.0.2.15::10.0.2.2:24::eth0:none")
+
+	config.Network = nil
+	ipParams = ipParamState{}
+	require.Error(t, parseParams("ip=10.0.2.15::10.0.2.2:24::eth0:none ip=eth1:dhcp"))
+	require.False(t, config.Network.Dhcp)
+	require.Equal(t, "10.0.2.15/24", config.Network.IP)
+	require.Equal(t, []string{"eth0"}, config.Network.InterfaceNames)
+
+	config.Network = nil
+	ipParams = ipParamState{}
+}
+
+func TestParseParamsNfsRoot(t *testing.T) {
+	nfsRoot, nfsRootParam, nfsServerAddr = nil, "", ""
+	ipParams = ipParamState{}
+	config.Network = nil
+
+	require.NoError(t, parseParams("root=/dev/nfs nfsroot=10.0.2.2:/srv/root,vers=4.2,tcp"))
+	require.Equal(t, &nfsRootConfig{"10.0.2.2", "/srv/root", []string{"vers=4.2", "tcp"}}, nfsRoot)
+	fstype, options := nfsRoot.fsType()
+	require.Equal(t, "nfs4", fstype)
+	require.Equal(t, []string{"vers=4.2", "tcp"}, options)
+
+	// server address comes from ip= param
+	nfsRoot, nfsRootParam, nfsServerAddr = nil, "", ""
+	require.NoError(t, parseParams("ip=10.0.2.15:10.0.2.3:10.0.2.2:24::eth0:none root=/dev/nfs nfsroot=/srv/root"))
+	require.Equal(t, &nfsRootConfig{"10.0.2.3", "/srv/root", nil}, nfsRoot)
+	fstype, options = nfsRoot.fsType()
+	require.Equal(t, "nfs", fstype)
+	require.Equal(t, []string{"nolock"}, options)
+
+	nfsRoot, nfsRootParam, nfsServerAddr = nil, "", ""
+	ipParams = ipParamState{}
+	require.Error(t, parseParams("root=/dev/nfs nfsroot=/srv/root"))
+	require.Error(t, parseParams("root=/dev/nfs nfsroot=10.0.2.2:srv"))
+
+	nfsRoot, nfsRootParam, nfsServerAddr = nil, "", ""
+	ipParams = ipParamState{}
+	config.Network = nil
+	cmdRoot = nil
+}
+
+func TestParseParamsNfsDracutRoot(t *testing.T) {
+	defer func() {
+		nfsRoot, nfsRootDracut, nfsServerAddr = nil, "", ""
+		ipParams = ipParamState{}
+		config.Network = nil
+		cmdRoot = nil
+	}()
+
+	check := func(params string, expected *nfsRootConfig) {
+		nfsRoot, nfsRootDracut, nfsServerAddr = nil, "", ""
+		ipParams = ipParamState{}
+		config.Network = nil
+		require.NoError(t, parseParams(params))
+		require.Equal(t, expected, nfsRoot)
+	}
+
+	check("root=nfs:10.0.2.2:/srv/root", &nfsRootConfig{"10.0.2.2", "/srv/root", nil})
+	check("root=nfs:10.0.2.2:/srv/root:vers=3,tcp", &nfsRootConfig{"10.0.2.2", "/srv/root", []string{"vers=3", "tcp"}})
+	check("root=nfs4:server.lan:/srv/root", &nfsRootConfig{"server.lan", "/srv/root", []string{"vers=4"}})
+	check("root=nfs4:[fd00::2]:/srv/root:vers=4.2", &nfsRootConfig{"fd00::2", "/srv/root", []string{"vers=4.2"}})
+	check("netroot=nfs:10.0.2.2:/srv/root", &nfsRootConfig{"10.0.2.2", "/srv/root", nil})
+	// server address comes from ip= param
+	check("ip=10.0.2.15:10.0.2.3:10.0.2.2:24::eth0:none root=nfs:/srv/root", &nfsRootConfig{"10.0.2.3", "/srv/root", nil})
+	require.Equal(t, "10.0.2.3:/srv/root", nfsRoot.source())
+
+	nfsRoot, nfsRootDracut, nfsServerAddr = nil, "", ""
+	require.Equal(t, "[fd00::2]:/srv/root", (&nfsRootConfig{server: "fd00::2", path: "/srv/root"}).source())
+	require.Error(t, parseParams("root=nfs:/srv/root"))
+	nfsRootDracut = ""
+	require.Error(t, parseParams("root=nfs:10.0.2.2:srv"))
+	nfsRootDracut = ""
+	require.Error(t, parseParams("root=nfs4:[fd00::2/srv"))
+}
+
+func TestParseParamsQuiet(t *testing.T) {
+	defer func() {
+		verbosityLevel = levelInfo
+		printToConsole = false
+	}()
+
+	check := func(params string, level int, toConsole bool) {
+		verbosityLevel = levelInfo
+		printToConsole = false
+		require.NoError(t, parseParams(params))
+		require.Equal(t, level, verbosityLevel)
+		require.Equal(t, toConsole, printToConsole)
+	}
+
+	check("quiet", levelError, false)
+	check("booster.log=warning quiet", levelWarning, false)
+	check("quiet booster.log=info,console", levelInfo, true)
+	check("quiet booster.verbose", levelDebug, true)
+	check("booster.verbose booster.log=error quiet", levelDebug, true)
+}
+
+func TestParseParamsLoadModules(t *testing.T) {
+	defer func() {
+		modaliasAutoload = true
+		aliases = nil
+	}()
+
+	const modalias = "pci:v00008086d00001234sv00008086sd00000001bc02sc00i00"
+	aliases = []alias{{"pci:v00008086d00001234sv*sd*bc*sc*i*", "e1000e"}}
+	require.Equal(t, []string{"e1000e"}, matchAlias(modalias))
+
+	require.NoError(t, parseParams("booster.load_modules=none"))
+	require.False(t, modaliasAutoload)
+	require.NoError(t, loadModalias(modalias))
+	// the alias is not even processed, so it is loaded if autoload is enabled later
+	_, processed := processedAliases.Load(modalias)
+	require.False(t, processed)
+	modulesMutex.Lock()
+	require.NotContains(t, loadingModules, "e1000e")
+	require.NotContains(t, loadedModules, "e1000e")
+	modulesMutex.Unlock()
+
+	require.NoError(t, parseParams("booster.load_modules=auto"))
+	require.True(t, modaliasAutoload)
+
+	require.Error(t, parseParams("booster.load_modules=foo"))
+}
+
+func TestParseParamsFido2RelyingParty(t *testing.T) {
+	defer func() { fido2RelyingParty = "io.systemd.cryptsetup" }()
+
+	require.NoError(t, parseParams("booster.fido2_rp=example.com"))
+	require.Equal(t, "example.com", fido2RelyingParty)
+	require.Error(t, parseParams("booster.fido2_rp="))
+}
+
+func TestParseParamsFido2Retries(t *testing.T) {
+	defer func() {
+		fido2OpenAttempts = 5
+		fido2OpenDelay = 200 * time.Millisecond
+	}()
+
+	require.NoError(t, parseParams("booster.fido2_retries=10 booster.fido2_retry_delay=1s"))
+	require.Equal(t, 10, fido2OpenAttempts)
+	require.Equal(t, time.Second, fido2OpenDelay)
+	require.Error(t, parseParams("booster.fido2_retries=0"))
+	require.Error(t, parseParams("booster.fido2_retry_delay=foo"))
+
+	require.True(t, isFido2TransientError([]byte("fido2-assert: fido_dev_open /dev/hidraw3: FIDO_ERR_RX")))
+	require.False(t, isFido2TransientError([]byte("fido2-assert: fido_dev_get_assert: FIDO_ERR_PIN_INVALID")))
+}
+
+func TestParseParamsPkcs11Module(t *testing.T) {
+	defer func() { pkcs11Module = "/usr/lib/p11-kit-proxy.so" }()
+
+	require.NoError(t, parseParams("booster.pkcs11_module=/usr/lib/opensc-pkcs11.so"))
+	require.Equal(t, "/usr/lib/opensc-pkcs11.so", pkcs11Module)
+	require.Error(t, parseParams("booster.pkcs11_module=opensc-pkcs11.so"))
+}
+
+func TestParseParamsUnlockJobs(t *testing.T) {
+	defer func() { unlockJobs = runtime.NumCPU() }()
+
+	require.NoError(t, parseParams("booster.unlock_jobs=2"))
+	require.Equal(t, 2, unlockJobs)
+	require.Error(t, parseParams("booster.unlock_jobs=0"))
+	require.Error(t, parseParams("booster.unlock_jobs=foo"))
+}
+
+func TestParseParamsIntegrityHash(t *testing.T) {
+	defer func() { integrityHash = "crc32c" }()
+
+	require.NoError(t, parseParams("booster.integrity_hash=sha256"))
+	require.Equal(t, "sha256", integrityHash)
+	require.Error(t, parseParams("booster.integrity_hash="))
+}
+
+func TestParseParamsKdfLowMemory(t *testing.T) {
+	defer func() { kdfLowMemory = false }()
+
+	require.NoError(t, parseParams("booster.kdf_low_memory"))
+	require.True(t, kdfLowMemory)
+}
+
+func TestParseParamsMdDegraded(t *testing.T) {
+	defer func() { mdDegraded, mdDegradedTimeout = false, 10*time.Second }()
+
+	require.NoError(t, parseParams("rd.md.degraded=yes"))
+	require.True(t, mdDegraded)
+	require.Equal(t, 10*time.Second, mdDegradedTimeout)
+	require.NoError(t, parseParams("rd.md.degraded=30s"))
+	require.True(t, mdDegraded)
+	require.Equal(t, 30*time.Second, mdDegradedTimeout)
+	require.NoError(t, parseParams("rd.md.degraded=no"))
+	require.False(t, mdDegraded)
+	require.Error(t, parseParams("rd.md.degraded=foo"))
+}
+
+func TestParseParamsBtrfsSubvol(t *testing.T) {
+	defer func() {
+		btrfsSubvol = ""
+		rootFlags = ""
+		cmdRoot = nil
+	}()
+
+	require.NoError(t, parseParams("root=UUID=1884e1eb-186f-4b1b-af11-45ea80da8e3c rootflags=compress=zstd booster.subvol=@root"))
+	require.Equal(t, "@root", btrfsSubvol)
+	require.Equal(t, "compress=zstd,subvol=@root", rootFlags)
+
+	rootFlags = ""
+	require.Error(t, parseParams("root=UUID=1884e1eb-186f-4b1b-af11-45ea80da8e3c rootflags=subvol=@ booster.subvol=@root"))
+	require.Error(t, parseParams("booster.subvol="))
+}
+
+func TestParseParamsZfsRoot(t *testing.T) {
+	defer func() {
+		zfsDataset = ""
+		config.EnableZfs = false
+	}()
+	cmdRoot = nil
+
+	require.Error(t, parseParams("root=ZFS=rpool/ROOT/arch"))
+
+	config.EnableZfs = true
+	require.NoError(t, parseParams("root=ZFS=rpool/ROOT/arch"))
+	require.Equal(t, "rpool/ROOT/arch", zfsDataset)
+	require.Nil(t, cmdRoot)
+}
+
+func TestHasMountOption(t *testing.T) {
+	require.True(t, hasMountOption("noatime,degraded", "degraded"))
+	require.True(t, hasMountOption("subvol=@,compress=zstd", "subvol"))
+	require.False(t, hasMountOption("subvolid=5", "subvol"))
+	require.False(t, hasMountOption("", "degraded"))
+}
+
+func TestParseParamsFido2Timeout(t *testing.T) {
+	defer func() { fido2Timeout = 0 }()
+
+	require.NoError(t, parseParams("booster.fido2_timeout=45s"))
+	require.Equal(t, 45*time.Second, fido2Timeout)
+	require.Error(t, parseParams("booster.fido2_timeout=0"))
+	require.Error(t, parseParams("booster.fido2_timeout=foo"))
+}
+
+func TestParseParamsWifi(t *testing.T) {
+	defer func() {
+		wifi = nil
+		config.Network = nil
+	}()
+
+	config.Network = nil
+	require.NoError(t, parseParams("booster.wifi=home:pass:word:wlan0"))
+	require.Equal(t, &wifiConfig{ssid: "home", psk: "pass:word", ifname: "wlan0"}, wifi)
+	require.True(t, config.Network.Dhcp)
+	require.Equal(t, []string{"wlan0"}, config.Network.InterfaceNames)
+	require.Equal(t, "network={\n\tssid=686f6d65\n\tpsk=\"pass:word\"\n\tkey_mgmt=WPA-PSK SAE\n\tieee80211w=1\n\tscan_ssid=1\n}\n", wifi.supplicantConfig())
+
+	// SAE cannot be used with a raw key
+	key := "f42c6fc52df0ebef9ebb4b90b38a5f902e83fe1b135a70e23aed762e9710a12e"
+	require.NoError(t, parseParams("booster.wifi=home:"+key+":wlan0"))
+	require.Equal(t, "network={\n\tssid=686f6d65\n\tpsk="+key+"\n\tkey_mgmt=WPA-PSK\n\tscan_ssid=1\n}\n", wifi.supplicantConfig())
+
+	require.Error(t, parseParams("booster.wifi=home:short:wlan0"))
+	require.Error(t, parseParams("booster.wifi=home:wlan0"))
+}
+
+func TestParseParamsUnlockOrder(t *testing.T) {
+	defer func() { unlockOrder = nil }()
+
+	require.NoError(t, parseParams("booster.unlock_order=tpm2,fido2,passphrase"))
+	require.Equal(t, []string{"tpm2", "fido2", "passphrase"}, unlockOrder)
+
+	require.NoError(t, parseParams("booster.unlock_order=tpm2,recovery-key"))
+	require.Equal(t, []string{"tpm2", "recovery-key"}, unlockOrder)
+
+	require.Error(t, parseParams("booster.unlock_order=tpm2,foo"))
+	require.Error(t, parseParams("booster.unlock_order=tpm2,tpm2"))
+}
+
+func TestParseParamsKeySource(t *testing.T) {
+	defer func() {
+		keySrc = nil
+		keySourceTimeout = 2 * time.Minute
+	}()
+
+	require.NoError(t, parseParams("booster.key_source=fifo:/run/booster.key booster.key_source_timeout=10s"))
+	require.Equal(t, &keySource{kind: "fifo", path: "/run/booster.key"}, keySrc)
+	require.Equal(t, 10*time.Second, keySourceTimeout)
+	require.NoError(t, parseParams("booster.key_source=socket:/run/booster.sock"))
+	require.Equal(t, &keySource{kind: "socket", path: "/run/booster.sock"}, keySrc)
+
+	require.Error(t, parseParams("booster.key_source=/run/booster.key"))
+	require.Error(t, parseParams("booster.key_source=pipe:/run/booster.key"))
+	require.Error(t, parseParams("booster.key_source_timeout=0"))
+}
+
+func TestParseParamsFsck(t *testing.T) {
+	defer func() {
+		fsckMode = "auto"
+		fsckRepair = "yes"
+		cmdRoot = nil
+	}()
+
+	require.NoError(t, parseParams("root=/dev/sda1 fsck.mode=force fsck.repair=preen"))
+	require.Equal(t, "force", fsckMode)
+	require.Equal(t, "preen", fsckRepair)
+	require.Equal(t, []string{"-C3", "-t", "ext4", "-a", "-f", "/dev/sda1"}, fsckArgs("/dev/sda1", "ext4"))
+
+	require.Error(t, parseParams("root=/dev/sda1 fsck.mode=always"))
+	require.Error(t, parseParams("root=/dev/sda1 fsck.repair=maybe"))
+}
+
+func TestParseParamsOverlay(t *testing.T) {
+	defer func() {
+		overlayRoot = nil
+		cmdRoot = nil
+	}()
+
+	require.NoError(t, parseParams("root=/dev/sda1 booster.overlay=yes"))
+	require.NotNil(t, overlayRoot)
+	require.Nil(t, overlayRoot.device)
+
+	require.NoError(t, parseParams("root=/dev/sda1 booster.overlay=LABEL=persist"))
+	require.NotNil(t, overlayRoot)
+	require.NotNil(t, overlayRoot.device)
+	require.Equal(t, "LABEL=persist", overlayRoot.deviceName)
+
+	require.NoError(t, parseParams("root=/dev/sda1 booster.overlay=no"))
+	require.Nil(t, overlayRoot)
+}
+
+func TestParseParamsLiveRoot(t *testing.T) {
+	defer func() {
+		liveMedium = nil
+		liveDir = "LiveOS"
+		liveSquashImg = "squashfs.img"
+		cmdRoot = nil
+	}()
+	cmdRoot = nil
+
+	require.NoError(t, parseParams("root=live:LABEL=ARCH_202401 rd.live.dir=arch rd.live.squashimg=airootfs.sfs"))
+	require.Equal(t, &deviceRef{refFsLabel, "ARCH_202401"}, liveMedium)
+	require.Equal(t, "arch", liveDir)
+	require.Equal(t, "airootfs.sfs", liveSquashImg)
+	require.Nil(t, cmdRoot)
+}
+
+func TestParseParamsBreakpoints(t *testing.T) {
+	defer func() {
+		breakpoints = make(set)
+		config.EnableShell = false
+	}()
+
+	// the image does not allow the shell
+	config.EnableShell = false
+	breakpoints = make(set)
+	require.NoError(t, parseParams("rd.break=pre-mount"))
+	require.Empty(t, breakpoints)
+	require.False(t, breakpointRequested(breakPreMount))
+
+	config.EnableShell = true
+	breakpoints = make(set)
+	require.NoError(t, parseParams("rd.break"))
+	require.Equal(t, set{breakPrePivot: true}, breakpoints)
+
+	breakpoints = make(set)
+	require.NoError(t, parseParams("rd.break=cmdline,pre-mount rd.break=initqueue"))
+	require.Equal(t, set{breakCmdline: true, breakPreMount: true, breakInitqueue: true}, breakpoints)
+	require.True(t, breakpointRequested(breakInitqueue))
+	require.False(t, breakpointRequested(breakPrePivot))
+
+	require.Error(t, parseBreakpoints("pre-udev"))
+}
+
+func TestParseParamsSplash(t *testing.T) {
+	defer func() { splashRequested, plymouthDisabled = false, false }()
+
+	require.NoError(t, parseParams("quiet splash"))
+	require.True(t, splashRequested)
+	require.False(t, plymouthDisabled)
+
+	require.NoError(t, parseParams("splash rd.plymouth=0"))
+	require.True(t, plymouthDisabled)
+}
+
+func TestParseParamsPasswordPrompt(t *testing.T) {
+	defer func() { passwordEchoMasked, passwordTimeout, passwordTries = false, 0, 0 }()
+
+	require.NoError(t, parseParams("booster.password_echo=masked booster.password_timeout=90s booster.password_tries=3"))
+	require.True(t, passwordEchoMasked)
+	require.Equal(t, 90*time.Second, passwordTimeout)
+	require.Equal(t, 3, passwordTries)
+
+	require.NoError(t, parseParams("booster.password_echo=no"))
+	require.False(t, passwordEchoMasked)
+
+	require.Error(t, parseParams("booster.password_echo=yes"))
+	require.Error(t, parseParams("booster.password_timeout=-1s"))
+	require.Error(t, parseParams("booster.password_tries=many"))
+}
+
+func TestParseParamsResumeOffset(t *testing.T) {
+	defer func() { cmdResume, cmdResumeOffset = nil, 0 }()
+
+	require.NoError(t, parseParams("resume=UUID=e8e81fc3-8f81-4a3a-ac3d-aab36aa0c45f resume_offset=38912"))
+	require.Equal(t, refFsUUID, cmdResume.format)
+	require.Equal(t, uint64(38912), cmdResumeOffset)
+
+	require.Error(t, parseParams("resume_offset=-1"))
+}
+
+func TestParseParamsKexec(t *testing.T) {
+	defer func() { kexecKernel, kexecInitrd, kexecCmdline = "", "", "" }()
+
+	require.NoError(t, parseParams(`booster.kexec=/boot/vmlinuz-b booster.kexec_initrd=/boot/initramfs-b.img booster.kexec_cmdline="root=/dev/sda2 rw"`))
+	require.Equal(t, "/boot/vmlinuz-b", kexecKernel)
+	require.Equal(t, "/boot/initramfs-b.img", kexecInitrd)
+	require.Equal(t, "root=/dev/sda2 rw", kexecCmdline)
+
+	require.Error(t, parseParams("booster.kexec="))
+}
+
+func TestKexecCommandLine(t *testing.T) {
+	require.Equal(t, `root=/dev/sda2 rw quiet foo="a b"`, kexecCommandLine("root=/dev/sda2 booster.kexec=/boot/vmlinuz rw quiet booster.kexec_initrd=/boot/initrd foo=\"a b\"\n"))
+	require.Equal(t, "", kexecCommandLine("booster.kexec=/vmlinuz"))
+}
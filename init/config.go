@@ -3,13 +3,23 @@ package main
 import "net"
 
 type InitNetworkConfig struct {
-	Interfaces []net.HardwareAddr `yaml:",omitempty"` // list of active interfaces to use
+	Interfaces     []net.HardwareAddr `yaml:",omitempty"`                // list of active interfaces to use
+	InterfaceNames []string           `yaml:"interface_names,omitempty"` // list of active interfaces specified by name, e.g. with booster.ip= boot param
 
 	Dhcp bool `yaml:",omitempty"`
 
 	IP         string `yaml:",omitempty"`            // e.g. 10.0.2.15/24
 	Gateway    string `yaml:",omitempty"`            // e.g. 10.0.2.255
 	DNSServers string `yaml:"dns_servers,omitempty"` // comma-separated list of ips, e.g. 10.0.1.1,8.8.8.8
+	Hostname   string `yaml:",omitempty"`
+
+	IPv6 string `yaml:"ipv6,omitempty"` // IPv6 configuration method: auto6 (SLAAC) or dhcp6
+
+	Vlans   []string `yaml:",omitempty"` // 802.1Q interfaces in <name>:<parent> format, e.g. vlan10:eth0
+	Bonds   []string `yaml:",omitempty"` // bonding interfaces in <name>:<slaves>[:<options>[:<mtu>]] format, e.g. bond0:eth0,eth1:mode=802.3ad
+	Bridges []string `yaml:",omitempty"` // bridge interfaces in <name>:<ports> format, e.g. br0:eth0
+
+	Handoff bool `yaml:",omitempty"` // keep the interfaces up and pass their configuration to the booted system
 }
 
 type VirtualConsole struct {
@@ -20,20 +30,84 @@ type VirtualConsole struct {
 	FontUnicodeFile string `yaml:",omitempty"`
 }
 
+// InitLuksKeyfile is a keyfile that unlocks a LUKS volume
+type InitLuksKeyfile struct {
+	Volume string `yaml:",omitempty"` // LUKS volume UUID
+	Device string `yaml:",omitempty"` // device with the keyfile, e.g. LABEL=keys, empty if the keyfile is in the image
+	Path   string `yaml:",omitempty"`
+	Offset int64  `yaml:",omitempty"`
+	Size   int64  `yaml:",omitempty"`
+}
+
+// InitSSHConfig configures the SSH server that allows to unlock volumes remotely
+type InitSSHConfig struct {
+	Port int `yaml:",omitempty"`
+}
+
+const (
+	sshHostKeyPath        = "/etc/booster/ssh/host_key"
+	sshAuthorizedKeysPath = "/etc/booster/ssh/authorized_keys"
+)
+
+// graphicalPromptFontPath is the PSF font used to render the graphical password prompt
+const graphicalPromptFontPath = "/usr/share/booster/prompt.psf"
+
+// uswsuspResumeBinary is the uswsusp tool that resumes hibernation images written by s2disk
+const uswsuspResumeBinary = "/usr/lib/suspend/resume"
+
+// rescueToolsDir contains links to the extra binaries (e.g. busybox applets) that are added to PATH of the emergency shell
+const rescueToolsDir = "/usr/lib/booster/rescue"
+
+// InitWireGuardConfig is a WireGuard tunnel that is brought up at boot, e.g. to reach the SSH server of a machine behind NAT
+type InitWireGuardConfig struct {
+	Interface  string              `yaml:",omitempty"` // wg0 if not specified
+	Addresses  []string            `yaml:",omitempty"` // addresses in CIDR format, e.g. 10.100.0.2/24
+	ListenPort int                 `yaml:"listen_port,omitempty"`
+	Peers      []InitWireGuardPeer `yaml:",omitempty"`
+	Secrets    string              `yaml:",omitempty"`           // base64 of AES-GCM encrypted private key followed by the peers preshared keys
+	SealedKey  string              `yaml:"sealed_key,omitempty"` // booster-tpm2 token (JSON) with the TPM sealed key of the secrets
+}
+
+type InitWireGuardPeer struct {
+	PublicKey           string   `yaml:"public_key,omitempty"` // base64
+	Endpoint            string   `yaml:",omitempty"`           // host:port
+	AllowedIPs          []string `yaml:"allowed_ips,omitempty"`
+	PersistentKeepalive int      `yaml:"persistent_keepalive,omitempty"` // in seconds
+}
+
+// InitKdumpConfig configures the crash capture image
+type InitKdumpConfig struct {
+	Path         string `yaml:",omitempty"` // directory at the root filesystem where crash dumps are saved
+	Makedumpfile string `yaml:",omitempty"` // makedumpfile arguments, the dump is copied with gzip compression if empty
+}
+
 type InitConfig struct {
-	Network                *InitNetworkConfig  `yaml:",omitempty"`
-	ModuleDependencies     map[string][]string `yaml:",omitempty"`
-	ModulePostDependencies map[string][]string `yaml:",omitempty"`
-	ModulesForceLoad       []string            `yaml:",omitempty"`
-	ModprobeOptions        map[string]string   `yaml:",omitempty"`
-	BuiltinModules         set                 `yaml:",omitempty"`
-	Kernel                 string              `yaml:",omitempty"` // kernel version this image was built for
-	MountTimeout           int                 `yaml:",omitempty"` // mount timeout in seconds
-	VirtualConsole         *VirtualConsole     `yaml:",omitempty"`
-	EnableLVM              bool                `yaml:",omitempty"`
-	EnableMdraid           bool                `yaml:",omitempty"`
-	EnableZfs              bool                `yaml:",omitempty"`
-	ZfsImportParams        string              `yaml:",omitempty"` // TODO: remove it
+	Network                *InitNetworkConfig   `yaml:",omitempty"`
+	ModuleDependencies     map[string][]string  `yaml:",omitempty"`
+	ModulePostDependencies map[string][]string  `yaml:",omitempty"`
+	ModulesForceLoad       []string             `yaml:",omitempty"`
+	ModprobeOptions        map[string]string    `yaml:",omitempty"`
+	BuiltinModules         set                  `yaml:",omitempty"`
+	Kernel                 string               `yaml:",omitempty"` // kernel version this image was built for
+	MountTimeout           int                  `yaml:",omitempty"` // mount timeout in seconds
+	VirtualConsole         *VirtualConsole      `yaml:",omitempty"`
+	EnableLVM              bool                 `yaml:",omitempty"`
+	LvmNative              bool                 `yaml:",omitempty"` // activate LVM volumes without lvm tools
+	EnableMdraid           bool                 `yaml:",omitempty"`
+	MdraidNative           bool                 `yaml:",omitempty"` // assemble md arrays without mdadm
+	EnableIntegrity        bool                 `yaml:",omitempty"`
+	EnableZfs              bool                 `yaml:",omitempty"`
+	EnableWifi             bool                 `yaml:",omitempty"`
+	HooksIgnoreFailures    bool                 `yaml:",omitempty"` // continue boot if a post-unlock hook fails
+	LuksKeyfiles           []InitLuksKeyfile    `yaml:",omitempty"`
+	DisablePassphraseCache bool                 `yaml:",omitempty"` // do not try the passphrase of the previous volume
+	SSH                    *InitSSHConfig       `yaml:"ssh,omitempty"`
+	WireGuard              *InitWireGuardConfig `yaml:"wireguard,omitempty"`
+	EnableGraphicalPrompt  bool                 `yaml:",omitempty"` // ask passwords with the built-in graphical prompt
+	Kdump                  *InitKdumpConfig     `yaml:",omitempty"` // the image saves the crash dump instead of booting the system
+	MeasurePCR             int                  `yaml:",omitempty"` // PCR extended with the config, command line and keys measurements, zero disables it
+	EnableShell            bool                 `yaml:",omitempty"` // rd.break= breakpoints and the built-in emergency shell are allowed
+	ZfsImportParams        string               `yaml:",omitempty"` // TODO: remove it
 }
 
 const initConfigPath = "/etc/booster.init.yaml"
@@ -2,11 +2,14 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/anatol/booster/init/quirk"
@@ -158,11 +161,19 @@ func readPasswordLine(reader io.Reader) ([]byte, error) {
 			switch buf[0] {
 			case '\b':
 				if len(ret) > 0 {
+					ret[len(ret)-1] = 0
 					ret = ret[:len(ret)-1]
 				}
 			case '\n':
 				return ret, nil
 			default:
+				if len(ret) == cap(ret) {
+					// grow the buffer manually to wipe the old copy of the password
+					grown := make([]byte, len(ret), 2*cap(ret)+64)
+					copy(grown, ret)
+					memZeroBytes(ret)
+					ret = grown
+				}
 				ret = append(ret, buf[0])
 			}
 			continue
@@ -176,12 +187,251 @@ func readPasswordLine(reader io.Reader) ([]byte, error) {
 	}
 }
 
+// readMaskedPasswordLine is the same as readPasswordLine but it expects the terminal in non-canonical mode and echoes
+// an asterisk for every character typed. Backspace removes the last character and Ctrl-U clears the line.
+func readMaskedPasswordLine(reader io.Reader, echo io.Writer) ([]byte, error) {
+	var buf [1]byte
+	var ret []byte
+
+	// isContinuation reports whether the byte continues a multi-byte UTF-8 character
+	isContinuation := func(b byte) bool { return b&0xc0 == 0x80 }
+	eraseChar := func() {
+		for len(ret) > 0 {
+			last := ret[len(ret)-1]
+			ret[len(ret)-1] = 0
+			ret = ret[:len(ret)-1]
+			if !isContinuation(last) {
+				break
+			}
+		}
+	}
+
+	for {
+		n, err := reader.Read(buf[:])
+		if n > 0 {
+			switch buf[0] {
+			case '\b', 0x7f: // Backspace sends DEL at most terminals
+				if len(ret) > 0 {
+					eraseChar()
+					_, _ = io.WriteString(echo, "\b \b")
+				}
+			case 0x15: // Ctrl-U
+				for len(ret) > 0 {
+					eraseChar()
+					_, _ = io.WriteString(echo, "\b \b")
+				}
+			case '\n', '\r':
+				return ret, nil
+			default:
+				if len(ret) == cap(ret) {
+					grown := make([]byte, len(ret), 2*cap(ret)+64)
+					copy(grown, ret)
+					memZeroBytes(ret)
+					ret = grown
+				}
+				ret = append(ret, buf[0])
+				if !isContinuation(buf[0]) {
+					_, _ = io.WriteString(echo, "*")
+				}
+			}
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(ret) > 0 {
+				return ret, nil
+			}
+			return ret, err
+		}
+	}
+}
+
+// capsLockOn reports whether Caps Lock is active at the console keyboard
+func capsLockOn() bool {
+	const (
+		// from linux/kd.h
+		KDGKBLED   = 0x4B64
+		K_CAPSLOCK = 0x04
+	)
+	var flags uint8
+	if err := ioctl(os.Stdin.Fd(), KDGKBLED, uintptr(unsafe.Pointer(&flags))); err != nil {
+		return false // not a virtual terminal, e.g. a serial console
+	}
+	return flags&K_CAPSLOCK != 0
+}
+
+var (
+	passwordEchoMasked bool          // booster.password_echo=masked
+	passwordTimeout    time.Duration // booster.password_timeout=, zero means the prompt waits forever
+	passwordTries      int           // booster.password_tries=, zero means unlimited number of attempts
+)
+
+var errPasswordTimeout = errors.New("timed out waiting for the input")
+
+func parsePasswordEchoParam(value string) error {
+	switch value {
+	case "masked":
+		passwordEchoMasked = true
+	case "no":
+		passwordEchoMasked = false
+	default:
+		return fmt.Errorf("expected masked or no")
+	}
+	return nil
+}
+
 var inputMutex sync.Mutex
 
+var (
+	errConsoleInputCancelled = errors.New("console input is cancelled")
+	consoleInputCancelled    atomic.Bool
+)
+
+// cancelConsoleInput makes pending and future password prompts fail, e.g. before the emergency shell takes the console over.
+// It returns once the pending prompt is finished.
+func cancelConsoleInput() {
+	consoleInputCancelled.Store(true)
+	inputMutex.Lock()
+	inputMutex.Unlock()
+}
+
+// pendingPrompt is a console prompt that waits for the user input. Besides the console it can be answered remotely,
+// e.g. by a user connected over SSH.
+type pendingPrompt struct {
+	text   string
+	seq    uint64
+	answer chan []byte
+}
+
+var (
+	currentPrompt      *pendingPrompt
+	promptSeq          uint64
+	promptChanged      = make(chan struct{}) // closed and replaced every time the current prompt changes
+	currentPromptMutex sync.Mutex
+)
+
+func setCurrentPrompt(p *pendingPrompt) {
+	currentPromptMutex.Lock()
+	defer currentPromptMutex.Unlock()
+
+	currentPrompt = p
+	close(promptChanged)
+	promptChanged = make(chan struct{})
+}
+
+// getCurrentPrompt returns the prompt waiting for the input (nil if there is none) and a channel that is closed once
+// the prompt changes
+func getCurrentPrompt() (*pendingPrompt, <-chan struct{}) {
+	currentPromptMutex.Lock()
+	defer currentPromptMutex.Unlock()
+	return currentPrompt, promptChanged
+}
+
+// answerPrompt passes the remote input to the prompt with the given sequence number.
+// It returns false if the prompt is not pending anymore.
+func answerPrompt(seq uint64, input []byte) bool {
+	currentPromptMutex.Lock()
+	defer currentPromptMutex.Unlock()
+
+	if currentPrompt == nil || currentPrompt.seq != seq {
+		return false
+	}
+	select {
+	case currentPrompt.answer <- input:
+		return true
+	default: // the prompt has been answered already
+		return false
+	}
+}
+
+// remoteAnswer is returned by consoleReader when the prompt is answered remotely
+type remoteAnswer struct {
+	input []byte
+}
+
+func (remoteAnswer) Error() string {
+	return "the prompt is answered remotely"
+}
+
+// consoleReader reads the console input and notes the user activity. It polls the console so a pending read can be
+// cancelled with cancelConsoleInput() or answered remotely with answerPrompt().
+type consoleReader struct {
+	f        *os.File
+	remote   <-chan []byte
+	deadline time.Time // zero if the prompt has no timeout
+}
+
+func (r consoleReader) Read(p []byte) (int, error) {
+	fds := []unix.PollFd{{Fd: int32(r.f.Fd()), Events: unix.POLLIN}}
+	for {
+		if consoleInputCancelled.Load() {
+			return 0, errConsoleInputCancelled
+		}
+		if !r.deadline.IsZero() && time.Now().After(r.deadline) {
+			return 0, errPasswordTimeout
+		}
+		select {
+		case input := <-r.remote:
+			return 0, remoteAnswer{input}
+		default:
+		}
+		n, err := unix.Poll(fds, 500)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			break
+		}
+	}
+
+	n, err := r.f.Read(p)
+	if n > 0 {
+		noteUserInput()
+	}
+	return n, err
+}
+
 func readPassword(prompt, postPrompt string) ([]byte, error) {
 	inputMutex.Lock()
 	defer inputMutex.Unlock()
 
+	currentPromptMutex.Lock()
+	promptSeq++
+	p := &pendingPrompt{text: prompt, seq: promptSeq, answer: make(chan []byte, 1)}
+	currentPromptMutex.Unlock()
+	setCurrentPrompt(p)
+	defer setCurrentPrompt(nil)
+
+	var deadline time.Time
+	if passwordTimeout != 0 {
+		deadline = time.Now().Add(passwordTimeout)
+	}
+
+	if plymouthRunning() {
+		password, err := plymouthAskPassword(prompt, p.answer, deadline)
+		if err == nil || err == errConsoleInputCancelled || err == errPasswordTimeout {
+			return password, err
+		}
+		warning("%v, falling back to the console prompt", err)
+		stopPlymouth()
+	}
+
+	if graphicalPromptEnabled() {
+		password, err := graphicalAskPassword(prompt, p.answer, deadline)
+		if err == nil || err == errConsoleInputCancelled || err == errPasswordTimeout {
+			return password, err
+		}
+		if err != errGraphicalPromptAborted {
+			warning("%v, falling back to the console prompt", err)
+		}
+		graphicalPromptFailed = true
+	}
+
+	if capsLockOn() {
+		console("Warning: Caps Lock is on\n")
+	}
 	console(prompt)
 
 	stdin := os.Stdin
@@ -196,13 +446,31 @@ func readPassword(prompt, postPrompt string) ([]byte, error) {
 	newState.Lflag &^= unix.ECHO
 	newState.Lflag |= unix.ICANON | unix.ISIG
 	newState.Iflag |= unix.ICRNL
+	if passwordEchoMasked {
+		// the input is read char by char to echo the asterisks
+		newState.Lflag &^= unix.ICANON
+		newState.Cc[unix.VMIN] = 1
+		newState.Cc[unix.VTIME] = 0
+	}
 	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &newState); err != nil {
 		return nil, err
 	}
 
 	defer unix.IoctlSetTermios(fd, unix.TCSETS, termios)
 
-	password, err := readPasswordLine(stdin)
+	reader := consoleReader{f: stdin, remote: p.answer, deadline: deadline}
+	var password []byte
+	if passwordEchoMasked {
+		password, err = readMaskedPasswordLine(reader, os.Stdout)
+	} else {
+		password, err = readPasswordLine(reader)
+	}
+	var remote remoteAnswer
+	if errors.As(err, &remote) {
+		// drop whatever has been typed at the console
+		memZeroBytes(password)
+		password, err = remote.input, nil
+	}
 	if postPrompt != "" {
 		console(postPrompt)
 	}
@@ -211,3 +479,51 @@ func readPassword(prompt, postPrompt string) ([]byte, error) {
 	}
 	return password, err
 }
+
+// pinTries is the default limit of PIN attempts. Every wrong TPM PIN increments the dictionary attack counter shared
+// by all the secrets sealed with the TPM, so unlike passphrases PINs are never asked forever.
+const pinTries = 3
+
+// passwordAttempts counts failed attempts of a passphrase prompt loop and enforces booster.password_tries= limit
+type passwordAttempts struct {
+	name   string // the volume the passphrase is asked for
+	pin    bool   // PIN of a TPM or a security key, once the attempts are exhausted the token is skipped
+	failed int
+}
+
+// read asks for a non-empty passphrase. A timed out prompt counts as a failed attempt.
+func (a *passwordAttempts) read(prompt string) ([]byte, error) {
+	for {
+		password, err := readPassword(prompt, "   Unlocking...")
+		if err == errPasswordTimeout {
+			if err := a.fail("   Timed out waiting for the passphrase"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil || len(password) > 0 {
+			return password, err
+		}
+	}
+}
+
+// fail records a failed attempt and prints the message. Once the limit of attempts is reached the boot fails
+// and booster drops to the emergency shell, for a PIN only an error is returned.
+func (a *passwordAttempts) fail(msg string) error {
+	a.failed++
+	tries := passwordTries
+	if a.pin && tries == 0 {
+		tries = pinTries
+	}
+	if tries == 0 || a.failed < tries {
+		console("%s, please try again\n", msg)
+		return nil
+	}
+	console("%s\n", msg)
+	err := fmt.Errorf("%s: giving up after %d failed attempts", a.name, a.failed)
+	if !a.pin {
+		// other unlock methods might still work if a PIN protected token has failed
+		failBoot(err)
+	}
+	return err
+}
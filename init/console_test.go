@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordAttempts(t *testing.T) {
+	defer func() { passwordTries = 0 }()
+
+	a := passwordAttempts{name: "root"}
+	for i := 0; i < 5; i++ {
+		require.NoError(t, a.fail("   Incorrect passphrase"))
+	}
+
+	passwordTries = 2
+	a = passwordAttempts{name: "root"}
+	require.NoError(t, a.fail("   Incorrect passphrase"))
+	require.EqualError(t, a.fail("   Incorrect passphrase"), "root: giving up after 2 failed attempts")
+	require.EqualError(t, <-bootFailed, "root: giving up after 2 failed attempts")
+
+	// PIN attempts are limited by default and do not fail the boot
+	passwordTries = 0
+	a = passwordAttempts{name: "TPM pin", pin: true}
+	for i := 1; i < pinTries; i++ {
+		require.NoError(t, a.fail("   Incorrect TPM pin"))
+	}
+	require.EqualError(t, a.fail("   Incorrect TPM pin"), "TPM pin: giving up after 3 failed attempts")
+	select {
+	case err := <-bootFailed:
+		require.Fail(t, "boot failed", "%v", err)
+	default:
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 
 	"golang.org/x/sys/unix"
 )
@@ -57,7 +58,11 @@ func (blk *blkInfo) matchesRef(d *deviceRef) bool {
 	case refFsUUID:
 		return bytes.Equal(d.data.(UUID), blk.uuid)
 	case refFsLabel:
-		return d.data.(string) == blk.label
+		if d.data.(string) != blk.label {
+			return false
+		}
+		noteLabelMatch(d, "LABEL", blk.label, blk.path)
+		return true
 	case refHwPath:
 		return blk.hwPath != "" && d.data.(string) == blk.hwPath
 	case refWwID:
@@ -82,12 +87,67 @@ func calculateDevPath(parent string, partition int) string {
 	return name
 }
 
+// labelMatch is a list of devices that match a LABEL= or PARTLABEL= reference
+type labelMatch struct {
+	kind, label string
+	devices     []string
+}
+
+var (
+	labelMatchesMutex sync.Mutex
+	labelMatches      = make(map[*deviceRef]*labelMatch)
+)
+
+// noteLabelMatch records the device that matches the label reference. Labels are not guaranteed to be unique
+// (e.g. a cloned disk or a USB stick with the same installer label) and booster uses the device that appears first.
+// It is reported loudly as it is not deterministic which device is used.
+func noteLabelMatch(d *deviceRef, kind, label, path string) {
+	labelMatchesMutex.Lock()
+	defer labelMatchesMutex.Unlock()
+
+	m := labelMatches[d]
+	if m == nil {
+		m = &labelMatch{kind: kind, label: label}
+		labelMatches[d] = m
+	}
+	if stringListContains(path, m.devices) {
+		return
+	}
+	m.devices = append(m.devices, path)
+	if len(m.devices) > 1 {
+		warning("%s=%s is ambiguous, it matches devices %s. Booster uses %s, please use UUID= or PARTUUID= reference to select the device",
+			kind, label, strings.Join(m.devices, ", "), m.devices[0])
+	}
+}
+
+// partLabelRef returns the label of PARTLABEL= reference, including the references that have already been resolved to a device path
+func partLabelRef(d *deviceRef) (string, bool) {
+	if d.format == refGptLabel {
+		return d.data.(string), true
+	}
+
+	labelMatchesMutex.Lock()
+	defer labelMatchesMutex.Unlock()
+	if m := labelMatches[d]; m != nil && m.kind == "PARTLABEL" {
+		return m.label, true
+	}
+	return "", false
+}
+
 // checks if the reference is a gpt-specific and if yes then tries to resolve it to a device name
 func (blk *blkInfo) resolveGptRef(d *deviceRef) {
 	if d == nil {
 		return
 	}
 
+	if label, ok := partLabelRef(d); ok {
+		for _, p := range blk.data.(gptData).partitions {
+			if p.name == label {
+				noteLabelMatch(d, "PARTLABEL", label, calculateDevPath(blk.path, p.num))
+			}
+		}
+	}
+
 	if !d.dependsOnGpt() {
 		return
 	}
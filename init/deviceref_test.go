@@ -24,3 +24,25 @@ func TestParseDeviceRef(t *testing.T) {
 	check("PARTLABEL=hello", refGptLabel, "hello")
 	check("PARTLABEL=привет", refGptLabel, "привет")
 }
+
+func TestAmbiguousLabels(t *testing.T) {
+	defer func() { labelMatches = make(map[*deviceRef]*labelMatch) }()
+
+	ref := &deviceRef{refFsLabel, "root"}
+	require.True(t, (&blkInfo{path: "/dev/sda1", label: "root"}).matchesRef(ref))
+	require.True(t, (&blkInfo{path: "/dev/sda1", label: "root"}).matchesRef(ref))
+	require.False(t, (&blkInfo{path: "/dev/sdb1", label: "home"}).matchesRef(ref))
+	require.Equal(t, []string{"/dev/sda1"}, labelMatches[ref].devices)
+	require.True(t, (&blkInfo{path: "/dev/sdc1", label: "root"}).matchesRef(ref))
+	require.Equal(t, []string{"/dev/sda1", "/dev/sdc1"}, labelMatches[ref].devices)
+
+	// PARTLABEL reference is resolved to a path by the first disk, the same label at the second disk is still detected
+	partRef := &deviceRef{refGptLabel, "data"}
+	disk1 := &blkInfo{path: "/dev/sda", data: gptData{partitions: []gptPart{{num: 0, name: "efi"}, {num: 1, name: "data"}}}}
+	disk2 := &blkInfo{path: "/dev/nvme0n1", data: gptData{partitions: []gptPart{{num: 2, name: "data"}}}}
+	disk1.resolveGptRef(partRef)
+	require.Equal(t, deviceRef{refPath, "/dev/sda2"}, *partRef)
+	disk2.resolveGptRef(partRef)
+	require.Equal(t, deviceRef{refPath, "/dev/sda2"}, *partRef)
+	require.Equal(t, []string{"/dev/sda2", "/dev/nvme0n1p3"}, labelMatches[partRef].devices)
+}
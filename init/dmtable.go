@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/anatol/devmapper.go"
+	"golang.org/x/sys/unix"
+)
+
+// devmapper library supports a fixed set of targets (crypt, verity, linear, zero). dmTarget allows to load
+// a table of any other device mapper target (e.g. integrity) using the spec string from the target documentation.
+type dmTarget struct {
+	start  uint64 // in sectors
+	length uint64 // in sectors
+	typ    string
+	spec   string
+}
+
+// dmCreate creates a device mapper device with the given targets and activates it
+func dmCreate(name, uuid string, flags uint32, targets ...dmTarget) error {
+	if err := devmapper.Create(name, uuid); err != nil {
+		return err
+	}
+	if err := dmLoadTable(name, flags, targets); err != nil {
+		_ = devmapper.Remove(name)
+		return err
+	}
+	return devmapper.Resume(name)
+}
+
+func dmLoadTable(name string, flags uint32, targets []dmTarget) error {
+	const alignment = 8
+	align := func(n int) int { return (n + alignment - 1) / alignment * alignment }
+
+	length := unix.SizeofDmIoctl
+	for _, t := range targets {
+		length += unix.SizeofDmTargetSpec + align(len(t.spec)+1)
+	}
+
+	data := make([]byte, length)
+	ioctlData := (*unix.DmIoctl)(unsafe.Pointer(&data[0]))
+	ioctlData.Version = [...]uint32{4, 0, 0}
+	copy(ioctlData.Name[:], name)
+	ioctlData.Data_size = uint32(length)
+	ioctlData.Data_start = unix.SizeofDmIoctl
+	ioctlData.Target_count = uint32(len(targets))
+	ioctlData.Flags = flags & unix.DM_READONLY_FLAG
+
+	idx := unix.SizeofDmIoctl
+	for _, t := range targets {
+		size := unix.SizeofDmTargetSpec + align(len(t.spec)+1)
+		spec := (*unix.DmTargetSpec)(unsafe.Pointer(&data[idx]))
+		spec.Sector_start = t.start
+		spec.Length = t.length
+		spec.Next = uint32(size)
+		copy(spec.Target_type[:], t.typ)
+		copy(data[idx+unix.SizeofDmTargetSpec:], t.spec)
+		idx += size
+	}
+
+	control, err := os.Open("/dev/mapper/control")
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, control.Fd(), unix.DM_TABLE_LOAD, uintptr(unsafe.Pointer(&data[0]))); errno != 0 {
+		return fmt.Errorf("loading %s table: %v", name, errno)
+	}
+	return nil
+}
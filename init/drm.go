@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Minimal DRM/KMS support: booster sets a mode at the first connected connector and draws into a 32-bit
+// dumb buffer. The structures and ioctls are defined in include/uapi/drm/drm.h and drm_mode.h.
+
+type drmModeCardRes struct {
+	fbIDPtr, crtcIDPtr, connectorIDPtr, encoderIDPtr     uint64
+	countFbs, countCrtcs, countConnectors, countEncoders uint32
+	minWidth, maxWidth, minHeight, maxHeight             uint32
+}
+
+type drmModeInfo struct {
+	clock                                         uint32
+	hdisplay, hsyncStart, hsyncEnd, htotal, hskew uint16
+	vdisplay, vsyncStart, vsyncEnd, vtotal, vscan uint16
+	vrefresh, flags, typ                          uint32
+	name                                          [32]byte
+}
+
+type drmModeGetConnector struct {
+	encodersPtr, modesPtr, propsPtr, propValuesPtr                     uint64
+	countModes, countProps, countEncoders                              uint32
+	encoderID, connectorID, connectorType, connectorTypeID, connection uint32
+	mmWidth, mmHeight, subpixel, pad                                   uint32
+}
+
+type drmModeGetEncoder struct {
+	encoderID, encoderType, crtcID, possibleCrtcs, possibleClones uint32
+}
+
+type drmModeCrtc struct {
+	setConnectorsPtr                                      uint64
+	countConnectors, crtcID, fbID, x, y, gammaSize, valid uint32
+	mode                                                  drmModeInfo
+}
+
+type drmModeCreateDumb struct {
+	height, width, bpp, flags, handle, pitch uint32
+	size                                     uint64
+}
+
+type drmModeMapDumb struct {
+	handle, pad uint32
+	offset      uint64
+}
+
+type drmModeFbCmd struct {
+	fbID, width, height, pitch, bpp, depth, handle uint32
+}
+
+const (
+	drmModeConnected     = 1
+	drmModeTypePreferred = 1 << 3
+)
+
+func drmIOWR(nr, size uintptr) uintptr {
+	const iocReadWrite = 3
+	return iocReadWrite<<30 | size<<16 | 'd'<<8 | nr
+}
+
+var (
+	drmIoctlModeGetResources = drmIOWR(0xa0, unsafe.Sizeof(drmModeCardRes{}))
+	drmIoctlModeGetCrtc      = drmIOWR(0xa1, unsafe.Sizeof(drmModeCrtc{}))
+	drmIoctlModeSetCrtc      = drmIOWR(0xa2, unsafe.Sizeof(drmModeCrtc{}))
+	drmIoctlModeGetEncoder   = drmIOWR(0xa6, unsafe.Sizeof(drmModeGetEncoder{}))
+	drmIoctlModeGetConnector = drmIOWR(0xa7, unsafe.Sizeof(drmModeGetConnector{}))
+	drmIoctlModeAddFb        = drmIOWR(0xae, unsafe.Sizeof(drmModeFbCmd{}))
+	drmIoctlModeRmFb         = drmIOWR(0xaf, unsafe.Sizeof(uint32(0)))
+	drmIoctlModeCreateDumb   = drmIOWR(0xb2, unsafe.Sizeof(drmModeCreateDumb{}))
+	drmIoctlModeMapDumb      = drmIOWR(0xb3, unsafe.Sizeof(drmModeMapDumb{}))
+	drmIoctlModeDestroyDumb  = drmIOWR(0xb4, unsafe.Sizeof(uint32(0)))
+)
+
+func drmIoctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	for {
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+		if errno == unix.EINTR || errno == unix.EAGAIN {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
+
+func ptrOf[T any](s []T) uint64 {
+	if len(s) == 0 {
+		return 0
+	}
+	return uint64(uintptr(unsafe.Pointer(&s[0])))
+}
+
+// drmDisplay is a dumb buffer shown at the first connected display
+type drmDisplay struct {
+	f             *os.File
+	width, height int
+	pitch         int
+	pixels        []byte // mmaped XRGB8888 dumb buffer
+	handle, fbID  uint32
+	connectorID   uint32
+	savedCrtc     drmModeCrtc // the mode to restore once the display is closed
+}
+
+// drmConnector returns the first connected connector with its preferred mode
+func drmConnector(fd int, connectors []uint32) (*drmModeGetConnector, drmModeInfo, error) {
+	for _, id := range connectors {
+		c := drmModeGetConnector{connectorID: id}
+		if err := drmIoctl(fd, drmIoctlModeGetConnector, unsafe.Pointer(&c)); err != nil {
+			return nil, drmModeInfo{}, err
+		}
+		if c.connection != drmModeConnected || c.countModes == 0 {
+			continue
+		}
+		modes := make([]drmModeInfo, c.countModes)
+		encoders := make([]uint32, c.countEncoders)
+		c = drmModeGetConnector{connectorID: id, modesPtr: ptrOf(modes), countModes: uint32(len(modes)), encodersPtr: ptrOf(encoders), countEncoders: uint32(len(encoders))}
+		if err := drmIoctl(fd, drmIoctlModeGetConnector, unsafe.Pointer(&c)); err != nil {
+			return nil, drmModeInfo{}, err
+		}
+		if c.countModes == 0 {
+			continue
+		}
+		mode := modes[0]
+		for _, m := range modes[:c.countModes] {
+			if m.typ&drmModeTypePreferred != 0 {
+				mode = m
+				break
+			}
+		}
+		return &c, mode, nil
+	}
+	return nil, drmModeInfo{}, fmt.Errorf("no connected displays")
+}
+
+// drmCrtc finds the CRTC that drives the connector
+func drmCrtc(fd int, conn *drmModeGetConnector, crtcs []uint32) (uint32, error) {
+	if conn.encoderID != 0 {
+		enc := drmModeGetEncoder{encoderID: conn.encoderID}
+		if err := drmIoctl(fd, drmIoctlModeGetEncoder, unsafe.Pointer(&enc)); err == nil && enc.crtcID != 0 {
+			return enc.crtcID, nil
+		}
+	}
+	// the connector is not active, use the first CRTC the encoders support
+	encoders := make([]uint32, conn.countEncoders)
+	c := drmModeGetConnector{connectorID: conn.connectorID, encodersPtr: ptrOf(encoders), countEncoders: uint32(len(encoders))}
+	if err := drmIoctl(fd, drmIoctlModeGetConnector, unsafe.Pointer(&c)); err != nil {
+		return 0, err
+	}
+	for _, e := range encoders {
+		enc := drmModeGetEncoder{encoderID: e}
+		if err := drmIoctl(fd, drmIoctlModeGetEncoder, unsafe.Pointer(&enc)); err != nil {
+			continue
+		}
+		for i, crtc := range crtcs {
+			if enc.possibleCrtcs&(1<<i) != 0 {
+				return crtc, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no CRTC found for connector %d", conn.connectorID)
+}
+
+// openDrmDisplay sets the preferred mode at the first connected display of the DRM device
+func openDrmDisplay(dev string) (*drmDisplay, error) {
+	f, err := os.OpenFile(dev, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	fd := int(f.Fd())
+	d := &drmDisplay{f: f}
+	ok := false
+	defer func() {
+		if !ok {
+			d.close()
+		}
+	}()
+
+	var res drmModeCardRes
+	if err := drmIoctl(fd, drmIoctlModeGetResources, unsafe.Pointer(&res)); err != nil {
+		return nil, fmt.Errorf("%s: %v", dev, err)
+	}
+	crtcs := make([]uint32, res.countCrtcs)
+	connectors := make([]uint32, res.countConnectors)
+	res = drmModeCardRes{crtcIDPtr: ptrOf(crtcs), countCrtcs: uint32(len(crtcs)), connectorIDPtr: ptrOf(connectors), countConnectors: uint32(len(connectors))}
+	if err := drmIoctl(fd, drmIoctlModeGetResources, unsafe.Pointer(&res)); err != nil {
+		return nil, fmt.Errorf("%s: %v", dev, err)
+	}
+
+	conn, mode, err := drmConnector(fd, connectors)
+	if err != nil {
+		return nil, err
+	}
+	crtcID, err := drmCrtc(fd, conn, crtcs)
+	if err != nil {
+		return nil, err
+	}
+	d.connectorID = conn.connectorID
+	d.width, d.height = int(mode.hdisplay), int(mode.vdisplay)
+
+	d.savedCrtc = drmModeCrtc{crtcID: crtcID}
+	if err := drmIoctl(fd, drmIoctlModeGetCrtc, unsafe.Pointer(&d.savedCrtc)); err != nil {
+		return nil, err
+	}
+
+	create := drmModeCreateDumb{width: uint32(d.width), height: uint32(d.height), bpp: 32}
+	if err := drmIoctl(fd, drmIoctlModeCreateDumb, unsafe.Pointer(&create)); err != nil {
+		return nil, fmt.Errorf("create dumb buffer: %v", err)
+	}
+	d.handle, d.pitch = create.handle, int(create.pitch)
+
+	fb := drmModeFbCmd{width: create.width, height: create.height, pitch: create.pitch, bpp: 32, depth: 24, handle: create.handle}
+	if err := drmIoctl(fd, drmIoctlModeAddFb, unsafe.Pointer(&fb)); err != nil {
+		return nil, fmt.Errorf("add framebuffer: %v", err)
+	}
+	d.fbID = fb.fbID
+
+	mapDumb := drmModeMapDumb{handle: create.handle}
+	if err := drmIoctl(fd, drmIoctlModeMapDumb, unsafe.Pointer(&mapDumb)); err != nil {
+		return nil, fmt.Errorf("map dumb buffer: %v", err)
+	}
+	d.pixels, err = unix.Mmap(fd, int64(mapDumb.offset), int(create.size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mmap: %v", err)
+	}
+
+	connectorIDs := []uint32{d.connectorID}
+	set := drmModeCrtc{crtcID: crtcID, fbID: d.fbID, setConnectorsPtr: ptrOf(connectorIDs), countConnectors: 1, valid: 1, mode: mode}
+	if err := drmIoctl(fd, drmIoctlModeSetCrtc, unsafe.Pointer(&set)); err != nil {
+		return nil, fmt.Errorf("set mode: %v", err)
+	}
+
+	ok = true
+	return d, nil
+}
+
+// close restores the previous mode (e.g. the text console) and frees the buffer
+func (d *drmDisplay) close() {
+	fd := int(d.f.Fd())
+	if d.fbID != 0 && d.savedCrtc.crtcID != 0 {
+		connectorIDs := []uint32{d.connectorID}
+		restore := d.savedCrtc
+		restore.setConnectorsPtr, restore.countConnectors = ptrOf(connectorIDs), 1
+		if err := drmIoctl(fd, drmIoctlModeSetCrtc, unsafe.Pointer(&restore)); err != nil {
+			debug("drm: unable to restore the mode: %v", err)
+		}
+	}
+	if d.pixels != nil {
+		_ = unix.Munmap(d.pixels)
+	}
+	if d.fbID != 0 {
+		_ = drmIoctl(fd, drmIoctlModeRmFb, unsafe.Pointer(&d.fbID))
+	}
+	if d.handle != 0 {
+		_ = drmIoctl(fd, drmIoctlModeDestroyDumb, unsafe.Pointer(&d.handle))
+	}
+	d.f.Close()
+}
@@ -0,0 +1,124 @@
+//go:build fido2diag
+// +build fido2diag
+
+package main
+
+// Diagnostic harness for FIDO2 unlocking, it is compiled in only with 'fido2diag' build tag.
+// '/init fido2-test /dev/hidrawN [LUKS_DEVICE]' runs the same steps as the boot process does and prints the result
+// of every step. The output can be attached to a bug report.
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/anatol/luks.go"
+)
+
+const fido2TestCommand = "fido2-test"
+
+func init() {
+	diagnosticCommands[fido2TestCommand] = runFido2Test
+}
+
+func fido2TestStep(name string, err error) bool {
+	if err != nil {
+		fmt.Printf("%s: FAILED, %v\n", name, err)
+		return false
+	}
+	fmt.Printf("%s: OK\n", name)
+	return true
+}
+
+// runFido2Test implements 'fido2-test' command and returns the process exit code
+func runFido2Test(args []string) int {
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Printf("usage: %s %s /dev/hidrawN [LUKS_DEVICE]\n", os.Args[0], fido2TestCommand)
+		return 2
+	}
+	devName := filepath.Base(args[0])
+
+	printToConsole = true // there is no kmsg outside of the boot process
+	verbosityLevel = levelDebug
+	go handleSignals()
+
+	// step 1: enumerate
+	entries, err := os.ReadDir("/sys/class/hidraw/")
+	if !fido2TestStep("enumerate hidraw devices", err) {
+		return 1
+	}
+	found := false
+	for _, e := range entries {
+		uevent, _ := os.ReadFile(filepath.Join("/sys/class/hidraw", e.Name(), "device/uevent"))
+		for _, line := range strings.Split(string(uevent), "\n") {
+			if strings.HasPrefix(line, "HID_NAME=") {
+				fmt.Printf("  %s: %s\n", e.Name(), strings.TrimPrefix(line, "HID_NAME="))
+			}
+		}
+		found = found || e.Name() == devName
+	}
+	if !found {
+		fido2TestStep("find "+devName, fmt.Errorf("device is not present"))
+		return 1
+	}
+
+	// step 2: check that the device is a FIDO2 key
+	if !fido2TestStep("check FIDO2 support", checkFido2Device(devName)) {
+		return 1
+	}
+
+	// step 3: device info
+	out, err := exec.Command("fido2-token", "-I", "/dev/"+devName).CombinedOutput()
+	if fido2TestStep("get device info", err) {
+		for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+			fmt.Printf("  %s\n", line)
+		}
+	} else if len(out) > 0 {
+		fmt.Printf("  %s\n", strings.TrimSpace(string(out)))
+	}
+
+	if len(args) == 1 {
+		return 0
+	}
+
+	// step 4: assertion against every systemd-fido2 token of the LUKS device
+	d, err := luks.Open(args[1])
+	if !fido2TestStep("open "+args[1], err) {
+		return 1
+	}
+	defer d.Close()
+	tokens, err := d.Tokens()
+	if !fido2TestStep("read LUKS tokens", err) {
+		return 1
+	}
+
+	exitCode := 1
+	for _, t := range tokens {
+		if t.Type != "systemd-fido2" {
+			continue
+		}
+		step := fmt.Sprintf("token #%d assertion", t.ID)
+		tok, err := parseSystemdFido2Token(t.Payload)
+		if !fido2TestStep(step, err) {
+			continue
+		}
+		fmt.Printf("  relying party %s, pin required %v, user presence required %v, user verification required %v\n",
+			tok.RelyingParty, tok.PinRequired, tok.UserPresenceRequired, tok.UserVerificationRequired)
+		password, err := tok.recoverPassword(devName)
+		if !fido2TestStep(step, err) {
+			continue
+		}
+
+		v, slot := unsealTokenSlots(d, t, password)
+		memZeroBytes(password)
+		if v == nil {
+			fido2TestStep(fmt.Sprintf("token #%d unlock", t.ID), fmt.Errorf("hmac secret does not match keyslots %v", t.Slots))
+			continue
+		}
+		fido2TestStep(fmt.Sprintf("token #%d unlock keyslot %d", t.ID, slot), nil)
+		exitCode = 0
+	}
+	return exitCode
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// The root filesystem is checked before mounting if fsck and the filesystem specific checker (fsck.$FSTYPE) are added
+// to the image. The check is controlled with fsck.mode= and fsck.repair= boot params the same way as systemd-fsck does.
+
+const fsckBinary = "/usr/bin/fsck"
+
+var (
+	fsckMode   = "auto" // fsck.mode=auto|force|skip
+	fsckRepair = "yes"  // fsck.repair=preen|yes|no
+)
+
+// fsck exit codes, see man fsck(8)
+const (
+	fsckErrorsCorrected   = 0x1
+	fsckRebootRequired    = 0x2
+	fsckErrorsUncorrected = 0x4
+)
+
+func parseFsckModeParam(value string) error {
+	switch value {
+	case "auto", "force", "skip":
+		fsckMode = value
+		return nil
+	default:
+		return fmt.Errorf("expected auto, force or skip")
+	}
+}
+
+func parseFsckRepairParam(value string) error {
+	switch value {
+	case "preen", "yes", "no":
+		fsckRepair = value
+		return nil
+	default:
+		return fmt.Errorf("expected preen, yes or no")
+	}
+}
+
+// fsckArgs returns fsck command line arguments, the progress is reported to file descriptor 3
+func fsckArgs(dev, fstype string) []string {
+	args := []string{"-C3", "-t", fstype}
+	switch fsckRepair {
+	case "preen":
+		args = append(args, "-a")
+	case "yes":
+		args = append(args, "-y")
+	case "no":
+		args = append(args, "-n")
+	}
+	if fsckMode == "force" {
+		args = append(args, "-f")
+	}
+	return append(args, dev)
+}
+
+// fsckProgress parses a progress line of the checker ("$PASS $CURRENT $MAX $DEVICE") and returns the completion
+// percentage. The pass weights are the same that e2fsck uses.
+func fsckProgress(line string) (float64, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return 0, false
+	}
+	pass, err1 := strconv.Atoi(fields[0])
+	cur, err2 := strconv.ParseUint(fields[1], 10, 64)
+	total, err3 := strconv.ParseUint(fields[2], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, false
+	}
+
+	passTable := []float64{0, 70, 90, 92, 95, 100}
+	if pass <= 0 {
+		return 0, true
+	}
+	if pass >= len(passTable) || total == 0 {
+		return 100, true
+	}
+	if cur > total {
+		cur = total
+	}
+	return passTable[pass-1] + (passTable[pass]-passTable[pass-1])*float64(cur)/float64(total), true
+}
+
+// showFsckProgress prints the check progress at the console until the checker closes the pipe
+func showFsckProgress(r io.Reader, dev string) {
+	printed := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if percent, ok := fsckProgress(scanner.Text()); ok {
+			console("\rChecking %s: %3.0f%%", dev, percent)
+			printed = true
+		}
+	}
+	if printed {
+		console("\n")
+	}
+}
+
+func fsck(dev, fstype string) error {
+	if fsckMode == "skip" {
+		return nil
+	}
+	if _, err := os.Stat(fsckBinary); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(fsckBinary + "." + fstype); os.IsNotExist(err) {
+		debug("%s.%s is not found, skip checking %s", fsckBinary, fstype, dev)
+		return nil
+	}
+
+	progressReader, progressWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer progressReader.Close()
+
+	info("checking filesystem %s, fs=%s, mode=%s, repair=%s", dev, fstype, fsckMode, fsckRepair)
+	defer startPhase("fsck %s", dev)()
+	var output bytes.Buffer
+	cmd := exec.Command(fsckBinary, fsckArgs(dev, fstype)...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.ExtraFiles = []*os.File{progressWriter}
+	if verbosityLevel >= levelDebug {
+		w := io.MultiWriter(&output, os.Stdout)
+		cmd.Stdout, cmd.Stderr = w, w
+	}
+	if err := cmd.Start(); err != nil {
+		_ = progressWriter.Close()
+		return fmt.Errorf("fsck for %s: %v", dev, err)
+	}
+	// the child process holds its own copy of the pipe
+	_ = progressWriter.Close()
+	showFsckProgress(progressReader, dev)
+
+	err = cmd.Wait()
+	if err == nil {
+		return nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return fmt.Errorf("fsck for %s: unknown error %v", dev, err)
+	}
+
+	code := exitErr.ExitCode()
+	if code&^(fsckErrorsCorrected|fsckRebootRequired) == 0 {
+		// the filesystem is not mounted yet thus there is no need to reboot even if the checker asks for it
+		info("fsck for %s: errors were corrected", dev)
+		return nil
+	}
+	if out := strings.TrimSpace(output.String()); out != "" {
+		warning("fsck for %s: %s", dev, out)
+	}
+	if code&fsckErrorsUncorrected != 0 {
+		return fmt.Errorf("fsck for %s: filesystem errors left uncorrected, run fsck manually to fix the filesystem", dev)
+	}
+	return fmt.Errorf("fsck for %s: %v", dev, unwrapExitError(err))
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFsckProgress(t *testing.T) {
+	check := func(line string, expected float64) {
+		percent, ok := fsckProgress(line)
+		require.True(t, ok, line)
+		require.InDelta(t, expected, percent, 0.01, line)
+	}
+
+	check("1 0 1000 /dev/sda1", 0)
+	check("1 500 1000 /dev/sda1", 35)
+	check("2 1000 1000 /dev/sda1", 90)
+	check("5 10 20 /dev/sda1", 97.5)
+	check("6 0 0 /dev/sda1", 100)
+
+	_, ok := fsckProgress("e2fsck 1.47.0 (5-Feb-2023)")
+	require.False(t, ok)
+}
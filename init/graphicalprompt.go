@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The graphical prompt is a lightweight alternative to plymouth: the password box is drawn with the bundled PSF
+// font into a DRM dumb buffer and the keyboard input is read from evdev devices. If KMS is not available then
+// the text console prompt is used.
+
+const drmCardDevice = "/dev/dri/card0"
+
+var (
+	errGraphicalPromptAborted = errors.New("graphical prompt is aborted by user")
+	graphicalPromptFailed     bool // the prompt is not shown anymore once it fails or user switches to the text console
+
+	promptFont     *psfFont
+	promptFontErr  error
+	promptFontOnce sync.Once
+)
+
+func graphicalPromptEnabled() bool {
+	if !config.EnableGraphicalPrompt || graphicalPromptFailed {
+		return false
+	}
+	_, err := os.Stat(drmCardDevice)
+	return err == nil
+}
+
+func loadPromptFont() (*psfFont, error) {
+	promptFontOnce.Do(func() {
+		data, err := os.ReadFile(graphicalPromptFontPath)
+		if err != nil {
+			promptFontErr = err
+			return
+		}
+		promptFont, promptFontErr = parsePsf(data)
+	})
+	return promptFont, promptFontErr
+}
+
+// input event codes, see include/uapi/linux/input-event-codes.h
+const (
+	evKey = 0x01
+
+	keyEsc        = 1
+	keyBackspace  = 14
+	keyEnter      = 28
+	keyLeftCtrl   = 29
+	keyLeftShift  = 42
+	keyRightShift = 54
+	keyCapsLock   = 58
+	keyKpEnter    = 96
+	keyRightCtrl  = 97
+
+	keyA = 30
+)
+
+// US keyboard layout, the index is the key code
+var (
+	keymapNormal = "\x00\x00" + "1234567890-=" + "\x00\x00" + "qwertyuiop[]" + "\x00\x00" + "asdfghjkl;'`" + "\x00" + "\\zxcvbnm,./" + "\x00*\x00 "
+	keymapShift  = "\x00\x00" + "!@#$%^&*()_+" + "\x00\x00" + "QWERTYUIOP{}" + "\x00\x00" + "ASDFGHJKL:\"~" + "\x00" + "|ZXCVBNM<>?" + "\x00*\x00 "
+)
+
+// passwordInput is the state of the password typed at the graphical prompt
+type passwordInput struct {
+	buf          []byte
+	shift, ctrl  bool
+	capsLock     bool
+	done, abort  bool
+	keysReceived bool
+}
+
+func (in *passwordInput) append(ch byte) {
+	if len(in.buf) == cap(in.buf) {
+		// grow the buffer manually to wipe the old copy of the password
+		grown := make([]byte, len(in.buf), 2*cap(in.buf)+64)
+		copy(grown, in.buf)
+		memZeroBytes(in.buf)
+		in.buf = grown
+	}
+	in.buf = append(in.buf, ch)
+}
+
+func (in *passwordInput) clear() {
+	memZeroBytes(in.buf)
+	in.buf = in.buf[:0]
+}
+
+// handleKey processes a key event, value is 0 for release, 1 for press and 2 for autorepeat
+func (in *passwordInput) handleKey(code uint16, value int32) {
+	pressed := value != 0
+	switch code {
+	case keyLeftShift, keyRightShift:
+		in.shift = pressed
+		return
+	case keyLeftCtrl, keyRightCtrl:
+		in.ctrl = pressed
+		return
+	}
+	if !pressed {
+		return
+	}
+	in.keysReceived = true
+
+	switch code {
+	case keyCapsLock:
+		if value == 1 {
+			in.capsLock = !in.capsLock
+		}
+	case keyEnter, keyKpEnter:
+		in.done = true
+	case keyEsc:
+		in.abort = true
+	case keyBackspace:
+		if len(in.buf) > 0 {
+			in.buf[len(in.buf)-1] = 0
+			in.buf = in.buf[:len(in.buf)-1]
+		}
+	default:
+		if int(code) >= len(keymapNormal) {
+			return
+		}
+		ch := keymapNormal[code]
+		if in.shift {
+			ch = keymapShift[code]
+		}
+		if ch == 0 {
+			return
+		}
+		if in.ctrl {
+			if ch == 'u' || ch == 'U' {
+				in.clear()
+			}
+			return
+		}
+		if in.capsLock && ch >= 'a' && ch <= 'z' {
+			ch -= 'a' - 'A'
+		} else if in.capsLock && ch >= 'A' && ch <= 'Z' {
+			ch += 'a' - 'A'
+		}
+		in.append(ch)
+	}
+}
+
+// isKeyboard checks the key capabilities bitmap (/sys/class/input/eventX/device/capabilities/key) of the input device.
+// The bitmap is a list of hex words, the most significant word goes first.
+func isKeyboard(capabilities string) bool {
+	words := strings.Fields(capabilities)
+	if len(words) == 0 {
+		return false
+	}
+	last, err := strconv.ParseUint(words[len(words)-1], 16, 64)
+	if err != nil {
+		return false
+	}
+	return last&(1<<keyA) != 0 && last&(1<<keyEnter) != 0
+}
+
+type keyEvent struct {
+	code  uint16
+	value int32
+}
+
+// inputEvent is struct input_event from include/uapi/linux/input.h
+type inputEvent struct {
+	time  unix.Timeval
+	typ   uint16
+	code  uint16
+	value int32
+}
+
+var inputEventSize = int(unsafe.Sizeof(inputEvent{}))
+
+const evdevGrab = 1<<30 | 4<<16 | 'E'<<8 | 0x90 // EVIOCGRAB
+
+// evdevKeyboards reads key events from all keyboards connected to the system
+type evdevKeyboards struct {
+	events chan keyEvent
+	done   chan struct{}
+	opened map[string]*os.File
+}
+
+func newEvdevKeyboards() *evdevKeyboards {
+	return &evdevKeyboards{
+		events: make(chan keyEvent, 64),
+		done:   make(chan struct{}),
+		opened: make(map[string]*os.File),
+	}
+}
+
+// scan opens keyboards that appeared since the previous scan
+func (k *evdevKeyboards) scan() {
+	devices, _ := filepath.Glob("/dev/input/event*")
+	for _, dev := range devices {
+		if _, ok := k.opened[dev]; ok {
+			continue
+		}
+		capabilities, err := os.ReadFile(filepath.Join("/sys/class/input", filepath.Base(dev), "device/capabilities/key"))
+		if err != nil || !isKeyboard(string(capabilities)) {
+			continue
+		}
+		f, err := os.Open(dev)
+		if err != nil {
+			debug("%s: %v", dev, err)
+			continue
+		}
+		// grab the device so the keys are not passed to the text console underneath
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), evdevGrab, 1); errno != 0 {
+			debug("%s: unable to grab the device: %v", dev, errno)
+		}
+		k.opened[dev] = f
+		go k.read(f)
+	}
+}
+
+func (k *evdevKeyboards) read(f *os.File) {
+	buf := make([]byte, 64*inputEventSize)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			return
+		}
+		for i := 0; i+inputEventSize <= n; i += inputEventSize {
+			ev := buf[i+inputEventSize-8:]
+			if binary.LittleEndian.Uint16(ev) != evKey {
+				continue
+			}
+			e := keyEvent{code: binary.LittleEndian.Uint16(ev[2:]), value: int32(binary.LittleEndian.Uint32(ev[4:]))}
+			select {
+			case k.events <- e:
+			case <-k.done:
+				return
+			}
+		}
+	}
+}
+
+func (k *evdevKeyboards) close() {
+	close(k.done)
+	for _, f := range k.opened {
+		_, _, _ = unix.Syscall(unix.SYS_IOCTL, f.Fd(), evdevGrab, 0)
+		f.Close()
+	}
+}
+
+// canvas is an XRGB8888 pixel buffer
+type canvas struct {
+	pixels        []byte
+	width, height int
+	pitch         int
+}
+
+const (
+	colorBackground = 0x000000
+	colorBox        = 0x202020
+	colorBorder     = 0x808080
+	colorField      = 0x000000
+	colorText       = 0xffffff
+	colorHint       = 0x909090
+)
+
+func (c *canvas) fillRect(x, y, w, h int, color uint32) {
+	x0, y0 := maxInt(x, 0), maxInt(y, 0)
+	x1, y1 := minInt(x+w, c.width), minInt(y+h, c.height)
+	for py := y0; py < y1; py++ {
+		row := c.pixels[py*c.pitch:]
+		for px := x0; px < x1; px++ {
+			binary.LittleEndian.PutUint32(row[px*4:], color)
+		}
+	}
+}
+
+// drawText draws the text with the font scaled by the given factor
+func (c *canvas) drawText(font *psfFont, x, y, scale int, text string, color uint32) {
+	for _, r := range text {
+		glyph := font.glyph(r)
+		for gy := 0; gy < font.height; gy++ {
+			for gx := 0; gx < font.width; gx++ {
+				if font.pixel(glyph, gx, gy) {
+					c.fillRect(x+gx*scale, y+gy*scale, scale, scale, color)
+				}
+			}
+		}
+		x += font.width * scale
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// promptScale returns the font scale factor that keeps the text readable at high resolution displays
+func promptScale(font *psfFont, width, height int) int {
+	return maxInt(1, minInt(width/(font.width*60), height/(font.height*25)))
+}
+
+// renderPasswordPrompt draws a box with the prompt text and the input field that shows one '*' per typed character
+func renderPasswordPrompt(c *canvas, font *psfFont, prompt string, length int, capsLock bool) {
+	scale := promptScale(font, c.width, c.height)
+	charW, charH := font.width*scale, font.height*scale
+	padding := charW * 2
+
+	hint := "Press Esc to use the text console"
+	if capsLock {
+		hint = "Caps Lock is on"
+	}
+	columns := maxInt(maxInt(len([]rune(prompt)), len(hint)), 32)
+
+	boxW := columns*charW + 2*padding
+	boxH := 5*charH + 2*padding
+	boxX, boxY := (c.width-boxW)/2, (c.height-boxH)/2
+	border := scale
+
+	c.fillRect(0, 0, c.width, c.height, colorBackground)
+	c.fillRect(boxX-border, boxY-border, boxW+2*border, boxH+2*border, colorBorder)
+	c.fillRect(boxX, boxY, boxW, boxH, colorBox)
+
+	x, y := boxX+padding, boxY+padding
+	c.drawText(font, x, y, scale, prompt, colorText)
+
+	y += 3 * charH / 2
+	c.fillRect(x-border, y-border, columns*charW+2*border, 3*charH/2+2*border, colorBorder)
+	c.fillRect(x, y, columns*charW, 3*charH/2, colorField)
+	// long passwords are scrolled, only the tail fits the field
+	c.drawText(font, x, y+charH/4, scale, strings.Repeat("*", minInt(length, columns-1))+"_", colorText)
+
+	y += 2 * charH
+	c.drawText(font, x, y+charH/2, scale, hint, colorHint)
+}
+
+// graphicalAskPassword shows the password box on the display and reads the password from the keyboards.
+// Same as the console prompt it can be answered remotely, cancelled with cancelConsoleInput() or time out at
+// the deadline (if it is not zero).
+func graphicalAskPassword(prompt string, remote <-chan []byte, deadline time.Time) ([]byte, error) {
+	font, err := loadPromptFont()
+	if err != nil {
+		return nil, fmt.Errorf("graphical prompt: font %s: %v", graphicalPromptFontPath, err)
+	}
+
+	keyboards := newEvdevKeyboards()
+	defer keyboards.close()
+	keyboards.scan()
+	if len(keyboards.opened) == 0 {
+		return nil, fmt.Errorf("graphical prompt: no keyboards found")
+	}
+
+	display, err := openDrmDisplay(drmCardDevice)
+	if err != nil {
+		return nil, fmt.Errorf("graphical prompt: %v", err)
+	}
+	defer display.close()
+	c := &canvas{pixels: display.pixels, width: display.width, height: display.height, pitch: display.pitch}
+
+	in := passwordInput{capsLock: capsLockOn()}
+	prompt = strings.TrimSpace(prompt)
+	renderPasswordPrompt(c, font, prompt, 0, in.capsLock)
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-keyboards.events:
+			in.handleKey(e.code, e.value)
+			if in.keysReceived {
+				noteUserInput()
+				in.keysReceived = false
+			}
+			if in.abort {
+				in.clear()
+				return nil, errGraphicalPromptAborted
+			}
+			if in.done {
+				return in.buf, nil
+			}
+			renderPasswordPrompt(c, font, prompt, len(in.buf), in.capsLock)
+		case input := <-remote:
+			in.clear()
+			return input, nil
+		case <-ticker.C:
+			if consoleInputCancelled.Load() {
+				in.clear()
+				return nil, errConsoleInputCancelled
+			}
+			if !deadline.IsZero() && time.Now().After(deadline) {
+				in.clear()
+				return nil, errPasswordTimeout
+			}
+			// keyboards might be plugged in while the prompt is shown
+			keyboards.scan()
+		}
+	}
+}
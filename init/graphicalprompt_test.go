@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func typeKeys(in *passwordInput, codes ...uint16) {
+	for _, c := range codes {
+		in.handleKey(c, 1)
+		in.handleKey(c, 0)
+	}
+}
+
+func TestPasswordInput(t *testing.T) {
+	var in passwordInput
+	typeKeys(&in, 25, 30, 31, 31) // p a s s
+	in.handleKey(keyLeftShift, 1)
+	typeKeys(&in, 3, 17) // @ W
+	in.handleKey(keyLeftShift, 0)
+	typeKeys(&in, 57, keyBackspace, 11) // space, backspace, 0
+	require.Equal(t, "pass@W0", string(in.buf))
+	require.False(t, in.done)
+
+	typeKeys(&in, keyCapsLock, 30)
+	in.handleKey(keyRightShift, 1)
+	typeKeys(&in, 30)
+	in.handleKey(keyRightShift, 0)
+	require.Equal(t, "pass@W0Aa", string(in.buf))
+	require.True(t, in.capsLock)
+
+	in.handleKey(keyLeftCtrl, 1)
+	typeKeys(&in, 22) // Ctrl-U
+	in.handleKey(keyLeftCtrl, 0)
+	require.Empty(t, in.buf)
+
+	in.handleKey(30, 1)
+	in.handleKey(30, 2) // autorepeat
+	typeKeys(&in, keyKpEnter)
+	require.Equal(t, "AA", string(in.buf))
+	require.True(t, in.done)
+
+	var aborted passwordInput
+	typeKeys(&aborted, keyEsc)
+	require.True(t, aborted.abort)
+}
+
+func TestIsKeyboard(t *testing.T) {
+	// a regular keyboard and a power button
+	require.True(t, isKeyboard("120013 0 0 0 0 1 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 e080ffdf01cfffff fffffffffffffffe\n"))
+	require.False(t, isKeyboard("10000000000000 0\n"))
+	require.False(t, isKeyboard(""))
+}
+
+func TestRenderPasswordPrompt(t *testing.T) {
+	font := &psfFont{width: 8, height: 16, bytesPerRow: 1, glyphs: make([][]byte, 256)}
+	for i := range font.glyphs {
+		font.glyphs[i] = make([]byte, 16)
+	}
+	font.glyphs['*'][8] = 0xff
+
+	c := &canvas{width: 640, height: 480, pitch: 640 * 4}
+	c.pixels = make([]byte, c.pitch*c.height)
+	require.Equal(t, 1, promptScale(font, c.width, c.height))
+	require.Equal(t, 2, promptScale(font, 1920, 1080))
+
+	renderPasswordPrompt(c, font, "Enter passphrase for root:", 3, false)
+	pixel := func(x, y int) uint32 { return binary.LittleEndian.Uint32(c.pixels[y*c.pitch+x*4:]) }
+	require.Equal(t, uint32(colorBackground), pixel(0, 0))
+	require.Equal(t, uint32(colorBox), pixel(c.width/2, c.height/2-50))
+
+	// three asterisks drawn as horizontal lines in the input field
+	stars := 0
+	for y := 0; y < c.height; y++ {
+		row := 0
+		for x := 0; x < c.width; x++ {
+			if pixel(x, y) == colorText {
+				row++
+			}
+		}
+		if row > 0 {
+			stars = row
+		}
+	}
+	require.Equal(t, 3*8, stars)
+}
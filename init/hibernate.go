@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Hibernation images written by the kernel (swsusp) are resumed by writing the device number to /sys/power/resume.
+// Images written by the userspace suspend tool (s2disk from uswsusp) might be compressed and encrypted, they are
+// resumed by uswsusp resume tool that asks for the image passphrase.
+
+const (
+	swsuspSignature  = "S1SUSPEND"
+	uswsuspSignature = "ULSUSPEND"
+)
+
+// hibernationSignature returns the signature at the end of the swap header page, the header is located at offset
+// (in pages) of the device
+func hibernationSignature(devpath string, offset uint64) (string, error) {
+	f, err := os.Open(devpath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	pageSize := int64(os.Getpagesize())
+	sig := make([]byte, 10)
+	if _, err := f.ReadAt(sig, int64(offset)*pageSize+pageSize-int64(len(sig))); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(sig), "\x00"), nil
+}
+
+// uswsuspResume runs uswsusp resume tool at the console. The tool returns only if the image is not resumed.
+func uswsuspResume(devpath string) error {
+	if _, err := os.Stat(uswsuspResumeBinary); err != nil {
+		return fmt.Errorf("the hibernation image is written by s2disk but uswsusp is not added to the image")
+	}
+
+	// the tool asks for the image passphrase, no other prompts should use the console meanwhile
+	inputMutex.Lock()
+	defer inputMutex.Unlock()
+	stopPlymouth()
+
+	args := []string{"-r", devpath}
+	if cmdResumeOffset != 0 {
+		args = append(args, "-o", strconv.FormatUint(cmdResumeOffset, 10))
+	}
+	info("resuming uswsusp image from %s", devpath)
+	cmd := exec.Command(uswsuspResumeBinary, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v", uswsuspResumeBinary, unwrapExitError(err))
+	}
+	info("uswsusp image at %s is not resumed", devpath)
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHibernationSignature(t *testing.T) {
+	pageSize := os.Getpagesize()
+	dev := filepath.Join(t.TempDir(), "swap")
+	data := make([]byte, 3*pageSize)
+	copy(data[pageSize-10:], "SWAPSPACE2")
+	copy(data[3*pageSize-10:], "ULSUSPEND\x00")
+	require.NoError(t, os.WriteFile(dev, data, 0o644))
+
+	sig, err := hibernationSignature(dev, 0)
+	require.NoError(t, err)
+	require.Equal(t, "SWAPSPACE2", sig)
+
+	// swap file header located at resume_offset
+	sig, err = hibernationSignature(dev, 2)
+	require.NoError(t, err)
+	require.Equal(t, uswsuspSignature, sig)
+
+	_, err = hibernationSignature(dev, 3)
+	require.Error(t, err)
+}
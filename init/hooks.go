@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Post-unlock hooks are user executables that booster runs after a LUKS volume is unlocked and before the root
+// filesystem is mounted, e.g. to set up a swap or bind mounts on the unlocked device. The hooks are added to the image
+// from the host's /etc/booster/hooks.d directory by the generator.
+
+var (
+	postUnlockHooksDir = "/etc/booster/hooks.d"
+	// postUnlockHooksLock is read-locked while a volume is being unlocked and its hooks run.
+	// Root mount takes the write lock to make sure all started hooks are finished.
+	postUnlockHooksLock sync.RWMutex
+)
+
+// listPostUnlockHooks returns executables from the hooks directory sorted by name
+func listPostUnlockHooks() ([]string, error) {
+	entries, err := os.ReadDir(postUnlockHooksDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var hooks []string
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		if !fi.Mode().IsRegular() || fi.Mode().Perm()&0o111 == 0 {
+			debug("hooks: skipping %s as it is not an executable file", e.Name())
+			continue
+		}
+		hooks = append(hooks, filepath.Join(postUnlockHooksDir, e.Name()))
+	}
+	sort.Strings(hooks)
+	return hooks, nil
+}
+
+// logHookOutput forwards the hook output to the booster log line by line
+func logHookOutput(name string, r io.Reader, wg *sync.WaitGroup) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		info("hook %s: %s", name, scanner.Text())
+	}
+	_, _ = io.Copy(io.Discard, r) // drain the rest in case of a too long line so the hook does not block
+}
+
+// runPostUnlockHooks runs the hooks for the unlocked mapping. The device is passed both as arguments
+// ($1 - mapper device path, $2 - mapping name) and as BOOSTER_* environment variables.
+// A failed hook aborts the boot unless the image is configured to ignore hook failures.
+func runPostUnlockHooks(mappingName, sourceDev, uuid string) error {
+	hooks, err := listPostUnlockHooks()
+	if err != nil {
+		return fmt.Errorf("hooks: %v", err)
+	}
+
+	mapperDev := "/dev/mapper/" + mappingName
+	for _, h := range hooks {
+		name := filepath.Base(h)
+		info("running post-unlock hook %s for %s", name, mapperDev)
+
+		cmd := exec.Command(h, mapperDev, mappingName)
+		cmd.Env = append(os.Environ(),
+			"BOOSTER_DEVICE="+mapperDev,
+			"BOOSTER_NAME="+mappingName,
+			"BOOSTER_SOURCE="+sourceDev,
+			"BOOSTER_UUID="+uuid,
+		)
+		pr, pw := io.Pipe()
+		cmd.Stdout = pw
+		cmd.Stderr = pw
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go logHookOutput(name, pr, &wg)
+		err := cmd.Run()
+		_ = pw.Close()
+		wg.Wait()
+
+		if err == nil {
+			continue
+		}
+		if config.HooksIgnoreFailures {
+			warning("post-unlock hook %s failed for %s: %v", name, mapperDev, err)
+			continue
+		}
+		return fmt.Errorf("post-unlock hook %s failed for %s: %v", name, mapperDev, err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostUnlockHooks(t *testing.T) {
+	dir := t.TempDir()
+	postUnlockHooksDir = dir
+	defer func() {
+		postUnlockHooksDir = "/etc/booster/hooks.d"
+		config.HooksIgnoreFailures = false
+	}()
+
+	out := filepath.Join(t.TempDir(), "out")
+	writeHook := func(name, script string, mode os.FileMode) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), mode))
+	}
+	writeHook("20-second", `echo "second $BOOSTER_NAME" >> `+out, 0o755)
+	writeHook("10-first", `echo "first $1 $2 $BOOSTER_DEVICE $BOOSTER_SOURCE $BOOSTER_UUID" >> `+out, 0o755)
+	writeHook("15-disabled", `echo disabled >> `+out, 0o644) // not executable
+
+	require.NoError(t, runPostUnlockHooks("cryptroot", "/dev/sda2", "e2a2f4d0-1a1c-4b52-8d4c-7e0e6f5c2d11"))
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"first /dev/mapper/cryptroot cryptroot /dev/mapper/cryptroot /dev/sda2 e2a2f4d0-1a1c-4b52-8d4c-7e0e6f5c2d11",
+		"second cryptroot",
+	}, strings.Split(strings.TrimSpace(string(data)), "\n"))
+
+	// a failing hook stops the following ones
+	require.NoError(t, os.Remove(out))
+	writeHook("12-fail", "exit 3", 0o755)
+	require.Error(t, runPostUnlockHooks("cryptroot", "/dev/sda2", ""))
+	data, err = os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "first", strings.Fields(string(data))[0])
+	require.NotContains(t, string(data), "second")
+
+	config.HooksIgnoreFailures = true
+	require.NoError(t, os.Remove(out))
+	require.NoError(t, runPostUnlockHooks("cryptroot", "/dev/sda2", ""))
+	data, err = os.ReadFile(out)
+	require.NoError(t, err)
+	require.Contains(t, string(data), "second")
+}
+
+func TestPostUnlockHooksMissingDir(t *testing.T) {
+	postUnlockHooksDir = filepath.Join(t.TempDir(), "nonexistent")
+	defer func() { postUnlockHooksDir = "/etc/booster/hooks.d" }()
+
+	require.NoError(t, runPostUnlockHooks("cryptroot", "/dev/sda2", ""))
+}
@@ -20,3 +20,12 @@ func TestSunderMountFlags(t *testing.T) {
 	check("nodev", unix.MS_NODEV, "")
 	check("user_xattr,noatime,nobarrier,nodev,dirsync,lazytime,nolazytime,dev,rw,ro", unix.MS_NOATIME|unix.MS_DIRSYNC|unix.MS_RDONLY, "user_xattr,nobarrier")
 }
+
+func TestFilesystemsContain(t *testing.T) {
+	filesystems := "nodev\tsysfs\nnodev\ttmpfs\n\text4\n\tvfat\nnodev\tbtrfs-control-x\n"
+
+	require.True(t, filesystemsContain(filesystems, "ext4"))
+	require.True(t, filesystemsContain(filesystems, "tmpfs"))
+	require.False(t, filesystemsContain(filesystems, "btrfs"))
+	require.False(t, filesystemsContain(filesystems, "nodev"))
+}
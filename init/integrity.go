@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Standalone dm-integrity devices (created with 'integritysetup format') are detected by the superblock and activated
+// as /dev/mapper/integrity-$DEVNAME. The device content (e.g. a LUKS volume or a filesystem) is processed after that
+// as any other block device. The integrity algorithm is not stored in the superblock, crc32c (integritysetup default)
+// is used unless booster.integrity_hash= is specified.
+
+var integrityHash = "crc32c"
+
+const (
+	integrityFlagHaveJournalMac = 1 << 0
+	integrityFlagRecalculating  = 1 << 1
+	integrityFlagDirtyBitmap    = 1 << 2
+	integrityFlagFixedPadding   = 1 << 3
+	integrityFlagFixedHmac      = 1 << 4
+)
+
+type integritySuperblock struct {
+	version             uint8
+	tagSize             uint16
+	providedDataSectors uint64
+	flags               uint32
+	log2SectorsPerBlock uint8
+}
+
+func probeIntegrity(f *os.File) *blkInfo {
+	const superblockSize = 48
+
+	sb := make([]byte, superblockSize)
+	if _, err := f.ReadAt(sb, 0); err != nil {
+		return nil
+	}
+	if !bytes.Equal(sb[0:8], []byte("integrt\x00")) {
+		return nil
+	}
+
+	data := integritySuperblock{
+		version:             sb[8],
+		tagSize:             binary.LittleEndian.Uint16(sb[10:12]),
+		providedDataSectors: binary.LittleEndian.Uint64(sb[16:24]),
+		flags:               binary.LittleEndian.Uint32(sb[24:28]),
+		log2SectorsPerBlock: sb[28],
+	}
+	return &blkInfo{format: "integrity", data: data}
+}
+
+// integrityTarget builds dm-integrity table for the device, see https://docs.kernel.org/admin-guide/device-mapper/dm-integrity.html
+func integrityTarget(dev string, sb integritySuperblock, hash string) (dmTarget, error) {
+	if sb.flags&(integrityFlagHaveJournalMac|integrityFlagFixedHmac) != 0 {
+		return dmTarget{}, fmt.Errorf("keyed (HMAC) integrity is not supported")
+	}
+	if sb.tagSize == 0 || sb.providedDataSectors == 0 {
+		return dmTarget{}, fmt.Errorf("invalid integrity superblock")
+	}
+
+	mode := "J" // journal
+	if sb.flags&integrityFlagDirtyBitmap != 0 {
+		mode = "B"
+	}
+	options := []string{"internal_hash:" + hash}
+	if sb.log2SectorsPerBlock > 0 {
+		options = append(options, "block_size:"+strconv.Itoa(512<<sb.log2SectorsPerBlock))
+	}
+	if sb.flags&integrityFlagFixedPadding != 0 {
+		options = append(options, "fix_padding")
+	}
+	if sb.flags&integrityFlagRecalculating != 0 {
+		options = append(options, "recalculate")
+	}
+
+	return dmTarget{
+		length: sb.providedDataSectors,
+		typ:    "integrity",
+		spec:   fmt.Sprintf("%s 0 %d %s %d %s", dev, sb.tagSize, mode, len(options), strings.Join(options, " ")),
+	}, nil
+}
+
+func handleIntegrityBlockDevice(blk *blkInfo) error {
+	if !config.EnableIntegrity {
+		info("dm-integrity support is disabled, ignoring integrity device %s", blk.path)
+		return nil
+	}
+
+	target, err := integrityTarget(blk.path, blk.data.(integritySuperblock), integrityHash)
+	if err != nil {
+		return fmt.Errorf("%s: %v", blk.path, err)
+	}
+
+	modules := []string{"dm_integrity"}
+	modules = append(modules, matchAlias("crypto_"+integrityHash)...)
+	wg := loadModules(modules...)
+	wg.Wait()
+
+	name := "integrity-" + filepath.Base(blk.path)
+	info("activating integrity device %s as /dev/mapper/%s", blk.path, name)
+	if err := dmCreate(name, "CRYPT-INTEGRITY-"+name, 0, target); err != nil {
+		return fmt.Errorf("%s: unable to activate integrity device: %v", blk.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeIntegrity(t *testing.T) {
+	sb := make([]byte, 4096)
+	copy(sb, "integrt\x00")
+	sb[8] = 5 // version
+	binary.LittleEndian.PutUint16(sb[10:], 4)
+	binary.LittleEndian.PutUint64(sb[16:], 204800)
+	binary.LittleEndian.PutUint32(sb[24:], integrityFlagFixedPadding)
+	sb[28] = 3 // 4096 bytes block
+
+	path := filepath.Join(t.TempDir(), "integrity.img")
+	require.NoError(t, os.WriteFile(path, sb, 0o600))
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	blk := probeIntegrity(f)
+	require.NotNil(t, blk)
+	require.Equal(t, "integrity", blk.format)
+	require.Equal(t, integritySuperblock{version: 5, tagSize: 4, providedDataSectors: 204800, flags: integrityFlagFixedPadding, log2SectorsPerBlock: 3}, blk.data)
+
+	target, err := integrityTarget("/dev/sda2", blk.data.(integritySuperblock), "crc32c")
+	require.NoError(t, err)
+	require.Equal(t, dmTarget{length: 204800, typ: "integrity", spec: "/dev/sda2 0 4 J 3 internal_hash:crc32c block_size:4096 fix_padding"}, target)
+
+	bitmap := integritySuperblock{tagSize: 32, providedDataSectors: 1024, flags: integrityFlagDirtyBitmap}
+	target, err = integrityTarget("/dev/sdb", bitmap, "sha256")
+	require.NoError(t, err)
+	require.Equal(t, "/dev/sdb 0 32 B 1 internal_hash:sha256", target.spec)
+
+	_, err = integrityTarget("/dev/sdb", integritySuperblock{tagSize: 32, providedDataSectors: 1024, flags: integrityFlagHaveJournalMac}, "sha256")
+	require.Error(t, err)
+}
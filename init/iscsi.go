@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// iscsiTarget specifies an iSCSI target configured with rd.iscsi.*, iscsi_* or netroot=iscsi:... boot params
+// or read from the iSCSI Boot Firmware Table. The login is done by 'iscsistart' tool from open-iscsi if it is added
+// to the image, otherwise booster logs in natively (see iscsinative.go). Once logged in the kernel exposes the target LUNs
+// as SCSI disks that are handled the same way as local disks.
+type iscsiTarget struct {
+	initiator    string
+	name         string
+	address      string
+	port         int
+	group        int
+	username     string // CHAP credentials
+	password     string
+	inUsername   string // mutual (reverse) CHAP credentials
+	inPassword   string
+	netInterface string
+}
+
+var (
+	iscsi           *iscsiTarget // non-nil if iSCSI target is configured
+	iscsiFirmware   bool         // read the target from iBFT, set with rd.iscsi.firmware=1, rd.iscsi.ibft=1 or ip=ibft
+	ibftDir         = "/sys/firmware/ibft"
+	iscsistartPaths = []string{"/usr/bin/iscsistart", "/usr/sbin/iscsistart", "/sbin/iscsistart"}
+)
+
+const (
+	iscsiDefaultPort    = 3260
+	iscsiConnectTimeout = 60 * time.Second // max time to wait for the target login, including retries
+	iscsiInitiatorFile  = "/etc/iscsi/initiatorname.iscsi"
+)
+
+func iscsiConfig() *iscsiTarget {
+	if iscsi == nil {
+		iscsi = &iscsiTarget{port: iscsiDefaultPort, group: 1}
+	}
+	return iscsi
+}
+
+// parseIscsiParam handles rd.iscsi.* and iscsi_* boot params, it returns false if the param is not iSCSI related
+func parseIscsiParam(key, value string) (bool, error) {
+	var name string
+	switch {
+	case strings.HasPrefix(key, "rd.iscsi."):
+		name = strings.ReplaceAll(strings.TrimPrefix(key, "rd.iscsi."), ".", "_")
+	case strings.HasPrefix(key, "iscsi_"):
+		name = strings.TrimPrefix(key, "iscsi_")
+	default:
+		return false, nil
+	}
+
+	switch name {
+	case "initiator":
+		iscsiConfig().initiator = value
+	case "target_name":
+		iscsiConfig().name = value
+	case "target_ip":
+		iscsiConfig().address = value
+	case "target_port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port <= 0 || port > 65535 {
+			return true, fmt.Errorf("invalid iSCSI port %s", value)
+		}
+		iscsiConfig().port = port
+	case "target_group":
+		group, err := strconv.Atoi(value)
+		if err != nil || group < 0 {
+			return true, fmt.Errorf("invalid iSCSI target portal group %s", value)
+		}
+		iscsiConfig().group = group
+	case "username":
+		iscsiConfig().username = value
+	case "password":
+		iscsiConfig().password = value
+	case "in_username":
+		iscsiConfig().inUsername = value
+	case "in_password":
+		iscsiConfig().inPassword = value
+	case "firmware", "ibft":
+		iscsiFirmware = value != "0"
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// parseIscsiNetroot parses dracut style netroot param
+// iscsi:[username:password[:reverse_username:reverse_password]@][server]:[protocol]:[port]:[iface]:[netdev]:[LUN]:targetname
+func parseIscsiNetroot(param string) error {
+	if !strings.HasPrefix(param, "iscsi:") {
+		return fmt.Errorf("iscsi parameter should start with 'iscsi:'")
+	}
+	param = strings.TrimPrefix(param, "iscsi:")
+	t := iscsiConfig()
+
+	if idx := strings.LastIndexByte(param, '@'); idx != -1 {
+		creds := strings.Split(param[:idx], ":")
+		switch len(creds) {
+		case 4:
+			t.inUsername, t.inPassword = creds[2], creds[3]
+			fallthrough
+		case 2:
+			t.username, t.password = creds[0], creds[1]
+		default:
+			return fmt.Errorf("invalid iSCSI credentials format")
+		}
+		param = param[idx+1:]
+	}
+
+	// IPv6 server address is enclosed with brackets
+	if strings.HasPrefix(param, "[") {
+		end := strings.IndexByte(param, ']')
+		if end == -1 {
+			return fmt.Errorf("invalid iSCSI server address")
+		}
+		t.address = param[1:end]
+		param = param[end+1:]
+		if !strings.HasPrefix(param, ":") {
+			return fmt.Errorf("invalid iSCSI server address")
+		}
+		param = param[1:]
+	} else {
+		server, rest, ok := strings.Cut(param, ":")
+		if !ok {
+			return fmt.Errorf("target name is not specified")
+		}
+		t.address, param = server, rest
+	}
+
+	// protocol, port, iface, netdev and LUN fields go first, the target name itself contains ':'
+	fields := strings.SplitN(param, ":", 6)
+	if len(fields) != 6 || fields[5] == "" {
+		return fmt.Errorf("target name is not specified")
+	}
+	if fields[0] != "" && fields[0] != "6" {
+		return fmt.Errorf("unsupported iSCSI protocol %s, only TCP (6) is supported", fields[0])
+	}
+	if fields[1] != "" {
+		port, err := strconv.Atoi(fields[1])
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid iSCSI port %s", fields[1])
+		}
+		t.port = port
+	}
+	t.netInterface = fields[3]
+	t.name = fields[5]
+	return nil
+}
+
+func (t *iscsiTarget) portal() string {
+	return net.JoinHostPort(t.address, strconv.Itoa(t.port))
+}
+
+func (t *iscsiTarget) validate() error {
+	if t.name == "" {
+		return fmt.Errorf("iSCSI target name is not specified")
+	}
+	if t.address == "" {
+		return fmt.Errorf("iSCSI target address is not specified")
+	}
+	if (t.username == "") != (t.password == "") {
+		return fmt.Errorf("both CHAP username and password should be specified")
+	}
+	if (t.inUsername == "") != (t.inPassword == "") {
+		return fmt.Errorf("both reverse CHAP username and password should be specified")
+	}
+	return nil
+}
+
+// readInitiatorName reads the initiator name from the open-iscsi config file in the format InitiatorName=iqn...
+func readInitiatorName() (string, error) {
+	data, err := os.ReadFile(iscsiInitiatorFile)
+	if err != nil {
+		return "", fmt.Errorf("iSCSI initiator name is not specified, use rd.iscsi.initiator= boot param or add %s to the image", iscsiInitiatorFile)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if name, ok := strings.CutPrefix(strings.TrimSpace(line), "InitiatorName="); ok && name != "" {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("%s does not contain InitiatorName", iscsiInitiatorFile)
+}
+
+// ibftNic is a network interface described by the iSCSI Boot Firmware Table
+type ibftNic struct {
+	mac        net.HardwareAddr
+	dhcp       bool
+	ip         string // e.g. 10.0.2.15/24
+	gateway    string
+	dnsServers []string
+	hostname   string
+}
+
+const (
+	ibftFlagFirmwareBoot = 1 << 1 // the block is selected for boot by the firmware
+	ibftOriginDhcp       = 3
+)
+
+func readIbftAttr(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func readIbftInt(dir, name string) int {
+	v, _ := strconv.Atoi(readIbftAttr(dir, name))
+	return v
+}
+
+// readIbft reads the boot target and the network interface associated with it from iBFT exposed
+// by iscsi_ibft module at sysfs (see drivers/firmware/iscsi_ibft.c). If several targets are present then
+// the one selected by the firmware for boot is used.
+func readIbft(dir string) (*iscsiTarget, *ibftNic, error) {
+	targets, _ := filepath.Glob(filepath.Join(dir, "target*"))
+	if len(targets) == 0 {
+		return nil, nil, fmt.Errorf("iBFT does not contain iSCSI targets")
+	}
+	targetDir := targets[0]
+	for _, d := range targets {
+		if readIbftInt(d, "flags")&ibftFlagFirmwareBoot != 0 {
+			targetDir = d
+			break
+		}
+	}
+
+	t := &iscsiTarget{
+		initiator:  readIbftAttr(filepath.Join(dir, "initiator"), "initiator-name"),
+		name:       readIbftAttr(targetDir, "target-name"),
+		address:    readIbftAttr(targetDir, "ip-addr"),
+		port:       readIbftInt(targetDir, "port"),
+		group:      1,
+		username:   readIbftAttr(targetDir, "chap-name"),
+		password:   readIbftAttr(targetDir, "chap-secret"),
+		inUsername: readIbftAttr(targetDir, "rev-chap-name"),
+		inPassword: readIbftAttr(targetDir, "rev-chap-secret"),
+	}
+	if t.port == 0 {
+		t.port = iscsiDefaultPort
+	}
+	if t.name == "" || t.address == "" {
+		return nil, nil, fmt.Errorf("iBFT target %s does not specify the target name or address", filepath.Base(targetDir))
+	}
+
+	nicDir := filepath.Join(dir, "ethernet"+readIbftAttr(targetDir, "nic-assoc"))
+	if _, err := os.Stat(nicDir); err != nil {
+		return t, nil, nil
+	}
+	mac, err := net.ParseMAC(readIbftAttr(nicDir, "mac"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("iBFT %s: %v", filepath.Base(nicDir), err)
+	}
+	nic := &ibftNic{
+		mac:      mac,
+		dhcp:     readIbftInt(nicDir, "origin") == ibftOriginDhcp,
+		hostname: readIbftAttr(nicDir, "hostname"),
+	}
+	if gw := net.ParseIP(readIbftAttr(nicDir, "gateway")); gw != nil && !gw.IsUnspecified() {
+		nic.gateway = gw.String()
+	}
+	if ip := net.ParseIP(readIbftAttr(nicDir, "ip-addr")); !nic.dhcp && ip != nil && !ip.IsUnspecified() {
+		nic.ip = fmt.Sprintf("%s/%d", ip, readIbftInt(nicDir, "prefix-len"))
+	}
+	if nic.ip == "" {
+		nic.dhcp = true
+	}
+	for _, a := range []string{"primary-dns", "secondary-dns"} {
+		if dns := net.ParseIP(readIbftAttr(nicDir, a)); dns != nil && !dns.IsUnspecified() {
+			nic.dnsServers = append(nic.dnsServers, dns.String())
+		}
+	}
+	return t, nic, nil
+}
+
+// configureIscsiFromIbft sets up the iSCSI target and the network from iBFT.
+// Explicitly specified rd.iscsi.* params take precedence over the firmware values.
+func configureIscsiFromIbft() error {
+	wg := loadModules("iscsi_ibft")
+	wg.Wait()
+
+	fw, nic, err := readIbft(ibftDir)
+	if err != nil {
+		return err
+	}
+
+	t := iscsiConfig()
+	for _, f := range []struct{ dst, src *string }{
+		{&t.initiator, &fw.initiator},
+		{&t.name, &fw.name},
+		{&t.address, &fw.address},
+		{&t.username, &fw.username},
+		{&t.password, &fw.password},
+		{&t.inUsername, &fw.inUsername},
+		{&t.inPassword, &fw.inPassword},
+	} {
+		if *f.dst == "" {
+			*f.dst = *f.src
+		}
+	}
+	if t.port == iscsiDefaultPort {
+		t.port = fw.port
+	}
+	info("iscsi: iBFT boot target %s at %s", t.name, t.portal())
+
+	if nic != nil && config.Network == nil {
+		c := &InitNetworkConfig{Interfaces: []net.HardwareAddr{nic.mac}, Dhcp: nic.dhcp, Hostname: nic.hostname}
+		if !nic.dhcp {
+			c.IP, c.Gateway, c.DNSServers = nic.ip, nic.gateway, strings.Join(nic.dnsServers, ",")
+		}
+		config.Network = c
+	}
+	return nil
+}
+
+func (t *iscsiTarget) iscsistartArgs() []string {
+	args := []string{"-i", t.initiator, "-t", t.name, "-g", strconv.Itoa(t.group), "-a", t.address, "-p", strconv.Itoa(t.port)}
+	if t.username != "" {
+		args = append(args, "-u", t.username, "-w", t.password)
+	}
+	if t.inUsername != "" {
+		args = append(args, "-U", t.inUsername, "-W", t.inPassword)
+	}
+	return args
+}
+
+// isIscsiTransientError checks whether iscsistart failed because the target is not reachable yet.
+// Authentication and unknown target errors are permanent.
+func isIscsiTransientError(output []byte) bool {
+	output = bytes.ToLower(output)
+	for _, msg := range []string{"authorization failure", "authentication failure", "target not found", "not authorized"} {
+		if bytes.Contains(output, []byte(msg)) {
+			return false
+		}
+	}
+	return true
+}
+
+// connectIscsi logs in to the iSCSI target. The target might lag behind network availability at boot so
+// transient errors are retried until iscsiConnectTimeout.
+func connectIscsi(t *iscsiTarget) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	if t.initiator == "" {
+		var err error
+		t.initiator, err = readInitiatorName()
+		if err != nil {
+			return err
+		}
+	}
+
+	wg := loadModules("iscsi_tcp")
+	wg.Wait()
+
+	var binary string
+	for _, b := range iscsistartPaths {
+		if _, err := os.Stat(b); err == nil {
+			binary = b
+			break
+		}
+	}
+	if binary == "" {
+		return loginIscsiNative(t)
+	}
+
+	info("iscsi: logging in to target %s at %s as %s", t.name, t.portal(), t.initiator)
+	deadline := time.Now().Add(iscsiConnectTimeout)
+	for {
+		out, err := exec.Command(binary, t.iscsistartArgs()...).CombinedOutput()
+		if err == nil {
+			info("iscsi: logged in to target %s", t.name)
+			return nil
+		}
+		msg := strings.TrimSpace(string(out))
+		if !isIscsiTransientError(out) {
+			return fmt.Errorf("iscsi: login to target %s at %s failed: %v: %s", t.name, t.portal(), err, msg)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("iscsi: unable to login to target %s at %s after %v: %s", t.name, t.portal(), iscsiConnectTimeout, msg)
+		}
+		debug("iscsi: login to %s: %v: %s, retrying", t.portal(), err, msg)
+		time.Sleep(2 * time.Second)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIscsiNetroot(t *testing.T) {
+	defer func() { iscsi = nil }()
+
+	check := func(param string, expected iscsiTarget) {
+		iscsi = nil
+		require.NoError(t, parseIscsiNetroot(param))
+		require.Equal(t, expected, *iscsi)
+	}
+
+	check("iscsi:192.168.1.10::::::iqn.2009-06.com.example:disk1",
+		iscsiTarget{address: "192.168.1.10", port: 3260, group: 1, name: "iqn.2009-06.com.example:disk1"})
+	check("iscsi:user:secret@192.168.1.10:6:3261::eth0:0:iqn.2009-06.com.example:disk1",
+		iscsiTarget{address: "192.168.1.10", port: 3261, group: 1, name: "iqn.2009-06.com.example:disk1", username: "user", password: "secret", netInterface: "eth0"})
+	check("iscsi:user:secret:ruser:rsecret@[fd00::1]::::::iqn.2009-06.com.example:disk1",
+		iscsiTarget{address: "fd00::1", port: 3260, group: 1, name: "iqn.2009-06.com.example:disk1", username: "user", password: "secret", inUsername: "ruser", inPassword: "rsecret"})
+
+	invalid := func(param string) {
+		iscsi = nil
+		require.Error(t, parseIscsiNetroot(param), param)
+	}
+	invalid("nbd:server")
+	invalid("iscsi:192.168.1.10")
+	invalid("iscsi:192.168.1.10::::::")
+	invalid("iscsi:192.168.1.10:17:::::iqn.2009-06.com.example:disk1")
+	invalid("iscsi:user@192.168.1.10::::::iqn.2009-06.com.example:disk1")
+	invalid("iscsi:[fd00::1::::::iqn.2009-06.com.example:disk1")
+}
+
+func TestParseParamsIscsi(t *testing.T) {
+	defer func() { iscsi = nil }()
+
+	iscsi = nil
+	require.NoError(t, parseParams("rd.iscsi.initiator=iqn.2021-01.org.example:client rd.iscsi.target.name=iqn.2009-06.com.example:disk1 rd.iscsi.target.ip=10.0.2.2 rd.iscsi.target.port=3262 iscsi_username=user iscsi_password=secret"))
+	require.Equal(t, iscsiTarget{
+		initiator: "iqn.2021-01.org.example:client",
+		name:      "iqn.2009-06.com.example:disk1",
+		address:   "10.0.2.2",
+		port:      3262,
+		group:     1,
+		username:  "user",
+		password:  "secret",
+	}, *iscsi)
+	require.NoError(t, iscsi.validate())
+	require.Equal(t, []string{"-i", "iqn.2021-01.org.example:client", "-t", "iqn.2009-06.com.example:disk1", "-g", "1", "-a", "10.0.2.2", "-p", "3262", "-u", "user", "-w", "secret"}, iscsi.iscsistartArgs())
+
+	iscsi = nil
+	require.Error(t, parseParams("rd.iscsi.target.port=abc"))
+
+	iscsi = nil
+	require.NoError(t, parseParams("rd.iscsi.target.name=iqn.2009-06.com.example:disk1 rd.iscsi.target.ip=10.0.2.2 rd.iscsi.username=user"))
+	require.Error(t, iscsi.validate())
+}
+
+func TestReadIbft(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, value string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(value+"\n"), 0o644))
+	}
+	write("initiator/initiator-name", "iqn.2021-01.org.example:client")
+	write("target0/flags", "1")
+	write("target0/target-name", "iqn.2009-06.com.example:other")
+	write("target0/ip-addr", "10.0.2.5")
+	write("target1/flags", "3")
+	write("target1/target-name", "iqn.2009-06.com.example:disk1")
+	write("target1/ip-addr", "10.0.2.2")
+	write("target1/port", "3261")
+	write("target1/chap-name", "user")
+	write("target1/chap-secret", "secret")
+	write("target1/nic-assoc", "0")
+	write("ethernet0/mac", "52:54:00:12:34:56")
+	write("ethernet0/origin", "1")
+	write("ethernet0/ip-addr", "10.0.2.15")
+	write("ethernet0/prefix-len", "24")
+	write("ethernet0/gateway", "10.0.2.2")
+	write("ethernet0/primary-dns", "10.0.2.3")
+	write("ethernet0/secondary-dns", "0.0.0.0")
+
+	target, nic, err := readIbft(dir)
+	require.NoError(t, err)
+	require.Equal(t, iscsiTarget{
+		initiator: "iqn.2021-01.org.example:client",
+		name:      "iqn.2009-06.com.example:disk1",
+		address:   "10.0.2.2",
+		port:      3261,
+		group:     1,
+		username:  "user",
+		password:  "secret",
+	}, *target)
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	require.Equal(t, ibftNic{mac: mac, ip: "10.0.2.15/24", gateway: "10.0.2.2", dnsServers: []string{"10.0.2.3"}}, *nic)
+
+	write("ethernet0/origin", "3")
+	_, nic, err = readIbft(dir)
+	require.NoError(t, err)
+	require.True(t, nic.dhcp)
+
+	_, _, err = readIbft(t.TempDir())
+	require.Error(t, err)
+}
+
+func TestParseParamsIscsiFirmware(t *testing.T) {
+	defer func() { iscsi, iscsiFirmware = nil, false }()
+
+	for _, p := range []string{"rd.iscsi.firmware=1", "rd.iscsi.ibft", "ip=ibft"} {
+		iscsiFirmware = false
+		require.NoError(t, parseParams(p))
+		require.True(t, iscsiFirmware, p)
+	}
+}
@@ -0,0 +1,660 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Native iSCSI initiator logs in to the target over TCP in userspace and then passes the connected socket to the kernel
+// iscsi_tcp driver with NETLINK_ISCSI messages, the same way iscsid does it. This way open-iscsi tools are not needed in the image.
+// Only single connection sessions without header/data digests and with error recovery level 0 are supported.
+
+const (
+	iscsiOpLoginReq   = 0x03
+	iscsiOpLoginResp  = 0x23
+	iscsiOpReject     = 0x3f
+	iscsiBhsSize      = 48 // basic header segment
+	iscsiFlagImmed    = 0x40
+	iscsiFlagTransit  = 0x80
+	iscsiLoginMaxPdus = 16 // max number of login PDUs exchanged at a login stage
+
+	iscsiStageSecurity    = 0
+	iscsiStageOperational = 1
+	iscsiStageFullFeature = 3
+
+	iscsiMaxRecvDataSegment = 262144
+	iscsiChapMD5            = "5"
+)
+
+// iscsiIsid is the initiator part of the session identifier, the same default value as open-iscsi uses
+var iscsiIsid = [6]byte{0x00, 0x02, 0x3d, 0x00, 0x00, 0x01}
+
+// iscsiOperationalKeys are the session parameters offered to the target, the values match open-iscsi defaults
+var iscsiOperationalKeys = []string{
+	"HeaderDigest=None",
+	"DataDigest=None",
+	"DefaultTime2Wait=2",
+	"DefaultTime2Retain=0",
+	"IFMarker=No",
+	"OFMarker=No",
+	"ErrorRecoveryLevel=0",
+	"InitialR2T=No",
+	"ImmediateData=Yes",
+	"MaxBurstLength=16776192",
+	"FirstBurstLength=262144",
+	"MaxOutstandingR2T=1",
+	"MaxConnections=1",
+	"DataPDUInOrder=Yes",
+	"DataSequenceInOrder=Yes",
+	"MaxRecvDataSegmentLength=" + strconv.Itoa(iscsiMaxRecvDataSegment),
+}
+
+// iscsiLoginError is a login response with non-zero status (see RFC 7143 section 11.13.5)
+type iscsiLoginError struct {
+	class, detail uint8
+}
+
+func (e *iscsiLoginError) Error() string {
+	switch {
+	case e.class == 1:
+		return "target moved, login redirection is not supported"
+	case e.class == 2 && e.detail == 1:
+		return "authentication failure"
+	case e.class == 2 && e.detail == 2:
+		return "authorization failure"
+	case e.class == 2 && e.detail == 3:
+		return "target not found"
+	case e.class == 3:
+		return fmt.Sprintf("target error 0x%02x", e.detail)
+	default:
+		return fmt.Sprintf("login failed with status 0x%02x%02x", e.class, e.detail)
+	}
+}
+
+// transient checks whether the target might accept the login later, e.g. if it is out of resources
+func (e *iscsiLoginError) transient() bool {
+	return e.class == 3
+}
+
+// iscsiLogin is the login phase state of a new session
+type iscsiLogin struct {
+	t        *iscsiTarget
+	conn     io.ReadWriter
+	cmdSN    uint32
+	statSN   uint32
+	expCmdSN uint32
+	tsih     uint16
+	keys     map[string]string // keys received from the target
+}
+
+// encodeIscsiKeys encodes key=value pairs as a login PDU data segment
+func encodeIscsiKeys(keys []string) []byte {
+	var buf bytes.Buffer
+	for _, k := range keys {
+		buf.WriteString(k)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// parseIscsiKeys parses key=value pairs of a login PDU data segment
+func parseIscsiKeys(data []byte) map[string]string {
+	keys := make(map[string]string)
+	for _, kv := range bytes.Split(data, []byte{0}) {
+		if k, v, ok := strings.Cut(string(kv), "="); ok {
+			keys[k] = v
+		}
+	}
+	return keys
+}
+
+// exchange sends a login request with the given keys and reads the target response.
+// It returns the response keys and whether the target transitioned to the next stage.
+func (l *iscsiLogin) exchange(stage uint8, transit bool, keys []string) (map[string]string, bool, error) {
+	data := encodeIscsiKeys(keys)
+	if len(data) > 0xffffff {
+		return nil, false, fmt.Errorf("login data is too large")
+	}
+
+	pdu := make([]byte, iscsiBhsSize, iscsiBhsSize+len(data)+3)
+	pdu[0] = iscsiFlagImmed | iscsiOpLoginReq
+	pdu[1] = stage << 2
+	if transit {
+		next := uint8(iscsiStageOperational)
+		if stage == iscsiStageOperational {
+			next = iscsiStageFullFeature
+		}
+		pdu[1] |= iscsiFlagTransit | next
+	}
+	pdu[5], pdu[6], pdu[7] = byte(len(data)>>16), byte(len(data)>>8), byte(len(data))
+	copy(pdu[8:14], iscsiIsid[:])
+	binary.BigEndian.PutUint16(pdu[14:16], l.tsih)
+	binary.BigEndian.PutUint32(pdu[24:28], l.cmdSN)
+	binary.BigEndian.PutUint32(pdu[28:32], l.statSN+1)
+	pdu = append(pdu, data...)
+	pdu = append(pdu, make([]byte, -len(data)&3)...) // data segment is padded to 4 bytes
+	if _, err := l.conn.Write(pdu); err != nil {
+		return nil, false, err
+	}
+
+	hdr := make([]byte, iscsiBhsSize)
+	if _, err := io.ReadFull(l.conn, hdr); err != nil {
+		return nil, false, err
+	}
+	switch op := hdr[0] & 0x3f; op {
+	case iscsiOpLoginResp:
+	case iscsiOpReject:
+		return nil, false, fmt.Errorf("target rejected the login request with reason 0x%02x", hdr[2])
+	default:
+		return nil, false, fmt.Errorf("unexpected iSCSI opcode 0x%02x in login response", op)
+	}
+	ahsLen := 4 * int(hdr[4])
+	dataLen := int(hdr[5])<<16 | int(hdr[6])<<8 | int(hdr[7])
+	resp := make([]byte, ahsLen+dataLen+(-dataLen&3))
+	if _, err := io.ReadFull(l.conn, resp); err != nil {
+		return nil, false, err
+	}
+
+	l.statSN = binary.BigEndian.Uint32(hdr[24:28])
+	l.expCmdSN = binary.BigEndian.Uint32(hdr[28:32])
+	if class, detail := hdr[36], hdr[37]; class != 0 {
+		return nil, false, &iscsiLoginError{class, detail}
+	}
+	l.tsih = binary.BigEndian.Uint16(hdr[14:16])
+
+	respKeys := parseIscsiKeys(resp[ahsLen : ahsLen+dataLen])
+	for k, v := range respKeys {
+		l.keys[k] = v
+	}
+	return respKeys, hdr[1]&iscsiFlagTransit != 0, nil
+}
+
+// transit requests the transition from the current login stage until the target accepts it
+func (l *iscsiLogin) transit(stage uint8, keys []string) error {
+	for i := 0; i < iscsiLoginMaxPdus; i++ {
+		_, transit, err := l.exchange(stage, true, keys)
+		if err != nil {
+			return err
+		}
+		if transit {
+			return nil
+		}
+		keys = nil
+	}
+	return fmt.Errorf("target does not complete login stage %d", stage)
+}
+
+// login performs the security and operational negotiation stages of the login phase
+func (l *iscsiLogin) login() error {
+	t := l.t
+	l.keys = make(map[string]string)
+
+	authMethod := "None"
+	if t.inUsername != "" {
+		authMethod = "CHAP" // mutual authentication is requested so the target has to use CHAP
+	} else if t.username != "" {
+		authMethod = "CHAP,None"
+	}
+	keys := []string{
+		"InitiatorName=" + t.initiator,
+		"SessionType=Normal",
+		"TargetName=" + t.name,
+		"AuthMethod=" + authMethod,
+	}
+
+	if t.username == "" {
+		if err := l.transit(iscsiStageSecurity, keys); err != nil {
+			return err
+		}
+	} else {
+		resp, transit, err := l.exchange(iscsiStageSecurity, false, keys)
+		if err != nil {
+			return err
+		}
+		switch resp["AuthMethod"] {
+		case "CHAP":
+			if err := l.authenticateChap(); err != nil {
+				return err
+			}
+		case "None":
+			if t.inUsername != "" {
+				return fmt.Errorf("target does not support mutual CHAP authentication")
+			}
+			if !transit {
+				if err := l.transit(iscsiStageSecurity, nil); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("target does not support authentication method %s", authMethod)
+		}
+	}
+
+	return l.transit(iscsiStageOperational, iscsiOperationalKeys)
+}
+
+// chapResponse calculates CHAP response with MD5 algorithm (RFC 1994)
+func chapResponse(id byte, secret string, challenge []byte) []byte {
+	h := md5.New()
+	h.Write([]byte{id})
+	h.Write([]byte(secret))
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+// decodeChapValue decodes a CHAP binary value that is either hex (0x prefix) or base64 (0b prefix) encoded
+func decodeChapValue(value string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(value, "0x"), strings.HasPrefix(value, "0X"):
+		return hex.DecodeString(value[2:])
+	case strings.HasPrefix(value, "0b"), strings.HasPrefix(value, "0B"):
+		return base64.StdEncoding.DecodeString(value[2:])
+	default:
+		return nil, fmt.Errorf("invalid CHAP value encoding '%s'", value)
+	}
+}
+
+func (l *iscsiLogin) authenticateChap() error {
+	t := l.t
+	resp, _, err := l.exchange(iscsiStageSecurity, false, []string{"CHAP_A=" + iscsiChapMD5})
+	if err != nil {
+		return err
+	}
+	if resp["CHAP_A"] != iscsiChapMD5 {
+		return fmt.Errorf("target does not support CHAP with MD5")
+	}
+	id, err := strconv.ParseUint(resp["CHAP_I"], 10, 8)
+	if err != nil {
+		return fmt.Errorf("invalid CHAP identifier '%s'", resp["CHAP_I"])
+	}
+	challenge, err := decodeChapValue(resp["CHAP_C"])
+	if err != nil {
+		return err
+	}
+
+	keys := []string{
+		"CHAP_N=" + t.username,
+		"CHAP_R=0x" + hex.EncodeToString(chapResponse(byte(id), t.password, challenge)),
+	}
+	var ourChallenge []byte
+	if t.inUsername != "" {
+		ourChallenge = make([]byte, 17) // the first byte is used as the identifier
+		if _, err := rand.Read(ourChallenge); err != nil {
+			return err
+		}
+		keys = append(keys, "CHAP_I="+strconv.Itoa(int(ourChallenge[0])), "CHAP_C=0x"+hex.EncodeToString(ourChallenge[1:]))
+	}
+
+	resp, transit, err := l.exchange(iscsiStageSecurity, true, keys)
+	if err != nil {
+		return err
+	}
+	if t.inUsername != "" {
+		if resp["CHAP_N"] != t.inUsername {
+			return fmt.Errorf("target responded with unexpected mutual CHAP name '%s'", resp["CHAP_N"])
+		}
+		r, err := decodeChapValue(resp["CHAP_R"])
+		if err != nil {
+			return err
+		}
+		expected := chapResponse(ourChallenge[0], t.inPassword, ourChallenge[1:])
+		if subtle.ConstantTimeCompare(r, expected) != 1 {
+			return fmt.Errorf("target failed mutual CHAP authentication")
+		}
+	}
+	if !transit {
+		return l.transit(iscsiStageSecurity, nil)
+	}
+	return nil
+}
+
+func (l *iscsiLogin) intKey(name string, def int) string {
+	if v, err := strconv.Atoi(l.keys[name]); err == nil {
+		return strconv.Itoa(v)
+	}
+	return strconv.Itoa(def)
+}
+
+func (l *iscsiLogin) boolKey(name string, def bool) string {
+	switch l.keys[name] {
+	case "Yes":
+		return "1"
+	case "No":
+		return "0"
+	}
+	if def {
+		return "1"
+	}
+	return "0"
+}
+
+// constants from include/scsi/iscsi_if.h
+const (
+	iscsiUeventCreateSession = 11
+	iscsiUeventCreateConn    = 13
+	iscsiUeventBindConn      = 15
+	iscsiUeventSetParam      = 16
+	iscsiUeventStartConn     = 17
+
+	iscsiUeventSize        = 56 // sizeof(struct iscsi_uevent)
+	iscsiUeventRequestOff  = 16 // offset of the u->k union
+	iscsiUeventReplyOffset = 40 // offset of the k->u union
+
+	iscsiParamMaxRecvDLength    = 0
+	iscsiParamMaxXmitDLength    = 1
+	iscsiParamHdrDgstEn         = 2
+	iscsiParamDataDgstEn        = 3
+	iscsiParamInitialR2TEn      = 4
+	iscsiParamMaxR2T            = 5
+	iscsiParamImmDataEn         = 6
+	iscsiParamFirstBurst        = 7
+	iscsiParamMaxBurst          = 8
+	iscsiParamPduInorderEn      = 9
+	iscsiParamDataseqInorderEn  = 10
+	iscsiParamErl               = 11
+	iscsiParamIfMarkerEn        = 12
+	iscsiParamOfMarkerEn        = 13
+	iscsiParamExpStatSN         = 14
+	iscsiParamTargetName        = 15
+	iscsiParamTpgt              = 16
+	iscsiParamPersistentAddress = 17
+	iscsiParamPersistentPort    = 18
+	iscsiParamSessRecoveryTmo   = 19
+	iscsiParamPingTmo           = 30
+	iscsiParamRecvTmo           = 31
+	iscsiParamInitiatorName     = 34
+
+	iscsiCmdsMax         = 128 // the same defaults as open-iscsi uses
+	iscsiQueueDepth      = 32
+	iscsiTransportHandle = "/sys/class/iscsi_transport/tcp/handle"
+)
+
+type iscsiParam struct {
+	id    uint32
+	value string
+}
+
+// kernelParams returns the negotiated session parameters in the form expected by the kernel
+func (l *iscsiLogin) kernelParams() []iscsiParam {
+	t := l.t
+	return []iscsiParam{
+		{iscsiParamMaxRecvDLength, strconv.Itoa(iscsiMaxRecvDataSegment)},
+		{iscsiParamMaxXmitDLength, l.intKey("MaxRecvDataSegmentLength", 8192)},
+		{iscsiParamHdrDgstEn, "0"},
+		{iscsiParamDataDgstEn, "0"},
+		{iscsiParamInitialR2TEn, l.boolKey("InitialR2T", true)},
+		{iscsiParamMaxR2T, l.intKey("MaxOutstandingR2T", 1)},
+		{iscsiParamImmDataEn, l.boolKey("ImmediateData", true)},
+		{iscsiParamFirstBurst, l.intKey("FirstBurstLength", 65536)},
+		{iscsiParamMaxBurst, l.intKey("MaxBurstLength", 262144)},
+		{iscsiParamPduInorderEn, l.boolKey("DataPDUInOrder", true)},
+		{iscsiParamDataseqInorderEn, l.boolKey("DataSequenceInOrder", true)},
+		{iscsiParamErl, "0"},
+		{iscsiParamIfMarkerEn, "0"},
+		{iscsiParamOfMarkerEn, "0"},
+		{iscsiParamExpStatSN, strconv.FormatUint(uint64(l.statSN+1), 10)},
+		{iscsiParamTargetName, t.name},
+		{iscsiParamTpgt, l.intKey("TargetPortalGroupTag", t.group)},
+		{iscsiParamPersistentAddress, t.address},
+		{iscsiParamPersistentPort, strconv.Itoa(t.port)},
+		{iscsiParamInitiatorName, t.initiator},
+		{iscsiParamSessRecoveryTmo, "120"},
+		{iscsiParamPingTmo, "5"},
+		{iscsiParamRecvTmo, "5"},
+	}
+}
+
+// iscsiNetlink is a connection to the kernel iSCSI transport class
+type iscsiNetlink struct {
+	fd        int
+	transport uint64 // handle of iscsi_tcp transport
+	seq       uint32
+}
+
+func openIscsiNetlink() (*iscsiNetlink, error) {
+	data, err := os.ReadFile(iscsiTransportHandle)
+	if err != nil {
+		return nil, fmt.Errorf("iscsi_tcp transport is not available: %v", err)
+	}
+	handle, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid iscsi_tcp transport handle: %v", err)
+	}
+
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ISCSI)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 10}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &iscsiNetlink{fd: fd, transport: handle}, nil
+}
+
+func (n *iscsiNetlink) Close() error {
+	return unix.Close(n.fd)
+}
+
+// request sends struct iscsi_uevent with the given request fields followed by data,
+// it returns the reply union of the kernel answer
+func (n *iscsiNetlink) request(typ uint32, fields []byte, data []byte) ([]byte, error) {
+	native := nl.NativeEndian()
+	n.seq++
+
+	msg := make([]byte, unix.SizeofNlMsghdr+iscsiUeventSize, unix.SizeofNlMsghdr+iscsiUeventSize+len(data))
+	native.PutUint32(msg[0:4], uint32(unix.SizeofNlMsghdr+iscsiUeventSize+len(data)))
+	native.PutUint16(msg[4:6], uint16(typ))
+	native.PutUint32(msg[8:12], n.seq)
+	ev := msg[unix.SizeofNlMsghdr:]
+	native.PutUint32(ev[0:4], typ)
+	native.PutUint64(ev[8:16], n.transport)
+	copy(ev[iscsiUeventRequestOff:iscsiUeventReplyOffset], fields)
+	msg = append(msg, data...)
+
+	if err := unix.Sendto(n.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, unix.Getpagesize())
+	for {
+		nr, _, err := unix.Recvfrom(n.fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:nr])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Type != uint16(typ) || len(m.Data) < iscsiUeventSize {
+				continue // a kernel event or a reply to an earlier request
+			}
+			if errno := int32(native.Uint32(m.Data[4:8])); errno != 0 {
+				return nil, unix.Errno(-errno)
+			}
+			return m.Data[iscsiUeventReplyOffset:iscsiUeventSize], nil
+		}
+	}
+}
+
+// requestRetcode sends a request that replies with a return code
+func (n *iscsiNetlink) requestRetcode(typ uint32, fields []byte, data []byte) error {
+	r, err := n.request(typ, fields, data)
+	if err != nil {
+		return err
+	}
+	if rc := int32(nl.NativeEndian().Uint32(r[0:4])); rc < 0 {
+		return unix.Errno(-rc)
+	} else if rc > 0 {
+		return unix.Errno(rc)
+	}
+	return nil
+}
+
+func (n *iscsiNetlink) createSession(initialCmdSN uint32) (sid, hostNo uint32, err error) {
+	native := nl.NativeEndian()
+	f := make([]byte, 8)
+	native.PutUint32(f[0:4], initialCmdSN)
+	native.PutUint16(f[4:6], iscsiCmdsMax)
+	native.PutUint16(f[6:8], iscsiQueueDepth)
+	r, err := n.request(iscsiUeventCreateSession, f, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	return native.Uint32(r[0:4]), native.Uint32(r[4:8]), nil
+}
+
+func (n *iscsiNetlink) createConn(sid uint32) (uint32, error) {
+	native := nl.NativeEndian()
+	f := make([]byte, 8)
+	native.PutUint32(f[0:4], sid)
+	r, err := n.request(iscsiUeventCreateConn, f, nil)
+	if err != nil {
+		return 0, err
+	}
+	return native.Uint32(r[4:8]), nil
+}
+
+func (n *iscsiNetlink) bindConn(sid, cid uint32, sockFd int) error {
+	native := nl.NativeEndian()
+	f := make([]byte, 24)
+	native.PutUint32(f[0:4], sid)
+	native.PutUint32(f[4:8], cid)
+	native.PutUint64(f[8:16], uint64(sockFd))
+	native.PutUint32(f[16:20], 1) // is_leading
+	return n.requestRetcode(iscsiUeventBindConn, f, nil)
+}
+
+func (n *iscsiNetlink) setParam(sid, cid uint32, p iscsiParam) error {
+	native := nl.NativeEndian()
+	value := append([]byte(p.value), 0)
+	f := make([]byte, 16)
+	native.PutUint32(f[0:4], sid)
+	native.PutUint32(f[4:8], cid)
+	native.PutUint32(f[8:12], p.id)
+	native.PutUint32(f[12:16], uint32(len(value)))
+	return n.requestRetcode(iscsiUeventSetParam, f, value)
+}
+
+func (n *iscsiNetlink) startConn(sid, cid uint32) error {
+	native := nl.NativeEndian()
+	f := make([]byte, 8)
+	native.PutUint32(f[0:4], sid)
+	native.PutUint32(f[4:8], cid)
+	return n.requestRetcode(iscsiUeventStartConn, f, nil)
+}
+
+// handOver passes the logged in connection to the kernel iscsi_tcp driver that continues the session
+// in the full feature phase. It returns the SCSI host number of the session.
+func (l *iscsiLogin) handOver(sockFd int) (uint32, error) {
+	n, err := openIscsiNetlink()
+	if err != nil {
+		return 0, err
+	}
+	defer n.Close()
+
+	sid, hostNo, err := n.createSession(l.expCmdSN)
+	if err != nil {
+		return 0, fmt.Errorf("create session: %v", err)
+	}
+	cid, err := n.createConn(sid)
+	if err != nil {
+		return 0, fmt.Errorf("create connection: %v", err)
+	}
+	if err := n.bindConn(sid, cid, sockFd); err != nil {
+		return 0, fmt.Errorf("bind connection: %v", err)
+	}
+	for _, p := range l.kernelParams() {
+		if err := n.setParam(sid, cid, p); err != nil && !errors.Is(err, unix.ENOSYS) {
+			return 0, fmt.Errorf("set session param %d: %v", p.id, err)
+		}
+	}
+	if err := n.startConn(sid, cid); err != nil {
+		return 0, fmt.Errorf("start connection: %v", err)
+	}
+	return hostNo, nil
+}
+
+func loginIscsiNativeOnce(t *iscsiTarget) (uint32, error) {
+	conn, err := net.DialTimeout("tcp", t.portal(), 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	l := &iscsiLogin{t: t, conn: conn, cmdSN: 1}
+	if err := l.login(); err != nil {
+		return 0, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	// kernel requires a blocking socket, File() returns a duplicated descriptor that we can safely switch to blocking mode
+	sock, err := conn.(*net.TCPConn).File()
+	if err != nil {
+		return 0, err
+	}
+	defer sock.Close()
+	if err := unix.SetNonblock(int(sock.Fd()), false); err != nil {
+		return 0, err
+	}
+	return l.handOver(int(sock.Fd()))
+}
+
+// isIscsiNativeTransientError checks whether the login might succeed later, e.g. once the network is configured
+func isIscsiNativeTransientError(err error) bool {
+	var loginErr *iscsiLoginError
+	if errors.As(err, &loginErr) {
+		return loginErr.transient()
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return isTransientNetworkError(err) || errors.Is(err, io.EOF) || errors.Is(err, unix.ECONNRESET)
+}
+
+// loginIscsiNative logs in to the target without open-iscsi tools and scans the SCSI host for the target LUNs.
+func loginIscsiNative(t *iscsiTarget) error {
+	info("iscsi: logging in to target %s at %s as %s", t.name, t.portal(), t.initiator)
+	deadline := time.Now().Add(iscsiConnectTimeout)
+	for {
+		hostNo, err := loginIscsiNativeOnce(t)
+		if err == nil {
+			info("iscsi: logged in to target %s, scsi host%d", t.name, hostNo)
+			// scan all the LUNs of the target, the same as iscsistart does
+			scan := fmt.Sprintf("/sys/class/scsi_host/host%d/scan", hostNo)
+			return os.WriteFile(scan, []byte("- - -"), 0o200)
+		}
+		if !isIscsiNativeTransientError(err) {
+			return fmt.Errorf("iscsi: login to target %s at %s failed: %v", t.name, t.portal(), err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("iscsi: unable to login to target %s at %s after %v: %v", t.name, t.portal(), iscsiConnectTimeout, err)
+		}
+		debug("iscsi: login to %s: %v, retrying", t.portal(), err)
+		time.Sleep(2 * time.Second)
+	}
+}
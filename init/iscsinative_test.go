@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeIscsiTarget answers login requests the way a target with CHAP authentication does it
+type fakeIscsiTarget struct {
+	conn       net.Conn
+	username   string
+	password   string
+	inUsername string
+	inPassword string
+	statSN     uint32
+	requests   []map[string]string
+}
+
+func (f *fakeIscsiTarget) readRequest() ([]byte, map[string]string, error) {
+	hdr := make([]byte, iscsiBhsSize)
+	if _, err := io.ReadFull(f.conn, hdr); err != nil {
+		return nil, nil, err
+	}
+	dataLen := int(hdr[5])<<16 | int(hdr[6])<<8 | int(hdr[7])
+	data := make([]byte, dataLen+(-dataLen&3))
+	if _, err := io.ReadFull(f.conn, data); err != nil {
+		return nil, nil, err
+	}
+	keys := parseIscsiKeys(data[:dataLen])
+	f.requests = append(f.requests, keys)
+	return hdr, keys, nil
+}
+
+func (f *fakeIscsiTarget) respond(req []byte, transit bool, status uint16, keys ...string) error {
+	data := encodeIscsiKeys(keys)
+	hdr := make([]byte, iscsiBhsSize)
+	hdr[0] = iscsiOpLoginResp
+	hdr[1] = req[1] & 0x0c
+	if transit {
+		hdr[1] |= req[1] & (iscsiFlagTransit | 0x03)
+		if req[1]&0x03 == iscsiStageFullFeature {
+			binary.BigEndian.PutUint16(hdr[14:16], 7) // TSIH
+		}
+	}
+	hdr[5], hdr[6], hdr[7] = byte(len(data)>>16), byte(len(data)>>8), byte(len(data))
+	copy(hdr[8:14], req[8:14])
+	binary.BigEndian.PutUint32(hdr[24:28], f.statSN)
+	binary.BigEndian.PutUint32(hdr[28:32], binary.BigEndian.Uint32(req[24:28]))
+	binary.BigEndian.PutUint16(hdr[36:38], status)
+	f.statSN++
+	data = append(data, make([]byte, -len(data)&3)...)
+	_, err := f.conn.Write(append(hdr, data...))
+	return err
+}
+
+func (f *fakeIscsiTarget) serve() error {
+	req, keys, err := f.readRequest()
+	if err != nil {
+		return err
+	}
+	if f.username == "" {
+		if err := f.respond(req, true, 0, "AuthMethod=None", "TargetPortalGroupTag=3"); err != nil {
+			return err
+		}
+	} else {
+		if keys["AuthMethod"] != "CHAP" && keys["AuthMethod"] != "CHAP,None" {
+			return f.respond(req, false, 0x0201)
+		}
+		if err := f.respond(req, false, 0, "AuthMethod=CHAP", "TargetPortalGroupTag=3"); err != nil {
+			return err
+		}
+
+		req, _, err = f.readRequest()
+		if err != nil {
+			return err
+		}
+		challenge := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+		if err := f.respond(req, false, 0, "CHAP_A=5", "CHAP_I=42", "CHAP_C=0x"+hex.EncodeToString(challenge)); err != nil {
+			return err
+		}
+
+		req, keys, err = f.readRequest()
+		if err != nil {
+			return err
+		}
+		expected := "0x" + hex.EncodeToString(chapResponse(42, f.password, challenge))
+		if keys["CHAP_N"] != f.username || keys["CHAP_R"] != expected {
+			return f.respond(req, false, 0x0201)
+		}
+		var resp []string
+		if f.inUsername != "" {
+			id, _ := strconv.Atoi(keys["CHAP_I"])
+			c, _ := decodeChapValue(keys["CHAP_C"])
+			resp = []string{"CHAP_N=" + f.inUsername, "CHAP_R=0x" + hex.EncodeToString(chapResponse(byte(id), f.inPassword, c))}
+		}
+		if err := f.respond(req, true, 0, resp...); err != nil {
+			return err
+		}
+	}
+
+	req, _, err = f.readRequest()
+	if err != nil {
+		return err
+	}
+	return f.respond(req, true, 0, "HeaderDigest=None", "DataDigest=None", "InitialR2T=Yes", "ImmediateData=Yes",
+		"MaxBurstLength=262144", "FirstBurstLength=65536", "MaxRecvDataSegmentLength=65536")
+}
+
+func testIscsiLogin(t *testing.T, target iscsiTarget, fake *fakeIscsiTarget) (*iscsiLogin, error) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	fake.conn = c2
+	go func() { _ = fake.serve() }()
+
+	l := &iscsiLogin{t: &target, conn: c1, cmdSN: 1}
+	return l, l.login()
+}
+
+func TestIscsiNativeLogin(t *testing.T) {
+	target := iscsiTarget{initiator: "iqn.2021-01.org.example:client", name: "iqn.2009-06.com.example:disk1", address: "10.0.2.2", port: 3260, group: 1}
+
+	l, err := testIscsiLogin(t, target, &fakeIscsiTarget{})
+	require.NoError(t, err)
+	require.Equal(t, uint16(7), l.tsih)
+	require.Equal(t, "3", l.intKey("TargetPortalGroupTag", 1))
+	params := map[uint32]string{}
+	for _, p := range l.kernelParams() {
+		params[p.id] = p.value
+	}
+	require.Equal(t, "65536", params[iscsiParamMaxXmitDLength])
+	require.Equal(t, "1", params[iscsiParamInitialR2TEn])
+	require.Equal(t, "262144", params[iscsiParamMaxBurst])
+	require.Equal(t, "2", params[iscsiParamExpStatSN])
+	require.Equal(t, "3", params[iscsiParamTpgt])
+}
+
+func TestIscsiNativeLoginChap(t *testing.T) {
+	target := iscsiTarget{initiator: "iqn.2021-01.org.example:client", name: "iqn.2009-06.com.example:disk1", address: "10.0.2.2", port: 3260, group: 1}
+
+	target.username, target.password = "user", "secret"
+	fake := &fakeIscsiTarget{username: "user", password: "secret"}
+	_, err := testIscsiLogin(t, target, fake)
+	require.NoError(t, err)
+	require.Equal(t, "CHAP,None", fake.requests[0]["AuthMethod"])
+	require.Equal(t, "iqn.2021-01.org.example:client", fake.requests[0]["InitiatorName"])
+
+	// mutual CHAP
+	target.inUsername, target.inPassword = "target", "tsecret"
+	_, err = testIscsiLogin(t, target, &fakeIscsiTarget{username: "user", password: "secret", inUsername: "target", inPassword: "tsecret"})
+	require.NoError(t, err)
+	_, err = testIscsiLogin(t, target, &fakeIscsiTarget{username: "user", password: "secret", inUsername: "target", inPassword: "wrong"})
+	require.ErrorContains(t, err, "mutual CHAP")
+
+	// wrong password
+	target.inUsername, target.inPassword = "", ""
+	target.password = "wrong"
+	_, err = testIscsiLogin(t, target, &fakeIscsiTarget{username: "user", password: "secret"})
+	require.Equal(t, &iscsiLoginError{2, 1}, err)
+	require.False(t, isIscsiNativeTransientError(err))
+
+	// the target requires authentication
+	target.username, target.password = "", ""
+	_, err = testIscsiLogin(t, target, &fakeIscsiTarget{username: "user", password: "secret"})
+	require.Error(t, err)
+}
+
+func TestChapValue(t *testing.T) {
+	v, err := decodeChapValue("0x0102ff")
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 0xff}, v)
+	v, err = decodeChapValue("0bAQL/")
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 0xff}, v)
+	_, err = decodeChapValue("0102")
+	require.Error(t, err)
+
+	// RFC 1994 MD5 over id, secret and challenge
+	require.Equal(t, "afd81c66f2d5f7fc733e1b2d88bb2630", hex.EncodeToString(chapResponse(1, "secret", []byte{1, 2, 3, 4})))
+}
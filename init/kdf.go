@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anatol/luks.go"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Volumes are unlocked concurrently so the boot time is bounded by the slowest volume rather than the sum. KDF computation
+// is CPU and memory heavy (argon2 might use gigabytes of memory) so the number of keyslots checked at the same time is
+// limited with booster.unlock_jobs=.
+var (
+	unlockJobs     = runtime.NumCPU()
+	unlockJobsSem  chan struct{}
+	unlockJobsOnce sync.Once
+)
+
+// kdfLowMemory allows to try keyslots that need more argon2 memory than available (booster.kdf_low_memory).
+// Such keyslots are unlocked one at a time after dropping the page cache, otherwise they are skipped.
+var kdfLowMemory bool
+
+// kdfMemory tracks argon2 memory reserved by the keyslots that are being checked at the moment. A keyslot waits
+// until its memory fits into memory available when the checks started, so concurrent unlocking does not end up with OOM killer.
+var kdfMemory struct {
+	sync.Mutex
+	cond  *sync.Cond
+	used  int // KiB
+	limit int // KiB, 0 if unknown
+}
+
+func init() {
+	kdfMemory.cond = sync.NewCond(&kdfMemory)
+}
+
+// reserveKdfMemory blocks until the given amount of memory (in KiB) can be used for key derivation
+func reserveKdfMemory(size int) (release func()) {
+	kdfMemory.Lock()
+	defer kdfMemory.Unlock()
+
+	for kdfMemory.used > 0 && kdfMemory.limit > 0 && kdfMemory.used+size > kdfMemory.limit {
+		kdfMemory.cond.Wait()
+	}
+	if kdfMemory.used == 0 {
+		kdfMemory.limit, _ = memAvailable()
+	}
+	kdfMemory.used += size
+
+	return func() {
+		kdfMemory.Lock()
+		kdfMemory.used -= size
+		kdfMemory.Unlock()
+		kdfMemory.cond.Broadcast()
+	}
+}
+
+// dropCaches frees the page cache to make more memory available for key derivation
+func dropCaches() {
+	if err := os.WriteFile("/proc/sys/vm/drop_caches", []byte("3"), 0o200); err != nil {
+		warning("unable to drop caches: %v", err)
+	}
+}
+
+// keyslotMemory returns amount of memory (in KiB) used by the keyslot key derivation
+func keyslotMemory(d luks.Device, slot int) int {
+	if d.Version() != 2 {
+		return 0
+	}
+	kdfs, err := readKeyslotKDFs(d.Path())
+	if err != nil {
+		return 0
+	}
+	kdf, ok := kdfs[slot]
+	if !ok || kdf.Type == "pbkdf2" {
+		return 0
+	}
+	return kdf.Memory
+}
+
+// unsealVolume tries the passphrase against the keyslot, it waits for a free unlock job slot
+// and for enough memory to derive the keyslot key first
+func unsealVolume(d luks.Device, slot int, password []byte) (*luks.Volume, error) {
+	unlockJobsOnce.Do(func() { unlockJobsSem = make(chan struct{}, unlockJobs) })
+	unlockJobsSem <- struct{}{}
+	defer func() { <-unlockJobsSem }()
+
+	if size := keyslotMemory(d, slot); size > 0 {
+		release := reserveKdfMemory(size)
+		defer release()
+		if available, err := memAvailable(); err == nil && size > available {
+			debug("%s: keyslot %d needs %d KiB of memory, %d KiB is available, dropping caches", d.Path(), slot, size, available)
+			dropCaches()
+		}
+	}
+	return d.UnsealVolume(slot, password)
+}
+
+// luks2KDF is a key derivation function description as it is stored in LUKS2 keyslot metadata
+type luks2KDF struct {
+	Type string `json:"type"` // pbkdf2, argon2i or argon2id
+	Salt string `json:"salt"` // base64
+
+	// pbkdf2 fields
+	Hash       string `json:"hash"`
+	Iterations int    `json:"iterations"`
+
+	// argon2 fields
+	Time   int `json:"time"`
+	Memory int `json:"memory"` // in KiB
+	Cpus   int `json:"cpus"`
+}
+
+func kdfHash(name string) (func() hash.Hash, error) {
+	switch name {
+	case "sha1":
+		return sha1.New, nil
+	case "sha256":
+		return sha256.New, nil
+	case "sha512":
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("unsupported pbkdf2 hash %s", name)
+	}
+}
+
+// validate checks the KDF parameters. argon2 implementation panics on some invalid parameters (e.g. zero cpus)
+// so they must be checked before a key is derived.
+func (k *luks2KDF) validate() error {
+	switch k.Type {
+	case "pbkdf2":
+		if _, err := kdfHash(k.Hash); err != nil {
+			return err
+		}
+		if k.Iterations < 1 {
+			return fmt.Errorf("invalid pbkdf2 iterations %d", k.Iterations)
+		}
+	case "argon2i", "argon2id":
+		if k.Time < 1 {
+			return fmt.Errorf("invalid %s time cost %d", k.Type, k.Time)
+		}
+		if k.Cpus < 1 || k.Cpus > 255 {
+			return fmt.Errorf("invalid %s parallelism %d", k.Type, k.Cpus)
+		}
+		// argon2 needs at least 8 KiB of memory per lane, cryptsetup limits memory to 4 GiB
+		if k.Memory < 8*k.Cpus || k.Memory > 4*1024*1024 {
+			return fmt.Errorf("invalid %s memory cost %d KiB", k.Type, k.Memory)
+		}
+	default:
+		return fmt.Errorf("unsupported kdf type %s", k.Type)
+	}
+	return nil
+}
+
+// deriveKey derives a key of the given length from the passphrase using this KDF
+func (k *luks2KDF) deriveKey(passphrase []byte, keyLength int) ([]byte, error) {
+	if err := k.validate(); err != nil {
+		return nil, err
+	}
+	salt, err := base64.StdEncoding.DecodeString(k.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kdf salt: %v", err)
+	}
+
+	switch k.Type {
+	case "pbkdf2":
+		h, _ := kdfHash(k.Hash)
+		return pbkdf2.Key(passphrase, salt, k.Iterations, keyLength, h), nil
+	case "argon2i":
+		return argon2.Key(passphrase, salt, uint32(k.Time), uint32(k.Memory), uint8(k.Cpus), uint32(keyLength)), nil
+	default: // argon2id
+		return argon2.IDKey(passphrase, salt, uint32(k.Time), uint32(k.Memory), uint8(k.Cpus), uint32(keyLength)), nil
+	}
+}
+
+// readKeyslotKDFs reads KDF parameters of LUKS2 keyslots
+func readKeyslotKDFs(path string) (map[int]*luks2KDF, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, jsonArea, err := readLuks2Header(f, 0)
+	if err != nil {
+		return nil, err
+	}
+	var metadata struct {
+		Keyslots map[string]struct {
+			KDF luks2KDF `json:"kdf"`
+		} `json:"keyslots"`
+	}
+	if err := json.Unmarshal(bytes.TrimRight(jsonArea, "\x00"), &metadata); err != nil {
+		return nil, err
+	}
+
+	kdfs := make(map[int]*luks2KDF)
+	for id, ks := range metadata.Keyslots {
+		slot, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keyslot id %s", id)
+		}
+		kdf := ks.KDF
+		kdfs[slot] = &kdf
+	}
+	return kdfs, nil
+}
+
+// memAvailable returns the amount of available memory in KiB
+func memAvailable() (int, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			return strconv.Atoi(fields[1])
+		}
+	}
+	return 0, fmt.Errorf("MemAvailable is not found in /proc/meminfo")
+}
+
+// unusableKeyslots checks KDF parameters of the device keyslots and returns the slots that cannot be unlocked.
+// Without this check a keyslot with KDF parameters booster cannot handle looks exactly like a wrong passphrase.
+func unusableKeyslots(d luks.Device) map[int]bool {
+	if d.Version() != 2 {
+		return nil
+	}
+	kdfs, err := readKeyslotKDFs(d.Path())
+	if err != nil {
+		warning("%s: unable to read keyslots kdf parameters: %v", d.Path(), err)
+		return nil
+	}
+	available, _ := memAvailable()
+
+	unusable := make(map[int]bool)
+	for slot, kdf := range kdfs {
+		if err := kdf.validate(); err != nil {
+			warning("%s: keyslot %d cannot be unlocked: %v", d.Path(), slot, err)
+			unusable[slot] = true
+			continue
+		}
+		if kdf.Type != "pbkdf2" && available > 0 && kdf.Memory > available {
+			warning("%s: keyslot %d requires %d KiB of memory for %s but only %d KiB is available", d.Path(), slot, kdf.Memory, kdf.Type, available)
+			if kdfLowMemory {
+				continue
+			}
+			// trying such keyslot gets booster killed by OOM killer in the middle of unlocking
+			console("Keyslot %d of %s needs %d MiB of memory to unlock but only %d MiB is available.\n"+
+				"Re-enroll the passphrase with a lower memory cost (cryptsetup luksConvertKey --pbkdf-memory), see 'booster benchmark-kdf',\n"+
+				"or boot with booster.kdf_low_memory to try it anyway.\n", slot, d.Path(), kdf.Memory/1024, available/1024)
+			unusable[slot] = true
+		}
+	}
+	return unusable
+}
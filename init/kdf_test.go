@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKDFDeriveKey(t *testing.T) {
+	check := func(kdf luks2KDF, keyLength int, expected string) {
+		key, err := kdf.deriveKey([]byte("password"), keyLength)
+		require.NoError(t, err)
+		require.Equal(t, expected, hex.EncodeToString(key))
+	}
+
+	// RFC 6070 test vector
+	check(luks2KDF{Type: "pbkdf2", Hash: "sha1", Iterations: 4096, Salt: "c2FsdA=="}, 20, "4b007901b765489abead49d926f721d065a429c1")
+	// argon2 vectors guard against mixing up the parameters order and the argon2 variants
+	check(luks2KDF{Type: "argon2id", Time: 2, Memory: 64, Cpus: 1, Salt: "c29tZXNhbHQ="}, 32, "16a1a498734609dd01456da406de9f3d9da93e6c86c300a12fc1465214ce4922")
+	check(luks2KDF{Type: "argon2i", Time: 2, Memory: 64, Cpus: 1, Salt: "c29tZXNhbHQ="}, 32, "989da65458e8be1440ae555d0b3c8ac3a6584e0d2290b9dcc915a68a71e41c1e")
+}
+
+func TestKDFValidate(t *testing.T) {
+	require.NoError(t, (&luks2KDF{Type: "pbkdf2", Hash: "sha256", Iterations: 1000}).validate())
+	require.NoError(t, (&luks2KDF{Type: "argon2id", Time: 4, Memory: 1048576, Cpus: 4}).validate())
+
+	require.Error(t, (&luks2KDF{Type: "pbkdf2", Hash: "whirlpool", Iterations: 1000}).validate())
+	require.Error(t, (&luks2KDF{Type: "pbkdf2", Hash: "sha256"}).validate())
+	require.Error(t, (&luks2KDF{Type: "argon2id", Time: 4, Memory: 1048576}).validate())
+	require.Error(t, (&luks2KDF{Type: "argon2id", Memory: 1048576, Cpus: 4}).validate())
+	require.Error(t, (&luks2KDF{Type: "argon2id", Time: 4, Memory: 16, Cpus: 4}).validate())
+	require.Error(t, (&luks2KDF{Type: "scrypt"}).validate())
+
+	_, err := (&luks2KDF{Type: "argon2id", Time: 1, Memory: 64, Cpus: 0, Salt: "c2FsdA=="}).deriveKey([]byte("password"), 32)
+	require.Error(t, err)
+}
+
+func TestReadKeyslotKDFs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "luks.img")
+	writeTestLuks2Header(t, path, `{"keyslots":{"0":{"type":"luks2","kdf":{"type":"argon2id","time":4,"memory":1048576,"cpus":4,"salt":"c2FsdA=="}},"2":{"type":"luks2","kdf":{"type":"pbkdf2","hash":"sha256","iterations":1000,"salt":"c2FsdA=="}}},"tokens":{},"config":{"json_size":"12288"}}`)
+
+	kdfs, err := readKeyslotKDFs(path)
+	require.NoError(t, err)
+	require.Len(t, kdfs, 2)
+	require.Equal(t, luks2KDF{Type: "argon2id", Time: 4, Memory: 1048576, Cpus: 4, Salt: "c2FsdA=="}, *kdfs[0])
+	require.Equal(t, luks2KDF{Type: "pbkdf2", Hash: "sha256", Iterations: 1000, Salt: "c2FsdA=="}, *kdfs[2])
+}
+
+func TestReserveKdfMemory(t *testing.T) {
+	available, err := memAvailable()
+	require.NoError(t, err)
+
+	// a reservation larger than available memory is allowed if nothing else runs
+	release := reserveKdfMemory(available * 2)
+
+	reserved := make(chan struct{})
+	go func() {
+		reserveKdfMemory(1024)()
+		close(reserved)
+	}()
+
+	select {
+	case <-reserved:
+		require.Fail(t, "memory is reserved while it is exhausted")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	select {
+	case <-reserved:
+	case <-time.After(time.Second):
+		require.Fail(t, "memory is not reserved after it is released")
+	}
+}
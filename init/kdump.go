@@ -0,0 +1,108 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Crash capture: an image built with 'booster build --kdump' is loaded as the kdump crash kernel initramfs.
+// It mounts the root filesystem (the dump target) the usual way, saves /proc/vmcore there and reboots the machine.
+
+const vmcorePath = "/proc/vmcore"
+
+// kdumpDir returns the directory where the crash dump is saved, every crash gets its own directory
+func kdumpDir(root, path string, now time.Time) string {
+	return filepath.Join(root, path, now.Format("2006-01-02-15:04:05"))
+}
+
+// saveVmcore copies the memory image of the crashed kernel to dir compressing it with gzip
+func saveVmcore(vmcore, dir string) (string, error) {
+	in, err := os.Open(vmcore)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out := filepath.Join(dir, "vmcore.gz")
+	// the dump is written under a temporary name so an interrupted copy is not mistaken for a complete one
+	f, err := os.OpenFile(out+".incomplete", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	w, err := gzip.NewWriterLevel(f, gzip.BestSpeed)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return out, os.Rename(out+".incomplete", out)
+}
+
+// saveVmcoreMakedumpfile filters and compresses the memory image with makedumpfile
+func saveVmcoreMakedumpfile(dir, args string) (string, error) {
+	out := filepath.Join(dir, "vmcore")
+	cmdArgs := append(strings.Fields(args), vmcorePath, out+".incomplete")
+	cmd := exec.Command("makedumpfile", cmdArgs...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("makedumpfile: %v", unwrapExitError(err))
+	}
+	return out, os.Rename(out+".incomplete", out)
+}
+
+// kdump saves the crash dump to the mounted root filesystem
+func kdump() error {
+	if _, err := os.Stat(vmcorePath); err != nil {
+		return fmt.Errorf("%s is not available, the image is not booted as a crash kernel", vmcorePath)
+	}
+
+	// root is often mounted read-only at the first stage of the boot
+	if err := unix.Mount("", newRoot, "", unix.MS_REMOUNT, ""); err != nil {
+		debug("unable to remount %s read-write: %v", newRoot, err)
+	}
+
+	dir := kdumpDir(newRoot, config.Kdump.Path, time.Now())
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	info("saving the crash dump to %s", strings.TrimPrefix(dir, newRoot))
+
+	var out string
+	var err error
+	if config.Kdump.Makedumpfile != "" {
+		out, err = saveVmcoreMakedumpfile(dir, config.Kdump.Makedumpfile)
+	} else {
+		out, err = saveVmcore(vmcorePath, dir)
+	}
+	if err != nil {
+		return err
+	}
+	info("the crash dump is saved to %s", strings.TrimPrefix(out, newRoot))
+	return nil
+}
+
+// kdumpReboot releases the dump target and restarts the machine
+func kdumpReboot() error {
+	unix.Sync()
+	if err := unix.Unmount(newRoot, 0); err != nil {
+		debug("unable to unmount %s: %v", newRoot, err)
+	}
+	return unix.Reboot(unix.LINUX_REBOOT_CMD_RESTART)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKdumpDir(t *testing.T) {
+	now := time.Date(2023, 7, 14, 9, 5, 3, 0, time.UTC)
+	require.Equal(t, "/booster.root/var/crash/2023-07-14-09:05:03", kdumpDir("/booster.root", "/var/crash", now))
+}
+
+func TestSaveVmcore(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("ELF core"), 4096)
+	vmcore := filepath.Join(dir, "vmcore")
+	require.NoError(t, os.WriteFile(vmcore, content, 0o400))
+
+	out, err := saveVmcore(vmcore, dir)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "vmcore.gz"), out)
+	require.NoFileExists(t, out+".incomplete")
+
+	f, err := os.Open(out)
+	require.NoError(t, err)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, content, data)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Kexec handoff: once the root filesystem is mounted booster loads a kernel stored at the root filesystem
+// and jumps into it. It lets A/B update schemes keep only a stub kernel at the boot partition.
+
+var (
+	kexecKernel  string // path to the kernel image at the root filesystem, handoff is disabled if empty
+	kexecInitrd  string // path to the initramfs at the root filesystem
+	kexecCmdline string // command line for the new kernel, the current one is reused if not specified
+)
+
+// kexecCommandLine removes booster.kexec* parameters from the command line, otherwise the next booster
+// instance would kexec again
+func kexecCommandLine(cmdline string) string {
+	var params []string
+	for i := 0; i < len(cmdline); {
+		var key, value string
+		key, value, i = getNextParam(cmdline, i)
+		if key == "" || strings.HasPrefix(key, "booster.kexec") {
+			continue
+		}
+		param := key
+		if value != "" {
+			if strings.ContainsAny(value, " \t") {
+				value = `"` + value + `"`
+			}
+			param += "=" + value
+		}
+		params = append(params, param)
+	}
+	return strings.Join(params, " ")
+}
+
+// kexecLoad loads the kernel from the mounted root filesystem
+func kexecLoad() error {
+	kernel, err := os.Open(filepath.Join(newRoot, kexecKernel))
+	if err != nil {
+		return err
+	}
+	defer kernel.Close()
+
+	initrdFd := -1
+	var flags int
+	if kexecInitrd != "" {
+		initrd, err := os.Open(filepath.Join(newRoot, kexecInitrd))
+		if err != nil {
+			return err
+		}
+		defer initrd.Close()
+		initrdFd = int(initrd.Fd())
+	} else {
+		flags |= unix.KEXEC_FILE_NO_INITRAMFS
+	}
+
+	cmdline := kexecCmdline
+	if cmdline == "" {
+		data, err := os.ReadFile("/proc/cmdline")
+		if err != nil {
+			return err
+		}
+		cmdline = kexecCommandLine(string(data))
+	}
+
+	info("loading kernel %s, initrd %s, cmdline %q", kexecKernel, kexecInitrd, cmdline)
+	if err := unix.KexecFileLoad(int(kernel.Fd()), initrdFd, cmdline, flags); err != nil {
+		return fmt.Errorf("kexec_file_load: %v", err)
+	}
+	return nil
+}
+
+// kexecReboot releases the root filesystem and jumps into the loaded kernel
+func kexecReboot() error {
+	unix.Sync()
+	if err := unix.Unmount(newRoot, 0); err != nil {
+		debug("unable to unmount %s: %v, remounting it read-only", newRoot, err)
+		if err := unix.Mount("", newRoot, "", unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+			warning("unable to remount %s read-only: %v", newRoot, err)
+		}
+	}
+	info("jumping into the new kernel")
+	return unix.Reboot(unix.LINUX_REBOOT_CMD_KEXEC)
+}
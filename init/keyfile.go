@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anatol/luks.go"
+	"golang.org/x/sys/unix"
+)
+
+// A keyfile might be located in the image or at a removable device (e.g. a USB stick) that is mounted read-only for
+// the time of reading the key. The keyfile is specified with rd.luks.key= boot param in systemd format
+// rd.luks.key=$LUKS_UUID=$PATH[:$KEYDEV] or in dracut format rd.luks.key=$PATH[:$KEYDEV[:$LUKSDEV]], or with
+// luks_keyfiles config option that also allows to specify the offset and size of the key within the file.
+
+// luksKeyfile describes where the key of a LUKS volume is located
+type luksKeyfile struct {
+	path       string
+	device     *deviceRef // device with the keyfile, nil if the keyfile is in the image
+	deviceName string     // the device as specified by the user, e.g. LABEL=keys
+	offset     int64
+	size       int64 // zero means the key continues till the end of the file
+
+	deviceFound chan *blkInfo
+}
+
+// keyfileDeviceTimeout is the max time to wait for the device with the keyfile before asking for the passphrase
+const keyfileDeviceTimeout = 30 * time.Second
+
+// keyfileMaxSize is the max keyfile size, the same as cryptsetup default
+const keyfileMaxSize = 8 * 1024 * 1024
+
+var (
+	// configKeyfiles are keyfiles specified in the image config, LUKS UUID -> keyfile
+	configKeyfiles = make(map[string]*luksKeyfile)
+
+	keyfilesMutex sync.Mutex
+	keyfiles      []*luksKeyfile // keyfiles located at devices, used to match the devices when they appear
+
+	keyfileMountDir = "/run/booster/keyfile"
+	keyfileMountNum int
+)
+
+func newLuksKeyfile(path, device string, offset, size int64) (*luksKeyfile, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("keyfile path %s should be absolute", path)
+	}
+	if offset < 0 || size < 0 || size > keyfileMaxSize {
+		return nil, fmt.Errorf("invalid keyfile offset or size")
+	}
+	k := &luksKeyfile{path: path, offset: offset, size: size}
+	if device != "" {
+		ref, err := parseDeviceRef(device)
+		if err != nil {
+			return nil, err
+		}
+		k.device = ref
+		k.deviceName = device
+		k.deviceFound = make(chan *blkInfo, 1)
+
+		keyfilesMutex.Lock()
+		keyfiles = append(keyfiles, k)
+		keyfilesMutex.Unlock()
+	}
+	return k, nil
+}
+
+// parseLuksKeyParam parses rd.luks.key= value. It returns the UUID of the LUKS volume or nil if the param does not
+// specify the volume.
+func parseLuksKeyParam(value string) (UUID, *luksKeyfile, error) {
+	var uuid UUID
+	var path, device string
+	if strings.HasPrefix(value, "/") {
+		// dracut format: $PATH[:$KEYDEV[:$LUKSDEV]]
+		parts := strings.SplitN(value, ":", 3)
+		path = parts[0]
+		if len(parts) > 1 {
+			device = parts[1]
+		}
+		if len(parts) > 2 {
+			luksDev := parts[2]
+			luksDev = strings.TrimPrefix(luksDev, "UUID=")
+			luksDev = strings.TrimPrefix(luksDev, "luks-")
+			u, err := parseUUID(luksDev)
+			if err != nil {
+				return nil, nil, fmt.Errorf("LUKS device %s: %v", parts[2], err)
+			}
+			uuid = u
+		}
+	} else {
+		// systemd format: $LUKS_UUID=$PATH[:$KEYDEV]
+		luksUUID, keyfile, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, nil, fmt.Errorf("expected format is $UUID=$PATH[:$KEYDEV] or $PATH[:$KEYDEV[:$LUKSDEV]]")
+		}
+		u, err := parseUUID(luksUUID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid UUID %s: %v", luksUUID, err)
+		}
+		uuid = u
+		path, device, _ = strings.Cut(keyfile, ":")
+	}
+
+	k, err := newLuksKeyfile(path, device, 0, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return uuid, k, nil
+}
+
+// applyConfigKeyfiles reads luks_keyfiles option of the image config
+func applyConfigKeyfiles() error {
+	for _, c := range config.LuksKeyfiles {
+		u, err := parseUUID(strings.TrimPrefix(c.Volume, "UUID="))
+		if err != nil {
+			return fmt.Errorf("luks_keyfiles: volume %s: %v", c.Volume, err)
+		}
+		k, err := newLuksKeyfile(c.Path, c.Device, c.Offset, c.Size)
+		if err != nil {
+			return fmt.Errorf("luks_keyfiles: volume %s: %v", c.Volume, err)
+		}
+		configKeyfiles[u.toString()] = k
+	}
+	return nil
+}
+
+// volumeKeyfile returns the keyfile of the volume, rd.luks.key= takes precedence over the image config
+func volumeKeyfile(mapping *luksMapping, d luks.Device) *luksKeyfile {
+	if mapping.keyfile != nil {
+		return mapping.keyfile
+	}
+	if u, err := parseUUID(d.UUID()); err == nil {
+		return configKeyfiles[u.toString()]
+	}
+	return nil
+}
+
+// matchKeyfileDevices notifies keyfiles located at the block device
+func matchKeyfileDevices(blk *blkInfo) {
+	keyfilesMutex.Lock()
+	defer keyfilesMutex.Unlock()
+	for _, k := range keyfiles {
+		if blk.matchesRef(k.device) {
+			// the latest matching device wins, the previous one might have been removed
+			select {
+			case <-k.deviceFound:
+			default:
+			}
+			select {
+			case k.deviceFound <- blk:
+			default:
+			}
+		}
+	}
+}
+
+func (k *luksKeyfile) String() string {
+	if k.device == nil {
+		return k.path
+	}
+	return k.path + " at " + k.deviceName
+}
+
+// read reads the key, if the keyfile is located at a device then the device is awaited and mounted read-only
+func (k *luksKeyfile) read() ([]byte, error) {
+	var key []byte
+	err := k.withFile(keyfileDeviceTimeout, func(path string) error {
+		var err error
+		key, err = readKeyfileData(path, k.offset, k.size)
+		return err
+	})
+	if err == nil {
+		measure("keyfile "+k.String(), []byte(k.String())) // the location only, the key itself is secret
+	}
+	return key, err
+}
+
+// awaitDevice waits for the device with the file, zero timeout means waiting forever
+func (k *luksKeyfile) awaitDevice(timeout time.Duration) (*blkInfo, error) {
+	var timeoutCh <-chan time.Time
+	if timeout != 0 {
+		timeoutCh = time.After(timeout)
+	}
+	for {
+		select {
+		case blk := <-k.deviceFound:
+			if _, err := os.Stat(blk.path); err != nil {
+				// the device has been removed, wait till it is plugged in again
+				continue
+			}
+			// keep it for the next reads unless a new device has been found in the meantime
+			select {
+			case k.deviceFound <- blk:
+			default:
+			}
+			return blk, nil
+		case <-timeoutCh:
+			return nil, fmt.Errorf("timeout waiting for device %s", k.deviceName)
+		}
+	}
+}
+
+// withFile calls fn with the path of the file. If the file is located at a device then the device is awaited
+// and mounted read-only for the time of running fn. If the device is removed in the meantime then it is awaited again.
+func (k *luksKeyfile) withFile(timeout time.Duration, fn func(path string) error) error {
+	if k.device == nil {
+		return fn(k.path)
+	}
+
+	for {
+		blk, err := k.awaitDevice(timeout)
+		if err != nil {
+			return err
+		}
+
+		keyfilesMutex.Lock()
+		keyfileMountNum++
+		dir := fmt.Sprintf("%s%d", keyfileMountDir, keyfileMountNum)
+		keyfilesMutex.Unlock()
+
+		err = withReadOnlyMount(blk, dir, func() error {
+			return fn(filepath.Join(dir, k.path))
+		})
+		if _, statErr := os.Stat(blk.path); err == nil || statErr == nil {
+			return err
+		}
+		console("Device %s has been removed, please insert it again\n", k.deviceName)
+	}
+}
+
+func readKeyfileData(path string, offset, size int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		size = keyfileMaxSize
+	}
+	key, err := io.ReadAll(io.LimitReader(f, size))
+	if err != nil {
+		memZeroBytes(key)
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("the key is empty")
+	}
+	return key, nil
+}
+
+// withReadOnlyMount mounts the filesystem read-only at dir for the time of running fn
+func withReadOnlyMount(blk *blkInfo, dir string, fn func() error) error {
+	fstype := blk.format
+	if fstype == "fat" {
+		fstype = "vfat" // e.g. a file stored at ESP or a USB stick
+	}
+	wg := loadModules(fstype)
+	wg.Wait()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := mount(blk.path, dir, fstype, unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return err
+	}
+	defer func() {
+		if err := unix.Unmount(dir, 0); err != nil {
+			warning("unmounting %s: %v", dir, err)
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLuksKeyParam(t *testing.T) {
+	const luksUUID = "2a9f1e2c-4ba5-4c1c-8b66-3d1e1c7f6d2a"
+
+	uuid, k, err := parseLuksKeyParam(luksUUID + "=/etc/root.key")
+	require.NoError(t, err)
+	require.Equal(t, luksUUID, uuid.toString())
+	require.Equal(t, "/etc/root.key", k.path)
+	require.Nil(t, k.device)
+
+	uuid, k, err = parseLuksKeyParam(luksUUID + "=/root.key:LABEL=keys")
+	require.NoError(t, err)
+	require.Equal(t, luksUUID, uuid.toString())
+	require.Equal(t, "/root.key", k.path)
+	require.Equal(t, &deviceRef{refFsLabel, "keys"}, k.device)
+	require.Equal(t, "/root.key at LABEL=keys", k.String())
+
+	// dracut format
+	uuid, k, err = parseLuksKeyParam("/root.key:UUID=8fba3c8a-3ef6-4a45-a9f4-0f1b2f5e9d10:UUID=" + luksUUID)
+	require.NoError(t, err)
+	require.Equal(t, luksUUID, uuid.toString())
+	require.Equal(t, refFsUUID, k.device.format)
+
+	uuid, k, err = parseLuksKeyParam("/root.key:LABEL=keys")
+	require.NoError(t, err)
+	require.Nil(t, uuid)
+	require.Equal(t, "/root.key", k.path)
+
+	_, _, err = parseLuksKeyParam("foo=/root.key")
+	require.Error(t, err)
+	_, _, err = parseLuksKeyParam(luksUUID + "=root.key")
+	require.Error(t, err)
+	_, _, err = parseLuksKeyParam("/root.key:LABEL=keys:foo")
+	require.Error(t, err)
+}
+
+func TestReadKeyfileData(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(file, []byte("headerSECRETtrailer"), 0o600))
+
+	key, err := readKeyfileData(file, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, "headerSECRETtrailer", string(key))
+
+	key, err = readKeyfileData(file, 6, 6)
+	require.NoError(t, err)
+	require.Equal(t, "SECRET", string(key))
+
+	_, err = readKeyfileData(file, 100, 0)
+	require.Error(t, err)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anatol/luks.go"
+	"golang.org/x/sys/unix"
+)
+
+// booster.key_source=fifo:/run/booster.key or booster.key_source=socket:/run/booster.sock lets an external agent
+// (e.g. a network unlock service started in the initramfs) pass the passphrase to booster. Booster creates the endpoint,
+// waits for the passphrase and tries it against the passphrase keyslots. If nothing arrives within
+// booster.key_source_timeout or the passphrase does not match then booster falls back to the console prompt.
+// The passphrase ends with a newline or when the agent closes the endpoint.
+
+type keySource struct {
+	kind string // "fifo" or "socket"
+	path string
+}
+
+var (
+	keySrc           *keySource
+	keySourceTimeout = 2 * time.Minute
+	keySourceMutex   sync.Mutex // volumes read passphrases from the endpoint one by one
+)
+
+const keySourceMaxSize = 8192
+
+var errKeySourceClosed = errors.New("the endpoint is closed without a passphrase")
+
+func parseKeySource(value string) (*keySource, error) {
+	kind, path, ok := strings.Cut(value, ":")
+	if !ok || !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("expected format is fifo:/path or socket:/path")
+	}
+	if kind != "fifo" && kind != "socket" {
+		return nil, fmt.Errorf("unknown key source type '%s'", kind)
+	}
+	return &keySource{kind: kind, path: path}, nil
+}
+
+func (ks *keySource) String() string {
+	return ks.kind + ":" + ks.path
+}
+
+// readKey waits for a passphrase at the endpoint
+func (ks *keySource) readKey(timeout time.Duration) ([]byte, error) {
+	keySourceMutex.Lock()
+	defer keySourceMutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(ks.path), 0o755); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	if ks.kind == "socket" {
+		return readKeySocket(ks.path, deadline)
+	}
+	return readKeyFifo(ks.path, deadline)
+}
+
+func readKeyFifo(path string, deadline time.Time) ([]byte, error) {
+	if err := unix.Mkfifo(path, 0o600); err != nil && !errors.Is(err, fs.ErrExist) {
+		return nil, err
+	}
+	st, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if st.Mode()&fs.ModeNamedPipe == 0 {
+		return nil, fmt.Errorf("%s is not a fifo", path)
+	}
+
+	for {
+		// non-blocking open does not wait for a writer, the data is awaited with poll() instead
+		fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, err
+		}
+		key, err := readKeyLine(&fifoReader{fd: fd, deadline: deadline})
+		unix.Close(fd)
+		if err == errKeySourceClosed {
+			// a writer opened and closed the fifo without writing anything, wait for the next one
+			continue
+		}
+		return key, err
+	}
+}
+
+// fifoReader reads from a non-blocking fifo until the deadline
+type fifoReader struct {
+	fd       int
+	deadline time.Time
+}
+
+func (r *fifoReader) Read(buf []byte) (int, error) {
+	for {
+		remaining := time.Until(r.deadline)
+		if remaining <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		fds := []unix.PollFd{{Fd: int32(r.fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, int(remaining.Milliseconds())+1)
+		if err == unix.EINTR || n == 0 {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		n, err = unix.Read(r.fd, buf)
+		if err == unix.EAGAIN {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, io.EOF // the writer closed the fifo
+		}
+		return n, nil
+	}
+}
+
+func readKeySocket(path string, deadline time.Time) ([]byte, error) {
+	_ = os.Remove(path) // a stale socket from the previous read
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close() // removes the socket file
+
+	if err := l.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	return readKeyLine(conn)
+}
+
+// readKeyLine reads the passphrase up to the first newline or EOF
+func readKeyLine(r io.Reader) ([]byte, error) {
+	key := make([]byte, 0, keySourceMaxSize)
+	buf := make([]byte, 512)
+	defer memZeroBytes(buf)
+
+	for {
+		n, err := r.Read(buf)
+		key = append(key, buf[:n]...)
+		if idx := bytes.IndexByte(key, '\n'); idx != -1 {
+			memZeroBytes(key[idx:])
+			key = bytes.TrimSuffix(key[:idx], []byte{'\r'})
+			break
+		}
+		if len(key) > keySourceMaxSize {
+			memZeroBytes(key)
+			return nil, fmt.Errorf("the passphrase is longer than %d bytes", keySourceMaxSize)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			memZeroBytes(key)
+			return nil, err
+		}
+	}
+
+	if len(key) == 0 {
+		return nil, errKeySourceClosed
+	}
+	return key, nil
+}
+
+// recoverKeySourcePassword tries to unlock the volume with a passphrase received from booster.key_source endpoint
+func recoverKeySourcePassword(volumes chan *luks.Volume, d luks.Device, checkSlots []int, mappingName string) error {
+	info("%s: waiting %v for a passphrase at %s", mappingName, keySourceTimeout, keySrc)
+	password, err := keySrc.readKey(keySourceTimeout)
+	if err != nil {
+		return fmt.Errorf("key_source %s: %w", keySrc, err)
+	}
+	defer memZeroBytes(password)
+
+	for _, s := range checkSlots {
+		v, err := unsealVolume(d, s, password)
+		if err == luks.ErrPassphraseDoesNotMatch {
+			continue
+		} else if err != nil {
+			warning("unlocking slot %v: %v", s, err)
+			continue
+		}
+		if tpmAutoReseal {
+			adviseTPM2Reenroll(d)
+		}
+		unlockRecords.Store(v, passphraseUnlockRecord(d, s))
+		volumes <- v
+		return nil
+	}
+	return fmt.Errorf("key_source %s: %w", keySrc, luks.ErrPassphraseDoesNotMatch)
+}
+
+// removeKeySource removes the fifo so it does not stay at /run of the booted system
+func removeKeySource() {
+	if keySrc == nil || keySrc.kind != "fifo" {
+		return
+	}
+	if err := os.Remove(keySrc.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		warning("removing %s: %v", keySrc.path, err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeySourceFifo(t *testing.T) {
+	ks := &keySource{kind: "fifo", path: filepath.Join(t.TempDir(), "booster.key")}
+
+	go func() {
+		// wait till booster creates the fifo
+		for {
+			if _, err := os.Stat(ks.path); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		_ = os.WriteFile(ks.path, []byte("1234"), 0o600)
+	}()
+	key, err := ks.readKey(5 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "1234", string(key))
+
+	// the fifo stays in place, the next passphrase is a line
+	go func() { _ = os.WriteFile(ks.path, []byte("5678\nignored"), 0o600) }()
+	key, err = ks.readKey(5 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "5678", string(key))
+
+	_, err = ks.readKey(100 * time.Millisecond)
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestKeySourceSocket(t *testing.T) {
+	ks := &keySource{kind: "socket", path: filepath.Join(t.TempDir(), "booster.sock")}
+
+	go func() {
+		for {
+			conn, err := net.Dial("unix", ks.path)
+			if err != nil {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			_, _ = conn.Write([]byte("secret\r\n"))
+			_ = conn.Close()
+			return
+		}
+	}()
+	key, err := ks.readKey(5 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "secret", string(key))
+
+	_, err = ks.readKey(100 * time.Millisecond)
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Live media (e.g. an installer or rescue ISO) are booted with root=live:$DEVICE the same way as dracut dmsquash-live
+// module does it. The medium is mounted read-only and the root filesystem image $DIR/$IMAGE (rd.live.dir= and
+// rd.live.squashimg= params, LiveOS/squashfs.img by default) is attached to a loop device that becomes the root device.
+// If the squashfs image contains LiveOS/rootfs.img then that image is used as root. $DEVICE might also point to
+// a squashfs or erofs filesystem itself. Use booster.overlay= to make the root writable.
+
+const (
+	liveMediumDir   = "/run/initramfs/live"
+	liveSquashfsDir = "/run/initramfs/squashfs"
+)
+
+var (
+	liveMedium    *deviceRef // root=live:
+	liveDir       = "LiveOS"
+	liveSquashImg = "squashfs.img"
+
+	liveMediumMutex sync.Mutex
+	liveMediumFound bool
+)
+
+// handleLiveMedium finds the root filesystem image at the live medium and attaches it as the root device
+func handleLiveMedium(blk *blkInfo) error {
+	liveMediumMutex.Lock()
+	found := liveMediumFound
+	liveMediumFound = true
+	liveMediumMutex.Unlock()
+	if found {
+		// e.g. a hybrid ISO is seen both as the whole disk and its first partition
+		debug("live medium has been found already, ignore %s", blk.path)
+		return nil
+	}
+
+	if blk.format == "squashfs" || blk.format == "erofs" {
+		return setLiveRoot(blk.path)
+	}
+	if !blk.isFs {
+		return fmt.Errorf("live medium %s does not contain a filesystem", blk.path)
+	}
+
+	fstype, module := blk.format, blk.format
+	switch fstype {
+	case "fat":
+		fstype, module = "vfat", "vfat"
+	case "iso9660":
+		module = "isofs"
+	}
+	wg := loadModules(module, "loop")
+	wg.Wait()
+	info("mounting live medium %s, fs=%s", blk.path, fstype)
+	if err := mount(blk.path, liveMediumDir, fstype, unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV, ""); err != nil {
+		return err
+	}
+
+	image := filepath.Join(liveMediumDir, liveDir, liveSquashImg)
+	loopDev, err := setupLoopDevice(image)
+	if err != nil {
+		return fmt.Errorf("live image %s: %v", image, err)
+	}
+
+	// older live images keep the root filesystem image within squashfs
+	rootImg, err := findNestedRootImage(loopDev)
+	if err != nil {
+		return err
+	}
+	if rootImg != "" {
+		loopDev, err = setupLoopDevice(rootImg)
+		if err != nil {
+			return fmt.Errorf("live image %s: %v", rootImg, err)
+		}
+	}
+	return setLiveRoot(loopDev)
+}
+
+// findNestedRootImage returns LiveOS/rootfs.img located at the squashfs image or an empty string if it does not exist.
+// If the image exists then the squashfs stays mounted.
+func findNestedRootImage(dev string) (string, error) {
+	blk, err := readBlkInfo(dev)
+	if err != nil || blk.format != "squashfs" {
+		return "", nil
+	}
+	wg := loadModules("squashfs")
+	wg.Wait()
+	if err := mount(dev, liveSquashfsDir, "squashfs", unix.MS_RDONLY, ""); err != nil {
+		return "", err
+	}
+	image := filepath.Join(liveSquashfsDir, "LiveOS", "rootfs.img")
+	if _, err := os.Stat(image); err == nil {
+		return image, nil
+	}
+	if err := unix.Unmount(liveSquashfsDir, 0); err != nil {
+		return "", fmt.Errorf("unmount(%s): %v", liveSquashfsDir, err)
+	}
+	return "", nil
+}
+
+// setLiveRoot makes the device the root device and processes it
+func setLiveRoot(dev string) error {
+	info("using %s as the live root device", dev)
+	cmdRoot = &deviceRef{refPath, dev}
+	// the loop device might have been seen when it was empty
+	forgetBlockDevice(dev)
+	return addBlockDevice(dev, false, nil)
+}
+
+// setupLoopDevice attaches the file read-only to a free loop device and returns the device path
+func setupLoopDevice(file string) (string, error) {
+	backing, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer backing.Close()
+
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer ctl.Close()
+
+	for {
+		num, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return "", fmt.Errorf("get free loop device: %v", err)
+		}
+		dev := fmt.Sprintf("/dev/loop%d", num)
+		loop, err := os.OpenFile(dev, os.O_RDONLY, 0)
+		if err != nil {
+			return "", err
+		}
+		err = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(backing.Fd()))
+		if err == unix.EBUSY {
+			// the device has been taken in the meantime
+			_ = loop.Close()
+			continue
+		}
+		if err != nil {
+			_ = loop.Close()
+			return "", fmt.Errorf("%s: set fd: %v", dev, err)
+		}
+
+		loopInfo := unix.LoopInfo64{Flags: unix.LO_FLAGS_READ_ONLY}
+		copy(loopInfo.File_name[:len(loopInfo.File_name)-1], file)
+		if err := unix.IoctlLoopSetStatus64(int(loop.Fd()), &loopInfo); err != nil {
+			warning("%s: set status: %v", dev, err)
+		}
+		_ = loop.Close()
+		debug("attached %s to %s", file, dev)
+		return dev, nil
+	}
+}
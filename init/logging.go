@@ -2,10 +2,16 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 
 	"github.com/anatol/booster/init/quirk"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -23,12 +29,103 @@ var (
 	devKmsg *os.File
 )
 
+var levelNames = [...]string{levelError: "error", levelWarning: "warning", levelInfo: "info", levelDebug: "debug"}
+
+// logRecord is a structured log message. Records of all levels (regardless of the booster.log verbosity) are written
+// as JSON lines to logFilePath. /run is passed to the booted system so the boot log is available after the boot.
+type logRecord struct {
+	Monotonic uint64 `json:"monotonic_usec"` // CLOCK_MONOTONIC, the same clock as the kernel log timestamps
+	Level     string `json:"level"`
+	Subsystem string `json:"subsystem"` // source file name of the caller, e.g. 'network' or 'luks'
+	Message   string `json:"message"`
+}
+
+const maxBufferedLogRecords = 4096
+
+var (
+	logFilePath = "/run/booster/init.log"
+
+	logMutex    sync.Mutex
+	logFile     *os.File
+	logRecords  []logRecord // records logged before the log file is opened
+	droppedLogs int
+)
+
+// logSubsystem returns name of the source file that calls a logging function, skip is the number of
+// stack frames between logSubsystem and the logging function caller
+func logSubsystem(skip int) string {
+	_, file, _, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return "unknown"
+	}
+	return strings.TrimSuffix(filepath.Base(file), ".go")
+}
+
+// recordLog stores the record in memory or writes it to the log file if it is opened already
+func recordLog(level int, subsystem, msg string) {
+	now, _ := readClock(unix.CLOCK_MONOTONIC)
+	r := logRecord{Monotonic: now, Level: levelNames[level], Subsystem: subsystem, Message: msg}
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	if logFile == nil {
+		if len(logRecords) < maxBufferedLogRecords {
+			logRecords = append(logRecords, r)
+		} else {
+			droppedLogs++
+		}
+		return
+	}
+	writeLogRecord(r)
+}
+
+// writeLogRecord appends the record to the log file, logMutex must be held
+func writeLogRecord(r logRecord) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	if _, err := logFile.Write(append(data, '\n')); err != nil {
+		// do not use the logging functions here to avoid recursion
+		fmt.Printf("%s: %v\n", logFilePath, err)
+		logFile.Close()
+		logFile = nil
+	}
+}
+
+// openLogFile opens the log file once /run is mounted and writes the records buffered so far
+func openLogFile() error {
+	if err := os.MkdirAll(filepath.Dir(logFilePath), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(logFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	logFile = f
+	for _, r := range logRecords {
+		writeLogRecord(r)
+	}
+	if droppedLogs > 0 {
+		writeLogRecord(logRecord{Level: levelNames[levelWarning], Subsystem: "logging", Message: fmt.Sprintf("%d log records are dropped", droppedLogs)})
+	}
+	logRecords, droppedLogs = nil, 0
+	return nil
+}
+
 func printMessage(format string, requestedLevel, kernelLevel int, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	recordLog(requestedLevel, logSubsystem(2), msg)
+
 	if verbosityLevel < requestedLevel {
 		return
 	}
 
-	msg := fmt.Sprintf(format, v...)
 	if devKmsg != nil {
 		kmsg := msg
 		// The maximum size of the kmsg is determined by LOG_LINE_MAX in kernel/printk/printk.c
@@ -82,10 +179,15 @@ func disableKmsgThrottling() error {
 // but if we are compiling the binary with "tets" tag (e.g. for integration tests) then it prints message to kmsg to avoid
 // messing log output in qemu console
 func console(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if trimmed := strings.TrimSpace(msg); trimmed != "" {
+		recordLog(levelInfo, "console", trimmed)
+		plymouthMessage(trimmed)
+	}
+
 	if quirk.TestEnabled {
-		msg := fmt.Sprintf(format, v...)
 		_, _ = fmt.Fprint(devKmsg, "<", 2, ">booster: ", msg, "\n")
 	} else {
-		fmt.Printf(format, v...)
+		fmt.Print(msg)
 	}
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogRecords(t *testing.T) {
+	logMutex.Lock()
+	logRecords, logFile = nil, nil
+	logMutex.Unlock()
+	defer func() {
+		logMutex.Lock()
+		if logFile != nil {
+			logFile.Close()
+		}
+		logRecords, logFile = nil, nil
+		logMutex.Unlock()
+		logFilePath = "/run/booster/init.log"
+	}()
+	logFilePath = filepath.Join(t.TempDir(), "booster", "init.log")
+
+	// records are buffered till the log file is opened
+	debug("buffered %d", 1)
+	warning("buffered %d", 2)
+	require.NoError(t, openLogFile())
+	info("written")
+
+	data, err := os.ReadFile(logFilePath)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 3)
+
+	var records []logRecord
+	for _, l := range lines {
+		var r logRecord
+		require.NoError(t, json.Unmarshal([]byte(l), &r))
+		require.NotZero(t, r.Monotonic)
+		records = append(records, r)
+	}
+	require.Equal(t, "debug", records[0].Level)
+	require.Equal(t, "buffered 1", records[0].Message)
+	require.Equal(t, "logging_test", records[0].Subsystem)
+	require.Equal(t, "warning", records[1].Level)
+	require.Equal(t, "info", records[2].Level)
+	require.Equal(t, "written", records[2].Message)
+	require.LessOrEqual(t, records[0].Monotonic, records[2].Monotonic)
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
@@ -14,21 +13,27 @@ import (
 	"net"
 	"os"
 	"os/exec"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/anatol/clevis.go"
 	"github.com/anatol/luks.go"
+	"github.com/google/go-tpm/legacy/tpm2"
 )
 
 // specifies information needed to process/open a LUKS device
 // often these mappings specified by a user via command-line
 type luksMapping struct {
-	ref     *deviceRef
-	name    string
-	keyfile string
-	options []string
+	ref           *deviceRef
+	name          string
+	keyfile       *luksKeyfile
+	header        *luksKeyfile // detached LUKS header, nil if the header is at the device itself
+	data          *deviceRef   // data device of the volume with detached header
+	options       []string
+	hasOwnOptions bool // options specified with rd.luks.options=<UUID>=..., global options are not applied to this mapping
 }
 
 // rd luks options match systemd naming https://www.freedesktop.org/software/systemd/man/crypttab.html
@@ -58,7 +63,7 @@ func recoverClevisPassword(t luks.Token, luksVersion int) ([]byte, error) {
 	deadline := time.Now().Add(60 * time.Second) // wait for network readiness for 60 seconds max
 	waitedForTpm := false
 	for {
-		password, err := clevis.Decrypt(payload)
+		password, err := clevisDecrypt(payload, deadline)
 		if err != nil {
 			var netError *net.OpError
 			if errors.Is(err, fs.ErrNotExist) && !waitedForTpm {
@@ -89,40 +94,172 @@ func recoverClevisPassword(t luks.Token, luksVersion int) ([]byte, error) {
 	}
 }
 
-func recoverFido2Password(devName string, credential string, salt string, relyingParty string, pinRequired bool, userPresenceRequired bool, userVerificationRequired bool) ([]byte, error) {
-	usbhidWg.Wait()
+// fido2UsagePage is HID usage page of FIDO authenticators
+const fido2UsagePage = 0xf1d0
+
+// isFido2ReportDescriptor checks whether the HID report descriptor declares FIDO usage page, it is the same check libfido2 does
+func isFido2ReportDescriptor(desc []byte) bool {
+	for len(desc) > 0 {
+		prefix := desc[0]
+		if prefix == 0xfe {
+			// long item: prefix, data size, tag, data
+			if len(desc) < 3+int(desc[1]) {
+				return false
+			}
+			desc = desc[3+int(desc[1]):]
+			continue
+		}
 
+		size := int(prefix & 0x3)
+		if size == 3 {
+			size = 4
+		}
+		if len(desc) < 1+size {
+			return false
+		}
+		var value uint32
+		for i := size; i > 0; i-- {
+			value = value<<8 | uint32(desc[i])
+		}
+		// global item (type 1) with tag 0 is Usage Page
+		if prefix&0xfc == 0x04 && value == fido2UsagePage {
+			return true
+		}
+		desc = desc[1+size:]
+	}
+	return false
+}
+
+// checkFido2Device returns errNotFido2Device error if the hidraw device is not a FIDO2 security key
+func checkFido2Device(devName string) error {
+	desc, err := os.ReadFile("/sys/class/hidraw/" + devName + "/device/report_descriptor")
+	if err == nil {
+		if !isFido2ReportDescriptor(desc) {
+			return fmt.Errorf("%w: HID %s does not support FIDO", errNotFido2Device, devName)
+		}
+		return nil
+	}
+
+	// the report descriptor is not available at older kernels, check the device name instead
 	ueventContent, err := os.ReadFile("/sys/class/hidraw/" + devName + "/device/uevent")
 	if err != nil {
-		return nil, fmt.Errorf("unable to read uevent file for %s", devName)
+		return fmt.Errorf("%w: unable to read uevent file for %s", errNotFido2Device, devName)
 	}
-
-	// TODO: find better way to identify devices that support FIDO2
 	if !strings.Contains(string(ueventContent), "FIDO") {
-		return nil, fmt.Errorf("HID %s does not support FIDO", devName)
+		return fmt.Errorf("%w: HID %s does not support FIDO", errNotFido2Device, devName)
+	}
+	return nil
+}
+
+var (
+	// a security key might enumerate before it is ready to accept commands or the hidraw device might be briefly
+	// held by another process, such errors are retried with a doubling delay
+	fido2OpenAttempts = 5
+	fido2OpenDelay    = 200 * time.Millisecond
+
+	errFido2Transient  = errors.New("FIDO2 device is busy or not ready")
+	errFido2PinInvalid = errors.New("invalid PIN")
+)
+
+// isFido2TransientError checks fido2-assert error output for libfido2 errors worth retrying.
+// Errors like missing credentials, invalid PIN or a non-FIDO device are permanent.
+func isFido2TransientError(msg []byte) bool {
+	for _, e := range []string{"FIDO_ERR_TX", "FIDO_ERR_RX", "FIDO_ERR_CHANNEL_BUSY", "FIDO_ERR_INTERNAL", "Device or resource busy"} {
+		if bytes.Contains(msg, []byte(e)) {
+			return true
+		}
+	}
+	return false
+}
+
+func recoverFido2Password(devName string, credential string, salt string, relyingParty string, pinRequired bool, userPresenceRequired bool, userVerificationRequired bool) ([]byte, error) {
+	usbhidWg.Wait()
+
+	if err := checkFido2Device(devName); err != nil {
+		return nil, err
+	}
+
+	if !fido2HasCredential("/dev/"+devName, relyingParty, credential) {
+		return nil, fmt.Errorf("%w: /dev/%s", errFido2NoCredential, devName)
 	}
 
 	info("HID %s supports FIDO, trying it to recover the password", devName)
 
-	var challenge strings.Builder
-	const zeroString = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=" // 32byte zero string encoded as hex, hex.EncodeToString(make([]byte, 32))
-	challenge.WriteString(zeroString)                                 // client data, an empty string
-	challenge.WriteRune('\n')
-	challenge.WriteString(relyingParty)
-	challenge.WriteRune('\n')
-	challenge.WriteString(credential)
-	challenge.WriteRune('\n')
-	challenge.WriteString(salt)
-	challenge.WriteRune('\n')
+	pinAttempts := passwordAttempts{name: "PIN of security key /dev/" + devName, pin: true}
+	delay := fido2OpenDelay
+	for attempt := 1; ; {
+		password, err := fido2Assert(devName, credential, salt, relyingParty, pinRequired, userPresenceRequired, userVerificationRequired, &pinAttempts)
+		if errors.Is(err, errFido2PinInvalid) {
+			if err := pinAttempts.fail("Invalid PIN for security key /dev/" + devName); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err == nil || !errors.Is(err, errFido2Transient) || attempt >= fido2OpenAttempts {
+			return password, err
+		}
+		debug("HID %s: %v, retrying in %v (attempt %d of %d)", devName, err, delay, attempt, fido2OpenAttempts)
+		time.Sleep(delay)
+		delay *= 2
+		attempt++
+	}
+}
+
+// fido2HasCredential checks whether the security key holds the credential. The check does not need a touch or PIN as
+// it asks for an assertion without user presence and without hmac-secret. It lets booster skip keys that do not hold
+// the credential (e.g. when several keys are plugged in) instead of asking the user to touch them.
+func fido2HasCredential(device, relyingParty, credential string) bool {
+	cmd := exec.Command("fido2-assert", "-G", "-t", "up=false", device)
+	cmd.Stdin = strings.NewReader(fido2ClientDataHash + "\n" + relyingParty + "\n" + credential + "\n")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return true
+	}
+	if bytes.Contains(out, []byte("FIDO_ERR_NO_CREDENTIALS")) {
+		return false
+	}
+	// some keys do not support assertions without user presence, the real assertion tells whether the credential matches
+	debug("probing credential at %s: %v: %s", device, err, bytes.TrimSpace(out))
+	return true
+}
 
-	device := "/dev/" + devName
-	args := []string{"-G", "-h", device}
-	if userPresenceRequired {
-		args = append(args, "-t", "up=true")
+// fido2PinRetries returns the number of PIN attempts left before the security key blocks the PIN. It uses fido2-token
+// tool (fido_dev_get_retry_count) that is optional, -1 is returned if the number is not available.
+func fido2PinRetries(device string) int {
+	out, err := exec.Command("fido2-token", "-I", device).Output()
+	if err != nil {
+		debug("fido2-token -I %s: %v", device, err)
+		return -1
 	}
-	if userVerificationRequired {
-		args = append(args, "-t", "uv=true")
+	return parseFido2PinRetries(out)
+}
+
+// parseFido2PinRetries parses 'pin retries: N' line of fido2-token -I output
+func parseFido2PinRetries(out []byte) int {
+	for _, line := range strings.Split(string(out), "\n") {
+		value, ok := strings.CutPrefix(line, "pin retries: ")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return -1
+		}
+		return n
 	}
+	return -1
+}
+
+// fido2Assert runs fido2-assert tool to get hmac-secret from the security key
+func fido2Assert(devName string, credential string, salt string, relyingParty string, pinRequired bool, userPresenceRequired bool, userVerificationRequired bool, pinAttempts *passwordAttempts) ([]byte, error) {
+	challenge := fido2AssertInput(relyingParty, credential, salt)
+
+	device := "/dev/" + devName
+	// up and uv are always set explicitly as otherwise the authenticator uses its defaults,
+	// e.g. requires a touch for a credential enrolled with --fido2-with-user-presence=no
+	args := []string{"-G", "-h", device}
+	args = append(args, "-t", fmt.Sprintf("up=%t", userPresenceRequired))
+	args = append(args, "-t", fmt.Sprintf("uv=%t", userVerificationRequired))
 	if pinRequired {
 		args = append(args, "-t", "pin=true")
 	}
@@ -144,28 +281,49 @@ func recoverFido2Password(devName string, credential string, salt string, relyin
 	if err := cmd.Start(); err != nil {
 		return nil, err
 	}
+	// killing fido2-assert on interrupt closes its output and the assertion fails
+	defer onInterrupt(func() { _ = cmd.Process.Kill() })()
 
-	if _, err := pipeIn.Write([]byte(challenge.String())); err != nil {
+	if userPresenceRequired && !pinRequired {
+		// the prompt is printed even in 'quiet' mode as otherwise boot silently waits for the user
+		console("Please touch the security key %s to unlock the volume\n", device)
+	}
+
+	if _, err := pipeIn.Write([]byte(challenge)); err != nil {
 		return nil, err
 	}
 
+	var errHead []byte // stderr output read before the PIN prompt
 	if pinRequired {
 		// wait till the command requests the pin
 		buff := make([]byte, 500)
-		if _, err := pipeErr.Read(buff); err != nil {
+		n, err := pipeErr.Read(buff)
+		if err != nil && err != io.EOF {
 			return nil, err
 		}
+		buff = buff[:n]
 		// Dealing with Yubikey using command-line tools is getting out of control
 		// TODO: find a way to do the same using libfido2
 		prompt := "Enter PIN for " + device + ":"
-		if strings.HasPrefix(string(buff), prompt) {
+		if !strings.HasPrefix(string(buff), prompt) {
+			// the tool failed before requesting the pin e.g. unable to open the device
+			errHead = buff
+		} else {
 			// fido2-assert tool requests for PIN
-			pin, err := readPassword(prompt, "")
+			if retries := fido2PinRetries(device); retries >= 0 {
+				prompt = fmt.Sprintf("Enter PIN for %s (%d attempts left):", device, retries)
+			}
+			pin, err := pinAttempts.read(prompt)
 			if err != nil {
 				return nil, err
 			}
-			pin = append(pin, '\n')
-			if _, err := pipeIn.Write(pin); err != nil {
+			// write pin and the newline separately, appending to pin might leave a copy of it in memory
+			_, err = pipeIn.Write(pin)
+			memZeroBytes(pin)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := pipeIn.Write([]byte{'\n'}); err != nil {
 				return nil, err
 			}
 		}
@@ -177,37 +335,147 @@ func recoverFido2Password(devName string, credential string, salt string, relyin
 	}
 	lines := bytes.Split(content, []byte{'\n'})
 	if len(lines) < 5 {
+		memZeroBytes(content)
 		msg, _ := io.ReadAll(pipeErr)
-		msg = bytes.TrimRight(msg, "\n")
+		msg = bytes.TrimRight(append(errHead, msg...), "\n")
+		_ = cmd.Wait()
+		if bytes.Contains(msg, []byte("FIDO_ERR_NO_CREDENTIALS")) {
+			return nil, fmt.Errorf("%s: no credentials match relying party '%s', make sure the key is enrolled with the same relying party ID", device, relyingParty)
+		}
+		if bytes.Contains(msg, []byte("FIDO_ERR_PIN_INVALID")) {
+			return nil, fmt.Errorf("%s: %w", device, errFido2PinInvalid)
+		}
+		if bytes.Contains(msg, []byte("FIDO_ERR_PIN_BLOCKED")) || bytes.Contains(msg, []byte("FIDO_ERR_PIN_AUTH_BLOCKED")) {
+			console("PIN of security key %s is blocked, re-plug the key or reset its PIN\n", device)
+			return nil, fmt.Errorf("%s: PIN is blocked", device)
+		}
+		if isFido2TransientError(msg) {
+			return nil, fmt.Errorf("%w: %s", errFido2Transient, string(msg))
+		}
 		return nil, fmt.Errorf("%s", string(msg))
 	}
 
-	// hmac is the 5th line in the output
-	return lines[4], nil
+	// hmac is the 5th line in the output, the rest of the output is not sensitive
+	password, err := fido2HMACToPassphrase(lines[4])
+	memZeroBytes(content)
+	return password, err
+}
+
+// fido2ClientDataHash is the client data hash systemd-cryptsetup uses for hmac-secret assertions: 32 zero bytes,
+// the security of the scheme relies on the secret salt rather than on the client data
+var fido2ClientDataHash = base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+// fido2AssertInput builds fido2-assert input: client data hash, relying party ID, credential ID and hmac salt,
+// binary values are base64 encoded
+func fido2AssertInput(relyingParty, credential, salt string) string {
+	return fido2ClientDataHash + "\n" + relyingParty + "\n" + credential + "\n" + salt + "\n"
+}
+
+// fido2HMACToPassphrase converts hmac-secret output printed by fido2-assert into the LUKS passphrase.
+// systemd-cryptenroll uses base64 encoded (with padding) hmac-secret as the keyslot passphrase. The output is
+// decoded and encoded again so that any formatting difference of the tool does not produce a wrong passphrase.
+func fido2HMACToPassphrase(encoded []byte) ([]byte, error) {
+	hmac := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+	n, err := base64.StdEncoding.Decode(hmac, bytes.TrimSpace(encoded))
+	defer memZeroBytes(hmac)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hmac-secret output: %v", err)
+	}
+	if n != fido2HMACSecretSize {
+		return nil, fmt.Errorf("hmac-secret output is %d bytes long, expected %d bytes", n, fido2HMACSecretSize)
+	}
+
+	password := make([]byte, base64.StdEncoding.EncodedLen(n))
+	base64.StdEncoding.Encode(password, hmac[:n])
+	return password, nil
 }
 
+// fido2HMACSecretSize is the size of hmac-secret extension output and its salt for a single salt request
+const fido2HMACSecretSize = 32
+
 var hidrawDevices = make(chan string, 10) // channel that receives 'add hidraw' events
 
-func recoverSystemdFido2Password(t luks.Token) ([]byte, error) {
-	var node struct {
-		Credential               string `json:"fido2-credential"` // base64
-		Salt                     string `json:"fido2-salt"`       // base64
-		RelyingParty             string `json:"fido2-rp"`
-		PinRequired              bool   `json:"fido2-clientPin-required"`
-		UserPresenceRequired     bool   `json:"fido2-up-required"`
-		UserVerificationRequired bool   `json:"fido2-uv-required"`
-	}
-	if err := json.Unmarshal(t.Payload, &node); err != nil {
+var (
+	errNotFido2Device    = errors.New("not a FIDO2 device")
+	errFido2NoCredential = errors.New("security key does not hold the credential")
+)
+
+// fido2RelyingParty is used for tokens that do not specify the relying party ID, systemd-cryptenroll uses the same default value
+var fido2RelyingParty = "io.systemd.cryptsetup"
+
+// systemdFido2Token is a FIDO2 credential stored in systemd-fido2 token
+type systemdFido2Token struct {
+	Credential               string `json:"fido2-credential"` // base64
+	Salt                     string `json:"fido2-salt"`       // base64
+	RelyingParty             string `json:"fido2-rp"`
+	PinRequired              bool   `json:"fido2-clientPin-required"`
+	UserPresenceRequired     bool   `json:"fido2-up-required"`
+	UserVerificationRequired bool   `json:"fido2-uv-required"`
+}
+
+func parseSystemdFido2Token(payload []byte) (*systemdFido2Token, error) {
+	var tok systemdFido2Token
+	if err := json.Unmarshal(payload, &tok); err != nil {
 		return nil, err
 	}
+	if tok.RelyingParty == "" {
+		tok.RelyingParty = fido2RelyingParty
+	}
+	if tok.Credential == "" {
+		return nil, fmt.Errorf("fido2-credential is missing")
+	}
+	if _, err := base64.StdEncoding.DecodeString(tok.Credential); err != nil {
+		return nil, fmt.Errorf("invalid fido2-credential: %v", err)
+	}
+	if tok.Salt == "" {
+		return nil, fmt.Errorf("fido2-salt is missing")
+	}
+	salt, err := base64.StdEncoding.DecodeString(tok.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fido2-salt: %v", err)
+	}
+	if len(salt) != fido2HMACSecretSize {
+		return nil, fmt.Errorf("fido2-salt is %d bytes long, expected %d bytes", len(salt), fido2HMACSecretSize)
+	}
+	return &tok, nil
+}
+
+func (tok *systemdFido2Token) recoverPassword(devName string) ([]byte, error) {
+	return recoverFido2Password(devName, tok.Credential, tok.Salt, tok.RelyingParty, tok.PinRequired, tok.UserPresenceRequired, tok.UserVerificationRequired)
+}
+
+// fido2Timeout is how long booster waits for a matching security key before it gives up on FIDO2 tokens and leaves
+// the volume to the remaining unlock methods, booster.fido2_timeout=. Zero means the default: wait forever when unlock
+// methods run concurrently or unlockOrderFido2Timeout with booster.unlock_order.
+var fido2Timeout time.Duration
+
+var (
+	errFido2Interrupted   = errors.New("waiting for fido2 device is interrupted")
+	errFido2DeviceTimeout = errors.New("timeout waiting for fido2 device")
+	errFido2NoDevice      = errors.New("no security key present")
+)
 
-	if node.RelyingParty == "" {
-		node.RelyingParty = "io.systemd.cryptsetup"
+// hasFido2Device checks whether any of the present hidraw devices is a FIDO2 security key
+func hasFido2Device() bool {
+	usbhidWg.Wait() // hidraw devices of the keys plugged in at boot appear once usbhid is loaded
+	dir, err := os.ReadDir("/sys/class/hidraw/")
+	if err != nil {
+		return false
+	}
+	for _, d := range dir {
+		if checkFido2Device(d.Name()) == nil {
+			return true
+		}
 	}
+	return false
+}
 
+// forEachHidrawDevice calls fn for every present and hotplugged hidraw device until fn returns true.
+// If timeout is not zero then it gives up if no device is accepted within the timeout.
+func forEachHidrawDevice(timeout time.Duration, fn func(devName string) bool) error {
 	dir, err := os.ReadDir("/sys/class/hidraw/")
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	go func() {
@@ -217,36 +485,202 @@ func recoverSystemdFido2Password(t luks.Token) ([]byte, error) {
 		}
 	}()
 
+	interrupted := make(chan struct{}, 1)
+	defer onInterrupt(func() {
+		select {
+		case interrupted <- struct{}{}:
+		default:
+		}
+	})()
+
+	var timedOut <-chan time.Time
+	if timeout != 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
+
 	seenHidrawDevices := make(set)
 
-	for devName := range hidrawDevices {
+	for {
+		var devName string
+		select {
+		case devName = <-hidrawDevices:
+		case <-interrupted:
+			return errFido2Interrupted
+		case <-timedOut:
+			return errFido2DeviceTimeout
+		}
+
 		if seenHidrawDevices[devName] {
 			continue
 		}
 		seenHidrawDevices[devName] = true
 
-		password, err := recoverFido2Password(devName, node.Credential, node.Salt, node.RelyingParty, node.PinRequired, node.UserPresenceRequired, node.UserVerificationRequired)
+		if fn(devName) {
+			return nil
+		}
+	}
+}
+
+func recoverSystemdFido2Password(t luks.Token) ([]byte, error) {
+	tok, err := parseSystemdFido2Token(t.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// the token is only checked outside of the boot process (check-unlock), a missing key must not block it forever
+	waitTimeout := fido2Timeout
+	if waitTimeout == 0 {
+		waitTimeout = unlockOrderFido2Timeout
+	}
+
+	var password []byte
+	var recoverErr error
+	err = forEachHidrawDevice(waitTimeout, func(devName string) bool {
+		password, err = tok.recoverPassword(devName)
+		if errors.Is(err, errNotFido2Device) {
+			debug("%v", err)
+			return false
+		}
 		if err != nil {
 			if err != io.EOF {
 				info("%v", err)
 			}
+			recoverErr = err
+			return false
+		}
+		return true
+	})
+	if errors.Is(err, errFido2DeviceTimeout) {
+		if recoverErr != nil {
+			return nil, recoverErr
+		}
+		return nil, errFido2NoDevice
+	}
+	return password, err
+}
+
+// recoverFido2TokensPassword tries every enrolled FIDO2 credential against every security key until one of them
+// unlocks the volume. It allows to enroll a primary and a backup key and boot with any of them.
+// All tokens are handled by one goroutine as otherwise hidraw hotplug events are split between the tokens.
+// If waitTimeout is not zero then it gives up when no matching security key appears within the timeout.
+func recoverFido2TokensPassword(volumes chan *luks.Volume, d luks.Device, tokens []luks.Token, waitTimeout time.Duration) error {
+	fido2Tokens := make(map[int]*systemdFido2Token)
+	for _, t := range tokens {
+		tok, err := parseSystemdFido2Token(t.Payload)
+		if err != nil {
+			warning("parsing %s token #%d: %v", t.Type, t.ID, err)
 			continue
 		}
-		return password, nil
+		fido2Tokens[t.ID] = tok
+	}
+	if len(fido2Tokens) == 0 {
+		return fmt.Errorf("no valid systemd-fido2 tokens")
+	}
+
+	if !hasFido2Device() {
+		if waitTimeout != 0 {
+			console("Please insert your security key to unlock %s (waiting %v)\n", d.Path(), waitTimeout)
+		} else {
+			console("Please insert your security key to unlock %s\n", d.Path())
+		}
 	}
 
-	return nil, fmt.Errorf("no matching fido2 devices available")
+	err := forEachHidrawDevice(waitTimeout, func(devName string) bool {
+		isFido2 := false
+		for _, t := range tokens {
+			tok := fido2Tokens[t.ID]
+			if tok == nil {
+				continue
+			}
+			password, err := tok.recoverPassword(devName)
+			if errors.Is(err, errNotFido2Device) {
+				debug("%v", err)
+				return false
+			}
+			isFido2 = true
+			if errors.Is(err, errFido2NoCredential) {
+				debug("%s token #%d: %v", t.Type, t.ID, err)
+				continue
+			}
+			if err != nil {
+				if err != io.EOF {
+					info("%s token #%d: %v", t.Type, t.ID, err)
+				}
+				continue
+			}
+
+			v, slot := unsealTokenSlots(d, t, password)
+			memZeroBytes(password)
+			if v == nil {
+				info("password from %s token #%d does not match", t.Type, t.ID)
+				continue
+			}
+			info("security key /dev/%s matches %s token #%d", devName, t.Type, t.ID)
+			unlockRecords.Store(v, tokenUnlockRecord(t, slot))
+			volumes <- v
+			return true
+		}
+		if isFido2 {
+			console("Security key /dev/%s does not match any enrolled FIDO2 credential of %s, please insert a different key\n", devName, d.Path())
+		}
+		return false
+	})
+	if errors.Is(err, errFido2DeviceTimeout) {
+		console("No matching security key found for %s within %v\n", d.Path(), waitTimeout)
+	} else if err != nil {
+		info("%v", err)
+	}
+	return err
 }
 
-func recoverSystemdTPM2Password(t luks.Token) ([]byte, error) {
+// tpm2Token is a secret sealed by TPM that is stored in systemd-tpm2 and booster-tpm2 tokens
+type tpm2Token struct {
+	public, private []byte
+	pcrs            []int
+	bank            tpm2.Algorithm
+	policyHash      []byte
+	pin             bool
+	salt            []byte
+	pcrValues       map[int][]byte    // values of PCRs the secret is sealed against, stored by booster-tpm2 tokens only
+	signed          *tpmSignedPolicy  // set if the secret is sealed with systemd-cryptenroll --tpm2-public-key
+	primaryAlg      tpm2.Algorithm    // type of SRK the secret is sealed under
+	srk             *tpmPersistentKey // persistent SRK the secret is sealed under, nil if SRK is created at unlock
+}
+
+// readTPM2BlobPart reads a size-prefixed part of the sealed object and returns the rest of the blob
+func readTPM2BlobPart(blob []byte) ([]byte, []byte, error) {
+	if len(blob) < 2 {
+		return nil, nil, fmt.Errorf("blob is truncated")
+	}
+	size := int(binary.BigEndian.Uint16(blob[:2]))
+	blob = blob[2:]
+	if size == 0 {
+		return nil, nil, fmt.Errorf("empty area")
+	}
+	if len(blob) < size {
+		return nil, nil, fmt.Errorf("blob is truncated, expected %d bytes but only %d is available", size, len(blob))
+	}
+	return blob[:size], blob[size:], nil
+}
+
+func parseTPM2Token(payload []byte) (*tpm2Token, error) {
 	var node struct {
-		Blob       string `json:"tpm2-blob"` // base64
-		PCRs       []int  `json:"tpm2-pcrs"`
-		PCRBank    string `json:"tpm2-pcr-bank"`    // either sha1 or sha256
-		PolicyHash string `json:"tpm2-policy-hash"` // base64
-		Pin        bool   `json:"tpm2-pin"`
+		Blob       string            `json:"tpm2-blob"` // base64
+		PCRs       []int             `json:"tpm2-pcrs"`
+		PCRBank    string            `json:"tpm2-pcr-bank"`    // either sha1 or sha256
+		PolicyHash string            `json:"tpm2-policy-hash"` // hex
+		Pin        bool              `json:"tpm2-pin"`
+		Salt       string            `json:"tpm2_salt"`       // base64, set by newer systemd versions that salt the pin
+		PCRValues  map[string]string `json:"tpm2-pcr-values"` // PCR index -> hex value
+		Pubkey     string            `json:"tpm2_pubkey"`     // base64 of PEM encoded public key
+		PubkeyPCRs []int             `json:"tpm2_pubkey_pcrs"`
+		PrimaryAlg string            `json:"tpm2-primary-alg"` // ecc or rsa
+		SRK        string            `json:"tpm2_srk"`         // base64 of serialized ESYS_TR
+		PCRLock    bool              `json:"tpm2_pcrlock"`
 	}
-	if err := json.Unmarshal(t.Payload, &node); err != nil {
+	if err := json.Unmarshal(payload, &node); err != nil {
 		return nil, err
 	}
 
@@ -255,15 +689,28 @@ func recoverSystemdTPM2Password(t luks.Token) ([]byte, error) {
 		return nil, err
 	}
 
-	privateSize := binary.BigEndian.Uint16(blob[:2])
-	blob = blob[2:]
-	private := blob[:privateSize]
-	blob = blob[privateSize:]
+	private, blob, err := readTPM2BlobPart(blob)
+	if err != nil {
+		return nil, fmt.Errorf("tpm2-blob private area: %v", err)
+	}
+	public, _, err := readTPM2BlobPart(blob)
+	if err != nil {
+		return nil, fmt.Errorf("tpm2-blob public area: %v", err)
+	}
 
-	publcSize := binary.BigEndian.Uint16(blob[:2])
-	blob = blob[2:]
-	public := blob[:publcSize]
-	blob = blob[publcSize:]
+	if node.PCRLock {
+		// the policy is stored in a TPM NV index managed by systemd-pcrlock
+		return nil, fmt.Errorf("systemd-pcrlock policies are not supported")
+	}
+	for _, pcr := range append(node.PCRs, node.PubkeyPCRs...) {
+		if pcr < 0 {
+			return nil, fmt.Errorf("invalid PCR index %d", pcr)
+		}
+	}
+	bank, err := parsePCRBank(node.PCRBank)
+	if err != nil {
+		return nil, err
+	}
 
 	if node.PolicyHash == "" {
 		return nil, fmt.Errorf("empty policy hash")
@@ -273,146 +720,369 @@ func recoverSystemdTPM2Password(t luks.Token) ([]byte, error) {
 		return nil, err
 	}
 
-	bank := parsePCRBank(node.PCRBank)
+	var salt []byte
+	if node.Salt != "" {
+		salt, err = base64.StdEncoding.DecodeString(node.Salt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tpm2_salt: %v", err)
+		}
+	}
+
+	pcrValues, err := decodePCRValues(node.PCRValues)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tpm2-pcr-values: %v", err)
+	}
 
-	var authValue []byte
-	if node.Pin {
-		prompt := fmt.Sprintf("Please enter TPM pin: ")
-		pin, err := readPassword(prompt, "")
+	var signed *tpmSignedPolicy
+	if node.Pubkey != "" {
+		pubkey, err := base64.StdEncoding.DecodeString(node.Pubkey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tpm2_pubkey: %v", err)
+		}
+		signed = &tpmSignedPolicy{pubkey: pubkey, pcrs: node.PubkeyPCRs}
+	}
+
+	primaryAlg, err := parsePrimaryAlg(node.PrimaryAlg)
+	if err != nil {
+		return nil, err
+	}
+	var srk *tpmPersistentKey
+	if node.SRK != "" {
+		blob, err := base64.StdEncoding.DecodeString(node.SRK)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tpm2_srk: %v", err)
+		}
+		srk, err = parseESYSTR(blob)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tpm2_srk: %v", err)
+		}
+	}
+
+	return &tpm2Token{
+		public:     public,
+		private:    private,
+		pcrs:       node.PCRs,
+		bank:       bank,
+		policyHash: policyHash,
+		pin:        node.Pin,
+		salt:       salt,
+		pcrValues:  pcrValues,
+		signed:     signed,
+		primaryAlg: primaryAlg,
+		srk:        srk,
+	}, nil
+}
+
+func recoverSystemdTPM2Password(t luks.Token) ([]byte, error) {
+	tok, err := parseTPM2Token(t.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if !tok.pin {
+		password, err := tpm2Unseal(tok, nil)
 		if err != nil {
 			return nil, err
 		}
+		return encodeSystemdTPM2Password(password), nil
+	}
 
-		hash := sha256.Sum256(pin)
-		authValue = hash[:]
+	// check the PCR policy first, it makes no sense to ask for the pin if the token is sealed against different PCR values
+	if err := tpm2CheckPolicy(tok, true); err != nil {
+		return nil, err
 	}
 
-	password, err := tpm2Unseal(public, private, node.PCRs, bank, policyHash, authValue)
+	attempts := passwordAttempts{name: "TPM pin", pin: true}
+	password, err := unsealWithTPMPin(&attempts, func() ([]byte, error) {
+		return attempts.read("Please enter TPM pin: ")
+	}, func(pin []byte) ([]byte, error) {
+		authValue := systemdTPM2PinAuth(pin, tok.salt)
+		defer memZeroBytes(authValue)
+		return tpm2Unseal(tok, authValue)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return []byte(base64.StdEncoding.EncodeToString(password)), nil
+	return encodeSystemdTPM2Password(password), nil
 }
 
-func recoverTokenPassword(volumes chan *luks.Volume, d luks.Device, t luks.Token) {
-	var password []byte
-	var err error
+// unsealWithTPMPin asks for the pin until the secret is unsealed. The number of attempts is limited as every wrong pin
+// increments the TPM dictionary attack counter, a lockout stops the prompt as no pin is accepted anymore.
+func unsealWithTPMPin(attempts *passwordAttempts, readPin func() ([]byte, error), unseal func(pin []byte) ([]byte, error)) ([]byte, error) {
+	for {
+		pin, err := readPin()
+		if err != nil {
+			return nil, err
+		}
+		password, err := unseal(pin)
+		memZeroBytes(pin)
+		if isTPMAuthFailure(err) {
+			if err := attempts.fail("   Incorrect TPM pin"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var lockoutErr *tpmLockoutError
+		if errors.As(err, &lockoutErr) {
+			console("   TPM is in dictionary attack lockout mode, too many incorrect pins were entered (%v)\n", lockoutErr.state)
+			return nil, err
+		} else if isTPMLockout(err) {
+			console("   TPM is in dictionary attack lockout mode, too many incorrect pins were entered\n")
+			return nil, fmt.Errorf("TPM is in dictionary attack lockout mode: %w", err)
+		}
+		return password, err
+	}
+}
 
-	switch t.Type {
-	case "clevis":
-		password, err = recoverClevisPassword(t, d.Version())
-	case "systemd-fido2":
-		password, err = recoverSystemdFido2Password(t)
-	case "systemd-tpm2":
-		password, err = recoverSystemdTPM2Password(t)
-	default:
-		info("token #%d has unknown type: %s", t.ID, t.Type)
-		return
+// recoverBoosterTPM2Password recovers the passphrase from booster-tpm2 token created by booster.tpm_auto_reseal.
+// Unlike systemd-tpm2 the token seals the passphrase itself.
+func recoverBoosterTPM2Password(t luks.Token) ([]byte, error) {
+	tok, err := parseTPM2Token(t.Payload)
+	if err != nil {
+		return nil, err
 	}
+	return tpm2Unseal(tok, nil)
+}
+
+// encodeSystemdTPM2Password converts the unsealed secret into LUKS passphrase and wipes the secret
+func encodeSystemdTPM2Password(secret []byte) []byte {
+	password := make([]byte, base64.StdEncoding.EncodedLen(len(secret)))
+	base64.StdEncoding.Encode(password, secret)
+	memZeroBytes(secret)
+	return password
+}
 
+// recoverTokenPassword recovers the password from the token and unlocks the volume with it.
+// It returns nil if the volume has been unlocked.
+func recoverTokenPassword(volumes chan *luks.Volume, d luks.Device, t luks.Token) error {
+	password, err := recoverTokenSecret(t, d.Version())
+	if errors.Is(err, errUnknownTokenType) {
+		info("token #%d has unknown type: %s", t.ID, t.Type)
+		return err
+	}
 	if err != nil {
 		warning("recovering %s token #%d failed: %v", t.Type, t.ID, err)
-		return
+		return err
 	}
 
 	info("recovered password from %s token #%d", t.Type, t.ID)
+	defer memZeroBytes(password)
+
+	v, slot := unsealTokenSlots(d, t, password)
+	if v == nil {
+		info("password from %s token #%d does not match", t.Type, t.ID)
+		return luks.ErrPassphraseDoesNotMatch
+	}
+	info("password from %s token #%d matches", t.Type, t.ID)
+	unlockRecords.Store(v, tokenUnlockRecord(t, slot))
+	volumes <- v
+	return nil
+}
+
+var errUnknownTokenType = errors.New("unknown token type")
+
+// recoverTokenSecret recovers the LUKS password stored in the token
+func recoverTokenSecret(t luks.Token, luksVersion int) ([]byte, error) {
+	switch t.Type {
+	case "clevis":
+		return recoverClevisPassword(t, luksVersion)
+	case "systemd-fido2":
+		return recoverSystemdFido2Password(t)
+	case "systemd-tpm2":
+		return recoverSystemdTPM2Password(t)
+	case "systemd-pkcs11":
+		return recoverSystemdPkcs11Password(t)
+	case "booster-tpm2":
+		return recoverBoosterTPM2Password(t)
+	default:
+		return nil, errUnknownTokenType
+	}
+}
 
+// unsealTokenSlots tries the password against the keyslots of the token.
+// It returns the unsealed volume and the matching keyslot or nil if the password does not match.
+func unsealTokenSlots(d luks.Device, t luks.Token, password []byte) (*luks.Volume, int) {
 	for _, s := range t.Slots {
-		v, err := d.UnsealVolume(s, password)
+		v, err := unsealVolume(d, s, password)
 		if err == luks.ErrPassphraseDoesNotMatch {
 			continue
 		} else if err != nil {
 			warning("unlocking slot %v: %v", s, err)
 			continue
 		}
-		info("password from %s token #%d matches", t.Type, t.ID)
-		volumes <- v
-		return
+		return v, s
 	}
-	info("password from %s token #%d does not match", t.Type, t.ID)
+	return nil, 0
 }
 
-func recoverKeyfilePassword(volumes chan *luks.Volume, d luks.Device, checkSlots []int, mappingName string, keyfile string) {
-	var err error
-	var password []byte
-
-	// keyfile might be in the format /path:UUID=<DEV UUID> to indicate the keyfile lives on another device
-	parts := regexp.MustCompile("(?i):UUID=").Split(keyfile, 2)
+func systemdTPM2TokenRequiresPin(t luks.Token) bool {
+	var node struct {
+		Pin bool `json:"tpm2-pin"`
+	}
+	_ = json.Unmarshal(t.Payload, &node)
+	return node.Pin
+}
 
-	if len(parts) == 1 {
-		password, err = os.ReadFile(parts[0])
+// recoverTPM2TokensPassword tries TPM2 tokens one by one until one of them unlocks the volume.
+// A disk might have several tokens sealed against different PCR policies (e.g. for A/B kernels) and only one of
+// them matches the current PCR values. Trying them sequentially avoids concurrent TPM sessions and multiple pin prompts.
+func recoverTPM2TokensPassword(volumes chan *luks.Volume, d luks.Device, tokens []luks.Token) error {
+	// tokens that do not need a pin go first
+	sort.SliceStable(tokens, func(i, j int) bool {
+		return !systemdTPM2TokenRequiresPin(tokens[i]) && systemdTPM2TokenRequiresPin(tokens[j])
+	})
 
-		if err != nil {
-			warning("reading password: %v", err)
+	var err error
+	for _, t := range tokens {
+		err = recoverTokenPassword(volumes, d, t)
+		if err == nil {
+			return nil
 		}
-	} else {
-		// read password from device matching uuid
-		uuid, err := parseUUID(parts[1])
-		if err != nil {
-			warning("invalid UUID %s in rd.luks.key boot param: %s", uuid, keyfile)
-		} else {
-			// TODO: access path on uuid device, read password
-			warning("user wants keyfile from device %s, but I don't know how to do that", uuid)
+		if errors.Is(err, errPCRPolicyMismatch) {
+			changed := reportPCRDrift(d, t)
+			recordPCRPolicyMismatch(d, t, changed)
 		}
 	}
+	if len(tokens) > 1 {
+		warning("none of %d TPM2 tokens unlocked the volume", len(tokens))
+	}
+	return err
+}
+
+// recoverTokensPassword tries clevis and other generic tokens concurrently. It returns nil once one of them
+// unlocks the volume, otherwise the error of the last failed token.
+func recoverTokensPassword(volumes chan *luks.Volume, d luks.Device, tokens []luks.Token) error {
+	results := make(chan error, len(tokens))
+	for _, t := range tokens {
+		go func(t luks.Token) { results <- recoverTokenPassword(volumes, d, t) }(t)
+	}
+	var err error
+	for range tokens {
+		if err = <-results; err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func recoverKeyfilePassword(volumes chan *luks.Volume, d luks.Device, checkSlots []int, mappingName string, keyfile *luksKeyfile) error {
+	password, err := keyfile.read()
+	if err != nil {
+		warning("reading keyfile %s: %v", keyfile, err)
+	}
 
 	if len(password) > 0 {
 		for _, s := range checkSlots {
-			v, err := d.UnsealVolume(s, password)
+			v, err := unsealVolume(d, s, password)
 			if err == luks.ErrPassphraseDoesNotMatch {
 				continue
 			} else if err != nil {
 				warning("unlocking slot %v: %v", s, err)
 				continue
 			}
+			memZeroBytes(password)
+			unlockRecords.Store(v, &unlockRecord{Method: unlockMethodKeyfile, Keyslot: s})
 			volumes <- v
-			return
+			return nil
 		}
+		memZeroBytes(password)
+		warning("keyfile %s was unable to unseal %s", keyfile, mappingName)
 	}
 
-	warning("password in keyfile #{keyfile} was unable to unseal #{mappingName}\n")
-
 	// have to use keyboard password
-	requestKeyboardPassword(volumes, d, checkSlots, mappingName)
+	return requestKeyboardPassword(volumes, d, checkSlots, mappingName)
+}
+
+func requestKeyboardPassword(volumes chan *luks.Volume, d luks.Device, checkSlots []int, mappingName string) error {
+	if keySrc != nil {
+		err := recoverKeySourcePassword(volumes, d, checkSlots, mappingName)
+		if err == nil {
+			return nil
+		}
+		info("%v, falling back to the console prompt", err)
+	}
+
+	v, s, password, err := promptPassword(d, checkSlots, mappingName)
+	if err != nil {
+		return err
+	}
+	memZeroBytes(password)
+	if tpmAutoReseal {
+		adviseTPM2Reenroll(d)
+	}
+	unlockRecords.Store(v, passphraseUnlockRecord(d, s))
+	volumes <- v
+	return nil
 }
 
-func requestKeyboardPassword(volumes chan *luks.Volume, d luks.Device, checkSlots []int, mappingName string) {
+// promptPassword unlocks the volume with the cached passphrase or with the one entered at the console.
+// It returns the unlocked volume, the keyslot and the entered passphrase (nil if the cached one matched),
+// the caller wipes the passphrase once done with it.
+func promptPassword(d luks.Device, checkSlots []int, mappingName string) (*luks.Volume, int, []byte, error) {
+	passphrasePromptMutex.Lock()
+	defer passphrasePromptMutex.Unlock()
+
+	if v, s := tryCachedPassphrase(d, checkSlots); v != nil {
+		info("%s is unlocked with the passphrase of the previous volume", mappingName)
+		return v, s, nil, nil
+	}
+
+	attempts := passwordAttempts{name: mappingName}
 	for {
-		prompt := fmt.Sprintf("Enter passphrase for %s:", mappingName)
-		password, err := readPassword(prompt, "   Unlocking...")
+		password, err := attempts.read(fmt.Sprintf("Enter passphrase for %s:", mappingName))
 		if err != nil {
 			warning("reading password: %v", err)
-			return
-		}
-		if len(password) == 0 {
-			continue
+			return nil, 0, nil, err
 		}
 
 		for _, s := range checkSlots {
-			v, err := d.UnsealVolume(s, password)
+			v, err := unsealVolume(d, s, password)
 			if err == luks.ErrPassphraseDoesNotMatch {
 				continue
 			} else if err != nil {
 				warning("unlocking slot %v: %v", s, err)
 				continue
 			}
-			volumes <- v
-			return
+			cachePassphrase(password)
+			return v, s, password, nil
+		}
+		memZeroBytes(password)
+
+		if err := attempts.fail("   Incorrect passphrase"); err != nil {
+			return nil, 0, nil, err
 		}
+	}
+}
 
-		// retry password
-		console("   Incorrect passphrase, please try again\n")
+func usableSlots(slots []int, unusable map[int]bool) []int {
+	var result []int
+	for _, s := range slots {
+		if !unusable[s] {
+			result = append(result, s)
+		}
 	}
+	return result
 }
 
 func luksOpen(dev string, mapping *luksMapping) error {
+	defer startPhase("unlock %s", mapping.name)()
+
 	module := loadModules("dm_crypt")
 
-	d, err := luks.Open(dev)
+	var d luks.Device
+	var err error
+	if mapping.header != nil {
+		d, err = openDetachedHeader(mapping, dev)
+	} else {
+		d, err = luks.Open(dev)
+	}
 	if err != nil {
 		return err
 	}
 	defer d.Close()
+	if mapping.header != nil {
+		defer os.Remove(d.Path()) // the header copy is not needed once the volume is unlocked
+	}
 
 	if len(d.Slots()) == 0 {
 		return fmt.Errorf("device %s has no slots to unlock", dev)
@@ -422,48 +1092,166 @@ func luksOpen(dev string, mapping *luksMapping) error {
 		return err
 	}
 
-	volumes := make(chan *luks.Volume)
+	// unlock methods available for the device, the key is the method name used by booster.unlock_order
+	methods := make(map[string]unlockFunc)
 
 	slotsWithTokens := make(map[int]bool)
-	tokens, err := d.Tokens()
+	tokens, err := volumeTokens(d)
 	if err != nil {
 		return err
 	}
+	// keyslots with invalid KDF parameters are reported and not checked, otherwise they fail as a wrong passphrase
+	unusableSlots := unusableKeyslots(d)
+	var tpm2Tokens, fido2Tokens, otherTokens []luks.Token
+	recoverySlots := make(map[int]bool)
 	for _, t := range tokens {
+		t.Slots = usableSlots(t.Slots, unusableSlots)
 		if t.Type == "systemd-recovery" {
-			continue // skip systemd-recovery tokens as they are supposed to be entered by a keyboard later
+			// recovery keys are entered with keyboard
+			for _, s := range t.Slots {
+				recoverySlots[s] = true
+			}
+			continue
+		}
+		if t.Type == "systemd-tpm2" || t.Type == "booster-tpm2" {
+			tpm2Tokens = append(tpm2Tokens, t)
+		} else if t.Type == "systemd-fido2" {
+			fido2Tokens = append(fido2Tokens, t)
+		} else {
+			otherTokens = append(otherTokens, t)
 		}
-		go recoverTokenPassword(volumes, d, t)
 		for _, s := range t.Slots {
 			slotsWithTokens[s] = true
 		}
 	}
+	if len(tpm2Tokens) > 0 {
+		methods[unlockMethodTPM2] = func(volumes chan *luks.Volume) error {
+			return recoverTPM2TokensPassword(volumes, d, tpm2Tokens)
+		}
+	}
+	if len(fido2Tokens) > 0 {
+		methods[unlockMethodFido2] = func(volumes chan *luks.Volume) error {
+			waitTimeout := fido2Timeout
+			if waitTimeout == 0 && len(unlockOrder) != 0 {
+				// with an explicit order a missing security key should not block the next methods forever
+				waitTimeout = unlockOrderFido2Timeout
+			}
+			return recoverFido2TokensPassword(volumes, d, fido2Tokens, waitTimeout)
+		}
+	}
+	if len(otherTokens) > 0 {
+		methods[unlockMethodClevis] = func(volumes chan *luks.Volume) error {
+			return recoverTokensPassword(volumes, d, otherTokens)
+		}
+	}
 
-	var checkSlotsWithPassword []int
+	var checkSlotsWithPassword, checkSlotsWithRecoveryKey []int
 	for _, s := range d.Slots() {
-		if !slotsWithTokens[s] {
+		if recoverySlots[s] {
+			checkSlotsWithRecoveryKey = append(checkSlotsWithRecoveryKey, s)
+		} else if !slotsWithTokens[s] && !unusableSlots[s] {
 			// only slots that do not have tokens will be checked with keyboard password
 			checkSlotsWithPassword = append(checkSlotsWithPassword, s)
 		}
 	}
+
+	// automaticFailed is closed once all the token based methods fail, unlocked is closed once the volume is unlocked
+	automaticFailed := make(chan struct{})
+	unlocked := make(chan struct{})
+	if len(checkSlotsWithRecoveryKey) > 0 {
+		recoveryKey := func(volumes chan *luks.Volume) error {
+			return requestRecoveryKey(volumes, d, checkSlotsWithRecoveryKey, mapping.name, automaticFailed, unlocked)
+		}
+		switch {
+		case unlockOrderContains(unlockMethodRecoveryKey):
+			methods[unlockMethodRecoveryKey] = recoveryKey
+		case len(checkSlotsWithPassword) > 0:
+			// the console is taken by the passphrase prompt, it accepts recovery keys as well
+			checkSlotsWithPassword = append(checkSlotsWithPassword, checkSlotsWithRecoveryKey...)
+		case len(unlockOrder) != 0:
+			// the recovery key replaces the passphrase if the order does not list it explicitly
+			methods[unlockMethodPassphrase] = recoveryKey
+		default:
+			methods[unlockMethodRecoveryKey] = recoveryKey
+		}
+	}
 	if len(checkSlotsWithPassword) > 0 {
-		// is there a keyfile defined for the password for this volume?
-		if len(mapping.keyfile) > 0 {
-			// if the keyfile doesn't work we will fallback to password
-			go recoverKeyfilePassword(volumes, d, checkSlotsWithPassword, mapping.name, mapping.keyfile)
-		} else {
-			go requestKeyboardPassword(volumes, d, checkSlotsWithPassword, mapping.name)
+		methods[unlockMethodPassphrase] = func(volumes chan *luks.Volume) error {
+			// is there a keyfile defined for the password for this volume?
+			if keyfile := volumeKeyfile(mapping, d); keyfile != nil {
+				// if the keyfile doesn't work we will fallback to password
+				return recoverKeyfilePassword(volumes, d, checkSlotsWithPassword, mapping.name, keyfile)
+			}
+			return requestKeyboardPassword(volumes, d, checkSlotsWithPassword, mapping.name)
+		}
+	}
+
+	progress := newUnlockProgress()
+	results := make(chan unlockResult, 1)
+	if len(unlockOrder) == 0 {
+		// all the methods run concurrently, the first one that unlocks the volume wins
+		volumes := make(chan *luks.Volume)
+		var automatic sync.WaitGroup
+		var automaticSucceeded atomic.Bool
+		for name, m := range methods {
+			isAutomatic := name != unlockMethodPassphrase && name != unlockMethodRecoveryKey
+			if isAutomatic {
+				automatic.Add(1)
+			}
+			progress.start(name)
+			go func(name string, m unlockFunc) {
+				err := m(volumes)
+				progress.finish(name)
+				if isAutomatic {
+					if err == nil {
+						automaticSucceeded.Store(true)
+					}
+					automatic.Done()
+				}
+			}(name, m)
 		}
+		go func() {
+			automatic.Wait()
+			if !automaticSucceeded.Load() {
+				close(automaticFailed)
+			}
+		}()
+		go func() {
+			v := <-volumes
+			close(unlocked)
+			results <- unlockResult{volume: v}
+		}()
+	} else {
+		close(automaticFailed) // the ordered unlock runs the recovery key after the listed token methods
+		go func() {
+			v, err := unlockInOrder(d, methods, progress)
+			results <- unlockResult{v, err}
+		}()
 	}
 
-	v := <-volumes
+	v, err := waitForUnlock(dev, results, progress)
+	if err != nil {
+		if errors.Is(err, errUnlockTimeout) {
+			failBoot(err)
+		}
+		return err
+	}
 
 	if err := loadRequiredCryptoModules(v.StorageEncryption); err != nil {
 		return err
 	}
 
 	module.Wait()
-	return v.SetupMapper(mapping.name)
+	// hold root mount until the post-unlock hooks are finished
+	postUnlockHooksLock.RLock()
+	defer postUnlockHooksLock.RUnlock()
+	// with a detached header the volume is read from the header copy, the data is stored at the device itself
+	v.BackingDevice = dev
+	if err := v.SetupMapper(mapping.name); err != nil {
+		return err
+	}
+	writeUnlockRecord(v, mapping.name, d.UUID())
+	return runPostUnlockHooks(mapping.name, dev, d.UUID())
 }
 
 func loadRequiredCryptoModules(encryption string) error {
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// LUKS2 on-disk binary header, see https://gitlab.com/cryptsetup/LUKS2-docs
+type luks2BinaryHeader struct {
+	Magic        [6]byte
+	Version      uint16
+	HeaderSize   uint64
+	SeqID        uint64
+	Label        [48]byte
+	ChecksumAlg  [32]byte
+	Salt         [64]byte
+	UUID         [40]byte
+	Subsystem    [48]byte
+	HeaderOffset uint64
+	_            [184]byte
+	Checksum     [64]byte
+	_            [7 * 512]byte
+}
+
+const luks2BinaryHeaderSize = 4096
+
+// readLuks2Header reads the binary header at the offset and the JSON metadata area that follows it.
+// The header is only read, booster never writes LUKS metadata.
+func readLuks2Header(f *os.File, offset int64) (*luks2BinaryHeader, []byte, error) {
+	var hdr luks2BinaryHeader
+	if err := binary.Read(io.NewSectionReader(f, offset, luks2BinaryHeaderSize), binary.BigEndian, &hdr); err != nil {
+		return nil, nil, err
+	}
+	if hdr.Version != 2 {
+		return nil, nil, fmt.Errorf("LUKS version %d is not supported", hdr.Version)
+	}
+	if alg := fixedArrayToString(hdr.ChecksumAlg[:]); alg != "sha256" {
+		return nil, nil, fmt.Errorf("LUKS2 header checksum algorithm %s is not supported", alg)
+	}
+	if hdr.HeaderSize <= luks2BinaryHeaderSize || hdr.HeaderSize > 4*1024*1024 {
+		return nil, nil, fmt.Errorf("invalid LUKS2 header size %d", hdr.HeaderSize)
+	}
+
+	jsonArea := make([]byte, hdr.HeaderSize-luks2BinaryHeaderSize)
+	if _, err := f.ReadAt(jsonArea, offset+luks2BinaryHeaderSize); err != nil {
+		return nil, nil, err
+	}
+	return &hdr, jsonArea, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	luks2PrimaryMagic   = []byte("LUKS\xba\xbe")
+	luks2SecondaryMagic = []byte("SKUL\xba\xbe")
+)
+
+// luks2HeaderChecksum computes the checksum over the binary header (with zeroed checksum field) and JSON area
+func luks2HeaderChecksum(hdr *luks2BinaryHeader, jsonArea []byte) ([]byte, error) {
+	h := *hdr
+	h.Checksum = [64]byte{}
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, &h); err != nil {
+		return nil, err
+	}
+	buf.Write(jsonArea)
+	sum := sha256.Sum256(buf.Bytes())
+	return sum[:], nil
+}
+
+func writeTestLuks2Header(t *testing.T, path string, metadata string) {
+	const hdrSize = 16384
+
+	jsonArea := make([]byte, hdrSize-luks2BinaryHeaderSize)
+	copy(jsonArea, metadata)
+
+	var image bytes.Buffer
+	for i, magic := range [][]byte{luks2PrimaryMagic, luks2SecondaryMagic} {
+		var hdr luks2BinaryHeader
+		copy(hdr.Magic[:], magic)
+		hdr.Version = 2
+		hdr.HeaderSize = hdrSize
+		hdr.SeqID = 3
+		hdr.HeaderOffset = uint64(i * hdrSize)
+		copy(hdr.ChecksumAlg[:], "sha256")
+		sum, err := luks2HeaderChecksum(&hdr, jsonArea)
+		require.NoError(t, err)
+		copy(hdr.Checksum[:], sum)
+
+		require.NoError(t, binary.Write(&image, binary.BigEndian, &hdr))
+		image.Write(jsonArea)
+	}
+	require.NoError(t, os.WriteFile(path, image.Bytes(), 0o600))
+}
+
+func TestReadLuks2Header(t *testing.T) {
+	require.Equal(t, luks2BinaryHeaderSize, binary.Size(luks2BinaryHeader{}))
+
+	path := filepath.Join(t.TempDir(), "luks.img")
+	writeTestLuks2Header(t, path, `{"keyslots":{"0":{"type":"luks2"}},"tokens":{},"config":{"json_size":"12288"}}`)
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	for _, offset := range []int64{0, 16384} {
+		hdr, jsonArea, err := readLuks2Header(f, offset)
+		require.NoError(t, err)
+		require.Equal(t, uint64(3), hdr.SeqID)
+		require.Equal(t, uint64(offset), hdr.HeaderOffset)
+		require.Len(t, jsonArea, 16384-luks2BinaryHeaderSize)
+		require.True(t, bytes.HasPrefix(jsonArea, []byte(`{"keyslots":`)))
+	}
+
+	_, _, err = readLuks2Header(f, 512)
+	require.Error(t, err)
+}
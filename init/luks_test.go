@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// token payload in the format written by systemd-cryptenroll --fido2-device
+const testSystemdFido2Token = `{
+	"type": "systemd-fido2",
+	"keyslots": ["1"],
+	"fido2-credential": "tTSTQvVYGbiDlqP1M1FVSE4GBhf7yFErB7rXJtLqyapHYbCV7gjSlKLzW1hfcXroezdOpiGd5HnBWONtObZrMA==",
+	"fido2-salt": "Y0ea1poJCyWCd+yPum+ZQZov+ySJgVEGV8lEzNEUjpc=",
+	"fido2-rp": "io.systemd.cryptsetup",
+	"fido2-clientPin-required": true,
+	"fido2-up-required": true,
+	"fido2-uv-required": false
+}`
+
+func TestParseSystemdFido2Token(t *testing.T) {
+	tok, err := parseSystemdFido2Token([]byte(testSystemdFido2Token))
+	require.NoError(t, err)
+	require.Equal(t, &systemdFido2Token{
+		Credential:           "tTSTQvVYGbiDlqP1M1FVSE4GBhf7yFErB7rXJtLqyapHYbCV7gjSlKLzW1hfcXroezdOpiGd5HnBWONtObZrMA==",
+		Salt:                 "Y0ea1poJCyWCd+yPum+ZQZov+ySJgVEGV8lEzNEUjpc=",
+		RelyingParty:         "io.systemd.cryptsetup",
+		PinRequired:          true,
+		UserPresenceRequired: true,
+	}, tok)
+
+	// tokens enrolled by older systemd versions do not store the relying party
+	tok, err = parseSystemdFido2Token([]byte(`{"fido2-credential": "tTSTQvVY", "fido2-salt": "Y0ea1poJCyWCd+yPum+ZQZov+ySJgVEGV8lEzNEUjpc=", "fido2-uv-required": true}`))
+	require.NoError(t, err)
+	require.Equal(t, "io.systemd.cryptsetup", tok.RelyingParty)
+	require.True(t, tok.UserVerificationRequired)
+
+	_, err = parseSystemdFido2Token([]byte(`{"fido2-salt": "Y0ea1poJCyWCd+yPum+ZQZov+ySJgVEGV8lEzNEUjpc="}`))
+	require.EqualError(t, err, "fido2-credential is missing")
+	_, err = parseSystemdFido2Token([]byte(`{"fido2-credential": "tTSTQvVY"}`))
+	require.EqualError(t, err, "fido2-salt is missing")
+	_, err = parseSystemdFido2Token([]byte(`{"fido2-credential": "not base64!", "fido2-salt": "Y0ea1poJCyWCd+yPum+ZQZov+ySJgVEGV8lEzNEUjpc="}`))
+	require.Error(t, err)
+	_, err = parseSystemdFido2Token([]byte(`{"fido2-credential": "tTSTQvVY", "fido2-salt": "not base64!"}`))
+	require.Error(t, err)
+	_, err = parseSystemdFido2Token([]byte(`{"fido2-credential": "tTSTQvVY", "fido2-salt": "c2hvcnQ="}`))
+	require.EqualError(t, err, "fido2-salt is 5 bytes long, expected 32 bytes")
+	_, err = parseSystemdFido2Token([]byte(`{"fido2-credential": "tTSTQvVY", "fido2-salt": "Y0ea1poJCyWCd+yPum+ZQZov+ySJgVEGV8lEzNEUjpc=", "fido2-up-required": "yes"}`))
+	require.Error(t, err)
+}
+
+func TestSystemdFido2AssertInput(t *testing.T) {
+	tok, err := parseSystemdFido2Token([]byte(testSystemdFido2Token))
+	require.NoError(t, err)
+
+	// systemd uses all-zero client data hash, the credential and salt are passed as they are stored in the token
+	require.Equal(t, "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n"+
+		"io.systemd.cryptsetup\n"+
+		"tTSTQvVYGbiDlqP1M1FVSE4GBhf7yFErB7rXJtLqyapHYbCV7gjSlKLzW1hfcXroezdOpiGd5HnBWONtObZrMA==\n"+
+		"Y0ea1poJCyWCd+yPum+ZQZov+ySJgVEGV8lEzNEUjpc=\n",
+		fido2AssertInput(tok.RelyingParty, tok.Credential, tok.Salt))
+}
+
+func TestFido2HMACToPassphrase(t *testing.T) {
+	// the passphrase is the base64 encoded hmac-secret, the same as systemd-cryptenroll sets to the keyslot
+	password, err := fido2HMACToPassphrase([]byte("+czZK7avTLReQxE4Z+Ydqzmk56KgqImAqUAlBjd3MZk=\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, "+czZK7avTLReQxE4Z+Ydqzmk56KgqImAqUAlBjd3MZk=", string(password))
+
+	_, err = fido2HMACToPassphrase([]byte("c2hvcnQ="))
+	require.Error(t, err)
+	_, err = fido2HMACToPassphrase([]byte("not base64"))
+	require.Error(t, err)
+}
+
+func TestParseFido2PinRetries(t *testing.T) {
+	out := "proto: 0x02\nmajor: 0x05\nversion strings: U2F_V2, FIDO_2_0\nextension strings: credProtect, hmac-secret\nremaining rk(s): 25\npin retries: 7\n"
+	require.Equal(t, 7, parseFido2PinRetries([]byte(out)))
+	require.Equal(t, -1, parseFido2PinRetries([]byte("proto: 0x02\n")))
+	require.Equal(t, -1, parseFido2PinRetries([]byte("pin retries: undefined\n")))
+}
+
+func TestFido2ReportDescriptor(t *testing.T) {
+	// report descriptor of a Yubikey FIDO interface: Usage Page (FIDO Alliance), Usage (CTAPHID), Collection ...
+	fido := []byte{0x06, 0xd0, 0xf1, 0x09, 0x01, 0xa1, 0x01, 0x09, 0x20, 0x15, 0x00, 0x26, 0xff, 0x00, 0x75, 0x08, 0x95, 0x40, 0x81, 0x02, 0xc0}
+	require.True(t, isFido2ReportDescriptor(fido))
+
+	// keyboard: Usage Page (Generic Desktop), Usage (Keyboard), Collection (Application), Usage Page (Keyboard) ...
+	keyboard := []byte{0x05, 0x01, 0x09, 0x06, 0xa1, 0x01, 0x05, 0x07, 0x19, 0xe0, 0x29, 0xe7, 0xc0}
+	require.False(t, isFido2ReportDescriptor(keyboard))
+
+	// long item followed by FIDO usage page, and a truncated descriptor
+	require.True(t, isFido2ReportDescriptor(append([]byte{0xfe, 0x02, 0x10, 0xaa, 0xbb}, fido...)))
+	require.False(t, isFido2ReportDescriptor([]byte{0x06, 0xd0}))
+}
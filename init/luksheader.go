@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anatol/luks.go"
+)
+
+// A LUKS header might be detached from the encrypted data and stored e.g. at a USB stick. Such volume is specified with
+// rd.luks.header=$LUKS_UUID=$PATH[:$HEADERDEV] and rd.luks.data=$LUKS_UUID=$DATADEV, the same as systemd does.
+// The data device has no LUKS metadata so it is matched by the device reference rather than by the LUKS UUID.
+// The header is copied to tmpfs once the header device appears, so the device can be removed right after that.
+
+const (
+	luksHeaderDir = "/run/booster/luks-header"
+	// luksHeaderMaxSize is the max size of the header file, LUKS2 metadata and max keyslots area that cryptsetup supports
+	luksHeaderMaxSize = 2*4*1024*1024 + 128*1024*1024
+	// luksHeaderPromptDelay is the time after which the user is asked to insert the header device
+	luksHeaderPromptDelay = 5 * time.Second
+)
+
+// parseLuksHeaderParam parses rd.luks.header= value
+func parseLuksHeaderParam(value string) (UUID, *luksKeyfile, error) {
+	luksUUID, header, ok := strings.Cut(value, "=")
+	if !ok {
+		return nil, nil, fmt.Errorf("expected format is $UUID=$PATH[:$HEADERDEV]")
+	}
+	u, err := parseUUID(strings.TrimPrefix(luksUUID, "luks-"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid UUID %s: %v", luksUUID, err)
+	}
+	path, device, _ := strings.Cut(header, ":")
+	h, err := newLuksKeyfile(path, device, 0, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, h, nil
+}
+
+// parseLuksDataParam parses rd.luks.data= value
+func parseLuksDataParam(value string) (UUID, *deviceRef, error) {
+	luksUUID, data, ok := strings.Cut(value, "=")
+	if !ok {
+		return nil, nil, fmt.Errorf("expected format is $UUID=$DATADEV")
+	}
+	u, err := parseUUID(strings.TrimPrefix(luksUUID, "luks-"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid UUID %s: %v", luksUUID, err)
+	}
+	ref, err := parseDeviceRef(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, ref, nil
+}
+
+// matchLuksDataDevice returns the mapping with detached header that uses blk as the data device
+func matchLuksDataDevice(blk *blkInfo) *luksMapping {
+	for _, m := range luksMappings {
+		if m.header != nil && blk.matchesRef(m.data) {
+			return m
+		}
+	}
+	return nil
+}
+
+// copyLuksHeader copies the header file to dst. The copy is extended to the data device size as the data segment
+// size might be 'dynamic' i.e. calculated from the size of the file the header is read from.
+func copyLuksHeader(src, dst string, dataSize int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	n, err := io.Copy(out, io.LimitReader(in, luksHeaderMaxSize))
+	if err != nil {
+		return err
+	}
+	if dataSize > n {
+		// a sparse file, it does not use any memory
+		if err := out.Truncate(dataSize); err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// openDetachedHeader opens LUKS device using the detached header of the mapping. It waits for the header device
+// if the header is located at a removable device.
+func openDetachedHeader(mapping *luksMapping, dataDev string) (luks.Device, error) {
+	f, err := os.Open(dataDev)
+	if err != nil {
+		return nil, err
+	}
+	dataSize, err := f.Seek(0, io.SeekEnd)
+	_ = f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", dataDev, err)
+	}
+
+	if err := os.MkdirAll(luksHeaderDir, 0o700); err != nil {
+		return nil, err
+	}
+	uuid := mapping.ref.data.(UUID).toString()
+	path := filepath.Join(luksHeaderDir, uuid)
+
+	if mapping.header.device != nil {
+		prompt := time.AfterFunc(luksHeaderPromptDelay, func() {
+			console("Please insert device %s with LUKS header of %s\n", mapping.header.deviceName, dataDev)
+		})
+		defer prompt.Stop()
+	}
+	err = mapping.header.withFile(0, func(header string) error {
+		return copyLuksHeader(header, path, dataSize)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("LUKS header %s: %v", mapping.header, err)
+	}
+
+	d, err := luks.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("LUKS header %s: %v", mapping.header, err)
+	}
+	if u, err := parseUUID(d.UUID()); err != nil || u.toString() != uuid {
+		_ = d.Close()
+		return nil, fmt.Errorf("LUKS header %s has UUID %s, expected %s", mapping.header, d.UUID(), uuid)
+	}
+	return d, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLuksHeaderParam(t *testing.T) {
+	const luksUUID = "2a9f1e2c-4ba5-4c1c-8b66-3d1e1c7f6d2a"
+
+	uuid, h, err := parseLuksHeaderParam(luksUUID + "=/etc/root.hdr")
+	require.NoError(t, err)
+	require.Equal(t, luksUUID, uuid.toString())
+	require.Equal(t, "/etc/root.hdr", h.path)
+	require.Nil(t, h.device)
+
+	uuid, h, err = parseLuksHeaderParam("luks-" + luksUUID + "=/root.hdr:UUID=8fba3c8a-3ef6-4a45-a9f4-0f1b2f5e9d10")
+	require.NoError(t, err)
+	require.Equal(t, luksUUID, uuid.toString())
+	require.Equal(t, refFsUUID, h.device.format)
+
+	_, _, err = parseLuksHeaderParam("/root.hdr")
+	require.Error(t, err)
+	_, _, err = parseLuksHeaderParam(luksUUID + "=root.hdr")
+	require.Error(t, err)
+}
+
+func TestParseLuksDataParam(t *testing.T) {
+	const luksUUID = "2a9f1e2c-4ba5-4c1c-8b66-3d1e1c7f6d2a"
+
+	uuid, ref, err := parseLuksDataParam(luksUUID + "=/dev/sda2")
+	require.NoError(t, err)
+	require.Equal(t, luksUUID, uuid.toString())
+	require.Equal(t, &deviceRef{refPath, "/dev/sda2"}, ref)
+
+	_, _, err = parseLuksDataParam("/dev/sda2")
+	require.Error(t, err)
+}
+
+func TestCopyLuksHeader(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "header")
+	dst := filepath.Join(dir, "copy")
+	header := []byte("LUKS\xba\xbe\x00\x02")
+	require.NoError(t, os.WriteFile(src, header, 0o600))
+
+	// the copy is extended to the data device size
+	require.NoError(t, copyLuksHeader(src, dst, 4096))
+	data, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	require.Len(t, data, 4096)
+	require.Equal(t, header, data[:len(header)])
+
+	require.NoError(t, copyLuksHeader(src, dst, 0))
+	data, err = os.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, header, data)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anatol/luks.go"
+)
+
+// Some deployments keep unlock metadata (tokens) outside of the LUKS header, e.g. on a small plaintext boot partition.
+// booster.luks_meta=UUID=$UUID:/path.json points to such a file, tokens from the file are used instead of the tokens
+// stored in the LUKS header of the matching volumes. The file might be gzip compressed. Its format is
+//
+//	{"volumes": [{"uuid": "$LUKS_UUID", "tokens": [{"type": "systemd-tpm2", "keyslots": ["1"], ...}]}]}
+//
+// where tokens use the same format as LUKS2 header tokens.
+
+type luksMetaSource struct {
+	device *deviceRef // nil if the file is located in the image
+	path   string
+}
+
+var (
+	luksMeta       *luksMetaSource
+	luksMetaLoaded sync.WaitGroup // done once the metadata file is read
+	luksMetaOnce   sync.Once
+	luksMetaTokens map[string][]luks.Token // LUKS UUID -> tokens
+	luksMetaErr    error
+
+	luksMetaMountDir = "/run/booster/luks-meta"
+)
+
+func parseLuksMetaParam(value string) (*luksMetaSource, error) {
+	if strings.HasPrefix(value, "/") {
+		return &luksMetaSource{path: value}, nil
+	}
+	idx := strings.Index(value, ":/")
+	if idx == -1 {
+		return nil, fmt.Errorf("expected format is UUID=$UUID:/path or /path")
+	}
+	ref, err := parseDeviceRef(value[:idx])
+	if err != nil {
+		return nil, err
+	}
+	return &luksMetaSource{device: ref, path: value[idx+1:]}, nil
+}
+
+type luksMetaToken struct {
+	Type     string   `json:"type"`
+	Keyslots []string `json:"keyslots"`
+}
+
+// parseLuksMeta parses (optionally gzip compressed) metadata file content
+func parseLuksMeta(data []byte) (map[string][]luks.Token, error) {
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data, err = io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %v", err)
+		}
+	}
+
+	var meta struct {
+		Volumes []struct {
+			UUID   string            `json:"uuid"`
+			Tokens []json.RawMessage `json:"tokens"`
+		} `json:"volumes"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&meta); err != nil {
+		return nil, err
+	}
+	if len(meta.Volumes) == 0 {
+		return nil, fmt.Errorf("no volumes defined")
+	}
+
+	result := make(map[string][]luks.Token)
+	for i, v := range meta.Volumes {
+		u, err := parseUUID(v.UUID)
+		if err != nil {
+			return nil, fmt.Errorf("volume #%d: invalid uuid '%s'", i, v.UUID)
+		}
+		uuid := u.toString()
+		if _, ok := result[uuid]; ok {
+			return nil, fmt.Errorf("volume %s is specified twice", uuid)
+		}
+		if len(v.Tokens) == 0 {
+			return nil, fmt.Errorf("volume %s: no tokens defined", uuid)
+		}
+
+		var tokens []luks.Token
+		for id, payload := range v.Tokens {
+			var t luksMetaToken
+			if err := json.Unmarshal(payload, &t); err != nil {
+				return nil, fmt.Errorf("volume %s token #%d: %v", uuid, id, err)
+			}
+			if t.Type == "" {
+				return nil, fmt.Errorf("volume %s token #%d: type is not specified", uuid, id)
+			}
+			if len(t.Keyslots) == 0 {
+				return nil, fmt.Errorf("volume %s token #%d: keyslots are not specified", uuid, id)
+			}
+			var slots []int
+			for _, k := range t.Keyslots {
+				s, err := strconv.Atoi(k)
+				if err != nil || s < 0 {
+					return nil, fmt.Errorf("volume %s token #%d: invalid keyslot '%s'", uuid, id, k)
+				}
+				slots = append(slots, s)
+			}
+			tokens = append(tokens, luks.Token{ID: id, Slots: slots, Type: t.Type, Payload: payload})
+		}
+		result[uuid] = tokens
+	}
+	return result, nil
+}
+
+// readLuksMetaFile reads the metadata file, if it is located at a block device then the device is mounted read-only
+// for the time of reading
+func readLuksMetaFile(src *luksMetaSource, blk *blkInfo) ([]byte, error) {
+	if blk == nil {
+		return os.ReadFile(src.path)
+	}
+
+	var data []byte
+	err := withReadOnlyMount(blk, luksMetaMountDir, func() error {
+		var err error
+		data, err = os.ReadFile(filepath.Join(luksMetaMountDir, src.path))
+		return err
+	})
+	return data, err
+}
+
+// loadLuksMeta reads and parses the metadata file. blk is the device with the file or nil if the file is in the image.
+func loadLuksMeta(blk *blkInfo) {
+	luksMetaOnce.Do(func() {
+		defer luksMetaLoaded.Done()
+
+		data, err := readLuksMetaFile(luksMeta, blk)
+		if err != nil {
+			luksMetaErr = fmt.Errorf("luks_meta: unable to read %s: %v", luksMeta.path, err)
+			return
+		}
+		luksMetaTokens, err = parseLuksMeta(data)
+		if err != nil {
+			luksMetaErr = fmt.Errorf("luks_meta: invalid metadata file %s: %v", luksMeta.path, err)
+			return
+		}
+		info("luks_meta: loaded tokens for %d volume(s) from %s", len(luksMetaTokens), luksMeta.path)
+	})
+}
+
+// volumeTokens returns tokens of the LUKS device, either from booster.luks_meta file or from the LUKS header
+func volumeTokens(d luks.Device) ([]luks.Token, error) {
+	if luksMeta == nil {
+		return d.Tokens()
+	}
+
+	info("waiting for luks_meta file %s", luksMeta.path)
+	luksMetaLoaded.Wait()
+	if luksMetaErr != nil {
+		return nil, luksMetaErr
+	}
+	u, err := parseUUID(d.UUID())
+	if err != nil {
+		return nil, err
+	}
+	tokens, ok := luksMetaTokens[u.toString()]
+	if !ok {
+		debug("luks_meta: no tokens for %s, using the LUKS header tokens", d.UUID())
+		return d.Tokens()
+	}
+	return tokens, nil
+}
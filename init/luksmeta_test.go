@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLuksMetaParam(t *testing.T) {
+	src, err := parseLuksMetaParam("UUID=639b8fdd-36ba-443e-be3e-e5b335935502:/luks/meta.json")
+	require.NoError(t, err)
+	require.Equal(t, "/luks/meta.json", src.path)
+	require.Equal(t, refFsUUID, src.device.format)
+
+	src, err = parseLuksMetaParam("/etc/luks-meta.json")
+	require.NoError(t, err)
+	require.Nil(t, src.device)
+
+	_, err = parseLuksMetaParam("UUID=639b8fdd-36ba-443e-be3e-e5b335935502")
+	require.Error(t, err)
+}
+
+func TestParseLuksMeta(t *testing.T) {
+	meta := `{"volumes": [{"uuid": "2A9F1E2C-4BA5-4C1C-8B66-3D1E1C7F6D2A", "tokens": [
+		{"type": "systemd-tpm2", "keyslots": ["1"], "tpm2-pcrs": [7]},
+		{"type": "systemd-fido2", "keyslots": ["2", "3"]}
+	]}]}`
+	tokens, err := parseLuksMeta([]byte(meta))
+	require.NoError(t, err)
+	volume := tokens["2a9f1e2c-4ba5-4c1c-8b66-3d1e1c7f6d2a"]
+	require.Len(t, volume, 2)
+	require.Equal(t, "systemd-tpm2", volume[0].Type)
+	require.Equal(t, []int{1}, volume[0].Slots)
+	require.Contains(t, string(volume[0].Payload), `"tpm2-pcrs": [7]`)
+	require.Equal(t, 1, volume[1].ID)
+	require.Equal(t, []int{2, 3}, volume[1].Slots)
+
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	_, err = w.Write([]byte(meta))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	gzTokens, err := parseLuksMeta(compressed.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, tokens, gzTokens)
+
+	for _, invalid := range []string{
+		`{"volumes": []}`,
+		`{"volumes": [{"uuid": "foo", "tokens": [{"type": "clevis", "keyslots": ["0"]}]}]}`,
+		`{"volumes": [{"uuid": "2a9f1e2c-4ba5-4c1c-8b66-3d1e1c7f6d2a", "tokens": [{"keyslots": ["0"]}]}]}`,
+		`{"volumes": [{"uuid": "2a9f1e2c-4ba5-4c1c-8b66-3d1e1c7f6d2a", "tokens": [{"type": "clevis", "keyslots": ["x"]}]}]}`,
+		`{"volumes": [{"uuid": "2a9f1e2c-4ba5-4c1c-8b66-3d1e1c7f6d2a", "tokens": [{"type": "clevis"}]}]}`,
+		`{"volume": []}`,
+	} {
+		_, err := parseLuksMeta([]byte(invalid))
+		require.Error(t, err, invalid)
+	}
+}
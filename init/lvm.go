@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// LVM volume group might span multiple physical volumes e.g. several LUKS devices. 'pvscan -aay' activates the group
+// only once all its physical volumes are scanned, until then root logical volume does not appear.
+
+func handleLvmBlockDevice(blk *blkInfo) error {
+	if !config.EnableLVM {
+		info("LVM support is disabled, ignoring lvm physical volume %s", blk.path)
+		return nil
+	}
+
+	if config.LvmNative {
+		return handleLvmNativeDevice(blk)
+	}
+
+	info("scanning lvm physical volume %s", blk.path)
+	cmd := exec.Command("lvm", "pvscan", "--cache", "-aay", blk.path)
+	if verbosityLevel >= levelDebug {
+		cmd.Stdout = os.Stdout
+	}
+	if err := unwrapExitError(cmd.Run()); err != nil {
+		return err
+	}
+
+	groups, err := lvmIncompleteGroups()
+	if err != nil {
+		debug("lvm: %v", err)
+		return nil
+	}
+	for _, g := range groups {
+		info("lvm volume group %s is not complete yet, waiting for %d more physical volume(s)", g.name, len(g.missing))
+	}
+	return nil
+}
+
+// lvmDeviceLink returns /dev/VG/LV path for the device mapper device of a logical volume. Internal devices
+// (e.g. thin pool or snapshot layers) have a suffix in their UUID and do not get a link.
+func lvmDeviceLink(dmName, dmUUID string) (string, bool) {
+	const uuidLen = 32
+	if !strings.HasPrefix(dmUUID, "LVM-") || len(dmUUID) != len("LVM-")+2*uuidLen {
+		return "", false
+	}
+	// dashes in VG and LV names are doubled
+	for i := 0; i < len(dmName); i++ {
+		if dmName[i] != '-' {
+			continue
+		}
+		if i+1 < len(dmName) && dmName[i+1] == '-' {
+			i++
+			continue
+		}
+		vg := strings.ReplaceAll(dmName[:i], "--", "-")
+		lv := strings.ReplaceAll(dmName[i+1:], "--", "-")
+		return "/dev/" + vg + "/" + lv, true
+	}
+	return "", false
+}
+
+type lvmGroup struct {
+	name    string
+	missing []string // UUIDs of physical volumes that are not present
+}
+
+// parseLvmPhysicalVolumes parses output of 'lvm pvs --noheadings --separator : -o vg_name,pv_uuid,pv_missing'
+// and returns groups that have missing physical volumes
+func parseLvmPhysicalVolumes(out string) []lvmGroup {
+	missing := make(map[string][]string)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ":")
+		if len(fields) != 3 || fields[0] == "" {
+			continue // orphan physical volume
+		}
+		vg, uuid, state := fields[0], fields[1], fields[2]
+		if state == "missing" {
+			missing[vg] = append(missing[vg], uuid)
+		}
+	}
+
+	groups := make([]lvmGroup, 0, len(missing))
+	for vg, uuids := range missing {
+		groups = append(groups, lvmGroup{name: vg, missing: uuids})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].name < groups[j].name })
+	return groups
+}
+
+func lvmIncompleteGroups() ([]lvmGroup, error) {
+	if config.LvmNative {
+		return lvmNativeIncompleteGroups(), nil
+	}
+	out, err := exec.Command("lvm", "pvs", "--noheadings", "--separator", ":", "-o", "vg_name,pv_uuid,pv_missing").Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list physical volumes: %v", unwrapExitError(err))
+	}
+	return parseLvmPhysicalVolumes(string(out)), nil
+}
+
+// printIncompleteLvmGroups explains why a logical volume did not appear
+func printIncompleteLvmGroups() {
+	if !config.EnableLVM {
+		return
+	}
+	groups, err := lvmIncompleteGroups()
+	if err != nil {
+		warning("lvm: %v", err)
+		return
+	}
+	for _, g := range groups {
+		warning("lvm volume group %s was not activated, physical volumes [%s] are missing. Make sure all the disks are connected and all encrypted devices of the group are unlocked (specify them with rd.luks.uuid=)", g.name, strings.Join(g.missing, " "))
+	}
+}
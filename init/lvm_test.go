@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLvmPhysicalVolumes(t *testing.T) {
+	out := `  data:cX5vrN-0Ph0-yqC5-lHoS-c3dU-1y2J-iZKpsl:
+  data:eTq6pf-tbfI-Qbe0-OKTk-pmOZ-1k3X-gc2Qm5:missing
+  root:W1vJtT-6bDe-tXkI-x2yo-0iRu-yZLC-Ft6CIP:
+  :J0Msjd-7Nx5-a4kS-1b5L-2VhY-Br2a-qrNwpE:
+  backup:Yc3I8e-Q4HP-3lXT-qDPs-Jk6G-xqFJ-Rz4R1u:missing
+  data:aD5dVg-lZ3v-ql8G-YCSv-jbrl-9cAQ-1Ybbze:missing
+`
+	require.Equal(t, []lvmGroup{
+		{name: "backup", missing: []string{"Yc3I8e-Q4HP-3lXT-qDPs-Jk6G-xqFJ-Rz4R1u"}},
+		{name: "data", missing: []string{"eTq6pf-tbfI-Qbe0-OKTk-pmOZ-1k3X-gc2Qm5", "aD5dVg-lZ3v-ql8G-YCSv-jbrl-9cAQ-1Ybbze"}},
+	}, parseLvmPhysicalVolumes(out))
+
+	require.Empty(t, parseLvmPhysicalVolumes(""))
+}
+
+func TestLvmDeviceLink(t *testing.T) {
+	const uuid = "LVM-Ivxo3ss2LlJ3wd0b9V1m7OyXqVzv1LFJdA8hpUQbQvXHbKdQmKqXOmtYn2RnSxLe"
+
+	link, ok := lvmDeviceLink("vg-root", uuid)
+	require.True(t, ok)
+	require.Equal(t, "/dev/vg/root", link)
+
+	link, ok = lvmDeviceLink("my--vg-my--root", uuid)
+	require.True(t, ok)
+	require.Equal(t, "/dev/my-vg/my-root", link)
+
+	// internal devices
+	_, ok = lvmDeviceLink("vg-pool-tpool", uuid+"-tpool")
+	require.False(t, ok)
+	_, ok = lvmDeviceLink("luks-root", "CRYPT-LUKS2-foo")
+	require.False(t, ok)
+}
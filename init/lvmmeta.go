@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Reading LVM2 on-disk format: PV label, metadata area and the volume group metadata in LVM text config format.
+// See lib/format_text/layout.h in LVM2 sources.
+
+const (
+	lvmSectorSize     = 512
+	lvmLabelScanSize  = 4 // label is located in one of the first 4 sectors
+	lvmMdaHeaderSize  = 512
+	lvmMdaMagic       = " LVM2 x[5A%r0N*>"
+	lvmMaxMetadataLen = 16 * 1024 * 1024
+)
+
+// readLvmPhysicalVolume reads the PV UUID (without dashes) and the most recent VG metadata text from the device
+func readLvmPhysicalVolume(path string) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, lvmLabelScanSize*lvmSectorSize)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return "", "", err
+	}
+	var label []byte
+	for i := 0; i < lvmLabelScanSize; i++ {
+		sector := buf[i*lvmSectorSize : (i+1)*lvmSectorSize]
+		if bytes.Equal(sector[0:8], []byte("LABELONE")) && bytes.Equal(sector[24:32], []byte("LVM2 001")) {
+			label = sector
+			break
+		}
+	}
+	if label == nil {
+		return "", "", fmt.Errorf("LVM label is not found")
+	}
+
+	// pv_header: pv_uuid[32], device_size, list of data areas, list of metadata areas. Both lists are zero terminated.
+	offset := binary.LittleEndian.Uint32(label[20:24])
+	if offset >= lvmSectorSize-32 {
+		return "", "", fmt.Errorf("invalid pv header offset %d", offset)
+	}
+	pvHeader := label[offset:]
+	pvUUID := string(pvHeader[0:32])
+
+	areas := pvHeader[40:]
+	readLocation := func() (uint64, uint64, bool) {
+		if len(areas) < 16 {
+			return 0, 0, false
+		}
+		off, size := binary.LittleEndian.Uint64(areas[0:8]), binary.LittleEndian.Uint64(areas[8:16])
+		areas = areas[16:]
+		return off, size, off != 0 || size != 0
+	}
+	for { // skip data areas
+		if _, _, ok := readLocation(); !ok {
+			break
+		}
+	}
+	mdaOffset, _, ok := readLocation()
+	if !ok {
+		return pvUUID, "", nil // PV without metadata area
+	}
+
+	metadata, err := readLvmMetadataArea(f, int64(mdaOffset))
+	return pvUUID, metadata, err
+}
+
+// readLvmMetadataArea reads the current metadata text from the circular buffer of the metadata area
+func readLvmMetadataArea(f *os.File, mdaOffset int64) (string, error) {
+	header := make([]byte, lvmMdaHeaderSize)
+	if _, err := f.ReadAt(header, mdaOffset); err != nil {
+		return "", err
+	}
+	if string(header[4:20]) != lvmMdaMagic {
+		return "", fmt.Errorf("invalid metadata area magic")
+	}
+	mdaSize := binary.LittleEndian.Uint64(header[32:40])
+	// the first raw location points to the committed metadata
+	textOffset := binary.LittleEndian.Uint64(header[40:48])
+	textSize := binary.LittleEndian.Uint64(header[48:56])
+	if textOffset == 0 || textSize == 0 {
+		return "", nil
+	}
+	if textSize > lvmMaxMetadataLen || textOffset >= mdaSize || mdaSize <= lvmMdaHeaderSize {
+		return "", fmt.Errorf("invalid metadata location")
+	}
+
+	text := make([]byte, textSize)
+	first := textSize
+	if textOffset+textSize > mdaSize {
+		first = mdaSize - textOffset
+	}
+	if _, err := f.ReadAt(text[:first], mdaOffset+int64(textOffset)); err != nil {
+		return "", err
+	}
+	if first < textSize {
+		// the text wraps around the end of the buffer and continues right after the header
+		if _, err := f.ReadAt(text[first:], mdaOffset+lvmMdaHeaderSize); err != nil {
+			return "", err
+		}
+	}
+	return string(bytes.TrimRight(text, "\x00")), nil
+}
+
+// lvmSection is a section of LVM text config. Values are string, int64, []interface{} or lvmSection.
+type lvmSection map[string]interface{}
+
+func (s lvmSection) str(key string) string {
+	v, _ := s[key].(string)
+	return v
+}
+
+func (s lvmSection) int(key string) int64 {
+	v, _ := s[key].(int64)
+	return v
+}
+
+func (s lvmSection) section(key string) lvmSection {
+	v, _ := s[key].(lvmSection)
+	return v
+}
+
+func (s lvmSection) list(key string) []interface{} {
+	v, _ := s[key].([]interface{})
+	return v
+}
+
+func (s lvmSection) hasFlag(key, flag string) bool {
+	for _, v := range s.list(key) {
+		if v == flag {
+			return true
+		}
+	}
+	return false
+}
+
+type lvmConfigParser struct {
+	data string
+	pos  int
+}
+
+// parseLvmConfig parses LVM text config format e.g. volume group metadata
+func parseLvmConfig(data string) (lvmSection, error) {
+	p := &lvmConfigParser{data: data}
+	s, err := p.parseSection(false)
+	if err != nil {
+		return nil, fmt.Errorf("lvm metadata at offset %d: %v", p.pos, err)
+	}
+	return s, nil
+}
+
+func (p *lvmConfigParser) skipSpaces() {
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if c == '#' {
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+		} else if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			p.pos++
+		} else {
+			break
+		}
+	}
+}
+
+func isLvmIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("_.+-", c) != -1
+}
+
+func (p *lvmConfigParser) parseIdent() (string, error) {
+	start := p.pos
+	for p.pos < len(p.data) && isLvmIdentChar(p.data[p.pos]) {
+		p.pos++
+	}
+	if start == p.pos {
+		return "", fmt.Errorf("identifier expected")
+	}
+	return p.data[start:p.pos], nil
+}
+
+func (p *lvmConfigParser) parseSection(nested bool) (lvmSection, error) {
+	s := make(lvmSection)
+	for {
+		p.skipSpaces()
+		if p.pos == len(p.data) {
+			if nested {
+				return nil, fmt.Errorf("unexpected end of data")
+			}
+			return s, nil
+		}
+		if p.data[p.pos] == '}' {
+			if !nested {
+				return nil, fmt.Errorf("unexpected '}'")
+			}
+			p.pos++
+			return s, nil
+		}
+		key, err := p.parseIdent()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpaces()
+		if p.pos == len(p.data) {
+			return nil, fmt.Errorf("unexpected end of data")
+		}
+		switch p.data[p.pos] {
+		case '{':
+			p.pos++
+			sub, err := p.parseSection(true)
+			if err != nil {
+				return nil, err
+			}
+			s[key] = sub
+		case '=':
+			p.pos++
+			p.skipSpaces()
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			s[key] = v
+		default:
+			return nil, fmt.Errorf("'=' or '{' expected after %s", key)
+		}
+	}
+}
+
+func (p *lvmConfigParser) parseValue() (interface{}, error) {
+	if p.pos == len(p.data) {
+		return nil, fmt.Errorf("value expected")
+	}
+	switch c := p.data[p.pos]; {
+	case c == '"':
+		var sb strings.Builder
+		for p.pos++; p.pos < len(p.data); p.pos++ {
+			c := p.data[p.pos]
+			if c == '\\' && p.pos+1 < len(p.data) {
+				p.pos++
+				sb.WriteByte(p.data[p.pos])
+			} else if c == '"' {
+				p.pos++
+				return sb.String(), nil
+			} else {
+				sb.WriteByte(c)
+			}
+		}
+		return nil, fmt.Errorf("unterminated string")
+	case c == '[':
+		p.pos++
+		var list []interface{}
+		for {
+			p.skipSpaces()
+			if p.pos < len(p.data) && p.data[p.pos] == ']' {
+				p.pos++
+				return list, nil
+			}
+			if len(list) > 0 {
+				if p.pos == len(p.data) || p.data[p.pos] != ',' {
+					return nil, fmt.Errorf("',' expected")
+				}
+				p.pos++
+				p.skipSpaces()
+			}
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+	default:
+		tok, err := p.parseIdent()
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseInt(tok, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", tok)
+		}
+		return n, nil
+	}
+}
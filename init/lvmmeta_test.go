@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLvmConfig(t *testing.T) {
+	config, err := parseLvmConfig(`vg0 {
+id = "jLyt3A-gR1r-ZtNf-2oKI-7lJx-ypxa-QZE7t3"
+seqno = 3
+status = ["RESIZEABLE", "READ", "WRITE"] # comment
+extent_size = 8192
+
+physical_volumes {
+pv0 {
+id = "W1vJtT-6bDe-tXkI-x2yo-0iRu-yZLC-Ft6CIP"
+device = "/dev/sda2"
+pe_start = 2048
+}
+}
+}
+# Generated by LVM2
+contents = "Text Format Volume Group"
+description = "quoted \"text\""
+`)
+	require.NoError(t, err)
+	require.Equal(t, "Text Format Volume Group", config.str("contents"))
+	require.Equal(t, `quoted "text"`, config.str("description"))
+
+	vg := config.section("vg0")
+	require.Equal(t, int64(3), vg.int("seqno"))
+	require.Equal(t, []interface{}{"RESIZEABLE", "READ", "WRITE"}, vg.list("status"))
+	require.True(t, vg.hasFlag("status", "WRITE"))
+	require.Equal(t, int64(2048), vg.section("physical_volumes").section("pv0").int("pe_start"))
+
+	_, err = parseLvmConfig(`vg0 { id = "foo"`)
+	require.Error(t, err)
+	_, err = parseLvmConfig(`vg0 { stripes = ["pv0" 0] }`)
+	require.Error(t, err)
+}
+
+func TestReadLvmPhysicalVolume(t *testing.T) {
+	const (
+		pvUUID    = "W1vJtT6bDetXkIx2yo0iRuyZLCFt6CIP"
+		mdaOffset = 4096
+		mdaSize   = 1024 * 1024
+	)
+	metadata := `vg0 { id = "foo" seqno = 1 }`
+
+	disk := make([]byte, mdaOffset+mdaSize)
+	label := disk[512:]
+	copy(label, "LABELONE")
+	binary.LittleEndian.PutUint64(label[8:], 1)
+	binary.LittleEndian.PutUint32(label[20:], 32)
+	copy(label[24:], "LVM2 001")
+	pvHeader := label[32:]
+	copy(pvHeader, pvUUID)
+	binary.LittleEndian.PutUint64(pvHeader[32:], uint64(len(disk)))
+	// data area, terminator, metadata area, terminator
+	binary.LittleEndian.PutUint64(pvHeader[40:], 1024*1024)
+	binary.LittleEndian.PutUint64(pvHeader[72:], mdaOffset)
+	binary.LittleEndian.PutUint64(pvHeader[80:], mdaSize)
+
+	// the metadata text wraps around the end of the circular buffer
+	mda := disk[mdaOffset:]
+	copy(mda[4:], lvmMdaMagic)
+	binary.LittleEndian.PutUint64(mda[24:], mdaOffset)
+	binary.LittleEndian.PutUint64(mda[32:], mdaSize)
+	textOffset := mdaSize - 10
+	binary.LittleEndian.PutUint64(mda[40:], uint64(textOffset))
+	binary.LittleEndian.PutUint64(mda[48:], uint64(len(metadata)))
+	copy(mda[textOffset:], metadata[:10])
+	copy(mda[lvmMdaHeaderSize:], metadata[10:])
+
+	path := filepath.Join(t.TempDir(), "pv.img")
+	require.NoError(t, os.WriteFile(path, disk, 0o600))
+
+	id, text, err := readLvmPhysicalVolume(path)
+	require.NoError(t, err)
+	require.Equal(t, pvUUID, id)
+	require.Equal(t, metadata, text)
+}
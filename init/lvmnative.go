@@ -0,0 +1,466 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Native LVM activation (lvm_native config option) reads the volume group metadata from physical volumes and creates
+// device mapper devices the same way as 'lvm vgchange -ay' does, without shipping lvm2 tools in the image.
+// Linear/striped volumes, thin pools with thin volumes (including thin snapshots) and old-style snapshots are supported.
+
+type lvmStripe struct {
+	pv     string // physical volume name in the metadata, e.g. pv0
+	extent uint64
+}
+
+type lvmSegment struct {
+	startExtent, extentCount uint64
+	typ                      string
+
+	// striped
+	stripes    []lvmStripe
+	stripeSize uint64 // in sectors
+
+	// thin-pool
+	metadata, pool string
+	chunkSize      uint64 // in sectors, also used by snapshot
+	zeroNewBlocks  bool
+	discards       string
+
+	// thin
+	thinPool string
+	deviceID int64
+
+	// snapshot
+	origin, cowStore string
+}
+
+type lvmLogicalVolume struct {
+	name, id string
+	visible  bool
+	segments []lvmSegment
+}
+
+type lvmPhysicalVolume struct {
+	id      string // without dashes
+	peStart uint64 // in sectors
+}
+
+type lvmVolumeGroup struct {
+	name, id   string
+	seqno      int64
+	extentSize uint64 // in sectors
+	pvs        map[string]lvmPhysicalVolume
+	lvs        map[string]*lvmLogicalVolume
+}
+
+// parseLvmVolumeGroup converts VG metadata text to the volume group description
+func parseLvmVolumeGroup(text string) (*lvmVolumeGroup, error) {
+	config, err := parseLvmConfig(text)
+	if err != nil {
+		return nil, err
+	}
+
+	var vg *lvmVolumeGroup
+	for name, v := range config {
+		s, ok := v.(lvmSection)
+		if !ok {
+			continue
+		}
+		if vg != nil {
+			return nil, fmt.Errorf("metadata contains more than one volume group")
+		}
+		vg = &lvmVolumeGroup{
+			name:       name,
+			id:         s.str("id"),
+			seqno:      s.int("seqno"),
+			extentSize: uint64(s.int("extent_size")),
+			pvs:        make(map[string]lvmPhysicalVolume),
+			lvs:        make(map[string]*lvmLogicalVolume),
+		}
+		if vg.extentSize == 0 {
+			return nil, fmt.Errorf("volume group %s: invalid extent size", name)
+		}
+		for pvName, v := range s.section("physical_volumes") {
+			pv, ok := v.(lvmSection)
+			if !ok {
+				continue
+			}
+			vg.pvs[pvName] = lvmPhysicalVolume{id: strings.ReplaceAll(pv.str("id"), "-", ""), peStart: uint64(pv.int("pe_start"))}
+		}
+		for lvName, v := range s.section("logical_volumes") {
+			lv, ok := v.(lvmSection)
+			if !ok {
+				continue
+			}
+			l, err := parseLvmLogicalVolume(lvName, lv)
+			if err != nil {
+				return nil, fmt.Errorf("logical volume %s/%s: %v", name, lvName, err)
+			}
+			vg.lvs[lvName] = l
+		}
+	}
+	if vg == nil {
+		return nil, fmt.Errorf("no volume group found in metadata")
+	}
+	return vg, nil
+}
+
+func parseLvmLogicalVolume(name string, s lvmSection) (*lvmLogicalVolume, error) {
+	lv := &lvmLogicalVolume{name: name, id: s.str("id"), visible: s.hasFlag("status", "VISIBLE")}
+	for i := int64(1); i <= s.int("segment_count"); i++ {
+		seg := s.section("segment" + strconv.FormatInt(i, 10))
+		if seg == nil {
+			return nil, fmt.Errorf("segment%d is not found", i)
+		}
+		l := lvmSegment{
+			startExtent: uint64(seg.int("start_extent")),
+			extentCount: uint64(seg.int("extent_count")),
+			typ:         seg.str("type"),
+			stripeSize:  uint64(seg.int("stripe_size")),
+			metadata:    seg.str("metadata"),
+			pool:        seg.str("pool"),
+			chunkSize:   uint64(seg.int("chunk_size")),
+			discards:    seg.str("discards"),
+			thinPool:    seg.str("thin_pool"),
+			deviceID:    seg.int("device_id"),
+			origin:      seg.str("origin"),
+			cowStore:    seg.str("cow_store"),
+		}
+		l.zeroNewBlocks = seg.int("zero_new_blocks") != 0
+		stripes := seg.list("stripes")
+		for j := 0; j+1 < len(stripes); j += 2 {
+			pv, _ := stripes[j].(string)
+			extent, _ := stripes[j+1].(int64)
+			l.stripes = append(l.stripes, lvmStripe{pv: pv, extent: uint64(extent)})
+		}
+		lv.segments = append(lv.segments, l)
+	}
+	return lv, nil
+}
+
+// dmName returns device mapper name of the logical volume, dashes are doubled the same way as lvm does
+func (vg *lvmVolumeGroup) dmName(lv string, layer string) string {
+	name := strings.ReplaceAll(vg.name, "-", "--") + "-" + strings.ReplaceAll(lv, "-", "--")
+	if layer != "" {
+		name += "-" + layer
+	}
+	return name
+}
+
+func (vg *lvmVolumeGroup) dmUUID(lv *lvmLogicalVolume, layer string) string {
+	uuid := "LVM-" + strings.ReplaceAll(vg.id, "-", "") + strings.ReplaceAll(lv.id, "-", "")
+	if layer != "" {
+		uuid += "-" + layer
+	}
+	return uuid
+}
+
+// size returns size of the logical volume in sectors
+func (vg *lvmVolumeGroup) size(lv *lvmLogicalVolume) uint64 {
+	var extents uint64
+	for _, s := range lv.segments {
+		extents += s.extentCount
+	}
+	return extents * vg.extentSize
+}
+
+// stripedTargets builds linear/striped targets of the logical volume. pvPath returns the device of the physical volume.
+func (vg *lvmVolumeGroup) stripedTargets(lv *lvmLogicalVolume, pvPath func(id string) string) ([]dmTarget, error) {
+	var targets []dmTarget
+	for _, s := range lv.segments {
+		if s.typ != "striped" {
+			return nil, fmt.Errorf("unsupported segment type %s", s.typ)
+		}
+		if len(s.stripes) == 0 || s.extentCount%uint64(len(s.stripes)) != 0 {
+			return nil, fmt.Errorf("invalid stripes")
+		}
+		var areas []string
+		for _, st := range s.stripes {
+			pv, ok := vg.pvs[st.pv]
+			if !ok {
+				return nil, fmt.Errorf("unknown physical volume %s", st.pv)
+			}
+			offset := pv.peStart + st.extent*vg.extentSize
+			areas = append(areas, fmt.Sprintf("%s %d", pvPath(pv.id), offset))
+		}
+
+		t := dmTarget{start: s.startExtent * vg.extentSize, length: s.extentCount * vg.extentSize}
+		if len(areas) == 1 {
+			t.typ = "linear"
+			t.spec = areas[0]
+		} else {
+			t.typ = "striped"
+			t.spec = fmt.Sprintf("%d %d %s", len(areas), s.stripeSize, strings.Join(areas, " "))
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// lvmDevice is a device mapper device that needs to be created to activate a logical volume
+type lvmDevice struct {
+	name, uuid string
+	targets    []dmTarget
+}
+
+// activationPlan returns device mapper devices needed to activate visible logical volumes of the group.
+// Devices are listed in the creation order i.e. lower layers go first.
+func (vg *lvmVolumeGroup) activationPlan(pvPath func(id string) string) ([]lvmDevice, []error) {
+	var devices []lvmDevice
+	var errs []error
+	created := make(map[string]bool)
+
+	add := func(d lvmDevice) {
+		if !created[d.name] {
+			created[d.name] = true
+			devices = append(devices, d)
+		}
+	}
+	striped := func(lv *lvmLogicalVolume, layer string) (string, error) {
+		targets, err := vg.stripedTargets(lv, pvPath)
+		if err != nil {
+			return "", err
+		}
+		d := lvmDevice{name: vg.dmName(lv.name, layer), uuid: vg.dmUUID(lv, layer), targets: targets}
+		add(d)
+		return "/dev/mapper/" + d.name, nil
+	}
+
+	// old-style snapshots: origin LV -> its snapshot segments, cow LV -> the snapshot segment
+	origins := make(map[string]bool)
+	cows := make(map[string]lvmSegment)
+	for _, lv := range vg.lvs {
+		for _, s := range lv.segments {
+			if s.typ == "snapshot" {
+				origins[s.origin] = true
+				cows[s.cowStore] = s
+			}
+		}
+	}
+
+	pool := func(name string) (string, error) {
+		lv, ok := vg.lvs[name]
+		if !ok || len(lv.segments) != 1 || lv.segments[0].typ != "thin-pool" {
+			return "", fmt.Errorf("thin pool %s is not found", name)
+		}
+		s := lv.segments[0]
+		meta, ok := vg.lvs[s.metadata]
+		if !ok {
+			return "", fmt.Errorf("thin pool metadata %s is not found", s.metadata)
+		}
+		data, ok := vg.lvs[s.pool]
+		if !ok {
+			return "", fmt.Errorf("thin pool data %s is not found", s.pool)
+		}
+		metaDev, err := striped(meta, "")
+		if err != nil {
+			return "", err
+		}
+		dataDev, err := striped(data, "")
+		if err != nil {
+			return "", err
+		}
+
+		var features []string
+		if !s.zeroNewBlocks {
+			features = append(features, "skip_block_zeroing")
+		}
+		switch s.discards {
+		case "ignore":
+			features = append(features, "ignore_discard")
+		case "nopassdown":
+			features = append(features, "no_discard_passdown")
+		}
+		spec := fmt.Sprintf("%s %s %d 0 %d", metaDev, dataDev, s.chunkSize, len(features))
+		if len(features) > 0 {
+			spec += " " + strings.Join(features, " ")
+		}
+		d := lvmDevice{
+			name:    vg.dmName(name, "tpool"),
+			uuid:    vg.dmUUID(lv, "tpool"),
+			targets: []dmTarget{{length: vg.size(data), typ: "thin-pool", spec: spec}},
+		}
+		add(d)
+		return "/dev/mapper/" + d.name, nil
+	}
+
+	names := make([]string, 0, len(vg.lvs))
+	for name := range vg.lvs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		lv := vg.lvs[name]
+		// a cow store volume of old-style snapshot might be hidden, it is activated as the snapshot
+		if (!lv.visible && cows[name].typ == "") || len(lv.segments) == 0 {
+			continue
+		}
+
+		var err error
+		switch typ := lv.segments[0].typ; {
+		case typ == "snapshot":
+			// activated together with its cow store volume
+		case typ == "thin-pool":
+			// a pool is not a usable device by itself, it is activated together with its thin volumes
+		case typ == "thin":
+			var poolDev string
+			poolDev, err = pool(lv.segments[0].thinPool)
+			if err == nil {
+				add(lvmDevice{
+					name:    vg.dmName(name, ""),
+					uuid:    vg.dmUUID(lv, ""),
+					targets: []dmTarget{{length: vg.size(lv), typ: "thin", spec: fmt.Sprintf("%s %d", poolDev, lv.segments[0].deviceID)}},
+				})
+			}
+		case typ == "striped" && origins[name]:
+			var realDev string
+			realDev, err = striped(lv, "real")
+			if err == nil {
+				add(lvmDevice{
+					name:    vg.dmName(name, ""),
+					uuid:    vg.dmUUID(lv, ""),
+					targets: []dmTarget{{length: vg.size(lv), typ: "snapshot-origin", spec: realDev}},
+				})
+			}
+		case typ == "striped" && cows[name].typ != "":
+			snap := cows[name]
+			origin, ok := vg.lvs[snap.origin]
+			if !ok {
+				err = fmt.Errorf("snapshot origin %s is not found", snap.origin)
+				break
+			}
+			var realDev, cowDev string
+			realDev, err = striped(origin, "real")
+			if err != nil {
+				break
+			}
+			cowDev, err = striped(lv, "cow")
+			if err != nil {
+				break
+			}
+			add(lvmDevice{
+				name:    vg.dmName(name, ""),
+				uuid:    vg.dmUUID(lv, ""),
+				targets: []dmTarget{{length: vg.size(origin), typ: "snapshot", spec: fmt.Sprintf("%s %s P %d", realDev, cowDev, snap.chunkSize)}},
+			})
+		case typ == "striped":
+			_, err = striped(lv, "")
+		default:
+			err = fmt.Errorf("unsupported segment type %s", typ)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("logical volume %s/%s: %v", vg.name, name, err))
+		}
+	}
+	return devices, errs
+}
+
+// lvmNative tracks physical volumes found so far, a volume group is activated once all its physical volumes are present
+var lvmNative = struct {
+	sync.Mutex
+	pvs       map[string]string          // PV id -> device path
+	groups    map[string]*lvmVolumeGroup // VG id -> metadata with the highest seqno
+	activated map[string]bool            // VG id
+}{
+	pvs:       make(map[string]string),
+	groups:    make(map[string]*lvmVolumeGroup),
+	activated: make(map[string]bool),
+}
+
+func handleLvmNativeDevice(blk *blkInfo) error {
+	pvID, metadata, err := readLvmPhysicalVolume(blk.path)
+	if err != nil {
+		return fmt.Errorf("%s: %v", blk.path, err)
+	}
+
+	lvmNative.Lock()
+	lvmNative.pvs[pvID] = blk.path
+	if metadata != "" {
+		vg, err := parseLvmVolumeGroup(metadata)
+		if err != nil {
+			lvmNative.Unlock()
+			return fmt.Errorf("%s: %v", blk.path, err)
+		}
+		if old, ok := lvmNative.groups[vg.id]; !ok || old.seqno < vg.seqno {
+			lvmNative.groups[vg.id] = vg
+		}
+	}
+
+	var ready []*lvmVolumeGroup
+	for id, vg := range lvmNative.groups {
+		if !lvmNative.activated[id] && len(vg.missingPhysicalVolumes(lvmNative.pvs)) == 0 {
+			lvmNative.activated[id] = true
+			ready = append(ready, vg)
+		}
+	}
+	pvs := make(map[string]string, len(lvmNative.pvs))
+	for id, path := range lvmNative.pvs {
+		pvs[id] = path
+	}
+	lvmNative.Unlock()
+
+	for _, vg := range ready {
+		activateLvmVolumeGroup(vg, pvs)
+	}
+	return nil
+}
+
+func (vg *lvmVolumeGroup) missingPhysicalVolumes(present map[string]string) []string {
+	var missing []string
+	for _, pv := range vg.pvs {
+		if _, ok := present[pv.id]; !ok {
+			missing = append(missing, pv.id)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+func activateLvmVolumeGroup(vg *lvmVolumeGroup, pvs map[string]string) {
+	info("activating lvm volume group %s", vg.name)
+
+	devices, errs := vg.activationPlan(func(id string) string { return pvs[id] })
+	for _, err := range errs {
+		warning("lvm: %v", err)
+	}
+
+	modules := []string{"dm_mod"}
+	for _, d := range devices {
+		switch d.targets[0].typ {
+		case "thin-pool", "thin":
+			modules = append(modules, "dm_thin_pool")
+		case "snapshot", "snapshot-origin":
+			modules = append(modules, "dm_snapshot")
+		}
+	}
+	wg := loadModules(modules...)
+	wg.Wait()
+
+	for _, d := range devices {
+		if err := dmCreate(d.name, d.uuid, 0, d.targets...); err != nil {
+			warning("lvm: unable to create device %s: %v", d.name, err)
+		}
+	}
+}
+
+// lvmNativeIncompleteGroups returns groups that wait for physical volumes
+func lvmNativeIncompleteGroups() []lvmGroup {
+	lvmNative.Lock()
+	defer lvmNative.Unlock()
+
+	var groups []lvmGroup
+	for id, vg := range lvmNative.groups {
+		if lvmNative.activated[id] {
+			continue
+		}
+		groups = append(groups, lvmGroup{name: vg.name, missing: vg.missingPhysicalVolumes(lvmNative.pvs)})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].name < groups[j].name })
+	return groups
+}
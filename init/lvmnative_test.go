@@ -0,0 +1,180 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testLvmMetadata = `vg0 {
+id = "jLyt3A-gR1r-ZtNf-2oKI-7lJx-ypxa-QZE7t3"
+seqno = 12
+extent_size = 8192
+
+physical_volumes {
+pv0 {
+id = "W1vJtT-6bDe-tXkI-x2yo-0iRu-yZLC-Ft6CIP"
+pe_start = 2048
+}
+pv1 {
+id = "eTq6pf-tbfI-Qbe0-OKTk-pmOZ-1k3X-gc2Qm5"
+pe_start = 2048
+}
+}
+
+logical_volumes {
+root {
+id = "aD5dVg-lZ3v-ql8G-YCSv-jbrl-9cAQ-1Ybbze"
+status = ["READ", "WRITE", "VISIBLE"]
+segment_count = 2
+segment1 {
+start_extent = 0
+extent_count = 10
+type = "striped"
+stripe_count = 1
+stripes = ["pv0", 0]
+}
+segment2 {
+start_extent = 10
+extent_count = 4
+type = "striped"
+stripe_count = 2
+stripe_size = 128
+stripes = ["pv0", 100, "pv1", 0]
+}
+}
+snap {
+id = "Yc3I8e-Q4HP-3lXT-qDPs-Jk6G-xqFJ-Rz4R1u"
+status = ["READ", "WRITE", "VISIBLE"]
+segment_count = 1
+segment1 {
+start_extent = 0
+extent_count = 2
+type = "striped"
+stripe_count = 1
+stripes = ["pv1", 10]
+}
+}
+snapshot0 {
+id = "J0Msjd-7Nx5-a4kS-1b5L-2VhY-Br2a-qrNwpE"
+status = ["READ", "WRITE", "VISIBLE"]
+segment_count = 1
+segment1 {
+start_extent = 0
+extent_count = 14
+type = "snapshot"
+chunk_size = 8
+origin = "root"
+cow_store = "snap"
+}
+}
+pool {
+id = "cX5vrN-0Ph0-yqC5-lHoS-c3dU-1y2J-iZKpsl"
+status = ["READ", "WRITE", "VISIBLE"]
+segment_count = 1
+segment1 {
+start_extent = 0
+extent_count = 20
+type = "thin-pool"
+metadata = "pool_tmeta"
+pool = "pool_tdata"
+transaction_id = 2
+chunk_size = 128
+discards = "passdown"
+zero_new_blocks = 0
+}
+}
+pool_tmeta {
+id = "Ft6CIP-x2yo-0iRu-yZLC-W1vJ-tT6b-DetXkI"
+status = ["READ", "WRITE"]
+segment_count = 1
+segment1 {
+start_extent = 0
+extent_count = 1
+type = "striped"
+stripe_count = 1
+stripes = ["pv1", 12]
+}
+}
+pool_tdata {
+id = "gc2Qm5-eTq6-pftb-fIQb-e0OK-Tkpm-OZ1k3X"
+status = ["READ", "WRITE"]
+segment_count = 1
+segment1 {
+start_extent = 0
+extent_count = 20
+type = "striped"
+stripe_count = 1
+stripes = ["pv1", 13]
+}
+}
+home {
+id = "iZKpsl-cX5v-rN0P-h0yq-C5lH-oSc3-dU1y2J"
+status = ["READ", "WRITE", "VISIBLE"]
+segment_count = 1
+segment1 {
+start_extent = 0
+extent_count = 50
+type = "thin"
+thin_pool = "pool"
+transaction_id = 1
+device_id = 1
+}
+}
+mirror {
+id = "qrNwpE-J0Ms-jd7N-x5a4-kS1b-5L2V-hYBr2a"
+status = ["READ", "WRITE", "VISIBLE"]
+segment_count = 1
+segment1 {
+start_extent = 0
+extent_count = 1
+type = "raid1"
+}
+}
+}
+}
+`
+
+func TestLvmActivationPlan(t *testing.T) {
+	vg, err := parseLvmVolumeGroup(testLvmMetadata)
+	require.NoError(t, err)
+	require.Equal(t, "vg0", vg.name)
+	require.Equal(t, int64(12), vg.seqno)
+	require.Equal(t, []string{"W1vJtT6bDetXkIx2yo0iRuyZLCFt6CIP"}, vg.missingPhysicalVolumes(map[string]string{"eTq6pftbfIQbe0OKTkpmOZ1k3Xgc2Qm5": "/dev/sdb"}))
+
+	paths := map[string]string{
+		"W1vJtT6bDetXkIx2yo0iRuyZLCFt6CIP": "/dev/sda",
+		"eTq6pftbfIQbe0OKTkpmOZ1k3Xgc2Qm5": "/dev/sdb",
+	}
+	devices, errs := vg.activationPlan(func(id string) string { return paths[id] })
+	require.Len(t, errs, 1) // raid1 is not supported
+
+	const vgUUID = "LVM-jLyt3AgR1rZtNf2oKI7lJxypxaQZE7t3"
+	require.Equal(t, []lvmDevice{
+		{name: "vg0-pool_tmeta", uuid: vgUUID + "Ft6CIPx2yo0iRuyZLCW1vJtT6bDetXkI", targets: []dmTarget{
+			{length: 8192, typ: "linear", spec: "/dev/sdb 100352"},
+		}},
+		{name: "vg0-pool_tdata", uuid: vgUUID + "gc2Qm5eTq6pftbfIQbe0OKTkpmOZ1k3X", targets: []dmTarget{
+			{length: 163840, typ: "linear", spec: "/dev/sdb 108544"},
+		}},
+		{name: "vg0-pool-tpool", uuid: vgUUID + "cX5vrN0Ph0yqC5lHoSc3dU1y2JiZKpsl-tpool", targets: []dmTarget{
+			{length: 163840, typ: "thin-pool", spec: "/dev/mapper/vg0-pool_tmeta /dev/mapper/vg0-pool_tdata 128 0 1 skip_block_zeroing"},
+		}},
+		{name: "vg0-home", uuid: vgUUID + "iZKpslcX5vrN0Ph0yqC5lHoSc3dU1y2J", targets: []dmTarget{
+			{length: 409600, typ: "thin", spec: "/dev/mapper/vg0-pool-tpool 1"},
+		}},
+		{name: "vg0-root-real", uuid: vgUUID + "aD5dVglZ3vql8GYCSvjbrl9cAQ1Ybbze-real", targets: []dmTarget{
+			{length: 81920, typ: "linear", spec: "/dev/sda 2048"},
+			{start: 81920, length: 32768, typ: "striped", spec: "2 128 /dev/sda 821248 /dev/sdb 2048"},
+		}},
+		{name: "vg0-root", uuid: vgUUID + "aD5dVglZ3vql8GYCSvjbrl9cAQ1Ybbze", targets: []dmTarget{
+			{length: 114688, typ: "snapshot-origin", spec: "/dev/mapper/vg0-root-real"},
+		}},
+		{name: "vg0-snap-cow", uuid: vgUUID + "Yc3I8eQ4HP3lXTqDPsJk6GxqFJRz4R1u-cow", targets: []dmTarget{
+			{length: 16384, typ: "linear", spec: "/dev/sdb 83968"},
+		}},
+		{name: "vg0-snap", uuid: vgUUID + "Yc3I8eQ4HP3lXTqDPsJk6GxqFJRz4R1u", targets: []dmTarget{
+			{length: 114688, typ: "snapshot", spec: "/dev/mapper/vg0-root-real /dev/mapper/vg0-snap-cow P 8"},
+		}},
+	}, devices)
+}
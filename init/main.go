@@ -12,8 +12,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
-	"unsafe"
 
 	"github.com/yookoala/realpath"
 	"golang.org/x/sys/unix"
@@ -31,8 +31,9 @@ var (
 	rootMountingMutex sync.Mutex
 	rootMounted       sync.WaitGroup // waits until the root partition is mounted
 
-	cmdRoot   *deviceRef
-	cmdResume *deviceRef
+	cmdRoot         *deviceRef
+	cmdResume       *deviceRef
+	cmdResumeOffset uint64 // offset of the hibernation image in PAGE_SIZE units, used when hibernating to a swap file
 
 	initBinary = "/sbin/init" // path to init binary inside the user's chroot
 
@@ -100,12 +101,15 @@ func waitForDeviceToProcess(dev string) {
 	wg.Wait()
 }
 
-func markDeviceProcessed(dev string) {
+// forgetBlockDevice is called when the device is removed, so it is processed again once it is plugged in
+func forgetBlockDevice(dev string) {
 	devicesMutex.Lock()
 	defer devicesMutex.Unlock()
 
-	wg := processingDevices[dev]
-	wg.Done()
+	if seenDevices[dev] {
+		delete(seenDevices, dev)
+		delete(processingDevices, dev)
+	}
 }
 
 func diskSymlink(typ, oldname, newname string) error {
@@ -134,17 +138,25 @@ func addBlockDevice(devpath string, isDevice bool, symlinks []string) error {
 		return nil
 	}
 	seenDevices[devpath] = true
-	_, ok := processingDevices[devpath]
+	wg, ok := processingDevices[devpath]
 	if !ok {
-		wg := &sync.WaitGroup{}
+		wg = &sync.WaitGroup{}
 		wg.Add(1)
 		processingDevices[devpath] = wg
 	}
 	devicesMutex.Unlock()
-	defer markDeviceProcessed(devpath)
+	defer wg.Done()
 
 	info("found a new device %s", devpath)
 
+	if isDisconnectedNbdDevice(devpath) {
+		// nbd devices are added once connected
+		devicesMutex.Lock()
+		delete(seenDevices, devpath)
+		devicesMutex.Unlock()
+		return nil
+	}
+
 	blk, err := readBlkInfo(devpath)
 	if err == errUnknownBlockType {
 		// even if booster unable to detect a filesystem we might still try to mount with the type specified by the user
@@ -173,6 +185,19 @@ func addBlockDevice(devpath string, isDevice bool, symlinks []string) error {
 		}
 	}
 
+	if luksMeta != nil && blk.matchesRef(luksMeta.device) {
+		go loadLuksMeta(blk)
+	}
+	matchKeyfileDevices(blk)
+	matchOverlayDevice(blk)
+	if err := matchVerityDevices(blk); err != nil {
+		return err
+	}
+	if m := matchLuksDataDevice(blk); m != nil {
+		info("%s is the data device of LUKS volume %s with detached header", blk.path, m.name)
+		return luksOpen(blk.path, m)
+	}
+
 	// check non-mountable types that require extra processing
 	switch blk.format {
 	case "luks":
@@ -181,18 +206,32 @@ func addBlockDevice(devpath string, isDevice bool, symlinks []string) error {
 		return handleLvmBlockDevice(blk)
 	case "mdraid":
 		return handleMdraidBlockDevice(blk)
+	case "imsm", "ddf":
+		return handleMdContainerBlockDevice(blk)
+	case "integrity":
+		return handleIntegrityBlockDevice(blk)
 	case "gpt":
 		return handleGptBlockDevice(blk)
 	}
 
 	if blk.matchesRef(cmdResume) {
 		if err := resume(devpath); err != nil {
-			return err
+			// resume failure is not fatal, the system can boot normally
+			warning("unable to resume from %s: %v, continue with a normal boot", devpath, err)
 		}
+		resumeProcessedOnce.Do(resumeProcessed.Done)
 	}
 
-	if blk.matchesRef(cmdRoot) {
-		if blk.format == "" && rootFsType != "" {
+	if blk.matchesRef(liveMedium) {
+		return handleLiveMedium(blk)
+	}
+
+	if blk.matchesRef(cmdRoot) || isNbdRootDevice(devpath) {
+		if rootFsType != "" && rootFsType != blk.format {
+			// user-specified filesystem type takes precedence over the detected one, the same way as the kernel does it
+			if blk.format != "" {
+				info("using rootfstype=%s for %s, detected filesystem type is %s", rootFsType, devpath, blk.format)
+			}
 			blk.format = rootFsType
 			blk.isFs = true
 		}
@@ -202,6 +241,12 @@ func addBlockDevice(devpath string, isDevice bool, symlinks []string) error {
 		if !blk.isFs {
 			return fmt.Errorf("specified root %s has type %s and cannot be mounted as a filesystem", devpath, blk.format)
 		}
+		switch blk.format {
+		case "btrfs":
+			return handleBtrfsRootDevice(blk)
+		case "bcachefs":
+			return handleBcachefsRootDevice(blk)
+		}
 		return mountRootFs(devpath, blk.format)
 	}
 
@@ -270,6 +315,11 @@ func handleGptBlockDevice(blk *blkInfo) error {
 
 	for _, m := range luksMappings {
 		blk.resolveGptRef(m.ref)
+		blk.resolveGptRef(m.data)
+	}
+	if verityRoot != nil {
+		blk.resolveGptRef(verityRoot.data)
+		blk.resolveGptRef(verityRoot.hash)
 	}
 
 	for _, part := range gpt.partitions {
@@ -282,65 +332,47 @@ func handleGptBlockDevice(blk *blkInfo) error {
 	return nil
 }
 
-var raidModules = map[uint32]string{
-	levelMultipath: "multipath",
-	levelLinear:    "linear",
-	levelRaid0:     "raid0",
-	levelRaid1:     "raid1",
-	levelRaid4:     "raid456",
-	levelRaid5:     "raid456",
-	levelRaid6:     "raid456",
-	levelRaid10:    "raid10",
-}
+// resumeDeviceTimeout is the max time root mounting waits for the resume device to appear
+const resumeDeviceTimeout = 30 * time.Second
 
-func handleMdraidBlockDevice(blk *blkInfo) error {
-	if !config.EnableMdraid {
-		info("MdRaid support is disabled, ignoring mdraid device %s", blk.path)
-		return nil
-	}
-	info("trying to assemble mdraid array %s", blk.uuid.toString())
+var (
+	resumeProcessed     sync.WaitGroup // waits until the resume device is processed
+	resumeProcessedOnce sync.Once
+	resumeTimedOut      bool // resume device did not appear in time and root has been mounted, protected by rootMountingMutex
+)
 
-	if mod, ok := raidModules[blk.data.(mdraidData).level]; ok {
-		wg := loadModules(mod)
-		wg.Wait()
-	} else {
-		return fmt.Errorf("unknown raid level for device %s", blk.path)
+// waitForResume waits until the resume device is processed. Resume must happen before the root filesystem is mounted
+// otherwise the hibernated image becomes inconsistent with the filesystem state.
+func waitForResume() {
+	if cmdResume == nil {
+		return
 	}
-
-	out, err := exec.Command("mdadm", "--export", "--incremental", blk.path).Output()
-	if err != nil {
-		return unwrapExitError(err)
+	if waitTimeout(&resumeProcessed, resumeDeviceTimeout) {
+		rootMountingMutex.Lock()
+		resumeTimedOut = true
+		rootMountingMutex.Unlock()
+		warning("timeout waiting for resume device, continue with a normal boot")
 	}
+}
 
-	props := parseProperties(string(out))
-	arrayName, hasArrayName := props["MD_DEVNAME"]
-	if !hasArrayName {
-		return fmt.Errorf("mdraid array at %s does not have a MD_DEVNAME property", blk.uuid.toString())
+func resume(devpath string) error {
+	rootMountingMutex.Lock()
+	defer rootMountingMutex.Unlock()
+	if resumeTimedOut {
+		return fmt.Errorf("root filesystem has been mounted already, it is not safe to resume")
 	}
 
-	if started, ok := props["MD_STARTED"]; !ok || started != "yes" {
-		info("mdraid array %s is not complete, ignore it", arrayName)
-		return nil
+	sig, err := hibernationSignature(devpath, cmdResumeOffset)
+	if err != nil {
+		return err
 	}
-
-	return addBlockDevice("/dev/md/"+arrayName, false, nil)
-}
-
-func handleLvmBlockDevice(blk *blkInfo) error {
-	if !config.EnableLVM {
-		info("LVM support is disabled, ignoring lvm physical volume %s", blk.path)
-		return nil
+	if sig == uswsuspSignature {
+		return uswsuspResume(devpath)
 	}
-
-	info("scanning lvm physical volume %s", blk.path)
-	cmd := exec.Command("lvm", "pvscan", "--cache", "-aay", blk.path)
-	if verbosityLevel >= levelDebug {
-		cmd.Stdout = os.Stdout
+	if sig != swsuspSignature {
+		debug("%s does not contain a hibernation image", devpath)
 	}
-	return unwrapExitError(cmd.Run())
-}
 
-func resume(devpath string) error {
 	devNo, err := deviceNo(devpath)
 	if err != nil {
 		return err
@@ -348,31 +380,16 @@ func resume(devpath string) error {
 	major := unix.Major(devNo)
 	minor := unix.Minor(devNo)
 
-	info("resuming device %s, devno=(%d,%d)", devpath, major, minor)
-	rd := fmt.Sprintf("%d:%d", major, minor)
-	return os.WriteFile("/sys/power/resume", []byte(rd), 0o644)
-}
-
-func fsck(dev string) error {
-	if _, err := os.Stat("/usr/bin/fsck"); !os.IsNotExist(err) {
-		cmd := exec.Command("/usr/bin/fsck", "-y", dev)
-		if verbosityLevel >= levelDebug {
-			cmd.Stdout = os.Stdout
-		}
-		if err := cmd.Run(); err != nil {
-			if err, ok := err.(*exec.ExitError); ok {
-				if err.ExitCode()&^0x1 != 0 {
-					// bit 1 means errors were corrected successfully which is good
-					return unwrapExitError(err)
-				}
-				return nil
-			}
-
-			return fmt.Errorf("fsck for %s: unknown error %v", dev, err)
+	// the offset has to be set first, writing the device number triggers the resume
+	if cmdResumeOffset != 0 {
+		if err := os.WriteFile("/sys/power/resume_offset", []byte(strconv.FormatUint(cmdResumeOffset, 10)), 0o644); err != nil {
+			return err
 		}
 	}
 
-	return nil
+	info("resuming device %s, devno=(%d,%d), offset=%d", devpath, major, minor, cmdResumeOffset)
+	rd := fmt.Sprintf("%d:%d", major, minor)
+	return os.WriteFile("/sys/power/resume", []byte(rd), 0o644)
 }
 
 func mountRootFs(dev, fstype string) error {
@@ -389,24 +406,44 @@ func mountRootFs(dev, fstype string) error {
 	wg := loadModules(fsmodule)
 	wg.Wait()
 
+	if supported, err := isFilesystemSupported(fstype); err != nil {
+		warning("unable to check supported filesystems: %v", err)
+	} else if !supported {
+		return fmt.Errorf("filesystem type %s is not supported by the kernel, make sure kernel module %s is added to the image", fstype, fsmodule)
+	}
+
 	if fstype == "btrfs" {
-		if err := waitForBtrfsDevicesReady(dev); err != nil {
+		if err := scanBtrfsDevice(dev); err != nil {
 			return err
 		}
 	}
 
+	waitForResume()
+
 	rootMountingMutex.Lock()
 	defer rootMountingMutex.Unlock()
 
 	// TODO: if root is already mounted we could return right here
 
-	if err := fsck(dev); err != nil {
+	if err := fsck(dev, fstype); err != nil {
 		return err
 	}
 
+	// wait for post-unlock hooks that might still be running
+	postUnlockHooksLock.Lock()
+	postUnlockHooksLock.Unlock()
+
+	breakpoint(breakPreMount)
+
 	rootMountFlags, options := mountFlags()
 	info("mounting %s->%s, fs=%s, flags=0x%x, options=%s", dev, newRoot, fstype, rootMountFlags, options)
-	if err := mount(dev, newRoot, fstype, rootMountFlags, options); err != nil {
+	mountDone := startPhase("mount %s", dev)
+	err := mount(dev, newRoot, fstype, rootMountFlags, options)
+	mountDone()
+	if err != nil {
+		if fstype == "btrfs" && errors.Is(err, unix.ENOENT) && hasMountOption(options, "subvol") {
+			return fmt.Errorf("%v: btrfs subvolume specified with %s does not exist", err, options)
+		}
 		// Note that this mounting function might be called multiple times
 		// e.g. in case of multiple devices needed to assemble the root array, see https://github.com/anatol/booster/issues/194
 		// It will try to mount it until mount() is successful.
@@ -417,25 +454,24 @@ func mountRootFs(dev, fstype string) error {
 	return nil
 }
 
-// Wait until all devices of a multiple-device filesystem are scanned and registered within the kernel module
-func waitForBtrfsDevicesReady(dev string) error {
-	controlFile, err := os.OpenFile("/dev/btrfs-control", os.O_RDWR, 0)
+// isFilesystemSupported checks whether the filesystem type is registered within the kernel
+func isFilesystemSupported(fstype string) (bool, error) {
+	data, err := os.ReadFile("/proc/filesystems")
 	if err != nil {
-		return err
+		return false, err
 	}
-	defer controlFile.Close()
+	return filesystemsContain(string(data), fstype), nil
+}
 
-	/* this should be 4k */
-	var btrfsIoctlVolArgs struct {
-		fs   int64
-		name [4088]uint8
+// filesystemsContain parses /proc/filesystems content, each line is in format "[nodev]\t$FSTYPE"
+func filesystemsContain(filesystems, fstype string) bool {
+	for _, line := range strings.Split(filesystems, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[len(fields)-1] == fstype {
+			return true
+		}
 	}
-
-	copy(btrfsIoctlVolArgs.name[:], dev)
-
-	var BTRFS_IOCTL_MAGIC uintptr = 0x94
-	BTRFS_IOC_DEVICES_READY := ior(BTRFS_IOCTL_MAGIC, 39, unsafe.Sizeof(btrfsIoctlVolArgs))
-	return ioctl(controlFile.Fd(), BTRFS_IOC_DEVICES_READY, uintptr(unsafe.Pointer(&btrfsIoctlVolArgs)))
+	return false
 }
 
 func mountFlags() (uintptr, string) {
@@ -446,6 +482,14 @@ func mountFlags() (uintptr, string) {
 	if rootRw {
 		rootMountFlags &^= unix.MS_RDONLY
 	}
+	if verityRoot != nil {
+		// dm-verity device is read-only
+		rootMountFlags |= unix.MS_RDONLY
+	}
+	if overlayRoot != nil {
+		// the root is the read-only lower layer of the overlay
+		rootMountFlags |= unix.MS_RDONLY
+	}
 	return rootMountFlags, options
 }
 
@@ -641,6 +685,8 @@ func deleteRamfs() error {
 
 // https://github.com/mirror/busybox/blob/9aa751b08ab03d6396f86c3df77937a19687981b/util-linux/switch_root.c#L297
 func switchRoot() error {
+	switchDone := startPhase("switch root")
+
 	if err := moveMountpointsToHost(); err != nil {
 		return err
 	}
@@ -687,6 +733,9 @@ func switchRoot() error {
 		initArgs = append(initArgs, "--switched-root", "--system", "--deserialize", strconv.Itoa(fd))
 	}
 
+	switchDone()
+	writeBootTimes()
+
 	// Run the OS init
 	info("Switching to the new userspace now. Да пабачэння!")
 	if err := unix.Exec(initBinary, initArgs, nil); err != nil {
@@ -699,7 +748,20 @@ func switchRoot() error {
 func cleanup() {
 	close(udevQuitLoop)
 	udevConn.Close()
-	shutdownNetwork()
+	closeTPM()
+	removeKeySource()
+	clearPassphraseCache()
+	handOffPlymouth()
+	if config.SSH != nil {
+		stopSSHServer()
+	}
+	if networkHandoffRequested() {
+		if err := writeNetworkHandoff(); err != nil {
+			warning("unable to pass network configuration to the booted system: %v", err)
+		}
+	} else {
+		shutdownNetwork()
+	}
 }
 
 func scanSysBlock() error {
@@ -792,6 +854,9 @@ func boost() error {
 	if err := mount("run", "/run", "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_STRICTATIME, "mode=755"); err != nil {
 		return err
 	}
+	if err := openLogFile(); err != nil {
+		warning("unable to open log file %s: %v", logFilePath, err)
+	}
 
 	// Mount efivarfs if running in EFI mode
 	if _, err := os.Stat("/sys/firmware/efi"); !errors.Is(err, os.ErrNotExist) {
@@ -826,18 +891,34 @@ func boost() error {
 		return err
 	}
 
+	if err := applyConfigKeyfiles(); err != nil {
+		return err
+	}
 	if err := parseCmdline(); err != nil {
 		return err
 	}
+	// keymap and font are loaded before any prompt (or the shell) is shown so passphrases with non-US characters
+	// can be typed
+	if err := configureVirtualConsole(); err != nil {
+		return err
+	}
+	breakpoint(breakCmdline)
 
 	rootMounted.Add(1)
+	if cmdResume != nil {
+		resumeProcessed.Add(1)
+	}
 
 	go func() { check(udevListener()) }()
 
 	_ = loadModules(config.ModulesForceLoad...)
 
-	if err := configureVirtualConsole(); err != nil {
-		return err
+	if plymouthRequested() {
+		go func() {
+			if err := startPlymouth(); err != nil {
+				warning("plymouth: %v", err)
+			}
+		}()
 	}
 
 	diskBy := []string{"id", "partuuid", "path", "uuid"}
@@ -847,8 +928,64 @@ func boost() error {
 		}
 	}
 
-	go func() { check(scanSysModaliases()) }()
-	go func() { check(scanSysBlock()) }()
+	if config.Network != nil && len(config.Network.InterfaceNames) > 0 {
+		go func() { check(waitForNetworkInterfaces(linkReadinessTimeout)) }()
+	}
+
+	if config.WireGuard != nil {
+		go func() {
+			if err := setupWireGuard(); err != nil {
+				warning("wireguard: %v", err)
+			}
+		}()
+	}
+
+	if config.SSH != nil {
+		go func() {
+			if err := startSSHServer(); err != nil {
+				warning("ssh server: %v", err)
+			}
+		}()
+	}
+
+	if nfsRoot != nil {
+		go func() { check(mountNfsRoot(nfsRoot)) }()
+	}
+
+	for _, t := range nbdTargets {
+		t := t
+		go func() { check(connectNbd(t)) }()
+	}
+
+	if iscsi != nil {
+		go func() { check(connectIscsi(iscsi)) }()
+	}
+
+	for _, t := range nvmfTargets {
+		t := t
+		go func() { check(connectNvmf(t)) }()
+	}
+
+	if luksMeta != nil && luksMeta.device == nil {
+		go loadLuksMeta(nil)
+	}
+
+	var modaliasesScanned sync.WaitGroup
+	modaliasesScanned.Add(1)
+	go func() {
+		defer modaliasesScanned.Done()
+		defer startPhase("scan modaliases")()
+		check(scanSysModaliases())
+	}()
+	if breakpointRequested(breakInitqueue) {
+		modaliasesScanned.Wait()
+		loadingModulesWg.Wait()
+		breakpoint(breakInitqueue)
+	}
+	go func() {
+		defer startPhase("scan block devices")()
+		check(scanSysBlock())
+	}()
 
 	if config.EnableZfs {
 		if err := mountZfsRoot(); err != nil {
@@ -856,15 +993,39 @@ func boost() error {
 		}
 	}
 
-	if config.MountTimeout != 0 {
-		// TODO: cancellable, timeout context?
-		timeout := waitTimeout(&rootMounted, time.Duration(config.MountTimeout)*time.Second)
-		if timeout {
-			return errRootMountTimeout
+	rootWaitDone := startPhase("wait for root filesystem")
+	if err := waitForRootMounted(); err != nil {
+		return err
+	}
+	rootWaitDone()
+
+	if overlayRoot != nil {
+		if err := setupOverlayRoot(); err != nil {
+			return err
+		}
+	}
+	breakpoint(breakPrePivot)
+
+	if config.Kdump != nil {
+		if err := kdump(); err != nil {
+			warning("kdump: %v", err)
+		}
+		cleanup()
+		return kdumpReboot()
+	}
+
+	if err := extendMeasurements(); err != nil {
+		warning("measure: %v", err)
+	}
+
+	if kexecKernel != "" {
+		if err := kexecLoad(); err != nil {
+			warning("kexec %s: %v, continue booting the current kernel", kexecKernel, err)
+		} else {
+			cleanup()
+			loadingModulesWg.Wait()
+			return kexecReboot()
 		}
-	} else {
-		// wait for mount forever
-		rootMounted.Wait()
 	}
 
 	cleanup()
@@ -872,56 +1033,37 @@ func boost() error {
 	return switchRoot()
 }
 
-func mountZfsRoot() error {
-	// note that 'zfs' module already in modulesForceLoad list and it already started loading
-	// this loadModule() is for zfs module synchronization - we need to wait till the full module loading
-	// before we try to import a pool
-	zfsWg := loadModules("zfs")
-	zfsWg.Wait()
-
-	// TODO: handle zfsDataset == bootfs
-	parts := strings.Split(zfsDataset, "/")
-	pool := parts[0]
-
-	debug("importing zfs pool %s", pool)
-
-	err := exec.Command("zpool", "import", "-c", "/etc/zfs/zpool.cache", "-N", pool).Run()
-	if err != nil {
-		return unwrapExitError(err)
-	}
+// bootFailed receives an error that makes waiting for the root filesystem pointless, e.g. an unlock timeout
+var bootFailed = make(chan error, 1)
 
-	// find all child datasets and mount them
-	// zfs list -H -o name -t filesystem -r $zfsDataset
-	var datasets []byte
-	datasets, err = exec.Command("zfs", "list", "-H", "-o", "name", "-t", "filesystem", "-r", zfsDataset).Output()
-	if err != nil {
-		return unwrapExitError(err)
+// failBoot stops waiting for the root filesystem and makes booster to start the emergency shell
+func failBoot(err error) {
+	select {
+	case bootFailed <- err:
+	default: // the boot has been failed already
 	}
+}
 
-	flags, options := mountFlags()
-	options = strings.Join([]string{"zfsutil", options}, ",")
-	for _, ds := range strings.Split(strings.TrimSpace(string(datasets)), "\n") {
-		val, err := exec.Command("zfs", "get", "-H", "-o", "value", "mountpoint", ds).Output()
-		if err != nil {
-			return unwrapExitError(err)
-		}
+func waitForRootMounted() error {
+	mounted := make(chan struct{})
+	go func() {
+		rootMounted.Wait()
+		close(mounted)
+	}()
 
-		mt := strings.TrimSpace(string(val))
-		switch mt {
-		case "none":
-			continue
-		case "legacy": // todo handle it
-		default:
-			err := mount(ds, filepath.Join(newRoot, mt), "zfs", flags, options)
-			if err != nil {
-				return err
-			}
-		}
+	var timeout <-chan time.Time
+	if config.MountTimeout != 0 {
+		timeout = time.After(time.Duration(config.MountTimeout) * time.Second)
 	}
 
-	rootMounted.Done()
-
-	return nil
+	select {
+	case <-mounted:
+		return nil
+	case <-timeout:
+		return errRootMountTimeout
+	case err := <-bootFailed:
+		return err
+	}
 }
 
 var config InitConfig
@@ -932,7 +1074,11 @@ func readConfig() error {
 		return err
 	}
 
-	return yaml.Unmarshal(data, &config)
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	measure("booster config", data)
+	return nil
 }
 
 func mount(source, target, fstype string, flags uintptr, options string) error {
@@ -940,7 +1086,7 @@ func mount(source, target, fstype string, flags uintptr, options string) error {
 		return err
 	}
 	if err := unix.Mount(source, target, fstype, flags, options); err != nil {
-		return fmt.Errorf("mount(%v): %v", source, err)
+		return fmt.Errorf("mount(%v): %w", source, err)
 	}
 	return nil
 }
@@ -975,22 +1121,57 @@ func enableLocalEcho() error {
 }
 
 func emergencyShell() {
-	if _, err := os.Stat("/usr/bin/busybox"); !os.IsNotExist(err) {
-		// Force local echo (might have been disabled by readPassword).
-		if err := enableLocalEcho(); err != nil {
-			warning("Failed to enable local echo: %v", err)
+	// the shell needs the console, stop reading passwords from it
+	cancelConsoleInput()
+	stopPlymouth()
+	runShell()
+}
+
+// runShell runs an interactive shell at the console and returns once the user exits it
+func runShell() {
+	// Force local echo (might have been disabled by readPassword).
+	if err := enableLocalEcho(); err != nil {
+		warning("Failed to enable local echo: %v", err)
+	}
+
+	interruptMutex.Lock()
+	emergencyShellStarted = true
+	interruptMutex.Unlock()
+
+	if _, err := os.Stat(rescueToolsDir); err == nil {
+		path := os.Getenv("PATH")
+		defer os.Setenv("PATH", path)
+		if err := os.Setenv("PATH", path+":"+rescueToolsDir); err != nil {
+			warning("Failed to add rescue tools to PATH: %v", err)
 		}
+	}
 
-		if err := unix.Exec("/usr/bin/busybox", []string{"sh", "-I"}, nil); err != nil {
-			severe("Unable to start an emergency shell: %v", err)
+	if _, err := os.Stat("/usr/bin/busybox"); os.IsNotExist(err) {
+		if !config.EnableShell {
+			// a root shell is given only if it is asked for explicitly: by adding busybox or with enable_shell option
+			info("no shell in the image, build it with enable_shell option to get the built-in shell")
+			return
 		}
+		builtinShell()
+		return
+	}
+
+	// The shell runs as a child process so booster stays PID 1 and can handle
+	// 'reboot'/'poweroff' requests sent by busybox as signals to init.
+	cmd := exec.Command("/usr/bin/busybox", "sh", "-I")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if err := cmd.Run(); err != nil {
+		severe("Emergency shell: %v", unwrapExitError(err))
 	}
 }
 
 func reboot() {
 	console("Press ENTER to reboot")
 	_, _ = fmt.Scanln()
-	_ = unix.Reboot(unix.LINUX_REBOOT_CMD_RESTART)
+	shutdown(unix.LINUX_REBOOT_CMD_RESTART)
 }
 
 func printMissingModules() {
@@ -1010,7 +1191,15 @@ func printMissingModules() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == checkUnlockCommand {
+		os.Exit(runCheckUnlock(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && diagnosticCommands[os.Args[1]] != nil {
+		os.Exit(diagnosticCommands[os.Args[1]](os.Args[2:]))
+	}
+
 	readStartTime()
+	go handleSignals()
 
 	if err := checkIfInitrd(); err != nil {
 		panic(err)
@@ -1023,11 +1212,14 @@ func main() {
 		if errors.Is(err, errRootMountTimeout) {
 			// if we fail to detect the root filesystem maybe we are missing some kernel modules needed for storage devices?
 			printMissingModules()
+			printIncompleteLvmGroups()
+			printIncompleteMdraidArrays()
+			btrfsFilesystems.printIncomplete("degraded")
+			bcachefsFilesystems.printIncomplete("degraded")
 		}
 	}
 	emergencyShell()
 
-	// if we are here then emergency shell did not launch
-	// in this case suggest user to reboot the computer
+	// the user has exited the emergency shell (or there is no shell in the image), offer to reboot the computer
 	reboot()
 }
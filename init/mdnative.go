@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Native mdraid assembly (mdraid_native config option) reads md superblocks of the array members and assembles
+// the array with md ioctls the same way as 'mdadm --incremental' does, without shipping mdadm in the image.
+// Only arrays with version 1.x superblocks are supported.
+
+const (
+	mdSuperblockMagic     = 0xa92b4efc
+	mdSuperblockSize      = 256 // fixed part, followed by dev_roles
+	mdSuperblockMaxDevs   = 384
+	mdRoleSpare           = 0xffff
+	mdRoleFaulty          = 0xfffe
+	mdRoleJournal         = 0xfffd
+	mdEventMargin         = 1 // a member that missed one update is still considered fresh, the same as mdadm does
+	mdNewArrayParam       = "/sys/module/md_mod/parameters/new_array"
+	mdFirstDynamicMinor   = 127 // named arrays get minors counting down from 127, the same as mdadm does
+	mdSuperblock10Reserve = 8 * 1024
+)
+
+// mdSuperblock is md superblock version 1.x, see struct mdp_superblock_1 in include/uapi/linux/raid/md_p.h
+type mdSuperblock struct {
+	minorVersion uint32 // 0 - at the end of the device, 1 - at the beginning, 2 - 4K from the beginning
+	uuid         []byte
+	name         string
+	level        uint32
+	layout       uint32
+	chunkSize    uint32 // in sectors
+	raidDisks    uint32
+	devNumber    uint32
+	events       uint64
+	role         uint16
+}
+
+// mdSuperblockOffset returns location of the superblock for the given minor version
+func mdSuperblockOffset(minorVersion uint32, deviceSize int64) int64 {
+	switch minorVersion {
+	case 0:
+		return (deviceSize - mdSuperblock10Reserve) &^ (4*1024 - 1)
+	case 1:
+		return 0
+	default:
+		return 4 * 1024
+	}
+}
+
+// readMdSuperblock looks for a valid 1.x superblock at all the locations the superblock can be stored at
+func readMdSuperblock(f *os.File) (*mdSuperblock, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, mdSuperblockSize+2*mdSuperblockMaxDevs)
+	for _, minor := range []uint32{2, 1, 0} {
+		offset := mdSuperblockOffset(minor, size)
+		if offset < 0 || offset+int64(len(buf)) > size {
+			continue
+		}
+		if _, err := f.ReadAt(buf, offset); err != nil {
+			continue
+		}
+		if sb := parseMdSuperblock(buf, offset); sb != nil {
+			sb.minorVersion = minor
+			return sb, nil
+		}
+	}
+	return nil, fmt.Errorf("md superblock is not found")
+}
+
+func parseMdSuperblock(buf []byte, offset int64) *mdSuperblock {
+	le := binary.LittleEndian
+	if le.Uint32(buf[0:4]) != mdSuperblockMagic || le.Uint32(buf[4:8]) != 1 {
+		return nil
+	}
+	if int64(le.Uint64(buf[144:152])) != offset/512 {
+		return nil // a superblock of a nested array or a stale one
+	}
+	maxDev := le.Uint32(buf[220:224])
+	if maxDev > mdSuperblockMaxDevs || mdSuperblockChecksum(buf[:mdSuperblockSize+2*maxDev]) != le.Uint32(buf[216:220]) {
+		return nil
+	}
+
+	sb := &mdSuperblock{
+		uuid:      append([]byte(nil), buf[16:32]...),
+		name:      string(bytes.TrimRight(buf[32:64], "\x00")),
+		level:     le.Uint32(buf[72:76]),
+		layout:    le.Uint32(buf[76:80]),
+		chunkSize: le.Uint32(buf[88:92]),
+		raidDisks: le.Uint32(buf[92:96]),
+		devNumber: le.Uint32(buf[160:164]),
+		events:    le.Uint64(buf[200:208]),
+		role:      mdRoleSpare,
+	}
+	if sb.devNumber < maxDev {
+		sb.role = le.Uint16(buf[mdSuperblockSize+2*sb.devNumber:])
+	}
+	return sb
+}
+
+// mdSuperblockChecksum is calc_sb_1_csum() from drivers/md/md.c
+func mdSuperblockChecksum(sb []byte) uint32 {
+	var sum uint64
+	for i := 0; i+4 <= len(sb); i += 4 {
+		if i == 216 {
+			continue // the checksum field itself
+		}
+		sum += uint64(binary.LittleEndian.Uint32(sb[i:]))
+	}
+	if len(sb)%4 == 2 {
+		sum += uint64(binary.LittleEndian.Uint16(sb[len(sb)-2:]))
+	}
+	return uint32((sum & 0xffffffff) + (sum >> 32))
+}
+
+// arrayName returns name of the array without the homehost prefix
+func (sb *mdSuperblock) arrayName() string {
+	if _, name, ok := strings.Cut(sb.name, ":"); ok {
+		return name
+	}
+	return sb.name
+}
+
+type mdMember struct {
+	path string
+	sb   *mdSuperblock
+}
+
+type mdArray struct {
+	name    string
+	uuid    UUID
+	members []mdMember
+	started bool
+}
+
+var mdNative = struct {
+	sync.Mutex
+	arrays map[string]*mdArray // array UUID -> array
+}{
+	arrays: make(map[string]*mdArray),
+}
+
+// freshMembers returns members with up-to-date data and the number of active roles they cover
+func (a *mdArray) freshMembers() ([]mdMember, uint32) {
+	var maxEvents uint64
+	for _, m := range a.members {
+		if m.sb.events > maxEvents {
+			maxEvents = m.sb.events
+		}
+	}
+
+	var fresh []mdMember
+	roles := make(map[uint16]bool)
+	for _, m := range a.members {
+		if m.sb.events+mdEventMargin < maxEvents {
+			continue
+		}
+		fresh = append(fresh, m)
+		if m.sb.role < mdRoleJournal && uint32(m.sb.role) < m.sb.raidDisks {
+			roles[m.sb.role] = true
+		}
+	}
+	sort.Slice(fresh, func(i, j int) bool { return fresh[i].sb.role < fresh[j].sb.role })
+	return fresh, uint32(len(roles))
+}
+
+// raidDisks returns number of disks in the array according to the most recent superblock
+func (a *mdArray) raidDisks() uint32 {
+	var sb *mdSuperblock
+	for _, m := range a.members {
+		if sb == nil || m.sb.events > sb.events {
+			sb = m.sb
+		}
+	}
+	return sb.raidDisks
+}
+
+func handleMdraidNativeDevice(blk *blkInfo) error {
+	f, err := os.Open(blk.path)
+	if err != nil {
+		return err
+	}
+	sb, err := readMdSuperblock(f)
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %v", blk.path, err)
+	}
+
+	key := blk.uuid.toString()
+	mdNative.Lock()
+	a, ok := mdNative.arrays[key]
+	if !ok {
+		name := sb.arrayName()
+		if name == "" {
+			name = key
+		}
+		a = &mdArray{name: name, uuid: blk.uuid}
+		mdNative.arrays[key] = a
+	}
+	a.members = append(a.members, mdMember{path: blk.path, sb: sb})
+	_, active := a.freshMembers()
+	complete := !a.started && active == a.raidDisks()
+	if complete {
+		a.started = true
+	}
+	mdNative.Unlock()
+
+	if complete {
+		return startMdArray(a, false)
+	}
+	info("mdraid array %s is not complete, %d of %d devices found", a.name, active, a.raidDisks())
+	if !ok {
+		scheduleMdDegradedStart(a.name, func() {
+			mdNative.Lock()
+			started := a.started
+			a.started = true
+			mdNative.Unlock()
+			if started {
+				return
+			}
+			if err := startMdArray(a, true); err != nil {
+				severe("%v", err)
+			}
+		})
+	}
+	return nil
+}
+
+// startMdArray assembles the array from its fresh members
+func startMdArray(a *mdArray, degraded bool) error {
+	mdNative.Lock()
+	members, active := a.freshMembers()
+	raidDisks := a.raidDisks()
+	mdNative.Unlock()
+
+	level := members[0].sb.level
+	mod, ok := raidModules[level]
+	if !ok {
+		return fmt.Errorf("mdraid array %s: unknown raid level %d", a.name, int32(level))
+	}
+	wg := loadModules(mod)
+	wg.Wait()
+
+	if degraded {
+		warning("starting mdraid array %s in degraded mode, %d of %d devices are present", a.name, active, raidDisks)
+	} else {
+		info("assembling mdraid array %s", a.name)
+	}
+
+	dev, err := mdNewArray()
+	if err != nil {
+		return fmt.Errorf("mdraid array %s: %v", a.name, err)
+	}
+	if err := mdAssemble(dev, members); err != nil {
+		return fmt.Errorf("mdraid array %s: %v", a.name, err)
+	}
+
+	link := "/dev/md/" + a.name
+	if err := os.MkdirAll(filepath.Dir(link), 0o755); err != nil {
+		return err
+	}
+	if err := os.Symlink(dev, link); err != nil {
+		return err
+	}
+	return addBlockDevice(link, false, nil)
+}
+
+// mdNewArray creates a new unused md device and returns its path
+func mdNewArray() (string, error) {
+	for minor := mdFirstDynamicMinor; minor >= 0; minor-- {
+		name := "md" + strconv.Itoa(minor)
+		if _, err := os.Stat("/sys/block/" + name); err == nil {
+			continue
+		}
+		if err := os.WriteFile(mdNewArrayParam, []byte(name), 0o200); err != nil {
+			if os.IsExist(err) {
+				continue // created concurrently
+			}
+			return "", err
+		}
+		return "/dev/" + name, nil
+	}
+	return "", fmt.Errorf("no free md device")
+}
+
+// mdu_array_info_t from include/uapi/linux/raid/md_u.h
+type mdArrayInfo struct {
+	majorVersion, minorVersion, patchVersion int32
+	ctime                                    uint32
+	level, size, nrDisks, raidDisks          int32
+	mdMinor, notPersistent                   int32
+	utime, state                             uint32
+	activeDisks, workingDisks, failedDisks   int32
+	spareDisks, layout, chunkSize            int32
+}
+
+// mdu_disk_info_t from include/uapi/linux/raid/md_u.h
+type mdDiskInfo struct {
+	number, major, minor, raidDisk, state int32
+}
+
+const (
+	mdMajor       = 9
+	mdParamSize   = 3 * 4 // mdu_param_t
+	mdAddNewDisk  = 0x21
+	mdSetArrayInf = 0x23
+	mdRunArray    = 0x30
+	mdStopArray   = 0x32
+)
+
+// mdAssemble adds the members to the md device and starts the array
+func mdAssemble(dev string, members []mdMember) error {
+	f, err := os.OpenFile(dev, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// superblock version only, the kernel reads the rest of the array configuration from the members
+	arrayInfo := mdArrayInfo{majorVersion: 1, minorVersion: int32(members[0].sb.minorVersion)}
+	if err := ioctl(f.Fd(), iow(mdMajor, mdSetArrayInf, unsafe.Sizeof(arrayInfo)), uintptr(unsafe.Pointer(&arrayInfo))); err != nil {
+		return fmt.Errorf("set array info: %v", err)
+	}
+
+	stop := func() { _ = ioctl(f.Fd(), ioc(directionNone, mdMajor, mdStopArray, 0), 0) }
+	for _, m := range members {
+		devNo, err := deviceNo(m.path)
+		if err != nil {
+			stop()
+			return err
+		}
+		disk := mdDiskInfo{major: int32(unix.Major(devNo)), minor: int32(unix.Minor(devNo))}
+		if err := ioctl(f.Fd(), iow(mdMajor, mdAddNewDisk, unsafe.Sizeof(disk)), uintptr(unsafe.Pointer(&disk))); err != nil {
+			stop()
+			return fmt.Errorf("add %s: %v", m.path, err)
+		}
+	}
+
+	if err := ioctl(f.Fd(), iow(mdMajor, mdRunArray, mdParamSize), 0); err != nil {
+		stop()
+		return fmt.Errorf("run array: %v", err)
+	}
+	return nil
+}
+
+// mdraidNativeIncompleteArrays returns arrays that wait for their members
+func mdraidNativeIncompleteArrays() []string {
+	mdNative.Lock()
+	defer mdNative.Unlock()
+
+	var arrays []string
+	for _, a := range mdNative.arrays {
+		if !a.started {
+			arrays = append(arrays, a.name)
+		}
+	}
+	sort.Strings(arrays)
+	return arrays
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// makeMdSuperblock creates a minimal valid md 1.x superblock located at the given offset
+func makeMdSuperblock(offset int64, name string, level, raidDisks, devNumber uint32, events uint64, roles []uint16) []byte {
+	le := binary.LittleEndian
+	sb := make([]byte, mdSuperblockSize+2*len(roles))
+	le.PutUint32(sb[0:4], mdSuperblockMagic)
+	le.PutUint32(sb[4:8], 1)
+	copy(sb[16:32], []byte{0x9e, 0xe4, 0xce, 0x4c, 0xc1, 0x79, 0x14, 0x1f, 0x33, 0xb0, 0x5b, 0x33, 0x98, 0x0e, 0xce, 0x9a})
+	copy(sb[32:64], name)
+	le.PutUint32(sb[72:76], level)
+	le.PutUint32(sb[92:96], raidDisks)
+	le.PutUint64(sb[144:152], uint64(offset/512))
+	le.PutUint32(sb[160:164], devNumber)
+	le.PutUint64(sb[200:208], events)
+	le.PutUint32(sb[220:224], uint32(len(roles)))
+	for i, r := range roles {
+		le.PutUint16(sb[mdSuperblockSize+2*i:], r)
+	}
+	le.PutUint32(sb[216:220], mdSuperblockChecksum(sb))
+	return sb
+}
+
+func TestReadMdSuperblock(t *testing.T) {
+	const size = 1024 * 1024
+
+	for _, minor := range []uint32{0, 1, 2} {
+		path := filepath.Join(t.TempDir(), "member")
+		offset := mdSuperblockOffset(minor, size)
+		data := make([]byte, size)
+		copy(data[offset:], makeMdSuperblock(offset, "myhost:array0", levelRaid1, 2, 1, 42, []uint16{0, 1}))
+		require.NoError(t, os.WriteFile(path, data, 0o644))
+
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		sb, err := readMdSuperblock(f)
+		_ = f.Close()
+		require.NoError(t, err)
+		require.Equal(t, minor, sb.minorVersion)
+		require.Equal(t, "array0", sb.arrayName())
+		require.Equal(t, uint32(levelRaid1), sb.level)
+		require.Equal(t, uint32(2), sb.raidDisks)
+		require.Equal(t, uint64(42), sb.events)
+		require.Equal(t, uint16(1), sb.role)
+		require.Equal(t, "9ee4ce4c-c179-141f-33b0-5b33980ece9a", UUID(sb.uuid).toString())
+	}
+
+	// corrupted checksum
+	path := filepath.Join(t.TempDir(), "member")
+	data := make([]byte, size)
+	sb := makeMdSuperblock(4096, "array0", levelRaid1, 2, 0, 1, []uint16{0, 1})
+	sb[100]++
+	copy(data[4096:], sb)
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = readMdSuperblock(f)
+	require.Error(t, err)
+}
+
+func TestMdArrayFreshMembers(t *testing.T) {
+	member := func(path string, role uint16, events uint64) mdMember {
+		return mdMember{path: path, sb: &mdSuperblock{raidDisks: 3, role: role, events: events}}
+	}
+
+	a := &mdArray{members: []mdMember{
+		member("/dev/sdc", 2, 10),
+		member("/dev/sda", 0, 10),
+		member("/dev/sdd", mdRoleSpare, 10),
+	}}
+	fresh, active := a.freshMembers()
+	require.Equal(t, uint32(2), active)
+	require.Equal(t, uint32(3), a.raidDisks())
+	require.Equal(t, []string{"/dev/sda", "/dev/sdc", "/dev/sdd"}, memberPaths(fresh))
+
+	// a member that missed updates is not used
+	a.members = append(a.members, member("/dev/sdb", 1, 5))
+	fresh, active = a.freshMembers()
+	require.Equal(t, uint32(2), active)
+	require.Equal(t, []string{"/dev/sda", "/dev/sdc", "/dev/sdd"}, memberPaths(fresh))
+
+	// but one missed update is tolerated
+	a.members[3] = member("/dev/sdb", 1, 9)
+	_, active = a.freshMembers()
+	require.Equal(t, uint32(3), active)
+}
+
+func memberPaths(members []mdMember) []string {
+	var paths []string
+	for _, m := range members {
+		paths = append(paths, m.path)
+	}
+	return paths
+}
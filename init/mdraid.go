@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mdraid array is assembled once all its members are present, either by 'mdadm --incremental' or natively
+// (mdraid_native config option). An incomplete array is not started unless rd.md.degraded= allows to start
+// it in degraded mode after waiting for the missing members.
+// Intel IMSM and DDF ("fake RAID") containers are always handled by mdadm as they need mdmon to update the metadata.
+
+var (
+	mdDegraded        bool // rd.md.degraded=
+	mdDegradedTimeout = 10 * time.Second
+)
+
+// parseMdDegradedParam parses rd.md.degraded= value that is either a boolean or the time to wait for missing members
+func parseMdDegradedParam(value string) (bool, time.Duration, error) {
+	switch value {
+	case "", "1", "yes", "true":
+		return true, mdDegradedTimeout, nil
+	case "0", "no", "false":
+		return false, 0, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return false, 0, fmt.Errorf("expected yes, no or a duration")
+	}
+	return true, timeout, nil
+}
+
+// scheduleMdDegradedStart calls start after rd.md.degraded timeout if degraded arrays are allowed
+func scheduleMdDegradedStart(name string, start func()) {
+	if !mdDegraded {
+		return
+	}
+	info("mdraid array %s is going to be started in degraded mode if its devices do not appear in %v", name, mdDegradedTimeout)
+	time.AfterFunc(mdDegradedTimeout, start)
+}
+
+var raidModules = map[uint32]string{
+	levelMultipath: "multipath",
+	levelLinear:    "linear",
+	levelRaid0:     "raid0",
+	levelRaid1:     "raid1",
+	levelRaid4:     "raid456",
+	levelRaid5:     "raid456",
+	levelRaid6:     "raid456",
+	levelRaid10:    "raid10",
+}
+
+func handleMdraidBlockDevice(blk *blkInfo) error {
+	if !config.EnableMdraid {
+		info("MdRaid support is disabled, ignoring mdraid device %s", blk.path)
+		return nil
+	}
+	if config.MdraidNative {
+		return handleMdraidNativeDevice(blk)
+	}
+	info("trying to assemble mdraid array %s", blk.uuid.toString())
+
+	if mod, ok := raidModules[blk.data.(mdraidData).level]; ok {
+		wg := loadModules(mod)
+		wg.Wait()
+	} else {
+		return fmt.Errorf("unknown raid level for device %s", blk.path)
+	}
+
+	out, err := exec.Command("mdadm", "--export", "--incremental", blk.path).Output()
+	if err != nil {
+		return unwrapExitError(err)
+	}
+
+	props := parseProperties(string(out))
+	arrayName, hasArrayName := props["MD_DEVNAME"]
+	if !hasArrayName {
+		return fmt.Errorf("mdraid array at %s does not have a MD_DEVNAME property", blk.uuid.toString())
+	}
+
+	if started, ok := props["MD_STARTED"]; !ok || started != "yes" {
+		info("mdraid array %s is not complete, ignore it", arrayName)
+		if mdadmArrays.add(arrayName) {
+			scheduleMdDegradedStart(arrayName, func() {
+				if err := mdadmRunDegraded(arrayName); err != nil {
+					severe("%v", err)
+				}
+			})
+		}
+		return nil
+	}
+
+	if !mdadmArrays.start(arrayName) {
+		return nil
+	}
+	return addBlockDevice("/dev/md/"+arrayName, false, nil)
+}
+
+// mdadmArrays tracks arrays assembled by mdadm
+var mdadmArrays = mdArraySet{arrays: make(map[string]bool)}
+
+type mdArraySet struct {
+	sync.Mutex
+	arrays map[string]bool // array name -> started
+}
+
+// add registers the array and returns true if it has not been seen before
+func (s *mdArraySet) add(name string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.arrays[name]; ok {
+		return false
+	}
+	s.arrays[name] = false
+	return true
+}
+
+// start marks the array as started and returns false if it has been started already
+func (s *mdArraySet) start(name string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.arrays[name] {
+		return false
+	}
+	s.arrays[name] = true
+	return true
+}
+
+func (s *mdArraySet) incomplete() []string {
+	s.Lock()
+	defer s.Unlock()
+	var names []string
+	for name, started := range s.arrays {
+		if !started {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func mdadmRunDegraded(arrayName string) error {
+	if !mdadmArrays.start(arrayName) {
+		return nil
+	}
+	dev := "/dev/md/" + arrayName
+	warning("starting mdraid array %s in degraded mode", arrayName)
+	if err := exec.Command("mdadm", "--run", dev).Run(); err != nil {
+		return fmt.Errorf("mdraid array %s: %v", arrayName, unwrapExitError(err))
+	}
+	return addBlockDevice(dev, false, nil)
+}
+
+// handleMdContainerBlockDevice adds a member of IMSM or DDF container. Once the container is complete mdadm starts
+// the volumes of the container, they are picked up with 'change' uevent.
+func handleMdContainerBlockDevice(blk *blkInfo) error {
+	if !config.EnableMdraid {
+		info("MdRaid support is disabled, ignoring %s container device %s", blk.format, blk.path)
+		return nil
+	}
+	if config.MdraidNative {
+		return fmt.Errorf("%s is a member of %s container, it can be assembled only with mdadm and mdraid_native config option needs to be disabled", blk.path, blk.format)
+	}
+
+	// the container might have volumes of any level
+	wg := loadModules("raid0", "raid1", "raid10", "raid456")
+	wg.Wait()
+
+	info("adding %s to %s container", blk.path, blk.format)
+	out, err := exec.Command("mdadm", "--export", "--incremental", blk.path).Output()
+	if err != nil {
+		return unwrapExitError(err)
+	}
+	debug("mdadm: %s", strings.TrimSpace(string(out)))
+	mdContainerDegradedOnce.Do(func() {
+		scheduleMdDegradedStart(blk.format+" container", func() {
+			// starts only the volumes that are not complete yet
+			if err := exec.Command("mdadm", "--incremental", "--run", "--scan").Run(); err != nil {
+				severe("mdraid containers: %v", unwrapExitError(err))
+			}
+		})
+	})
+	return nil
+}
+
+var (
+	mdContainerDegradedOnce sync.Once
+	mdContainerVolumesMutex sync.Mutex
+	mdContainerVolumes      = make(map[string]bool)
+)
+
+// handleMdContainerVolumeUevent adds a volume of IMSM/DDF container once it is started. The volume device is created
+// empty and 'add' uevent comes before the volume has any data.
+func handleMdContainerVolumeUevent(devName string) error {
+	metadata, err := os.ReadFile("/sys/block/" + devName + "/md/metadata_version")
+	if err != nil || !strings.HasPrefix(string(metadata), "external:/") {
+		return nil
+	}
+	state, err := os.ReadFile("/sys/block/" + devName + "/md/array_state")
+	if err != nil {
+		return nil
+	}
+	switch strings.TrimSpace(string(state)) {
+	case "clear", "inactive":
+		return nil
+	}
+
+	mdContainerVolumesMutex.Lock()
+	added := mdContainerVolumes[devName]
+	mdContainerVolumes[devName] = true
+	mdContainerVolumesMutex.Unlock()
+	if added {
+		return nil
+	}
+
+	// the volume might have been seen at 'add' uevent when it was empty
+	devPath := "/dev/" + devName
+	forgetBlockDevice(devPath)
+	return addBlockDevice(devPath, false, nil)
+}
+
+// printIncompleteMdraidArrays explains why an array did not appear
+func printIncompleteMdraidArrays() {
+	if !config.EnableMdraid {
+		return
+	}
+	arrays := mdadmArrays.incomplete()
+	if config.MdraidNative {
+		arrays = mdraidNativeIncompleteArrays()
+	}
+	for _, name := range arrays {
+		warning("mdraid array %s was not started as some of its devices are missing. Make sure all the disks are connected or boot with rd.md.degraded=yes to start the array in degraded mode", name)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"golang.org/x/sys/unix"
+)
+
+// Booster measures what defines the early boot path and is not covered by the firmware and the bootloader: the image
+// config, the kernel command line and the keys used to unlock the volumes (the keyfile location, never its content).
+// The measurements are extended to config.MeasurePCR right before switching to the root filesystem, so they do not
+// affect PCR policies of the secrets unsealed during the boot. The kernel event log is read-only, the firmware log
+// with the booster events appended is written to /run/booster/binary_bios_measurements for attestation tools.
+
+var (
+	firmwareEventLogPath = "/sys/kernel/security/tpm0/binary_bios_measurements"
+	measureEventLogPath  = "/run/booster/binary_bios_measurements"
+)
+
+const (
+	evIPL              = 0x0000000D // TCG event type used for measurements done by the OS loader
+	specIDEventOffset  = 32         // offset of the Spec ID event data in the first (TPM 1.2 format) event of the log
+	specIDEventCurrent = "Spec ID Event03"
+)
+
+type measureEvent struct {
+	description string // event data in the event log
+	data        []byte // measured content
+}
+
+type measureDigest struct {
+	alg    tpm2.Algorithm
+	digest []byte
+}
+
+var (
+	measurementsMutex sync.Mutex
+	measurements      []measureEvent
+)
+
+// measure records the content to be extended to the PCR
+func measure(description string, data []byte) {
+	if config.MeasurePCR == 0 {
+		return
+	}
+	measurementsMutex.Lock()
+	defer measurementsMutex.Unlock()
+	measurements = append(measurements, measureEvent{description, append([]byte(nil), data...)})
+}
+
+// measureDigests hashes the data with the algorithm of every PCR bank
+func measureDigests(banks []tpm2.Algorithm, data []byte) ([]measureDigest, error) {
+	var digests []measureDigest
+	for _, bank := range banks {
+		hash, err := bank.Hash()
+		if err != nil {
+			return nil, err
+		}
+		h := hash.New()
+		h.Write(data)
+		digests = append(digests, measureDigest{bank, h.Sum(nil)})
+	}
+	return digests, nil
+}
+
+// encodeTCGEvent encodes the event in the crypto agile (TCG_PCR_EVENT2) format of the TCG PC Client event log
+func encodeTCGEvent(pcr int, eventType uint32, digests []measureDigest, data []byte) []byte {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(pcr))
+	_ = binary.Write(&buf, binary.LittleEndian, eventType)
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(digests)))
+	for _, d := range digests {
+		_ = binary.Write(&buf, binary.LittleEndian, uint16(d.alg))
+		buf.Write(d.digest)
+	}
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// isCryptoAgileLog checks that the event log starts with the Spec ID event of the crypto agile format,
+// the booster events cannot be appended to a TPM 1.2 (SHA1 only) log
+func isCryptoAgileLog(log []byte) bool {
+	return len(log) > specIDEventOffset && bytes.HasPrefix(log[specIDEventOffset:], []byte(specIDEventCurrent))
+}
+
+// tpmPCRBanks returns the active PCR banks that have the PCR allocated
+func tpmPCRBanks(dev io.ReadWriter, pcr int) ([]tpm2.Algorithm, error) {
+	caps, _, err := tpm2.GetCapability(dev, tpm2.CapabilityPCRs, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	var banks []tpm2.Algorithm
+	for _, c := range caps {
+		sel, ok := c.(tpm2.PCRSelection)
+		if !ok {
+			continue
+		}
+		if _, err := sel.Hash.Hash(); err != nil {
+			warning("PCR bank 0x%x is not supported, it is not extended", uint16(sel.Hash))
+			continue
+		}
+		for _, p := range sel.PCRs {
+			if p == pcr {
+				banks = append(banks, sel.Hash)
+				break
+			}
+		}
+	}
+	return banks, nil
+}
+
+// extendMeasurements extends the PCR with the recorded measurements and writes the event log
+func extendMeasurements() error {
+	measurementsMutex.Lock()
+	events := measurements
+	measurements = nil
+	measurementsMutex.Unlock()
+	if len(events) == 0 {
+		return nil
+	}
+
+	pcr := config.MeasurePCR
+	var log []byte
+	err := withTPM(func(t *tpmConn) error {
+		banks, err := tpmPCRBanks(t.dev, pcr)
+		if err != nil {
+			return fmt.Errorf("reading PCR banks: %w", err)
+		}
+		for _, e := range events {
+			digests, err := measureDigests(banks, e.data)
+			if err != nil {
+				return err
+			}
+			for _, d := range digests {
+				if err := tpm2.PCRExtend(t.dev, tpmutil.Handle(pcr), d.alg, d.digest, ""); err != nil {
+					return fmt.Errorf("extending PCR %d: %w", pcr, err)
+				}
+			}
+			log = append(log, encodeTCGEvent(pcr, evIPL, digests, []byte(e.description))...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	info("measured %d events to PCR %d", len(events), pcr)
+
+	return writeMeasurementLog(log)
+}
+
+// writeMeasurementLog writes the firmware event log followed by the booster events
+func writeMeasurementLog(events []byte) error {
+	if err := mount("securityfs", "/sys/kernel/security", "securityfs", unix.MS_NOSUID|unix.MS_NOEXEC|unix.MS_NODEV, ""); err != nil && !errors.Is(err, unix.EBUSY) {
+		warning("%v", err)
+	}
+	firmwareLog, err := os.ReadFile(firmwareEventLogPath)
+	if err != nil {
+		warning("firmware event log: %v", err)
+	} else if !isCryptoAgileLog(firmwareLog) {
+		warning("firmware event log is not in crypto agile format, only the booster events are logged")
+		firmwareLog = nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(measureEventLogPath), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(measureEventLogPath, append(firmwareLog, events...), 0o600)
+}
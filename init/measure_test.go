@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeasure(t *testing.T) {
+	defer func() {
+		config.MeasurePCR = 0
+		measurements = nil
+	}()
+
+	measure("kernel cmdline", []byte("quiet"))
+	require.Empty(t, measurements)
+
+	config.MeasurePCR = 9
+	data := []byte("root=/dev/sda2")
+	measure("kernel cmdline", data)
+	data[0] = 'R'
+	require.Equal(t, []measureEvent{{"kernel cmdline", []byte("root=/dev/sda2")}}, measurements)
+}
+
+func TestEncodeTCGEvent(t *testing.T) {
+	data := []byte("booster config")
+	digests, err := measureDigests([]tpm2.Algorithm{tpm2.AlgSHA1, tpm2.AlgSHA256}, data)
+	require.NoError(t, err)
+	sha1Digest := sha1.Sum(data)
+	sha256Digest := sha256.Sum256(data)
+	require.Equal(t, []measureDigest{{tpm2.AlgSHA1, sha1Digest[:]}, {tpm2.AlgSHA256, sha256Digest[:]}}, digests)
+
+	event := encodeTCGEvent(9, evIPL, digests, []byte("booster config"))
+	var expected []byte
+	expected = binary.LittleEndian.AppendUint32(expected, 9)
+	expected = binary.LittleEndian.AppendUint32(expected, 0x0d)
+	expected = binary.LittleEndian.AppendUint32(expected, 2)
+	expected = binary.LittleEndian.AppendUint16(expected, 0x0004)
+	expected = append(expected, sha1Digest[:]...)
+	expected = binary.LittleEndian.AppendUint16(expected, 0x000b)
+	expected = append(expected, sha256Digest[:]...)
+	expected = binary.LittleEndian.AppendUint32(expected, 14)
+	expected = append(expected, "booster config"...)
+	require.Equal(t, expected, event)
+}
+
+func TestIsCryptoAgileLog(t *testing.T) {
+	log := make([]byte, 32)
+	log = append(log, "Spec ID Event03\x00"...)
+	require.True(t, isCryptoAgileLog(log))
+
+	log = make([]byte, 32)
+	log = append(log, "Spec ID Event00\x00"...)
+	require.False(t, isCryptoAgileLog(log))
+	require.False(t, isCryptoAgileLog(nil))
+}
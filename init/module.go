@@ -27,9 +27,16 @@ type alias struct{ pattern, module string } // module alias info
 var (
 	aliases          []alias      // all aliases from initramfs
 	processedAliases = sync.Map{} // aliases that have been seen/processed by booster
+
+	// modaliasAutoload enables loading of device drivers based on modalias reported by sysfs and uevents.
+	// If disabled then only modules specified explicitly (e.g. with rd.modules_force_load) are loaded.
+	modaliasAutoload = true
 )
 
 func loadModalias(alias string) error {
+	if !modaliasAutoload {
+		return nil
+	}
 	if _, existed := processedAliases.LoadOrStore(alias, true); existed {
 		return nil
 	}
@@ -39,6 +46,7 @@ func loadModalias(alias string) error {
 		debug("no match found for alias %s", alias)
 		return nil
 	}
+	debug("loading modules %v for alias %s", mods, alias)
 	_ = loadModules(mods...)
 	return nil
 }
@@ -68,7 +76,10 @@ func loadModuleUnlocked(wg *sync.WaitGroup, modules ...string) {
 		defer loadingModulesWg.Done()
 
 		depsWg.Wait()
-		if err := finitModule(mod); err != nil {
+		phaseDone := startPhase("load module %s", mod)
+		err := finitModule(mod)
+		phaseDone()
+		if err != nil {
 			info("finit(%v): %v", mod, err)
 			if errors.Is(err, os.ErrNotExist) {
 				missingModulesMutex.Lock()
@@ -89,7 +100,7 @@ func loadModuleUnlocked(wg *sync.WaitGroup, modules ...string) {
 
 		// post deps are loaded independently if finit() call successful or not
 		var postDepsWg sync.WaitGroup
-		if deps, ok := config.ModuleDependencies[mod]; ok {
+		if deps, ok := config.ModulePostDependencies[mod]; ok {
 			loadModuleUnlocked(&postDepsWg, deps...)
 		}
 	}
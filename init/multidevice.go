@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Filesystems like btrfs and bcachefs might span multiple devices. Root is mounted once all the devices of the
+// filesystem are present. If the root flags allow a degraded mount then the filesystem is mounted with the devices
+// found after multiDeviceDegradedTimeout.
+
+const multiDeviceDegradedTimeout = 10 * time.Second
+
+type multiDeviceFs struct {
+	sync.Mutex
+	fstype   string
+	devices  map[string]map[uint64]string // filesystem UUID -> device index -> device path
+	mounting map[string]bool              // filesystem UUID
+}
+
+func newMultiDeviceFs(fstype string) *multiDeviceFs {
+	return &multiDeviceFs{
+		fstype:   fstype,
+		devices:  make(map[string]map[uint64]string),
+		mounting: make(map[string]bool),
+	}
+}
+
+// paths returns the devices of the filesystem ordered by their index
+func (m *multiDeviceFs) paths(fsUUID string) []string {
+	m.Lock()
+	defer m.Unlock()
+
+	devices := m.devices[fsUUID]
+	indexes := make([]uint64, 0, len(devices))
+	for idx := range devices {
+		indexes = append(indexes, idx)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	paths := make([]string, 0, len(indexes))
+	for _, idx := range indexes {
+		paths = append(paths, devices[idx])
+	}
+	return paths
+}
+
+// claim makes sure that only one of the filesystem devices is used to mount it
+func (m *multiDeviceFs) claim(fsUUID string) bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.mounting[fsUUID] {
+		return false
+	}
+	m.mounting[fsUUID] = true
+	return true
+}
+
+// addDevice registers the device and calls mount once all total devices of the filesystem are present.
+// If degraded is true then mount is called after a timeout even if some devices are missing.
+func (m *multiDeviceFs) addDevice(fsUUID string, idx, total uint64, path string, degraded bool, mount func() error) error {
+	m.Lock()
+	devices, seen := m.devices[fsUUID]
+	if !seen {
+		devices = make(map[uint64]string)
+		m.devices[fsUUID] = devices
+	}
+	devices[idx] = path
+	present := uint64(len(devices))
+	m.Unlock()
+
+	doMount := func() error {
+		err := mount()
+		if err != nil {
+			// let the next device retry
+			m.Lock()
+			m.mounting[fsUUID] = false
+			m.Unlock()
+		}
+		return err
+	}
+
+	if present < total {
+		info("%s filesystem %s: %d of %d devices found, waiting for the rest of the devices", m.fstype, fsUUID, present, total)
+		if !seen && degraded {
+			time.AfterFunc(multiDeviceDegradedTimeout, func() {
+				if !m.claim(fsUUID) {
+					return
+				}
+				warning("%s filesystem %s: not all devices found, mounting it in degraded mode", m.fstype, fsUUID)
+				if err := doMount(); err != nil {
+					severe("%v", err)
+				}
+			})
+		}
+		return nil
+	}
+
+	if !m.claim(fsUUID) {
+		return nil
+	}
+	return doMount()
+}
+
+// printIncomplete explains why a multi-device root filesystem was not mounted
+func (m *multiDeviceFs) printIncomplete(degradedOption string) {
+	m.Lock()
+	defer m.Unlock()
+	for fsUUID, devices := range m.devices {
+		if !m.mounting[fsUUID] {
+			warning("%s filesystem %s was not mounted, only %d of its devices were found. Make sure all the disks are connected or add '%s' to rootflags= to mount it without the missing devices", m.fstype, fsUUID, len(devices), degradedOption)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// nbdTarget specifies a network block device export, e.g. root=nbd:server:port/export
+type nbdTarget struct {
+	server string
+	port   int
+	export string
+}
+
+var (
+	nbdTargets []*nbdTarget // list of network block devices that need to be connected at boot
+	nbdRoot    *nbdTarget   // the target that contains root filesystem
+
+	// the device the root target is connected to, it becomes known only after the connection is established
+	nbdRootDevice      string
+	nbdRootDeviceMutex sync.Mutex
+)
+
+const (
+	nbdDefaultPort    = 10809
+	nbdConnectTimeout = 60 * time.Second // max time to wait for the server connection, including retries
+)
+
+// parseNbdParam parses dracut style nbd parameter nbd:<server>:<port>[/<export>][:<fstype>[:<mountopts>[:<nbdopts>]]]
+// It returns the target and the rest of the fields (fstype, mount options).
+func parseNbdParam(param string) (*nbdTarget, []string, error) {
+	if !strings.HasPrefix(param, "nbd:") {
+		return nil, nil, fmt.Errorf("nbd parameter should start with 'nbd:'")
+	}
+	fields := strings.Split(strings.TrimPrefix(param, "nbd:"), ":")
+	if fields[0] == "" {
+		return nil, nil, fmt.Errorf("nbd server is not specified")
+	}
+
+	t := &nbdTarget{server: fields[0], port: nbdDefaultPort}
+	if len(fields) > 1 {
+		port := fields[1]
+		if idx := strings.IndexByte(port, '/'); idx != -1 {
+			t.export = port[idx+1:]
+			port = port[:idx]
+		}
+		if port != "" {
+			var err error
+			t.port, err = strconv.Atoi(port)
+			if err != nil || t.port <= 0 || t.port > 65535 {
+				return nil, nil, fmt.Errorf("invalid nbd port %s", port)
+			}
+		}
+	}
+
+	var rest []string
+	if len(fields) > 2 {
+		rest = fields[2:]
+	}
+	if len(rest) > 2 {
+		for _, o := range strings.Split(rest[2], ",") {
+			if o != "" {
+				warning("nbd: unknown option %s, ignoring it", o)
+			}
+		}
+	}
+
+	return t, rest, nil
+}
+
+// parseNbdRoot handles root=nbd:... parameter. The connected nbd device is used as the root device.
+func parseNbdRoot(param string) error {
+	t, rest, err := parseNbdParam(param)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 && rest[0] != "" {
+		rootFsType = rest[0]
+	}
+	if len(rest) > 1 && rest[1] != "" {
+		rootFlags = rest[1]
+	}
+
+	nbdTargets = append(nbdTargets, t)
+	nbdRoot = t
+	return nil
+}
+
+func (t *nbdTarget) address() string {
+	return net.JoinHostPort(t.server, strconv.Itoa(t.port))
+}
+
+// NBD protocol constants, see https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+const (
+	nbdMagic         = 0x4e42444d41474943 // "NBDMAGIC"
+	nbdOptMagic      = 0x49484156454f5054 // "IHAVEOPT"
+	nbdOldstyleMagic = 0x00420281861253
+
+	nbdFlagFixedNewstyle = 1 << 0
+	nbdFlagNoZeroes      = 1 << 1
+
+	nbdOptExportName = 1
+)
+
+// nbdHandshake performs the NBD negotiation phase and returns the export size and transmission flags.
+func nbdHandshake(conn io.ReadWriter, export string) (size uint64, flags uint16, err error) {
+	var hdr struct {
+		Magic    uint64
+		OptMagic uint64
+	}
+	if err := binary.Read(conn, binary.BigEndian, &hdr); err != nil {
+		return 0, 0, fmt.Errorf("reading handshake: %v", err)
+	}
+	if hdr.Magic != nbdMagic {
+		return 0, 0, fmt.Errorf("server is not an NBD server")
+	}
+
+	if hdr.OptMagic == nbdOldstyleMagic {
+		if export != "" {
+			return 0, 0, fmt.Errorf("server uses oldstyle negotiation that does not support named exports")
+		}
+		var old struct {
+			Size  uint64
+			Flags uint32
+			Zeros [124]byte
+		}
+		if err := binary.Read(conn, binary.BigEndian, &old); err != nil {
+			return 0, 0, err
+		}
+		return old.Size, uint16(old.Flags), nil
+	}
+	if hdr.OptMagic != nbdOptMagic {
+		return 0, 0, fmt.Errorf("unknown NBD negotiation magic 0x%x", hdr.OptMagic)
+	}
+
+	var serverFlags uint16
+	if err := binary.Read(conn, binary.BigEndian, &serverFlags); err != nil {
+		return 0, 0, err
+	}
+	clientFlags := serverFlags & (nbdFlagFixedNewstyle | nbdFlagNoZeroes)
+	if err := binary.Write(conn, binary.BigEndian, uint32(clientFlags)); err != nil {
+		return 0, 0, err
+	}
+
+	opt := struct {
+		Magic  uint64
+		Option uint32
+		Length uint32
+	}{nbdOptMagic, nbdOptExportName, uint32(len(export))}
+	if err := binary.Write(conn, binary.BigEndian, opt); err != nil {
+		return 0, 0, err
+	}
+	if _, err := conn.Write([]byte(export)); err != nil {
+		return 0, 0, err
+	}
+
+	var reply struct {
+		Size  uint64
+		Flags uint16
+	}
+	if err := binary.Read(conn, binary.BigEndian, &reply); err != nil {
+		// per protocol the server closes the connection if the export does not exist
+		return 0, 0, fmt.Errorf("export '%s' is not available: %v", export, err)
+	}
+	if clientFlags&nbdFlagNoZeroes == 0 {
+		if _, err := io.ReadFull(conn, make([]byte, 124)); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return reply.Size, reply.Flags, nil
+}
+
+// constants from include/uapi/linux/nbd-netlink.h
+const (
+	nbdCmdConnect = 1
+
+	nbdAttrIndex          = 1
+	nbdAttrSizeBytes      = 2
+	nbdAttrBlockSizeBytes = 3
+	nbdAttrTimeout        = 4
+	nbdAttrServerFlags    = 5
+	nbdAttrSockets        = 7
+
+	nbdSockItem = 1
+	nbdSockFd   = 1
+
+	nbdGenlVersion = 1
+)
+
+// nbdNetlinkConnect passes the connected socket to the kernel nbd driver.
+// Once the kernel holds the socket the device stays connected even after booster switches to the new root.
+func nbdNetlinkConnect(sock *os.File, size uint64, flags uint16) (int, error) {
+	family, err := netlink.GenlFamilyGet("nbd")
+	if err != nil {
+		return 0, fmt.Errorf("nbd netlink family: %v", err)
+	}
+
+	req := nl.NewNetlinkRequest(int(family.ID), 0)
+	req.AddData(&nl.Genlmsg{Command: nbdCmdConnect, Version: nbdGenlVersion})
+	req.AddData(nl.NewRtAttr(nbdAttrSizeBytes, nl.Uint64Attr(size)))
+	req.AddData(nl.NewRtAttr(nbdAttrBlockSizeBytes, nl.Uint64Attr(512)))
+	req.AddData(nl.NewRtAttr(nbdAttrServerFlags, nl.Uint64Attr(uint64(flags))))
+	req.AddData(nl.NewRtAttr(nbdAttrTimeout, nl.Uint64Attr(30)))
+	sockets := nl.NewRtAttr(nbdAttrSockets|unix.NLA_F_NESTED, nil)
+	item := sockets.AddRtAttr(nbdSockItem|unix.NLA_F_NESTED, nil)
+	item.AddRtAttr(nbdSockFd, nl.Uint32Attr(uint32(sock.Fd())))
+	req.AddData(sockets)
+
+	msgs, err := req.Execute(unix.NETLINK_GENERIC, 0)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range msgs {
+		attrs, err := nl.ParseRouteAttr(m[nl.SizeofGenlmsg:])
+		if err != nil {
+			return 0, err
+		}
+		for _, a := range attrs {
+			if a.Attr.Type == nbdAttrIndex {
+				return int(nl.NativeEndian().Uint32(a.Value)), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("kernel did not report the nbd device index")
+}
+
+// nbdConnectOnce connects to the server and attaches the export to a free nbd device.
+func nbdConnectOnce(t *nbdTarget) (string, error) {
+	conn, err := net.DialTimeout("tcp", t.address(), 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	size, flags, err := nbdHandshake(conn, t.export)
+	if err != nil {
+		return "", err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	// kernel requires a blocking socket, File() returns a duplicated descriptor that we can safely switch to blocking mode
+	sock, err := conn.(*net.TCPConn).File()
+	if err != nil {
+		return "", err
+	}
+	defer sock.Close()
+	if err := unix.SetNonblock(int(sock.Fd()), false); err != nil {
+		return "", err
+	}
+
+	idx, err := nbdNetlinkConnect(sock, size, flags)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("/dev/nbd%d", idx), nil
+}
+
+// connectNbd connects the network block device and adds it to the list of processed block devices.
+// Network might be not ready at the moment this function is called so transient errors are retried.
+func connectNbd(t *nbdTarget) error {
+	wg := loadModules("nbd")
+	wg.Wait()
+
+	info("nbd: connecting to %s export '%s'", t.address(), t.export)
+	deadline := time.Now().Add(nbdConnectTimeout)
+	for {
+		dev, err := nbdConnectOnce(t)
+		if err == nil {
+			info("nbd: export '%s' from %s is connected as %s", t.export, t.address(), dev)
+			if t == nbdRoot {
+				nbdRootDeviceMutex.Lock()
+				nbdRootDevice = dev
+				nbdRootDeviceMutex.Unlock()
+			}
+			return addBlockDevice(dev, true, nil)
+		}
+
+		var netError *net.OpError
+		if !errors.As(err, &netError) && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("nbd %s: %v", t.address(), err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("nbd: unable to connect to server %s: %v", t.address(), err)
+		}
+		debug("nbd: connecting to %s: %v, retrying", t.address(), err)
+		time.Sleep(time.Second)
+	}
+}
+
+// isNbdRootDevice checks whether the device is the connected root=nbd:... target
+func isNbdRootDevice(devpath string) bool {
+	nbdRootDeviceMutex.Lock()
+	defer nbdRootDeviceMutex.Unlock()
+	return nbdRootDevice != "" && nbdRootDevice == devpath
+}
+
+// isDisconnectedNbdDevice checks whether the device is an nbd device that has not been connected yet.
+// The kernel creates a number of nbd devices when the module is loaded, these devices are empty until connected.
+func isDisconnectedNbdDevice(devpath string) bool {
+	name := filepath.Base(devpath)
+	if !strings.HasPrefix(name, "nbd") {
+		return false
+	}
+	data, err := os.ReadFile("/sys/class/block/" + name + "/size")
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(data)) == "0"
+}
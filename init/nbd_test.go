@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNbdParam(t *testing.T) {
+	check := func(param string, expected nbdTarget, expectedRest []string) {
+		target, rest, err := parseNbdParam(param)
+		require.NoError(t, err)
+		require.Equal(t, expected, *target)
+		require.Equal(t, expectedRest, rest)
+	}
+
+	check("nbd:10.0.2.2", nbdTarget{"10.0.2.2", 10809, ""}, nil)
+	check("nbd:10.0.2.2:5000", nbdTarget{"10.0.2.2", 5000, ""}, nil)
+	check("nbd:server.local:5000/root", nbdTarget{"server.local", 5000, "root"}, nil)
+	check("nbd:server.local:/root:ext4:noatime", nbdTarget{"server.local", 10809, "root"}, []string{"ext4", "noatime"})
+
+	invalid := func(param string) {
+		_, _, err := parseNbdParam(param)
+		require.Error(t, err)
+	}
+	invalid("nbd:")
+	invalid("nbd:server:port")
+	invalid("nbd:server:70000")
+	invalid("iscsi:server")
+}
+
+// fakeNbdServer emulates the server side of the connection: reads come from 'in', writes go to 'out'
+type fakeNbdServer struct {
+	in  *bytes.Buffer
+	out bytes.Buffer
+}
+
+func (s *fakeNbdServer) Read(p []byte) (int, error)  { return s.in.Read(p) }
+func (s *fakeNbdServer) Write(p []byte) (int, error) { return s.out.Write(p) }
+
+func TestNbdHandshakeNewstyle(t *testing.T) {
+	var in bytes.Buffer
+	_ = binary.Write(&in, binary.BigEndian, uint64(nbdMagic))
+	_ = binary.Write(&in, binary.BigEndian, uint64(nbdOptMagic))
+	_ = binary.Write(&in, binary.BigEndian, uint16(nbdFlagFixedNewstyle|nbdFlagNoZeroes))
+	_ = binary.Write(&in, binary.BigEndian, uint64(1<<30))
+	_ = binary.Write(&in, binary.BigEndian, uint16(3))
+
+	conn := &fakeNbdServer{in: &in}
+	size, flags, err := nbdHandshake(conn, "root")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1<<30), size)
+	require.Equal(t, uint16(3), flags)
+
+	var expected bytes.Buffer
+	_ = binary.Write(&expected, binary.BigEndian, uint32(nbdFlagFixedNewstyle|nbdFlagNoZeroes))
+	_ = binary.Write(&expected, binary.BigEndian, uint64(nbdOptMagic))
+	_ = binary.Write(&expected, binary.BigEndian, uint32(nbdOptExportName))
+	_ = binary.Write(&expected, binary.BigEndian, uint32(4))
+	expected.WriteString("root")
+	require.Equal(t, expected.Bytes(), conn.out.Bytes())
+}
+
+func TestNbdHandshakeOldstyle(t *testing.T) {
+	var in bytes.Buffer
+	_ = binary.Write(&in, binary.BigEndian, uint64(nbdMagic))
+	_ = binary.Write(&in, binary.BigEndian, uint64(nbdOldstyleMagic))
+	_ = binary.Write(&in, binary.BigEndian, uint64(4096))
+	_ = binary.Write(&in, binary.BigEndian, uint32(1))
+	in.Write(make([]byte, 124))
+
+	size, flags, err := nbdHandshake(&fakeNbdServer{in: &in}, "")
+	require.NoError(t, err)
+	require.Equal(t, uint64(4096), size)
+	require.Equal(t, uint16(1), flags)
+}
+
+func TestParseParamsNbdRoot(t *testing.T) {
+	defer func() {
+		nbdTargets, nbdRoot = nil, nil
+		rootFsType, rootFlags = "", ""
+		cmdRoot = nil
+	}()
+	cmdRoot = nil
+
+	require.NoError(t, parseParams("root=nbd:10.0.2.2:/root:ext4:noatime"))
+	require.Equal(t, &nbdTarget{"10.0.2.2", 10809, "root"}, nbdRoot)
+	require.Equal(t, []*nbdTarget{nbdRoot}, nbdTargets)
+	require.Equal(t, "ext4", rootFsType)
+	require.Equal(t, "noatime", rootFlags)
+	// the device is resolved once connected
+	require.Nil(t, cmdRoot)
+	require.False(t, isNbdRootDevice("/dev/nbd0"))
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
@@ -58,7 +60,17 @@ func runDhcp(ifname string) error {
 		}
 	}
 
+	info("%s: got address %s from DHCP server %s", ifname, addr.IPNet, ack.ServerIPAddr)
+
 	dnsServers := dhcpv4.GetIPs(dhcpv4.OptionDomainNameServer, ack.Options)
+	recordInterfaceState(ifname, func(h *ifaceHandoff) {
+		h.dhcp = true
+		h.leaseAddress = addr.IPNet
+		h.leaseServer = ack.ServerIdentifier()
+		h.leaseLifetime = ack.IPAddressLeaseTime(0)
+		h.gateway = gateway
+		h.dnsServers = dnsServers
+	})
 	if dnsServers != nil {
 		if err := writeResolvConf(dnsServers); err != nil {
 			return err
@@ -69,6 +81,7 @@ func runDhcp(ifname string) error {
 }
 
 func shutdownNetwork() {
+	stopWpaSupplicant()
 	for _, ifname := range initializedIfnames {
 		debug("shutting down network interface %s", ifname)
 		link, err := netlink.LinkByName(ifname)
@@ -88,10 +101,277 @@ func shutdownNetwork() {
 
 		_ = netlink.LinkSetDown(link)
 	}
+
+	for _, ifname := range createdLinks {
+		debug("removing network interface %s", ifname)
+		if link, err := netlink.LinkByName(ifname); err == nil {
+			_ = netlink.LinkDel(link)
+		}
+	}
 }
 
 var initializedIfnames []string
 
+var (
+	// createdLinks is a list of virtual interfaces created by booster, they are removed at the network shutdown
+	createdLinks      []string
+	createdLinksMutex sync.Mutex
+)
+
+// createLink creates a virtual network interface (VLAN, bond, ...)
+func createLink(link netlink.Link) error {
+	if err := netlink.LinkAdd(link); err != nil {
+		return err
+	}
+	createdLinksMutex.Lock()
+	createdLinks = append(createdLinks, link.Attrs().Name)
+	createdLinksMutex.Unlock()
+	return nil
+}
+
+func isCreatedLink(ifname string) bool {
+	createdLinksMutex.Lock()
+	defer createdLinksMutex.Unlock()
+	return stringListContains(ifname, createdLinks)
+}
+
+var (
+	// networkReady is closed once a network interface is configured with an address
+	networkReady     = make(chan struct{})
+	networkReadyOnce sync.Once
+)
+
+func markNetworkReady(ifname string) {
+	networkReadyOnce.Do(func() {
+		info("network is ready at %s", ifname)
+		close(networkReady)
+	})
+}
+
+// awaitNetwork waits until a network interface is configured. It returns false if it did not happen within the timeout.
+func awaitNetwork(timeout time.Duration) bool {
+	select {
+	case <-networkReady:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// keepNetworkUp is set if the root filesystem is accessed over the network or rd.neednet=1 is specified,
+// in this case the network configuration is passed to the new root as-is.
+var keepNetworkUp bool
+
+// needNet is set with rd.neednet=1 boot param
+var needNet bool
+
+// enableNetworkForRoot makes sure the network is initialized as it is required to access the root filesystem
+// or by the booted system
+func enableNetworkForRoot() {
+	keepNetworkUp = true
+	if config.Network == nil {
+		info("network is required after boot but it is not configured, use DHCP for all interfaces")
+		config.Network = &InitNetworkConfig{Dhcp: true}
+	}
+}
+
+// linkReadinessTimeout is the maximum time to wait for an interface to get UP and detect a carrier
+const linkReadinessTimeout = 20 * time.Second
+
+// linkIsReady checks whether the link is UP and has a carrier so it is ready to send/receive packets
+func linkIsReady(flags uint32) bool {
+	return flags&unix.IFF_UP != 0 && flags&unix.IFF_RUNNING != 0
+}
+
+// ipParamState is what ip= params have configured so far. All params share the single network
+// config, so combinations that cannot be expressed with it are rejected.
+type ipParamState struct {
+	static  bool     // a static address is configured
+	dhcp    bool     // IPv4 DHCP is enabled
+	ifnames []string // interfaces named by the params, an empty name means all interfaces
+}
+
+var ipParams ipParamState
+
+// parseIPParam parses ip= boot parameter. Supported formats are
+// ip=dhcp - configure all interfaces using DHCP
+// ip=<iface>:dhcp - configure only the specified interface using DHCP
+// ip=auto6, ip=<iface>:auto6 - configure IPv6 using router advertisements (and DHCPv6 if the router asks for it)
+// ip=dhcp6, ip=<iface>:dhcp6 - configure IPv6 using DHCPv6
+// ip=<client-ip>:<server-ip>:<gw-ip>:<netmask>:<hostname>:<iface>:<autoconf>[:<dns0-ip>[:<dns1-ip>]] - the format
+// used by the kernel (see Documentation/admin-guide/nfs/nfsroot.rst)
+func parseIPParam(value string) error {
+	fields := strings.Split(value, ":")
+	switch len(fields) {
+	case 1:
+		return configureDhcpParam("", fields[0])
+	case 2:
+		return configureDhcpParam(fields[0], fields[1])
+	case 7, 8, 9:
+	default:
+		return fmt.Errorf("unsupported format, expected ip=dhcp, ip=<iface>:dhcp or ip=<client-ip>:<server-ip>:<gw-ip>:<netmask>:<hostname>:<iface>:<autoconf>")
+	}
+
+	clientIP, gateway, netmask, hostname, ifname, autoconf := fields[0], fields[2], fields[3], fields[4], fields[5], fields[6]
+	if server := fields[1]; server != "" {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("invalid server address %s", server)
+		}
+		nfsServerAddr = server
+	}
+	if clientIP == "" {
+		// no static address, the interface is configured dynamically
+		if err := configureDhcpParam(ifname, autoconf); err != nil {
+			return err
+		}
+		config.Network.Hostname = hostname
+		return nil
+	}
+
+	switch autoconf {
+	case "", "off", "none", "static":
+	default:
+		return fmt.Errorf("autoconfiguration method '%s' cannot be used with a static address", autoconf)
+	}
+
+	ip := net.ParseIP(clientIP).To4()
+	if ip == nil {
+		return fmt.Errorf("invalid client ip address %s", clientIP)
+	}
+	mask, err := parseNetmask(netmask, ip)
+	if err != nil {
+		return err
+	}
+	if gateway != "" && net.ParseIP(gateway) == nil {
+		return fmt.Errorf("invalid gateway address %s", gateway)
+	}
+	var dnsServers []string
+	for _, dns := range fields[7:] {
+		if dns == "" {
+			continue
+		}
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("invalid DNS server address %s", dns)
+		}
+		dnsServers = append(dnsServers, dns)
+	}
+
+	if config.Network == nil {
+		config.Network = &InitNetworkConfig{}
+	}
+	if ipParams.static {
+		return fmt.Errorf("only one static address configuration is supported")
+	}
+	if ipParams.dhcp {
+		return fmt.Errorf("a static address cannot be combined with DHCP configured by another ip= param")
+	}
+	for _, n := range ipParams.ifnames {
+		if n != ifname {
+			return fmt.Errorf("a static address for interface '%s' cannot be combined with ip= params for other interfaces", ifname)
+		}
+	}
+	ipParams.static = true
+	ipParams.ifnames = append(ipParams.ifnames, ifname)
+	c := config.Network
+	c.Dhcp = false
+	c.IP = (&net.IPNet{IP: ip, Mask: mask}).String()
+	c.Gateway = gateway
+	c.DNSServers = strings.Join(dnsServers, ",")
+	c.Hostname = hostname
+	if ifname != "" {
+		c.InterfaceNames = append(c.InterfaceNames, ifname)
+	}
+	return nil
+}
+
+// configureDhcpParam enables DHCP (or IPv6 autoconfiguration) for the given interface (or all interfaces if ifname is empty)
+func configureDhcpParam(ifname, autoconf string) error {
+	switch autoconf {
+	case "dhcp", "on", "any", ipv6Auto, ipv6Dhcp6:
+	default:
+		return fmt.Errorf("unsupported autoconfiguration method '%s'", autoconf)
+	}
+
+	ipv6 := autoconf == ipv6Auto || autoconf == ipv6Dhcp6
+	if ipParams.static {
+		if !ipv6 {
+			return fmt.Errorf("DHCP cannot be combined with a static address configured by another ip= param")
+		}
+		// the static address is applied to all the configured interfaces
+		if ifname != ipParams.ifnames[0] {
+			return fmt.Errorf("interface '%s' cannot be configured together with a static address for another interface", ifname)
+		}
+	}
+	ipParams.ifnames = append(ipParams.ifnames, ifname)
+
+	if config.Network == nil {
+		config.Network = &InitNetworkConfig{}
+	}
+	c := config.Network
+	if ipv6 {
+		// IPv6 is configured in addition to IPv4 settings (if any)
+		c.IPv6 = autoconf
+	} else {
+		ipParams.dhcp = true
+		c.Dhcp = true
+		c.IP, c.Gateway = "", ""
+	}
+	if ifname != "" {
+		c.InterfaceNames = append(c.InterfaceNames, ifname)
+	}
+	return nil
+}
+
+// parseNetmask parses netmask either in dotted form (255.255.255.0) or as a prefix length (24).
+// If the netmask is empty then the default mask for the ip class is used.
+func parseNetmask(netmask string, ip net.IP) (net.IPMask, error) {
+	if netmask == "" {
+		return ip.DefaultMask(), nil
+	}
+	if bits, err := strconv.Atoi(netmask); err == nil {
+		if bits < 0 || bits > 32 {
+			return nil, fmt.Errorf("invalid netmask prefix length %d", bits)
+		}
+		return net.CIDRMask(bits, 32), nil
+	}
+	m := net.ParseIP(netmask).To4()
+	if m == nil {
+		return nil, fmt.Errorf("invalid netmask %s", netmask)
+	}
+	mask := net.IPMask(m)
+	if ones, bits := mask.Size(); ones == 0 && bits == 0 {
+		return nil, fmt.Errorf("netmask %s is not canonical", netmask)
+	}
+	return mask, nil
+}
+
+// waitForNetworkInterfaces checks that all interfaces requested by name appear in the system.
+// Network interfaces are initialized asynchronously on udev events, this function only reports
+// the interfaces that did not appear during the timeout.
+func waitForNetworkInterfaces(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var missing []string
+		for _, ifname := range config.Network.InterfaceNames {
+			if _, err := netlink.LinkByName(ifname); err != nil {
+				missing = append(missing, ifname)
+			}
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			var available []string
+			links, _ := netlink.LinkList()
+			for _, l := range links {
+				available = append(available, l.Attrs().Name)
+			}
+			return fmt.Errorf("network interfaces [%s] do not exist, available interfaces are [%s]", strings.Join(missing, " "), strings.Join(available, " "))
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
 func initializeNetworkInterface(ifname string) error {
 	link, err := netlink.LinkByName(ifname)
 	if err != nil {
@@ -106,6 +386,12 @@ func initializeNetworkInterface(ifname string) error {
 			return nil
 		}
 	}
+	if len(config.Network.InterfaceNames) > 0 {
+		if !stringListContains(ifname, config.Network.InterfaceNames) {
+			info("interface %s is not in 'active' list, skipping it", ifname)
+			return nil
+		}
+	}
 
 	ch := make(chan netlink.LinkUpdate)
 	done := make(chan struct{})
@@ -114,27 +400,40 @@ func initializeNetworkInterface(ifname string) error {
 		return err
 	}
 
+	if wifi != nil && wifi.ifname == ifname {
+		if err := startWpaSupplicant(wifi); err != nil {
+			return err
+		}
+	}
+
 	if err := netlink.LinkSetUp(link); err != nil {
 		return err
 	}
 	initializedIfnames = append(initializedIfnames, ifname)
 
-	timeout := time.After(20 * time.Second)
+	timeout := time.After(linkReadinessTimeout)
 	debug("%s waiting interface to be UP", ifname)
+	// the link might have been already up before we subscribed to the updates
+	ready := linkIsReady(link.Attrs().RawFlags)
 linkReadinessLoop:
-	for {
+	for !ready {
 		select {
 		case ev := <-ch:
-			if ifname == ev.Link.Attrs().Name && (ev.IfInfomsg.Flags&unix.IFF_UP != 0) {
-				debug("%s: interface is UP", ifname)
+			if ifname == ev.Link.Attrs().Name && linkIsReady(ev.IfInfomsg.Flags) {
 				break linkReadinessLoop
 			}
 		case <-timeout:
-			return fmt.Errorf("Unable to setup network link %s: timeout", ifname)
+			return fmt.Errorf("Unable to setup network link %s: timeout waiting for carrier", ifname)
 		}
 	}
+	debug("%s: interface is UP and has carrier", ifname)
 
 	c := config.Network
+	if c.Hostname != "" {
+		if err := unix.Sethostname([]byte(c.Hostname)); err != nil {
+			return fmt.Errorf("sethostname(%s): %v", c.Hostname, err)
+		}
+	}
 	if c.Dhcp {
 		debug("%s: run DHCP", ifname)
 		if err := runDhcp(ifname); err != nil {
@@ -163,9 +462,9 @@ linkReadinessLoop:
 			}
 		}
 
+		var ips []net.IP
 		if c.DNSServers != "" {
 			servers := strings.Split(c.DNSServers, ",")
-			ips := make([]net.IP, 0)
 			for _, s := range servers {
 				ip := net.ParseIP(s)
 				if ip == nil {
@@ -177,8 +476,25 @@ linkReadinessLoop:
 				return err
 			}
 		}
+
+		recordInterfaceState(ifname, func(h *ifaceHandoff) {
+			if c.IP != "" {
+				h.addresses = []string{c.IP}
+			}
+			h.gateway = net.ParseIP(c.Gateway)
+			h.dnsServers = ips
+		})
+	}
+
+	if c.IPv6 != "" {
+		debug("%s: configure IPv6 using %s", ifname, c.IPv6)
+		if err := configureIPv6(ifname, link, c.IPv6, !c.Dhcp && c.DNSServers == ""); err != nil {
+			return err
+		}
+		recordInterfaceState(ifname, func(h *ifaceHandoff) { h.ipv6 = c.IPv6 })
 	}
 
+	markNetworkReady(ifname)
 	return nil
 }
 
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/nclient6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// IPv6 configuration methods selected with ip=...:auto6 and ip=...:dhcp6 boot params
+const (
+	ipv6Auto  = "auto6" // stateless autoconfiguration (SLAAC), DHCPv6 is used if the router asks for it
+	ipv6Dhcp6 = "dhcp6" // stateful DHCPv6, the default route still comes from router advertisements
+)
+
+const (
+	ipv6AutoconfTimeout     = 20 * time.Second
+	routerSolicitInterval   = 4 * time.Second
+	icmpv6RouterSolicit     = 133
+	icmpv6RouterAdvert      = 134
+	ndpOptSourceLinkAddr    = 1
+	ndpOptRdnss             = 25
+	raFlagManaged           = 0x80
+	raFlagOther             = 0x40
+	routerAdvertHeaderSize  = 16
+	dhcp6DuidFile           = "/run/booster/dhcp6.duid"
+	dhcp6ExchangeTimeout    = 30 * time.Second
+	dhcp6RetransmitTimeout  = 2 * time.Second
+	dhcp6RetransmitAttempts = 4
+)
+
+// machine-id is used to generate a stable DHCPv6 client identifier
+var machineIDFile = "/etc/machine-id"
+
+// routerAdvert is a part of router advertisement that is not handled by the kernel
+type routerAdvert struct {
+	managed    bool // addresses are available via DHCPv6
+	other      bool // other configuration (e.g. DNS servers) is available via DHCPv6
+	dnsServers []net.IP
+}
+
+// parseRouterAdvert parses ICMPv6 router advertisement message (RFC 4861 section 4.2)
+// together with its RDNSS options (RFC 8106)
+func parseRouterAdvert(b []byte) (*routerAdvert, error) {
+	if len(b) < routerAdvertHeaderSize || b[0] != icmpv6RouterAdvert {
+		return nil, fmt.Errorf("not a router advertisement")
+	}
+	ra := &routerAdvert{
+		managed: b[5]&raFlagManaged != 0,
+		other:   b[5]&raFlagOther != 0,
+	}
+	opts := b[routerAdvertHeaderSize:]
+	for len(opts) >= 2 {
+		size := int(opts[1]) * 8
+		if size == 0 || size > len(opts) {
+			return nil, fmt.Errorf("malformed router advertisement option")
+		}
+		if opts[0] == ndpOptRdnss && size >= 24 {
+			for a := opts[8:size]; len(a) >= net.IPv6len; a = a[net.IPv6len:] {
+				ra.dnsServers = append(ra.dnsServers, net.IP(append([]byte(nil), a[:net.IPv6len]...)))
+			}
+		}
+		opts = opts[size:]
+	}
+	return ra, nil
+}
+
+// solicitRouter sends router solicitations until a router advertisement is received
+func solicitRouter(ifi *net.Interface, timeout time.Duration) (*routerAdvert, error) {
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.IPPROTO_ICMPV6)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+
+	if err := unix.BindToDevice(fd, ifi.Name); err != nil {
+		return nil, err
+	}
+	// neighbor discovery messages are accepted only if they are sent with hop limit 255
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, 255); err != nil {
+		return nil, err
+	}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1}); err != nil {
+		return nil, err
+	}
+
+	rs := []byte{icmpv6RouterSolicit, 0, 0, 0, 0, 0, 0, 0} // the kernel calculates the checksum
+	if len(ifi.HardwareAddr) == 6 {
+		rs = append(rs, ndpOptSourceLinkAddr, 1)
+		rs = append(rs, ifi.HardwareAddr...)
+	}
+	allRouters := &unix.SockaddrInet6{Addr: [16]byte{0xff, 0x02, 15: 0x02}, ZoneId: uint32(ifi.Index)}
+
+	buf := make([]byte, 1500)
+	deadline := time.Now().Add(timeout)
+	var nextSolicit time.Time
+	for time.Now().Before(deadline) {
+		if time.Now().After(nextSolicit) {
+			if err := unix.Sendto(fd, rs, 0, allRouters); err != nil {
+				return nil, err
+			}
+			nextSolicit = time.Now().Add(routerSolicitInterval)
+		}
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 && buf[0] == icmpv6RouterAdvert {
+			return parseRouterAdvert(buf[:n])
+		}
+	}
+	return nil, fmt.Errorf("no router advertisement received")
+}
+
+// waitForIPv6Address waits until the interface gets a usable (i.e. passed duplicate address detection) address
+func waitForIPv6Address(link netlink.Link, global bool, timeout time.Duration) (*netlink.Addr, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			if a.Flags&(unix.IFA_F_TENTATIVE|unix.IFA_F_DADFAILED) != 0 {
+				continue
+			}
+			if (global && a.IP.IsGlobalUnicast()) || (!global && a.IP.IsLinkLocalUnicast()) {
+				return &a, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			kind := "link-local"
+			if global {
+				kind = "global"
+			}
+			return nil, fmt.Errorf("timeout waiting for %s IPv6 address", kind)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// dhcp6Duid returns DHCPv6 client identifier that stays the same across boots. It is DUID-UUID derived from
+// machine-id if the file is present in the image, otherwise it is DUID-LL of the interface.
+func dhcp6Duid(hwaddr net.HardwareAddr) dhcpv6.DUID {
+	if data, err := os.ReadFile(machineIDFile); err == nil {
+		if id, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(id) == 16 {
+			duid := &dhcpv6.DUIDUUID{}
+			copy(duid.UUID[:], id)
+			return duid
+		}
+	}
+	return &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: hwaddr}
+}
+
+// saveDhcp6Duid stores the DUID so the system can keep the same DHCPv6 identity after switching root
+func saveDhcp6Duid(duid dhcpv6.DUID) error {
+	if err := os.MkdirAll(filepath.Dir(dhcp6DuidFile), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(dhcp6DuidFile, []byte(hex.EncodeToString(duid.ToBytes())+"\n"), 0o644)
+}
+
+// runDhcp6 either requests an address from DHCPv6 server (stateful) or only asks it for the DNS servers (stateless)
+func runDhcp6(ifname string, link netlink.Link, stateful bool) ([]net.IP, error) {
+	duid := dhcp6Duid(link.Attrs().HardwareAddr)
+	if err := saveDhcp6Duid(duid); err != nil {
+		warning("%s: unable to save DHCPv6 DUID: %v", ifname, err)
+	}
+
+	client, err := nclient6.New(ifname, nclient6.WithTimeout(dhcp6RetransmitTimeout), nclient6.WithRetry(dhcp6RetransmitAttempts))
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dhcp6ExchangeTimeout)
+	defer cancel()
+
+	if !stateful {
+		msg, err := dhcpv6.NewMessage()
+		if err != nil {
+			return nil, err
+		}
+		msg.MessageType = dhcpv6.MessageTypeInformationRequest
+		msg.AddOption(dhcpv6.OptClientID(duid))
+		msg.AddOption(dhcpv6.OptRequestedOption(dhcpv6.OptionDNSRecursiveNameServer))
+		msg.AddOption(dhcpv6.OptElapsedTime(0))
+		reply, err := client.SendAndRead(ctx, nclient6.AllDHCPRelayAgentsAndServers, msg, nclient6.IsMessageType(dhcpv6.MessageTypeReply))
+		if err != nil {
+			return nil, fmt.Errorf("DHCPv6 information request: %v", err)
+		}
+		return reply.Options.DNS(), nil
+	}
+
+	reply, err := client.RapidSolicit(ctx, dhcpv6.WithClientID(duid))
+	if err != nil {
+		return nil, fmt.Errorf("DHCPv6 exchange: %v", err)
+	}
+	ia := reply.Options.OneIANA()
+	if ia == nil || ia.Options.OneAddress() == nil {
+		return nil, fmt.Errorf("DHCPv6 server did not provide an address")
+	}
+	a := ia.Options.OneAddress()
+	// the prefix length is not provided by DHCPv6, the on-link prefix comes from router advertisements
+	addr := &netlink.Addr{
+		IPNet:       &net.IPNet{IP: a.IPv6Addr, Mask: net.CIDRMask(128, 128)},
+		Flags:       unix.IFA_F_NODAD,
+		PreferedLft: int(a.PreferredLifetime.Seconds()),
+		ValidLft:    int(a.ValidLifetime.Seconds()),
+	}
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return nil, err
+	}
+	info("%s: got address %s from DHCPv6 server", ifname, a.IPv6Addr)
+	return reply.Options.DNS(), nil
+}
+
+func writeIPv6Sysctl(ifname, name, value string) error {
+	return os.WriteFile("/proc/sys/net/ipv6/conf/"+ifname+"/"+name, []byte(value), 0o644)
+}
+
+// configureIPv6 configures the interface address with SLAAC or DHCPv6, the default route is always
+// configured by the kernel from router advertisements. IPv6 DNS servers are used only if IPv4 configuration
+// does not provide them.
+func configureIPv6(ifname string, link netlink.Link, method string, setDNS bool) error {
+	autoconf := "0"
+	if method == ipv6Auto {
+		autoconf = "1"
+	}
+	for _, s := range []struct{ name, value string }{{"disable_ipv6", "0"}, {"accept_ra", "2"}, {"autoconf", autoconf}} {
+		if err := writeIPv6Sysctl(ifname, s.name, s.value); err != nil {
+			return fmt.Errorf("%s: IPv6 is not available: %v", ifname, err)
+		}
+	}
+
+	// DHCPv6 and router solicitations are sent from the link-local address
+	if _, err := waitForIPv6Address(link, false, ipv6AutoconfTimeout); err != nil {
+		return fmt.Errorf("%s: %v", ifname, err)
+	}
+
+	var dnsServers []net.IP
+	stateful := method == ipv6Dhcp6
+	ifi, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return err
+	}
+	ra, err := solicitRouter(ifi, ipv6AutoconfTimeout)
+	if err != nil {
+		if !stateful {
+			return fmt.Errorf("%s: %v", ifname, err)
+		}
+		// a network might provide addresses with DHCPv6 only, without a router
+		debug("%s: %v", ifname, err)
+	} else {
+		debug("%s: router advertisement managed=%v other=%v dns=%v", ifname, ra.managed, ra.other, ra.dnsServers)
+		dnsServers = ra.dnsServers
+		stateful = stateful || ra.managed
+	}
+
+	if stateful || ra.other {
+		servers, err := runDhcp6(ifname, link, stateful)
+		if err != nil {
+			return fmt.Errorf("%s: %v", ifname, err)
+		}
+		if len(dnsServers) == 0 {
+			dnsServers = servers
+		}
+	}
+
+	addr, err := waitForIPv6Address(link, true, ipv6AutoconfTimeout)
+	if err != nil {
+		return fmt.Errorf("%s: %v", ifname, err)
+	}
+	info("%s: configured IPv6 address %s", ifname, addr.IPNet)
+
+	if setDNS && len(dnsServers) > 0 {
+		return writeResolvConf(dnsServers)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRouterAdvert(t *testing.T) {
+	ra := []byte{
+		icmpv6RouterAdvert, 0, 0, 0, 64, raFlagOther, 0x07, 0x08, 0, 0, 0, 0, 0, 0, 0, 0,
+		// source link-layer address
+		1, 1, 0x52, 0x54, 0, 0x12, 0x34, 0x56,
+		// RDNSS with two servers
+		ndpOptRdnss, 5, 0, 0, 0, 0, 0x0e, 0x10,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x53,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x54,
+	}
+	a, err := parseRouterAdvert(ra)
+	require.NoError(t, err)
+	require.False(t, a.managed)
+	require.True(t, a.other)
+	require.Equal(t, []net.IP{net.ParseIP("2001:db8::53"), net.ParseIP("2001:db8::54")}, a.dnsServers)
+
+	_, err = parseRouterAdvert(ra[:20])
+	require.Error(t, err)
+	_, err = parseRouterAdvert([]byte{icmpv6RouterSolicit, 0, 0, 0, 0, 0, 0, 0})
+	require.Error(t, err)
+}
+
+func TestDhcp6Duid(t *testing.T) {
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+
+	machineIDFile = filepath.Join(t.TempDir(), "machine-id")
+	defer func() { machineIDFile = "/etc/machine-id" }()
+
+	require.Equal(t, &dhcpv6.DUIDLL{HWType: 1, LinkLayerAddr: mac}, dhcp6Duid(mac))
+
+	require.NoError(t, os.WriteFile(machineIDFile, []byte("0123456789abcdef0123456789abcdef\n"), 0o644))
+	duid := dhcp6Duid(mac)
+	require.Equal(t, dhcpv6.DUID_UUID, duid.DUIDType())
+	require.Equal(t, []byte{0, 4, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}, duid.ToBytes())
+}
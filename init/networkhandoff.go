@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The network configured by booster can be handed over to the booted system. In this case the interfaces are
+// kept up after switching root and their configuration is written to /run: systemd-networkd config files in
+// /run/systemd/network and lease files in /run/booster/network.
+
+var (
+	networkdConfigDir = "/run/systemd/network"
+	leaseDir          = "/run/booster/network"
+)
+
+// ifaceHandoff is the configuration of an interface that booster passes to the booted system
+type ifaceHandoff struct {
+	ifname     string
+	dhcp       bool
+	addresses  []string // static addresses in CIDR format
+	gateway    net.IP
+	dnsServers []net.IP
+	ipv6       string // IPv6 configuration method
+
+	// DHCPv4 lease
+	leaseAddress  *net.IPNet
+	leaseServer   net.IP
+	leaseLifetime time.Duration
+}
+
+var (
+	ifaceHandoffs      = make(map[string]*ifaceHandoff)
+	ifaceHandoffsMutex sync.Mutex
+)
+
+// recordInterfaceState updates the interface configuration that is passed to the booted system
+func recordInterfaceState(ifname string, update func(h *ifaceHandoff)) {
+	ifaceHandoffsMutex.Lock()
+	defer ifaceHandoffsMutex.Unlock()
+
+	h, ok := ifaceHandoffs[ifname]
+	if !ok {
+		h = &ifaceHandoff{ifname: ifname}
+		ifaceHandoffs[ifname] = h
+	}
+	update(h)
+}
+
+// networkHandoffRequested checks whether the network needs to be kept up after switching root
+func networkHandoffRequested() bool {
+	return keepNetworkUp || (config.Network != nil && config.Network.Handoff)
+}
+
+// networkdConfig generates systemd-networkd config that keeps the interface configuration made by booster
+func (h *ifaceHandoff) networkdConfig() string {
+	var c strings.Builder
+	c.WriteString("# generated by booster, the interface has been configured at early boot\n")
+	fmt.Fprintf(&c, "[Match]\nName=%s\n\n[Network]\n", h.ifname)
+
+	var dhcp []string
+	if h.dhcp {
+		dhcp = append(dhcp, "ipv4")
+	}
+	if h.ipv6 == ipv6Dhcp6 {
+		dhcp = append(dhcp, "ipv6")
+	}
+	switch len(dhcp) {
+	case 1:
+		fmt.Fprintf(&c, "DHCP=%s\n", dhcp[0])
+	case 2:
+		c.WriteString("DHCP=yes\n")
+	}
+	if h.ipv6 != "" {
+		c.WriteString("IPv6AcceptRA=yes\n")
+	}
+	for _, a := range h.addresses {
+		fmt.Fprintf(&c, "Address=%s\n", a)
+	}
+	if !h.dhcp && h.gateway != nil {
+		fmt.Fprintf(&c, "Gateway=%s\n", h.gateway)
+	}
+	for _, dns := range h.dnsServers {
+		fmt.Fprintf(&c, "DNS=%s\n", dns)
+	}
+	// do not drop the addresses while networkd takes over the interface, it matters if the root is on network
+	c.WriteString("KeepConfiguration=yes\n")
+
+	if h.dhcp {
+		// booster DHCP client identifies itself with the MAC address, use the same identity to renew the lease
+		c.WriteString("\n[DHCPv4]\nClientIdentifier=mac\n")
+	}
+	return c.String()
+}
+
+// leaseFile generates a lease file in KEY=VALUE format similar to the one used by systemd-networkd
+func (h *ifaceHandoff) leaseFile() string {
+	var c strings.Builder
+	fmt.Fprintf(&c, "ADDRESS=%s\n", h.leaseAddress.IP)
+	fmt.Fprintf(&c, "NETMASK=%s\n", net.IP(h.leaseAddress.Mask))
+	if h.gateway != nil {
+		fmt.Fprintf(&c, "ROUTER=%s\n", h.gateway)
+	}
+	if h.leaseServer != nil {
+		fmt.Fprintf(&c, "SERVER_ADDRESS=%s\n", h.leaseServer)
+	}
+	if len(h.dnsServers) > 0 {
+		var servers []string
+		for _, s := range h.dnsServers {
+			servers = append(servers, s.String())
+		}
+		fmt.Fprintf(&c, "DNS=%s\n", strings.Join(servers, " "))
+	}
+	if h.leaseLifetime > 0 {
+		fmt.Fprintf(&c, "LIFETIME=%d\n", int(h.leaseLifetime.Seconds()))
+	}
+	return c.String()
+}
+
+// writeNetworkHandoff writes the configuration of all the interfaces configured by booster
+func writeNetworkHandoff() error {
+	ifaceHandoffsMutex.Lock()
+	defer ifaceHandoffsMutex.Unlock()
+
+	for ifname, h := range ifaceHandoffs {
+		if err := os.MkdirAll(networkdConfigDir, 0o755); err != nil {
+			return err
+		}
+		file := filepath.Join(networkdConfigDir, "10-booster-"+ifname+".network")
+		if err := os.WriteFile(file, []byte(h.networkdConfig()), 0o644); err != nil {
+			return err
+		}
+
+		if h.leaseAddress == nil {
+			continue
+		}
+		if err := os.MkdirAll(leaseDir, 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(leaseDir, ifname+".lease"), []byte(h.leaseFile()), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkdConfig(t *testing.T) {
+	h := &ifaceHandoff{
+		ifname:        "eth0",
+		dhcp:          true,
+		ipv6:          ipv6Auto,
+		gateway:       net.ParseIP("10.0.2.2"),
+		dnsServers:    []net.IP{net.ParseIP("10.0.2.3")},
+		leaseAddress:  &net.IPNet{IP: net.ParseIP("10.0.2.15").To4(), Mask: net.CIDRMask(24, 32)},
+		leaseServer:   net.ParseIP("10.0.2.2"),
+		leaseLifetime: time.Hour,
+	}
+	require.Equal(t, `# generated by booster, the interface has been configured at early boot
+[Match]
+Name=eth0
+
+[Network]
+DHCP=ipv4
+IPv6AcceptRA=yes
+DNS=10.0.2.3
+KeepConfiguration=yes
+
+[DHCPv4]
+ClientIdentifier=mac
+`, h.networkdConfig())
+	require.Equal(t, "ADDRESS=10.0.2.15\nNETMASK=255.255.255.0\nROUTER=10.0.2.2\nSERVER_ADDRESS=10.0.2.2\nDNS=10.0.2.3\nLIFETIME=3600\n", h.leaseFile())
+
+	h = &ifaceHandoff{ifname: "br0", addresses: []string{"10.0.2.15/24"}, gateway: net.ParseIP("10.0.2.2"), ipv6: ipv6Dhcp6}
+	require.Equal(t, `# generated by booster, the interface has been configured at early boot
+[Match]
+Name=br0
+
+[Network]
+DHCP=ipv6
+IPv6AcceptRA=yes
+Address=10.0.2.15/24
+Gateway=10.0.2.2
+KeepConfiguration=yes
+`, h.networkdConfig())
+}
+
+func TestWriteNetworkHandoff(t *testing.T) {
+	dir := t.TempDir()
+	networkdConfigDir, leaseDir = filepath.Join(dir, "network"), filepath.Join(dir, "leases")
+	defer func() {
+		networkdConfigDir, leaseDir = "/run/systemd/network", "/run/booster/network"
+		ifaceHandoffs = make(map[string]*ifaceHandoff)
+	}()
+
+	recordInterfaceState("eth0", func(h *ifaceHandoff) {
+		h.dhcp = true
+		h.leaseAddress = &net.IPNet{IP: net.ParseIP("10.0.2.15").To4(), Mask: net.CIDRMask(24, 32)}
+	})
+	recordInterfaceState("eth0", func(h *ifaceHandoff) { h.ipv6 = ipv6Auto })
+	recordInterfaceState("eth1", func(h *ifaceHandoff) { h.addresses = []string{"192.168.1.5/16"} })
+	require.NoError(t, writeNetworkHandoff())
+
+	data, err := os.ReadFile(filepath.Join(networkdConfigDir, "10-booster-eth0.network"))
+	require.NoError(t, err)
+	require.Contains(t, string(data), "DHCP=ipv4\nIPv6AcceptRA=yes\n")
+	require.FileExists(t, filepath.Join(networkdConfigDir, "10-booster-eth1.network"))
+	require.FileExists(t, filepath.Join(leaseDir, "eth0.lease"))
+	require.NoFileExists(t, filepath.Join(leaseDir, "eth1.lease"))
+}
+
+func TestParseParamsNeedNet(t *testing.T) {
+	defer func() { needNet = false }()
+
+	require.NoError(t, parseParams("rd.neednet=1"))
+	require.True(t, needNet)
+	require.NoError(t, parseParams("rd.neednet=0"))
+	require.False(t, needNet)
+}
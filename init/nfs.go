@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// nfsRootConfig specifies NFS share used as the root filesystem
+type nfsRootConfig struct {
+	server  string
+	path    string
+	options []string
+}
+
+var (
+	nfsRoot       *nfsRootConfig // non-nil if root=/dev/nfs or root=nfs: is specified
+	nfsRootParam  string         // value of nfsroot= boot param
+	nfsRootDracut string         // value of root=nfs:/nfs4: (or netroot=) boot param in dracut format
+	nfsServerAddr string         // server ip address specified with ip= boot param
+)
+
+const nfsMountTimeout = 60 * time.Second // max time to wait for the NFS server
+
+// parseNfsRootParam parses nfsroot= boot param in format [<server-ip>:]<root-dir>[,<nfs-options>]
+// (see Documentation/admin-guide/nfs/nfsroot.rst). If server is not specified then the server address from ip= param is used.
+func parseNfsRootParam(param, defaultServer string) (*nfsRootConfig, error) {
+	var options []string
+	if idx := strings.IndexByte(param, ','); idx != -1 {
+		options = strings.Split(param[idx+1:], ",")
+		param = param[:idx]
+	}
+
+	server, path := defaultServer, param
+	if idx := strings.IndexByte(param, ':'); idx != -1 {
+		server, path = param[:idx], param[idx+1:]
+	}
+	if server == "" {
+		return nil, fmt.Errorf("NFS server address is not specified")
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("NFS root path '%s' should be absolute", path)
+	}
+
+	return &nfsRootConfig{server: server, path: path, options: options}, nil
+}
+
+// isNfsDracutRoot checks if root= value is an NFS share in dracut format
+func isNfsDracutRoot(value string) bool {
+	return strings.HasPrefix(value, "nfs:") || strings.HasPrefix(value, "nfs4:")
+}
+
+// parseNfsDracutRootParam parses root=nfs:[<server>:]<path>[:<options>] (or root=nfs4:) boot param the same way as dracut
+// does it (see man dracut.cmdline). IPv6 server address is specified within brackets, options are comma-separated.
+func parseNfsDracutRootParam(param, defaultServer string) (*nfsRootConfig, error) {
+	proto, value, _ := strings.Cut(param, ":")
+
+	server := defaultServer
+	if strings.HasPrefix(value, "[") {
+		end := strings.Index(value, "]:")
+		if end == -1 {
+			return nil, fmt.Errorf("invalid IPv6 server address")
+		}
+		server, value = value[1:end], value[end+2:]
+	} else if !strings.HasPrefix(value, "/") {
+		var ok bool
+		server, value, ok = strings.Cut(value, ":")
+		if !ok {
+			return nil, fmt.Errorf("NFS root path is not specified")
+		}
+	}
+	if server == "" {
+		return nil, fmt.Errorf("NFS server address is not specified")
+	}
+
+	path, opts, _ := strings.Cut(value, ":")
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("NFS root path '%s' should be absolute", path)
+	}
+	var options []string
+	if opts != "" {
+		options = strings.Split(opts, ",")
+	}
+	if proto == "nfs4" {
+		hasVersion := false
+		for _, o := range options {
+			if strings.HasPrefix(o, "vers=") || strings.HasPrefix(o, "nfsvers=") {
+				hasVersion = true
+			}
+		}
+		if !hasVersion {
+			options = append(options, "vers=4")
+		}
+	}
+
+	return &nfsRootConfig{server: server, path: path, options: options}, nil
+}
+
+// source returns the share in the form expected by the kernel NFS client
+func (c *nfsRootConfig) source() string {
+	if strings.Contains(c.server, ":") {
+		return "[" + c.server + "]:" + c.path
+	}
+	return c.server + ":" + c.path
+}
+
+// fsType returns the filesystem type and options used for mount() syscall
+func (c *nfsRootConfig) fsType() (string, []string) {
+	fstype := "nfs"
+	options := c.options
+	hasLock := false
+	for _, o := range options {
+		switch {
+		case strings.HasPrefix(o, "vers=4"), strings.HasPrefix(o, "nfsvers=4"):
+			fstype = "nfs4"
+		case o == "lock", o == "nolock":
+			hasLock = true
+		}
+	}
+	if fstype == "nfs" && !hasLock {
+		// there is no rpc.statd running in the initramfs so locking is not available with NFSv3
+		options = append(options, "nolock")
+	}
+	return fstype, options
+}
+
+// mountNfsRoot mounts the NFS share as the root filesystem.
+// The network might not be configured yet at the time of the call, so the mount is retried for some time.
+func mountNfsRoot(c *nfsRootConfig) error {
+	fstype, options := c.fsType()
+	modules := []string{"nfs"}
+	if fstype == "nfs4" {
+		modules = append(modules, "nfsv4")
+	} else {
+		modules = append(modules, "nfsv3")
+	}
+	wg := loadModules(modules...)
+	wg.Wait()
+
+	source := c.source()
+	deadline := time.Now().Add(nfsMountTimeout)
+	for {
+		err := mountNfsRootOnce(c, source, fstype, options)
+		if err == nil {
+			return nil
+		}
+
+		var dnsError *net.DNSError
+		if !errors.As(err, &dnsError) && !isTransientNetworkError(err) {
+			return fmt.Errorf("mounting NFS root %s: %v", source, err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("unable to mount NFS root %s, NFS server %s is not reachable: %v", source, c.server, err)
+		}
+		debug("mounting NFS root %s: %v, retrying", source, err)
+		time.Sleep(time.Second)
+	}
+}
+
+func mountNfsRootOnce(c *nfsRootConfig, source, fstype string, options []string) error {
+	// kernel NFS client requires the server IP address to be passed with 'addr=' option
+	ips, err := net.LookupIP(c.server)
+	if err != nil {
+		return err
+	}
+	opts := append([]string{"addr=" + ips[0].String()}, options...)
+	if rootFlags != "" {
+		// rootflags= are applied on top of the share options
+		opts = append(opts, rootFlags)
+	}
+
+	waitForResume()
+
+	rootMountingMutex.Lock()
+	defer rootMountingMutex.Unlock()
+
+	flags, extraOptions := sunderMountFlags(strings.Join(opts, ","), 0)
+	if rootRo {
+		flags |= unix.MS_RDONLY
+	}
+	if rootRw {
+		flags &^= unix.MS_RDONLY
+	}
+	info("mounting %s->%s, fs=%s, flags=0x%x, options=%s", source, newRoot, fstype, flags, extraOptions)
+	if err := mount(source, newRoot, fstype, flags, extraOptions); err != nil {
+		return err
+	}
+
+	rootMounted.Done()
+	return nil
+}
+
+// isTransientNetworkError checks whether the error is caused by network that is not configured yet
+func isTransientNetworkError(err error) bool {
+	return errors.Is(err, unix.ENETUNREACH) ||
+		errors.Is(err, unix.EHOSTUNREACH) ||
+		errors.Is(err, unix.ETIMEDOUT) ||
+		errors.Is(err, unix.ECONNREFUSED) ||
+		errors.Is(err, unix.EAGAIN)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// nvmfTarget is an NVMe over Fabrics discovery controller specified with rd.nvmf.discover= boot param.
+// Booster connects all NVMe subsystems reported by the discovery controller, their namespaces show up
+// as regular nvme block devices.
+type nvmfTarget struct {
+	traddr     string
+	hostTraddr string
+	trsvcid    int
+}
+
+var (
+	nvmfTargets []*nvmfTarget
+	nvmfHostNqn string // set with rd.nvmf.hostnqn=, otherwise read from /etc/nvme/hostnqn
+	nvmfHostID  string // set with rd.nvmf.hostid=, otherwise read from /etc/nvme/hostid
+)
+
+const (
+	nvmfDiscoveryNqn     = "nqn.2014-08.org.nvmexpress.discovery"
+	nvmfDiscoveryPort    = 8009
+	nvmfFabricsDev       = "/dev/nvme-fabrics"
+	nvmfHostNqnFile      = "/etc/nvme/hostnqn"
+	nvmfHostIDFile       = "/etc/nvme/hostid"
+	nvmfConnectTimeout   = 60 * time.Second // max time to wait for the discovery controller, including retries
+	nvmfDiscoveryLogPage = 0x70
+)
+
+// parseNvmfDiscoverParam parses dracut style rd.nvmf.discover=<transport>,<traddr>[,<host_traddr>[,<trsvcid>]] param.
+// Only TCP transport is supported.
+func parseNvmfDiscoverParam(value string) (*nvmfTarget, error) {
+	fields := strings.Split(value, ",")
+	if fields[0] != "tcp" {
+		return nil, fmt.Errorf("unsupported NVMe over Fabrics transport '%s', only tcp is supported", fields[0])
+	}
+	if len(fields) < 2 || len(fields) > 4 {
+		return nil, fmt.Errorf("expected format is tcp,<traddr>[,<host_traddr>[,<trsvcid>]]")
+	}
+
+	t := &nvmfTarget{traddr: fields[1], trsvcid: nvmfDiscoveryPort}
+	// kernel expects numeric addresses
+	if net.ParseIP(t.traddr) == nil {
+		return nil, fmt.Errorf("invalid target address %s", t.traddr)
+	}
+	if len(fields) > 2 && fields[2] != "" {
+		if net.ParseIP(fields[2]) == nil {
+			return nil, fmt.Errorf("invalid host address %s", fields[2])
+		}
+		t.hostTraddr = fields[2]
+	}
+	if len(fields) > 3 && fields[3] != "" {
+		port, err := strconv.Atoi(fields[3])
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %s", fields[3])
+		}
+		t.trsvcid = port
+	}
+	return t, nil
+}
+
+func (t *nvmfTarget) address() string {
+	return net.JoinHostPort(t.traddr, strconv.Itoa(t.trsvcid))
+}
+
+// nvmfHostOptions returns hostnqn/hostid connect options. If they are not specified then the kernel uses
+// a generated host NQN.
+func nvmfHostOptions() string {
+	var opts string
+	readID := func(param, file string) string {
+		if param != "" {
+			return param
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(data))
+	}
+	if nqn := readID(nvmfHostNqn, nvmfHostNqnFile); nqn != "" {
+		opts += ",hostnqn=" + nqn
+	}
+	if id := readID(nvmfHostID, nvmfHostIDFile); id != "" {
+		opts += ",hostid=" + id
+	}
+	return opts
+}
+
+// nvmfConnect asks the kernel to create a fabrics controller with the given options and returns the controller instance number
+func nvmfConnect(options string) (int, error) {
+	f, err := os.OpenFile(nvmfFabricsDev, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(options); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 4096)
+	n, err := f.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	// the response has format instance=%d,cntlid=%d
+	for _, kv := range strings.Split(strings.TrimSpace(string(buf[:n])), ",") {
+		if v, ok := strings.CutPrefix(kv, "instance="); ok {
+			return strconv.Atoi(v)
+		}
+	}
+	return 0, fmt.Errorf("unexpected %s response: %s", nvmfFabricsDev, buf[:n])
+}
+
+func nvmfDisconnect(instance int) error {
+	return os.WriteFile(fmt.Sprintf("/sys/class/nvme/nvme%d/delete_controller", instance), []byte("1"), 0o200)
+}
+
+// nvmeAdminCmd is struct nvme_passthru_cmd from include/uapi/linux/nvme_ioctl.h
+type nvmeAdminCmd struct {
+	opcode      uint8
+	flags       uint8
+	rsvd1       uint16
+	nsid        uint32
+	cdw2        uint32
+	cdw3        uint32
+	metadata    uint64
+	addr        uint64
+	metadataLen uint32
+	dataLen     uint32
+	cdw10       uint32
+	cdw11       uint32
+	cdw12       uint32
+	cdw13       uint32
+	cdw14       uint32
+	cdw15       uint32
+	timeoutMs   uint32
+	result      uint32
+}
+
+const nvmeAdminGetLogPage = 0x02
+
+var nvmeIoctlAdminCmd = iowr('N', 0x41, unsafe.Sizeof(nvmeAdminCmd{}))
+
+// nvmeGetLogPage reads len(buf) bytes of the log page with the given id
+func nvmeGetLogPage(f *os.File, lid uint8, buf []byte) error {
+	numd := uint32(len(buf)/4 - 1)
+	cmd := nvmeAdminCmd{
+		opcode:  nvmeAdminGetLogPage,
+		addr:    uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		dataLen: uint32(len(buf)),
+		cdw10:   uint32(lid) | (numd&0xffff)<<16,
+		cdw11:   numd >> 16,
+	}
+	return ioctl(f.Fd(), nvmeIoctlAdminCmd, uintptr(unsafe.Pointer(&cmd)))
+}
+
+// nvmfLogEntry is a discovery log page entry, see struct nvmf_disc_rsp_page_entry in include/linux/nvme.h
+type nvmfLogEntry struct {
+	trtype  uint8
+	subtype uint8
+	trsvcid string
+	subnqn  string
+	traddr  string
+}
+
+const (
+	nvmfLogHeaderSize = 1024
+	nvmfLogEntrySize  = 1024
+	nvmfMaxLogRecords = 1024
+
+	nvmfTrtypeTCP   = 3
+	nvmfSubtypeNvme = 2 // NVM subsystem, other subtypes are discovery controllers
+)
+
+// parseNvmfDiscoveryLog parses the discovery log page
+func parseNvmfDiscoveryLog(buf []byte) ([]nvmfLogEntry, error) {
+	if len(buf) < nvmfLogHeaderSize {
+		return nil, fmt.Errorf("discovery log page is too short")
+	}
+	numrec := binary.LittleEndian.Uint64(buf[8:16])
+	if uint64(len(buf)) < nvmfLogHeaderSize+numrec*nvmfLogEntrySize {
+		return nil, fmt.Errorf("discovery log page contains %d records but its size is %d", numrec, len(buf))
+	}
+
+	field := func(b []byte) string {
+		return string(bytes.TrimRight(b, "\x00 "))
+	}
+	entries := make([]nvmfLogEntry, 0, numrec)
+	for i := uint64(0); i < numrec; i++ {
+		e := buf[nvmfLogHeaderSize+i*nvmfLogEntrySize:][:nvmfLogEntrySize]
+		entries = append(entries, nvmfLogEntry{
+			trtype:  e[0],
+			subtype: e[2],
+			trsvcid: field(e[32:64]),
+			subnqn:  field(e[256:512]),
+			traddr:  field(e[512:768]),
+		})
+	}
+	return entries, nil
+}
+
+// nvmfDiscover connects the discovery controller and reads its log page
+func nvmfDiscover(t *nvmfTarget) ([]nvmfLogEntry, error) {
+	opts := fmt.Sprintf("nqn=%s,transport=tcp,traddr=%s,trsvcid=%d", nvmfDiscoveryNqn, t.traddr, t.trsvcid)
+	if t.hostTraddr != "" {
+		opts += ",host_traddr=" + t.hostTraddr
+	}
+	instance, err := nvmfConnect(opts + nvmfHostOptions())
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := nvmfDisconnect(instance); err != nil {
+			warning("nvmf: unable to disconnect discovery controller nvme%d: %v", instance, err)
+		}
+	}()
+
+	f, err := os.Open(fmt.Sprintf("/dev/nvme%d", instance))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, nvmfLogHeaderSize)
+	if err := nvmeGetLogPage(f, nvmfDiscoveryLogPage, hdr); err != nil {
+		return nil, err
+	}
+	numrec := binary.LittleEndian.Uint64(hdr[8:16])
+	if numrec > nvmfMaxLogRecords {
+		return nil, fmt.Errorf("discovery log page contains too many records: %d", numrec)
+	}
+	buf := make([]byte, nvmfLogHeaderSize+numrec*nvmfLogEntrySize)
+	if err := nvmeGetLogPage(f, nvmfDiscoveryLogPage, buf); err != nil {
+		return nil, err
+	}
+	return parseNvmfDiscoveryLog(buf)
+}
+
+// connectNvmf connects all the NVMe subsystems reported by the discovery controller.
+// Network might be not ready at the moment this function is called so transient errors are retried.
+func connectNvmf(t *nvmfTarget) error {
+	wg := loadModules("nvme_tcp")
+	wg.Wait()
+
+	info("nvmf: discovering subsystems at %s", t.address())
+	deadline := time.Now().Add(nvmfConnectTimeout)
+	var entries []nvmfLogEntry
+	for {
+		var err error
+		entries, err = nvmfDiscover(t)
+		if err == nil {
+			break
+		}
+		if !isTransientNetworkError(err) {
+			return fmt.Errorf("nvmf: discovery at %s: %v", t.address(), err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("nvmf: unable to connect to discovery controller %s: %v", t.address(), err)
+		}
+		debug("nvmf: discovery at %s: %v, retrying", t.address(), err)
+		time.Sleep(time.Second)
+	}
+
+	connected := 0
+	for _, e := range entries {
+		if e.trtype != nvmfTrtypeTCP || e.subtype != nvmfSubtypeNvme {
+			continue
+		}
+		opts := fmt.Sprintf("nqn=%s,transport=tcp,traddr=%s,trsvcid=%s", e.subnqn, e.traddr, e.trsvcid)
+		if t.hostTraddr != "" {
+			opts += ",host_traddr=" + t.hostTraddr
+		}
+		instance, err := nvmfConnect(opts + nvmfHostOptions())
+		if errors.Is(err, unix.EALREADY) {
+			debug("nvmf: subsystem %s at %s is connected already", e.subnqn, e.traddr)
+			connected++
+			continue
+		}
+		if err != nil {
+			warning("nvmf: unable to connect subsystem %s at %s:%s: %v", e.subnqn, e.traddr, e.trsvcid, err)
+			continue
+		}
+		info("nvmf: subsystem %s at %s:%s is connected as nvme%d", e.subnqn, e.traddr, e.trsvcid, instance)
+		connected++
+	}
+	if connected == 0 {
+		return fmt.Errorf("nvmf: discovery controller %s does not provide any NVMe over TCP subsystems", t.address())
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNvmfDiscoverParam(t *testing.T) {
+	check := func(param string, expected nvmfTarget) {
+		target, err := parseNvmfDiscoverParam(param)
+		require.NoError(t, err)
+		require.Equal(t, expected, *target)
+	}
+
+	check("tcp,10.0.2.2", nvmfTarget{traddr: "10.0.2.2", trsvcid: 8009})
+	check("tcp,10.0.2.2,,4420", nvmfTarget{traddr: "10.0.2.2", trsvcid: 4420})
+	check("tcp,fd00::2,fd00::15", nvmfTarget{traddr: "fd00::2", hostTraddr: "fd00::15", trsvcid: 8009})
+
+	invalid := func(param string) {
+		_, err := parseNvmfDiscoverParam(param)
+		require.Error(t, err, param)
+	}
+	invalid("rdma,10.0.2.2")
+	invalid("fc,auto")
+	invalid("tcp")
+	invalid("tcp,server.lan")
+	invalid("tcp,10.0.2.2,,port")
+	invalid("tcp,10.0.2.2,,4420,extra")
+}
+
+func TestParseNvmfDiscoveryLog(t *testing.T) {
+	require.Equal(t, uintptr(72), unsafe.Sizeof(nvmeAdminCmd{}))
+
+	buf := make([]byte, nvmfLogHeaderSize+2*nvmfLogEntrySize)
+	binary.LittleEndian.PutUint64(buf[8:16], 2)
+	entry := func(i int, trtype, subtype uint8, trsvcid, subnqn, traddr string) {
+		e := buf[nvmfLogHeaderSize+i*nvmfLogEntrySize:]
+		e[0], e[2] = trtype, subtype
+		copy(e[32:], trsvcid+"   ")
+		copy(e[256:], subnqn)
+		copy(e[512:], traddr+"   ")
+	}
+	entry(0, nvmfTrtypeTCP, 3, "8009", nvmfDiscoveryNqn, "10.0.2.2")
+	entry(1, nvmfTrtypeTCP, nvmfSubtypeNvme, "4420", "nqn.2023-01.com.example:root", "10.0.2.2")
+
+	entries, err := parseNvmfDiscoveryLog(buf)
+	require.NoError(t, err)
+	require.Equal(t, []nvmfLogEntry{
+		{nvmfTrtypeTCP, 3, "8009", nvmfDiscoveryNqn, "10.0.2.2"},
+		{nvmfTrtypeTCP, nvmfSubtypeNvme, "4420", "nqn.2023-01.com.example:root", "10.0.2.2"},
+	}, entries)
+
+	_, err = parseNvmfDiscoveryLog(buf[:nvmfLogHeaderSize+nvmfLogEntrySize])
+	require.Error(t, err)
+}
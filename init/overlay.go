@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// booster.overlay= boots a live or stateless system: the real root filesystem is mounted read-only and used as
+// the lower layer of an overlayfs root. The upper layer is either a tmpfs (all changes are lost at reboot) or
+// a persistence partition. The layers are available at the same paths as dracut uses so tools of the booted
+// system can find them.
+
+const (
+	overlayLowerDir = "/run/rootfsbase"
+	overlayUpperDir = "/run/overlayfs"
+
+	// overlayDeviceTimeout is the max time to wait for the persistence partition once the root is mounted
+	overlayDeviceTimeout = 30 * time.Second
+)
+
+type overlayRootConfig struct {
+	device      *deviceRef // persistence partition, nil if the upper layer is a tmpfs
+	deviceName  string     // the device as specified by the user, e.g. LABEL=persist
+	deviceFound chan *blkInfo
+}
+
+var overlayRoot *overlayRootConfig // booster.overlay=
+
+// parseOverlayParam parses booster.overlay= value that is either a boolean or the persistence partition reference
+func parseOverlayParam(value string) (*overlayRootConfig, error) {
+	switch value {
+	case "", "1", "yes", "true", "tmpfs":
+		return &overlayRootConfig{}, nil
+	case "0", "no", "false":
+		return nil, nil
+	}
+	ref, err := parseDeviceRef(value)
+	if err != nil {
+		return nil, err
+	}
+	return &overlayRootConfig{device: ref, deviceName: value, deviceFound: make(chan *blkInfo, 1)}, nil
+}
+
+// matchOverlayDevice notifies the overlay root if the block device is the persistence partition
+func matchOverlayDevice(blk *blkInfo) {
+	if overlayRoot == nil || overlayRoot.device == nil || !blk.matchesRef(overlayRoot.device) {
+		return
+	}
+	select {
+	case overlayRoot.deviceFound <- blk:
+	default:
+	}
+}
+
+// mountUpper mounts the filesystem that keeps the upper layer
+func (o *overlayRootConfig) mountUpper() error {
+	if o.device == nil {
+		return mount("overlay-upper", overlayUpperDir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=755")
+	}
+
+	var blk *blkInfo
+	select {
+	case blk = <-o.deviceFound:
+	case <-time.After(overlayDeviceTimeout):
+		return fmt.Errorf("timeout waiting for overlay persistence device %s", o.deviceName)
+	}
+	if !blk.isFs {
+		return fmt.Errorf("overlay persistence device %s does not contain a filesystem", blk.path)
+	}
+	fstype := blk.format
+	wg := loadModules(fstype)
+	wg.Wait()
+	info("mounting overlay persistence device %s, fs=%s", blk.path, fstype)
+	return mount(blk.path, overlayUpperDir, fstype, unix.MS_NOSUID|unix.MS_NODEV, "")
+}
+
+// setupOverlayRoot replaces the mounted root with an overlayfs that has the root as its read-only lower layer
+func setupOverlayRoot() error {
+	wg := loadModules("overlay")
+	wg.Wait()
+	if supported, err := isFilesystemSupported("overlay"); err != nil {
+		warning("unable to check supported filesystems: %v", err)
+	} else if !supported {
+		return fmt.Errorf("overlay filesystem is not supported by the kernel, make sure enable_overlay config option is set")
+	}
+
+	if err := os.MkdirAll(overlayLowerDir, 0o755); err != nil {
+		return err
+	}
+	if err := unix.Mount(newRoot, overlayLowerDir, "", unix.MS_MOVE, ""); err != nil {
+		return fmt.Errorf("move root to %s: %v", overlayLowerDir, err)
+	}
+	// the root might be mounted read-write e.g. with 'rw' boot param, the lower layer must not be modified
+	if err := unix.Mount("", overlayLowerDir, "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("remount %s read-only: %v", overlayLowerDir, err)
+	}
+
+	if err := overlayRoot.mountUpper(); err != nil {
+		return err
+	}
+	upper := filepath.Join(overlayUpperDir, "upper")
+	work := filepath.Join(overlayUpperDir, "work")
+	for _, dir := range []string{upper, work} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", overlayLowerDir, upper, work)
+	info("mounting overlay root, %s", options)
+	return mount("overlay", newRoot, "overlay", 0, options)
+}
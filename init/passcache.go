@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/anatol/luks.go"
+	"golang.org/x/sys/unix"
+)
+
+// Several LUKS volumes often share the same passphrase. The last passphrase entered at the console is kept in locked
+// (non-swappable) memory and tried against the next volumes before asking the user again. The cache is wiped before
+// switching to the root filesystem. disable_passphrase_cache config option turns it off.
+
+var (
+	// passphrasePromptMutex serializes the console passphrase flow of the volumes so a volume waiting for the prompt
+	// sees the passphrase that unlocked the previous volume
+	passphrasePromptMutex sync.Mutex
+
+	passphraseCacheMutex sync.Mutex
+	passphraseCacheMem   []byte // mmap'ed and mlock'ed memory of the cached passphrase
+	passphraseCache      []byte // the passphrase, a slice of passphraseCacheMem
+)
+
+// cachePassphrase stores a copy of the passphrase that unlocked a volume
+func cachePassphrase(password []byte) {
+	if config.DisablePassphraseCache || len(password) == 0 {
+		return
+	}
+	passphraseCacheMutex.Lock()
+	defer passphraseCacheMutex.Unlock()
+
+	clearPassphraseCacheLocked()
+	mem, err := unix.Mmap(-1, 0, len(password), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		warning("passphrase cache: %v", err)
+		return
+	}
+	if err := unix.Mlock(mem); err != nil {
+		// do not keep the passphrase in memory that might be swapped out
+		warning("passphrase cache: mlock: %v", err)
+		_ = unix.Munmap(mem)
+		return
+	}
+	passphraseCacheMem = mem
+	passphraseCache = mem[:copy(mem, password)]
+}
+
+// tryCachedPassphrase tries the cached passphrase against the keyslots, it returns the unlocked volume and the keyslot
+func tryCachedPassphrase(d luks.Device, checkSlots []int) (*luks.Volume, int) {
+	passphraseCacheMutex.Lock()
+	defer passphraseCacheMutex.Unlock()
+	if passphraseCache == nil {
+		return nil, 0
+	}
+
+	for _, s := range checkSlots {
+		v, err := unsealVolume(d, s, passphraseCache)
+		if err == luks.ErrPassphraseDoesNotMatch {
+			continue
+		} else if err != nil {
+			warning("unlocking slot %v: %v", s, err)
+			continue
+		}
+		return v, s
+	}
+	return nil, 0
+}
+
+// clearPassphraseCache wipes the cached passphrase
+func clearPassphraseCache() {
+	passphraseCacheMutex.Lock()
+	defer passphraseCacheMutex.Unlock()
+	clearPassphraseCacheLocked()
+}
+
+func clearPassphraseCacheLocked() {
+	if passphraseCacheMem == nil {
+		return
+	}
+	memZeroBytes(passphraseCacheMem)
+	_ = unix.Munlock(passphraseCacheMem)
+	_ = unix.Munmap(passphraseCacheMem)
+	passphraseCacheMem, passphraseCache = nil, nil
+}
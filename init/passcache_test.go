@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPassphraseCache(t *testing.T) {
+	defer clearPassphraseCache()
+
+	cachePassphrase([]byte("first"))
+	cachePassphrase([]byte("second"))
+	require.Equal(t, "second", string(passphraseCache))
+
+	clearPassphraseCache()
+	require.Nil(t, passphraseCache)
+	require.Nil(t, passphraseCacheMem)
+
+	config.DisablePassphraseCache = true
+	defer func() { config.DisablePassphraseCache = false }()
+	cachePassphrase([]byte("third"))
+	require.Nil(t, passphraseCache)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/anatol/luks.go"
+	"github.com/google/go-tpm/legacy/tpm2"
+)
+
+// When a TPM2 token fails with PCR policy mismatch the user wants to know what has changed. The policy digest itself
+// does not tell it, but booster-tpm2 tokens store the PCR values they are sealed against so booster can compare
+// them with the current values and point to the changed PCRs.
+
+// pcrDescriptions tells what is usually measured to the PCR, see TCG PC Client Platform Firmware Profile and
+// https://uapi-group.org/specifications/specs/linux_tpm_pcr_registry/
+var pcrDescriptions = map[int]string{
+	0:  "firmware code, likely a firmware update",
+	1:  "firmware configuration, likely a firmware settings or hardware change",
+	2:  "option ROMs, likely an expansion card change or its firmware update",
+	3:  "option ROMs configuration",
+	4:  "boot loader, likely a boot loader or kernel update",
+	5:  "boot loader configuration or GPT partition table change",
+	6:  "platform specific events e.g. resume from hibernation",
+	7:  "Secure Boot state, likely a Secure Boot keys (db/dbx) update or Secure Boot was toggled",
+	8:  "kernel command line measured by the boot loader",
+	9:  "files loaded by the boot loader e.g. initramfs",
+	10: "IMA measurements",
+	11: "unified kernel image, likely a kernel or initramfs update",
+	12: "kernel command line or credentials measured by systemd-stub",
+	13: "system extensions",
+	14: "shim MOK certificates",
+	15: "volume keys or machine-id measured by systemd",
+}
+
+// tpmReadPCRValues reads the current values of the given PCRs
+func tpmReadPCRValues(pcrs []int, bank tpm2.Algorithm) (map[int][]byte, error) {
+	values := make(map[int][]byte)
+	err := withTPM(func(t *tpmConn) error {
+		for _, pcr := range pcrs {
+			v, err := tpm2.ReadPCR(t.dev, pcr, bank)
+			if err != nil {
+				return fmt.Errorf("reading PCR %d: %w", pcr, err)
+			}
+			values[pcr] = v
+		}
+		return nil
+	})
+	return values, err
+}
+
+// encodePCRValues encodes PCR values to the format stored in booster-tpm2 token: {"7": "hex value"}
+func encodePCRValues(values map[int][]byte) map[string]string {
+	encoded := make(map[string]string)
+	for pcr, v := range values {
+		encoded[strconv.Itoa(pcr)] = hex.EncodeToString(v)
+	}
+	return encoded
+}
+
+func decodePCRValues(encoded map[string]string) (map[int][]byte, error) {
+	values := make(map[int][]byte)
+	for k, v := range encoded {
+		pcr, err := strconv.Atoi(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PCR index %s", k)
+		}
+		values[pcr], err = hex.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PCR %d value: %v", pcr, err)
+		}
+	}
+	return values, nil
+}
+
+// changedPCRs returns sorted list of PCRs whose current value differs from the expected one
+func changedPCRs(expected, current map[int][]byte) []int {
+	var changed []int
+	for pcr, v := range expected {
+		if !bytes.Equal(v, current[pcr]) {
+			changed = append(changed, pcr)
+		}
+	}
+	sort.Ints(changed)
+	return changed
+}
+
+// reportPCRDrift explains which PCRs have changed since the token was sealed.
+// It returns the changed PCRs or nil if they cannot be determined.
+func reportPCRDrift(d luks.Device, t luks.Token) []int {
+	tok, err := parseTPM2Token(t.Payload)
+	if err != nil {
+		return nil
+	}
+	if len(tok.pcrValues) == 0 {
+		info("%s token #%d does not store sealed PCR values, unable to tell which of PCRs %v changed. Re-enroll the token if the change is expected", t.Type, t.ID, tok.pcrs)
+		if !tok.pin && tok.signed == nil {
+			// the token policy is a plain PolicyPCR, the digest of the current values tells what the policy would be now
+			if current, err := tpmCurrentPCRPolicyDigest(tok.pcrs, tok.bank); err == nil {
+				info("%s token #%d: policy digest of the current PCR values is %x, the token is sealed against %x", t.Type, t.ID, current, tok.policyHash)
+			}
+		}
+		return nil
+	}
+
+	current, err := tpmReadPCRValues(tok.pcrs, tok.bank)
+	if err != nil {
+		warning("%v", err)
+		return nil
+	}
+	changed := changedPCRs(tok.pcrValues, current)
+	if len(changed) == 0 {
+		warning("%s token #%d: PCR values match the sealed ones but the policy does not, the token is likely corrupted", t.Type, t.ID)
+		return nil
+	}
+	for _, pcr := range changed {
+		desc, ok := pcrDescriptions[pcr]
+		if !ok {
+			desc = "application specific measurements"
+		}
+		warning("%s: PCR %d changed since %s token #%d was sealed - %s", d.Path(), pcr, t.Type, t.ID, desc)
+	}
+	return changed
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/anatol/luks.go"
+)
+
+// systemd-pkcs11 token stores a key encrypted with the public key of a smartcard (e.g. a YubiKey PIV slot).
+// For RSA keys pkcs11-key is the key encrypted with RSA-PKCS, for EC keys it is an ephemeral public key and the key is
+// the ECDH shared secret. Booster uses pkcs11-tool (OpenSC) to run the private key operation at the card, the same way
+// as FIDO2 tokens use fido2-assert. The LUKS passphrase is the base64 encoded key.
+
+// pkcs11Module is the PKCS#11 module used for systemd-pkcs11 tokens, booster.pkcs11_module=
+var pkcs11Module = "/usr/lib/p11-kit-proxy.so"
+
+// pkcs11PinAttempts is how many times the PIN is asked before giving up on the token
+const pkcs11PinAttempts = 3
+
+type systemdPkcs11Token struct {
+	URI string `json:"pkcs11-uri"`
+	Key string `json:"pkcs11-key"` // base64
+}
+
+// parsePkcs11URI parses RFC 7512 PKCS#11 URI into its path attributes, the values are percent-decoded
+func parsePkcs11URI(uri string) (map[string]string, error) {
+	path, ok := strings.CutPrefix(uri, "pkcs11:")
+	if !ok {
+		return nil, fmt.Errorf("PKCS#11 URI '%s' does not start with 'pkcs11:'", uri)
+	}
+	path, _, _ = strings.Cut(path, "?") // query attributes like pin-value are not used
+	attrs := make(map[string]string)
+	for _, a := range strings.Split(path, ";") {
+		if a == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(a, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid PKCS#11 URI attribute '%s'", a)
+		}
+		v, err := url.PathUnescape(value)
+		if err != nil {
+			return nil, fmt.Errorf("PKCS#11 URI attribute %s: %v", name, err)
+		}
+		attrs[name] = v
+	}
+	return attrs, nil
+}
+
+// pkcs11ToolArgs converts the PKCS#11 URI into pkcs11-tool options that select the token and the private key
+func pkcs11ToolArgs(uri string) ([]string, error) {
+	attrs, err := parsePkcs11URI(uri)
+	if err != nil {
+		return nil, err
+	}
+	module := pkcs11Module
+	if m := attrs["module-path"]; m != "" {
+		module = m
+	} else if m := attrs["module-name"]; m != "" {
+		module = filepath.Join(filepath.Dir(pkcs11Module), m+".so")
+	}
+
+	args := []string{"--module", module, "--login", "--pin", "env:PKCS11_PIN", "--type", "privkey"}
+	if v := attrs["token"]; v != "" {
+		args = append(args, "--token-label", v)
+	}
+	if v := attrs["id"]; v != "" {
+		args = append(args, "--id", hex.EncodeToString([]byte(v)))
+	}
+	if v := attrs["object"]; v != "" {
+		args = append(args, "--label", v)
+	}
+	return args, nil
+}
+
+// pkcs11ECPeerKey converts the uncompressed EC point stored by systemd into SubjectPublicKeyInfo DER that pkcs11-tool
+// expects as ECDH peer key. It returns nil if the data is not an EC point, i.e. the key is RSA encrypted.
+func pkcs11ECPeerKey(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != 0x04 {
+		return nil, nil
+	}
+	var curve ecdh.Curve
+	switch len(data) {
+	case 65:
+		curve = ecdh.P256()
+	case 97:
+		curve = ecdh.P384()
+	case 133:
+		curve = ecdh.P521()
+	default:
+		return nil, nil
+	}
+	pub, err := curve.NewPublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return x509.MarshalPKIXPublicKey(pub)
+}
+
+func recoverSystemdPkcs11Password(t luks.Token) ([]byte, error) {
+	var tok systemdPkcs11Token
+	if err := json.Unmarshal(t.Payload, &tok); err != nil {
+		return nil, err
+	}
+	encryptedKey, err := base64.StdEncoding.DecodeString(tok.Key)
+	if err != nil || len(encryptedKey) == 0 {
+		return nil, fmt.Errorf("invalid pkcs11-key")
+	}
+	args, err := pkcs11ToolArgs(tok.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	input := encryptedKey
+	peerKey, err := pkcs11ECPeerKey(encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11-key: %v", err)
+	}
+	if peerKey != nil {
+		args = append(args, "--derive", "--mechanism", "ECDH1-DERIVE")
+		input = peerKey
+	} else {
+		args = append(args, "--decrypt", "--mechanism", "RSA-PKCS")
+	}
+
+	dir, err := os.MkdirTemp("/run", "booster-pkcs11")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	inputFile, outputFile := filepath.Join(dir, "input"), filepath.Join(dir, "output")
+	if err := os.WriteFile(inputFile, input, 0o600); err != nil {
+		return nil, err
+	}
+	args = append(args, "--input-file", inputFile, "--output-file", outputFile)
+
+	for attempt := 1; ; attempt++ {
+		pin, err := readPassword("Enter PIN for the security token "+tok.URI+":", "")
+		if err != nil {
+			return nil, err
+		}
+		cmd := exec.Command("pkcs11-tool", args...)
+		cmd.Env = append(os.Environ(), "PKCS11_PIN="+string(pin))
+		memZeroBytes(pin)
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			break
+		}
+		out = bytes.TrimSpace(out)
+		if bytes.Contains(out, []byte("CKR_PIN_INCORRECT")) && attempt < pkcs11PinAttempts {
+			console("Invalid PIN, please try again\n")
+			continue
+		}
+		if bytes.Contains(out, []byte("CKR_PIN_LOCKED")) {
+			return nil, fmt.Errorf("PIN of the security token is locked")
+		}
+		return nil, fmt.Errorf("pkcs11-tool: %v: %s", err, out)
+	}
+
+	key, err := os.ReadFile(outputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer memZeroBytes(key)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("pkcs11-tool returned an empty key")
+	}
+	password := make([]byte, base64.StdEncoding.EncodedLen(len(key)))
+	base64.StdEncoding.Encode(password, key)
+	return password, nil
+}
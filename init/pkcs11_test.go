@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePkcs11URI(t *testing.T) {
+	attrs, err := parsePkcs11URI("pkcs11:model=PKCS%2315%20emulated;manufacturer=piv_II;serial=1234;token=YubiKey%20PIV;id=%03;type=private?pin-value=1234")
+	require.NoError(t, err)
+	require.Equal(t, "PKCS#15 emulated", attrs["model"])
+	require.Equal(t, "YubiKey PIV", attrs["token"])
+	require.Equal(t, "\x03", attrs["id"])
+	require.Equal(t, "private", attrs["type"])
+	require.Empty(t, attrs["pin-value"])
+
+	_, err = parsePkcs11URI("token=foo")
+	require.Error(t, err)
+	_, err = parsePkcs11URI("pkcs11:token")
+	require.Error(t, err)
+}
+
+func TestPkcs11ToolArgs(t *testing.T) {
+	args, err := pkcs11ToolArgs("pkcs11:token=YubiKey%20PIV;id=%01%02;object=KEY%20MAN")
+	require.NoError(t, err)
+	require.Equal(t, []string{"--module", "/usr/lib/p11-kit-proxy.so", "--login", "--pin", "env:PKCS11_PIN", "--type", "privkey",
+		"--token-label", "YubiKey PIV", "--id", "0102", "--label", "KEY MAN"}, args)
+
+	args, err = pkcs11ToolArgs("pkcs11:id=%01;module-name=opensc-pkcs11")
+	require.NoError(t, err)
+	require.Equal(t, "/usr/lib/opensc-pkcs11.so", args[1])
+}
+
+func TestPkcs11ECPeerKey(t *testing.T) {
+	priv, err := ecdh.P384().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := pkcs11ECPeerKey(priv.PublicKey().Bytes())
+	require.NoError(t, err)
+	pub, err := x509.ParsePKIXPublicKey(der)
+	require.NoError(t, err)
+	require.NotNil(t, pub)
+
+	// RSA encrypted key is not an EC point
+	der, err = pkcs11ECPeerKey(make([]byte, 256))
+	require.NoError(t, err)
+	require.Nil(t, der)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// If plymouth is added to the image and 'splash' boot parameter is set then booster shows the plymouth splash screen.
+// The password prompts are shown by the splash and the splash is handed over to the booted system at switch root.
+
+const (
+	plymouthDaemon  = "/usr/bin/plymouthd"
+	plymouthClient  = "/usr/bin/plymouth"
+	plymouthPidFile = "/run/plymouth/pid"
+)
+
+var (
+	splashRequested  bool // 'splash' boot parameter
+	plymouthDisabled bool // plymouth.enable=0 or rd.plymouth=0 boot parameters
+
+	// plymouthDeviceTimeout is the time to wait for a KMS device to appear before starting the splash
+	plymouthDeviceTimeout = 3 * time.Second
+
+	plymouthActive    atomic.Bool
+	plymouthStarted   = make(chan struct{}) // closed once the start attempt is finished
+	plymouthStartOnce sync.Once
+)
+
+func plymouthRequested() bool {
+	if !splashRequested || plymouthDisabled {
+		return false
+	}
+	_, err := os.Stat(plymouthDaemon)
+	return err == nil
+}
+
+func runPlymouth(args ...string) error {
+	out, err := exec.Command(plymouthClient, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("plymouth %s: %v: %s", args[0], err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// startPlymouth starts plymouth daemon and shows the splash
+func startPlymouth() error {
+	defer plymouthStartOnce.Do(func() { close(plymouthStarted) })
+
+	// udev daemon is not running in booster so plymouth needs to open the devices directly
+	deadline := time.Now().Add(plymouthDeviceTimeout)
+	for {
+		if _, err := os.Stat("/dev/dri/card0"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			info("plymouth: KMS device is not found, the splash falls back to the framebuffer or text mode")
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	cmdline, err := os.ReadFile("/proc/cmdline")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll("/run/plymouth", 0o755); err != nil {
+		return err
+	}
+	// plymouthd forks once it is ready to accept the requests
+	cmd := exec.Command(plymouthDaemon, "--mode=boot", "--attach-to-session", "--pid-file="+plymouthPidFile,
+		"--kernel-command-line="+strings.TrimSpace(string(cmdline))+" plymouth.ignore-udev")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("plymouthd: %v: %s", err, bytes.TrimSpace(out))
+	}
+	if err := runPlymouth("show-splash"); err != nil {
+		return err
+	}
+	plymouthActive.Store(true)
+	info("plymouth splash is started")
+	return nil
+}
+
+// plymouthRunning waits till the splash start attempt is finished and reports whether the splash is shown
+func plymouthRunning() bool {
+	if !plymouthRequested() {
+		return false
+	}
+	<-plymouthStarted
+	return plymouthActive.Load()
+}
+
+// plymouthMessage shows the message at the splash screen
+func plymouthMessage(msg string) {
+	if !plymouthActive.Load() {
+		return
+	}
+	if err := runPlymouth("display-message", "--text="+msg); err != nil {
+		debug("%v", err)
+	}
+}
+
+// plymouthAskPassword shows the password dialog of the splash. Same as the console prompt it can be answered
+// remotely, cancelled with cancelConsoleInput() or time out at the deadline (if it is not zero).
+func plymouthAskPassword(prompt string, remote <-chan []byte, deadline time.Time) ([]byte, error) {
+	var out bytes.Buffer
+	cmd := exec.Command(plymouthClient, "ask-for-password", "--prompt="+strings.TrimSpace(prompt))
+	cmd.Stdout = &out
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			defer memZeroBytes(out.Bytes())
+			if err != nil {
+				return nil, fmt.Errorf("plymouth ask-for-password: %v", err)
+			}
+			noteUserInput()
+			return append([]byte(nil), bytes.TrimSuffix(out.Bytes(), []byte("\n"))...), nil
+		case input := <-remote:
+			_ = cmd.Process.Kill()
+			<-done
+			memZeroBytes(out.Bytes())
+			return input, nil
+		case <-ticker.C:
+			if consoleInputCancelled.Load() {
+				_ = cmd.Process.Kill()
+				<-done
+				return nil, errConsoleInputCancelled
+			}
+			if !deadline.IsZero() && time.Now().After(deadline) {
+				_ = cmd.Process.Kill()
+				<-done
+				return nil, errPasswordTimeout
+			}
+		}
+	}
+}
+
+// stopPlymouth hides the splash, e.g. before the emergency shell is started
+func stopPlymouth() {
+	if !plymouthActive.Swap(false) {
+		return
+	}
+	if err := runPlymouth("quit"); err != nil {
+		warning("%v", err)
+	}
+}
+
+// handOffPlymouth passes the splash to the booted system. If the root filesystem has plymouth then its services
+// stop the splash once the boot is finished, otherwise plymouth quits keeping the splash image on the screen till
+// the display manager starts.
+func handOffPlymouth() {
+	if !plymouthActive.Swap(false) {
+		return
+	}
+	if _, err := os.Stat(newRoot + plymouthClient); err == nil {
+		if err := runPlymouth("update-root-fs", "--new-root-dir="+newRoot); err != nil {
+			warning("%v", err)
+		}
+		return
+	}
+	if err := runPlymouth("quit", "--retain-splash"); err != nil {
+		warning("%v", err)
+	}
+}
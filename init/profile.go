@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Booster records the time spent in each boot phase (module loading, devices scanning, unlocking, mounting, ...)
+// and writes a report similar to 'systemd-analyze blame' to /run/booster/boot-times right before running the new init.
+// booster.debug_timing boot parameter prints the report to the console as well.
+
+var (
+	bootTimesFile = "/run/booster/boot-times"
+	debugTiming   bool // print the boot times report to the console
+)
+
+type bootPhase struct {
+	name       string
+	start, end uint64 // CLOCK_MONOTONIC in usec, end is 0 while the phase is running
+}
+
+var (
+	bootPhases      []*bootPhase
+	bootPhasesMutex sync.Mutex
+)
+
+func monotonicNow() uint64 {
+	now, _ := readClock(unix.CLOCK_MONOTONIC)
+	return now
+}
+
+// startPhase records the start of a boot phase, the returned function marks the phase finished
+func startPhase(format string, v ...interface{}) func() {
+	p := &bootPhase{name: fmt.Sprintf(format, v...), start: monotonicNow()}
+
+	bootPhasesMutex.Lock()
+	bootPhases = append(bootPhases, p)
+	bootPhasesMutex.Unlock()
+
+	return func() {
+		bootPhasesMutex.Lock()
+		defer bootPhasesMutex.Unlock()
+		if p.end == 0 {
+			p.end = monotonicNow()
+		}
+	}
+}
+
+// formatDuration formats the duration the same way as systemd-analyze does, e.g. 812ms or 1.234s
+func formatDuration(usec uint64) string {
+	switch {
+	case usec < 1000:
+		return fmt.Sprintf("%dus", usec)
+	case usec < 1000000:
+		return fmt.Sprintf("%dms", usec/1000)
+	default:
+		return fmt.Sprintf("%.3fs", float64(usec)/1000000)
+	}
+}
+
+// formatBootTimes returns the report of the boot phases sorted by duration. The phases that are still
+// running are reported up to now. start is the time the initramfs started at.
+func formatBootTimes(phases []bootPhase, start, now uint64) string {
+	sort.SliceStable(phases, func(i, j int) bool {
+		di, dj := phases[i].end-phases[i].start, phases[j].end-phases[j].start
+		if phases[i].end == 0 {
+			di = now - phases[i].start
+		}
+		if phases[j].end == 0 {
+			dj = now - phases[j].start
+		}
+		return di > dj
+	})
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Startup finished in %s (kernel) + %s (initrd) = %s\n", formatDuration(start), formatDuration(now-start), formatDuration(now))
+	for _, p := range phases {
+		end, suffix := p.end, ""
+		if end == 0 {
+			end, suffix = now, " (running)"
+		}
+		var offset uint64
+		if p.start > start {
+			offset = p.start - start
+		}
+		fmt.Fprintf(&b, "%10s %s @%s%s\n", formatDuration(end-p.start), p.name, formatDuration(offset), suffix)
+	}
+	return b.String()
+}
+
+// writeBootTimes writes the boot phases report, it is called right before the new init is executed
+func writeBootTimes() {
+	bootPhasesMutex.Lock()
+	phases := make([]bootPhase, len(bootPhases))
+	for i, p := range bootPhases {
+		phases[i] = *p
+	}
+	bootPhasesMutex.Unlock()
+
+	report := formatBootTimes(phases, startMonotonic, monotonicNow())
+	if debugTiming {
+		console("%s", report)
+	}
+	if err := os.MkdirAll(filepath.Dir(bootTimesFile), 0o755); err != nil {
+		warning("boot times: %v", err)
+		return
+	}
+	if err := os.WriteFile(bootTimesFile, []byte(report), 0o644); err != nil {
+		warning("boot times: %v", err)
+	}
+}
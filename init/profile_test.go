@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatDuration(t *testing.T) {
+	require.Equal(t, "345us", formatDuration(345))
+	require.Equal(t, "812ms", formatDuration(812345))
+	require.Equal(t, "1.234s", formatDuration(1234000))
+}
+
+func TestFormatBootTimes(t *testing.T) {
+	phases := []bootPhase{
+		{name: "load module ext4", start: 1100000, end: 1105000},
+		{name: "unlock cryptroot", start: 1200000, end: 2400000},
+		{name: "scan block devices", start: 1050000}, // still running
+	}
+	report := formatBootTimes(phases, 1000000, 2500000)
+	require.Equal(t, `Startup finished in 1.000s (kernel) + 1.500s (initrd) = 2.500s
+    1.450s scan block devices @50ms (running)
+    1.200s unlock cryptroot @200ms
+       5ms load module ext4 @100ms
+`, report)
+}
+
+func TestStartPhase(t *testing.T) {
+	bootPhases = nil
+	defer func() { bootPhases = nil }()
+
+	done := startPhase("unlock %s", "cryptroot")
+	require.Len(t, bootPhases, 1)
+	require.Equal(t, "unlock cryptroot", bootPhases[0].name)
+	require.Zero(t, bootPhases[0].end)
+	done()
+	require.GreaterOrEqual(t, bootPhases[0].end, bootPhases[0].start)
+	require.NotZero(t, bootPhases[0].end)
+}
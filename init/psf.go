@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf8"
+)
+
+// PC Screen Font used by the graphical password prompt, see https://www.win.tue.nl/~aeb/linux/kbd/font-formats-1.html
+
+var (
+	psf1Magic = []byte{0x36, 0x04}
+	psf2Magic = []byte{0x72, 0xb5, 0x4a, 0x86}
+)
+
+const (
+	psf1Mode512    = 0x01
+	psf1ModeHasTab = 0x02
+	psf1Separator  = 0xffff
+	psf1StartSeq   = 0xfffe
+
+	psf2HasUnicodeTable = 0x01
+	psf2Separator       = 0xff
+	psf2StartSeq        = 0xfe
+)
+
+type psfFont struct {
+	width, height int
+	bytesPerRow   int
+	glyphs        [][]byte
+	unicode       map[rune]int // rune to glyph index, nil if the font has no unicode table
+}
+
+func parsePsf(data []byte) (*psfFont, error) {
+	switch {
+	case bytes.HasPrefix(data, psf1Magic):
+		return parsePsf1(data)
+	case bytes.HasPrefix(data, psf2Magic):
+		return parsePsf2(data)
+	default:
+		return nil, fmt.Errorf("not a PSF font")
+	}
+}
+
+func parsePsf1(data []byte) (*psfFont, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("psf1: header is too short")
+	}
+	mode, charSize := data[2], int(data[3])
+	num := 256
+	if mode&psf1Mode512 != 0 {
+		num = 512
+	}
+	font := &psfFont{width: 8, height: charSize, bytesPerRow: 1}
+	tab, err := font.readGlyphs(data[4:], num, charSize)
+	if err != nil {
+		return nil, fmt.Errorf("psf1: %v", err)
+	}
+	if mode&psf1ModeHasTab != 0 {
+		font.unicode = make(map[rune]int)
+		glyph := 0
+		for i := 0; i+1 < len(tab) && glyph < num; i += 2 {
+			switch v := binary.LittleEndian.Uint16(tab[i:]); v {
+			case psf1Separator:
+				glyph++
+			case psf1StartSeq:
+				// sequences of combining characters are not supported, skip the rest of the entry
+				for i+3 < len(tab) && binary.LittleEndian.Uint16(tab[i+2:]) != psf1Separator {
+					i += 2
+				}
+			default:
+				if _, ok := font.unicode[rune(v)]; !ok {
+					font.unicode[rune(v)] = glyph
+				}
+			}
+		}
+	}
+	return font, nil
+}
+
+func parsePsf2(data []byte) (*psfFont, error) {
+	if len(data) < 32 {
+		return nil, fmt.Errorf("psf2: header is too short")
+	}
+	headerSize := int(binary.LittleEndian.Uint32(data[8:]))
+	flags := binary.LittleEndian.Uint32(data[12:])
+	num := int(binary.LittleEndian.Uint32(data[16:]))
+	charSize := int(binary.LittleEndian.Uint32(data[20:]))
+	height := int(binary.LittleEndian.Uint32(data[24:]))
+	width := int(binary.LittleEndian.Uint32(data[28:]))
+	if headerSize < 32 || headerSize > len(data) || width == 0 || height == 0 {
+		return nil, fmt.Errorf("psf2: invalid header")
+	}
+	font := &psfFont{width: width, height: height, bytesPerRow: (width + 7) / 8}
+	if charSize < font.bytesPerRow*height {
+		return nil, fmt.Errorf("psf2: glyph size %d is too small for %dx%d font", charSize, width, height)
+	}
+	tab, err := font.readGlyphs(data[headerSize:], num, charSize)
+	if err != nil {
+		return nil, fmt.Errorf("psf2: %v", err)
+	}
+	if flags&psf2HasUnicodeTable != 0 {
+		font.unicode = make(map[rune]int)
+		glyph := 0
+		for len(tab) > 0 && glyph < num {
+			switch tab[0] {
+			case psf2Separator:
+				glyph++
+				tab = tab[1:]
+			case psf2StartSeq:
+				if end := bytes.IndexByte(tab, psf2Separator); end >= 0 {
+					tab = tab[end:]
+				} else {
+					tab = nil
+				}
+			default:
+				r, size := utf8.DecodeRune(tab)
+				if _, ok := font.unicode[r]; r != utf8.RuneError && !ok {
+					font.unicode[r] = glyph
+				}
+				tab = tab[size:]
+			}
+		}
+	}
+	return font, nil
+}
+
+// readGlyphs reads num glyphs of charSize bytes each and returns the remaining data
+func (f *psfFont) readGlyphs(data []byte, num, charSize int) ([]byte, error) {
+	if num == 0 || charSize == 0 || len(data) < num*charSize {
+		return nil, fmt.Errorf("expected %d glyphs of %d bytes, got %d bytes", num, charSize, len(data))
+	}
+	f.glyphs = make([][]byte, num)
+	for i := range f.glyphs {
+		f.glyphs[i] = data[i*charSize : (i+1)*charSize]
+	}
+	return data[num*charSize:], nil
+}
+
+// glyph returns the bitmap for the rune, characters missing in the font are shown as '?'
+func (f *psfFont) glyph(r rune) []byte {
+	if f.unicode != nil {
+		if idx, ok := f.unicode[r]; ok {
+			return f.glyphs[idx]
+		}
+		if idx, ok := f.unicode['?']; ok {
+			return f.glyphs[idx]
+		}
+		return f.glyphs[0]
+	}
+	if r >= 0 && int(r) < len(f.glyphs) {
+		return f.glyphs[r]
+	}
+	if '?' < len(f.glyphs) {
+		return f.glyphs['?']
+	}
+	return f.glyphs[0]
+}
+
+// pixel reports whether the pixel at (x, y) of the glyph is set
+func (f *psfFont) pixel(glyph []byte, x, y int) bool {
+	b := glyph[y*f.bytesPerRow+x/8]
+	return b&(0x80>>(x%8)) != 0
+}
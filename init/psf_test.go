@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePsf1(t *testing.T) {
+	data := []byte{0x36, 0x04, psf1ModeHasTab, 2}
+	for i := 0; i < 256; i++ {
+		data = append(data, byte(i), 0x81)
+	}
+	// glyph 0 is 'x', glyph 1 is 'a' and 'б', the rest have no mapping
+	tab := []uint16{'x', psf1Separator, 'a', 0x431, psf1StartSeq, 'a', 0x301, psf1Separator}
+	for _, v := range tab {
+		data = binary.LittleEndian.AppendUint16(data, v)
+	}
+
+	font, err := parsePsf(data)
+	require.NoError(t, err)
+	require.Equal(t, 8, font.width)
+	require.Equal(t, 2, font.height)
+	require.Len(t, font.glyphs, 256)
+	require.Equal(t, map[rune]int{'x': 0, 'a': 1, 'б': 1}, font.unicode)
+	require.Equal(t, []byte{1, 0x81}, font.glyph('б'))
+	require.Equal(t, []byte{0, 0x81}, font.glyph('z'))
+
+	require.True(t, font.pixel(font.glyph('a'), 7, 0))
+	require.False(t, font.pixel(font.glyph('a'), 0, 0))
+	require.True(t, font.pixel(font.glyph('a'), 0, 1))
+}
+
+func TestParsePsf2(t *testing.T) {
+	header := []uint32{0, 32, psf2HasUnicodeTable, 3, 2 * 2, 2, 10}
+	data := []byte{0x72, 0xb5, 0x4a, 0x86}
+	for _, v := range header {
+		data = binary.LittleEndian.AppendUint32(data, v)
+	}
+	data = append(data, 0, 0, 0, 0, 0xff, 0xc0, 0xff, 0xc0, 0x80, 0, 0x80, 0)
+	data = append(data, []byte("?\xffAÄ\xfeA\xcc\x88\xff|\xff")...)
+
+	font, err := parsePsf(data)
+	require.NoError(t, err)
+	require.Equal(t, 10, font.width)
+	require.Equal(t, 2, font.height)
+	require.Equal(t, 2, font.bytesPerRow)
+	require.Equal(t, map[rune]int{'?': 0, 'A': 1, 'Ä': 1, '|': 2}, font.unicode)
+
+	glyph := font.glyph('A')
+	require.True(t, font.pixel(glyph, 9, 0))
+	require.True(t, font.pixel(glyph, 0, 1))
+	require.Equal(t, font.glyphs[0], font.glyph('z'))
+}
+
+func TestParsePsfInvalid(t *testing.T) {
+	_, err := parsePsf([]byte("not a font"))
+	require.Error(t, err)
+	_, err = parsePsf([]byte{0x36, 0x04, 0, 16, 1, 2, 3})
+	require.Error(t, err)
+	_, err = parsePsf([]byte{0x72, 0xb5, 0x4a, 0x86, 0})
+	require.Error(t, err)
+}
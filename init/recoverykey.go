@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/anatol/luks.go"
+)
+
+// systemd-cryptenroll --recovery-key generates a 256-bit key encoded with modhex alphabet (the same as YubiKey uses,
+// it is unambiguous with any keyboard layout) as 8 groups of 8 characters separated by dashes. The whole string including
+// the dashes is the passphrase of the keyslot that is referenced by a systemd-recovery token.
+
+const (
+	recoveryKeyAlphabet   = "cbdefghijklnrtuv"
+	recoveryKeyGroups     = 8
+	recoveryKeyGroupSize  = 8
+	recoveryKeyPromptWait = 30 * time.Second // max time to wait for token based methods before asking for the recovery key
+)
+
+// normalizeRecoveryKey validates the recovery key typed by the user and converts it to the canonical form.
+// Dashes and spaces between the characters are optional and the key is case-insensitive.
+func normalizeRecoveryKey(input []byte) ([]byte, error) {
+	key := make([]byte, 0, recoveryKeyGroups*(recoveryKeyGroupSize+1))
+	n := 0
+	for _, c := range input {
+		if c == '-' || c == ' ' {
+			continue
+		}
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if strings.IndexByte(recoveryKeyAlphabet, c) == -1 {
+			memZeroBytes(key)
+			return nil, fmt.Errorf("invalid character '%c', a recovery key consists of letters %s", c, recoveryKeyAlphabet)
+		}
+		if n == recoveryKeyGroups*recoveryKeyGroupSize {
+			n++
+			break
+		}
+		if n != 0 && n%recoveryKeyGroupSize == 0 {
+			key = append(key, '-')
+		}
+		key = append(key, c)
+		n++
+	}
+	if n != recoveryKeyGroups*recoveryKeyGroupSize {
+		memZeroBytes(key)
+		return nil, fmt.Errorf("a recovery key has %d characters, not counting dashes", recoveryKeyGroups*recoveryKeyGroupSize)
+	}
+	return key, nil
+}
+
+// requestRecoveryKey asks for a recovery key once the token based unlock methods failed
+func requestRecoveryKey(volumes chan *luks.Volume, d luks.Device, checkSlots []int, mappingName string, automaticFailed, unlocked <-chan struct{}) error {
+	select {
+	case <-automaticFailed:
+	case <-unlocked:
+		return nil
+	case <-time.After(recoveryKeyPromptWait):
+		info("%s: token based unlock methods are still running, asking for the recovery key", mappingName)
+	}
+
+	console("Automatic unlocking of %s failed, the volume can be unlocked with its recovery key\n", mappingName)
+	console("The key has format xxxxxxxx-xxxxxxxx-xxxxxxxx-xxxxxxxx-xxxxxxxx-xxxxxxxx-xxxxxxxx-xxxxxxxx, dashes are optional\n")
+	attempts := passwordAttempts{name: mappingName}
+	for {
+		input, err := attempts.read(fmt.Sprintf("Enter recovery key for %s:", mappingName))
+		if err != nil {
+			warning("reading recovery key: %v", err)
+			return err
+		}
+		key, err := normalizeRecoveryKey(input)
+		memZeroBytes(input)
+		if err != nil {
+			console("   Invalid recovery key: %v\n", err)
+			continue
+		}
+
+		for _, s := range checkSlots {
+			v, err := unsealVolume(d, s, key)
+			if err == luks.ErrPassphraseDoesNotMatch {
+				continue
+			} else if err != nil {
+				warning("unlocking slot %v: %v", s, err)
+				continue
+			}
+			memZeroBytes(key)
+			unlockRecords.Store(v, passphraseUnlockRecord(d, s))
+			volumes <- v
+			return nil
+		}
+		memZeroBytes(key)
+		if err := attempts.fail("   Incorrect recovery key"); err != nil {
+			return err
+		}
+	}
+}
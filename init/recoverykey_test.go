@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeRecoveryKey(t *testing.T) {
+	const key = "fjhecvbt-lbhdlekg-ntcjhuee-drgtjjgj-ffkbitkb-elnfrckn-icbbjrbl-klgetdhg"
+
+	for _, input := range []string{
+		key,
+		"fjhecvbtlbhdlekgntcjhueedrgtjjgjffkbitkbelnfrcknicbbjrblklgetdhg",
+		"FJHECVBT LBHDLEKG NTCJHUEE DRGTJJGJ FFKBITKB ELNFRCKN ICBBJRBL KLGETDHG",
+	} {
+		got, err := normalizeRecoveryKey([]byte(input))
+		require.NoError(t, err, input)
+		require.Equal(t, key, string(got))
+	}
+
+	_, err := normalizeRecoveryKey([]byte("fjhecvbt-lbhdlekg"))
+	require.ErrorContains(t, err, "64 characters")
+	_, err = normalizeRecoveryKey([]byte(key + "c"))
+	require.ErrorContains(t, err, "64 characters")
+	_, err = normalizeRecoveryKey([]byte("ajhecvbt-lbhdlekg-ntcjhuee-drgtjjgj-ffkbitkb-elnfrckn-icbbjrbl-klgetdhg"))
+	require.ErrorContains(t, err, "invalid character 'a'")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anatol/luks.go"
+	"github.com/google/go-tpm/legacy/tpm2"
+)
+
+// With booster.tpm_auto_reseal booster tells the user how to re-enroll a TPM2 token that failed because of PCR policy
+// mismatch (e.g. after a firmware update) once the volume is unlocked with the passphrase.
+
+var tpmAutoReseal bool
+
+type pcrPolicy struct {
+	pcrs    []int
+	bank    tpm2.Algorithm
+	changed []int // PCRs that differ from the sealed values, nil if unknown
+	pin     bool
+}
+
+// pcrSecureBootPolicy is the PCR that holds the Secure Boot state and the certificates that verified the boot chain
+const pcrSecureBootPolicy = 7
+
+var pcrPolicyMismatches sync.Map // LUKS UUID -> *pcrPolicy of the token that failed because of PCR policy mismatch
+
+// secureBootPolicyChanged reports whether the failed token was sealed against the Secure Boot policy PCR and
+// the PCR has changed since then. The change is assumed if the token does not tell the sealed PCR values.
+func (p *pcrPolicy) secureBootPolicyChanged() bool {
+	if !intListContains(pcrSecureBootPolicy, p.pcrs) {
+		return false
+	}
+	return p.changed == nil || intListContains(pcrSecureBootPolicy, p.changed)
+}
+
+func recordPCRPolicyMismatch(d luks.Device, t luks.Token, changed []int) {
+	tok, err := parseTPM2Token(t.Payload)
+	if err != nil || tok.signed != nil {
+		// a token bound to a signed policy is not re-enrolled, it needs a signature for the new PCR values instead
+		return
+	}
+	pcrPolicyMismatches.LoadOrStore(d.UUID(), &pcrPolicy{pcrs: tok.pcrs, bank: tok.bank, changed: changed, pin: tok.pin})
+}
+
+// adviseTPM2Reenroll tells the user how to re-enroll the TPM2 token that failed with a PCR policy mismatch once
+// the volume is unlocked with the passphrase. Booster does not write the LUKS header itself: the header is updated
+// by systemd-cryptenroll from the booted system where cryptsetup keeps the header consistent (both header copies,
+// checksums, locking). If the Secure Boot policy (PCR 7) has changed then the boot chain was verified by different
+// certificates and the user is asked to make sure the change is expected.
+func adviseTPM2Reenroll(d luks.Device) {
+	p, ok := pcrPolicyMismatches.LoadAndDelete(d.UUID())
+	if !ok {
+		return
+	}
+	policy := p.(*pcrPolicy)
+
+	pcrs := policy.pcrs
+	if len(tpmPCRs) > 0 {
+		pcrs = tpmPCRs
+	}
+	pcrList := make([]string, len(pcrs))
+	for i, pcr := range pcrs {
+		pcrList[i] = strconv.Itoa(pcr)
+	}
+	args := "--tpm2-pcrs=" + strings.Join(pcrList, "+")
+	if policy.pin {
+		args += " --tpm2-with-pin=yes"
+	}
+
+	// make it visible even in quiet mode, the user has to act after boot
+	if policy.secureBootPolicyChanged() {
+		console("booster: Secure Boot policy (PCR %d) of %s has changed, make sure the firmware or Secure Boot keys update is expected before re-enrolling the TPM2 token\n", pcrSecureBootPolicy, d.Path())
+	}
+	console("booster: TPM2 token of %s does not match the current PCR values, re-enroll it after boot with\n"+
+		"    systemd-cryptenroll --wipe-slot=tpm2 --tpm2-device=auto %s %s\n", d.Path(), args, d.Path())
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+)
+
+// The built-in emergency shell is started if busybox is not present in the image and the image is built with
+// enable_shell option. It provides line editing, command history, simple job control and a set of commands
+// implemented in Go (see shellcmds.go) that help to debug boot failures. Pipes and redirections are not supported.
+
+// lineEditor reads a line from a terminal in raw mode and supports cursor movement and history navigation
+type lineEditor struct {
+	in      io.Reader
+	out     io.Writer
+	history []string
+}
+
+var errLineInterrupted = errors.New("interrupted")
+
+func (e *lineEditor) readByte() (byte, error) {
+	var b [1]byte
+	for {
+		n, err := e.in.Read(b[:])
+		if n == 1 {
+			return b[0], nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// readLine reads a line, it returns io.EOF if Ctrl-D is pressed at an empty line and errLineInterrupted at Ctrl-C
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	var line []rune
+	cursor := 0
+	historyPos := len(e.history)
+	var pending []byte // bytes of an incomplete UTF-8 character
+
+	redraw := func() {
+		s := "\r" + prompt + string(line) + "\x1b[K"
+		if back := len(line) - cursor; back > 0 {
+			s += fmt.Sprintf("\x1b[%dD", back)
+		}
+		_, _ = io.WriteString(e.out, s)
+	}
+	setLine := func(s string) {
+		line = []rune(s)
+		cursor = len(line)
+	}
+
+	_, _ = io.WriteString(e.out, prompt)
+	for {
+		b, err := e.readByte()
+		if err != nil {
+			return "", err
+		}
+
+		switch b {
+		case '\r', '\n':
+			_, _ = io.WriteString(e.out, "\r\n")
+			s := string(line)
+			if strings.TrimSpace(s) != "" && (len(e.history) == 0 || e.history[len(e.history)-1] != s) {
+				e.history = append(e.history, s)
+			}
+			return s, nil
+		case 0x03: // Ctrl-C
+			_, _ = io.WriteString(e.out, "^C\r\n")
+			return "", errLineInterrupted
+		case 0x04: // Ctrl-D
+			if len(line) == 0 {
+				_, _ = io.WriteString(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if cursor < len(line) {
+				line = append(line[:cursor], line[cursor+1:]...)
+			}
+		case 0x7f, '\b': // Backspace
+			if cursor > 0 {
+				line = append(line[:cursor-1], line[cursor:]...)
+				cursor--
+			}
+		case 0x01: // Ctrl-A
+			cursor = 0
+		case 0x05: // Ctrl-E
+			cursor = len(line)
+		case 0x02: // Ctrl-B
+			if cursor > 0 {
+				cursor--
+			}
+		case 0x06: // Ctrl-F
+			if cursor < len(line) {
+				cursor++
+			}
+		case 0x0b: // Ctrl-K
+			line = line[:cursor]
+		case 0x15: // Ctrl-U
+			line = line[cursor:]
+			cursor = 0
+		case 0x0c: // Ctrl-L
+			_, _ = io.WriteString(e.out, "\x1b[H\x1b[2J")
+		case 0x1b: // escape sequence
+			b1, err := e.readByte()
+			if err != nil {
+				return "", err
+			}
+			if b1 != '[' && b1 != 'O' {
+				continue
+			}
+			b2, err := e.readByte()
+			if err != nil {
+				return "", err
+			}
+			switch b2 {
+			case 'A': // Up
+				if historyPos > 0 {
+					historyPos--
+					setLine(e.history[historyPos])
+				}
+			case 'B': // Down
+				if historyPos < len(e.history) {
+					historyPos++
+					if historyPos == len(e.history) {
+						setLine("")
+					} else {
+						setLine(e.history[historyPos])
+					}
+				}
+			case 'C': // Right
+				if cursor < len(line) {
+					cursor++
+				}
+			case 'D': // Left
+				if cursor > 0 {
+					cursor--
+				}
+			case 'H':
+				cursor = 0
+			case 'F':
+				cursor = len(line)
+			case '1', '3', '4', '7', '8': // Home, Delete, End sequences in the form of ESC [ n ~
+				if b3, err := e.readByte(); err != nil {
+					return "", err
+				} else if b3 != '~' {
+					continue
+				}
+				switch b2 {
+				case '1', '7':
+					cursor = 0
+				case '4', '8':
+					cursor = len(line)
+				case '3':
+					if cursor < len(line) {
+						line = append(line[:cursor], line[cursor+1:]...)
+					}
+				}
+			}
+		default:
+			if b < 0x20 {
+				continue
+			}
+			pending = append(pending, b)
+			if !utf8.FullRune(pending) {
+				continue
+			}
+			r, _ := utf8.DecodeRune(pending)
+			pending = pending[:0]
+			line = append(line[:cursor], append([]rune{r}, line[cursor:]...)...)
+			cursor++
+		}
+		redraw()
+	}
+}
+
+// splitCommandLine splits the line into arguments following the shell quoting rules. Variables in the form of
+// $NAME or ${NAME} are expanded outside of single quotes. A trailing '&' requests to run the command in background.
+func splitCommandLine(line string) (args []string, background bool, err error) {
+	var arg strings.Builder
+	inArg := false
+	flush := func() {
+		if inArg {
+			args = append(args, arg.String())
+			arg.Reset()
+			inArg = false
+		}
+	}
+	expand := func(s string, i int) int {
+		// s[i] is '$', returns the index of the last consumed character
+		name, end := "", i
+		if i+1 < len(s) && s[i+1] == '{' {
+			if j := strings.IndexByte(s[i+2:], '}'); j != -1 {
+				name, end = s[i+2:i+2+j], i+2+j
+			}
+		} else {
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] >= 'a' && s[j] <= 'z' || s[j] >= 'A' && s[j] <= 'Z' || s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			name, end = s[i+1:j], j-1
+		}
+		if name == "" {
+			arg.WriteByte('$')
+			return i
+		}
+		arg.WriteString(os.Getenv(name))
+		return end
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			flush()
+		case c == '#' && !inArg:
+			i = len(line)
+		case c == '\\':
+			if i+1 < len(line) {
+				i++
+				arg.WriteByte(line[i])
+			}
+			inArg = true
+		case c == '\'':
+			j := strings.IndexByte(line[i+1:], '\'')
+			if j == -1 {
+				return nil, false, fmt.Errorf("unterminated quote")
+			}
+			arg.WriteString(line[i+1 : i+1+j])
+			i += j + 1
+			inArg = true
+		case c == '"':
+			inArg = true
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				switch {
+				case line[i] == '\\' && i+1 < len(line) && strings.IndexByte("\"\\$", line[i+1]) != -1:
+					i++
+					arg.WriteByte(line[i])
+				case line[i] == '$':
+					i = expand(line, i)
+				default:
+					arg.WriteByte(line[i])
+				}
+			}
+			if i == len(line) {
+				return nil, false, fmt.Errorf("unterminated quote")
+			}
+		case c == '$':
+			i = expand(line, i)
+			inArg = true
+		case c == '&' && strings.TrimSpace(line[i+1:]) == "":
+			background = true
+			i = len(line)
+		default:
+			arg.WriteByte(c)
+			inArg = true
+		}
+	}
+	flush()
+	return args, background, nil
+}
+
+// shellJob is an external command started by the shell
+type shellJob struct {
+	id      int
+	cmdline string
+	pgid    int
+	done    chan struct{}
+	err     error
+}
+
+type shellSession struct {
+	tty        *os.File
+	editor     *lineEditor
+	jobControl bool // the terminal is the controlling terminal of booster so jobs can be moved to foreground
+	jobs       []*shellJob
+	nextJobID  int
+	exited     bool
+}
+
+// openConsoleTTY opens the terminal device behind /dev/console. Unlike /dev/console it can be a controlling terminal,
+// this is what busybox 'cttyhack' does.
+func openConsoleTTY() (*os.File, error) {
+	data, err := os.ReadFile("/sys/class/tty/console/active")
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no active console")
+	}
+	name := fields[len(fields)-1]
+	if name == "tty0" {
+		// tty0 is the current virtual terminal
+		if data, err := os.ReadFile("/sys/class/tty/tty0/active"); err == nil {
+			name = strings.TrimSpace(string(data))
+		}
+	}
+	return os.OpenFile("/dev/"+name, os.O_RDWR, 0)
+}
+
+func newShell() *shellSession {
+	sh := &shellSession{tty: os.Stdin}
+	if tty, err := openConsoleTTY(); err == nil {
+		_, _ = unix.Setsid()
+		if err := unix.IoctlSetInt(int(tty.Fd()), unix.TIOCSCTTY, 0); err == nil {
+			sh.tty = tty
+			sh.jobControl = true
+		} else {
+			debug("shell: unable to set controlling terminal %s: %v", tty.Name(), err)
+			tty.Close()
+		}
+	}
+	// booster moves itself back to foreground once a job finishes, SIGHUP is sent when the terminal is released
+	signal.Ignore(unix.SIGTTOU, unix.SIGTTIN, unix.SIGTSTP, unix.SIGHUP)
+	sh.editor = &lineEditor{in: sh.tty, out: sh.tty}
+	return sh
+}
+
+func (sh *shellSession) printf(format string, v ...interface{}) {
+	_, _ = fmt.Fprintf(sh.tty, format, v...)
+}
+
+// withTerminalMode runs fn with the terminal either in raw mode (for line editing) or in the regular cooked mode
+func (sh *shellSession) withTerminalMode(raw bool, fn func() error) error {
+	fd := int(sh.tty.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return fn()
+	}
+	newState := *termios
+	if raw {
+		newState.Lflag &^= unix.ICANON | unix.ECHO | unix.ISIG | unix.IEXTEN
+		newState.Iflag &^= unix.IXON | unix.ICRNL
+		newState.Cc[unix.VMIN] = 1
+		newState.Cc[unix.VTIME] = 0
+	} else {
+		newState.Lflag |= unix.ICANON | unix.ECHO | unix.ISIG | unix.IEXTEN
+		newState.Iflag |= unix.ICRNL
+		newState.Oflag |= unix.OPOST | unix.ONLCR
+	}
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &newState); err != nil {
+		return fn()
+	}
+	defer unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+	return fn()
+}
+
+// setForeground gives the terminal to the given process group
+func (sh *shellSession) setForeground(pgid int) {
+	if sh.jobControl {
+		_ = unix.IoctlSetPointerInt(int(sh.tty.Fd()), unix.TIOCSPGRP, pgid)
+	}
+}
+
+func (sh *shellSession) reportFinishedJobs() {
+	var running []*shellJob
+	for _, j := range sh.jobs {
+		select {
+		case <-j.done:
+			status := "Done"
+			if j.err != nil {
+				status = fmt.Sprintf("Exit (%v)", unwrapExitError(j.err))
+			}
+			sh.printf("[%d] %s\t%s\n", j.id, status, j.cmdline)
+		default:
+			running = append(running, j)
+		}
+	}
+	sh.jobs = running
+}
+
+// waitForeground puts the job to foreground and waits till it finishes
+func (sh *shellSession) waitForeground(j *shellJob) error {
+	sh.setForeground(j.pgid)
+	<-j.done
+	sh.setForeground(unix.Getpgrp())
+	return j.err
+}
+
+func (sh *shellSession) runExternal(args []string, background bool) error {
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return fmt.Errorf("%s: command not found, type 'help' to see the built-in commands", args[0])
+	}
+
+	cmd := exec.Command(path, args[1:]...)
+	cmd.Stdout = sh.tty
+	cmd.Stderr = sh.tty
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if !background {
+		cmd.Stdin = sh.tty
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	sh.nextJobID++
+	j := &shellJob{id: sh.nextJobID, cmdline: strings.Join(args, " "), pgid: cmd.Process.Pid, done: make(chan struct{})}
+	go func() {
+		j.err = cmd.Wait()
+		close(j.done)
+	}()
+
+	if background {
+		sh.jobs = append(sh.jobs, j)
+		sh.printf("[%d] %d\n", j.id, j.pgid)
+		return nil
+	}
+	return unwrapExitError(sh.waitForeground(j))
+}
+
+// findJob finds a background job by its id specified as N or %N, the most recent job is used if spec is empty
+func (sh *shellSession) findJob(spec string) (*shellJob, error) {
+	if len(sh.jobs) == 0 {
+		return nil, fmt.Errorf("no current job")
+	}
+	if spec == "" {
+		return sh.jobs[len(sh.jobs)-1], nil
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(spec, "%"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid job", spec)
+	}
+	for _, j := range sh.jobs {
+		if j.id == id {
+			return j, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: no such job", spec)
+}
+
+func (sh *shellSession) execute(line string) error {
+	args, background, err := splitCommandLine(line)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	if c, ok := shellCommands[args[0]]; ok {
+		if background {
+			return fmt.Errorf("%s: built-in commands cannot run in background", args[0])
+		}
+		return sh.withTerminalMode(false, func() error { return c.run(sh, args[1:]) })
+	}
+	return sh.withTerminalMode(false, func() error { return sh.runExternal(args, background) })
+}
+
+func (sh *shellSession) run() {
+	sh.printf("\nBooster emergency shell. Type 'help' to see the available commands.\n")
+	for !sh.exited {
+		sh.reportFinishedJobs()
+
+		wd, _ := os.Getwd()
+		var line string
+		err := sh.withTerminalMode(true, func() error {
+			var err error
+			line, err = sh.editor.readLine(wd + " # ")
+			return err
+		})
+		if errors.Is(err, errLineInterrupted) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if err := sh.execute(line); err != nil {
+			sh.printf("%v\n", err)
+		}
+	}
+}
+
+// shellCommand is a command built into the emergency shell
+type shellCommand struct {
+	usage string
+	help  string
+	run   func(sh *shellSession, args []string) error
+}
+
+var shellCommands map[string]shellCommand
+
+func shellHelp(sh *shellSession, _ []string) error {
+	names := make([]string, 0, len(shellCommands))
+	for n := range shellCommands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		c := shellCommands[n]
+		sh.printf("  %-40s %s\n", strings.TrimSpace(n+" "+c.usage), c.help)
+	}
+	sh.printf("Other commands are looked up in PATH=%s\n", os.Getenv("PATH"))
+	return nil
+}
+
+// close releases the controlling terminal, so the boot can continue after a breakpoint shell
+func (sh *shellSession) close() {
+	if sh.jobControl {
+		_ = unix.IoctlSetInt(int(sh.tty.Fd()), unix.TIOCNOTTY, 0)
+		sh.tty.Close()
+	}
+}
+
+// builtinShell runs the built-in emergency shell, it returns once the user exits the shell
+func builtinShell() {
+	sh := newShell()
+	defer sh.close()
+	sh.run()
+}
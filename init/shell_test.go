@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readEditorLine(t *testing.T, e *lineEditor, input string) (string, error) {
+	e.in = strings.NewReader(input)
+	e.out = io.Discard
+	return e.readLine("# ")
+}
+
+func TestLineEditor(t *testing.T) {
+	e := &lineEditor{}
+
+	check := func(input, expected string) {
+		line, err := readEditorLine(t, e, input)
+		require.NoError(t, err)
+		require.Equal(t, expected, line)
+	}
+
+	check("ls /\r", "ls /")
+	check("lsx\x7f /dev\n", "ls /dev")
+	check("ls\x1b[D\x1b[Dx\r", "xls")         // cursor left
+	check("abc\x01X\x05Y\r", "XabcY")         // Ctrl-A, Ctrl-E
+	check("abc\x1b[D\x1b[D\x0b\r", "a")       // Ctrl-K
+	check("abc\x1b[D\x15\r", "c")             // Ctrl-U
+	check("abc\x1b[H\x1b[3~\r", "bc")         // Home, Delete
+	check("привет\x7f\r", "приве")            // UTF-8
+	check("\x1b[A\r", "приве")                // history up
+	check("\x1b[A\x1b[A\x1b[A\x1b[B\r", "bc") // history navigation
+	check("\x1b[A\x1b[B\x1b[B\r", "")         // down past the last entry gives an empty line
+	require.Equal(t, []string{"ls /", "ls /dev", "xls", "XabcY", "a", "c", "bc", "приве", "bc"}, e.history)
+
+	_, err := readEditorLine(t, e, "abc\x03")
+	require.ErrorIs(t, err, errLineInterrupted)
+	_, err = readEditorLine(t, e, "\x04")
+	require.ErrorIs(t, err, io.EOF)
+	_, err = readEditorLine(t, e, "abc")
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestLineEditorRedraw(t *testing.T) {
+	var out bytes.Buffer
+	e := &lineEditor{in: strings.NewReader("ab\x1b[D\r"), out: &out}
+	_, err := e.readLine("# ")
+	require.NoError(t, err)
+	require.Equal(t, "# \r# a\x1b[K\r# ab\x1b[K\r# ab\x1b[K\x1b[1D\r\n", out.String())
+}
+
+func TestSplitCommandLine(t *testing.T) {
+	require.NoError(t, os.Setenv("BOOSTER_TEST_VAR", "value"))
+	defer os.Unsetenv("BOOSTER_TEST_VAR")
+
+	check := func(line string, expected []string, background bool) {
+		args, bg, err := splitCommandLine(line)
+		require.NoError(t, err)
+		require.Equal(t, expected, args)
+		require.Equal(t, background, bg)
+	}
+
+	check("", nil, false)
+	check("  ls   -l  /dev ", []string{"ls", "-l", "/dev"}, false)
+	check(`echo "a b" 'c d' e\ f`, []string{"echo", "a b", "c d", "e f"}, false)
+	check(`echo ""`, []string{"echo", ""}, false)
+	check("echo $BOOSTER_TEST_VAR ${BOOSTER_TEST_VAR}x \"$BOOSTER_TEST_VAR\" '$BOOSTER_TEST_VAR'", []string{"echo", "value", "valuex", "value", "$BOOSTER_TEST_VAR"}, false)
+	check("echo $ a#b # comment", []string{"echo", "$", "a#b"}, false)
+	check("sleep 10 &", []string{"sleep", "10"}, true)
+	check("sleep 10&", []string{"sleep", "10"}, true)
+	check("echo a&b", []string{"echo", "a&b"}, false)
+
+	_, _, err := splitCommandLine(`echo "abc`)
+	require.Error(t, err)
+	_, _, err = splitCommandLine(`echo 'abc`)
+	require.Error(t, err)
+}
+
+func TestFormatSize(t *testing.T) {
+	require.Equal(t, "0B", formatSize(0))
+	require.Equal(t, "512B", formatSize(512))
+	require.Equal(t, "1.0K", formatSize(1024))
+	require.Equal(t, "1.5G", formatSize(3<<29))
+	require.Equal(t, "20G", formatSize(20<<30))
+	require.Equal(t, "1.8T", formatSize(2000000000000))
+}
+
+func TestFormatKernelLog(t *testing.T) {
+	require.Equal(t, "Linux version 6.4\nbooster: mounted\n<abc\n",
+		string(formatKernelLog([]byte("<5>Linux version 6.4\n<12>booster: mounted\n<abc\n"))))
+}
+
+func TestIcmpEchoRequest(t *testing.T) {
+	msg := icmpEchoRequest(false, 0x1234, 1, []byte{1, 2, 3})
+	require.Equal(t, []byte{8, 0, 0xe1, 0xc8, 0x12, 0x34, 0, 1, 1, 2, 3}, msg)
+	require.Equal(t, uint16(0), icmpChecksum(msg))
+
+	msg = icmpEchoRequest(true, 0x1234, 1, nil)
+	require.Equal(t, []byte{128, 0, 0, 0, 0x12, 0x34, 0, 1}, msg)
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anatol/luks.go"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	shellCommands = map[string]shellCommand{
+		"help":             {"", "show this help", shellHelp},
+		"exit":             {"", "exit the shell", shellExit},
+		"reboot":           {"", "reboot the machine", func(*shellSession, []string) error { shutdown(unix.LINUX_REBOOT_CMD_RESTART); return nil }},
+		"poweroff":         {"", "power off the machine", func(*shellSession, []string) error { shutdown(unix.LINUX_REBOOT_CMD_POWER_OFF); return nil }},
+		"cd":               {"[DIR]", "change the current directory", shellCd},
+		"pwd":              {"", "print the current directory", shellPwd},
+		"export":           {"[NAME=VALUE]...", "set or print environment variables", shellExport},
+		"history":          {"", "print the command history", shellHistory},
+		"jobs":             {"", "list background jobs", shellJobs},
+		"fg":               {"[%N]", "move a background job to foreground", shellFg},
+		"echo":             {"[ARG]...", "print the arguments", shellEcho},
+		"cat":              {"FILE...", "print the files content", shellCat},
+		"ls":               {"[PATH]...", "list directory content", shellLs},
+		"lsblk":            {"", "list block devices", shellLsblk},
+		"dmesg":            {"", "print the kernel log", shellDmesg},
+		"mount":            {"[-t TYPE] [-o OPTIONS] DEVICE DIR", "mount a filesystem or list mounts", shellMount},
+		"umount":           {"DIR", "unmount a filesystem", shellUmount},
+		"cryptsetup-open":  {"DEVICE NAME", "unlock a LUKS device with a passphrase as /dev/mapper/NAME", shellCryptsetupOpen},
+		checkUnlockCommand: {"DEVICE...", "check whether LUKS tokens unlock the devices", shellCheckUnlock},
+		"modprobe":         {"MODULE...", "load kernel modules", shellModprobe},
+		"ip":               {"link|addr|route ...", "show or change the network configuration", shellIP},
+		"ping":             {"[-c COUNT] HOST", "send ICMP echo requests", shellPing},
+	}
+}
+
+var errUsage = errors.New("invalid arguments")
+
+func shellExit(sh *shellSession, _ []string) error {
+	sh.exited = true
+	return nil
+}
+
+func shellCd(_ *shellSession, args []string) error {
+	dir := "/"
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	return os.Chdir(dir)
+}
+
+func shellPwd(sh *shellSession, _ []string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	sh.printf("%s\n", wd)
+	return nil
+}
+
+func shellExport(sh *shellSession, args []string) error {
+	if len(args) == 0 {
+		for _, e := range os.Environ() {
+			sh.printf("%s\n", e)
+		}
+		return nil
+	}
+	for _, a := range args {
+		name, value, _ := strings.Cut(a, "=")
+		if err := os.Setenv(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func shellHistory(sh *shellSession, _ []string) error {
+	for i, h := range sh.editor.history {
+		sh.printf("%5d  %s\n", i+1, h)
+	}
+	return nil
+}
+
+func shellJobs(sh *shellSession, _ []string) error {
+	for _, j := range sh.jobs {
+		sh.printf("[%d] Running\t%s\n", j.id, j.cmdline)
+	}
+	return nil
+}
+
+func shellFg(sh *shellSession, args []string) error {
+	spec := ""
+	if len(args) > 0 {
+		spec = args[0]
+	}
+	j, err := sh.findJob(spec)
+	if err != nil {
+		return err
+	}
+	sh.printf("%s\n", j.cmdline)
+	for i, job := range sh.jobs {
+		if job == j {
+			sh.jobs = append(sh.jobs[:i], sh.jobs[i+1:]...)
+			break
+		}
+	}
+	return unwrapExitError(sh.waitForeground(j))
+}
+
+func shellEcho(sh *shellSession, args []string) error {
+	sh.printf("%s\n", strings.Join(args, " "))
+	return nil
+}
+
+func shellCat(sh *shellSession, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	for _, a := range args {
+		f, err := os.Open(a)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(sh.tty, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func shellLs(sh *shellSession, args []string) error {
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	for _, a := range args {
+		st, err := os.Lstat(a)
+		if err != nil {
+			return err
+		}
+		entries := []string{a}
+		if st.IsDir() {
+			if len(args) > 1 {
+				sh.printf("%s:\n", a)
+			}
+			des, err := os.ReadDir(a)
+			if err != nil {
+				return err
+			}
+			entries = entries[:0]
+			for _, de := range des {
+				entries = append(entries, filepath.Join(a, de.Name()))
+			}
+		}
+		for _, e := range entries {
+			st, err := os.Lstat(e)
+			if err != nil {
+				continue
+			}
+			name := filepath.Base(e)
+			if !st.IsDir() || len(entries) == 1 && e == a {
+				name = e
+			}
+			if st.Mode()&os.ModeSymlink != 0 {
+				if target, err := os.Readlink(e); err == nil {
+					name += " -> " + target
+				}
+			}
+			sh.printf("%s %10d %s\n", st.Mode(), st.Size(), name)
+		}
+	}
+	return nil
+}
+
+// formatSize formats the size in bytes in a human-readable form, e.g. 1.5G
+func formatSize(size uint64) string {
+	const units = "BKMGTPE"
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", size)
+	}
+	if value < 10 {
+		return fmt.Sprintf("%.1f%c", value, units[i])
+	}
+	return fmt.Sprintf("%.0f%c", value, units[i])
+}
+
+// readMounts returns map of mounted devices to their mount points
+func readMounts() map[string]string {
+	mounts := make(map[string]string)
+	data, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		return mounts
+	}
+	for _, l := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) >= 2 && strings.HasPrefix(fields[0], "/dev/") {
+			mounts[fields[0]] = fields[1]
+		}
+	}
+	return mounts
+}
+
+func shellLsblk(sh *shellSession, _ []string) error {
+	disks, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return err
+	}
+	mounts := readMounts()
+
+	sh.printf("%-20s %7s %-5s %-12s %-36s %-16s %s\n", "NAME", "SIZE", "TYPE", "FSTYPE", "UUID", "LABEL", "MOUNTPOINT")
+	printDevice := func(sysPath, name, typ string) {
+		devPath := "/dev/" + name
+		if dmName, err := os.ReadFile(filepath.Join(sysPath, "dm", "name")); err == nil {
+			typ = "dm"
+			name = strings.TrimSpace(string(dmName))
+			devPath = "/dev/mapper/" + name
+		}
+
+		var size uint64
+		if data, err := os.ReadFile(filepath.Join(sysPath, "size")); err == nil {
+			sectors, _ := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+			size = sectors * 512
+		}
+		var fstype, uuid, label string
+		if blk, err := readBlkInfo(devPath); err == nil {
+			fstype, label = blk.format, blk.label
+			if blk.uuid != nil {
+				uuid = blk.uuid.toString()
+			}
+		}
+		mountpoint := mounts[devPath]
+		if mountpoint == "" {
+			mountpoint = mounts["/dev/"+filepath.Base(sysPath)]
+		}
+		sh.printf("%-20s %7s %-5s %-12s %-36s %-16s %s\n", name, formatSize(size), typ, fstype, uuid, label, mountpoint)
+	}
+
+	for _, d := range disks {
+		sysPath := filepath.Join("/sys/block", d.Name())
+		printDevice(sysPath, d.Name(), "disk")
+
+		parts, err := os.ReadDir(sysPath)
+		if err != nil {
+			continue
+		}
+		for _, p := range parts {
+			partPath := filepath.Join(sysPath, p.Name())
+			if _, err := os.Stat(filepath.Join(partPath, "partition")); err == nil {
+				printDevice(partPath, p.Name(), "part")
+			}
+		}
+	}
+	return nil
+}
+
+// formatKernelLog strips the '<N>' log level prefixes from the kernel log lines
+func formatKernelLog(data []byte) []byte {
+	var out bytes.Buffer
+	for _, l := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(l) > 2 && l[0] == '<' {
+			if i := bytes.IndexByte(l, '>'); i != -1 {
+				l = l[i+1:]
+			}
+		}
+		out.Write(l)
+	}
+	return out.Bytes()
+}
+
+func shellDmesg(sh *shellSession, _ []string) error {
+	size, err := unix.Klogctl(unix.SYSLOG_ACTION_SIZE_BUFFER, nil)
+	if err != nil {
+		return fmt.Errorf("dmesg: %v", err)
+	}
+	buf := make([]byte, size)
+	n, err := unix.Klogctl(unix.SYSLOG_ACTION_READ_ALL, buf)
+	if err != nil {
+		return fmt.Errorf("dmesg: %v", err)
+	}
+	_, err = sh.tty.Write(formatKernelLog(buf[:n]))
+	return err
+}
+
+func shellMount(sh *shellSession, args []string) error {
+	if len(args) == 0 {
+		return shellCat(sh, []string{"/proc/mounts"})
+	}
+
+	var fstype, options string
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-t", "-o":
+			if i+1 == len(args) {
+				return errUsage
+			}
+			if args[i] == "-t" {
+				fstype = args[i+1]
+			} else {
+				options = args[i+1]
+			}
+			i++
+		default:
+			positional = append(positional, args[i])
+		}
+	}
+	if len(positional) != 2 {
+		return errUsage
+	}
+	dev, dir := positional[0], positional[1]
+
+	if fstype == "" {
+		blk, err := readBlkInfo(dev)
+		if err != nil {
+			return fmt.Errorf("%s: %v, specify the filesystem type with -t", dev, err)
+		}
+		if !blk.isFs {
+			return fmt.Errorf("%s: %s is not a mountable filesystem", dev, blk.format)
+		}
+		fstype = blk.format
+	}
+	flags, options := sunderMountFlags(options, 0)
+	return mount(dev, dir, fstype, flags, options)
+}
+
+func shellUmount(_ *shellSession, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	return unix.Unmount(args[0], 0)
+}
+
+// readPassword reads a passphrase from the shell terminal with the echo disabled
+func (sh *shellSession) readPassword(prompt string) ([]byte, error) {
+	sh.printf("%s", prompt)
+	defer sh.printf("\n")
+
+	fd := int(sh.tty.Fd())
+	if termios, err := unix.IoctlGetTermios(fd, unix.TCGETS); err == nil {
+		newState := *termios
+		newState.Lflag &^= unix.ECHO
+		if err := unix.IoctlSetTermios(fd, unix.TCSETS, &newState); err == nil {
+			defer unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+		}
+	}
+	return readPasswordLine(sh.tty)
+}
+
+func shellCryptsetupOpen(sh *shellSession, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	dev, name := args[0], args[1]
+
+	d, err := luks.Open(dev)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if len(d.Slots()) == 0 {
+		return fmt.Errorf("%s: no keyslots", dev)
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		password, err := sh.readPassword(fmt.Sprintf("Enter passphrase for %s:", dev))
+		if err != nil {
+			return err
+		}
+		for _, s := range d.Slots() {
+			v, err := unsealVolume(d, s, password)
+			if err == luks.ErrPassphraseDoesNotMatch {
+				continue
+			}
+			memZeroBytes(password)
+			if err != nil {
+				return err
+			}
+			if err := v.SetupMapper(name); err != nil {
+				return err
+			}
+			sh.printf("%s is unlocked as /dev/mapper/%s\n", dev, name)
+			return nil
+		}
+		memZeroBytes(password)
+		sh.printf("No key available with this passphrase.\n")
+	}
+	return fmt.Errorf("%s: unable to unlock", dev)
+}
+
+func shellCheckUnlock(sh *shellSession, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	for _, dev := range args {
+		n, err := checkUnlock(dev)
+		if err != nil {
+			return fmt.Errorf("%s: %v", dev, err)
+		}
+		sh.printf("%s: %d token(s) unlock the device\n", dev, n)
+	}
+	return nil
+}
+
+func shellModprobe(_ *shellSession, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	loadModules(args...).Wait()
+
+	modulesMutex.Lock()
+	defer modulesMutex.Unlock()
+	for _, m := range args {
+		if !loadedModules[normalizeModuleName(m)] {
+			return fmt.Errorf("module %s is not loaded, see dmesg for details", m)
+		}
+	}
+	return nil
+}
+
+func shellIP(sh *shellSession, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	object, args := args[0], args[1:]
+	cmd := "show"
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch {
+	case strings.HasPrefix("link", object) && (cmd == "show" || cmd == "list"):
+		links, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		for _, l := range links {
+			a := l.Attrs()
+			sh.printf("%d: %s: <%s> mtu %d state %s\n    link/%s %s\n", a.Index, a.Name, strings.ToUpper(strings.ReplaceAll(a.Flags.String(), "|", ",")), a.MTU, a.OperState, l.Type(), a.HardwareAddr)
+		}
+		return nil
+	case strings.HasPrefix("link", object) && cmd == "set":
+		if len(args) != 2 {
+			return errUsage
+		}
+		link, err := netlink.LinkByName(args[0])
+		if err != nil {
+			return fmt.Errorf("%s: %v", args[0], err)
+		}
+		switch args[1] {
+		case "up":
+			return netlink.LinkSetUp(link)
+		case "down":
+			return netlink.LinkSetDown(link)
+		}
+		return errUsage
+	case strings.HasPrefix("address", object) && (cmd == "show" || cmd == "list"):
+		links, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		for _, l := range links {
+			if len(args) > 0 && l.Attrs().Name != args[len(args)-1] {
+				continue
+			}
+			addrs, err := netlink.AddrList(l, netlink.FAMILY_ALL)
+			if err != nil {
+				return err
+			}
+			sh.printf("%d: %s: state %s\n", l.Attrs().Index, l.Attrs().Name, l.Attrs().OperState)
+			for _, a := range addrs {
+				family := "inet"
+				if a.IP.To4() == nil {
+					family = "inet6"
+				}
+				sh.printf("    %s %s\n", family, a.IPNet)
+			}
+		}
+		return nil
+	case strings.HasPrefix("address", object) && (cmd == "add" || cmd == "del"):
+		// ip addr add|del CIDR dev IFNAME
+		if len(args) != 3 || args[1] != "dev" {
+			return errUsage
+		}
+		addr, err := netlink.ParseAddr(args[0])
+		if err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName(args[2])
+		if err != nil {
+			return fmt.Errorf("%s: %v", args[2], err)
+		}
+		if cmd == "add" {
+			return netlink.AddrAdd(link, addr)
+		}
+		return netlink.AddrDel(link, addr)
+	case strings.HasPrefix("route", object) && (cmd == "show" || cmd == "list"):
+		routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+		if err != nil {
+			return err
+		}
+		for _, r := range routes {
+			sh.printf("%s\n", formatRoute(r))
+		}
+		return nil
+	case strings.HasPrefix("route", object) && (cmd == "add" || cmd == "del"):
+		route, err := parseRouteArgs(args)
+		if err != nil {
+			return err
+		}
+		if cmd == "add" {
+			return netlink.RouteAdd(route)
+		}
+		return netlink.RouteDel(route)
+	}
+	return errUsage
+}
+
+func formatRoute(r netlink.Route) string {
+	s := "default"
+	if r.Dst != nil {
+		s = r.Dst.String()
+	}
+	if r.Gw != nil {
+		s += " via " + r.Gw.String()
+	}
+	if link, err := netlink.LinkByIndex(r.LinkIndex); err == nil {
+		s += " dev " + link.Attrs().Name
+	}
+	if r.Src != nil {
+		s += " src " + r.Src.String()
+	}
+	if r.Priority != 0 {
+		s += fmt.Sprintf(" metric %d", r.Priority)
+	}
+	return s
+}
+
+// parseRouteArgs parses 'DST [via GATEWAY] [dev IFNAME]' arguments, DST is either CIDR or 'default'
+func parseRouteArgs(args []string) (*netlink.Route, error) {
+	if len(args) == 0 || len(args)%2 != 1 {
+		return nil, errUsage
+	}
+	route := &netlink.Route{}
+	if args[0] != "default" {
+		_, dst, err := net.ParseCIDR(args[0])
+		if err != nil {
+			return nil, err
+		}
+		route.Dst = dst
+	}
+	for i := 1; i < len(args); i += 2 {
+		switch args[i] {
+		case "via":
+			route.Gw = net.ParseIP(args[i+1])
+			if route.Gw == nil {
+				return nil, fmt.Errorf("invalid gateway %s", args[i+1])
+			}
+		case "dev":
+			link, err := netlink.LinkByName(args[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", args[i+1], err)
+			}
+			route.LinkIndex = link.Attrs().Index
+		default:
+			return nil, errUsage
+		}
+	}
+	if route.Gw == nil && route.LinkIndex == 0 {
+		return nil, fmt.Errorf("either gateway or device has to be specified")
+	}
+	if route.Gw == nil {
+		route.Scope = netlink.SCOPE_LINK
+	}
+	return route, nil
+}
+
+// icmpChecksum computes the internet checksum (RFC 1071)
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// icmpEchoRequest creates ICMP (or ICMPv6 if ipv6 is true) echo request message
+func icmpEchoRequest(ipv6 bool, id, seq uint16, payload []byte) []byte {
+	msg := make([]byte, 8, 8+len(payload))
+	msg[0] = 8 // ICMP echo request
+	if ipv6 {
+		msg[0] = 128 // kernel computes the ICMPv6 checksum
+	}
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	msg = append(msg, payload...)
+	if !ipv6 {
+		binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	}
+	return msg
+}
+
+func shellPing(sh *shellSession, args []string) error {
+	count := -1
+	if len(args) == 3 && args[0] == "-c" {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid count %s", args[1])
+		}
+		count, args = n, args[2:]
+	}
+	if len(args) != 1 {
+		return errUsage
+	}
+	host := args[0]
+
+	addr, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return err
+	}
+	ipv6 := addr.IP.To4() == nil
+	network, listenAddr, replyType := "ip4:icmp", "0.0.0.0", byte(0)
+	if ipv6 {
+		network, listenAddr, replyType = "ip6:ipv6-icmp", "::", 129
+	}
+	conn, err := net.ListenPacket(network, listenAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	interrupted := make(chan struct{})
+	unregister := onInterrupt(func() { close(interrupted) })
+	defer unregister()
+
+	id := uint16(os.Getpid())
+	payload := make([]byte, 56)
+	sh.printf("PING %s (%s): %d data bytes\n", host, addr.IP, len(payload))
+
+	var sent, received int
+	reply := make([]byte, 1500)
+loop:
+	for seq := uint16(1); count < 0 || sent < count; seq++ {
+		start := time.Now()
+		if _, err := conn.WriteTo(icmpEchoRequest(ipv6, id, seq, payload), addr); err != nil {
+			return err
+		}
+		sent++
+
+		deadline := start.Add(time.Second)
+		_ = conn.SetReadDeadline(deadline)
+		for {
+			n, from, err := conn.ReadFrom(reply)
+			if err != nil {
+				break // timeout
+			}
+			if n < 8 || reply[0] != replyType || binary.BigEndian.Uint16(reply[4:]) != id || binary.BigEndian.Uint16(reply[6:]) != seq {
+				continue
+			}
+			received++
+			sh.printf("%d bytes from %s: icmp_seq=%d time=%.1f ms\n", n, from, seq, float64(time.Since(start).Microseconds())/1000)
+			break
+		}
+
+		select {
+		case <-interrupted:
+			break loop
+		case <-time.After(time.Until(deadline)):
+		}
+	}
+
+	sh.printf("--- %s ping statistics ---\n%d packets transmitted, %d received, %d%% packet loss\n", host, sent, received, 100*(sent-received)/sent)
+	return nil
+}
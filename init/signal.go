@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Booster runs as PID 1 and if the process exits (e.g. Go runtime default handler for SIGINT) then kernel panics with
+// "Attempted to kill init!". Instead of exiting booster converts the interrupts into cancellation of the blocking
+// unlock operations (e.g. waiting for a FIDO2 touch) so it can move to the next unlock method.
+
+var (
+	interruptMutex    sync.Mutex
+	interruptHandlers = make(map[int]func())
+	nextInterruptID   int
+
+	emergencyShellStarted bool // protected by interruptMutex
+)
+
+// onInterrupt registers a function that is called when user interrupts booster with SIGINT/SIGTERM.
+// The returned function unregisters the handler, it should be called once the blocking operation completes.
+func onInterrupt(fn func()) func() {
+	interruptMutex.Lock()
+	defer interruptMutex.Unlock()
+
+	id := nextInterruptID
+	nextInterruptID++
+	interruptHandlers[id] = fn
+
+	return func() {
+		interruptMutex.Lock()
+		defer interruptMutex.Unlock()
+		delete(interruptHandlers, id)
+	}
+}
+
+func handleInterrupt() {
+	interruptMutex.Lock()
+	defer interruptMutex.Unlock()
+
+	if len(interruptHandlers) == 0 {
+		debug("interrupt received but there are no operations to cancel")
+		return
+	}
+	for _, fn := range interruptHandlers {
+		fn()
+	}
+}
+
+// handleSignals processes signals sent to init. Before emergency shell is started SIGINT and SIGTERM cancel
+// ongoing unlock operations. In the emergency shell the signals are used by busybox 'reboot', 'halt' and 'poweroff'
+// commands to request the system shutdown, SIGINT (Ctrl-C) interrupts a running built-in shell command.
+func handleSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, unix.SIGINT, unix.SIGTERM, unix.SIGUSR1, unix.SIGUSR2)
+
+	for sig := range ch {
+		interruptMutex.Lock()
+		inShell := emergencyShellStarted
+		interruptMutex.Unlock()
+
+		if inShell {
+			switch sig {
+			case unix.SIGINT:
+				handleInterrupt()
+			case unix.SIGTERM:
+				shutdown(unix.LINUX_REBOOT_CMD_RESTART)
+			case unix.SIGUSR1:
+				shutdown(unix.LINUX_REBOOT_CMD_HALT)
+			case unix.SIGUSR2:
+				shutdown(unix.LINUX_REBOOT_CMD_POWER_OFF)
+			}
+			continue
+		}
+
+		switch sig {
+		case unix.SIGINT, unix.SIGTERM:
+			info("received %v, cancelling ongoing unlock operations", sig)
+			handleInterrupt()
+		}
+	}
+}
+
+// shutdown flushes the filesystem buffers and restarts/halts the machine
+func shutdown(cmd int) {
+	unix.Sync()
+	if err := unix.Reboot(cmd); err != nil {
+		severe("reboot(0x%x): %v", cmd, err)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The SSH server allows to unlock volumes of a headless machine remotely. A user authenticated with one of the keys
+// from the authorized_keys file added to the image runs 'cryptroot-unlock' command that answers the passphrase prompts
+// shown at the console.
+
+const (
+	sshDefaultPort   = 22
+	sshUnlockCommand = "cryptroot-unlock"
+)
+
+var (
+	sshListener net.Listener
+	sshConns    = make(map[*ssh.ServerConn]bool)
+	sshStopped  = make(chan struct{})
+	sshSessions sync.WaitGroup
+	sshMutex    sync.Mutex
+)
+
+// parseAuthorizedKeys parses authorized_keys file in the OpenSSH format. Key options (e.g. from= or command=) are not
+// supported, a key restricted with them is refused as otherwise it would be accepted without the restrictions.
+func parseAuthorizedKeys(data []byte) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, _, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", line, err)
+		}
+		if len(options) > 0 {
+			return nil, fmt.Errorf("key %s has options %v, key options are not supported", ssh.FingerprintSHA256(key), options)
+		}
+		keys[string(key.Marshal())] = true
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found")
+	}
+	return keys, nil
+}
+
+func sshServerConfig(hostKeyFile, authorizedKeysFile string) (*ssh.ServerConfig, error) {
+	data, err := os.ReadFile(hostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	hostKey, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", hostKeyFile, err)
+	}
+
+	data, err = os.ReadFile(authorizedKeysFile)
+	if err != nil {
+		return nil, err
+	}
+	authorizedKeys, err := parseAuthorizedKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", authorizedKeysFile, err)
+	}
+	measure("ssh authorized keys", data)
+
+	conf := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !authorizedKeys[string(key.Marshal())] {
+				return nil, fmt.Errorf("key %s is not authorized", ssh.FingerprintSHA256(key))
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"pubkey-fp": ssh.FingerprintSHA256(key)}}, nil
+		},
+	}
+	conf.AddHostKey(hostKey)
+	return conf, nil
+}
+
+// startSSHServer accepts SSH connections once the network is configured and till stopSSHServer() is called
+func startSSHServer() error {
+	conf, err := sshServerConfig(sshHostKeyPath, sshAuthorizedKeysPath)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-networkReady:
+	case <-sshStopped:
+		return nil
+	}
+
+	port := config.SSH.Port
+	if port == 0 {
+		port = sshDefaultPort
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+
+	sshMutex.Lock()
+	select {
+	case <-sshStopped:
+		sshMutex.Unlock()
+		return l.Close()
+	default:
+	}
+	sshListener = l
+	sshMutex.Unlock()
+
+	info("ssh server is listening at port %d", port)
+	for {
+		c, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go serveSSHConn(c, conf)
+	}
+}
+
+// stopSSHServer stops accepting connections and closes the existing ones. The sessions are given a moment to
+// notify the users that the boot continues.
+func stopSSHServer() {
+	sshMutex.Lock()
+	close(sshStopped)
+	if sshListener != nil {
+		_ = sshListener.Close()
+	}
+	sshMutex.Unlock()
+
+	sessionsDone := make(chan struct{})
+	go func() {
+		sshSessions.Wait()
+		close(sessionsDone)
+	}()
+	select {
+	case <-sessionsDone:
+	case <-time.After(time.Second):
+	}
+
+	sshMutex.Lock()
+	defer sshMutex.Unlock()
+	for c := range sshConns {
+		_ = c.Close()
+	}
+}
+
+func serveSSHConn(c net.Conn, conf *ssh.ServerConfig) {
+	conn, chans, reqs, err := ssh.NewServerConn(c, conf)
+	if err != nil {
+		debug("ssh: handshake with %s failed: %v", c.RemoteAddr(), err)
+		_ = c.Close()
+		return
+	}
+
+	sshMutex.Lock()
+	select {
+	case <-sshStopped:
+		sshMutex.Unlock()
+		_ = conn.Close()
+		return
+	default:
+	}
+	sshConns[conn] = true
+	sshMutex.Unlock()
+
+	defer func() {
+		sshMutex.Lock()
+		delete(sshConns, conn)
+		sshMutex.Unlock()
+	}()
+
+	info("ssh: %s@%s authenticated with key %s", conn.User(), conn.RemoteAddr(), conn.Permissions.Extensions["pubkey-fp"])
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			_ = nc.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			debug("ssh: unable to accept channel: %v", err)
+			continue
+		}
+		go serveSSHSession(ch, requests)
+	}
+}
+
+func serveSSHSession(ch ssh.Channel, requests <-chan *ssh.Request) {
+	var pty, started bool
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			pty = true
+			_ = req.Reply(true, nil)
+		case "shell", "exec":
+			if started {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			command := sshUnlockCommand
+			if req.Type == "exec" {
+				var payload struct{ Command string }
+				if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				command = strings.TrimSpace(payload.Command)
+			}
+			_ = req.Reply(true, nil)
+			started = true
+
+			sshSessions.Add(1)
+			go func() {
+				defer sshSessions.Done()
+
+				var status uint32
+				if command == sshUnlockCommand {
+					status = runUnlockSession(ch, pty)
+				} else {
+					_, _ = fmt.Fprintf(ch.Stderr(), "%s: command not found, only %s is supported\n", command, sshUnlockCommand)
+					status = 127
+				}
+				_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+				_ = ch.Close()
+			}()
+		default:
+			// env, window-change and the other requests do not matter for the unlock session
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+	_ = ch.Close()
+}
+
+var errSSHInputInterrupted = errors.New("interrupted")
+
+// sshInputReader converts the terminal input of an SSH session to the form expected by readPasswordLine()
+type sshInputReader struct {
+	r io.Reader
+}
+
+func (s sshInputReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	for i := 0; i < n; i++ {
+		switch p[i] {
+		case '\r':
+			p[i] = '\n'
+		case 0x7f: // DEL is sent by the Backspace key
+			p[i] = '\b'
+		case 0x03, 0x04: // Ctrl-C, Ctrl-D
+			return i, errSSHInputInterrupted
+		}
+	}
+	return n, err
+}
+
+// runUnlockSession passes the passphrases entered by the remote user to the pending console prompts.
+// It returns once the boot continues or the user interrupts the session.
+func runUnlockSession(rw io.ReadWriter, pty bool) uint32 {
+	out := func(format string, v ...interface{}) {
+		msg := fmt.Sprintf(format, v...)
+		if pty {
+			msg = strings.ReplaceAll(msg, "\n", "\r\n")
+		}
+		_, _ = io.WriteString(rw, msg)
+	}
+	in := sshInputReader{rw}
+
+	// waitForPrompt returns the next prompt, nil means the boot continues
+	waitForPrompt := func() *pendingPrompt {
+		for {
+			p, changed := getCurrentPrompt()
+			if p != nil {
+				return p
+			}
+			select {
+			case <-changed:
+			case <-sshStopped:
+				return nil
+			}
+		}
+	}
+
+	if p, _ := getCurrentPrompt(); p == nil {
+		out("Waiting for a volume to request a passphrase...\n")
+	}
+	for {
+		p := waitForPrompt()
+		if p == nil {
+			out("The volumes are unlocked, the boot continues\n")
+			return 0
+		}
+
+		out("%s ", p.text)
+		input, err := readPasswordLine(in)
+		out("\n")
+		if err != nil {
+			memZeroBytes(input)
+			return 1
+		}
+		if !answerPrompt(p.seq, input) {
+			memZeroBytes(input)
+			out("The prompt is already answered at the console\n")
+			continue
+		}
+		out("Unlocking...\n")
+
+		// wait till the answered prompt is closed, the same prompt shows up again if the passphrase is incorrect
+		for curr, changed := getCurrentPrompt(); curr == p; curr, changed = getCurrentPrompt() {
+			select {
+			case <-changed:
+			case <-sshStopped:
+				return 0
+			}
+		}
+		if next := waitForPrompt(); next != nil && next.text == p.text {
+			out("Incorrect passphrase, try again\n")
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	line := ssh.MarshalAuthorizedKey(signer.PublicKey())
+
+	data := append([]byte("# comment\n\n"), line...)
+	keys, err := parseAuthorizedKeys(data)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{string(signer.PublicKey().Marshal()): true}, keys)
+
+	_, err = parseAuthorizedKeys([]byte("# no keys here\n"))
+	require.Error(t, err)
+	_, err = parseAuthorizedKeys([]byte("ssh-ed25519 notbase64\n"))
+	require.Error(t, err)
+
+	// a key restricted with options is refused rather than accepted without the restrictions
+	for _, opts := range []string{`from="10.0.0.1" `, "restrict ", `command="cryptroot-unlock" `} {
+		_, err = parseAuthorizedKeys(append([]byte(opts), line...))
+		require.ErrorContains(t, err, "key options are not supported")
+	}
+}
+
+func startTestSSHServer(t *testing.T) *ssh.Client {
+	dir := t.TempDir()
+
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(hostPriv)
+	require.NoError(t, err)
+	hostKeyFile := filepath.Join(dir, "host_key")
+	require.NoError(t, os.WriteFile(hostKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	require.NoError(t, err)
+
+	_, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	clientSigner, err := ssh.NewSignerFromKey(clientPriv)
+	require.NoError(t, err)
+	authorizedKeysFile := filepath.Join(dir, "authorized_keys")
+	require.NoError(t, os.WriteFile(authorizedKeysFile, ssh.MarshalAuthorizedKey(clientSigner.PublicKey()), 0o644))
+
+	conf, err := sshServerConfig(hostKeyFile, authorizedKeysFile)
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			serveSSHConn(c, conf)
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "root",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientSigner)},
+		HostKeyCallback: ssh.FixedHostKey(hostSigner.PublicKey()),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+func TestSSHUnlockSession(t *testing.T) {
+	client := startTestSSHServer(t)
+
+	prompt := &pendingPrompt{text: "Enter passphrase for root:", seq: 1001, answer: make(chan []byte, 1)}
+	setCurrentPrompt(prompt)
+	defer setCurrentPrompt(nil)
+
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	stdin, err := session.StdinPipe()
+	require.NoError(t, err)
+	require.NoError(t, session.Start(sshUnlockCommand))
+
+	_, err = stdin.Write([]byte("secret\n"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret"), <-prompt.answer)
+
+	// the passphrase is incorrect, the same prompt is shown again
+	setCurrentPrompt(nil)
+	setCurrentPrompt(&pendingPrompt{text: prompt.text, seq: 1002, answer: make(chan []byte, 1)})
+	require.NoError(t, stdin.Close())
+
+	var exitErr *ssh.ExitError
+	require.True(t, errors.As(session.Wait(), &exitErr))
+	require.Equal(t, 1, exitErr.ExitStatus())
+	require.Equal(t, "Enter passphrase for root: \nUnlocking...\nIncorrect passphrase, try again\nEnter passphrase for root: \n", stdout.String())
+}
+
+func TestSSHUnsupportedCommand(t *testing.T) {
+	client := startTestSSHServer(t)
+
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	var exitErr *ssh.ExitError
+	require.True(t, errors.As(session.Run("sh"), &exitErr))
+	require.Equal(t, 127, exitErr.ExitStatus())
+	require.Equal(t, "sh: command not found, only cryptroot-unlock is supported\n", stderr.String())
+}
@@ -2,13 +2,21 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/go-tpm/legacy/tpm2"
 	"github.com/google/go-tpm/tpmutil"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 var defaultSymScheme = &tpm2.SymScheme{
@@ -27,7 +35,14 @@ var defaultECCParams = &tpm2.ECCParams{
 	CurveID:   tpm2.CurveNISTP256,
 }
 
-var enableSwEmulator bool
+var errPCRPolicyMismatch = errors.New("PCR policy mismatch")
+
+var (
+	enableSwEmulator bool
+	tpmVendors       []string          // allowed TPM manufacturer IDs specified with booster.tpm_vendor=, e.g. IFX,STM
+	tpmPCRs          []int             // PCRs specified with booster.tpm_pcrs=, e.g. 0,2,4,7
+	tpmReadyTimeout  = 3 * time.Second // max time to wait for the TPM device and its initialization, booster.tpm_timeout=
+)
 
 func openTPM() (io.ReadWriteCloser, error) {
 	var dev io.ReadWriteCloser
@@ -42,78 +57,509 @@ func openTPM() (io.ReadWriteCloser, error) {
 		return nil, err
 	}
 
-	if _, err := tpm2.GetManufacturer(dev); err != nil {
+	manufacturer, err := tpmGetManufacturer(dev)
+	if isTPMNotInitialized(err) {
+		_ = dev.Close()
+		return nil, fmt.Errorf("TPM is not initialized: %w", err)
+	}
+	if err != nil {
+		_ = dev.Close()
 		return nil, fmt.Errorf("device is not a TPM 2.0")
 	}
+	if err := checkTPMVendor(manufacturer); err != nil {
+		_ = dev.Close()
+		return nil, err
+	}
 
 	return dev, nil
 }
 
+// checkTPMVendor verifies that TPM manufacturer is in the list of vendors allowed by user.
+// It helps to detect a swapped or emulated TPM device.
+func checkTPMVendor(manufacturer []byte) error {
+	vendor := strings.TrimRight(string(manufacturer), "\x00 ")
+	if len(tpmVendors) == 0 {
+		debug("TPM manufacturer is %s", vendor)
+		return nil
+	}
+
+	for _, v := range tpmVendors {
+		if strings.EqualFold(v, vendor) {
+			return nil
+		}
+	}
+	return fmt.Errorf("TPM manufacturer %s is not in the allowed vendor list [%s]", vendor, strings.Join(tpmVendors, ","))
+}
+
+// parsePCRList parses a comma separated list of PCR indices e.g. 0,2,4,7
+func parsePCRList(value string) ([]int, error) {
+	var pcrs []int
+	seen := make(map[int]bool)
+	for _, p := range strings.Split(value, ",") {
+		p = strings.TrimSpace(p)
+		pcr, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PCR index '%s'", p)
+		}
+		if pcr < 0 {
+			return nil, fmt.Errorf("invalid PCR index %d", pcr)
+		}
+		if seen[pcr] {
+			return nil, fmt.Errorf("duplicated PCR index %d", pcr)
+		}
+		seen[pcr] = true
+		pcrs = append(pcrs, pcr)
+	}
+	sort.Ints(pcrs)
+	return pcrs, nil
+}
+
+// tpmPCRCount returns the number of PCRs implemented by the TPM
+func tpmPCRCount(dev io.ReadWriter) (int, error) {
+	vals, _, err := tpm2.GetCapability(dev, tpm2.CapabilityTPMProperties, 1, uint32(tpm2.PCRCount))
+	if err != nil {
+		return 0, err
+	}
+	if len(vals) == 0 {
+		return 0, fmt.Errorf("TPM did not report PCR count")
+	}
+	prop, ok := vals[0].(tpm2.TaggedProperty)
+	if !ok || prop.Tag != tpm2.PCRCount {
+		return 0, fmt.Errorf("TPM did not report PCR count")
+	}
+	return int(prop.Value), nil
+}
+
+// validatePCRs checks that the TPM implements all the given PCRs.
+// Otherwise a nonexistent PCR (e.g. a typo in the PCR list) is reported by TPM as a confusing policy error.
+func validatePCRs(dev io.ReadWriter, pcrs []int) error {
+	count, err := tpmPCRCount(dev)
+	if err != nil {
+		debug("unable to get TPM PCR count: %v", err)
+		return nil
+	}
+	for _, pcr := range pcrs {
+		if pcr < 0 || pcr >= count {
+			return fmt.Errorf("PCR %d does not exist, TPM implements PCRs 0..%d", pcr, count-1)
+		}
+	}
+	return nil
+}
+
 // Waits until a tpm device is available for use. Times out and returns false after 3 seconds.
 func tpmAwaitReady() bool {
-	timedOut := waitTimeout(&tpmReadyWg, time.Second*3)
+	timedOut := waitTimeout(&tpmReadyWg, tpmReadyTimeout)
 	if timedOut {
-		info("no tpm devices found after 3 seconds.")
+		info("no tpm devices found after %v", tpmReadyTimeout)
 	}
 	return !timedOut
 }
 
-func tpm2Unseal(public, private []byte, pcrs []int, bank tpm2.Algorithm, policyHash, password []byte) ([]byte, error) {
-	tpmAwaitReady()
+// isTPMNotInitialized checks for TPM_RC_INITIALIZE, the TPM has not received TPM2_Startup yet
+func isTPMNotInitialized(err error) bool {
+	var e tpm2.Error
+	return errors.As(err, &e) && e.Code == tpm2.RCInitialize
+}
 
-	dev, err := openTPM()
-	if err != nil {
-		return nil, err
+// tpmGetManufacturer reads the TPM manufacturer. Some firmware hands the TPM over to the OS late and the device node
+// appears before the TPM is through TPM2_Startup. Booster waits for the firmware/kernel to finish the initialization
+// and only if it does not happen within tpmReadyTimeout it sends TPM2_Startup(CLEAR) itself.
+func tpmGetManufacturer(dev io.ReadWriter) ([]byte, error) {
+	deadline := time.Now().Add(tpmReadyTimeout)
+	for {
+		manufacturer, err := tpm2.GetManufacturer(dev)
+		if !isTPMNotInitialized(err) {
+			return manufacturer, err
+		}
+		if time.Now().After(deadline) {
+			info("TPM is not initialized after %v, sending TPM2_Startup", tpmReadyTimeout)
+			if err := tpm2.Startup(dev, tpm2.StartupClear); err != nil {
+				return nil, fmt.Errorf("TPM2_Startup: %w", err)
+			}
+			return tpm2.GetManufacturer(dev)
+		}
+		debug("TPM is not initialized yet, waiting")
+		time.Sleep(100 * time.Millisecond)
 	}
-	defer dev.Close()
+}
 
-	sessHandle, _, err := policyPCRSession(dev, pcrs, bank, policyHash, password != nil)
-	if err != nil {
-		return nil, err
+const (
+	tpmRetryAttempts = 5
+	tpmRetryDelay    = 100 * time.Millisecond
+)
+
+// isTPMTransientError checks whether the TPM asks to retry the command later e.g. because another process
+// (or the firmware) is using the TPM at the moment. Policy mismatches, auth failures and DA lockout are not transient.
+func isTPMTransientError(err error) bool {
+	if isTPMNotInitialized(err) {
+		return true
 	}
-	defer tpm2.FlushContext(dev, sessHandle)
+	var w tpm2.Warning
+	if !errors.As(err, &w) {
+		return false
+	}
+	switch w.Code {
+	case tpm2.RCRetry, tpm2.RCYielded, tpm2.RCTesting:
+		return true
+	default:
+		return false
+	}
+}
+
+// tpmRetry runs the TPM command sequence and re-runs it with an increasing delay while the TPM returns a transient error.
+// The shared TPM connection is re-opened before the next attempt so every attempt starts with a fresh connection.
+func tpmRetry(fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || !isTPMTransientError(err) || attempt == tpmRetryAttempts {
+			return err
+		}
+		debug("TPM returned a transient error, retrying (attempt %d of %d): %v", attempt, tpmRetryAttempts, err)
+		closeTPM()
+		time.Sleep(time.Duration(attempt) * tpmRetryDelay)
+	}
+}
+
+// tpmConn is the TPM connection shared by all TPM operations of the unlock phase. It saves re-opening the device,
+// checking its manufacturer and creating the SRK for every token and every volume.
+type tpmConn struct {
+	dev  io.ReadWriteCloser
+	srks map[tpm2.Algorithm]tpmutil.Handle // transient SRKs by key type, they live as long as the connection to the resource manager is open
+}
 
-	srkTemplate := tpm2.Public{
-		Type:          tpm2.AlgECC,
-		NameAlg:       tpm2.AlgSHA256,
-		Attributes:    tpm2.FlagStorageDefault,
-		AuthPolicy:    nil,
-		ECCParameters: defaultECCParams,
-		RSAParameters: defaultRSAParams,
+var (
+	tpmMutex  sync.Mutex // serializes TPM operations, commands of different operations must not interleave
+	tpmShared *tpmConn
+)
+
+// withTPM runs fn with the shared TPM connection, the connection is opened at the first use
+func withTPM(fn func(t *tpmConn) error) error {
+	tpmMutex.Lock()
+	defer tpmMutex.Unlock()
+
+	if tpmShared == nil {
+		tpmAwaitReady()
+		dev, err := openTPM()
+		if err != nil {
+			return err
+		}
+		tpmShared = &tpmConn{dev: dev, srks: make(map[tpm2.Algorithm]tpmutil.Handle)}
 	}
+	return fn(tpmShared)
+}
 
-	srkHandle, _, err := tpm2.CreatePrimary(dev, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", srkTemplate)
+// srkHandle returns the handle of SRK of the given type (ECC or RSA) creating the key at the first use
+func (t *tpmConn) srkHandle(alg tpm2.Algorithm) (tpmutil.Handle, error) {
+	if srk, ok := t.srks[alg]; ok {
+		return srk, nil
+	}
+	srk, err := createSRK(t.dev, alg)
 	if err != nil {
-		return nil, fmt.Errorf("clevis.go/tpm2: can't create primary key: %v", err)
+		return tpm2.HandleNull, err
+	}
+	t.srks[alg] = srk
+	return srk, nil
+}
+
+// parentHandle returns the handle of the key the sealed object of the token is loaded under
+func (t *tpmConn) parentHandle(tok *tpm2Token) (tpmutil.Handle, error) {
+	if tok.srk == nil {
+		return t.srkHandle(tok.primaryAlg)
 	}
-	defer tpm2.FlushContext(dev, srkHandle)
 
-	objectHandle, _, err := tpm2.Load(dev, srkHandle, "", public, private)
+	_, name, _, err := tpm2.ReadPublic(t.dev, tok.srk.handle)
 	if err != nil {
-		return nil, fmt.Errorf("clevis.go/tpm2: unable to load data: %v", err)
+		return tpm2.HandleNull, fmt.Errorf("unable to read SRK at 0x%x: %w", tok.srk.handle, err)
+	}
+	if !bytes.Equal(name, tok.srk.name) {
+		return tpm2.HandleNull, fmt.Errorf("SRK at 0x%x does not match the token, the key has been replaced or the TPM has been cleared", tok.srk.handle)
 	}
-	defer tpm2.FlushContext(dev, objectHandle)
+	return tok.srk.handle, nil
+}
+
+// closeTPM closes the shared TPM connection. It is called at the end of the unlock phase.
+func closeTPM() {
+	tpmMutex.Lock()
+	defer tpmMutex.Unlock()
+
+	if tpmShared == nil {
+		return
+	}
+	for _, srk := range tpmShared.srks {
+		_ = tpm2.FlushContext(tpmShared.dev, srk)
+	}
+	_ = tpmShared.dev.Close()
+	tpmShared = nil
+}
 
-	unsealed, err := tpm2.UnsealWithSession(dev, sessHandle, objectHandle, string(password))
+// tpm2Unseal unseals the secret of the token. password is the object auth value, it is nil if the token has no pin.
+func tpm2Unseal(tok *tpm2Token, password []byte) ([]byte, error) {
+	var unsealed []byte
+	waitStart := time.Now()
+	for {
+		err := tpmRetry(func() error {
+			var err error
+			unsealed, err = tpm2UnsealOnce(tok, password)
+			return err
+		})
+		if isTPMLockout(err) {
+			if err = tpmAwaitLockout(err, waitStart); err == nil {
+				continue
+			}
+		}
+		return unsealed, err
+	}
+}
+
+// tpmMaxQuoteNonceSize is the max size of qualifying data, TPM2B_DATA is limited by the largest digest size
+const tpmMaxQuoteNonceSize = 64
+
+// tpmQuote signs the selected PCR values with the attestation key loaded at akHandle. The nonce is provided by
+// a remote verifier to prove freshness of the quote. It returns TPMS_ATTEST structure and TPMT_SIGNATURE over it
+// that the verifier checks (e.g. with 'tpm2_checkquote') before releasing further secrets.
+func tpmQuote(pcrs []int, bank tpm2.Algorithm, nonce []byte, akHandle tpmutil.Handle) (attest, signature []byte, err error) {
+	if len(nonce) > tpmMaxQuoteNonceSize {
+		return nil, nil, fmt.Errorf("quote nonce is %d bytes long, max %d bytes are allowed", len(nonce), tpmMaxQuoteNonceSize)
+	}
+	err = tpmRetry(func() error {
+		return withTPM(func(t *tpmConn) error {
+			if err := validatePCRs(t.dev, pcrs); err != nil {
+				return err
+			}
+
+			pub, _, _, err := tpm2.ReadPublic(t.dev, akHandle)
+			if err != nil {
+				return fmt.Errorf("unable to read attestation key public area: %w", err)
+			}
+			var sigAlg tpm2.Algorithm
+			switch pub.Type {
+			case tpm2.AlgRSA:
+				sigAlg = tpm2.AlgRSASSA
+				if pub.RSAParameters != nil && pub.RSAParameters.Sign != nil && pub.RSAParameters.Sign.Alg != tpm2.AlgNull {
+					sigAlg = pub.RSAParameters.Sign.Alg
+				}
+			case tpm2.AlgECC:
+				sigAlg = tpm2.AlgECDSA
+				if pub.ECCParameters != nil && pub.ECCParameters.Sign != nil && pub.ECCParameters.Sign.Alg != tpm2.AlgNull {
+					sigAlg = pub.ECCParameters.Sign.Alg
+				}
+			default:
+				return fmt.Errorf("attestation key type %v is not a signing key", pub.Type)
+			}
+
+			sel := tpm2.PCRSelection{Hash: bank, PCRs: pcrs}
+			attest, signature, err = tpm2.QuoteRaw(t.dev, akHandle, "", "", nonce, sel, sigAlg)
+			if err != nil {
+				return fmt.Errorf("unable to quote PCRs %v: %w", pcrs, err)
+			}
+			return nil
+		})
+	})
+	return attest, signature, err
+}
+
+func tpm2UnsealOnce(tok *tpm2Token, password []byte) ([]byte, error) {
+	var unsealed []byte
+	err := withTPM(func(t *tpmConn) error {
+		dev := t.dev
+		parentHandle, err := t.parentHandle(tok)
+		if err != nil {
+			return err
+		}
+
+		objectHandle, objectName, err := tpm2.Load(dev, parentHandle, "", tok.public, tok.private)
+		if err != nil {
+			return fmt.Errorf("clevis.go/tpm2: unable to load data: %w", err)
+		}
+		defer tpm2.FlushContext(dev, objectHandle)
+
+		if tpmParamEncryption {
+			unsealed, err = t.unsealEncrypted(tok, parentHandle, objectHandle, objectName, password)
+			return err
+		}
+
+		sessHandle, _, err := policyPCRSession(dev, tok.pcrs, tok.bank, tok.policyHash, password != nil, tok.signed)
+		if err != nil {
+			return err
+		}
+		defer tpm2.FlushContext(dev, sessHandle)
+
+		unsealed, err = tpm2.UnsealWithSession(dev, sessHandle, objectHandle, string(password))
+		if err != nil {
+			return fmt.Errorf("unable to unseal data: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("unable to unseal data: %v", err)
+		return nil, err
 	}
+	// an empty secret is a valid sealed object for TPM but cannot be a LUKS passphrase, fail here rather than at keyslot check
+	if len(unsealed) == 0 {
+		return nil, fmt.Errorf("TPM unsealed empty data, the sealed object is likely corrupted")
+	}
+	debug("unsealed %d bytes of data from TPM", len(unsealed))
 
 	return unsealed, nil
 }
 
-func parsePCRBank(bank string) tpm2.Algorithm {
+// tpm2CheckPolicy verifies that the current PCR values match the policy the data is sealed against
+func tpm2CheckPolicy(tok *tpm2Token, usePassword bool) error {
+	return tpmRetry(func() error {
+		return tpm2CheckPolicyOnce(tok, usePassword)
+	})
+}
+
+func tpm2CheckPolicyOnce(tok *tpm2Token, usePassword bool) error {
+	return withTPM(func(t *tpmConn) error {
+		sessHandle, _, err := policyPCRSession(t.dev, tok.pcrs, tok.bank, tok.policyHash, usePassword, tok.signed)
+		if err != nil {
+			return err
+		}
+		return tpm2.FlushContext(t.dev, sessHandle)
+	})
+}
+
+// systemdTPM2PinAuth derives the TPM object auth value from the user pin the same way as systemd-cryptenroll --tpm2-with-pin does.
+// Newer systemd versions salt the pin with PBKDF2 and use base64 of the derived key as the pin.
+func systemdTPM2PinAuth(pin, salt []byte) []byte {
+	if len(salt) > 0 {
+		derived := pbkdf2.Key(pin, salt, 10000, sha256.Size, sha256.New)
+		salted := make([]byte, base64.StdEncoding.EncodedLen(len(derived)))
+		base64.StdEncoding.Encode(salted, derived)
+		memZeroBytes(derived)
+		defer memZeroBytes(salted)
+		pin = salted
+	}
+	hash := sha256.Sum256(pin)
+	auth := make([]byte, len(hash))
+	copy(auth, hash[:])
+	memZeroBytes(hash[:])
+	// TPM strips trailing zeros from the auth value when the object is created
+	return bytes.TrimRight(auth, "\x00")
+}
+
+// isTPMLockout checks whether the TPM refuses authorization because it is in dictionary attack lockout mode
+func isTPMLockout(err error) bool {
+	var w tpm2.Warning
+	return errors.As(err, &w) && w.Code == tpm2.RCLockout
+}
+
+// isTPMAuthFailure checks whether the TPM rejected the provided auth value, e.g. because the user entered a wrong pin
+func isTPMAuthFailure(err error) bool {
+	var sessErr tpm2.SessionError
+	if errors.As(err, &sessErr) {
+		return sessErr.Code == tpm2.RCAuthFail || sessErr.Code == tpm2.RCBadAuth
+	}
+	return false
+}
+
+// srkTemplate returns the template of ECC or RSA storage root key
+func srkTemplate(alg tpm2.Algorithm) (tpm2.Public, error) {
+	tmpl := tpm2.Public{
+		Type:       alg,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagStorageDefault,
+		AuthPolicy: nil,
+	}
+	switch alg {
+	case tpm2.AlgECC:
+		tmpl.ECCParameters = defaultECCParams
+	case tpm2.AlgRSA:
+		tmpl.RSAParameters = defaultRSAParams
+	default:
+		return tpm2.Public{}, fmt.Errorf("unsupported SRK algorithm %v", alg)
+	}
+	return tmpl, nil
+}
+
+// parsePrimaryAlg parses tpm2-primary-alg token field
+func parsePrimaryAlg(alg string) (tpm2.Algorithm, error) {
+	switch alg {
+	case "", "ecc":
+		// ECC was the only algorithm used by systemd before the field was introduced
+		return tpm2.AlgECC, nil
+	case "rsa":
+		return tpm2.AlgRSA, nil
+	}
+	return tpm2.AlgNull, fmt.Errorf("unknown primary key algorithm '%s'", alg)
+}
+
+// tpmPersistentKey is a key stored in TPM non-volatile memory, e.g. SRK created by systemd-tpm2-setup
+type tpmPersistentKey struct {
+	handle tpmutil.Handle
+	name   []byte
+}
+
+// parseESYSTR parses a key reference serialized with Esys_TR_Serialize(). The serialized form starts with
+// TPM handle and TPM2B_NAME of the key followed by its public area that is not needed here.
+func parseESYSTR(blob []byte) (*tpmPersistentKey, error) {
+	var handle tpmutil.Handle
+	var name tpmutil.U16Bytes
+	if _, err := tpmutil.Unpack(blob, &handle, &name); err != nil {
+		return nil, err
+	}
+	if handle>>24 != 0x81 {
+		return nil, fmt.Errorf("0x%x is not a persistent handle", handle)
+	}
+	if len(name) == 0 {
+		return nil, fmt.Errorf("empty key name")
+	}
+	return &tpmPersistentKey{handle: handle, name: name}, nil
+}
+
+// createSRK creates the storage root key that is used as a parent of sealed objects
+func createSRK(dev io.ReadWriter, alg tpm2.Algorithm) (tpmutil.Handle, error) {
+	srkTemplate, err := srkTemplate(alg)
+	if err != nil {
+		return tpm2.HandleNull, err
+	}
+
+	srkHandle, _, err := tpm2.CreatePrimary(dev, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", srkTemplate)
+	if err != nil {
+		return tpm2.HandleNull, fmt.Errorf("clevis.go/tpm2: can't create primary key: %w", err)
+	}
+	return srkHandle, nil
+}
+
+// parsePCRBank parses tpm2-pcr-bank token field, systemd tokens without the field use sha256 bank
+func parsePCRBank(bank string) (tpm2.Algorithm, error) {
 	switch bank {
 	case "sha1":
-		return tpm2.AlgSHA1
-	case "sha256":
-		return tpm2.AlgSHA256
+		return tpm2.AlgSHA1, nil
+	case "", "sha256":
+		return tpm2.AlgSHA256, nil
+	case "sha384":
+		return tpm2.AlgSHA384, nil
+	case "sha512":
+		return tpm2.AlgSHA512, nil
+	}
+	return tpm2.AlgNull, fmt.Errorf("unsupported PCR bank '%s'", bank)
+}
+
+func pcrBankName(bank tpm2.Algorithm) string {
+	switch bank {
+	case tpm2.AlgSHA1:
+		return "sha1"
+	case tpm2.AlgSHA384:
+		return "sha384"
+	case tpm2.AlgSHA512:
+		return "sha512"
 	}
-	return tpm2.AlgSHA256
+	return "sha256"
 }
 
+// tpmAuthPolicy is the way the object auth value (TPM pin) is provided
+type tpmAuthPolicy int
+
+const (
+	tpmAuthNone     tpmAuthPolicy = iota
+	tpmAuthPassword               // PolicyPassword, the auth value is sent in clear
+	tpmAuthHMAC                   // PolicyAuthValue, the auth value is a part of the session HMAC key
+)
+
 // Returns session handle and policy digest.
-func policyPCRSession(dev io.ReadWriteCloser, pcrs []int, algo tpm2.Algorithm, expectedDigest []byte, usePassword bool) (handle tpmutil.Handle, policy []byte, retErr error) {
+func policyPCRSession(dev io.ReadWriteCloser, pcrs []int, algo tpm2.Algorithm, expectedDigest []byte, usePassword bool, signed *tpmSignedPolicy) (handle tpmutil.Handle, policy []byte, retErr error) {
 	// This session assumes the bus is trusted, so we:
 	// - use nil for tpmkey, encrypted salt, and symmetric
 	// - use and all-zeros caller nonce, and ignore the returned nonce
@@ -130,7 +576,26 @@ func policyPCRSession(dev io.ReadWriteCloser, pcrs []int, algo tpm2.Algorithm, e
 		/*symmetric=*/ tpm2.AlgNull,
 		/*authHash=*/ tpm2.AlgSHA256)
 	if err != nil {
-		return tpm2.HandleNull, nil, fmt.Errorf("unable to start session: %v", err)
+		return tpm2.HandleNull, nil, fmt.Errorf("unable to start session: %w", err)
+	}
+
+	auth := tpmAuthNone
+	if usePassword {
+		auth = tpmAuthPassword
+	}
+	policy, err = applyPolicy(dev, sessHandle, pcrs, algo, expectedDigest, auth, signed)
+	if err != nil {
+		_ = tpm2.FlushContext(dev, sessHandle)
+		return tpm2.HandleNull, nil, err
+	}
+	return sessHandle, policy, nil
+}
+
+// applyPolicy runs the policy commands in the session and checks that the resulting digest matches the expected one.
+// The policy is built in the same order as systemd does: PolicyAuthorize (if signed is not nil), PolicyPCR, PolicyAuthValue.
+func applyPolicy(dev io.ReadWriter, sessHandle tpmutil.Handle, pcrs []int, algo tpm2.Algorithm, expectedDigest []byte, auth tpmAuthPolicy, signed *tpmSignedPolicy) ([]byte, error) {
+	if err := validatePCRs(dev, pcrs); err != nil {
+		return nil, err
 	}
 
 	pcrSelection := tpm2.PCRSelection{
@@ -138,25 +603,97 @@ func policyPCRSession(dev io.ReadWriteCloser, pcrs []int, algo tpm2.Algorithm, e
 		PCRs: pcrs,
 	}
 
-	// An empty expected digest means that digest verification is skipped.
-	if err := tpm2.PolicyPCR(dev, sessHandle, nil, pcrSelection); err != nil {
-		return tpm2.HandleNull, nil, fmt.Errorf("unable to bind PCRs to auth policy: %v", err)
+	if signed != nil {
+		if err := signed.authorize(dev, sessHandle, algo); err != nil {
+			return nil, err
+		}
 	}
 
-	if usePassword {
+	// a policy signed with a public key might have no static PCRs
+	if signed == nil || len(pcrs) > 0 {
+		// An empty expected digest means that digest verification is skipped.
+		if err := tpm2.PolicyPCR(dev, sessHandle, nil, pcrSelection); err != nil {
+			return nil, fmt.Errorf("unable to bind PCRs to auth policy: %w", err)
+		}
+	}
+
+	// PolicyPassword and PolicyAuthValue result in the same policy digest
+	switch auth {
+	case tpmAuthPassword:
 		if err := tpm2.PolicyPassword(dev, sessHandle); err != nil {
-			return tpm2.HandleNull, nil, err
+			return nil, err
+		}
+	case tpmAuthHMAC:
+		if err := tpmPolicyAuthValue(dev, sessHandle); err != nil {
+			return nil, err
 		}
 	}
 
-	policy, err = tpm2.PolicyGetDigest(dev, sessHandle)
+	policy, err := tpm2.PolicyGetDigest(dev, sessHandle)
 	if err != nil {
-		return tpm2.HandleNull, nil, fmt.Errorf("unable to get policy digest: %v", err)
+		return nil, fmt.Errorf("unable to get policy digest: %w", err)
 	}
 
 	if !bytes.Equal(policy, expectedDigest) {
-		return tpm2.HandleNull, nil, fmt.Errorf("current policy digest does not match stored policy digest, cancelling TPM2 authentication attempt")
+		logPCRValues(dev, pcrSelection)
+		return nil, fmt.Errorf("%w: current policy digest %x does not match stored policy digest %x, cancelling TPM2 authentication attempt", errPCRPolicyMismatch, policy, expectedDigest)
 	}
 
-	return sessHandle, policy, nil
+	return policy, nil
+}
+
+// tpmCurrentPCRPolicyDigest computes PolicyPCR digest for the current values of the given PCRs.
+// It uses a trial session that authorizes nothing. The digest can be used to seal data against the current PCR state
+// or to find out why the stored policy does not match.
+func tpmCurrentPCRPolicyDigest(pcrs []int, bank tpm2.Algorithm) ([]byte, error) {
+	var digest []byte
+	err := withTPM(func(t *tpmConn) error {
+		var err error
+		digest, err = trialPCRPolicyDigest(t.dev, pcrs, bank, false)
+		return err
+	})
+	return digest, err
+}
+
+func trialPCRPolicyDigest(dev io.ReadWriter, pcrs []int, bank tpm2.Algorithm, usePassword bool) ([]byte, error) {
+	if err := validatePCRs(dev, pcrs); err != nil {
+		return nil, err
+	}
+
+	sessHandle, _, err := tpm2.StartAuthSession(
+		dev,
+		/*tpmkey=*/ tpm2.HandleNull,
+		/*bindkey=*/ tpm2.HandleNull,
+		/*nonceCaller=*/ make([]byte, 32),
+		/*encryptedSalt=*/ nil,
+		/*sessionType=*/ tpm2.SessionTrial,
+		/*symmetric=*/ tpm2.AlgNull,
+		/*authHash=*/ tpm2.AlgSHA256)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start trial session: %w", err)
+	}
+	defer tpm2.FlushContext(dev, sessHandle)
+
+	if err := tpm2.PolicyPCR(dev, sessHandle, nil, tpm2.PCRSelection{Hash: bank, PCRs: pcrs}); err != nil {
+		return nil, fmt.Errorf("unable to bind PCRs to auth policy: %w", err)
+	}
+	if usePassword {
+		if err := tpm2.PolicyPassword(dev, sessHandle); err != nil {
+			return nil, err
+		}
+	}
+
+	return tpm2.PolicyGetDigest(dev, sessHandle)
+}
+
+// logPCRValues prints current PCR values, it helps to debug a policy mismatch
+func logPCRValues(dev io.ReadWriter, sel tpm2.PCRSelection) {
+	values, err := tpm2.ReadPCRs(dev, sel)
+	if err != nil {
+		debug("unable to read PCR values: %v", err)
+		return
+	}
+	for _, pcr := range sel.PCRs {
+		debug("PCR %d (%v bank) = %x", pcr, sel.Hash, values[pcr])
+	}
 }
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	tpmdirect "github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystemdTPM2PinAuth(t *testing.T) {
+	check := func(pin, salt, expected string) {
+		require.Equal(t, expected, hex.EncodeToString(systemdTPM2PinAuth([]byte(pin), []byte(salt))))
+	}
+
+	check("foo654", "", "b45f7ebd746ed390f878184a49b08d17d4fbdeccc27e226675fd81c0a94aea21")
+	check("foo654", "0123456789abcdef", "b2e3255f4aaceb62a2dcddac914ab7ccaddf27a5d712fe458268642d5d87d18f")
+}
+
+func TestCheckTPMVendor(t *testing.T) {
+	defer func() { tpmVendors = nil }()
+
+	require.NoError(t, checkTPMVendor([]byte("IFX\x00")))
+
+	require.NoError(t, parseParams("booster.tpm_vendor=ifx,STM"))
+	require.Equal(t, []string{"ifx", "STM"}, tpmVendors)
+	require.NoError(t, checkTPMVendor([]byte("IFX\x00")))
+	require.NoError(t, checkTPMVendor([]byte("STM ")))
+	require.Error(t, checkTPMVendor([]byte("IBM\x00")))
+}
+
+func TestParsePCRList(t *testing.T) {
+	defer func() { tpmPCRs = nil }()
+
+	pcrs, err := parsePCRList("7,0, 2,4")
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 2, 4, 7}, pcrs)
+
+	require.NoError(t, parseParams("booster.tpm_pcrs=0,2,4,7"))
+	require.Equal(t, []int{0, 2, 4, 7}, tpmPCRs)
+
+	for _, v := range []string{"", "0,,7", "0,-1", "0,7,7", "pcr7"} {
+		_, err := parsePCRList(v)
+		require.Error(t, err, v)
+	}
+}
+
+func TestTPMRetry(t *testing.T) {
+	calls := 0
+	err := tpmRetry(func() error {
+		calls++
+		if calls < 3 {
+			return fmt.Errorf("unable to start session: %w", tpm2.Warning{Code: tpm2.RCRetry})
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+
+	// permanent errors are not retried
+	calls = 0
+	err = tpmRetry(func() error {
+		calls++
+		return fmt.Errorf("unable to unseal data: %w", tpm2.Warning{Code: tpm2.RCLockout})
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, calls)
+
+	calls = 0
+	err = tpmRetry(func() error {
+		calls++
+		return errPCRPolicyMismatch
+	})
+	require.ErrorIs(t, err, errPCRPolicyMismatch)
+	require.Equal(t, 1, calls)
+}
+
+func TestUnsealWithTPMPin(t *testing.T) {
+	defer func() { passwordTries = 0 }()
+
+	readPin := func() ([]byte, error) { return []byte("1234"), nil }
+	var unsealed int
+	wrongPin := func(pin []byte) ([]byte, error) {
+		unsealed++
+		return nil, fmt.Errorf("unable to unseal data: %w", tpm2.SessionError{Code: tpm2.RCAuthFail})
+	}
+
+	// the TPM sees at most pinTries wrong pins by default
+	_, err := unsealWithTPMPin(&passwordAttempts{name: "TPM pin", pin: true}, readPin, wrongPin)
+	require.EqualError(t, err, "TPM pin: giving up after 3 failed attempts")
+	require.Equal(t, pinTries, unsealed)
+
+	passwordTries = 5
+	unsealed = 0
+	_, err = unsealWithTPMPin(&passwordAttempts{name: "TPM pin", pin: true}, readPin, wrongPin)
+	require.Error(t, err)
+	require.Equal(t, 5, unsealed)
+
+	// lockout stops the prompt right away
+	unsealed = 0
+	_, err = unsealWithTPMPin(&passwordAttempts{name: "TPM pin", pin: true}, readPin, func(pin []byte) ([]byte, error) {
+		unsealed++
+		return nil, fmt.Errorf("unable to unseal data: %w", tpm2.Warning{Code: tpm2.RCLockout})
+	})
+	require.True(t, isTPMLockout(err))
+	require.Equal(t, 1, unsealed)
+
+	unsealed = 0
+	password, err := unsealWithTPMPin(&passwordAttempts{name: "TPM pin", pin: true}, readPin, func(pin []byte) ([]byte, error) {
+		unsealed++
+		if unsealed < 2 {
+			return wrongPin(pin)
+		}
+		require.Equal(t, "1234", string(pin))
+		return []byte("secret"), nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "secret", string(password))
+}
+
+func TestTPMErrorCodes(t *testing.T) {
+	err := fmt.Errorf("unable to unseal data: %w", tpm2.Warning{Code: tpm2.RCLockout})
+	require.True(t, isTPMLockout(err))
+	require.False(t, isTPMAuthFailure(err))
+
+	err = fmt.Errorf("unable to unseal data: %w", tpm2.SessionError{Code: tpm2.RCAuthFail})
+	require.True(t, isTPMAuthFailure(err))
+	require.False(t, isTPMLockout(err))
+	require.False(t, isTPMTransientError(err))
+
+	err = fmt.Errorf("TPM is not initialized: %w", tpm2.Error{Code: tpm2.RCInitialize})
+	require.True(t, isTPMNotInitialized(err))
+
+	// errors returned by go-tpm direct API, e.g. auth failure of session #1
+	require.True(t, isTPMAuthFailure(tpmDirectError(fmt.Errorf("unseal: %w", tpmdirect.TPMRCAuthFail+0x900))))
+	require.True(t, isTPMLockout(tpmDirectError(tpmdirect.TPMRCLockout)))
+	require.True(t, isTPMTransientError(tpmDirectError(tpmdirect.TPMRCRetry)))
+	require.True(t, isTPMNotInitialized(tpmDirectError(tpmdirect.TPMRCInitialize)))
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC1}, tpmDirectError(tpmdirect.TPMRCValue+0x140))
+	require.True(t, isTPMTransientError(err))
+}
+
+func TestParseTPM2TokenTruncatedBlob(t *testing.T) {
+	token := func(blob string) []byte {
+		return []byte(`{"type":"systemd-tpm2","tpm2-blob":"` + blob + `","tpm2-pcrs":[7],"tpm2-pcr-bank":"sha256","tpm2-policy-hash":"00ff"}`)
+	}
+
+	// 2-byte private area ab00 followed by 2-byte public area cdef
+	tok, err := parseTPM2Token(token("AAKrAAACze8="))
+	require.NoError(t, err)
+	require.Equal(t, []byte{0xab, 0x00}, tok.private)
+	require.Equal(t, []byte{0xcd, 0xef}, tok.public)
+
+	for _, blob := range []string{"", "AA==", "AAKr", "AAKrAAACzQ==", "AAAAAs3v"} {
+		_, err := parseTPM2Token(token(blob))
+		require.Error(t, err, blob)
+	}
+}
+
+func TestChangedPCRs(t *testing.T) {
+	sealed := map[int][]byte{0: {0x01}, 4: {0x02}, 7: {0x03}}
+	encoded := encodePCRValues(sealed)
+	require.Equal(t, map[string]string{"0": "01", "4": "02", "7": "03"}, encoded)
+	decoded, err := decodePCRValues(encoded)
+	require.NoError(t, err)
+	require.Equal(t, sealed, decoded)
+
+	require.Empty(t, changedPCRs(sealed, map[int][]byte{0: {0x01}, 4: {0x02}, 7: {0x03}}))
+	require.Equal(t, []int{4, 7}, changedPCRs(sealed, map[int][]byte{0: {0x01}, 4: {0x12}, 7: {0x13}}))
+
+	_, err = decodePCRValues(map[string]string{"seven": "00"})
+	require.Error(t, err)
+	_, err = decodePCRValues(map[string]string{"7": "xyz"})
+	require.Error(t, err)
+
+	tok, err := parseTPM2Token([]byte(`{"type":"booster-tpm2","tpm2-blob":"AAKrAAACze8=","tpm2-pcrs":[7],"tpm2-pcr-bank":"sha256","tpm2-policy-hash":"00ff","tpm2-pcr-values":{"7":"aabb"}}`))
+	require.NoError(t, err)
+	require.Equal(t, map[int][]byte{7: {0xaa, 0xbb}}, tok.pcrValues)
+}
+
+func TestPCRPolicySecureBootChanged(t *testing.T) {
+	require.False(t, (&pcrPolicy{pcrs: []int{0, 2}, changed: []int{0}}).secureBootPolicyChanged())
+	require.False(t, (&pcrPolicy{pcrs: []int{0, 7}, changed: []int{0}}).secureBootPolicyChanged())
+	require.True(t, (&pcrPolicy{pcrs: []int{0, 7}, changed: []int{0, 7}}).secureBootPolicyChanged())
+	// the token does not store the sealed values, PCR 7 cannot be verified
+	require.True(t, (&pcrPolicy{pcrs: []int{7}}).secureBootPolicyChanged())
+	require.False(t, (&pcrPolicy{pcrs: []int{4}}).secureBootPolicyChanged())
+}
+
+func TestTPMSignedPolicy(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	pubkey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	tok, err := parseTPM2Token([]byte(`{"type":"systemd-tpm2","tpm2-blob":"AAKrAAACze8=","tpm2-pcrs":[],"tpm2-pcr-bank":"sha256","tpm2-policy-hash":"00ff",` +
+		`"tpm2_pubkey":"` + base64.StdEncoding.EncodeToString(pubkey) + `","tpm2_pubkey_pcrs":[11]}`))
+	require.NoError(t, err)
+	require.Equal(t, &tpmSignedPolicy{pubkey: pubkey, pcrs: []int{11}}, tok.signed)
+
+	parsed, parsedDer, err := parseRSAPublicKey(tok.signed.pubkey)
+	require.NoError(t, err)
+	require.Equal(t, der, parsedDer)
+	pub := tpmPublicKeyTemplate(parsed)
+	require.Equal(t, uint32(0), pub.RSAParameters.ExponentRaw)
+	require.Equal(t, uint16(2048), pub.RSAParameters.KeyBits)
+	require.Equal(t, key.N.Bytes(), []byte(pub.RSAParameters.ModulusRaw))
+
+	fp := sha256.Sum256(der)
+	policy := []byte{0x01, 0x02}
+	signatures := `{"sha256":[` +
+		`{"pcrs":[11],"pkfp":"` + hex.EncodeToString(fp[:]) + `","pol":"0a0b","sig":"AAAA"},` +
+		`{"pcrs":[11],"pkfp":"` + hex.EncodeToString(fp[:]) + `","pol":"0102","sig":"AQID"}]}`
+	sig, err := findPCRSignature([]byte(signatures), tpm2.AlgSHA256, []int{11}, fp[:], policy)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, sig)
+
+	_, err = findPCRSignature([]byte(signatures), tpm2.AlgSHA256, []int{7, 11}, fp[:], policy)
+	require.ErrorIs(t, err, errPCRPolicyMismatch)
+	_, err = findPCRSignature([]byte(signatures), tpm2.AlgSHA1, []int{11}, fp[:], policy)
+	require.ErrorIs(t, err, errPCRPolicyMismatch)
+	_, err = findPCRSignature([]byte(signatures), tpm2.AlgSHA256, []int{11}, []byte{0xff}, policy)
+	require.ErrorIs(t, err, errPCRPolicyMismatch)
+}
+
+func TestTPM2TokenPrimaryKey(t *testing.T) {
+	token := func(fields string) []byte {
+		return []byte(`{"type":"systemd-tpm2","tpm2-blob":"AAKrAAACze8=","tpm2-pcrs":[7],"tpm2-pcr-bank":"sha256","tpm2-policy-hash":"00ff"` + fields + `}`)
+	}
+
+	tok, err := parseTPM2Token(token(``))
+	require.NoError(t, err)
+	require.Equal(t, tpm2.AlgECC, tok.primaryAlg)
+	require.Nil(t, tok.srk)
+
+	tok, err = parseTPM2Token(token(`,"tpm2-primary-alg":"rsa"`))
+	require.NoError(t, err)
+	require.Equal(t, tpm2.AlgRSA, tok.primaryAlg)
+	tmpl, err := srkTemplate(tok.primaryAlg)
+	require.NoError(t, err)
+	require.Equal(t, defaultRSAParams, tmpl.RSAParameters)
+	require.Nil(t, tmpl.ECCParameters)
+
+	_, err = parseTPM2Token(token(`,"tpm2-primary-alg":"dsa"`))
+	require.Error(t, err)
+
+	// handle 0x81000001, 34-byte name (sha256 name alg + digest) followed by the resource data
+	name := append([]byte{0x00, 0x0b}, make([]byte, 32)...)
+	blob := append([]byte{0x81, 0x00, 0x00, 0x01, 0x00, 0x22}, name...)
+	blob = append(blob, 0x00, 0x00, 0x00, 0x01)
+	tok, err = parseTPM2Token(token(`,"tpm2_srk":"` + base64.StdEncoding.EncodeToString(blob) + `"`))
+	require.NoError(t, err)
+	require.Equal(t, &tpmPersistentKey{handle: 0x81000001, name: name}, tok.srk)
+
+	// a transient handle cannot be stored in the token
+	blob[0] = 0x80
+	_, err = parseTPM2Token(token(`,"tpm2_srk":"` + base64.StdEncoding.EncodeToString(blob) + `"`))
+	require.Error(t, err)
+}
+
+func TestTPMLockoutError(t *testing.T) {
+	state := &tpmLockoutState{inLockout: true, failures: 32, maxFailures: 32, interval: 10 * time.Minute, recovery: 24 * time.Hour}
+	require.Equal(t, "32 of 32 failed authorization attempts, the next attempt is allowed in up to 10m0s", state.String())
+
+	err := fmt.Errorf("unable to unseal data: %w", tpm2.Warning{Code: tpm2.RCLockout})
+	lockoutErr := &tpmLockoutError{err: err, state: state}
+	require.True(t, isTPMLockout(lockoutErr))
+	require.Contains(t, lockoutErr.Error(), "32 of 32 failed authorization attempts")
+
+	// without the lockout interval the TPM never forgets failures
+	state.interval = 0
+	require.Equal(t, "32 of 32 failed authorization attempts, the lockout can be reset only with the TPM lockout password", state.String())
+}
+
+func TestParseSystemdTPM2Token(t *testing.T) {
+	// token payload in the format written by systemd-cryptenroll --tpm2-device=auto --tpm2-with-pin=yes
+	payload := `{"type":"systemd-tpm2","keyslots":["1"],"tpm2-blob":"AAKrAAACze8=","tpm2-pcrs":[7],"tpm2-pcr-bank":"sha384",` +
+		`"tpm2-primary-alg":"ecc","tpm2-policy-hash":"7e8e7ee1","tpm2-pin":true,"tpm2_salt":"c2FsdA=="}`
+	tok, err := parseTPM2Token([]byte(payload))
+	require.NoError(t, err)
+	require.Equal(t, []int{7}, tok.pcrs)
+	require.Equal(t, tpm2.AlgSHA384, tok.bank)
+	require.Equal(t, []byte{0x7e, 0x8e, 0x7e, 0xe1}, tok.policyHash)
+	require.True(t, tok.pin)
+	require.Equal(t, []byte("salt"), tok.salt)
+	require.Equal(t, "sha384", pcrBankName(tok.bank))
+
+	for _, invalid := range []string{
+		`{"tpm2-blob":"AAKrAAACze8=","tpm2-pcrs":[7],"tpm2-pcr-bank":"sm3_256","tpm2-policy-hash":"00ff"}`,
+		`{"tpm2-blob":"AAKrAAACze8=","tpm2-pcrs":[-1],"tpm2-policy-hash":"00ff"}`,
+		`{"tpm2-blob":"AAKrAAACze8=","tpm2-pcrs":[7],"tpm2-policy-hash":""}`,
+		`{"tpm2-blob":"AAKrAAACze8=","tpm2-pcrs":[],"tpm2-policy-hash":"00ff","tpm2_pcrlock":true}`,
+	} {
+		_, err := parseTPM2Token([]byte(invalid))
+		require.Error(t, err, invalid)
+	}
+}
+
+// startSwtpm starts swtpm emulator at the port booster.tpm_emulator connects to and makes withTPM use it
+func startSwtpm(t *testing.T) {
+	if _, err := exec.LookPath("swtpm"); err != nil {
+		t.Skip("test requires swtpm")
+	}
+
+	cmd := exec.Command("swtpm", "socket", "--tpm2", "--tpmstate", "dir="+t.TempDir(),
+		"--server", "type=tcp,port=2321", "--ctrl", "type=tcp,port=2322", "--flags", "not-need-init,startup-clear")
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		if tpmShared != nil {
+			_ = tpmShared.dev.Close()
+			tpmShared = nil
+		}
+		enableSwEmulator = false
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", ":2322")
+		if err == nil {
+			_ = conn.Close()
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "swtpm has not started: %v", err)
+		time.Sleep(50 * time.Millisecond)
+	}
+	enableSwEmulator = true
+}
+
+func TestTPMQuoteNonceSize(t *testing.T) {
+	_, _, err := tpmQuote([]int{7}, tpm2.AlgSHA256, make([]byte, tpmMaxQuoteNonceSize+1), tpm2.HandleNull)
+	require.Error(t, err)
+}
+
+func TestTPMQuote(t *testing.T) {
+	startSwtpm(t)
+
+	akTemplate := tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSignerDefault,
+		RSAParameters: &tpm2.RSAParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256},
+			KeyBits: 2048,
+		},
+	}
+	var ak tpmutil.Handle
+	var akPub crypto.PublicKey
+	require.NoError(t, withTPM(func(c *tpmConn) error {
+		var err error
+		ak, akPub, err = tpm2.CreatePrimary(c.dev, tpm2.HandleEndorsement, tpm2.PCRSelection{}, "", "", akTemplate)
+		return err
+	}))
+
+	pcrs := []int{0, 7}
+	nonce := []byte("remote verifier nonce")
+	attest, signature, err := tpmQuote(pcrs, tpm2.AlgSHA256, nonce, ak)
+	require.NoError(t, err)
+
+	data, err := tpm2.DecodeAttestationData(attest)
+	require.NoError(t, err)
+	require.Equal(t, tpm2.TagAttestQuote, data.Type)
+	require.Equal(t, nonce, []byte(data.ExtraData))
+	require.NotNil(t, data.AttestedQuoteInfo)
+	require.Equal(t, tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: pcrs}, data.AttestedQuoteInfo.PCRSelection)
+
+	values, err := tpmReadPCRValues(pcrs, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	h := sha256.New()
+	for _, pcr := range pcrs {
+		h.Write(values[pcr])
+	}
+	require.Equal(t, h.Sum(nil), []byte(data.AttestedQuoteInfo.PCRDigest))
+
+	sig, err := tpm2.DecodeSignature(bytes.NewBuffer(signature))
+	require.NoError(t, err)
+	require.Equal(t, tpm2.AlgRSASSA, sig.Alg)
+	require.NotNil(t, sig.RSA)
+	digest := sha256.Sum256(attest)
+	require.NoError(t, rsa.VerifyPKCS1v15(akPub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig.RSA.Signature))
+
+	// the signature does not match the quote with a different nonce
+	attest2, _, err := tpmQuote(pcrs, tpm2.AlgSHA256, []byte("another nonce"), ak)
+	require.NoError(t, err)
+	digest = sha256.Sum256(attest2)
+	require.Error(t, rsa.VerifyPKCS1v15(akPub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig.RSA.Signature))
+}
+
+func TestTPMCurrentPCRPolicyDigest(t *testing.T) {
+	startSwtpm(t)
+
+	pcrs := []int{0, 7}
+	values, err := tpmReadPCRValues(pcrs, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	digest, err := tpmCurrentPCRPolicyDigest(pcrs, tpm2.AlgSHA256)
+	require.NoError(t, err)
+
+	h := sha256.New()
+	for _, pcr := range pcrs {
+		h.Write(values[pcr])
+	}
+	calc, err := tpmdirect.NewPolicyCalculator(tpmdirect.TPMAlgSHA256)
+	require.NoError(t, err)
+	policy := tpmdirect.PolicyPCR{
+		PcrDigest: tpmdirect.TPM2BDigest{Buffer: h.Sum(nil)},
+		Pcrs: tpmdirect.TPMLPCRSelection{PCRSelections: []tpmdirect.TPMSPCRSelection{{
+			Hash:      tpmdirect.TPMAlgSHA256,
+			PCRSelect: []byte{0x81, 0x00, 0x00}, // PCRs 0 and 7
+		}}},
+	}
+	require.NoError(t, policy.Update(calc))
+	require.Equal(t, calc.Hash().Digest, digest)
+
+	// extending a PCR changes the policy
+	require.NoError(t, withTPM(func(c *tpmConn) error {
+		return tpm2.PCRExtend(c.dev, tpmutil.Handle(7), tpm2.AlgSHA256, make([]byte, sha256.Size), "")
+	}))
+	changed, err := tpmCurrentPCRPolicyDigest(pcrs, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	require.NotEqual(t, digest, changed)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+)
+
+// tpmLockoutWait is how long booster waits for the TPM to leave dictionary attack lockout mode before giving up
+// on TPM2 tokens, booster.tpm_lockout_wait=. By default booster does not wait.
+var tpmLockoutWait time.Duration
+
+// tpmLockoutPollInterval is how often booster re-checks the lockout state while waiting
+const tpmLockoutPollInterval = 10 * time.Second
+
+// tpmLockoutState is the dictionary attack protection state reported by TPM2_GetCapability
+type tpmLockoutState struct {
+	inLockout   bool
+	failures    uint32        // TPM_PT_LOCKOUT_COUNTER
+	maxFailures uint32        // TPM_PT_MAX_AUTH_FAIL
+	interval    time.Duration // TPM_PT_LOCKOUT_INTERVAL, time to forget one failed attempt
+	recovery    time.Duration // TPM_PT_LOCKOUT_RECOVERY, lockout of the lockout hierarchy
+}
+
+// tpmAttrInLockout is inLockout bit of TPMA_PERMANENT
+const tpmAttrInLockout = 1 << 9
+
+func readTPMLockoutState(dev io.ReadWriter) (*tpmLockoutState, error) {
+	vals, _, err := tpm2.GetCapability(dev, tpm2.CapabilityTPMProperties, uint32(tpm2.LockoutRecovery-tpm2.TPMAPermanent+1), uint32(tpm2.TPMAPermanent))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read TPM properties: %w", err)
+	}
+
+	var s tpmLockoutState
+	for _, v := range vals {
+		prop, ok := v.(tpm2.TaggedProperty)
+		if !ok {
+			continue
+		}
+		switch prop.Tag {
+		case tpm2.TPMAPermanent:
+			s.inLockout = prop.Value&tpmAttrInLockout != 0
+		case tpm2.LockoutCounter:
+			s.failures = prop.Value
+		case tpm2.MaxAuthFail:
+			s.maxFailures = prop.Value
+		case tpm2.LockoutInterval:
+			s.interval = time.Duration(prop.Value) * time.Second
+		case tpm2.LockoutRecovery:
+			s.recovery = time.Duration(prop.Value) * time.Second
+		}
+	}
+	return &s, nil
+}
+
+func tpmLockoutStatus() (*tpmLockoutState, error) {
+	var s *tpmLockoutState
+	err := withTPM(func(t *tpmConn) error {
+		var err error
+		s, err = readTPMLockoutState(t.dev)
+		return err
+	})
+	return s, err
+}
+
+func (s *tpmLockoutState) String() string {
+	msg := fmt.Sprintf("%d of %d failed authorization attempts", s.failures, s.maxFailures)
+	if s.interval == 0 {
+		return msg + ", the lockout can be reset only with the TPM lockout password"
+	}
+	// the TPM does not report when the last failure happened, one failure is forgotten every interval
+	return msg + fmt.Sprintf(", the next attempt is allowed in up to %v", s.interval)
+}
+
+// tpmLockoutError is a TPM lockout error together with the TPM dictionary attack state
+type tpmLockoutError struct {
+	err   error
+	state *tpmLockoutState
+}
+
+func (e *tpmLockoutError) Error() string {
+	return fmt.Sprintf("TPM is in dictionary attack lockout mode (%v): %v", e.state, e.err)
+}
+
+func (e *tpmLockoutError) Unwrap() error {
+	return e.err
+}
+
+// tpmAwaitLockout handles TPM_RC_LOCKOUT returned by an operation. It returns nil if the TPM has left lockout mode
+// and the operation should be retried, otherwise an error that describes the lockout state.
+func tpmAwaitLockout(err error, waitStart time.Time) error {
+	state, stateErr := tpmLockoutStatus()
+	if stateErr != nil {
+		debug("%v", stateErr)
+		return err
+	}
+	lockoutErr := &tpmLockoutError{err: err, state: state}
+	if state.interval == 0 || time.Since(waitStart) >= tpmLockoutWait {
+		return lockoutErr
+	}
+
+	console("TPM is in dictionary attack lockout mode (%v), waiting for it to recover\n", state)
+	for time.Since(waitStart) < tpmLockoutWait {
+		time.Sleep(tpmLockoutPollInterval)
+		state, stateErr = tpmLockoutStatus()
+		if stateErr != nil {
+			return err
+		}
+		if !state.inLockout {
+			info("TPM has left dictionary attack lockout mode, retrying")
+			return nil
+		}
+		lockoutErr.state = state
+	}
+	return lockoutErr
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	tpmdirect "github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// The TPM is connected via SPI/LPC/I2C bus that can be sniffed by an attacker with physical access to the machine.
+// To keep the unsealed secret off the bus booster unseals it with a policy session salted with the SRK. Only the TPM
+// can decrypt the salt, the session key derived from it encrypts the unsealed data (AES-CFB response parameter
+// encryption). The pin is not sent in clear either: the policy uses PolicyAuthValue instead of PolicyPassword
+// (both result in the same policy digest) and the pin becomes a part of the session HMAC key.
+// go-tpm legacy API does not support encrypted sessions so the session and the unseal command use go-tpm direct API.
+
+// tpmParamEncryption is disabled with booster.tpm_unencrypted_sessions for TPMs that have problems with salted sessions
+var tpmParamEncryption = true
+
+const cmdPolicyAuthValue tpmutil.Command = 0x0000016B
+
+// tpmPolicyAuthValue runs TPM2_PolicyAuthValue that is missing in go-tpm legacy API
+func tpmPolicyAuthValue(dev io.ReadWriter, session tpmutil.Handle) error {
+	_, code, err := tpmutil.RunCommand(dev, tpm2.TagNoSessions, cmdPolicyAuthValue, session)
+	if err != nil {
+		return err
+	}
+	if code != tpmutil.RCSuccess {
+		return fmt.Errorf("TPM2_PolicyAuthValue failed: %w", tpmDirectError(tpmdirect.TPMRC(code)))
+	}
+	return nil
+}
+
+// unsealEncrypted unseals the loaded object using a salted policy session with response parameter encryption
+func (t *tpmConn) unsealEncrypted(tok *tpm2Token, parent, object tpmutil.Handle, objectName, password []byte) ([]byte, error) {
+	tp := transport.FromReadWriter(t.dev)
+
+	parentPublic, err := tpmdirect.ReadPublic{ObjectHandle: tpmdirect.TPMHandle(parent)}.Execute(tp)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read SRK public area: %w", tpmDirectError(err))
+	}
+	saltKey, err := parentPublic.OutPublic.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse SRK public area: %v", err)
+	}
+
+	opts := []tpmdirect.AuthOption{
+		tpmdirect.Salted(tpmdirect.TPMHandle(parent), *saltKey),
+		tpmdirect.AESEncryption(128, tpmdirect.EncryptOut),
+	}
+	auth := tpmAuthNone
+	if password != nil {
+		opts = append(opts, tpmdirect.Auth(password))
+		auth = tpmAuthHMAC
+	}
+	sess, closeSession, err := tpmdirect.PolicySession(tp, tpmdirect.TPMAlgSHA256, 16, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start salted session: %w", tpmDirectError(err))
+	}
+	defer closeSession()
+
+	if _, err := applyPolicy(t.dev, tpmutil.Handle(sess.Handle()), tok.pcrs, tok.bank, tok.policyHash, auth, tok.signed); err != nil {
+		return nil, err
+	}
+
+	resp, err := tpmdirect.Unseal{
+		ItemHandle: tpmdirect.AuthHandle{
+			Handle: tpmdirect.TPMHandle(object),
+			Name:   tpmdirect.TPM2BName{Buffer: objectName},
+			Auth:   sess,
+		},
+	}.Execute(tp)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unseal data: %w", tpmDirectError(err))
+	}
+	return resp.OutData.Buffer, nil
+}
+
+// tpmDirectError converts go-tpm direct API response codes to go-tpm legacy errors so the code that checks TPM errors
+// (e.g. isTPMAuthFailure, isTPMLockout or isTPMTransientError) handles both APIs the same way
+func tpmDirectError(err error) error {
+	var rc tpmdirect.TPMRC
+	if !errors.As(err, &rc) {
+		return err
+	}
+
+	code := uint32(rc)
+	switch {
+	case code&0x180 == 0: // TPM 1.2 response code
+		return err
+	case code&0x80 == 0 && code&0x400 != 0:
+		return tpm2.VendorError{Code: code}
+	case code&0x80 == 0 && code&0x800 != 0:
+		return tpm2.Warning{Code: tpm2.RCWarn(code & 0x7f)}
+	case code&0x80 == 0:
+		return tpm2.Error{Code: tpm2.RCFmt0(code & 0x7f)}
+	case code&0x40 != 0:
+		return tpm2.ParameterError{Code: tpm2.RCFmt1(code & 0x3f), Parameter: tpm2.RCIndex((code & 0xf00) >> 8)}
+	case code&0x800 == 0:
+		return tpm2.HandleError{Code: tpm2.RCFmt1(code & 0x3f), Handle: tpm2.RCIndex((code & 0x700) >> 8)}
+	default:
+		return tpm2.SessionError{Code: tpm2.RCFmt1(code & 0x3f), Session: tpm2.RCIndex((code & 0x700) >> 8)}
+	}
+}
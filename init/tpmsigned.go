@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// A secret sealed with systemd-cryptenroll --tpm2-public-key is bound to a public key rather than to fixed PCR values.
+// Its policy is PolicyAuthorize(key) and it is unsealed with any PCR policy signed by the matching private key
+// (e.g. by systemd-measure or ukify when a kernel is built). The signatures are provided at boot as a JSON file:
+//
+//	{"sha256": [{"pcrs": [11], "pkfp": "<public key fingerprint>", "pol": "<policy digest>", "sig": "<signature>"}]}
+
+// tpmPCRSignaturePath is the file with signed PCR policies, booster.tpm2_signature=
+var tpmPCRSignaturePath = "/.extra/tpm2-pcr-signature.json"
+
+const cmdPolicyAuthorize tpmutil.Command = 0x0000016A
+const cmdVerifySignature tpmutil.Command = 0x00000177
+
+// tpmSignedPolicy describes a PolicyAuthorize policy
+type tpmSignedPolicy struct {
+	pubkey []byte // PEM encoded public key
+	pcrs   []int  // PCRs covered by the signed policy
+}
+
+type tpmPCRSignature struct {
+	PCRs        []int  `json:"pcrs"`
+	Fingerprint string `json:"pkfp"` // hex
+	Policy      string `json:"pol"`  // hex
+	Signature   string `json:"sig"`  // base64
+}
+
+func parseRSAPublicKey(data []byte) (*rsa.PublicKey, []byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, fmt.Errorf("public key is not PEM encoded")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported public key type %T, only RSA keys are supported", key)
+	}
+	return rsaKey, block.Bytes, nil
+}
+
+// tpmPublicKeyTemplate converts the public key into TPM public area. The area is the same as systemd uses as
+// the key name is a part of the PolicyAuthorize digest.
+func tpmPublicKeyTemplate(key *rsa.PublicKey) tpm2.Public {
+	exponent := uint32(key.E)
+	if exponent == 0x10001 {
+		exponent = 0 // zero means the default exponent
+	}
+	return tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagDecrypt | tpm2.FlagSign | tpm2.FlagUserWithAuth,
+		RSAParameters: &tpm2.RSAParams{
+			KeyBits:     uint16(key.Size() * 8),
+			ExponentRaw: exponent,
+			ModulusRaw:  key.N.FillBytes(make([]byte, key.Size())),
+		},
+	}
+}
+
+// findPCRSignature looks for the signature of the policy in the signature file content
+func findPCRSignature(data []byte, bank tpm2.Algorithm, pcrs []int, fingerprint, policy []byte) ([]byte, error) {
+	bankName := pcrBankName(bank)
+	var banks map[string][]tpmPCRSignature
+	if err := json.Unmarshal(data, &banks); err != nil {
+		return nil, err
+	}
+
+	wantPCRs := append([]int(nil), pcrs...)
+	sort.Ints(wantPCRs)
+	for _, s := range banks[bankName] {
+		sigPCRs := append([]int(nil), s.PCRs...)
+		sort.Ints(sigPCRs)
+		if fmt.Sprint(sigPCRs) != fmt.Sprint(wantPCRs) {
+			continue
+		}
+		if s.Fingerprint != "" {
+			fp, err := hex.DecodeString(s.Fingerprint)
+			if err != nil || !bytes.Equal(fp, fingerprint) {
+				continue
+			}
+		}
+		pol, err := hex.DecodeString(s.Policy)
+		if err != nil || !bytes.Equal(pol, policy) {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(s.Signature)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature encoding: %v", err)
+		}
+		return sig, nil
+	}
+	return nil, fmt.Errorf("%w: no signature for %s PCRs %v policy %x", errPCRPolicyMismatch, bankName, pcrs, policy)
+}
+
+// tpmVerifySignature runs TPM2_VerifySignature that is missing in go-tpm legacy API. It returns the ticket proving
+// that the TPM checked the RSASSA-SHA256 signature of the digest.
+func tpmVerifySignature(dev io.ReadWriter, key tpmutil.Handle, digest, signature []byte) (*tpm2.Ticket, error) {
+	resp, code, err := tpmutil.RunCommand(dev, tpm2.TagNoSessions, cmdVerifySignature,
+		key, tpmutil.U16Bytes(digest), tpm2.AlgRSASSA, tpm2.AlgSHA256, tpmutil.U16Bytes(signature))
+	if err != nil {
+		return nil, err
+	}
+	if code != tpmutil.RCSuccess {
+		return nil, fmt.Errorf("TPM2_VerifySignature failed with response code 0x%x", code)
+	}
+	var ticket tpm2.Ticket
+	if _, err := tpmutil.Unpack(resp, &ticket.Type, &ticket.Hierarchy, &ticket.Digest); err != nil {
+		return nil, err
+	}
+	return &ticket, nil
+}
+
+// tpmPolicyAuthorize runs TPM2_PolicyAuthorize that is missing in go-tpm legacy API
+func tpmPolicyAuthorize(dev io.ReadWriter, session tpmutil.Handle, approvedPolicy, keyName []byte, ticket *tpm2.Ticket) error {
+	_, code, err := tpmutil.RunCommand(dev, tpm2.TagNoSessions, cmdPolicyAuthorize,
+		session, tpmutil.U16Bytes(approvedPolicy), tpmutil.U16Bytes(nil), tpmutil.U16Bytes(keyName),
+		ticket.Type, ticket.Hierarchy, ticket.Digest)
+	if err != nil {
+		return err
+	}
+	if code != tpmutil.RCSuccess {
+		return fmt.Errorf("TPM2_PolicyAuthorize failed with response code 0x%x", code)
+	}
+	return nil
+}
+
+// authorize extends the policy session with the PCR policy signed by the public key
+func (p *tpmSignedPolicy) authorize(dev io.ReadWriter, session tpmutil.Handle, bank tpm2.Algorithm) error {
+	if err := validatePCRs(dev, p.pcrs); err != nil {
+		return err
+	}
+	key, der, err := parseRSAPublicKey(p.pubkey)
+	if err != nil {
+		return fmt.Errorf("tpm2 public key: %v", err)
+	}
+
+	sel := tpm2.PCRSelection{Hash: bank, PCRs: p.pcrs}
+	if err := tpm2.PolicyPCR(dev, session, nil, sel); err != nil {
+		return fmt.Errorf("unable to bind PCRs to auth policy: %w", err)
+	}
+	approvedPolicy, err := tpm2.PolicyGetDigest(dev, session)
+	if err != nil {
+		return fmt.Errorf("unable to get policy digest: %w", err)
+	}
+
+	data, err := os.ReadFile(tpmPCRSignaturePath)
+	if err != nil {
+		return fmt.Errorf("unable to read PCR signature file: %w", err)
+	}
+	fingerprint := sha256.Sum256(der)
+	signature, err := findPCRSignature(data, bank, p.pcrs, fingerprint[:], approvedPolicy)
+	if err != nil {
+		logPCRValues(dev, sel)
+		return err
+	}
+	if len(signature) != key.Size() {
+		return fmt.Errorf("signature of policy %x does not match the public key size", approvedPolicy)
+	}
+
+	keyHandle, keyName, err := tpm2.LoadExternal(dev, tpmPublicKeyTemplate(key), tpm2.Private{Type: tpm2.AlgNull}, tpm2.HandleOwner)
+	if err != nil {
+		return fmt.Errorf("unable to load the public key: %w", err)
+	}
+	defer tpm2.FlushContext(dev, keyHandle)
+
+	// the signed digest is H(approvedPolicy || policyRef) with an empty policyRef
+	digest := sha256.Sum256(approvedPolicy)
+	ticket, err := tpmVerifySignature(dev, keyHandle, digest[:], signature)
+	if err != nil {
+		return fmt.Errorf("%w: signature of policy %x: %v", errPCRPolicyMismatch, approvedPolicy, err)
+	}
+	measure("tpm2 public key", p.pubkey)
+	return tpmPolicyAuthorize(dev, session, approvedPolicy, keyName, ticket)
+}
@@ -148,12 +148,38 @@ func handleNetworkUevent(ev netlink.UEvent) error {
 	if ifname == "lo" {
 		return nil
 	}
+	if isWireGuardInterface(ifname) {
+		// the tunnel is configured by setupWireGuard()
+		return nil
+	}
 
 	if config.Network == nil {
 		info("network is disabled, skipping interface %s", ifname)
 		return nil
 	}
 
+	if err := setupVlans(ifname); err != nil {
+		return err
+	}
+	if isVlanParent(ifname) && !stringListContains(ifname, config.Network.InterfaceNames) {
+		// the interface carries tagged traffic only, the addresses are configured at its VLAN interfaces
+		return nil
+	}
+	if err := setupBonds(ifname); err != nil {
+		return err
+	}
+	if isBondSlave(ifname) {
+		// addresses are configured at the bond interface
+		return nil
+	}
+	if err := setupBridges(ifname); err != nil {
+		return err
+	}
+	if isBridgePort(ifname) {
+		// addresses are configured at the bridge interface
+		return nil
+	}
+
 	return initializeNetworkInterface(ifname)
 }
 
@@ -172,12 +198,20 @@ func handleBlockDeviceUevent(ev netlink.UEvent) error {
 		return handleMapperDeviceUevent(ev)
 	}
 
+	devPath := "/dev/" + devName
+
+	if ev.Action == "remove" {
+		// a removable device (e.g. a USB stick with a keyfile) might be plugged in again
+		forgetBlockDevice(devPath)
+		return nil
+	}
+	if ev.Action == "change" && strings.HasPrefix(devName, "md") && config.EnableMdraid {
+		return handleMdContainerVolumeUevent(devName)
+	}
 	if ev.Action != "add" {
 		return nil
 	}
 
-	devPath := "/dev/" + devName
-
 	isPartition := ev.Env["DEVTYPE"] == "partition"
 	if isPartition {
 		// if this device represents a partition inside a table (like GPT) then wait till the table is processed
@@ -224,9 +258,8 @@ func handleMapperDeviceUevent(ev netlink.UEvent) error {
 	}
 	symlinks = append(symlinks, dmLinkPath)
 
-	if strings.HasPrefix(info.UUID, "LVM-") {
+	if lvmLinkPath, ok := lvmDeviceLink(info.Name, info.UUID); ok {
 		// for LVM there is a special case - add /dev/VG/LG symlink
-		lvmLinkPath := "/dev/" + strings.ReplaceAll(info.Name, "-", "/")
 		if err := os.MkdirAll(filepath.Dir(lvmLinkPath), 0o755); err != nil {
 			return err
 		}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/anatol/luks.go"
+)
+
+// unlockFunc tries to unlock the volume with one method e.g. TPM2 tokens. It sends the unlocked volume to the channel
+// and returns nil, or returns the reason why the method failed.
+type unlockFunc func(volumes chan *luks.Volume) error
+
+var (
+	// unlockOrder is the order of unlock methods specified with booster.unlock_order boot param.
+	// If it is empty then all the methods run concurrently.
+	unlockOrder []string
+
+	unlockOrderMethods = []string{unlockMethodTPM2, unlockMethodFido2, unlockMethodClevis, unlockMethodPassphrase, unlockMethodRecoveryKey}
+)
+
+// unlockOrderFido2Timeout is how long the ordered unlock waits for a matching security key before moving to the next method
+const unlockOrderFido2Timeout = 30 * time.Second
+
+func parseUnlockOrder(value string) ([]string, error) {
+	supported := make(set)
+	for _, m := range unlockOrderMethods {
+		supported[m] = true
+	}
+
+	var order []string
+	seen := make(set)
+	for _, m := range strings.Split(value, ",") {
+		if !supported[m] {
+			return nil, fmt.Errorf("unknown unlock method '%s', supported methods are %s", m, strings.Join(unlockOrderMethods, ","))
+		}
+		if seen[m] {
+			return nil, fmt.Errorf("unlock method %s is specified twice", m)
+		}
+		seen[m] = true
+		order = append(order, m)
+	}
+	return order, nil
+}
+
+func unlockOrderContains(method string) bool {
+	for _, m := range unlockOrder {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnlockFallbackError checks whether the failed method should be followed by the next one. Errors like TPM
+// dictionary attack lockout or a broken device are hard errors that abort the unlock process.
+func isUnlockFallbackError(err error) bool {
+	return err == nil || // the method gave up without an explicit error
+		errors.Is(err, errPCRPolicyMismatch) ||
+		errors.Is(err, luks.ErrPassphraseDoesNotMatch) ||
+		errors.Is(err, errFido2DeviceTimeout) ||
+		errors.Is(err, errFido2Interrupted) ||
+		errors.Is(err, errUnknownTokenType) ||
+		errors.Is(err, fs.ErrNotExist) // e.g. there is no TPM device
+}
+
+// unlockInOrder tries the unlock methods one by one in booster.unlock_order order
+func unlockInOrder(d luks.Device, methods map[string]unlockFunc, progress *unlockProgress) (*luks.Volume, error) {
+	info("%s: unlock order is %s", d.Path(), strings.Join(unlockOrder, ","))
+
+	listed := make(set)
+	for _, name := range unlockOrder {
+		listed[name] = true
+	}
+	for name := range methods {
+		if !listed[name] {
+			info("%s: unlock method %s is available but not listed in booster.unlock_order, ignoring it", d.Path(), name)
+		}
+	}
+
+	var tried []string
+	for _, name := range unlockOrder {
+		fn, ok := methods[name]
+		if !ok {
+			debug("%s: unlock method %s is not available for the volume, skipping", d.Path(), name)
+			continue
+		}
+		tried = append(tried, name)
+
+		info("%s: trying to unlock with %s", d.Path(), name)
+		volumes := make(chan *luks.Volume)
+		result := make(chan error, 1)
+		progress.start(name)
+		go func() { result <- fn(volumes) }()
+
+		select {
+		case v := <-volumes:
+			progress.finish(name)
+			info("%s: unlocked with %s", d.Path(), name)
+			return v, nil
+		case err := <-result:
+			progress.finish(name)
+			if !isUnlockFallbackError(err) {
+				return nil, fmt.Errorf("%s: unlocking with %s failed: %v", d.Path(), name, err)
+			}
+			if err == nil {
+				err = fmt.Errorf("the volume is not unlocked")
+			}
+			info("%s: %s: %v, trying the next method", d.Path(), name, err)
+		}
+	}
+
+	if len(tried) == 0 {
+		return nil, fmt.Errorf("%s: none of unlock methods %s is available for the volume", d.Path(), strings.Join(unlockOrder, ","))
+	}
+	return nil, fmt.Errorf("%s: none of unlock methods %s unlocked the volume", d.Path(), strings.Join(tried, ","))
+}
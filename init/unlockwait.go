@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anatol/luks.go"
+)
+
+// If all unlock methods are stuck (e.g. waiting for a security key touch or for a passphrase with nobody at the
+// console) booster reports what it is waiting for and gives up after unlockTimeout so a headless machine ends up
+// in the emergency shell instead of hanging silently. Typing at the console restarts the timeout.
+
+var (
+	unlockTimeout          = 30 * time.Minute // booster.unlock_timeout=, zero disables the timeout
+	unlockProgressInterval = time.Minute
+
+	lastUserInputMutex sync.Mutex
+	lastUserInput      time.Time
+
+	errUnlockTimeout = errors.New("unlock timeout")
+)
+
+// noteUserInput records user activity at the console
+func noteUserInput() {
+	lastUserInputMutex.Lock()
+	lastUserInput = time.Now()
+	lastUserInputMutex.Unlock()
+}
+
+func lastUserInputTime() time.Time {
+	lastUserInputMutex.Lock()
+	defer lastUserInputMutex.Unlock()
+	return lastUserInput
+}
+
+// unlockProgress tracks unlock methods that are still running for a volume
+type unlockProgress struct {
+	mutex   sync.Mutex
+	pending map[string]bool
+}
+
+func newUnlockProgress() *unlockProgress {
+	return &unlockProgress{pending: make(map[string]bool)}
+}
+
+func (p *unlockProgress) start(method string) {
+	p.mutex.Lock()
+	p.pending[method] = true
+	p.mutex.Unlock()
+}
+
+func (p *unlockProgress) finish(method string) {
+	p.mutex.Lock()
+	delete(p.pending, method)
+	p.mutex.Unlock()
+}
+
+func (p *unlockProgress) String() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.pending) == 0 {
+		return "none"
+	}
+	methods := make([]string, 0, len(p.pending))
+	for m := range p.pending {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ",")
+}
+
+type unlockResult struct {
+	volume *luks.Volume
+	err    error
+}
+
+// unlockDeadline returns the time when waiting for the volume should stop
+func unlockDeadline(start time.Time) time.Time {
+	if input := lastUserInputTime(); input.After(start) {
+		start = input
+	}
+	return start.Add(unlockTimeout)
+}
+
+// waitForUnlock waits for the unlock result and periodically reports the pending unlock methods
+func waitForUnlock(path string, results chan unlockResult, progress *unlockProgress) (*luks.Volume, error) {
+	start := time.Now()
+	ticker := time.NewTicker(unlockProgressInterval)
+	defer ticker.Stop()
+
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	if unlockTimeout != 0 {
+		timer = time.NewTimer(time.Until(unlockDeadline(start)))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		select {
+		case r := <-results:
+			return r.volume, r.err
+		case <-ticker.C:
+			info("still waiting for %s to be unlocked (%v), pending unlock methods: %s", path, time.Since(start).Round(time.Second), progress)
+		case <-timeout:
+			if deadline := unlockDeadline(start); time.Now().Before(deadline) {
+				// the user typed something meanwhile
+				timer.Reset(time.Until(deadline))
+				continue
+			}
+			return nil, fmt.Errorf("%w: %s has not been unlocked in %v, pending unlock methods: %s", errUnlockTimeout, path, unlockTimeout, progress)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anatol/luks.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitForUnlock(t *testing.T) {
+	defer func() { unlockTimeout = 30 * time.Minute }()
+	unlockTimeout = 200 * time.Millisecond
+
+	progress := newUnlockProgress()
+	progress.start("tpm2")
+	progress.start("passphrase")
+	progress.finish("tpm2")
+
+	results := make(chan unlockResult, 1)
+	start := time.Now()
+	_, err := waitForUnlock("/dev/sda2", results, progress)
+	require.ErrorIs(t, err, errUnlockTimeout)
+	require.Contains(t, err.Error(), "pending unlock methods: passphrase")
+	require.GreaterOrEqual(t, time.Since(start), unlockTimeout)
+
+	// user input restarts the timeout
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		noteUserInput()
+		time.Sleep(150 * time.Millisecond)
+		results <- unlockResult{volume: &luks.Volume{}}
+	}()
+	v, err := waitForUnlock("/dev/sda2", results, progress)
+	require.NoError(t, err)
+	require.NotNil(t, v)
+}
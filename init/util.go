@@ -17,6 +17,10 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// memZeroBytes overwrites the backing array of a slice that holds a secret (passphrase, pin, key material).
+// Go garbage collector does not move heap objects so wiping the array removes the secret from memory. But a secret
+// converted to string or appended beyond the slice capacity leaves copies that cannot be wiped, thus keep secrets in
+// []byte and wipe them right after use.
 func memZeroBytes(bytes []byte) {
 	for i := range bytes {
 		bytes[i] = 0
@@ -40,6 +44,24 @@ func macListContains(value net.HardwareAddr, list []net.HardwareAddr) bool {
 	return false
 }
 
+func stringListContains(value string, list []string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func intListContains(value int, list []int) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func normalizeModuleName(mod string) string {
 	return strings.ReplaceAll(mod, "-", "_")
 }
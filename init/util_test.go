@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -20,6 +21,39 @@ func TestMemZeroBytes(t *testing.T) {
 	}
 }
 
+func TestReadPasswordLine(t *testing.T) {
+	t.Parallel()
+
+	long := strings.Repeat("x", 200)
+	check := func(input, expected string) {
+		password, err := readPasswordLine(strings.NewReader(input))
+		require.NoError(t, err)
+		require.Equal(t, expected, string(password))
+	}
+
+	check("foo\n", "foo")
+	check("fooo\bbar\n", "foobar")
+	check(long+"\n", long)
+}
+
+func TestReadMaskedPasswordLine(t *testing.T) {
+	t.Parallel()
+
+	check := func(input, expected, echo string) {
+		var out strings.Builder
+		password, err := readMaskedPasswordLine(strings.NewReader(input), &out)
+		require.NoError(t, err)
+		require.Equal(t, expected, string(password))
+		require.Equal(t, echo, out.String())
+	}
+
+	check("foo\r", "foo", "***")
+	check("fooo\x7fbar\n", "foobar", "****\b \b***")
+	check("паро\bль\n", "парль", "****\b \b**")
+	check("abc\x15de\n", "de", "***\b \b\b \b\b \b**")
+	check("\x7fx\n", "x", "*")
+}
+
 func TestFixedArrayToString(t *testing.T) {
 	t.Parallel()
 
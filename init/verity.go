@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anatol/devmapper.go"
+)
+
+// dm-verity protected root filesystem. The boot params are the same as systemd-veritysetup-generator uses:
+// roothash=$HEX systemd.verity_root_data=$DATADEV systemd.verity_root_hash=$HASHDEV [systemd.verity_root_options=...]
+// The hash device is expected to have a superblock created by 'veritysetup format'. The verified device
+// is activated as /dev/mapper/root and mounted read-only.
+
+const verityRootName = "root"
+
+type verityRootConfig struct {
+	rootHash string
+	data     *deviceRef
+	hash     *deviceRef
+	options  []string // dm-verity target optional params
+
+	mutex      sync.Mutex
+	dataDevice *blkInfo
+	hashDevice *blkInfo
+	activated  bool
+}
+
+var verityRoot *verityRootConfig
+
+// veritySuperblock is the superblock that 'veritysetup format' writes to the beginning of the hash device
+type veritySuperblock struct {
+	hashType      uint32
+	algorithm     string
+	dataBlockSize uint32
+	hashBlockSize uint32
+	dataBlocks    uint64
+	salt          []byte
+}
+
+// systemd verity options to dm-verity target params
+var verityOptions = map[string]string{
+	"ignore-corruption":     "ignore_corruption",
+	"restart-on-corruption": "restart_on_corruption",
+	"panic-on-corruption":   "panic_on_corruption",
+	"ignore-zero-blocks":    "ignore_zero_blocks",
+	"check-at-most-once":    "check_at_most_once",
+}
+
+func getVerityRoot() *verityRootConfig {
+	if verityRoot == nil {
+		verityRoot = &verityRootConfig{}
+	}
+	return verityRoot
+}
+
+// parseVerityParam handles verity related boot params, it returns false if the param is not related to verity
+func parseVerityParam(key, value string) (bool, error) {
+	switch strings.TrimPrefix(key, "systemd.") {
+	case "roothash":
+		hash, err := hex.DecodeString(value)
+		if err != nil || len(hash) == 0 {
+			return true, fmt.Errorf("invalid root hash")
+		}
+		getVerityRoot().rootHash = value
+	case "verity_root_data":
+		ref, err := parseDeviceRef(value)
+		if err != nil {
+			return true, err
+		}
+		getVerityRoot().data = ref
+	case "verity_root_hash":
+		ref, err := parseDeviceRef(value)
+		if err != nil {
+			return true, err
+		}
+		getVerityRoot().hash = ref
+	case "verity_root_options":
+		var options []string
+		for _, o := range strings.Split(value, ",") {
+			opt, ok := verityOptions[o]
+			if !ok {
+				warning("verity option %s is not supported", o)
+				continue
+			}
+			options = append(options, opt)
+		}
+		getVerityRoot().options = options
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// validateVerityRoot checks that the verity params are complete and points root= to the verified device
+func validateVerityRoot() error {
+	if verityRoot == nil {
+		return nil
+	}
+	if verityRoot.rootHash == "" || verityRoot.data == nil || verityRoot.hash == nil {
+		return fmt.Errorf("roothash=, systemd.verity_root_data= and systemd.verity_root_hash= should be specified together")
+	}
+
+	dev := "/dev/mapper/" + verityRootName
+	if cmdRoot != nil && !(cmdRoot.format == refPath && cmdRoot.data.(string) == dev) {
+		// mounting the data device directly would bypass the verification
+		warning("roothash= is specified, root= is ignored and the verified device %s is used as root", dev)
+	}
+	cmdRoot = &deviceRef{refPath, dev}
+	return nil
+}
+
+func probeVerity(f *os.File) *blkInfo {
+	const (
+		superblockSize = 512
+		uuidOffset     = 16
+		uuidSize       = 16
+		saltOffset     = 88
+		saltMaxSize    = 256
+	)
+
+	sb := make([]byte, superblockSize)
+	if _, err := f.ReadAt(sb, 0); err != nil {
+		return nil
+	}
+	if !bytes.Equal(sb[0:8], []byte("verity\x00\x00")) || binary.LittleEndian.Uint32(sb[8:12]) != 1 {
+		return nil
+	}
+
+	saltSize := int(binary.LittleEndian.Uint16(sb[80:82]))
+	if saltSize > saltMaxSize {
+		return nil
+	}
+	data := veritySuperblock{
+		hashType:      binary.LittleEndian.Uint32(sb[12:16]),
+		algorithm:     string(bytes.TrimRight(sb[32:64], "\x00")),
+		dataBlockSize: binary.LittleEndian.Uint32(sb[64:68]),
+		hashBlockSize: binary.LittleEndian.Uint32(sb[68:72]),
+		dataBlocks:    binary.LittleEndian.Uint64(sb[72:80]),
+		salt:          sb[saltOffset : saltOffset+saltSize],
+	}
+	uuid := sb[uuidOffset : uuidOffset+uuidSize]
+
+	return &blkInfo{format: "verity", uuid: uuid, data: data}
+}
+
+// verityTable builds dm-verity table for the given data and hash devices
+func verityTable(dataDev, hashDev string, sb veritySuperblock, rootHash string, options []string) (devmapper.VerityTable, error) {
+	if sb.dataBlockSize%devmapper.SectorSize != 0 || sb.hashBlockSize%devmapper.SectorSize != 0 || sb.dataBlockSize == 0 || sb.hashBlockSize == 0 {
+		return devmapper.VerityTable{}, fmt.Errorf("invalid verity block size")
+	}
+	if sb.hashType > 1 {
+		return devmapper.VerityTable{}, fmt.Errorf("unsupported verity hash type %d", sb.hashType)
+	}
+
+	salt := "-"
+	if len(sb.salt) > 0 {
+		salt = hex.EncodeToString(sb.salt)
+	}
+	var params []string
+	if len(options) > 0 {
+		params = append([]string{strconv.Itoa(len(options))}, options...)
+	}
+
+	const superblockSize = 512
+	return devmapper.VerityTable{
+		Length:        sb.dataBlocks * uint64(sb.dataBlockSize) / devmapper.SectorSize,
+		HashType:      uint64(sb.hashType),
+		DataDevice:    dataDev,
+		HashDevice:    hashDev,
+		DataBlockSize: uint64(sb.dataBlockSize),
+		HashBlockSize: uint64(sb.hashBlockSize),
+		NumDataBlocks: sb.dataBlocks,
+		// the hash tree starts at the first hash block after the superblock
+		HashStartBlock: (superblockSize + uint64(sb.hashBlockSize) - 1) / uint64(sb.hashBlockSize),
+		Algorithm:      sb.algorithm,
+		Digest:         strings.ToLower(rootHash),
+		Salt:           salt,
+		Params:         params,
+	}, nil
+}
+
+// matchVerityDevices checks if the block device is the verity data or hash device and activates the verified root
+// once both of them are found
+func matchVerityDevices(blk *blkInfo) error {
+	if verityRoot == nil {
+		return nil
+	}
+
+	v := verityRoot
+	v.mutex.Lock()
+	if blk.matchesRef(v.data) {
+		info("%s is the verity data device", blk.path)
+		v.dataDevice = blk
+	}
+	if blk.matchesRef(v.hash) {
+		info("%s is the verity hash device", blk.path)
+		v.hashDevice = blk
+	}
+	if v.activated || v.dataDevice == nil || v.hashDevice == nil {
+		v.mutex.Unlock()
+		return nil
+	}
+	v.activated = true
+	data, hash := v.dataDevice, v.hashDevice
+	v.mutex.Unlock()
+
+	return activateVerityRoot(data, hash)
+}
+
+func activateVerityRoot(data, hash *blkInfo) error {
+	sb, ok := hash.data.(veritySuperblock)
+	if hash.format != "verity" || !ok {
+		return fmt.Errorf("%s does not have a verity superblock", hash.path)
+	}
+
+	table, err := verityTable(data.path, hash.path, sb, verityRoot.rootHash, verityRoot.options)
+	if err != nil {
+		return fmt.Errorf("%s: %v", hash.path, err)
+	}
+
+	modules := []string{"dm_verity"}
+	modules = append(modules, matchAlias("crypto_"+sb.algorithm)...)
+	wg := loadModules(modules...)
+	wg.Wait()
+
+	uuid := fmt.Sprintf("CRYPT-VERITY-%s-%s", strings.ReplaceAll(hash.uuid.toString(), "-", ""), verityRootName)
+	if err := devmapper.CreateAndLoad(verityRootName, uuid, devmapper.ReadOnlyFlag, table); err != nil {
+		return fmt.Errorf("unable to activate verity device: %v", err)
+	}
+	info("verity device /dev/mapper/%s is activated", verityRootName)
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anatol/devmapper.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeVerity(t *testing.T) {
+	sb := make([]byte, 4096)
+	copy(sb, "verity\x00\x00")
+	binary.LittleEndian.PutUint32(sb[8:], 1)  // version
+	binary.LittleEndian.PutUint32(sb[12:], 1) // hash type
+	copy(sb[16:], []byte{0x9c, 0x3a, 0x1e, 0x2f, 0x6b, 0x4d, 0x4e, 0x1a, 0x8f, 0x2c, 0x1d, 0x3e, 0x5a, 0x7b, 0x9c, 0x0d})
+	copy(sb[32:], "sha256")
+	binary.LittleEndian.PutUint32(sb[64:], 4096)
+	binary.LittleEndian.PutUint32(sb[68:], 4096)
+	binary.LittleEndian.PutUint64(sb[72:], 256)
+	binary.LittleEndian.PutUint16(sb[80:], 4)
+	copy(sb[88:], []byte{0xde, 0xad, 0xbe, 0xef})
+
+	path := filepath.Join(t.TempDir(), "hash.img")
+	require.NoError(t, os.WriteFile(path, sb, 0o600))
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	blk := probeVerity(f)
+	require.NotNil(t, blk)
+	require.Equal(t, "verity", blk.format)
+	require.Equal(t, "9c3a1e2f-6b4d-4e1a-8f2c-1d3e5a7b9c0d", blk.uuid.toString())
+	require.Equal(t, veritySuperblock{hashType: 1, algorithm: "sha256", dataBlockSize: 4096, hashBlockSize: 4096, dataBlocks: 256, salt: []byte{0xde, 0xad, 0xbe, 0xef}}, blk.data)
+
+	table, err := verityTable("/dev/sda2", "/dev/sda3", blk.data.(veritySuperblock), "4392712BA01368EF", []string{"restart_on_corruption"})
+	require.NoError(t, err)
+	require.Equal(t, devmapper.VerityTable{
+		Length:         2048,
+		HashType:       1,
+		DataDevice:     "/dev/sda2",
+		HashDevice:     "/dev/sda3",
+		DataBlockSize:  4096,
+		HashBlockSize:  4096,
+		NumDataBlocks:  256,
+		HashStartBlock: 1,
+		Algorithm:      "sha256",
+		Digest:         "4392712ba01368ef",
+		Salt:           "deadbeef",
+		Params:         []string{"1", "restart_on_corruption"},
+	}, table)
+
+	// not a verity superblock
+	copy(sb, "ext4")
+	require.NoError(t, os.WriteFile(path, sb, 0o600))
+	f2, err := os.Open(path)
+	require.NoError(t, err)
+	defer f2.Close()
+	require.Nil(t, probeVerity(f2))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// vlanConfig is an 802.1Q sub-interface specified with vlan=<name>:<parent> boot param or 'network.vlans' config option
+type vlanConfig struct {
+	name, parent string
+	id           int
+}
+
+// parseVlanParam parses dracut style vlan=<name>:<parent> param. The VLAN id is taken from the name that
+// follows one of the naming schemes: vlan0005, vlan5, eth0.0005 or eth0.5
+func parseVlanParam(value string) (*vlanConfig, error) {
+	name, parent, ok := strings.Cut(value, ":")
+	if !ok || name == "" || parent == "" {
+		return nil, fmt.Errorf("expected format is <name>:<parent>")
+	}
+
+	var idStr string
+	if i := strings.LastIndexByte(name, '.'); i != -1 {
+		idStr = name[i+1:]
+	} else if s, ok := strings.CutPrefix(name, "vlan"); ok {
+		idStr = s
+	} else {
+		return nil, fmt.Errorf("unable to get VLAN id from interface name %s, use vlan<id> or <iface>.<id> name", name)
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil || id < 1 || id > 4094 {
+		return nil, fmt.Errorf("invalid VLAN id in interface name %s", name)
+	}
+	return &vlanConfig{name: name, parent: parent, id: id}, nil
+}
+
+// addVlanParam adds the VLAN interface to the network config and makes sure it is configured at boot
+func addVlanParam(value string) error {
+	v, err := parseVlanParam(value)
+	if err != nil {
+		return err
+	}
+	if config.Network == nil {
+		// unless ip= says otherwise the VLAN interface is configured with DHCP
+		config.Network = &InitNetworkConfig{Dhcp: true, InterfaceNames: []string{v.name}}
+	}
+	config.Network.Vlans = append(config.Network.Vlans, value)
+	return nil
+}
+
+func vlanConfigs() ([]*vlanConfig, error) {
+	var vlans []*vlanConfig
+	for _, value := range config.Network.Vlans {
+		v, err := parseVlanParam(value)
+		if err != nil {
+			return nil, fmt.Errorf("vlan %s: %v", value, err)
+		}
+		vlans = append(vlans, v)
+	}
+	return vlans, nil
+}
+
+// isVlanParent checks whether the interface carries VLAN sub-interfaces
+func isVlanParent(ifname string) bool {
+	vlans, _ := vlanConfigs()
+	for _, v := range vlans {
+		if v.parent == ifname {
+			return true
+		}
+	}
+	return false
+}
+
+// setupVlans creates VLAN sub-interfaces on top of the given interface. The new interfaces
+// show up as udev events and get configured the same way as physical interfaces.
+func setupVlans(ifname string) error {
+	vlans, err := vlanConfigs()
+	if err != nil {
+		return err
+	}
+
+	var parent netlink.Link
+	for _, v := range vlans {
+		if v.parent != ifname {
+			continue
+		}
+		if parent == nil {
+			loadModules("8021q").Wait()
+
+			parent, err = netlink.LinkByName(ifname)
+			if err != nil {
+				return err
+			}
+			// tagged frames can be sent only if the parent interface is up
+			if err := netlink.LinkSetUp(parent); err != nil {
+				return err
+			}
+			initializedIfnames = append(initializedIfnames, ifname)
+		}
+
+		info("creating VLAN interface %s with id %d on top of %s", v.name, v.id, ifname)
+		vlan := &netlink.Vlan{
+			LinkAttrs: netlink.LinkAttrs{Name: v.name, ParentIndex: parent.Attrs().Index},
+			VlanId:    v.id,
+		}
+		if err := createLink(vlan); err != nil {
+			return fmt.Errorf("unable to create VLAN interface %s: %v", v.name, err)
+		}
+	}
+	return nil
+}
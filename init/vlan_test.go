@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVlanParam(t *testing.T) {
+	check := func(param string, expected *vlanConfig) {
+		v, err := parseVlanParam(param)
+		require.NoError(t, err)
+		require.Equal(t, expected, v)
+	}
+	check("vlan10:eth0", &vlanConfig{name: "vlan10", parent: "eth0", id: 10})
+	check("vlan0005:eth0", &vlanConfig{name: "vlan0005", parent: "eth0", id: 5})
+	check("eth0.0010:eth0", &vlanConfig{name: "eth0.0010", parent: "eth0", id: 10})
+	check("enp0s3.4094:enp0s3", &vlanConfig{name: "enp0s3.4094", parent: "enp0s3", id: 4094})
+
+	for _, p := range []string{"vlan10", "vlan10:", ":eth0", "mgmt:eth0", "vlan0:eth0", "eth0.4095:eth0", "vlanx:eth0"} {
+		_, err := parseVlanParam(p)
+		require.Error(t, err, p)
+	}
+}
+
+func TestParseParamsVlan(t *testing.T) {
+	config.Network = nil
+	defer func() { config.Network = nil }()
+
+	require.NoError(t, parseParams("vlan=vlan10:eth0"))
+	require.True(t, config.Network.Dhcp)
+	require.Equal(t, []string{"vlan10"}, config.Network.InterfaceNames)
+	require.Equal(t, []string{"vlan10:eth0"}, config.Network.Vlans)
+	require.True(t, isVlanParent("eth0"))
+	require.False(t, isVlanParent("vlan10"))
+
+	config.Network = nil
+	require.NoError(t, parseParams("ip=eth0.20:dhcp vlan=eth0.20:eth0 vlan=eth0.30:eth0"))
+	require.Equal(t, []string{"eth0.20"}, config.Network.InterfaceNames)
+	require.Equal(t, []string{"eth0.20:eth0", "eth0.30:eth0"}, config.Network.Vlans)
+
+	config.Network = nil
+	require.Error(t, parseParams("vlan=eth0"))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// wifiConfig specifies a WPA2-PSK or WPA3-SAE wireless network specified with booster.wifi= boot param
+type wifiConfig struct {
+	ssid, psk, ifname string
+}
+
+var (
+	wifi           *wifiConfig // non-nil if wireless network is requested
+	wpaSupplicant  *exec.Cmd
+	wpaConfigPath  = "/run/booster/wpa_supplicant.conf"
+	wpaSupplicants = []string{"/usr/bin/wpa_supplicant", "/usr/sbin/wpa_supplicant"}
+)
+
+// parseWifiParam parses booster.wifi=<ssid>:<psk>:<iface> boot param.
+// SSID and interface name cannot contain ':' while the passphrase can.
+func parseWifiParam(value string) (*wifiConfig, error) {
+	ssidEnd := strings.IndexByte(value, ':')
+	ifnameStart := strings.LastIndexByte(value, ':')
+	if ssidEnd == -1 || ssidEnd == ifnameStart {
+		return nil, fmt.Errorf("expected format is <ssid>:<psk>:<iface>")
+	}
+	c := &wifiConfig{
+		ssid:   value[:ssidEnd],
+		psk:    value[ssidEnd+1 : ifnameStart],
+		ifname: value[ifnameStart+1:],
+	}
+	if c.ssid == "" || c.ifname == "" {
+		return nil, fmt.Errorf("SSID and interface name should not be empty")
+	}
+	if !isRawPSK(c.psk) && (len(c.psk) < 8 || len(c.psk) > 63) {
+		return nil, fmt.Errorf("WPA passphrase should be 8..63 characters long or 64 hex digits")
+	}
+	return c, nil
+}
+
+// isRawPSK checks whether the psk is a 256-bit key in hex format rather than a passphrase
+func isRawPSK(psk string) bool {
+	if len(psk) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(psk)
+	return err == nil
+}
+
+// supplicantConfig generates wpa_supplicant configuration for the network
+func (c *wifiConfig) supplicantConfig() string {
+	var conf strings.Builder
+	// SSID is encoded as hex to avoid quoting issues
+	fmt.Fprintf(&conf, "network={\n\tssid=%s\n", hex.EncodeToString([]byte(c.ssid)))
+	if isRawPSK(c.psk) {
+		fmt.Fprintf(&conf, "\tpsk=%s\n\tkey_mgmt=WPA-PSK\n", c.psk)
+	} else {
+		// SAE (WPA3) works with the passphrase only, WPA3 networks also require management frame protection
+		fmt.Fprintf(&conf, "\tpsk=\"%s\"\n\tkey_mgmt=WPA-PSK SAE\n\tieee80211w=1\n", c.psk)
+	}
+	conf.WriteString("\tscan_ssid=1\n}\n")
+	return conf.String()
+}
+
+// configureWifi sets up network config for the wireless interface unless the network is already configured with ip= param
+func configureWifi(c *wifiConfig) {
+	if config.Network == nil {
+		config.Network = &InitNetworkConfig{Dhcp: true, InterfaceNames: []string{c.ifname}}
+	}
+	if len(config.Network.InterfaceNames) > 0 && !stringListContains(c.ifname, config.Network.InterfaceNames) {
+		config.Network.InterfaceNames = append(config.Network.InterfaceNames, c.ifname)
+	}
+	wifi = c
+}
+
+// startWpaSupplicant starts wpa_supplicant daemon that associates the interface with the wireless network.
+// Once associated the kernel reports a carrier for the interface and the network is configured the usual way.
+func startWpaSupplicant(c *wifiConfig) error {
+	if !config.EnableWifi {
+		return fmt.Errorf("wifi support is not enabled in the image, please add 'enable_wifi: true' to the generator config")
+	}
+
+	var binary string
+	for _, b := range wpaSupplicants {
+		if _, err := os.Stat(b); err == nil {
+			binary = b
+			break
+		}
+	}
+	if binary == "" {
+		return startNativeSupplicant(c)
+	}
+
+	if err := os.MkdirAll("/run/booster", 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(wpaConfigPath, []byte(c.supplicantConfig()), 0o600); err != nil {
+		return err
+	}
+
+	info("%s: connecting to wireless network '%s'", c.ifname, c.ssid)
+	wpaSupplicant = exec.Command(binary, "-i", c.ifname, "-c", wpaConfigPath, "-D", "nl80211,wext")
+	if verbosityLevel >= levelDebug {
+		wpaSupplicant.Stdout = os.Stdout
+		wpaSupplicant.Stderr = os.Stderr
+	}
+	if err := wpaSupplicant.Start(); err != nil {
+		wpaSupplicant = nil
+		return fmt.Errorf("wpa_supplicant: %v", err)
+	}
+	return nil
+}
+
+func stopWpaSupplicant() {
+	stopNativeSupplicant()
+	if wpaSupplicant == nil {
+		return
+	}
+	_ = wpaSupplicant.Process.Kill()
+	_ = wpaSupplicant.Wait()
+	_ = os.Remove(wpaConfigPath)
+}
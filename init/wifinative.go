@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/sys/unix"
+)
+
+// The built-in supplicant is used if wpa_supplicant is not present in the image. It supports WPA2-PSK networks
+// with CCMP cipher, the 4-way handshake is performed by booster. WPA3-SAE is supported only by the drivers that
+// implement SAE in firmware (NL80211_EXT_FEATURE_SAE_OFFLOAD).
+
+const (
+	ethPPae = 0x888e // EAPOL ethertype
+
+	rsnCipherCCMP = 0x000fac04
+	rsnAkmPSK     = 0x000fac02
+	rsnAkmSAE     = 0x000fac08
+
+	eapolKeyDescriptorRSN = 2
+	eapolKeyVersionAES    = 2 // HMAC-SHA1 MIC and AES key wrap
+	eapolKeyInfoVersion   = 0x0007
+	eapolKeyInfoPairwise  = 1 << 3
+	eapolKeyInfoInstall   = 1 << 6
+	eapolKeyInfoAck       = 1 << 7
+	eapolKeyInfoMic       = 1 << 8
+	eapolKeyInfoSecure    = 1 << 9
+	eapolKeyInfoEncrypted = 1 << 12
+
+	eapolHeaderSize    = 4
+	eapolKeyHeaderSize = 95
+
+	wifiAssociationTimeout = 15 * time.Second
+)
+
+// wpaRsnIE builds RSN information element that describes the security parameters used by the station
+func wpaRsnIE(akm uint32, mfp bool) []byte {
+	ie := []byte{0x30, 20, 1, 0}
+	ie = binary.BigEndian.AppendUint32(ie, rsnCipherCCMP) // group cipher
+	ie = append(ie, 1, 0)
+	ie = binary.BigEndian.AppendUint32(ie, rsnCipherCCMP) // pairwise cipher
+	ie = append(ie, 1, 0)
+	ie = binary.BigEndian.AppendUint32(ie, akm)
+	var caps byte
+	if mfp {
+		caps = 0xc0 // management frame protection capable and required
+	}
+	return append(ie, caps, 0)
+}
+
+// wpaPmk derives pairwise master key from the passphrase (IEEE 802.11 Annex J.4) or decodes a raw key
+func wpaPmk(ssid, psk string) []byte {
+	if isRawPSK(psk) {
+		pmk, _ := hex.DecodeString(psk)
+		return pmk
+	}
+	return pbkdf2.Key([]byte(psk), []byte(ssid), 4096, 32, sha1.New)
+}
+
+// wpaPrf is the PRF-SHA1 function from IEEE 802.11 section 12.7.1.2
+func wpaPrf(key []byte, label string, data []byte, size int) []byte {
+	var out []byte
+	for i := byte(0); len(out) < size; i++ {
+		h := hmac.New(sha1.New, key)
+		h.Write([]byte(label))
+		h.Write([]byte{0})
+		h.Write(data)
+		h.Write([]byte{i})
+		out = h.Sum(out)
+	}
+	return out[:size]
+}
+
+// wpaPtk derives pairwise transient key. For CCMP it consists of KCK (16 bytes), KEK (16 bytes) and TK (16 bytes).
+func wpaPtk(pmk []byte, aa, spa net.HardwareAddr, anonce, snonce []byte) []byte {
+	minmax := func(a, b []byte) []byte {
+		if bytes.Compare(a, b) > 0 {
+			a, b = b, a
+		}
+		return append(append([]byte(nil), a...), b...)
+	}
+	data := append(minmax(aa, spa), minmax(anonce, snonce)...)
+	return wpaPrf(pmk, "Pairwise key expansion", data, 48)
+}
+
+// aesKeyUnwrap implements AES key unwrap algorithm from RFC 3394
+func aesKeyUnwrap(kek, data []byte) ([]byte, error) {
+	if len(data)%8 != 0 || len(data) < 24 {
+		return nil, fmt.Errorf("invalid wrapped key length %d", len(data))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(data)/8 - 1
+	a := binary.BigEndian.Uint64(data[:8])
+	r := append([]byte(nil), data[8:]...)
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			binary.BigEndian.PutUint64(buf, a^uint64(n*j+i))
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Decrypt(buf, buf)
+			a = binary.BigEndian.Uint64(buf[:8])
+			copy(r[(i-1)*8:i*8], buf[8:])
+		}
+	}
+	if a != 0xa6a6a6a6a6a6a6a6 {
+		return nil, fmt.Errorf("key unwrap integrity check failed")
+	}
+	return r, nil
+}
+
+// findElement returns the first information element (or KDE) of the EAPOL-Key data or the beacon IEs accepted
+// by the match function. The returned element includes its type and length.
+func findElement(data []byte, match func(typ byte, el []byte) bool) ([]byte, error) {
+	for len(data) >= 2 {
+		typ, size := data[0], int(data[1])
+		if typ == 0xdd && size == 0 {
+			break // padding
+		}
+		if 2+size > len(data) {
+			return nil, fmt.Errorf("malformed key data")
+		}
+		if match(typ, data[2:2+size]) {
+			return data[:2+size], nil
+		}
+		data = data[2+size:]
+	}
+	return nil, nil
+}
+
+// findRsnIE finds RSN information element
+func findRsnIE(data []byte) ([]byte, error) {
+	return findElement(data, func(typ byte, el []byte) bool { return typ == 0x30 })
+}
+
+// parseGtkKde finds group temporal key in the EAPOL-Key data
+func parseGtkKde(data []byte) (int, []byte, error) {
+	// GTK KDE is OUI 00-0f-ac, data type 1 followed by key id and the key itself
+	kde, err := findElement(data, func(typ byte, el []byte) bool {
+		return typ == 0xdd && len(el) > 6 && bytes.Equal(el[:4], []byte{0x00, 0x0f, 0xac, 0x01})
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	if kde == nil {
+		return 0, nil, fmt.Errorf("no GTK in the key data")
+	}
+	return int(kde[6] & 0x3), append([]byte(nil), kde[8:]...), nil
+}
+
+// wpaHandshake is the supplicant side of WPA 4-way handshake (IEEE 802.11 section 12.7.6) and group key handshake
+type wpaHandshake struct {
+	pmk     []byte
+	spa     net.HardwareAddr // station address
+	aa      net.HardwareAddr // authenticator (access point) address
+	rsnIE   []byte
+	apRsnIE []byte // RSN IE advertised by the access point in its beacons
+	anonce  []byte
+	snonce  []byte
+	tptk    []byte // temporary PTK derived from message 1, it becomes the PTK once message 3 is verified
+	ptk     []byte
+
+	established bool // 4-way handshake is completed
+
+	replayCounter uint64
+	replaySeen    bool
+
+	gtkID  int
+	gtk    []byte
+	gtkRsc []byte
+}
+
+type wpaEvent int
+
+const (
+	wpaNone        wpaEvent = iota
+	wpaPairwiseKey          // 4-way handshake is completed, PTK and GTK need to be installed
+	wpaGroupKey             // group key is updated
+)
+
+func ptkKCK(ptk []byte) []byte { return ptk[:16] }
+func ptkKEK(ptk []byte) []byte { return ptk[16:32] }
+func ptkTK(ptk []byte) []byte  { return ptk[32:48] }
+
+// keyFrame builds EAPOL-Key frame, the MIC is computed with KCK of the given PTK
+func keyFrame(ptk []byte, keyInfo uint16, replay, nonce, data []byte) []byte {
+	f := make([]byte, eapolHeaderSize+eapolKeyHeaderSize, eapolHeaderSize+eapolKeyHeaderSize+len(data))
+	f[0] = 1 // 802.1X-2001
+	f[1] = 3 // EAPOL-Key
+	binary.BigEndian.PutUint16(f[2:4], uint16(eapolKeyHeaderSize+len(data)))
+	k := f[eapolHeaderSize:]
+	k[0] = eapolKeyDescriptorRSN
+	binary.BigEndian.PutUint16(k[1:3], keyInfo)
+	copy(k[5:13], replay)
+	copy(k[13:45], nonce)
+	binary.BigEndian.PutUint16(k[93:95], uint16(len(data)))
+	f = append(f, data...)
+	if keyInfo&eapolKeyInfoMic != 0 {
+		copy(k[77:93], eapolMic(ptk, f))
+	}
+	return f
+}
+
+func eapolMic(ptk, frame []byte) []byte {
+	m := hmac.New(sha1.New, ptkKCK(ptk))
+	m.Write(frame)
+	return m.Sum(nil)[:16]
+}
+
+// handleFrame processes EAPOL frame received from the access point and returns a reply that needs to be sent back
+func (h *wpaHandshake) handleFrame(frame []byte) ([]byte, wpaEvent, error) {
+	if len(frame) < eapolHeaderSize+eapolKeyHeaderSize || frame[1] != 3 {
+		return nil, wpaNone, nil // not an EAPOL-Key frame
+	}
+	if l := int(binary.BigEndian.Uint16(frame[2:4])); eapolHeaderSize+l <= len(frame) {
+		frame = frame[:eapolHeaderSize+l] // strip the padding
+	}
+	k := frame[eapolHeaderSize:]
+	if k[0] != eapolKeyDescriptorRSN {
+		return nil, wpaNone, fmt.Errorf("unsupported key descriptor %d", k[0])
+	}
+	keyInfo := binary.BigEndian.Uint16(k[1:3])
+	if keyInfo&eapolKeyInfoAck == 0 {
+		return nil, wpaNone, nil // all the frames sent by the authenticator have Ack bit set
+	}
+	if keyInfo&eapolKeyInfoVersion != eapolKeyVersionAES {
+		return nil, wpaNone, fmt.Errorf("unsupported key descriptor version %d, only CCMP networks are supported", keyInfo&eapolKeyInfoVersion)
+	}
+	replay := k[5:13]
+	nonce := k[13:45]
+	dataLen := int(binary.BigEndian.Uint16(k[93:95]))
+	if eapolKeyHeaderSize+dataLen > len(k) {
+		return nil, wpaNone, fmt.Errorf("truncated EAPOL-Key frame")
+	}
+	data := k[eapolKeyHeaderSize : eapolKeyHeaderSize+dataLen]
+
+	pairwise := keyInfo&eapolKeyInfoPairwise != 0
+	if keyInfo&eapolKeyInfoMic != 0 {
+		// message 3 is protected with the temporary PTK, the PTK in use is replaced only once its MIC is verified
+		ptk := h.ptk
+		if pairwise && !h.established {
+			ptk = h.tptk
+		}
+		if ptk == nil {
+			return nil, wpaNone, fmt.Errorf("unexpected EAPOL-Key frame with MIC")
+		}
+		received := append([]byte(nil), k[77:93]...)
+		zeroed := append([]byte(nil), frame...)
+		for i := range zeroed[eapolHeaderSize+77 : eapolHeaderSize+93] {
+			zeroed[eapolHeaderSize+77+i] = 0
+		}
+		if !hmac.Equal(received, eapolMic(ptk, zeroed)) {
+			// most likely the passphrase is wrong
+			return nil, wpaNone, fmt.Errorf("EAPOL-Key MIC verification failed, check the passphrase")
+		}
+		counter := binary.BigEndian.Uint64(replay)
+		if h.replaySeen && counter <= h.replayCounter {
+			return nil, wpaNone, nil // replayed frame
+		}
+		h.replayCounter, h.replaySeen = counter, true
+	}
+
+	switch {
+	case pairwise && keyInfo&eapolKeyInfoMic == 0:
+		// message 1 of 4-way handshake
+		if h.established {
+			// the frame has no MIC so anyone in range can send it, the established keys are never replaced by it
+			return nil, wpaNone, nil
+		}
+		h.anonce = append([]byte(nil), nonce...)
+		h.snonce = make([]byte, 32)
+		if _, err := rand.Read(h.snonce); err != nil {
+			return nil, wpaNone, err
+		}
+		h.tptk = wpaPtk(h.pmk, h.aa, h.spa, h.anonce, h.snonce)
+		return keyFrame(h.tptk, eapolKeyVersionAES|eapolKeyInfoPairwise|eapolKeyInfoMic, replay, h.snonce, h.rsnIE), wpaNone, nil
+	case pairwise:
+		// message 3 of 4-way handshake
+		if keyInfo&eapolKeyInfoInstall == 0 || keyInfo&eapolKeyInfoEncrypted == 0 {
+			return nil, wpaNone, fmt.Errorf("unexpected 4-way handshake message")
+		}
+		if !bytes.Equal(nonce, h.anonce) {
+			return nil, wpaNone, fmt.Errorf("ANonce changed during 4-way handshake")
+		}
+		msg4Info := uint16(eapolKeyVersionAES | eapolKeyInfoPairwise | eapolKeyInfoMic | eapolKeyInfoSecure)
+		if h.established {
+			// message 4 was lost and the access point retransmits message 3, the keys must not be reinstalled
+			return keyFrame(h.ptk, msg4Info, replay, nil, nil), wpaNone, nil
+		}
+
+		keyData, err := aesKeyUnwrap(ptkKEK(h.tptk), data)
+		if err != nil {
+			return nil, wpaNone, err
+		}
+		rsnIE, err := findRsnIE(keyData)
+		if err != nil {
+			return nil, wpaNone, err
+		}
+		if h.apRsnIE == nil || !bytes.Equal(rsnIE, h.apRsnIE) {
+			return nil, wpaNone, fmt.Errorf("RSN IE in 4-way handshake message 3 does not match the one advertised by the access point")
+		}
+		gtkID, gtk, err := parseGtkKde(keyData)
+		if err != nil {
+			return nil, wpaNone, err
+		}
+
+		h.ptk, h.tptk, h.established = h.tptk, nil, true
+		h.gtkID, h.gtk, h.gtkRsc = gtkID, gtk, append([]byte(nil), k[61:67]...)
+		return keyFrame(h.ptk, msg4Info, replay, nil, nil), wpaPairwiseKey, nil
+	case keyInfo&eapolKeyInfoMic != 0 && keyInfo&eapolKeyInfoEncrypted != 0:
+		// message 1 of group key handshake
+		keyData, err := aesKeyUnwrap(ptkKEK(h.ptk), data)
+		if err != nil {
+			return nil, wpaNone, err
+		}
+		gtkID, gtk, err := parseGtkKde(keyData)
+		if err != nil {
+			return nil, wpaNone, err
+		}
+		reply := keyFrame(h.ptk, eapolKeyVersionAES|eapolKeyInfoMic|eapolKeyInfoSecure, replay, nil, nil)
+		if gtkID == h.gtkID && bytes.Equal(gtk, h.gtk) {
+			// reinstalling the same key resets its receive sequence counter and lets replayed group frames in
+			return reply, wpaNone, nil
+		}
+		h.gtkID, h.gtk, h.gtkRsc = gtkID, gtk, append([]byte(nil), k[61:67]...)
+		return reply, wpaGroupKey, nil
+	default:
+		return nil, wpaNone, fmt.Errorf("unexpected EAPOL-Key frame, key info 0x%x", keyInfo)
+	}
+}
+
+// nl80211 is a generic netlink client for the kernel wireless configuration API
+type nl80211 struct {
+	family uint16
+}
+
+func newNl80211() (*nl80211, error) {
+	f, err := netlink.GenlFamilyGet("nl80211")
+	if err != nil {
+		return nil, fmt.Errorf("nl80211: %v", err)
+	}
+	return &nl80211{family: f.ID}, nil
+}
+
+func (n *nl80211) request(cmd uint8, flags int, attrs ...*nl.RtAttr) ([][]byte, error) {
+	req := nl.NewNetlinkRequest(int(n.family), unix.NLM_F_ACK|flags)
+	req.AddData(&nl.Genlmsg{Command: cmd})
+	for _, a := range attrs {
+		req.AddData(a)
+	}
+	return req.Execute(unix.NETLINK_GENERIC, 0)
+}
+
+// hasExtFeature checks whether the wireless device supports the given nl80211 extended feature
+func (n *nl80211) hasExtFeature(ifname string, feature int) bool {
+	data, err := os.ReadFile("/sys/class/net/" + ifname + "/phy80211/index")
+	if err != nil {
+		return false
+	}
+	wiphy, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return false
+	}
+	msgs, err := n.request(unix.NL80211_CMD_GET_WIPHY, unix.NLM_F_DUMP,
+		nl.NewRtAttr(unix.NL80211_ATTR_WIPHY, nl.Uint32Attr(uint32(wiphy))),
+		nl.NewRtAttr(unix.NL80211_ATTR_SPLIT_WIPHY_DUMP, nil))
+	if err != nil {
+		return false
+	}
+	for _, m := range msgs {
+		attrs, err := nl.ParseRouteAttr(m[nl.SizeofGenlmsg:])
+		if err != nil {
+			continue
+		}
+		for _, a := range attrs {
+			if a.Attr.Type == unix.NL80211_ATTR_EXT_FEATURES && feature/8 < len(a.Value) {
+				return a.Value[feature/8]&(1<<(feature%8)) != 0
+			}
+		}
+	}
+	return false
+}
+
+func (n *nl80211) connect(ifindex int, ssid string, sae bool, psk string) error {
+	akm, version := uint32(rsnAkmPSK), uint32(unix.NL80211_WPA_VERSION_2)
+	if sae {
+		akm, version = rsnAkmSAE, unix.NL80211_WPA_VERSION_3
+	}
+	attrs := []*nl.RtAttr{
+		nl.NewRtAttr(unix.NL80211_ATTR_IFINDEX, nl.Uint32Attr(uint32(ifindex))),
+		nl.NewRtAttr(unix.NL80211_ATTR_SSID, []byte(ssid)),
+		nl.NewRtAttr(unix.NL80211_ATTR_PRIVACY, nil),
+		nl.NewRtAttr(unix.NL80211_ATTR_WPA_VERSIONS, nl.Uint32Attr(version)),
+		nl.NewRtAttr(unix.NL80211_ATTR_CIPHER_SUITES_PAIRWISE, nl.Uint32Attr(rsnCipherCCMP)),
+		nl.NewRtAttr(unix.NL80211_ATTR_CIPHER_SUITE_GROUP, nl.Uint32Attr(rsnCipherCCMP)),
+		nl.NewRtAttr(unix.NL80211_ATTR_AKM_SUITES, nl.Uint32Attr(akm)),
+		nl.NewRtAttr(unix.NL80211_ATTR_IE, wpaRsnIE(akm, sae)),
+	}
+	if sae {
+		attrs = append(attrs,
+			nl.NewRtAttr(unix.NL80211_ATTR_SAE_PASSWORD, []byte(psk)),
+			nl.NewRtAttr(unix.NL80211_ATTR_USE_MFP, nl.Uint32Attr(unix.NL80211_MFP_REQUIRED)))
+	}
+	_, err := n.request(unix.NL80211_CMD_CONNECT, 0, attrs...)
+	return err
+}
+
+// bssRsnIE returns RSN information element the access point advertises in its beacons and probe responses
+func (n *nl80211) bssRsnIE(ifindex int, bssid net.HardwareAddr) ([]byte, error) {
+	msgs, err := n.request(unix.NL80211_CMD_GET_SCAN, unix.NLM_F_DUMP,
+		nl.NewRtAttr(unix.NL80211_ATTR_IFINDEX, nl.Uint32Attr(uint32(ifindex))))
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		attrs, err := nl.ParseRouteAttr(m[nl.SizeofGenlmsg:])
+		if err != nil {
+			continue
+		}
+		for _, a := range attrs {
+			if a.Attr.Type&^unix.NLA_F_NESTED != unix.NL80211_ATTR_BSS {
+				continue
+			}
+			bss, err := nl.ParseRouteAttr(a.Value)
+			if err != nil {
+				continue
+			}
+			var addr net.HardwareAddr
+			var ies []byte
+			for _, b := range bss {
+				switch b.Attr.Type {
+				case unix.NL80211_BSS_BSSID:
+					addr = b.Value
+				case unix.NL80211_BSS_INFORMATION_ELEMENTS:
+					ies = b.Value
+				}
+			}
+			if !bytes.Equal(addr, bssid) {
+				continue
+			}
+			ie, err := findRsnIE(ies)
+			if err != nil {
+				return nil, err
+			}
+			if ie == nil {
+				return nil, fmt.Errorf("access point %s does not advertise RSN IE", bssid)
+			}
+			return append([]byte(nil), ie...), nil
+		}
+	}
+	return nil, fmt.Errorf("access point %s is not found in the scan results", bssid)
+}
+
+func (n *nl80211) disconnect(ifindex int) error {
+	_, err := n.request(unix.NL80211_CMD_DISCONNECT, 0,
+		nl.NewRtAttr(unix.NL80211_ATTR_IFINDEX, nl.Uint32Attr(uint32(ifindex))),
+		nl.NewRtAttr(unix.NL80211_ATTR_REASON_CODE, nl.Uint16Attr(3))) // deauthenticated because the station is leaving
+	return err
+}
+
+// newKey installs a pairwise key (if mac is specified) or a group key
+func (n *nl80211) newKey(ifindex int, mac net.HardwareAddr, idx int, key, seq []byte) error {
+	attrs := []*nl.RtAttr{
+		nl.NewRtAttr(unix.NL80211_ATTR_IFINDEX, nl.Uint32Attr(uint32(ifindex))),
+		nl.NewRtAttr(unix.NL80211_ATTR_KEY_DATA, key),
+		nl.NewRtAttr(unix.NL80211_ATTR_KEY_IDX, nl.Uint8Attr(uint8(idx))),
+		nl.NewRtAttr(unix.NL80211_ATTR_KEY_CIPHER, nl.Uint32Attr(rsnCipherCCMP)),
+	}
+	if mac != nil {
+		attrs = append(attrs, nl.NewRtAttr(unix.NL80211_ATTR_MAC, mac))
+	}
+	if seq != nil {
+		attrs = append(attrs, nl.NewRtAttr(unix.NL80211_ATTR_KEY_SEQ, seq))
+	}
+	_, err := n.request(unix.NL80211_CMD_NEW_KEY, 0, attrs...)
+	return err
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// nativeSupplicant is the state of the built-in supplicant
+type nativeSupplicant struct {
+	nl      *nl80211
+	ifindex int
+	fd      int // EAPOL packet socket
+	h       *wpaHandshake
+}
+
+var wifiNative *nativeSupplicant
+
+// startNativeSupplicant associates the interface with the wireless network and completes the WPA handshake.
+// After that it keeps handling group key updates until the network is shut down.
+func startNativeSupplicant(c *wifiConfig) error {
+	link, err := netlink.LinkByName(c.ifname)
+	if err != nil {
+		return err
+	}
+	n, err := newNl80211()
+	if err != nil {
+		return err
+	}
+	// the interface needs to be up to scan and associate
+	if err := netlink.LinkSetUp(link); err != nil {
+		return err
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, int(htons(ethPPae)))
+	if err != nil {
+		return err
+	}
+	s := &nativeSupplicant{nl: n, ifindex: link.Attrs().Index, fd: fd}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(ethPPae), Ifindex: s.ifindex}); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1}); err != nil {
+		unix.Close(fd)
+		return err
+	}
+
+	info("%s: connecting to wireless network '%s' using built-in supplicant", c.ifname, c.ssid)
+	err = s.connectWpa2(c, link.Attrs().HardwareAddr)
+	if err != nil && !isRawPSK(c.psk) && n.hasExtFeature(c.ifname, unix.NL80211_EXT_FEATURE_SAE_OFFLOAD) {
+		debug("%s: WPA2 connection failed: %v, trying WPA3", c.ifname, err)
+		_ = n.disconnect(s.ifindex)
+		s.h = nil
+		// the driver performs SAE and 4-way handshake itself, the interface gets a carrier once it is connected
+		err = n.connect(s.ifindex, c.ssid, true, c.psk)
+	}
+	if err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("%s: unable to connect to wireless network '%s': %v", c.ifname, c.ssid, err)
+	}
+
+	wifiNative = s
+	go s.handleGroupRekeys()
+	return nil
+}
+
+func (s *nativeSupplicant) connectWpa2(c *wifiConfig, spa net.HardwareAddr) error {
+	s.h = &wpaHandshake{pmk: wpaPmk(c.ssid, c.psk), spa: spa, rsnIE: wpaRsnIE(rsnAkmPSK, false)}
+	if err := s.nl.connect(s.ifindex, c.ssid, false, ""); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2048)
+	deadline := time.Now().Add(wifiAssociationTimeout)
+	for time.Now().Before(deadline) {
+		n, from, err := unix.Recvfrom(s.fd, buf, 0)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if ll, ok := from.(*unix.SockaddrLinklayer); ok && s.h.aa == nil {
+			s.h.aa = append(net.HardwareAddr(nil), ll.Addr[:ll.Halen]...)
+			if s.h.apRsnIE, err = s.nl.bssRsnIE(s.ifindex, s.h.aa); err != nil {
+				return err
+			}
+		}
+		reply, ev, err := s.h.handleFrame(buf[:n])
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			if err := s.send(reply); err != nil {
+				return err
+			}
+		}
+		if ev == wpaPairwiseKey {
+			if err := s.nl.newKey(s.ifindex, s.h.aa, 0, ptkTK(s.h.ptk), nil); err != nil {
+				return fmt.Errorf("unable to install pairwise key: %v", err)
+			}
+			if err := s.installGroupKey(); err != nil {
+				return err
+			}
+			info("%s: WPA2 handshake with %s is completed", c.ifname, s.h.aa)
+			return nil
+		}
+	}
+	return fmt.Errorf("timeout waiting for WPA handshake, note that WPA3-only networks require wpa_supplicant in the image")
+}
+
+func (s *nativeSupplicant) send(frame []byte) error {
+	to := &unix.SockaddrLinklayer{Protocol: htons(ethPPae), Ifindex: s.ifindex, Halen: 6}
+	copy(to.Addr[:], s.h.aa)
+	return unix.Sendto(s.fd, frame, 0, to)
+}
+
+func (s *nativeSupplicant) installGroupKey() error {
+	if err := s.nl.newKey(s.ifindex, nil, s.h.gtkID, s.h.gtk, s.h.gtkRsc); err != nil {
+		return fmt.Errorf("unable to install group key: %v", err)
+	}
+	return nil
+}
+
+// handleGroupRekeys handles group key handshakes initiated by the access point
+func (s *nativeSupplicant) handleGroupRekeys() {
+	if s.h == nil {
+		return // WPA3 handshake is offloaded to the driver
+	}
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := unix.Recvfrom(s.fd, buf, 0)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			if err != syscall.EBADF {
+				debug("wifi: %v", err)
+			}
+			return
+		}
+		reply, ev, err := s.h.handleFrame(buf[:n])
+		if err != nil {
+			warning("wifi: %v", err)
+			continue
+		}
+		if reply != nil {
+			if err := s.send(reply); err != nil {
+				warning("wifi: %v", err)
+			}
+		}
+		if ev == wpaGroupKey {
+			if err := s.installGroupKey(); err != nil {
+				warning("wifi: %v", err)
+			}
+		}
+	}
+}
+
+func stopNativeSupplicant() {
+	if wifiNative == nil {
+		return
+	}
+	unix.Close(wifiNative.fd)
+	wifiNative = nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWpaPmk(t *testing.T) {
+	// IEEE 802.11 Annex J.4 test vector
+	require.Equal(t, "f42c6fc52df0ebef9ebb4b90b38a5f902e83fe1b135a70e23aed762e9710a12e", hex.EncodeToString(wpaPmk("IEEE", "password")))
+	require.Equal(t, "f42c6fc52df0ebef9ebb4b90b38a5f902e83fe1b135a70e23aed762e9710a12e", hex.EncodeToString(wpaPmk("other", "f42c6fc52df0ebef9ebb4b90b38a5f902e83fe1b135a70e23aed762e9710a12e")))
+}
+
+// aesKeyWrap is RFC 3394 key wrap used by the fake authenticator
+func aesKeyWrap(t *testing.T, kek, data []byte) []byte {
+	block, err := aes.NewCipher(kek)
+	require.NoError(t, err)
+	n := len(data) / 8
+	a := uint64(0xa6a6a6a6a6a6a6a6)
+	r := append([]byte(nil), data...)
+	buf := make([]byte, 16)
+	for j := 0; j <= 5; j++ {
+		for i := 1; i <= n; i++ {
+			binary.BigEndian.PutUint64(buf, a)
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Encrypt(buf, buf)
+			a = binary.BigEndian.Uint64(buf[:8]) ^ uint64(n*j+i)
+			copy(r[(i-1)*8:i*8], buf[8:])
+		}
+	}
+	return append(binary.BigEndian.AppendUint64(nil, a), r...)
+}
+
+func TestAesKeyUnwrap(t *testing.T) {
+	// RFC 3394 section 4.1 test vector
+	kek, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	wrapped, _ := hex.DecodeString("1fa68b0a8112b447aef34bd8fb5a7b829d3e862371d2cfe5")
+	key, err := aesKeyUnwrap(kek, wrapped)
+	require.NoError(t, err)
+	require.Equal(t, "00112233445566778899aabbccddeeff", hex.EncodeToString(key))
+	require.Equal(t, wrapped, aesKeyWrap(t, kek, key))
+
+	wrapped[0] ^= 1
+	_, err = aesKeyUnwrap(kek, wrapped)
+	require.Error(t, err)
+}
+
+func TestWpaHandshake(t *testing.T) {
+	aa, _ := net.ParseMAC("02:00:00:00:00:01")
+	spa, _ := net.ParseMAC("02:00:00:00:00:02")
+	pmk := wpaPmk("home", "passphrase")
+	apRsnIE := wpaRsnIE(rsnAkmPSK, false)
+	h := &wpaHandshake{pmk: pmk, spa: spa, aa: aa, rsnIE: wpaRsnIE(rsnAkmPSK, false), apRsnIE: apRsnIE}
+
+	// the authenticator side
+	anonce := make([]byte, 32)
+	anonce[31] = 7
+	replay := func(n uint64) []byte { return binary.BigEndian.AppendUint64(nil, n) }
+
+	msg1 := keyFrame(nil, eapolKeyVersionAES|eapolKeyInfoPairwise|eapolKeyInfoAck, replay(1), anonce, nil)
+	msg2, ev, err := h.handleFrame(msg1)
+	require.NoError(t, err)
+	require.Equal(t, wpaNone, ev)
+	require.Nil(t, h.ptk) // not used until message 3 is verified
+	snonce := msg2[eapolHeaderSize+13 : eapolHeaderSize+45]
+	require.Equal(t, h.rsnIE, msg2[eapolHeaderSize+eapolKeyHeaderSize:])
+
+	// the authenticator derives the same PTK and verifies message 2 MIC
+	ptk := wpaPtk(pmk, aa, spa, anonce, snonce)
+	require.Equal(t, h.tptk, ptk)
+	mic := append([]byte(nil), msg2[eapolHeaderSize+77:eapolHeaderSize+93]...)
+	zeroed := append([]byte(nil), msg2...)
+	copy(zeroed[eapolHeaderSize+77:eapolHeaderSize+93], make([]byte, 16))
+	require.Equal(t, eapolMic(ptk, zeroed), mic)
+
+	gtkKeyData := func(id byte, gtk []byte, rsnIE []byte) []byte {
+		kde := append([]byte{0xdd, 22, 0x00, 0x0f, 0xac, 0x01, id, 0x00}, gtk...)
+		keyData := append(append(append([]byte(nil), rsnIE...), kde...), 0xdd, 0) // padded to 8 bytes
+		return append(keyData, make([]byte, 8-len(keyData)%8)...)
+	}
+	msg3Info := uint16(eapolKeyVersionAES | eapolKeyInfoPairwise | eapolKeyInfoAck | eapolKeyInfoMic | eapolKeyInfoInstall | eapolKeyInfoSecure | eapolKeyInfoEncrypted)
+	msg3Frame := func(ptk []byte, counter uint64, keyData []byte) []byte {
+		msg3 := keyFrame(ptk, msg3Info, replay(counter), anonce, aesKeyWrap(t, ptkKEK(ptk), keyData))
+		copy(msg3[eapolHeaderSize+61:], []byte{5, 0, 0, 0, 0, 0}) // RSC
+		copy(msg3[eapolHeaderSize+77:eapolHeaderSize+93], make([]byte, 16))
+		copy(msg3[eapolHeaderSize+77:], eapolMic(ptk, msg3))
+		return msg3
+	}
+
+	// RSN IE that differs from the beacon one is a downgrade attempt
+	downgraded := wpaRsnIE(rsnAkmPSK, false)
+	downgraded[len(downgraded)-6] = 0x01 // different AKM
+	_, _, err = h.handleFrame(msg3Frame(ptk, 2, gtkKeyData(1, []byte("0123456789abcdef"), downgraded)))
+	require.ErrorContains(t, err, "RSN IE")
+	require.False(t, h.established)
+	require.Nil(t, h.ptk)
+
+	gtk := []byte("0123456789abcdef")
+	msg3 := msg3Frame(ptk, 3, gtkKeyData(1, gtk, apRsnIE))
+	msg4, ev, err := h.handleFrame(msg3)
+	require.NoError(t, err)
+	require.Equal(t, wpaPairwiseKey, ev)
+	require.True(t, h.established)
+	require.Equal(t, ptk, h.ptk)
+	require.Equal(t, gtk, h.gtk)
+	require.Equal(t, 1, h.gtkID)
+	require.Equal(t, []byte{5, 0, 0, 0, 0, 0}, h.gtkRsc)
+	require.Equal(t, uint16(eapolKeyVersionAES|eapolKeyInfoPairwise|eapolKeyInfoMic|eapolKeyInfoSecure), binary.BigEndian.Uint16(msg4[eapolHeaderSize+1:]))
+
+	// replayed message is ignored
+	reply, ev, err := h.handleFrame(msg3)
+	require.NoError(t, err)
+	require.Nil(t, reply)
+	require.Equal(t, wpaNone, ev)
+
+	// retransmitted message 3 is acknowledged but the keys are not reinstalled
+	reply, ev, err = h.handleFrame(msg3Frame(ptk, 4, gtkKeyData(1, gtk, apRsnIE)))
+	require.NoError(t, err)
+	require.NotNil(t, reply)
+	require.Equal(t, wpaNone, ev)
+
+	// message 1 injected after the handshake does not replace the keys
+	injected := make([]byte, 32)
+	injected[0] = 0xff
+	reply, ev, err = h.handleFrame(keyFrame(nil, eapolKeyVersionAES|eapolKeyInfoPairwise|eapolKeyInfoAck, replay(100), injected, nil))
+	require.NoError(t, err)
+	require.Nil(t, reply)
+	require.Equal(t, wpaNone, ev)
+	require.Equal(t, ptk, h.ptk)
+	require.Equal(t, anonce, h.anonce)
+
+	groupFrame := func(counter uint64, id byte, gtk []byte) []byte {
+		kde := append([]byte{0xdd, 22, 0x00, 0x0f, 0xac, 0x01, id, 0x00}, gtk...)
+		kde = append(kde, 0xdd, 0)
+		kde = append(kde, make([]byte, 8-len(kde)%8)...)
+		return keyFrame(ptk, eapolKeyVersionAES|eapolKeyInfoAck|eapolKeyInfoMic|eapolKeyInfoSecure|eapolKeyInfoEncrypted, replay(counter), nil, aesKeyWrap(t, ptkKEK(ptk), kde))
+	}
+
+	// group key update
+	gtk2 := []byte("fedcba9876543210")
+	reply, ev, err = h.handleFrame(groupFrame(5, 2, gtk2))
+	require.NoError(t, err)
+	require.Equal(t, wpaGroupKey, ev)
+	require.NotNil(t, reply)
+	require.Equal(t, gtk2, h.gtk)
+	require.Equal(t, 2, h.gtkID)
+
+	// the same group key is acknowledged but not reinstalled, reinstalling would reset its replay counter
+	reply, ev, err = h.handleFrame(groupFrame(6, 2, gtk2))
+	require.NoError(t, err)
+	require.Equal(t, wpaNone, ev)
+	require.NotNil(t, reply)
+
+	// wrong passphrase
+	h = &wpaHandshake{pmk: wpaPmk("home", "wrong passphrase"), spa: spa, aa: aa, rsnIE: wpaRsnIE(rsnAkmPSK, false), apRsnIE: apRsnIE}
+	_, _, err = h.handleFrame(msg1)
+	require.NoError(t, err)
+	_, _, err = h.handleFrame(msg3)
+	require.ErrorContains(t, err, "MIC verification failed")
+	require.Nil(t, h.ptk)
+}
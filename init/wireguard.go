@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// A WireGuard tunnel lets admins reach a machine behind NAT at boot time, e.g. to unlock its volumes over SSH.
+// The interface private key and the peers preshared keys are stored in the image encrypted, the encryption key
+// is sealed with the TPM of the machine the image is generated at.
+
+const (
+	wireguardDefaultIfname = "wg0"
+	wireguardKeyLen        = 32
+	wireguardGenlVersion   = 1
+)
+
+// endpointResolveTimeout is the maximum time to wait for the peer endpoints to resolve, DNS might be not ready yet
+var endpointResolveTimeout = 30 * time.Second
+
+func wireguardIfname() string {
+	if config.WireGuard.Interface != "" {
+		return config.WireGuard.Interface
+	}
+	return wireguardDefaultIfname
+}
+
+// isWireGuardInterface checks whether the interface is the tunnel configured by booster
+func isWireGuardInterface(ifname string) bool {
+	return config.WireGuard != nil && ifname == wireguardIfname()
+}
+
+// decryptWireGuardSecrets decrypts the interface private key and the peers preshared keys. The secrets are encrypted
+// with AES-GCM, the nonce is prepended to the ciphertext. A preshared key of zeros means the peer does not use one.
+func decryptWireGuardSecrets(key, encrypted []byte, numPeers int) (privateKey []byte, presharedKeys [][]byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(encrypted) < gcm.NonceSize() {
+		return nil, nil, fmt.Errorf("secrets are truncated")
+	}
+	plain, err := gcm.Open(nil, encrypted[:gcm.NonceSize()], encrypted[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(plain) != (1+numPeers)*wireguardKeyLen {
+		memZeroBytes(plain)
+		return nil, nil, fmt.Errorf("secrets have unexpected size %d", len(plain))
+	}
+
+	privateKey = plain[:wireguardKeyLen]
+	zero := make([]byte, wireguardKeyLen)
+	for i := 0; i < numPeers; i++ {
+		psk := plain[(1+i)*wireguardKeyLen : (2+i)*wireguardKeyLen]
+		if string(psk) == string(zero) {
+			psk = nil
+		}
+		presharedKeys = append(presharedKeys, psk)
+	}
+	return privateKey, presharedKeys, nil
+}
+
+// unsealWireGuardSecrets unseals the secrets encryption key with TPM and decrypts the secrets
+func unsealWireGuardSecrets(c *InitWireGuardConfig) (privateKey []byte, presharedKeys [][]byte, err error) {
+	tok, err := parseTPM2Token([]byte(c.SealedKey))
+	if err != nil {
+		return nil, nil, fmt.Errorf("sealed key: %v", err)
+	}
+	key, err := tpm2Unseal(tok, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer memZeroBytes(key)
+
+	encrypted, err := base64.StdEncoding.DecodeString(c.Secrets)
+	if err != nil {
+		return nil, nil, err
+	}
+	return decryptWireGuardSecrets(key, encrypted, len(c.Peers))
+}
+
+// wireguardSockaddr encodes the endpoint as struct sockaddr_in or sockaddr_in6 expected by the kernel
+func wireguardSockaddr(addr *net.UDPAddr) []byte {
+	var b []byte
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b = binary.LittleEndian.AppendUint16(b, unix.AF_INET)
+		b = binary.BigEndian.AppendUint16(b, uint16(addr.Port))
+		b = append(b, ip4...)
+		return append(b, make([]byte, 8)...)
+	}
+	b = binary.LittleEndian.AppendUint16(b, unix.AF_INET6)
+	b = binary.BigEndian.AppendUint16(b, uint16(addr.Port))
+	b = append(b, 0, 0, 0, 0) // flow info
+	b = append(b, addr.IP.To16()...)
+	return append(b, 0, 0, 0, 0) // scope id
+}
+
+// resolveEndpoint resolves the peer endpoint retrying till DNS gets configured
+func resolveEndpoint(endpoint string) (*net.UDPAddr, error) {
+	deadline := time.Now().Add(endpointResolveTimeout)
+	for {
+		addr, err := net.ResolveUDPAddr("udp", endpoint)
+		if err == nil {
+			return addr, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+		debug("wireguard: unable to resolve endpoint %s: %v", endpoint, err)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// wireguardDeviceAttrs creates WG_CMD_SET_DEVICE attributes that replace the device configuration
+func wireguardDeviceAttrs(ifname string, c *InitWireGuardConfig, privateKey []byte, presharedKeys [][]byte, endpoints []*net.UDPAddr) ([]*nl.RtAttr, error) {
+	attrs := []*nl.RtAttr{
+		nl.NewRtAttr(unix.WGDEVICE_A_IFNAME, nl.ZeroTerminated(ifname)),
+		nl.NewRtAttr(unix.WGDEVICE_A_PRIVATE_KEY, privateKey),
+		nl.NewRtAttr(unix.WGDEVICE_A_FLAGS, nl.Uint32Attr(unix.WGDEVICE_F_REPLACE_PEERS)),
+	}
+	if c.ListenPort != 0 {
+		attrs = append(attrs, nl.NewRtAttr(unix.WGDEVICE_A_LISTEN_PORT, nl.Uint16Attr(uint16(c.ListenPort))))
+	}
+
+	peers := nl.NewRtAttr(unix.WGDEVICE_A_PEERS|unix.NLA_F_NESTED, nil)
+	for i, p := range c.Peers {
+		publicKey, err := base64.StdEncoding.DecodeString(p.PublicKey)
+		if err != nil || len(publicKey) != wireguardKeyLen {
+			return nil, fmt.Errorf("invalid public key %s", p.PublicKey)
+		}
+
+		peer := peers.AddRtAttr(i|unix.NLA_F_NESTED, nil)
+		peer.AddRtAttr(unix.WGPEER_A_PUBLIC_KEY, publicKey)
+		peer.AddRtAttr(unix.WGPEER_A_FLAGS, nl.Uint32Attr(unix.WGPEER_F_REPLACE_ALLOWEDIPS))
+		if presharedKeys[i] != nil {
+			peer.AddRtAttr(unix.WGPEER_A_PRESHARED_KEY, presharedKeys[i])
+		}
+		if endpoints[i] != nil {
+			peer.AddRtAttr(unix.WGPEER_A_ENDPOINT, wireguardSockaddr(endpoints[i]))
+		}
+		if p.PersistentKeepalive != 0 {
+			peer.AddRtAttr(unix.WGPEER_A_PERSISTENT_KEEPALIVE_INTERVAL, nl.Uint16Attr(uint16(p.PersistentKeepalive)))
+		}
+
+		allowedIPs := peer.AddRtAttr(unix.WGPEER_A_ALLOWEDIPS|unix.NLA_F_NESTED, nil)
+		for j, a := range p.AllowedIPs {
+			_, ipnet, err := net.ParseCIDR(a)
+			if err != nil {
+				return nil, err
+			}
+			ones, _ := ipnet.Mask.Size()
+			family, ip := uint16(unix.AF_INET6), ipnet.IP.To16()
+			if ip4 := ipnet.IP.To4(); ip4 != nil {
+				family, ip = unix.AF_INET, ip4
+			}
+			allowedIP := allowedIPs.AddRtAttr(j|unix.NLA_F_NESTED, nil)
+			allowedIP.AddRtAttr(unix.WGALLOWEDIP_A_FAMILY, nl.Uint16Attr(family))
+			allowedIP.AddRtAttr(unix.WGALLOWEDIP_A_IPADDR, ip)
+			allowedIP.AddRtAttr(unix.WGALLOWEDIP_A_CIDR_MASK, nl.Uint8Attr(uint8(ones)))
+		}
+	}
+	return append(attrs, peers), nil
+}
+
+// setupWireGuard brings up the WireGuard interface once the network is configured
+func setupWireGuard() error {
+	<-networkReady
+
+	c := config.WireGuard
+	ifname := wireguardIfname()
+
+	privateKey, presharedKeys, err := unsealWireGuardSecrets(c)
+	if err != nil {
+		return fmt.Errorf("unable to unseal the keys: %v", err)
+	}
+	defer memZeroBytes(privateKey)
+	defer func() {
+		for _, psk := range presharedKeys {
+			memZeroBytes(psk)
+		}
+	}()
+
+	endpoints := make([]*net.UDPAddr, len(c.Peers))
+	for i, p := range c.Peers {
+		if p.Endpoint == "" {
+			continue
+		}
+		endpoints[i], err = resolveEndpoint(p.Endpoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	loadModules("wireguard").Wait()
+	info("creating WireGuard interface %s", ifname)
+	if err := createLink(&netlink.GenericLink{LinkAttrs: netlink.LinkAttrs{Name: ifname}, LinkType: "wireguard"}); err != nil {
+		return fmt.Errorf("unable to create interface %s: %v", ifname, err)
+	}
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return err
+	}
+
+	attrs, err := wireguardDeviceAttrs(ifname, c, privateKey, presharedKeys, endpoints)
+	if err != nil {
+		return err
+	}
+	family, err := netlink.GenlFamilyGet("wireguard")
+	if err != nil {
+		return err
+	}
+	req := nl.NewNetlinkRequest(int(family.ID), unix.NLM_F_ACK)
+	req.AddData(&nl.Genlmsg{Command: unix.WG_CMD_SET_DEVICE, Version: wireguardGenlVersion})
+	for _, a := range attrs {
+		req.AddData(a)
+	}
+	if _, err := req.Execute(unix.NETLINK_GENERIC, 0); err != nil {
+		return fmt.Errorf("unable to configure interface %s: %v", ifname, err)
+	}
+
+	for _, a := range c.Addresses {
+		addr, err := netlink.ParseAddr(a)
+		if err != nil {
+			return err
+		}
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return fmt.Errorf("unable to add address %s to %s: %v", a, ifname, err)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return err
+	}
+
+	// traffic to the allowed IPs of the peers goes through the tunnel
+	for _, p := range c.Peers {
+		for _, a := range p.AllowedIPs {
+			_, dst, err := net.ParseCIDR(a)
+			if err != nil {
+				return err
+			}
+			route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Scope: netlink.SCOPE_LINK}
+			if err := netlink.RouteAdd(route); err != nil && !errors.Is(err, unix.EEXIST) {
+				return fmt.Errorf("unable to add route %s via %s: %v", a, ifname, err)
+			}
+		}
+	}
+
+	info("WireGuard interface %s is up", ifname)
+	return nil
+}
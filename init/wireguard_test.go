@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+func encryptTestSecrets(t *testing.T, key, plain []byte) []byte {
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	require.NoError(t, err)
+	return gcm.Seal(nonce, nonce, plain, nil)
+}
+
+func TestDecryptWireGuardSecrets(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	privateKey := make([]byte, wireguardKeyLen)
+	psk := make([]byte, wireguardKeyLen)
+	for i := range privateKey {
+		privateKey[i] = byte(i + 1)
+		psk[i] = byte(100 + i)
+	}
+	var plain []byte
+	plain = append(plain, privateKey...)
+	plain = append(plain, psk...)
+	plain = append(plain, make([]byte, wireguardKeyLen)...) // the second peer has no preshared key
+	encrypted := encryptTestSecrets(t, key, plain)
+
+	gotKey, gotPsks, err := decryptWireGuardSecrets(key, encrypted, 2)
+	require.NoError(t, err)
+	require.Equal(t, privateKey, gotKey)
+	require.Equal(t, [][]byte{psk, nil}, gotPsks)
+
+	_, _, err = decryptWireGuardSecrets(key, encrypted, 1)
+	require.Error(t, err)
+
+	encrypted[len(encrypted)-1] ^= 1
+	_, _, err = decryptWireGuardSecrets(key, encrypted, 2)
+	require.Error(t, err)
+}
+
+func TestWireGuardSockaddr(t *testing.T) {
+	require.Equal(t, []byte{2, 0, 0xca, 0x6c, 192, 0, 2, 1, 0, 0, 0, 0, 0, 0, 0, 0},
+		wireguardSockaddr(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820}))
+
+	sa := wireguardSockaddr(&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51820})
+	require.Len(t, sa, 28)
+	require.Equal(t, []byte{10, 0, 0xca, 0x6c, 0, 0, 0, 0}, sa[:8])
+	require.Equal(t, []byte(net.ParseIP("2001:db8::1")), sa[8:24])
+}
+
+func TestWireGuardDeviceAttrs(t *testing.T) {
+	publicKey := make([]byte, wireguardKeyLen)
+	publicKey[0] = 1
+	c := &InitWireGuardConfig{
+		ListenPort: 51820,
+		Peers: []InitWireGuardPeer{{
+			PublicKey:           base64.StdEncoding.EncodeToString(publicKey),
+			AllowedIPs:          []string{"10.100.0.0/24", "fd00::/64"},
+			PersistentKeepalive: 25,
+		}},
+	}
+	endpoint := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820}
+	attrs, err := wireguardDeviceAttrs("wg0", c, make([]byte, wireguardKeyLen), [][]byte{nil}, []*net.UDPAddr{endpoint})
+	require.NoError(t, err)
+
+	types := make(map[uint16][]byte)
+	for _, a := range attrs {
+		types[a.Type] = a.Serialize()
+	}
+	require.Contains(t, types, uint16(unix.WGDEVICE_A_LISTEN_PORT))
+	peers, ok := types[unix.WGDEVICE_A_PEERS|unix.NLA_F_NESTED]
+	require.True(t, ok)
+
+	// peers -> peer -> attributes
+	parsed, err := nl.ParseRouteAttr(peers[unix.SizeofRtAttr:])
+	require.NoError(t, err)
+	require.Len(t, parsed, 1)
+	peerAttrs, err := nl.ParseRouteAttr(parsed[0].Value)
+	require.NoError(t, err)
+	peer := make(map[uint16][]byte)
+	for _, a := range peerAttrs {
+		peer[a.Attr.Type] = a.Value
+	}
+	require.Equal(t, publicKey, peer[unix.WGPEER_A_PUBLIC_KEY])
+	require.Equal(t, wireguardSockaddr(endpoint), peer[unix.WGPEER_A_ENDPOINT])
+	require.NotContains(t, peer, uint16(unix.WGPEER_A_PRESHARED_KEY))
+	allowedIPs, err := nl.ParseRouteAttr(peer[unix.WGPEER_A_ALLOWEDIPS|unix.NLA_F_NESTED])
+	require.NoError(t, err)
+	require.Len(t, allowedIPs, 2)
+
+	c.Peers[0].PublicKey = "invalid"
+	_, err = wireguardDeviceAttrs("wg0", c, make([]byte, wireguardKeyLen), [][]byte{nil}, []*net.UDPAddr{endpoint})
+	require.Error(t, err)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ZFS root dataset is specified either with zfs=$POOL/$DATASET or with root=ZFS=$POOL/$DATASET (root=zfs:$POOL/$DATASET)
+// the same way as ZFS dracut module does. The pool is imported with zpool tool, keys of encrypted datasets are loaded
+// with a passphrase entered at the console.
+
+// parseZfsRootParam returns the dataset if root= param points to a ZFS dataset
+func parseZfsRootParam(value string) (string, bool) {
+	for _, prefix := range []string{"ZFS=", "zfs:"} {
+		if dataset, ok := strings.CutPrefix(value, prefix); ok {
+			return dataset, true
+		}
+	}
+	return "", false
+}
+
+type zfsDatasetInfo struct {
+	name           string
+	mountpoint     string
+	canmount       string
+	encryptionRoot string // "-" if the dataset is not encrypted
+	keyStatus      string
+}
+
+// parseZfsDatasets parses output of 'zfs list -H -o name,mountpoint,canmount,encryptionroot,keystatus'
+func parseZfsDatasets(out string) ([]zfsDatasetInfo, error) {
+	var datasets []zfsDatasetInfo
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("unexpected zfs list output: %s", line)
+		}
+		datasets = append(datasets, zfsDatasetInfo{
+			name:           fields[0],
+			mountpoint:     fields[1],
+			canmount:       fields[2],
+			encryptionRoot: fields[3],
+			keyStatus:      fields[4],
+		})
+	}
+	return datasets, nil
+}
+
+func listZfsDatasets(dataset string) ([]zfsDatasetInfo, error) {
+	out, err := exec.Command("zfs", "list", "-H", "-o", "name,mountpoint,canmount,encryptionroot,keystatus", "-t", "filesystem", "-r", dataset).Output()
+	if err != nil {
+		return nil, unwrapExitError(err)
+	}
+	return parseZfsDatasets(string(out))
+}
+
+// zfsLockedEncryptionRoots returns encryption roots which keys are not loaded yet. Note that the encryption root
+// might be a parent of the root dataset.
+func zfsLockedEncryptionRoots(datasets []zfsDatasetInfo) []string {
+	var roots []string
+	seen := make(map[string]bool)
+	for _, ds := range datasets {
+		if ds.encryptionRoot == "-" || ds.keyStatus != "unavailable" || seen[ds.encryptionRoot] {
+			continue
+		}
+		seen[ds.encryptionRoot] = true
+		roots = append(roots, ds.encryptionRoot)
+	}
+	return roots
+}
+
+func zfsLoadKey(encryptionRoot string, passphrase []byte) error {
+	cmd := exec.Command("zfs", "load-key", encryptionRoot)
+	if passphrase != nil {
+		// do not copy the passphrase to the memory that is not wiped
+		cmd.Stdin = io.MultiReader(bytes.NewReader(passphrase), strings.NewReader("\n"))
+	}
+	return unwrapExitError(cmd.Run())
+}
+
+// unlockZfsEncryptionRoot loads the key of the encryption root, the passphrase is asked at the console
+func unlockZfsEncryptionRoot(encryptionRoot string) error {
+	out, err := exec.Command("zfs", "get", "-H", "-o", "value", "keylocation", encryptionRoot).Output()
+	if err != nil {
+		return unwrapExitError(err)
+	}
+	if keyLocation := strings.TrimSpace(string(out)); keyLocation != "prompt" {
+		// e.g. file:///etc/zfs/root.key added to the image with extra_files
+		return zfsLoadKey(encryptionRoot, nil)
+	}
+
+	passphrasePromptMutex.Lock()
+	defer passphrasePromptMutex.Unlock()
+
+	passphraseCacheMutex.Lock()
+	if passphraseCache != nil && zfsLoadKey(encryptionRoot, passphraseCache) == nil {
+		passphraseCacheMutex.Unlock()
+		info("ZFS dataset %s is unlocked with the passphrase of the previous volume", encryptionRoot)
+		return nil
+	}
+	passphraseCacheMutex.Unlock()
+
+	attempts := passwordAttempts{name: "ZFS dataset " + encryptionRoot}
+	for {
+		password, err := attempts.read(fmt.Sprintf("Enter passphrase for %s:", attempts.name))
+		if err != nil {
+			return err
+		}
+
+		err = zfsLoadKey(encryptionRoot, password)
+		if err == nil {
+			cachePassphrase(password)
+			memZeroBytes(password)
+			return nil
+		}
+		memZeroBytes(password)
+		debug("zfs load-key %s: %v", encryptionRoot, err)
+
+		if err := attempts.fail("   Incorrect passphrase"); err != nil {
+			return err
+		}
+	}
+}
+
+func mountZfsRoot() error {
+	// note that 'zfs' module already in modulesForceLoad list and it already started loading
+	// this loadModule() is for zfs module synchronization - we need to wait till the full module loading
+	// before we try to import a pool
+	zfsWg := loadModules("zfs")
+	zfsWg.Wait()
+
+	// TODO: handle zfsDataset == bootfs
+	parts := strings.Split(zfsDataset, "/")
+	pool := parts[0]
+
+	debug("importing zfs pool %s", pool)
+
+	err := exec.Command("zpool", "import", "-c", "/etc/zfs/zpool.cache", "-N", pool).Run()
+	if err != nil {
+		return unwrapExitError(err)
+	}
+
+	// find the root dataset and all its child datasets
+	datasets, err := listZfsDatasets(zfsDataset)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range zfsLockedEncryptionRoots(datasets) {
+		if err := unlockZfsEncryptionRoot(r); err != nil {
+			return fmt.Errorf("unable to load key for ZFS dataset %s: %v", r, err)
+		}
+	}
+
+	flags, options := mountFlags()
+	rootMountpoint := "/"
+	for _, ds := range datasets {
+		var target string
+		if ds.name == zfsDataset {
+			// the root dataset is mounted even if it is not mounted automatically (e.g. a boot environment with canmount=noauto)
+			if ds.mountpoint != "none" && ds.mountpoint != "legacy" {
+				rootMountpoint = ds.mountpoint
+			}
+			target = newRoot
+		} else {
+			if ds.canmount != "on" || ds.mountpoint == "none" || ds.mountpoint == "legacy" {
+				continue
+			}
+			rel, err := filepath.Rel(rootMountpoint, ds.mountpoint)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				debug("ZFS dataset %s is mounted outside of the root dataset, skip it", ds.name)
+				continue
+			}
+			target = filepath.Join(newRoot, rel)
+		}
+
+		mountOptions := options
+		if ds.mountpoint != "legacy" {
+			// datasets with a mountpoint property can be mounted only by zfs tools
+			mountOptions = strings.Join([]string{"zfsutil", options}, ",")
+		}
+		if err := mount(ds.name, target, "zfs", flags, mountOptions); err != nil {
+			return err
+		}
+	}
+
+	rootMounted.Done()
+
+	return nil
+}
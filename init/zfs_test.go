@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseZfsRootParam(t *testing.T) {
+	ds, ok := parseZfsRootParam("ZFS=rpool/ROOT/arch")
+	require.True(t, ok)
+	require.Equal(t, "rpool/ROOT/arch", ds)
+	ds, ok = parseZfsRootParam("zfs:rpool/ROOT/arch")
+	require.True(t, ok)
+	require.Equal(t, "rpool/ROOT/arch", ds)
+	_, ok = parseZfsRootParam("UUID=98b1a905-3c72-42f0-957a-6c23b303b1fd")
+	require.False(t, ok)
+}
+
+func TestZfsLockedEncryptionRoots(t *testing.T) {
+	out := "rpool/ROOT/arch\t/\tnoauto\trpool/ROOT\tunavailable\n" +
+		"rpool/ROOT/arch/var\t/var\ton\trpool/ROOT\tunavailable\n" +
+		"rpool/ROOT/arch/home\t/home\ton\trpool/ROOT/arch/home\tunavailable\n" +
+		"rpool/ROOT/arch/tmp\t/tmp\ton\t-\t-\n" +
+		"rpool/ROOT/arch/srv\t/srv\ton\trpool/ROOT/arch/srv\tavailable\n"
+	datasets, err := parseZfsDatasets(out)
+	require.NoError(t, err)
+	require.Len(t, datasets, 5)
+	require.Equal(t, zfsDatasetInfo{name: "rpool/ROOT/arch", mountpoint: "/", canmount: "noauto", encryptionRoot: "rpool/ROOT", keyStatus: "unavailable"}, datasets[0])
+
+	require.Equal(t, []string{"rpool/ROOT", "rpool/ROOT/arch/home"}, zfsLockedEncryptionRoots(datasets))
+
+	_, err = parseZfsDatasets("rpool\t/\n")
+	require.Error(t, err)
+}
@@ -57,3 +57,29 @@ func TestMdRaid5UUID(t *testing.T) {
 
 	require.NoError(t, vm.ConsoleExpect("Hello, booster!"))
 }
+
+func TestMdRaid1Native(t *testing.T) {
+	vm, err := buildVmInstance(t, Opts{
+		enableMdraid: true,
+		mdraidNative: true,
+		disk:         "assets/mdraid_raid1.img",
+		kernelArgs:   []string{"root=/dev/md/BoosterTestArray1"},
+	})
+	require.NoError(t, err)
+	defer vm.Shutdown()
+
+	require.NoError(t, vm.ConsoleExpect("Hello, booster!"))
+}
+
+func TestMdRaid5Native(t *testing.T) {
+	vm, err := buildVmInstance(t, Opts{
+		enableMdraid: true,
+		mdraidNative: true,
+		disk:         "assets/mdraid_raid5.img",
+		kernelArgs:   []string{"root=UUID=e62c7dc0-5728-4571-b475-7745de2eef1e"},
+	})
+	require.NoError(t, err)
+	defer vm.Shutdown()
+
+	require.NoError(t, vm.ConsoleExpect("Hello, booster!"))
+}
@@ -243,6 +243,7 @@ type GeneratorConfig struct {
 	EnableLVM            bool           `yaml:"enable_lvm"`
 	EnableMdraid         bool           `yaml:"enable_mdraid"`
 	MdraidConfigPath     string         `yaml:"mdraid_config_path"`
+	MdraidNative         bool           `yaml:"mdraid_native,omitempty"`
 	EnableZfs            bool           `yaml:"enable_zfs"`
 	ZfsImportParams      string         `yaml:"zfs_import_params"`
 	ZfsCachePath         string         `yaml:"zfs_cache_path"`
@@ -273,6 +274,7 @@ func generateBoosterConfig(output string, opts Opts) error {
 	conf.EnableLVM = opts.enableLVM
 	conf.EnableMdraid = opts.enableMdraid
 	conf.MdraidConfigPath = opts.mdraidConf
+	conf.MdraidNative = opts.mdraidNative
 	conf.EnableZfs = opts.enableZfs
 	conf.ZfsImportParams = opts.zfsImportParams
 	conf.ZfsCachePath = opts.zfsCachePath
@@ -314,6 +316,7 @@ type Opts struct {
 	enableLVM            bool
 	enableMdraid         bool
 	mdraidConf           string
+	mdraidNative         bool
 	enableZfs            bool
 	zfsImportParams      string
 	zfsCachePath         string // TODO: do we need any of these parameters?